@@ -0,0 +1,237 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ---- Agent check-in & step reporting ----
+// The richer protocol for the WinPE agent on top of task runs. The agent
+// checks in with POST /api/v1/agent/checkin and gets its run, the whole
+// sequence with each step's status, and the step to run next (204 when there
+// is nothing to do). It then reports /api/v1/agent/step/start, streams the
+// step's stdout in chunks to /api/v1/agent/step/output and closes the step
+// with /api/v1/agent/step/result, which moves the run and its deployment on
+// exactly like /api/v1/tasks/report. Output is kept per step, the last
+// BOOTAH_STEP_OUTPUT_MAX characters (default 65536) of it. Operators see the
+// steps of a run or deployment at /api/v1/admin/task_runs/steps.
+type TaskStepStatus struct {
+	Index      int    `json:"index"`
+	Name       string `json:"name"`
+	Type       string `json:"type,omitempty"`
+	Status     string `json:"status"` // pending, running, succeeded, failed, skipped
+	StartedAt  string `json:"started_at,omitempty"`
+	FinishedAt string `json:"finished_at,omitempty"`
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	Detail     string `json:"detail,omitempty"`
+	Output     string `json:"output,omitempty"`
+}
+
+func initTaskSteps(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS task_steps (
+		run_id TEXT NOT NULL,
+		idx INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		status TEXT NOT NULL,
+		started_at TEXT,
+		finished_at TEXT,
+		exit_code INTEGER,
+		detail TEXT,
+		output TEXT,
+		PRIMARY KEY (run_id, idx)
+	)`)
+	return err
+}
+
+func stepOutputMax() int {
+	n, err := strconv.Atoi(getenv("BOOTAH_STEP_OUTPUT_MAX", "65536"))
+	if err != nil || n <= 0 { return 65536 }
+	return n
+}
+
+// startTaskStep marks step i of a run as running; starting it again (an
+// agent retrying after a reboot) restarts it with empty output.
+func (s *Server) startTaskStep(run *TaskRun, i int, name string) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	_, err := s.DB.Exec(`INSERT INTO task_steps (run_id, idx, name, status, started_at) VALUES (?,?,?,'running',?)
+		ON CONFLICT(run_id, idx) DO UPDATE SET name=excluded.name, status='running', started_at=excluded.started_at, finished_at=NULL, exit_code=NULL, detail=NULL, output=NULL`,
+		run.ID, i, name, now)
+	if err != nil { return err }
+	_, _ = s.DB.Exec(`UPDATE task_runs SET updated_at=? WHERE id=?`, now, run.ID)
+	s.emit("task_step.started", map[string]any{"run_id": run.ID, "mac": run.MAC, "deployment_id": run.DeploymentID, "index": i, "step": name})
+	return nil
+}
+
+// appendStepOutput adds a chunk of output to step i, keeping the tail.
+func (s *Server) appendStepOutput(runID string, i int, name, chunk string) error {
+	tail := "substr(%s, -?)"
+	if dbDriver == "postgres" { tail = "right(%s, ?)" }
+	_, err := s.DB.Exec(`INSERT INTO task_steps (run_id, idx, name, status, started_at, output) VALUES (?,?,?,'running',?,`+fmt.Sprintf(tail, "?")+`)
+		ON CONFLICT(run_id, idx) DO UPDATE SET output=`+fmt.Sprintf(tail, "COALESCE(task_steps.output,'')||excluded.output"),
+		runID, i, name, time.Now().UTC().Format(time.RFC3339), chunk, stepOutputMax(), stepOutputMax())
+	return err
+}
+
+// recordTaskStep closes step i of a run with its outcome; output, if any, is
+// appended to what was streamed.
+func (s *Server) recordTaskStep(runID string, i int, name string, ok bool, exitCode *int, detail, output string) error {
+	if output != "" {
+		if err := s.appendStepOutput(runID, i, name, output); err != nil { return err }
+	}
+	status := "succeeded"
+	if !ok { status = "failed" }
+	now := time.Now().UTC().Format(time.RFC3339)
+	var code any
+	if exitCode != nil { code = *exitCode }
+	_, err := s.DB.Exec(`INSERT INTO task_steps (run_id, idx, name, status, started_at, finished_at, exit_code, detail) VALUES (?,?,?,?,?,?,?,NULLIF(?,''))
+		ON CONFLICT(run_id, idx) DO UPDATE SET status=excluded.status, finished_at=excluded.finished_at, exit_code=excluded.exit_code, detail=excluded.detail`,
+		runID, i, name, status, now, now, code, detail)
+	if err != nil { return err }
+	s.emit("task_step.finished", map[string]any{"run_id": runID, "index": i, "step": name, "status": status, "exit_code": code, "detail": detail})
+	return nil
+}
+
+// taskStepStatuses lists the steps of a run: every step of its sequence,
+// with what was recorded for it, or just the recorded steps when the
+// sequence has since been deleted. Output is left out unless withOutput.
+func (s *Server) taskStepStatuses(run *TaskRun, withOutput bool) ([]TaskStepStatus, error) {
+	rows, err := s.DB.Query(`SELECT idx, name, status, COALESCE(started_at,''), COALESCE(finished_at,''), exit_code, COALESCE(detail,''), COALESCE(output,'') FROM task_steps WHERE run_id=? ORDER BY idx`, run.ID)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	recorded := map[int]TaskStepStatus{}
+	var order []int
+	for rows.Next() {
+		var t TaskStepStatus
+		var code sql.NullInt64
+		if err := rows.Scan(&t.Index, &t.Name, &t.Status, &t.StartedAt, &t.FinishedAt, &code, &t.Detail, &t.Output); err != nil { return nil, err }
+		if code.Valid { c := int(code.Int64); t.ExitCode = &c }
+		if !withOutput { t.Output = "" }
+		recorded[t.Index] = t
+		order = append(order, t.Index)
+	}
+	if err := rows.Err(); err != nil { return nil, err }
+	out := []TaskStepStatus{}
+	seq, err := s.taskSequence(run.SequenceID)
+	if errors.Is(err, sql.ErrNoRows) {
+		for _, i := range order { out = append(out, recorded[i]) }
+		return out, nil
+	}
+	if err != nil { return nil, err }
+	for i, st := range seq.Steps {
+		t, ok := recorded[i]
+		if !ok {
+			t = TaskStepStatus{Index: i, Name: st.Name, Status: "pending"}
+			if st.Type == "validate" && i < run.Step { t.Status = "skipped" }
+		}
+		t.Type = st.Type
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+func (s *Server) agentCheckinRoutes() {
+	// Agent: {"mac": "...", "agent_version": ""}; the run, its steps and the next one
+	s.Mux.HandleFunc("/api/v1/agent/checkin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		if !s.requireAgent(w, r) { return }
+		var body struct {
+			MAC          string `json:"mac"`
+			AgentVersion string `json:"agent_version"`
+		}
+		if !decodeJSON(w, r, &body) { return }
+		mac := normalizeMAC(body.MAC)
+		if mac == "" { http.Error(w, "mac required", 400); return }
+		if !s.agentTaskMAC(w, r, mac) || !s.requireEnrollment(w, r, mac) || !s.requireAttestation(w, r, mac) { return }
+		run, seq, i, err := s.pendingTaskStep(mac)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if run == nil { w.WriteHeader(http.StatusNoContent); return }
+		_, _ = s.DB.Exec(`UPDATE task_runs SET checkin_at=?, agent_version=NULLIF(?,'') WHERE id=?`, time.Now().UTC().Format(time.RFC3339), body.AgentVersion, run.ID)
+		steps, err := s.taskStepStatuses(run, false)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		var image string
+		if run.DeploymentID != "" { _ = s.DB.QueryRow(`SELECT COALESCE(image_id,'') FROM deployments WHERE id=?`, run.DeploymentID).Scan(&image) }
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, 200, map[string]any{"run_id": run.ID, "deployment_id": run.DeploymentID, "task_sequence_id": seq.ID, "task_sequence": seq.Name,
+			"image_id": image, "index": i, "total": len(seq.Steps), "step": seq.Steps[i], "steps": steps})
+	})
+
+	// Agent: {"run_id": "...", "step": "name"}
+	s.Mux.HandleFunc("/api/v1/agent/step/start", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		if !s.requireAgent(w, r) { return }
+		var body struct {
+			RunID string `json:"run_id"`
+			Step  string `json:"step"`
+		}
+		if !decodeJSON(w, r, &body) { return }
+		run, _, i, ok := s.agentRunStep(w, r, body.RunID, body.Step)
+		if !ok { return }
+		if err := s.startTaskStep(run, i, body.Step); err != nil { http.Error(w, err.Error(), 500); return }
+		writeJSON(w, 200, map[string]any{"run_id": run.ID, "index": i, "status": "running"})
+	})
+
+	// Agent: {"run_id": "...", "step": "name", "output": "chunk of stdout"}
+	s.Mux.HandleFunc("/api/v1/agent/step/output", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		if !s.requireAgent(w, r) { return }
+		var body struct {
+			RunID  string `json:"run_id"`
+			Step   string `json:"step"`
+			Output string `json:"output"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<20)).Decode(&body); err != nil { http.Error(w, err.Error(), 400); return }
+		run, _, i, ok := s.agentRunStep(w, r, body.RunID, body.Step)
+		if !ok { return }
+		if err := s.appendStepOutput(run.ID, i, body.Step, body.Output); err != nil { http.Error(w, err.Error(), 500); return }
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Agent: {"run_id": "...", "step": "name", "ok": true, "exit_code": 0, "detail": "", "output": ""}
+	s.Mux.HandleFunc("/api/v1/agent/step/result", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		if !s.requireAgent(w, r) { return }
+		var body struct {
+			RunID    string `json:"run_id"`
+			Step     string `json:"step"`
+			OK       bool   `json:"ok"`
+			ExitCode *int   `json:"exit_code"`
+			Detail   string `json:"detail"`
+			Output   string `json:"output"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<20)).Decode(&body); err != nil { http.Error(w, err.Error(), 400); return }
+		run, seq, i, ok := s.agentRunStep(w, r, body.RunID, body.Step)
+		if !ok { return }
+		detail := body.Detail
+		if !body.OK && detail == "" && body.ExitCode != nil { detail = "exit code " + strconv.Itoa(*body.ExitCode) }
+		status, err := s.advanceTaskRun(run, seq, i, body.OK, body.ExitCode, detail, body.Output)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		writeJSON(w, 200, map[string]any{"run_id": run.ID, "deployment_id": run.DeploymentID, "status": status})
+	})
+
+	// Steps of a run (?run_id=) or of a deployment's latest run (?deployment_id=), with output
+	s.Mux.HandleFunc("/api/v1/admin/task_runs/steps", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		var row *sql.Row
+		if id := r.URL.Query().Get("run_id"); id != "" {
+			row = s.DB.QueryRow(`SELECT `+taskRunColumns+` WHERE id=?`, id)
+		} else if dep := r.URL.Query().Get("deployment_id"); dep != "" {
+			row = s.DB.QueryRow(`SELECT `+taskRunColumns+` WHERE deployment_id=? ORDER BY started_at DESC LIMIT 1`, dep)
+		} else {
+			http.Error(w, "run_id or deployment_id required", 400); return
+		}
+		run, err := scanTaskRun(row)
+		if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		steps, err := s.taskStepStatuses(run, true)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		var checkin, version string
+		_ = s.DB.QueryRow(`SELECT COALESCE(checkin_at,''), COALESCE(agent_version,'') FROM task_runs WHERE id=?`, run.ID).Scan(&checkin, &version)
+		writeJSON(w, 200, map[string]any{"run": run, "checkin_at": checkin, "agent_version": version, "steps": steps})
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// ---- API error envelope ----
+// Every /api/ error response has the body
+// {"error": {"code", "message", "detail"?, "request_id"}} and every /api/
+// response carries X-Request-ID (the client's value when it sent a sane one).
+// Handlers keep calling http.Error; errorEnvelope rewrites the plain-text
+// reply on the way out. Codes follow the status (bad_request, not_found,
+// conflict, ...). Messages of 5xx replies, and of 4xx replies that carry
+// database or filesystem text, are replaced with a generic one and logged
+// with the request id instead; a unique-constraint failure becomes 409
+// already_exists. writeError sends a specific code directly.
+type apiError struct {
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	Detail    string       `json:"detail,omitempty"`
+	Fields    []fieldError `json:"fields,omitempty"`
+	RequestID string       `json:"request_id"`
+}
+
+var apiErrorCodes = map[int]string{
+	400: "bad_request", 401: "unauthorized", 403: "forbidden", 404: "not_found", 405: "method_not_allowed", 408: "request_timeout",
+	409: "conflict", 410: "gone", 412: "precondition_failed", 413: "payload_too_large", 415: "unsupported_media_type",
+	421: "misdirected_request", 422: "unprocessable", 423: "locked", 429: "rate_limited",
+	500: "internal", 501: "not_implemented", 502: "upstream_error", 503: "unavailable", 504: "upstream_timeout", 507: "insufficient_storage",
+}
+
+var apiErrorMessages = map[int]string{
+	500: "internal server error", 502: "an upstream service failed", 503: "service unavailable", 504: "an upstream service timed out",
+}
+
+// internalErrorRe spots messages that expose the database, storage or host.
+var internalErrorRe = regexp.MustCompile(`(?i)sqlite|sql: |constraint failed|no such (table|column)|syntax error|database is locked|` +
+	`open /|stat /|read /|write /|no such file or directory|permission denied|connection refused|dial tcp|i/o timeout|minio|s3:`)
+
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._:-]{8,64}$`)
+
+func apiErrorCode(status int) string {
+	if c, ok := apiErrorCodes[status]; ok { return c }
+	if status >= 500 { return "internal" }
+	return "bad_request"
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// writeError sends an error envelope with an explicit code.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]any{"error": apiError{Code: code, Message: message, RequestID: w.Header().Get("X-Request-ID")}})
+}
+
+// envelopeError turns a plain-text error reply into the envelope, hiding
+// internals.
+func envelopeError(status int, text, requestID, path string) (int, apiError) {
+	msg := strings.TrimSpace(text)
+	e := apiError{Code: apiErrorCode(status), Message: msg, RequestID: requestID}
+	if strings.Contains(msg, "UNIQUE constraint failed") {
+		return http.StatusConflict, apiError{Code: "already_exists", Message: "a record with the same unique value already exists", RequestID: requestID}
+	}
+	if status == 404 && msg == "404 page not found" { e.Message = "not found" }
+	if status >= 500 || internalErrorRe.MatchString(msg) {
+		log.Printf("request %s %s: %d %s", requestID, path, status, msg)
+		e.Message = apiErrorMessages[status]
+		if e.Message == "" && status >= 500 { e.Message = "internal server error" }
+		if status < 500 { e.Detail = "see the server log for request " + requestID }
+	}
+	if e.Message == "" { e.Message = strings.ReplaceAll(apiErrorCode(status), "_", " ") }
+	return status, e
+}
+
+// errorWriter holds back plain-text error replies so errorEnvelope can
+// rewrite them; everything else passes straight through.
+type errorWriter struct {
+	http.ResponseWriter
+	status    int
+	capturing bool
+	buf       bytes.Buffer
+}
+
+func (e *errorWriter) WriteHeader(status int) {
+	if e.status != 0 { return }
+	e.status = status
+	if status >= 400 && strings.HasPrefix(e.Header().Get("Content-Type"), "text/plain") {
+		e.capturing = true
+		return
+	}
+	e.ResponseWriter.WriteHeader(status)
+}
+
+func (e *errorWriter) Write(b []byte) (int, error) {
+	if e.status == 0 { e.WriteHeader(http.StatusOK) }
+	if e.capturing {
+		if e.buf.Len() < 8<<10 { e.buf.Write(b) }
+		return len(b), nil
+	}
+	return e.ResponseWriter.Write(b)
+}
+
+func (e *errorWriter) Flush() {
+	if e.capturing { return }
+	if f, ok := e.ResponseWriter.(http.Flusher); ok { f.Flush() }
+}
+
+func (e *errorWriter) Unwrap() http.ResponseWriter { return e.ResponseWriter }
+
+func errorEnvelope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") { next.ServeHTTP(w, r); return }
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRe.MatchString(id) { id = newRequestID() }
+		w.Header().Set("X-Request-ID", id)
+		ew := &errorWriter{ResponseWriter: w}
+		next.ServeHTTP(ew, r)
+		if !ew.capturing { return }
+		status, body := envelopeError(ew.status, ew.buf.String(), id, r.URL.Path)
+		h := w.Header()
+		h.Del("Content-Length")
+		h.Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": body})
+	})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ---- API keys ----
+// Automation (CI pipelines pushing images, agents, inventory scripts)
+// authenticates with a long-lived API key instead of a person's login:
+// "Authorization: Bearer bth_...". Keys are issued by admins with
+// POST /api/v1/admin/api_keys {"name", "scopes": [...], "expires_at"?}; the
+// token is returned once and only its SHA-256 is stored. A key reaches only
+// the routes its scopes name (see apiKeyScopes) and acts with the lowest role
+// those routes need, on behalf of the admin who issued it and only while they
+// hold that role. GET lists the keys with when and from where each was last
+// used; DELETE /api/v1/admin/api_keys/{id} revokes one. Keys with
+// agent:checkin are accepted by the agent endpoints in place of
+// BOOTAH_AGENT_TOKEN.
+const apiKeyPrefix = "bth_"
+
+type apiKeyScope struct {
+	Role     string
+	ReadOnly bool // GET and HEAD only
+	Paths    []string
+	Desc     string
+}
+
+var apiKeyScopes = map[string]apiKeyScope{
+	"images:read":       {"viewer", true, []string{"/api/v1/images", "/api/v1/image_tags", "/api/v1/catalog/"}, "List and download images"},
+	"images:write":      {"admin", false, []string{"/api/v1/images", "/api/v1/image_tags", "/api/v1/uploads", "/api/v1/builds"}, "Upload, build, tag, publish and delete images"},
+	"machines:read":     {"viewer", true, []string{"/api/v1/machines", "/api/v1/machine_tags"}, "List machines and their tags"},
+	"machines:write":    {"admin", false, []string{"/api/v1/machines", "/api/v1/machine_tags"}, "Create, import, tag and delete machines"},
+	"deployments:write": {"operator", false, []string{"/api/v1/admin/deployments", "/api/v1/deployments/plan"}, "Plan and create deployments"},
+	"agent:checkin":     {"viewer", false, []string{"/api/v1/agent/", "/api/v1/tasks/"}, "Act as a deployment agent"},
+}
+
+var roleRanks = map[string]int{"viewer": 1, "operator": 2, "admin": 3}
+
+func initAPIKeys(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS api_keys (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		token_hash TEXT UNIQUE NOT NULL,
+		hint TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		created_by INTEGER,
+		created_at TEXT NOT NULL,
+		expires_at TEXT,
+		last_used_at TEXT,
+		last_used_ip TEXT,
+		revoked_at TEXT
+	)`)
+	return err
+}
+
+type APIKey struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Hint       string   `json:"hint"`
+	Scopes     []string `json:"scopes"`
+	CreatedBy  int64    `json:"created_by,omitempty"`
+	CreatedAt  string   `json:"created_at"`
+	ExpiresAt  string   `json:"expires_at,omitempty"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+	LastUsedIP string   `json:"last_used_ip,omitempty"`
+	RevokedAt  string   `json:"revoked_at,omitempty"`
+}
+
+func (k *APIKey) validateFields(v *validator) {
+	v.required("name", k.Name)
+	if len(k.Scopes) == 0 { v.add("scopes", "required") }
+	for _, sc := range k.Scopes {
+		if _, ok := apiKeyScopes[sc]; !ok { v.add("scopes", fmt.Sprintf("unknown scope %q", sc)) }
+	}
+	if k.ExpiresAt != "" {
+		if t, err := time.Parse(time.RFC3339, k.ExpiresAt); err != nil {
+			v.add("expires_at", "must be RFC3339")
+		} else if !t.After(time.Now()) {
+			v.add("expires_at", "must be in the future")
+		}
+	}
+}
+
+const apiKeyColumns = `id, name, hint, scopes, COALESCE(created_by,0), created_at, COALESCE(expires_at,''), COALESCE(last_used_at,''), COALESCE(last_used_ip,''), COALESCE(revoked_at,'') FROM api_keys`
+
+func scanAPIKey(row interface{ Scan(...any) error }) (*APIKey, error) {
+	var k APIKey
+	var scopes string
+	if err := row.Scan(&k.ID, &k.Name, &k.Hint, &scopes, &k.CreatedBy, &k.CreatedAt, &k.ExpiresAt, &k.LastUsedAt, &k.LastUsedIP, &k.RevokedAt); err != nil { return nil, err }
+	k.Scopes = splitList(scopes)
+	return &k, nil
+}
+
+// apiKeyRole is the lowest role that covers every scope.
+func apiKeyRole(scopes []string) string {
+	role := "viewer"
+	for _, sc := range scopes {
+		if r := apiKeyScopes[sc].Role; roleRanks[r] > roleRanks[role] { role = r }
+	}
+	return role
+}
+
+// apiKeyAllows reports whether one of scopes covers method and path.
+func apiKeyAllows(scopes []string, method, path string) bool {
+	for _, sc := range scopes {
+		def, ok := apiKeyScopes[sc]
+		if !ok || def.ReadOnly && method != http.MethodGet && method != http.MethodHead { continue }
+		for _, p := range def.Paths {
+			if path == strings.TrimSuffix(p, "/") || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") { return true }
+		}
+	}
+	return false
+}
+
+// apiKeyCreatorHolds reports whether the user who issued k still exists and
+// still holds what the key acts with on path, so a demoted issuer's keys
+// lose what they lost.
+func (s *Server) apiKeyCreatorHolds(k *APIKey, path string) bool {
+	var role string
+	if s.DB.QueryRow(`SELECT role FROM users WHERE id=?`, k.CreatedBy).Scan(&role) != nil || role == rolePending { return false }
+	keyRole := apiKeyRole(k.Scopes)
+	if role == "admin" || roleRanks[role] > 0 && roleRanks[role] >= roleRanks[keyRole] { return true }
+	return keyRole == "viewer" || s.roleAllows(role, routePermission(path, keyRole))
+}
+
+// verifyAPIKey resolves a bth_ bearer token into claims like verifyAuth's,
+// refusing revoked and expired keys, routes outside the key's scopes and
+// keys whose issuer is gone or no longer holds their role.
+func (s *Server) verifyAPIKey(r *http.Request, tok string) (map[string]any, error) {
+	k, err := scanAPIKey(s.DB.QueryRow(`SELECT `+apiKeyColumns+` WHERE token_hash=?`, hashToken(tok)))
+	if errors.Is(err, sql.ErrNoRows) { return nil, errors.New("unknown api key") }
+	if err != nil { return nil, err }
+	now := time.Now().UTC()
+	if k.RevokedAt != "" { return nil, errors.New("api key revoked") }
+	if k.ExpiresAt != "" && k.ExpiresAt <= now.Format(time.RFC3339) { return nil, errors.New("api key expired") }
+	if !apiKeyAllows(k.Scopes, r.Method, r.URL.Path) { return nil, fmt.Errorf("api key %s has no scope for %s %s", k.Name, r.Method, r.URL.Path) }
+	if !s.apiKeyCreatorHolds(k, r.URL.Path) { return nil, fmt.Errorf("api key %s: its issuer no longer holds its role", k.Name) }
+	// last use is recorded at most once a minute per key
+	var ip string
+	if c := clientIP(r); c != nil { ip = c.String() }
+	_, _ = s.DB.Exec(`UPDATE api_keys SET last_used_at=?, last_used_ip=? WHERE id=? AND (last_used_at IS NULL OR last_used_at<?)`,
+		now.Format(time.RFC3339), ip, k.ID, now.Add(-time.Minute).Format(time.RFC3339))
+	return map[string]any{"sub": k.CreatedBy, "email": "api-key:" + k.Name, "role": apiKeyRole(k.Scopes), "api_key": k.ID, "scopes": k.Scopes}, nil
+}
+
+// agentAPIKey reports whether the request carries an API key with
+// agent:checkin.
+func (s *Server) agentAPIKey(r *http.Request) bool {
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "+apiKeyPrefix)
+	if !ok { return false }
+	c, err := s.verifyAPIKey(r, apiKeyPrefix+tok)
+	if err != nil { return false }
+	for _, sc := range c["scopes"].([]string) {
+		if sc == "agent:checkin" { return true }
+	}
+	return false
+}
+
+func (s *Server) apiKeyRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/api_keys", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := s.DB.Query(`SELECT ` + apiKeyColumns + ` ORDER BY created_at DESC`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			out := []*APIKey{}
+			for rows.Next() {
+				k, err := scanAPIKey(rows)
+				if err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, k)
+			}
+			scopes := map[string]string{}
+			for name, def := range apiKeyScopes { scopes[name] = def.Desc }
+			writeJSON(w, 200, map[string]any{"keys": out, "scopes": scopes})
+		case http.MethodPost:
+			var k APIKey
+			if !decodeJSON(w, r, &k) { return }
+			if _, c, err := s.verifyAuth(r); err == nil { k.CreatedBy, _ = c["sub"].(int64) }
+			sort.Strings(k.Scopes)
+			tok := apiKeyPrefix + randToken(32)
+			k.ID, k.Hint, k.CreatedAt = genID(), tok[:len(apiKeyPrefix)+6], time.Now().UTC().Format(time.RFC3339)
+			if k.ExpiresAt != "" { t, _ := time.Parse(time.RFC3339, k.ExpiresAt); k.ExpiresAt = t.UTC().Format(time.RFC3339) }
+			_, err := s.DB.Exec(`INSERT INTO api_keys (id, name, token_hash, hint, scopes, created_by, created_at, expires_at) VALUES (?,?,?,?,?,NULLIF(?,0),?,NULLIF(?,''))`,
+				k.ID, k.Name, hashToken(tok), k.Hint, strings.Join(k.Scopes, ","), k.CreatedBy, k.CreatedAt, k.ExpiresAt)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "create", "api_key", map[string]any{"id": k.ID, "name": k.Name, "scopes": k.Scopes, "expires_at": k.ExpiresAt})
+			writeJSON(w, 201, map[string]any{"key": k, "token": tok})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	s.Mux.HandleFunc("/api/v1/admin/api_keys/", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodDelete { http.Error(w, "method not allowed", 405); return }
+		id := strings.TrimPrefix(r.URL.Path, "/api/v1/admin/api_keys/")
+		var name string
+		if err := s.DB.QueryRow(`SELECT name FROM api_keys WHERE id=?`, id).Scan(&name); err != nil { http.Error(w, "not found", 404); return }
+		res, err := s.DB.Exec(`UPDATE api_keys SET revoked_at=? WHERE id=? AND revoked_at IS NULL`, time.Now().UTC().Format(time.RFC3339), id)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if n, _ := res.RowsAffected(); n == 0 { http.Error(w, "already revoked", 409); return }
+		s.audit(s.actorID(r), "revoke", "api_key", map[string]any{"id": id, "name": name})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
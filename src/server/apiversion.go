@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---- API versioning ----
+// The whole management API lives under /api/v1: /api/v1/admin/... and
+// /api/v1/auth/... replaced the unversioned /api/admin/... and /api/auth/....
+// The old paths still work: apiVersioning rewrites them to their successor
+// and marks the response with Deprecation (RFC 9745), Sunset (RFC 8594) and a
+// Link to the successor-version, and logs the first use of each old path so
+// operators can find the clients still on it. The dates come from
+// BOOTAH_LEGACY_API_DEPRECATED and BOOTAH_LEGACY_API_SUNSET (YYYY-MM-DD).
+// /api/health stays unversioned for load balancer probes.
+var legacyAPIPrefixes = []struct{ old, new string }{
+	{"/api/admin/", "/api/v1/admin/"},
+	{"/api/auth/", "/api/v1/auth/"},
+}
+
+var legacyAPISeen sync.Map
+
+func legacyAPIDate(key, def string) time.Time {
+	t, err := time.Parse("2006-01-02", getenv(key, def))
+	if err != nil { t, _ = time.Parse("2006-01-02", def) }
+	return t
+}
+
+// successorPath maps an unversioned API path to its /api/v1 equivalent.
+func successorPath(p string) (string, bool) {
+	for _, l := range legacyAPIPrefixes {
+		if rest, ok := strings.CutPrefix(p, l.old); ok { return l.new + rest, true }
+	}
+	return "", false
+}
+
+func apiVersioning(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := successorPath(r.URL.Path)
+		if !ok { next.ServeHTTP(w, r); return }
+		h := w.Header()
+		h.Set("Deprecation", fmt.Sprintf("@%d", legacyAPIDate("BOOTAH_LEGACY_API_DEPRECATED", "2026-10-01").Unix()))
+		h.Set("Sunset", legacyAPIDate("BOOTAH_LEGACY_API_SUNSET", "2027-10-01").UTC().Format(http.TimeFormat))
+		h.Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", p))
+		route := strings.SplitN(r.URL.Path, "/", 5)
+		if len(route) == 5 { route = route[:4] }
+		if _, seen := legacyAPISeen.LoadOrStore(strings.Join(route, "/"), true); !seen {
+			log.Printf("deprecated API path %s used by %s (%s); use %s", r.URL.Path, r.RemoteAddr, r.UserAgent(), p)
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = p
+		if r.URL.RawPath != "" {
+			if rp, ok := successorPath(r.URL.RawPath); ok { r2.URL.RawPath = rp } else { r2.URL.RawPath = "" }
+		}
+		next.ServeHTTP(w, r2)
+	})
+}
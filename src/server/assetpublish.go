@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ---- Boot asset publication ----
+// WinPE builds and ISO extractions write their outputs into a work directory
+// that is published under a boot asset prefix ("winpe", "ubuntu") when the
+// job succeeds. Everything is staged first and committed in one transaction,
+// and the commit is refused if a menu entry that uses the prefix would end up
+// pointing at a file that exists nowhere, or booting a kernel with an initrd
+// that does not match it, so the menu flips to the new build in one step or
+// not at all.
+//
+// WinPE builds are described in winpebuild.go. ISO extraction runs
+// BOOTAH_ISO_EXTRACT_CMD once per file with {src}, {from} and {dst}.
+var isoBootFiles = map[string]string{"/casper/vmlinuz": "vmlinuz", "/casper/initrd": "initrd"}
+
+func toolCommands(spec string) [][]string {
+	var cmds [][]string
+	for _, c := range strings.Split(spec, ";") {
+		if f := strings.Fields(c); len(f) > 0 { cmds = append(cmds, f) }
+	}
+	return cmds
+}
+
+func runTools(ctx context.Context, cmds [][]string, repl *strings.Replacer) error {
+	for n, c := range cmds {
+		args := make([]string, len(c))
+		for i, a := range c { args[i] = repl.Replace(a) }
+		jobProgress(ctx, n*100/len(cmds), args[0])
+		out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+		if err != nil { return fmt.Errorf("%s: %v: %s", args[0], err, strings.TrimSpace(string(out))) }
+	}
+	return nil
+}
+
+// entryAssets lists the boot asset paths an entry's script references.
+func entryAssets(e bootEntry) []string {
+	var out []string
+	e.Script(func(p string) string { out = append(out, strings.TrimPrefix(p, "/assets/")); return p }, e.Args)
+	return out
+}
+
+// assetAvailable reports whether p is served, managed or from the web root.
+func (s *Server) assetAvailable(p string) bool {
+	if _, err := s.bootAsset(p); err == nil { return true }
+	_, err := os.Stat(filepath.Join(s.WebRoot, "assets", filepath.FromSlash(p)))
+	return err == nil
+}
+
+// publishBootAssets publishes every file under dir as prefix/<relative path>
+// and returns the published paths.
+func (s *Server) publishBootAssets(ctx context.Context, source, prefix, dir string) ([]string, error) {
+	var staged []*BootAsset
+	discard := func() { for _, a := range staged { _ = s.Store.Delete(ctx, a.file) } }
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() { return err }
+		rel, _ := filepath.Rel(dir, p)
+		ap, err := cleanAssetPath(path.Join(prefix, filepath.ToSlash(rel)))
+		if err != nil { return err }
+		f, err := os.Open(p)
+		if err != nil { return err }
+		defer f.Close()
+		a, err := s.stageBootAsset(ctx, ap, f, "")
+		if err != nil { return err }
+		staged = append(staged, a)
+		return nil
+	})
+	if err != nil { discard(); return nil, err }
+	if len(staged) == 0 { return nil, errors.New("job produced no files") }
+	have := map[string]bool{}
+	var paths []string
+	for _, a := range staged { have[a.Path] = true; paths = append(paths, a.Path) }
+	var entries []string
+	for _, e := range bootEntries {
+		uses := false
+		for _, p := range entryAssets(e) {
+			if !strings.HasPrefix(p, prefix+"/") { continue }
+			uses = true
+			if !have[p] && !s.assetAvailable(p) { discard(); return nil, fmt.Errorf("output lacks %s required by boot entry %s", p, e.Name) }
+		}
+		if uses { entries = append(entries, e.Name) }
+	}
+	shadow := map[string]*BootAsset{}
+	for _, a := range staged { shadow[a.Path] = a }
+	for _, rep := range s.bootPairReportsWith(shadow) {
+		for _, pr := range rep.Pairs {
+			for _, a := range staged {
+				if pr.uses(a.Path) && len(pr.Errors) > 0 { discard(); return nil, fmt.Errorf("%s %s: %s", rep.Kind, rep.Name, strings.Join(pr.Errors, "; ")) }
+			}
+		}
+	}
+	replaced, err := s.commitBootAssets(ctx, staged)
+	if err != nil { return nil, err }
+	sort.Strings(paths)
+	s.audit(nil, "publish", "boot_asset", map[string]any{"source": source, "paths": paths, "replaced": replaced, "entries": entries})
+	s.emit("boot_assets.published", map[string]any{"source": source, "prefix": prefix, "paths": paths, "entries": entries})
+	return paths, nil
+}
+
+type isoExtractJob struct {
+	ImageID string            `json:"image_id"`
+	Prefix  string            `json:"prefix"`
+	Files   map[string]string `json:"files"` // path in the ISO -> name under prefix
+}
+
+func init() {
+	registerJobHandler("winpe-build", func(s *Server, ctx context.Context, payload json.RawMessage) (string, error) {
+		var j winpeBuildJob
+		if err := json.Unmarshal(payload, &j); err != nil { return "", err }
+		paths, err := s.buildWinPE(ctx, &j)
+		if err != nil { return "", err }
+		return "assets:" + strings.Join(paths, ","), nil
+	})
+
+	registerJobHandler("iso-extract", func(s *Server, ctx context.Context, payload json.RawMessage) (string, error) {
+		var j isoExtractJob
+		if err := json.Unmarshal(payload, &j); err != nil { return "", err }
+		var key string
+		if err := s.DB.QueryRow(`SELECT file FROM images WHERE id=?`, j.ImageID).Scan(&key); err != nil { return "", err }
+		work, err := os.MkdirTemp("", "bootah-iso-")
+		if err != nil { return "", err }
+		defer os.RemoveAll(work)
+		src, err := s.stageObject(ctx, key, work)
+		if err != nil { return "", err }
+		out := filepath.Join(work, "out")
+		cmds := toolCommands(getenv("BOOTAH_ISO_EXTRACT_CMD", "xorriso -osirrox on -indev {src} -extract {from} {dst}"))
+		for from, name := range j.Files {
+			dst := filepath.Join(out, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil { return "", err }
+			if err := runTools(ctx, cmds, strings.NewReplacer("{src}", src, "{from}", from, "{dst}", dst)); err != nil { return "", err }
+		}
+		paths, err := s.publishBootAssets(ctx, "iso:"+j.ImageID, j.Prefix, out)
+		if err != nil { return "", err }
+		return "assets:" + strings.Join(paths, ","), nil
+	})
+}
+
+func (s *Server) assetPublishRoutes() {
+	// {"image_id": "...", "prefix": "ubuntu", "files": {"/casper/vmlinuz": "vmlinuz"}}
+	s.Mux.HandleFunc("/api/v1/admin/images/extract-assets", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		var j isoExtractJob
+		if !decodeJSON(w, r, &j) { return }
+		var typ string
+		if err := s.DB.QueryRow(`SELECT type FROM images WHERE id=?`, j.ImageID).Scan(&typ); err != nil {
+			if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+			http.Error(w, err.Error(), 500); return
+		}
+		if typ != "iso" { http.Error(w, "image is not an iso", 400); return }
+		if j.Prefix == "" { j.Prefix = "ubuntu" }
+		if len(j.Files) == 0 { j.Files = isoBootFiles }
+		if _, err := cleanAssetPath(j.Prefix); err != nil { http.Error(w, err.Error(), 400); return }
+		for _, name := range j.Files {
+			p, err := cleanAssetPath(path.Join(j.Prefix, name))
+			if err != nil || !strings.HasPrefix(p, j.Prefix+"/") { http.Error(w, "invalid file name "+name, 400); return }
+		}
+		jobID, err := s.enqueueJob("iso-extract", j)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		s.audit(s.actorID(r), "extract_start", "image", map[string]any{"id": j.ImageID, "prefix": j.Prefix, "job": jobID})
+		writeJSON(w, 202, map[string]any{"job": jobID, "status": "queued"})
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// ---- Image attachments ----
+// Files stored alongside an image (SBOMs, release notes, manifests). Content
+// lives in Storage under "attachments/<image>/<id>"; rows carry the metadata.
+type Attachment struct {
+	ID          string `json:"id"`
+	ImageID     string `json:"image_id"`
+	Name        string `json:"name"`
+	Kind        string `json:"kind"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Created     string `json:"created"`
+	file        string
+}
+
+func initAttachments(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS image_attachments (
+		id TEXT PRIMARY KEY,
+		image_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		file TEXT NOT NULL,
+		created TEXT NOT NULL
+	)`)
+	return err
+}
+
+func (s *Server) addAttachment(ctx context.Context, imageID, name, kind, contentType string, body io.Reader) (*Attachment, error) {
+	a := &Attachment{ID: "att-" + genID(), ImageID: imageID, Name: name, Kind: kind, ContentType: contentType, Created: time.Now().UTC().Format(time.RFC3339)}
+	a.file = "attachments/" + imageID + "/" + a.ID
+	size, _, err := s.StorePut(ctx, a.file, body)
+	if err != nil { return nil, err }
+	a.Size = size
+	_, err = s.DB.Exec(`INSERT INTO image_attachments (id, image_id, name, kind, content_type, size, file, created) VALUES (?,?,?,?,?,?,?,?)`,
+		a.ID, a.ImageID, a.Name, a.Kind, a.ContentType, a.Size, a.file, a.Created)
+	if err != nil { return nil, err }
+	return a, nil
+}
+
+func (s *Server) listAttachments(imageID, kind string) ([]Attachment, error) {
+	q := `SELECT id, image_id, name, kind, content_type, size, file, created FROM image_attachments WHERE image_id=?`
+	args := []any{imageID}
+	if kind != "" { q += ` AND kind=?`; args = append(args, kind) }
+	rows, err := s.DB.Query(q+` ORDER BY created DESC`, args...)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := []Attachment{}
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.ID, &a.ImageID, &a.Name, &a.Kind, &a.ContentType, &a.Size, &a.file, &a.Created); err != nil { return nil, err }
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+func (s *Server) serveAttachment(w http.ResponseWriter, r *http.Request, a Attachment) {
+	w.Header().Set("Content-Type", a.ContentType)
+	s.serveObject(w, r, a.file, a.Name, objectMeta{})
+}
+
+// deleteAttachments removes every attachment of an image (used on image delete).
+func (s *Server) deleteAttachments(ctx context.Context, imageID string) {
+	list, err := s.listAttachments(imageID, "")
+	if err != nil { return }
+	for _, a := range list { _ = s.Store.Delete(ctx, a.file) }
+	_, _ = s.DB.Exec(`DELETE FROM image_attachments WHERE image_id=?`, imageID)
+}
+
+// handleImageAttachments serves /api/v1/images/{id}/attachments[/{aid}]:
+// GET lists or downloads, POST (multipart "file", optional "name"/"kind")
+// and DELETE require admin.
+func (s *Server) handleImageAttachments(w http.ResponseWriter, r *http.Request, imageID string, rest []string) {
+	switch {
+	case r.Method == http.MethodPost && len(rest) == 0:
+		if !s.requireRole(w, r, "admin") || !s.requireDiskSpace(w, r) { return }
+		var exists int
+		_ = s.DB.QueryRow(`SELECT COUNT(*) FROM images WHERE id=?`, imageID).Scan(&exists)
+		if exists == 0 { http.NotFound(w, r); return }
+		limitUploadBody(w, r)
+		if err := r.ParseMultipartForm(64 << 20); err != nil { uploadFailed(w, err, 400, "invalid multipart: "); return }
+		fh, hdr, err := getFilePart(r, "file")
+		if err != nil { http.Error(w, "file required: "+err.Error(), 400); return }
+		defer fh.Close()
+		name := filepath.Base(r.FormValue("name"))
+		if name == "." || name == "/" { name = filepath.Base(hdr.Filename) }
+		kind := r.FormValue("kind")
+		if kind == "" { kind = "file" }
+		if kind == "sbom" { http.Error(w, "sbom attachments are generated, not uploaded", 400); return }
+		ct := hdr.Header.Get("Content-Type")
+		if ct == "" { ct = mime.TypeByExtension(filepath.Ext(name)) }
+		if ct == "" { ct = "application/octet-stream" }
+		a, err := s.addAttachment(r.Context(), imageID, name, kind, ct, fh)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		s.audit(s.actorID(r), "attach", "image", map[string]any{"id": imageID, "attachment": a.ID, "name": a.Name})
+		writeJSON(w, 201, a)
+		return
+	case r.Method == http.MethodGet || (r.Method == http.MethodDelete && len(rest) == 1):
+	default:
+		http.Error(w, "method not allowed", 405); return
+	}
+	list, err := s.listAttachments(imageID, r.URL.Query().Get("kind"))
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	if len(rest) == 0 { writeJSON(w, 200, list); return }
+	for _, a := range list {
+		if a.ID != rest[0] { continue }
+		if r.Method == http.MethodGet { s.serveAttachment(w, r, a); return }
+		if !s.requireRole(w, r, "admin") { return }
+		_ = s.Store.Delete(r.Context(), a.file)
+		if _, err := s.DB.Exec(`DELETE FROM image_attachments WHERE id=?`, a.ID); err != nil { http.Error(w, err.Error(), 500); return }
+		s.audit(s.actorID(r), "detach", "image", map[string]any{"id": imageID, "attachment": a.ID})
+		writeJSON(w, 200, map[string]any{"deleted": a.ID})
+		return
+	}
+	http.NotFound(w, r)
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ---- TPM attestation ----
+// Groups flagged require_attestation only get answer files and device
+// certificates after the agent proves it runs on the machine's enrolled TPM.
+// An admin enrolls the TPM's endorsement key (public key or EK certificate,
+// checked against BOOTAH_TPM_EK_ROOTS when set) and attestation key (the
+// TPM2B_PUBLIC from tpm2_createak -u), and optionally a golden PCR digest.
+// Before its first quote the agent proves the AK lives in the same TPM as
+// the EK: the server makes a credential for the AK's name encrypted to the
+// EK, which only that TPM can open (tpm2_activatecredential), and the agent
+// returns the secret inside. Then it fetches a nonce, has the TPM quote its
+// PCRs with the nonce as qualifying data (tpm2_quote -q <nonce>), and posts
+// the TPMS_ATTEST blob with the AK signature (RSA PKCS#1 v1.5/PSS, or ECDSA
+// as DER). A verified quote opens the gate for BOOTAH_ATTEST_TTL (default
+// 1h). Group rules can match on reported inventory, so once a machine has a
+// TPM enrolled it needs attestation whatever its groups say, until an admin
+// removes the TPM.
+func initAttestation(db *sql.DB) error {
+	ddl1 := `CREATE TABLE IF NOT EXISTS tpm_keys (
+		mac TEXT PRIMARY KEY,
+		ek_pem TEXT NOT NULL,
+		ak_pem TEXT NOT NULL,
+		pcr_digest TEXT,
+		enrolled_at TEXT NOT NULL
+	);`
+	ddl2 := `CREATE TABLE IF NOT EXISTS attest_challenges (
+		nonce TEXT PRIMARY KEY,
+		mac TEXT NOT NULL,
+		expires TEXT NOT NULL
+	);`
+	ddl3 := `CREATE TABLE IF NOT EXISTS attestations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		mac TEXT NOT NULL,
+		ok INTEGER NOT NULL,
+		detail TEXT,
+		pcr_digest TEXT,
+		created TEXT NOT NULL
+	);`
+	for _, ddl := range []string{ddl1, ddl2, ddl3} {
+		if _, err := db.Exec(ddl); err != nil { return err }
+	}
+	return nil
+}
+
+func attestTTL() time.Duration {
+	d, err := time.ParseDuration(getenv("BOOTAH_ATTEST_TTL", "1h"))
+	if err != nil || d <= 0 { return time.Hour }
+	return d
+}
+
+// parsePublicPEM accepts a PUBLIC KEY or CERTIFICATE block.
+func parsePublicPEM(s string) (crypto.PublicKey, *x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil { return nil, nil, errors.New("not PEM") }
+	switch block.Type {
+	case "PUBLIC KEY":
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		return pub, nil, err
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil { return nil, nil, err }
+		return cert.PublicKey, cert, nil
+	}
+	return nil, nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+}
+
+// verifyEKCert checks an EK certificate against the configured manufacturer
+// roots. EK certificates carry TPM-specific critical extensions that x509
+// does not understand, so those are ignored for path validation.
+func verifyEKCert(cert *x509.Certificate) error {
+	path := getenv("BOOTAH_TPM_EK_ROOTS", "")
+	if path == "" { return nil }
+	b, err := os.ReadFile(path)
+	if err != nil { return err }
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(b) { return errors.New("no certificates in BOOTAH_TPM_EK_ROOTS") }
+	c := *cert
+	c.UnhandledCriticalExtensions = nil
+	_, err = c.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	return err
+}
+
+type tpmQuote struct {
+	ExtraData []byte
+	PCRDigest []byte
+}
+
+// parseTPMSAttest decodes the parts of a TPMS_ATTEST quote we check.
+func parseTPMSAttest(b []byte) (*tpmQuote, error) {
+	r := bytes.NewReader(b)
+	var magic uint32
+	var typ uint16
+	if err := binary.Read(r, binary.BigEndian, &magic); err != nil { return nil, err }
+	if magic != 0xff544347 { return nil, errors.New("not generated by a TPM") }
+	if err := binary.Read(r, binary.BigEndian, &typ); err != nil { return nil, err }
+	if typ != 0x8018 { return nil, fmt.Errorf("attestation type %#x is not a quote", typ) }
+	tpm2b := func() ([]byte, error) {
+		var n uint16
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil { return nil, err }
+		buf := make([]byte, n)
+		_, err := io.ReadFull(r, buf)
+		return buf, err
+	}
+	if _, err := tpm2b(); err != nil { return nil, err } // qualifiedSigner
+	q := &tpmQuote{}
+	var err error
+	if q.ExtraData, err = tpm2b(); err != nil { return nil, err }
+	// clockInfo (17 bytes) and firmwareVersion (8 bytes)
+	if _, err := r.Seek(17+8, io.SeekCurrent); err != nil { return nil, err }
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil { return nil, err }
+	if count > 16 { return nil, errors.New("invalid pcr selection") }
+	for i := uint32(0); i < count; i++ {
+		var hash uint16
+		var size uint8
+		if err := binary.Read(r, binary.BigEndian, &hash); err != nil { return nil, err }
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil { return nil, err }
+		if _, err := r.Seek(int64(size), io.SeekCurrent); err != nil { return nil, err }
+	}
+	if q.PCRDigest, err = tpm2b(); err != nil { return nil, err }
+	return q, nil
+}
+
+func verifyQuoteSignature(pub crypto.PublicKey, quote, sig []byte) error {
+	digest := sha256.Sum256(quote)
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err == nil { return nil }
+		return rsa.VerifyPSS(k, crypto.SHA256, digest[:], sig, nil)
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(k, digest[:], sig) { return nil }
+		return errors.New("ecdsa signature invalid")
+	}
+	return fmt.Errorf("unsupported attestation key type %T", pub)
+}
+
+const (
+	tpmAlgRSA    = 0x0001
+	tpmAlgSHA256 = 0x000b
+	tpmAlgNull   = 0x0010
+	tpmAlgECC    = 0x0023
+	tpmCurveP256 = 0x0003
+
+	tpmAttrFixedTPM   = 1 << 1
+	tpmAttrRestricted = 1 << 16
+	tpmAttrSign       = 1 << 18
+)
+
+// tpmPublic is what we use of a TPMT_PUBLIC area: the key, its attributes
+// and its TPM name (nameAlg followed by the hash of the area).
+type tpmPublic struct {
+	Key   crypto.PublicKey
+	Attrs uint32
+	Name  []byte
+}
+
+func tpm2b(b []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...)
+}
+
+// parseTPMPublic decodes a TPM2B_PUBLIC (as written by tpm2_createak -u) or
+// a bare TPMT_PUBLIC with an RSA or P-256 key and a SHA-256 name.
+func parseTPMPublic(b []byte) (*tpmPublic, error) {
+	if len(b) > 2 && int(binary.BigEndian.Uint16(b)) == len(b)-2 { b = b[2:] }
+	r := bytes.NewReader(b)
+	read := func(v any) error { return binary.Read(r, binary.BigEndian, v) }
+	sized := func() ([]byte, error) {
+		var n uint16
+		if err := read(&n); err != nil { return nil, err }
+		buf := make([]byte, n)
+		_, err := io.ReadFull(r, buf)
+		return buf, err
+	}
+	// an algorithm id, followed by two more bytes unless it is TPM_ALG_NULL
+	alg := func(extra int64) error {
+		var a uint16
+		if err := read(&a); err != nil { return err }
+		if a == tpmAlgNull { return nil }
+		_, err := r.Seek(extra, io.SeekCurrent)
+		return err
+	}
+	var typ, nameAlg uint16
+	p := &tpmPublic{}
+	if err := read(&typ); err != nil { return nil, err }
+	if err := read(&nameAlg); err != nil { return nil, err }
+	if nameAlg != tpmAlgSHA256 { return nil, fmt.Errorf("name algorithm %#x is not sha256", nameAlg) }
+	if err := read(&p.Attrs); err != nil { return nil, err }
+	if _, err := sized(); err != nil { return nil, err } // authPolicy
+	if err := alg(4); err != nil { return nil, err }     // symmetric: keyBits, mode
+	if err := alg(2); err != nil { return nil, err }     // scheme: hashAlg
+	switch typ {
+	case tpmAlgRSA:
+		var bits uint16
+		var exp uint32
+		if err := read(&bits); err != nil { return nil, err }
+		if err := read(&exp); err != nil { return nil, err }
+		n, err := sized()
+		if err != nil { return nil, err }
+		if exp == 0 { exp = 65537 }
+		p.Key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp)}
+	case tpmAlgECC:
+		var curve uint16
+		if err := read(&curve); err != nil { return nil, err }
+		if curve != tpmCurveP256 { return nil, fmt.Errorf("ecc curve %#x is not supported", curve) }
+		if err := alg(2); err != nil { return nil, err } // kdf: hashAlg
+		x, err := sized()
+		if err != nil { return nil, err }
+		y, err := sized()
+		if err != nil { return nil, err }
+		k := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !k.Curve.IsOnCurve(k.X, k.Y) { return nil, errors.New("ecc point is not on the curve") }
+		p.Key = k
+	default:
+		return nil, fmt.Errorf("key type %#x is not supported", typ)
+	}
+	if r.Len() != 0 { return nil, errors.New("trailing data after TPMT_PUBLIC") }
+	h := sha256.Sum256(b)
+	p.Name = append(binary.BigEndian.AppendUint16(nil, nameAlg), h[:]...)
+	return p, nil
+}
+
+// sameKey reports whether two parsed public keys are the same key.
+func sameKey(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
+
+// tpmKDFa is the TPM 2.0 KDFa with HMAC-SHA256 (Part 1, 11.4.10.2).
+func tpmKDFa(key []byte, label string, u, v []byte, bits int) []byte {
+	var out []byte
+	for c := uint32(1); len(out)*8 < bits; c++ {
+		m := hmac.New(sha256.New, key)
+		m.Write(binary.BigEndian.AppendUint32(nil, c))
+		m.Write(append([]byte(label), 0))
+		m.Write(u)
+		m.Write(v)
+		m.Write(binary.BigEndian.AppendUint32(nil, uint32(bits)))
+		out = m.Sum(out)
+	}
+	return out[:bits/8]
+}
+
+// tpmKDFe is the TPM 2.0 KDFe with SHA-256 (Part 1, 11.4.10.3).
+func tpmKDFe(z []byte, label string, u, v []byte, bits int) []byte {
+	var out []byte
+	for c := uint32(1); len(out)*8 < bits; c++ {
+		h := sha256.New()
+		h.Write(binary.BigEndian.AppendUint32(nil, c))
+		h.Write(z)
+		h.Write(append([]byte(label), 0))
+		h.Write(u)
+		h.Write(v)
+		out = h.Sum(out)
+	}
+	return out[:bits/8]
+}
+
+// makeCredential is TPM2_MakeCredential done in software: it wraps secret
+// for the object called name so only the TPM holding ek can unwrap it, for
+// the default EK templates (RSA 2048 or P-256, AES-128-CFB, SHA-256). It
+// returns the TPM2B_ID_OBJECT and TPM2B_ENCRYPTED_SECRET.
+func makeCredential(ek crypto.PublicKey, name, secret []byte) (idObject, encSecret []byte, err error) {
+	var seed, enc []byte
+	switch k := ek.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() != 2048 { return nil, nil, fmt.Errorf("rsa ek of %d bits is not supported", k.N.BitLen()) }
+		seed = make([]byte, sha256.Size)
+		if _, err := crand.Read(seed); err != nil { return nil, nil, err }
+		if enc, err = rsa.EncryptOAEP(sha256.New(), crand.Reader, k, seed, []byte("IDENTITY\x00")); err != nil { return nil, nil, err }
+	case *ecdsa.PublicKey:
+		ekECDH, err := k.ECDH()
+		if err != nil || k.Curve != elliptic.P256() { return nil, nil, errors.New("only P-256 ecc eks are supported") }
+		eph, err := ekECDH.Curve().GenerateKey(crand.Reader)
+		if err != nil { return nil, nil, err }
+		z, err := eph.ECDH(ekECDH)
+		if err != nil { return nil, nil, err }
+		pt := eph.PublicKey().Bytes()[1:] // uncompressed x || y
+		x, y := pt[:32], pt[32:]
+		seed = tpmKDFe(z, "IDENTITY", x, k.X.FillBytes(make([]byte, 32)), 256)
+		enc = append(tpm2b(x), tpm2b(y)...) // TPMS_ECC_POINT
+	default:
+		return nil, nil, fmt.Errorf("unsupported endorsement key type %T", ek)
+	}
+	block, err := aes.NewCipher(tpmKDFa(seed, "STORAGE", name, nil, 128))
+	if err != nil { return nil, nil, err }
+	encIdentity := tpm2b(secret)
+	cipher.NewCFBEncrypter(block, make([]byte, aes.BlockSize)).XORKeyStream(encIdentity, encIdentity)
+	m := hmac.New(sha256.New, tpmKDFa(seed, "INTEGRITY", nil, nil, 256))
+	m.Write(encIdentity)
+	m.Write(name)
+	return tpm2b(append(tpm2b(m.Sum(nil)), encIdentity...)), tpm2b(enc), nil
+}
+
+// attestationRequired reports whether mac has a TPM enrolled or any group it
+// belongs to demands a quote.
+func (s *Server) attestationRequired(mac string) (bool, error) {
+	var n int
+	if err := s.DB.QueryRow(`SELECT COUNT(*) FROM tpm_keys WHERE mac=?`, mac).Scan(&n); err != nil { return false, err }
+	if n > 0 { return true, nil }
+	ids, err := s.groupsForMachine(mac)
+	if err != nil { return false, err }
+	for _, id := range ids {
+		var req bool
+		if s.DB.QueryRow(`SELECT require_attestation FROM machine_groups WHERE id=?`, id).Scan(&req) == nil && req { return true, nil }
+	}
+	return false, nil
+}
+
+// requireAttestation writes 403 unless mac needs no attestation or has a
+// verified quote within the TTL.
+func (s *Server) requireAttestation(w http.ResponseWriter, r *http.Request, mac string) bool {
+	req, err := s.attestationRequired(mac)
+	if err != nil { http.Error(w, err.Error(), 500); return false }
+	if !req { return true }
+	var created string
+	_ = s.DB.QueryRow(`SELECT created FROM attestations WHERE mac=? AND ok=1 ORDER BY id DESC LIMIT 1`, mac).Scan(&created)
+	if t, err := time.Parse(time.RFC3339, created); err == nil && time.Since(t) < attestTTL() { return true }
+	s.audit(nil, "attestation_required", "machine", map[string]any{"mac": mac, "path": r.URL.Path})
+	http.Error(w, "tpm attestation required", 403)
+	return false
+}
+
+func (s *Server) recordAttestation(mac string, ok bool, detail, pcr string) {
+	_, _ = s.DB.Exec(`INSERT INTO attestations (mac, ok, detail, pcr_digest, created) VALUES (?,?,?,?,?)`, mac, ok, detail, pcr, time.Now().UTC().Format(time.RFC3339))
+	if !ok {
+		s.audit(nil, "attestation_failed", "machine", map[string]any{"mac": mac, "detail": detail})
+		s.notify("warning", "attestation_failed", "TPM attestation failed for "+mac+": "+detail, map[string]any{"mac": mac})
+	}
+}
+
+func (s *Server) attestationRoutes() {
+	// Admin: GET lists enrolled TPMs (?mac=); POST {"mac", "ek_pem",
+	// "ak_public": base64 TPM2B_PUBLIC, "pcr_digest"} enrolls or re-enrolls,
+	// the AK needing activation again; DELETE {"mac"} removes
+	s.Mux.HandleFunc("/api/v1/admin/machines/tpm", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+			q := `SELECT t.mac, t.ek_pem, t.ak_pem, COALESCE(t.pcr_digest,''), t.enrolled_at, COALESCE(t.ak_activated_at,''), COALESCE((SELECT MAX(created) FROM attestations a WHERE a.mac=t.mac AND a.ok=1),'') FROM tpm_keys t`
+			var args []any
+			if mac := normalizeMAC(r.URL.Query().Get("mac")); mac != "" { q += ` WHERE t.mac=?`; args = append(args, mac) }
+			rows, err := s.DB.Query(q+` ORDER BY t.mac`, args...)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			out := []map[string]any{}
+			for rows.Next() {
+				var mac, ek, ak, pcr, enrolled, activated, last string
+				if err := rows.Scan(&mac, &ek, &ak, &pcr, &enrolled, &activated, &last); err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, map[string]any{"mac": mac, "ek_pem": ek, "ak_pem": ak, "pcr_digest": pcr, "enrolled_at": enrolled, "ak_activated_at": activated, "last_attested": last})
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPost:
+			var body struct {
+				MAC       string `json:"mac"`
+				EKPEM     string `json:"ek_pem"`
+				AKPublic  string `json:"ak_public"`
+				PCRDigest string `json:"pcr_digest"`
+			}
+			if !decodeJSON(w, r, &body) { return }
+			mac := normalizeMAC(body.MAC)
+			if mac == "" { http.Error(w, "mac required", 400); return }
+			_, ekCert, err := parsePublicPEM(body.EKPEM)
+			if err != nil { http.Error(w, "ek_pem: "+err.Error(), 400); return }
+			if ekCert != nil {
+				if err := verifyEKCert(ekCert); err != nil { http.Error(w, "ek certificate: "+err.Error(), 400); return }
+			}
+			raw, err := base64.StdEncoding.DecodeString(body.AKPublic)
+			if err != nil { http.Error(w, "ak_public must be base64", 400); return }
+			ak, err := parseTPMPublic(raw)
+			if err != nil { http.Error(w, "ak_public: "+err.Error(), 400); return }
+			if want := uint32(tpmAttrFixedTPM | tpmAttrRestricted | tpmAttrSign); ak.Attrs&want != want {
+				http.Error(w, "ak_public: not a fixedTPM restricted signing key", 400); return
+			}
+			der, err := x509.MarshalPKIXPublicKey(ak.Key)
+			if err != nil { http.Error(w, "ak_public: "+err.Error(), 400); return }
+			akPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+			pcr := strings.ToLower(strings.TrimSpace(body.PCRDigest))
+			if _, err := hex.DecodeString(pcr); err != nil { http.Error(w, "pcr_digest must be hex", 400); return }
+			_, err = s.DB.Exec(`INSERT INTO tpm_keys (mac, ek_pem, ak_pem, ak_name, pcr_digest, enrolled_at) VALUES (?,?,?,?,?,?)
+				ON CONFLICT(mac) DO UPDATE SET ek_pem=excluded.ek_pem, ak_pem=excluded.ak_pem, ak_name=excluded.ak_name, pcr_digest=excluded.pcr_digest,
+				enrolled_at=excluded.enrolled_at, ak_activated_at=NULL, activation_hash=NULL, activation_expires=NULL`,
+				mac, body.EKPEM, akPEM, hex.EncodeToString(ak.Name), pcr, time.Now().UTC().Format(time.RFC3339))
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "enroll_tpm", "machine", map[string]any{"mac": mac, "ek_certificate": ekCert != nil, "pcr_policy": pcr != ""})
+			writeJSON(w, 200, map[string]any{"mac": mac, "enrolled": true, "ak_name": hex.EncodeToString(ak.Name)})
+		case http.MethodDelete:
+			var body struct{ MAC string `json:"mac"` }
+			if !decodeJSON(w, r, &body) { return }
+			mac := normalizeMAC(body.MAC)
+			if _, err := s.DB.Exec(`DELETE FROM tpm_keys WHERE mac=?`, mac); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "remove_tpm", "machine", map[string]any{"mac": mac})
+			writeJSON(w, 200, map[string]any{"deleted": mac})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// Agent: GET ?mac= makes a credential for the enrolled AK, encrypted to
+	// the EK and valid for five minutes: "id_object" and "encrypted_secret"
+	// as base64 TPM2B structures, "credential" the same in the
+	// tpm2_makecredential file format for tpm2_activatecredential -i. POST
+	// {"mac", "secret": base64} with the secret the TPM unwrapped activates
+	// the AK for quotes.
+	s.Mux.HandleFunc("/api/v1/agent/attest/credential", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			mac := normalizeMAC(r.URL.Query().Get("mac"))
+			if mac == "" { http.Error(w, "mac required", 400); return }
+			if !s.requireAgentFor(w, r, mac) { return }
+			var ekPEM, name string
+			if err := s.DB.QueryRow(`SELECT ek_pem, COALESCE(ak_name,'') FROM tpm_keys WHERE mac=?`, mac).Scan(&ekPEM, &name); err != nil {
+				if errors.Is(err, sql.ErrNoRows) { http.Error(w, "no tpm enrolled for this machine", 403); return }
+				http.Error(w, err.Error(), 500); return
+			}
+			akName, _ := hex.DecodeString(name)
+			if len(akName) == 0 { http.Error(w, "tpm enrolled without ak_public; re-enroll it", 409); return }
+			ek, _, err := parsePublicPEM(ekPEM)
+			if err != nil { http.Error(w, "enrolled ek: "+err.Error(), 500); return }
+			secret := make([]byte, 32)
+			if _, err := crand.Read(secret); err != nil { http.Error(w, err.Error(), 500); return }
+			idObject, encSecret, err := makeCredential(ek, akName, secret)
+			if err != nil { http.Error(w, "enrolled ek: "+err.Error(), 500); return }
+			expires := time.Now().UTC().Add(5 * time.Minute).Format(time.RFC3339)
+			if _, err := s.DB.Exec(`UPDATE tpm_keys SET activation_hash=?, activation_expires=? WHERE mac=?`, hashToken(hex.EncodeToString(secret)), expires, mac); err != nil {
+				http.Error(w, err.Error(), 500); return
+			}
+			file := binary.BigEndian.AppendUint32(nil, 0xbadcc0de)
+			file = binary.BigEndian.AppendUint32(file, 1)
+			file = append(append(file, idObject...), encSecret...)
+			writeJSON(w, 200, map[string]any{"id_object": base64.StdEncoding.EncodeToString(idObject), "encrypted_secret": base64.StdEncoding.EncodeToString(encSecret),
+				"credential": base64.StdEncoding.EncodeToString(file), "expires": expires})
+		case http.MethodPost:
+			var body struct {
+				MAC    string `json:"mac"`
+				Secret string `json:"secret"`
+			}
+			if !decodeJSON(w, r, &body) { return }
+			mac := normalizeMAC(body.MAC)
+			if !s.requireAgentFor(w, r, mac) { return }
+			secret, err := base64.StdEncoding.DecodeString(body.Secret)
+			if err != nil { http.Error(w, "secret must be base64", 400); return }
+			var want, expires string
+			_ = s.DB.QueryRow(`SELECT COALESCE(activation_hash,''), COALESCE(activation_expires,'') FROM tpm_keys WHERE mac=?`, mac).Scan(&want, &expires)
+			if want == "" || expires < time.Now().UTC().Format(time.RFC3339) { http.Error(w, "no credential outstanding for this machine", 400); return }
+			// one try per credential
+			_, _ = s.DB.Exec(`UPDATE tpm_keys SET activation_hash=NULL, activation_expires=NULL WHERE mac=?`, mac)
+			if subtle.ConstantTimeCompare([]byte(hashToken(hex.EncodeToString(secret))), []byte(want)) != 1 {
+				s.recordAttestation(mac, false, "credential activation: wrong secret", "")
+				http.Error(w, "attestation failed: the attestation key is not in the enrolled tpm", 403); return
+			}
+			now := time.Now().UTC().Format(time.RFC3339)
+			if _, err := s.DB.Exec(`UPDATE tpm_keys SET ak_activated_at=? WHERE mac=?`, now, mac); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(nil, "activate_tpm", "machine", map[string]any{"mac": mac})
+			writeJSON(w, 200, map[string]any{"mac": mac, "activated": true, "ak_activated_at": now})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// Agent: nonce to quote over (?mac=); valid for five minutes
+	s.Mux.HandleFunc("/api/v1/agent/attest/challenge", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		mac := normalizeMAC(r.URL.Query().Get("mac"))
+		if mac == "" { http.Error(w, "mac required", 400); return }
+		if !s.requireAgentFor(w, r, mac) { return }
+		b := make([]byte, 32)
+		if _, err := crand.Read(b); err != nil { http.Error(w, err.Error(), 500); return }
+		nonce := hex.EncodeToString(b)
+		expires := time.Now().UTC().Add(5 * time.Minute).Format(time.RFC3339)
+		_, _ = s.DB.Exec(`DELETE FROM attest_challenges WHERE expires < ?`, time.Now().UTC().Format(time.RFC3339))
+		if _, err := s.DB.Exec(`INSERT INTO attest_challenges (nonce, mac, expires) VALUES (?,?,?)`, nonce, mac, expires); err != nil { http.Error(w, err.Error(), 500); return }
+		writeJSON(w, 200, map[string]any{"nonce": nonce, "expires": expires})
+	})
+
+	// Agent: {"mac", "nonce", "quote": base64 TPMS_ATTEST, "signature": base64}
+	s.Mux.HandleFunc("/api/v1/agent/attest", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		var body struct {
+			MAC       string `json:"mac"`
+			Nonce     string `json:"nonce"`
+			Quote     string `json:"quote"`
+			Signature string `json:"signature"`
+		}
+		if !decodeJSON(w, r, &body) { return }
+		mac := normalizeMAC(body.MAC)
+		if !s.requireAgentFor(w, r, mac) { return }
+		res, err := s.DB.Exec(`DELETE FROM attest_challenges WHERE nonce=? AND mac=? AND expires >= ?`, body.Nonce, mac, time.Now().UTC().Format(time.RFC3339))
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if n, _ := res.RowsAffected(); n == 0 { http.Error(w, "unknown or expired nonce", 400); return }
+		var akPEM, golden, activated string
+		if err := s.DB.QueryRow(`SELECT ak_pem, COALESCE(pcr_digest,''), COALESCE(ak_activated_at,'') FROM tpm_keys WHERE mac=?`, mac).Scan(&akPEM, &golden, &activated); err != nil {
+			if errors.Is(err, sql.ErrNoRows) { http.Error(w, "no tpm enrolled for this machine", 403); return }
+			http.Error(w, err.Error(), 500); return
+		}
+		if activated == "" { http.Error(w, "attestation key not activated; complete /api/v1/agent/attest/credential first", 403); return }
+		fail := func(detail string) { s.recordAttestation(mac, false, detail, ""); http.Error(w, "attestation failed: "+detail, 403) }
+		quote, err1 := base64.StdEncoding.DecodeString(body.Quote)
+		sig, err2 := base64.StdEncoding.DecodeString(body.Signature)
+		if err1 != nil || err2 != nil { http.Error(w, "quote and signature must be base64", 400); return }
+		ak, _, err := parsePublicPEM(akPEM)
+		if err != nil { http.Error(w, "enrolled ak: "+err.Error(), 500); return }
+		if err := verifyQuoteSignature(ak, quote, sig); err != nil { fail("signature: " + err.Error()); return }
+		q, err := parseTPMSAttest(quote)
+		if err != nil { fail("quote: " + err.Error()); return }
+		nonce, _ := hex.DecodeString(body.Nonce)
+		if !bytes.Equal(q.ExtraData, nonce) { fail("quote is not bound to the nonce"); return }
+		pcr := hex.EncodeToString(q.PCRDigest)
+		if golden != "" && pcr != golden { fail("pcr digest " + pcr + " does not match policy"); return }
+		s.recordAttestation(mac, true, "", pcr)
+		s.audit(nil, "attested", "machine", map[string]any{"mac": mac, "pcr_digest": pcr})
+		writeJSON(w, 200, map[string]any{"mac": mac, "ok": true, "valid_until": time.Now().UTC().Add(attestTTL()).Format(time.RFC3339)})
+	})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ---- Audit event types ----
+// Every audit entry is typed "<resource>.<action>" and, when the type is
+// registered below, its meta is checked against the type's fields before it
+// is written. Entries that conform are stored with the type's schema
+// version; entries that don't are still stored (the audit trail never drops
+// events) with version 0 and a log line, so a consumer that relies on the
+// documented fields can skip them. Adding a field is backward compatible;
+// renaming, retyping or removing one bumps the version.
+// /api/v1/admin/audit/types publishes the registry.
+type auditField struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"` // string|integer|number|boolean|array|object|any
+	Required bool   `json:"required"`
+}
+
+type auditEventType struct {
+	Type        string       `json:"type"`
+	Version     int          `json:"version"`
+	Description string       `json:"description"`
+	Fields      []auditField `json:"fields"`
+}
+
+var auditEventTypes = map[string]auditEventType{}
+
+// registerAuditEvent adds a type to the registry. Fields are "name:type",
+// with a trailing "?" for optional ones.
+func registerAuditEvent(resource, action string, version int, description string, fields ...string) {
+	t := auditEventType{Type: resource + "." + action, Version: version, Description: description, Fields: []auditField{}}
+	for _, f := range fields {
+		name, typ, _ := strings.Cut(f, ":")
+		opt := strings.HasSuffix(typ, "?")
+		t.Fields = append(t.Fields, auditField{Name: name, Type: strings.TrimSuffix(typ, "?"), Required: !opt})
+	}
+	auditEventTypes[t.Type] = t
+}
+
+func init() {
+	for _, r := range []string{"saved_search", "site", "software_set", "task_sequence", "template"} {
+		registerAuditEvent(r, "create", 1, "A "+strings.ReplaceAll(r, "_", " ")+" was created", "id:string", "name:string")
+		registerAuditEvent(r, "update", 1, "A "+strings.ReplaceAll(r, "_", " ")+" was updated", "id:string", "name:string")
+		registerAuditEvent(r, "delete", 1, "A "+strings.ReplaceAll(r, "_", " ")+" was deleted", "id:string")
+	}
+	registerAuditEvent("task_sequence", "assign", 1, "A task sequence was assigned to a machine or group (empty id clears it)", "id:string", "mac:string", "group_id:string")
+	registerAuditEvent("task_run", "delete", 1, "A task sequence run was deleted so it can be repeated", "id:string")
+	registerAuditEvent("driver_pack", "overlay_build", 1, "A driver pack's initrd overlay build was queued", "id:string", "job:string")
+	registerAuditEvent("auth", "login", 1, "A user logged in", "email:string", "method:string?")
+	registerAuditEvent("auth", "change_password", 1, "A user changed their password")
+	registerAuditEvent("auth", "impersonated_request", 1, "A state-changing request was made under impersonation", "as_user:any", "method:string", "path:string")
+	registerAuditEvent("user", "impersonate", 1, "An admin started impersonating a user", "id:integer", "email:string", "role:string", "ttl:string")
+	registerAuditEvent("user", "role_update", 1, "A user's role was changed", "id:integer", "role:string")
+	registerAuditEvent("user", "reset_password", 1, "A user's password was reset", "id:integer", "delivery:string?", "expires_at:string?")
+	registerAuditEvent("session", "revoke", 1, "An admin ended one session or all of a user's sessions", "id:string?", "user_id:integer", "count:integer")
+	registerAuditEvent("user", "delete", 1, "A user was deleted; owned resources reassigned or orphaned", "id:integer", "reassign_to:integer", "owned:object")
+	registerAuditEvent("user", "provision", 1, "A user was created on first SSO or directory login", "email:string", "role:string", "source:string")
+	registerAuditEvent("user", "approve", 1, "A pending user was approved", "id:integer", "email:string", "role:string")
+	registerAuditEvent("user", "reject", 1, "A pending user was rejected", "id:integer", "email:string")
+	registerAuditEvent("image", "upload", 1, "An image was uploaded", "id:string", "name:string", "sizeMB:integer", "version:integer")
+	registerAuditEvent("image", "promote", 1, "A stored version of an image was made active", "id:string", "version:integer", "from:integer", "reason:string")
+	registerAuditEvent("image", "publish", 1, "A draft image version was published and made active", "id:string", "version:integer", "from:integer", "reason:string")
+	registerAuditEvent("image", "rollback", 1, "An image was rolled back to its previous version", "id:string", "version:integer", "from:integer", "reason:string")
+	registerAuditEvent("image", "tag", 1, "Tags were set on an image (tags) or added to and removed from images (add, remove)", "images:array", "tags:array?", "add:array?", "remove:array?")
+	registerAuditEvent("image", "version_delete", 1, "An inactive image version was deleted", "id:string", "version:integer")
+	registerAuditEvent("image", "inspect_start", 1, "Inspection of the active image version was queued", "id:string", "version:integer", "job:string")
+	registerAuditEvent("image", "delete", 1, "An image was deleted", "id:string")
+	registerAuditEvent("image", "attach", 1, "An attachment was added to an image", "id:string", "attachment:string", "name:string")
+	registerAuditEvent("image", "detach", 1, "An attachment was removed from an image", "id:string", "attachment:string")
+	registerAuditEvent("image", "convert_start", 1, "An image conversion was queued", "id:string", "target:string", "job:string")
+	registerAuditEvent("image", "convert", 1, "An image conversion finished", "id:string", "source:string", "from:string", "to:string")
+	registerAuditEvent("image", "sbom_start", 1, "SBOM generation was queued", "id:string", "format:string", "job:string")
+	registerAuditEvent("image", "extract_start", 1, "Boot asset extraction was queued", "id:string", "prefix:string", "job:string")
+	registerAuditEvent("image_build", "create", 1, "An image build was created", "id:string", "name:string")
+	registerAuditEvent("image_build", "promote", 1, "A build artifact was promoted to an image", "id:string", "image_id:string", "version:integer")
+	registerAuditEvent("boot_asset", "create", 1, "A boot asset was added", "path:string", "size:integer", "sha256:string")
+	registerAuditEvent("boot_asset", "replace", 1, "A boot asset was replaced", "path:string", "size:integer", "sha256:string")
+	registerAuditEvent("boot_asset", "delete", 1, "A boot asset was deleted", "path:string", "version:integer")
+	registerAuditEvent("boot_asset", "publish", 1, "A set of boot assets was published", "source:string", "paths:array", "replaced:array", "entries:array")
+	registerAuditEvent("kernel_args", "create", 1, "A kernel argument overlay was created", "id:string", "scope:string", "target:string", "args:string")
+	registerAuditEvent("kernel_args", "update", 1, "A kernel argument overlay was updated", "id:string", "scope:string", "target:string", "args:string")
+	registerAuditEvent("kernel_args", "delete", 1, "A kernel argument overlay was deleted", "id:string")
+	registerAuditEvent("deployment", "create", 1, "A deployment was created", "id:string", "mac:string", "template_id:string?", "image_id:string?", "deploy_link:string?", "ip:string?")
+	registerAuditEvent("deployment", "reveal_credentials", 1, "Deployment credentials were revealed", "id:string", "mac:string")
+	registerAuditEvent("deployment", "render_answer", 1, "An answer file was rendered for an agent", "id:string", "kind:string")
+	registerAuditEvent("deployment", "finish", 1, "An agent reported a deployment result", "id:string", "status:string")
+	registerAuditEvent("deploy_link", "create", 1, "A kiosk deploy link was created", "id:string", "image_ids:array", "expires_at:string")
+	registerAuditEvent("deploy_link", "revoke", 1, "A kiosk deploy link was revoked", "id:string")
+	registerAuditEvent("machine", "register", 1, "A machine was registered before its first boot", "mac:string")
+	registerAuditEvent("machine", "update", 1, "A machine record was edited", "mac:string", "fields:array")
+	registerAuditEvent("machine", "delete", 1, "A machine record was deleted", "mac:string")
+	registerAuditEvent("machine", "revert_profile", 1, "A machine's boot profile was switched back after a successful deployment", "mac:string", "from:string", "to:string")
+	registerAuditEvent("machine", "wipe", 1, "A disk wipe was reported", "mac:string", "certificate_id:string", "method:string", "disk_serial:string", "result:string")
+	registerAuditEvent("machine", "enrollment_rejected", 1, "A request failed the enrollment secret check", "mac:string", "path:string", "ip:string", "presented:boolean")
+	registerAuditEvent("machine", "set_enrollment_secret", 1, "An enrollment secret was set", "mac:string", "source:string")
+	registerAuditEvent("machine", "clear_enrollment_secret", 1, "An enrollment secret was cleared", "mac:string")
+	registerAuditEvent("machine", "enroll_tpm", 1, "A TPM attestation key was enrolled", "mac:string", "ek_certificate:boolean", "pcr_policy:boolean")
+	registerAuditEvent("machine", "remove_tpm", 1, "A TPM attestation key was removed", "mac:string")
+	registerAuditEvent("machine", "attested", 1, "A machine passed TPM attestation", "mac:string", "pcr_digest:string")
+	registerAuditEvent("machine", "attestation_failed", 1, "A machine failed TPM attestation", "mac:string", "detail:string")
+	registerAuditEvent("machine", "import", 1, "Machines were imported from a CSV or DHCP lease file", "format:string", "created:integer", "updated:integer", "errors:integer")
+	registerAuditEvent("machine", "tag", 1, "Tags were added to or removed from machines", "macs:array", "add:array", "remove:array")
+	registerAuditEvent("machine", "wake", 1, "A Wake-on-LAN packet was sent or queued for a machine", "mac:string", "via:string")
+	registerAuditEvent("machine", "attestation_required", 1, "A request was refused for lack of a fresh attestation", "mac:string", "path:string")
+	registerAuditEvent("machine_field", "update", 1, "A machine field was updated", "mac:string", "name:string")
+	registerAuditEvent("certificate", "enroll", 1, "A device certificate was issued", "mac:string", "serial:string", "subject:string", "source:string")
+	registerAuditEvent("download", "download_token_rejected", 1, "A download token was used from the wrong client", "path:string", "ip:string", "bound_ip:string", "mac:string")
+	registerAuditEvent("group", "create", 1, "A machine group was created", "id:string", "name:string")
+	registerAuditEvent("group", "delete", 1, "A machine group was deleted", "id:string")
+	registerAuditEvent("relay", "create", 1, "A relay was created", "id:string", "name:string")
+	registerAuditEvent("relay", "delete", 1, "A relay was deleted", "id:string")
+	registerAuditEvent("relay", "register", 1, "A relay registered", "id:string", "addr:string")
+	registerAuditEvent("rollout", "create", 1, "A rollout was created", "id:string", "name:string", "machines:integer", "waves:integer")
+	registerAuditEvent("availability_window", "create", 1, "An availability window was added to an image or menu entry", "id:string", "name:string", "kind:string", "target:string")
+	registerAuditEvent("availability_window", "update", 1, "An availability window was changed", "id:string", "name:string", "kind:string", "target:string")
+	registerAuditEvent("availability_window", "delete", 1, "An availability window was removed", "id:string")
+	registerAuditEvent("api_key", "create", 1, "An API key was issued", "id:string", "name:string", "scopes:array", "expires_at:string")
+	registerAuditEvent("api_key", "revoke", 1, "An API key was revoked", "id:string", "name:string")
+	registerAuditEvent("regional_preset", "create", 1, "A regional preset was added", "id:string", "name:string")
+	registerAuditEvent("regional_preset", "update", 1, "A regional preset was changed", "id:string", "name:string")
+	registerAuditEvent("regional_preset", "delete", 1, "A regional preset was removed", "id:string", "name:string")
+	registerAuditEvent("auth", "mfa_enable", 1, "A user turned on two-factor authentication", "email:string")
+	registerAuditEvent("auth", "mfa_disable", 1, "A user turned off two-factor authentication", "email:string")
+	registerAuditEvent("auth", "mfa_failed", 1, "A login failed on a wrong two-factor code", "email:string")
+	registerAuditEvent("auth", "mfa_policy", 1, "The roles that require two-factor authentication were changed", "roles:array")
+	registerAuditEvent("user", "reset_mfa", 1, "An admin removed a user's two-factor authentication", "id:integer")
+	registerAuditEvent("image_download", "export", 1, "The raw image download history was read or exported", "format:string", "filters:string", "rows:integer", "mode:string")
+	registerAuditEvent("role", "create", 1, "A role was added", "name:string", "permissions:array")
+	registerAuditEvent("role", "update", 1, "A role's permissions were changed", "name:string", "permissions:array")
+	registerAuditEvent("role", "delete", 1, "A role was removed", "name:string")
+	registerAuditEvent("user", "rehash_password", 1, "A password hash was upgraded to the configured parameters at login", "id:integer", "from:string", "to:string")
+	registerAuditEvent("template_secret", "create", 1, "A template secret was added", "name:string", "group_ids:array", "site_ids:array")
+	registerAuditEvent("template_secret", "update", 1, "A template secret's value or scope was changed", "name:string", "value_changed:boolean", "group_ids:array", "site_ids:array")
+	registerAuditEvent("template_secret", "delete", 1, "A template secret was removed", "name:string")
+	registerAuditEvent("template_secret", "resolve", 1, "A template secret was resolved into a deployment's answer file", "name:string", "deployment_id:string", "mac:string", "template_id:string")
+	registerAuditEvent("regional_preset", "assign", 1, "A regional preset was assigned to a site or group, or unassigned", "id:string", "site_id:string", "group_id:string")
+	registerAuditEvent("wake_schedule", "create", 1, "A wake schedule was created", "id:string", "name:string", "group_id:string", "run_at:string", "repeat:string")
+	registerAuditEvent("wake_schedule", "update", 1, "A wake schedule was changed", "id:string", "name:string", "group_id:string", "run_at:string", "repeat:string", "enabled:boolean")
+	registerAuditEvent("wake_schedule", "delete", 1, "A wake schedule was deleted", "id:string")
+	registerAuditEvent("wake_schedule", "run_now", 1, "A wake schedule was started by hand", "id:string")
+	registerAuditEvent("wake_schedule", "run", 1, "A wake schedule woke its machine group", "id:string", "group_id:string", "machines:integer", "sent:integer", "failed:integer")
+	registerAuditEvent("rollout", "start_wave", 1, "A rollout wave started", "id:string", "wave:integer", "machines:integer")
+	for _, a := range []string{"pause", "resume", "cancel"} {
+		registerAuditEvent("rollout", a, 1, "A rollout was "+map[string]string{"pause": "paused", "resume": "resumed", "cancel": "cancelled"}[a], "id:string")
+	}
+	registerAuditEvent("awx_job", "launch", 1, "An AWX job was launched", "deployment_id:string", "job:any")
+	registerAuditEvent("bundle", "export", 1, "A configuration bundle was exported")
+	registerAuditEvent("bundle", "import", 1, "A configuration bundle was imported", "source:string", "exported_at:string", "changes:integer")
+	registerAuditEvent("job", "winpe_build", 1, "A WinPE build was queued", "job:string", "prefix:string?", "arch:string?", "driver_packs:any?", "image_id:string?")
+	registerAuditEvent("job", "update_sync", 1, "An update catalog sync was queued", "job:string", "catalog:string")
+	registerAuditEvent("job", "cancel", 1, "A queued or running background job was cancelled", "id:string", "kind:string")
+	registerAuditEvent("boot_policy", "create", 1, "A boot menu policy was created", "id:string", "name:string")
+	registerAuditEvent("boot_policy", "update", 1, "A boot menu policy was updated", "id:string", "name:string")
+	registerAuditEvent("boot_policy", "delete", 1, "A boot menu policy was deleted", "id:string")
+	registerAuditEvent("boot_profile", "create", 1, "A boot profile was created", "id:string", "name:string", "default:boolean", "image_id:string?", "image_version:integer?", "image_sha256:string?")
+	registerAuditEvent("boot_profile", "update", 1, "A boot profile was updated", "id:string", "name:string", "default:boolean", "image_id:string?", "image_version:integer?", "image_sha256:string?")
+	registerAuditEvent("boot_profile", "exam_boot", 1, "A machine was served an exam profile", "id:string", "mac:string", "image_id:string", "version:integer", "result:string", "ip:string")
+	registerAuditEvent("boot_profile", "delete", 1, "A boot profile was deleted", "id:string")
+	registerAuditEvent("dhcp_lease", "release", 1, "A DHCP lease was released by an admin", "ip:string")
+	registerAuditEvent("update_bundle", "delete", 1, "An update bundle was deleted", "id:string")
+	registerAuditEvent("report_link", "create", 1, "A share link to a report was created", "id:string", "kind:string", "params:object", "expires_at:string", "max_views:integer")
+	registerAuditEvent("report_link", "revoke", 1, "A report share link was revoked", "id:string")
+	registerAuditEvent("report_link", "view", 1, "A guest opened a report through a share link", "id:string", "kind:string", "ip:string")
+	registerAuditEvent("report_link", "view_denied", 1, "A revoked, expired or used-up report share link was opened", "id:string", "reason:string", "ip:string")
+	registerAuditEvent("machine", "bulk_delete", 1, "Machines were deleted in bulk", "macs:array")
+	registerAuditEvent("maintenance", "gc", 1, "An admin ran garbage collection", "boot_asset_versions:integer", "bytes:integer", "upload_sessions:integer")
+	registerAuditEvent("maintenance", "retention", 1, "An admin applied the image download history retention policy", "deleted:integer", "anonymized:integer")
+	registerAuditEvent("db", "migrate", 1, "An admin applied pending schema migrations", "to:integer", "applied:array")
+	registerAuditEvent("user", "site_scope", 1, "A user's sites were set, making them a site admin or global again", "id:integer", "site_ids:array")
+	registerAuditEvent("standby", "promote", 1, "A warm standby was promoted to primary", "snapshot_at:string", "sha256:string", "from:string")
+	registerAuditEvent("deployment", "issue_token", 1, "A deployment's agent token was handed to its installer", "id:string", "mac:string", "ip:string")
+	registerAuditEvent("machine", "activate_tpm", 1, "A machine proved its attestation key is in its enrolled TPM", "mac:string")
+}
+
+func auditValueType(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		if x == float64(int64(x)) { return "integer" }
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// checkAuditMeta compares an encoded meta object with t's fields.
+func checkAuditMeta(t auditEventType, js []byte) []string {
+	var m map[string]any
+	if err := json.Unmarshal(js, &m); err != nil { return []string{err.Error()} }
+	var problems []string
+	known := map[string]bool{}
+	for _, f := range t.Fields {
+		known[f.Name] = true
+		v, ok := m[f.Name]
+		if !ok {
+			if f.Required { problems = append(problems, "missing "+f.Name) }
+			continue
+		}
+		got := auditValueType(v)
+		if f.Type == "any" || got == f.Type || (f.Type == "number" && got == "integer") || (got == "null" && (f.Type == "array" || f.Type == "object")) { continue }
+		problems = append(problems, fmt.Sprintf("%s is %s, want %s", f.Name, got, f.Type))
+	}
+	for k := range m {
+		if !known[k] { problems = append(problems, "unexpected "+k) }
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// auditSchema returns the event type and schema version to store with an
+// entry; the version is 0 when the type is unregistered or meta doesn't fit.
+func auditSchema(action, resource string, js []byte) (string, int) {
+	typ := resource + "." + action
+	t, ok := auditEventTypes[typ]
+	if !ok { return typ, 0 }
+	if problems := checkAuditMeta(t, js); len(problems) > 0 {
+		log.Printf("audit: %s meta does not match schema v%d: %s", typ, t.Version, strings.Join(problems, "; "))
+		return typ, 0
+	}
+	return typ, t.Version
+}
+
+func (s *Server) auditEventRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/audit/types", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		out := make([]auditEventType, 0, len(auditEventTypes))
+		for _, t := range auditEventTypes { out = append(out, t) }
+		sort.Slice(out, func(i, j int) bool { return out[i].Type < out[j].Type })
+		writeJSON(w, 200, out)
+	})
+}
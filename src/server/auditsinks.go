@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---- Audit forwarding ----
+// Every audit entry can also be shipped to a chain of remote sinks, set with
+// BOOTAH_AUDIT_SINKS="name=target,...":
+//
+//	udp://host:514, tcp://host:601,  RFC 5424 syslog, one message per entry
+//	tls://host:6514                  (octet-counted framing on TCP and TLS)
+//	https://host/hook, http://...    a JSON POST of {"entries": [...]} batches,
+//	                                 signed like plugin hooks when
+//	                                 BOOTAH_AUDIT_SINK_<NAME>_SECRET is set
+//
+// The audit table itself is the buffer: the leader forwards entries in id
+// order from each sink's saved cursor every BOOTAH_AUDIT_FORWARD_INTERVAL
+// (default 5s), so nothing is lost across restarts or outages. Every
+// instance writes audit rows and PostgreSQL ids can commit out of order, so
+// the cursor trails delivery by BOOTAH_AUDIT_FORWARD_LOOKBACK (default 5m):
+// entries above it are re-scanned and the ids already sent are skipped, so
+// one that commits late is still forwarded. A failing sink
+// is retried with exponential backoff up to 5 minutes and doesn't hold up the
+// others. New sinks start at the current end of the log unless
+// BOOTAH_AUDIT_SINK_<NAME>_BACKFILL=true. BOOTAH_AUDIT_SINK_<NAME>_FACILITY
+// sets the syslog facility number (default 16, local0).
+const auditSinkBatch = 100
+
+type auditSink struct {
+	name, target, secret string
+	scheme, addr         string
+	facility             int
+
+	mu        sync.Mutex
+	delivered int64
+	failed    int64
+	failures  int
+	retryAt   time.Time
+	lastError string
+	lastAt    string
+}
+
+var auditSinks []*auditSink
+
+func initAuditSinks(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS audit_sink_cursors (
+		sink TEXT PRIMARY KEY,
+		last_id INTEGER NOT NULL,
+		updated_at TEXT NOT NULL
+	)`)
+	if err != nil { return err }
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS audit_sink_sent (
+		sink TEXT NOT NULL,
+		audit_id INTEGER NOT NULL,
+		sent_at TEXT NOT NULL,
+		PRIMARY KEY (sink, audit_id)
+	)`)
+	return err
+}
+
+func auditSinkEnv(name, suffix string) string {
+	return getenv("BOOTAH_AUDIT_SINK_"+strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))+"_"+suffix, "")
+}
+
+// loadAuditSinks builds the sink chain from BOOTAH_AUDIT_SINKS.
+func loadAuditSinks() error {
+	auditSinks = nil
+	seen := map[string]bool{}
+	for _, spec := range splitList(getenv("BOOTAH_AUDIT_SINKS", "")) {
+		name, target, ok := strings.Cut(spec, "=")
+		name, target = strings.TrimSpace(name), strings.TrimSpace(target)
+		if !ok || name == "" || target == "" { return fmt.Errorf("BOOTAH_AUDIT_SINKS: want name=target, got %q", spec) }
+		if seen[name] { return fmt.Errorf("audit sink %q defined twice", name) }
+		seen[name] = true
+		u, err := url.Parse(target)
+		if err != nil { return fmt.Errorf("audit sink %q: %v", name, err) }
+		sk := &auditSink{name: name, target: target, scheme: u.Scheme, addr: u.Host, secret: auditSinkEnv(name, "SECRET"), facility: 16}
+		switch u.Scheme {
+		case "udp", "tcp", "tls":
+			if u.Port() == "" { return fmt.Errorf("audit sink %q: syslog target needs a port", name) }
+			if v := auditSinkEnv(name, "FACILITY"); v != "" {
+				if sk.facility, err = strconv.Atoi(v); err != nil || sk.facility < 0 || sk.facility > 23 { return fmt.Errorf("audit sink %q: facility must be 0-23", name) }
+			}
+		case "http", "https":
+		default:
+			return fmt.Errorf("audit sink %q: target must be udp://, tcp://, tls://, http:// or https://", name)
+		}
+		auditSinks = append(auditSinks, sk)
+	}
+	return nil
+}
+
+// startAuditSinks forwards new audit entries on the leader until ctx is
+// cancelled.
+func (s *Server) startAuditSinks(ctx context.Context) {
+	if len(auditSinks) == 0 { return }
+	names := make([]string, len(auditSinks))
+	for i, sk := range auditSinks { names[i] = sk.name }
+	log.Printf("audit sinks: %s", strings.Join(names, ", "))
+	go s.runAsLeader(ctx, "audit-forward", envDuration("BOOTAH_AUDIT_FORWARD_INTERVAL", 5*time.Second), func() {
+		for _, sk := range auditSinks { s.forwardAudit(ctx, sk) }
+	})
+}
+
+// auditCursor returns the id at or below which every entry has been
+// delivered to sk, starting new sinks at the end of the log (or its
+// beginning for backfills).
+func (s *Server) auditCursor(sk *auditSink) (int64, error) {
+	var last int64
+	err := s.DB.QueryRow(`SELECT last_id FROM audit_sink_cursors WHERE sink=?`, sk.name).Scan(&last)
+	if err != sql.ErrNoRows { return last, err }
+	if auditSinkEnv(sk.name, "BACKFILL") != "true" {
+		if err := s.DB.QueryRow(`SELECT COALESCE(MAX(id),0) FROM audit`).Scan(&last); err != nil { return 0, err }
+	}
+	_, err = s.DB.Exec(`INSERT INTO audit_sink_cursors (sink, last_id, updated_at) VALUES (?,?,?)`, sk.name, last, time.Now().UTC().Format(time.RFC3339))
+	return last, err
+}
+
+// forwardAudit sends sk everything past its cursor it hasn't been sent yet, a
+// batch at a time, until it's caught up or a send fails. Once caught up the
+// cursor moves to the highest id sent more than the lookback ago.
+func (s *Server) forwardAudit(ctx context.Context, sk *auditSink) {
+	sk.mu.Lock()
+	wait := time.Now().Before(sk.retryAt)
+	sk.mu.Unlock()
+	if wait { return }
+	last, err := s.auditCursor(sk)
+	if err != nil { log.Printf("audit sink %s: %v", sk.name, err); return }
+	for ctx.Err() == nil {
+		entries, err := s.auditEntriesUnsent(sk.name, last, auditSinkBatch)
+		if err != nil { log.Printf("audit sink %s: %v", sk.name, err); return }
+		if len(entries) == 0 {
+			if err := s.advanceAuditCursor(sk.name, last); err != nil { log.Printf("audit sink %s: %v", sk.name, err) }
+			return
+		}
+		sctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		err = sk.send(sctx, entries)
+		cancel()
+		sk.mu.Lock()
+		sk.lastAt = time.Now().UTC().Format(time.RFC3339)
+		if err != nil {
+			sk.failed++
+			sk.failures++
+			sk.lastError = err.Error()
+			backoff := time.Duration(1<<min(sk.failures, 9)) * time.Second
+			if backoff > 5*time.Minute { backoff = 5 * time.Minute }
+			sk.retryAt = time.Now().Add(backoff)
+			sk.mu.Unlock()
+			log.Printf("audit sink %s: %v (retrying in %s)", sk.name, err, backoff)
+			return
+		}
+		sk.delivered += int64(len(entries))
+		sk.failures, sk.lastError = 0, ""
+		sk.mu.Unlock()
+		if err := s.markAuditSent(sk.name, entries); err != nil {
+			log.Printf("audit sink %s: %v", sk.name, err)
+			return
+		}
+	}
+}
+
+// auditEntriesUnsent returns up to limit audit entries with ids above after
+// that haven't been sent to sink, oldest first.
+func (s *Server) auditEntriesUnsent(sink string, after int64, limit int) ([]map[string]any, error) {
+	rows, err := s.DB.Query(`SELECT a.id, a.ts, a.actor_id, COALESCE(a.actor_label,''), a.action, a.resource, a.meta, COALESCE(a.event_type, a.resource||'.'||a.action), a.schema_version
+		FROM audit a WHERE a.id>? AND NOT EXISTS (SELECT 1 FROM audit_sink_sent d WHERE d.sink=? AND d.audit_id=a.id)
+		ORDER BY a.id LIMIT ?`, after, sink, limit)
+	if err != nil { return nil, err }
+	return scanAuditEntries(rows)
+}
+
+func (s *Server) markAuditSent(sink string, entries []map[string]any) error {
+	tx, err := s.DB.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, e := range entries {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO audit_sink_sent (sink, audit_id, sent_at) VALUES (?,?,?)`, sink, e["id"], now); err != nil { return err }
+	}
+	return tx.Commit()
+}
+
+// advanceAuditCursor moves sink's cursor up to the highest id sent before
+// the lookback window and forgets the sent ids at or below it. An entry
+// below that id still uncommitted after the window is not forwarded.
+func (s *Server) advanceAuditCursor(sink string, last int64) error {
+	cutoff := time.Now().UTC().Add(-envDuration("BOOTAH_AUDIT_FORWARD_LOOKBACK", 5*time.Minute)).Format(time.RFC3339)
+	var floor int64
+	if err := s.DB.QueryRow(`SELECT COALESCE(MAX(audit_id),0) FROM audit_sink_sent WHERE sink=? AND sent_at<?`, sink, cutoff).Scan(&floor); err != nil { return err }
+	if floor <= last { return nil }
+	tx, err := s.DB.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE audit_sink_cursors SET last_id=?, updated_at=? WHERE sink=?`, floor, time.Now().UTC().Format(time.RFC3339), sink); err != nil { return err }
+	if _, err := tx.Exec(`DELETE FROM audit_sink_sent WHERE sink=? AND audit_id<=?`, sink, floor); err != nil { return err }
+	return tx.Commit()
+}
+
+func (sk *auditSink) send(ctx context.Context, entries []map[string]any) error {
+	if sk.scheme == "http" || sk.scheme == "https" { return sk.post(ctx, entries) }
+	return sk.syslog(ctx, entries)
+}
+
+func (sk *auditSink) post(ctx context.Context, entries []map[string]any) error {
+	js, _ := json.Marshal(map[string]any{"entries": entries})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sk.target, bytes.NewReader(js))
+	if err != nil { return err }
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Bootah-Event", "audit")
+	if sk.secret != "" {
+		m := hmac.New(sha256.New, []byte(sk.secret))
+		m.Write(js)
+		req.Header.Set("X-Bootah-Signature", "sha256="+hex.EncodeToString(m.Sum(nil)))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil { return err }
+	resp.Body.Close()
+	if resp.StatusCode >= 300 { return fmt.Errorf("%s returned %s", sk.target, resp.Status) }
+	return nil
+}
+
+// syslog sends entries as RFC 5424 messages at severity notice, the event
+// type as MSGID and the entry as JSON.
+func (sk *auditSink) syslog(ctx context.Context, entries []map[string]any) error {
+	var d net.Dialer
+	var conn net.Conn
+	var err error
+	switch sk.scheme {
+	case "tls":
+		conn, err = (&tls.Dialer{NetDialer: &d, Config: &tls.Config{MinVersion: tls.VersionTLS12}}).DialContext(ctx, "tcp", sk.addr)
+	default:
+		conn, err = d.DialContext(ctx, sk.scheme, sk.addr)
+	}
+	if err != nil { return err }
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok { _ = conn.SetDeadline(dl) }
+	host, _ := os.Hostname()
+	if host == "" { host = "-" }
+	for _, e := range entries {
+		js, _ := json.Marshal(e)
+		msg := fmt.Sprintf("<%d>1 %s %s bootah - %s - %s", sk.facility*8+5, e["ts"], host, e["type"], js)
+		if sk.scheme != "udp" { msg = strconv.Itoa(len(msg)) + " " + msg }
+		if _, err := conn.Write([]byte(msg)); err != nil { return err }
+	}
+	return nil
+}
+
+func (s *Server) auditSinkRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/audit/sinks", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		out := []map[string]any{}
+		for _, sk := range auditSinks {
+			// null until the leader first reaches the sink
+			var pending any
+			var n int64
+			if err := s.DB.QueryRow(`SELECT COUNT(*) FROM audit a WHERE a.id>(SELECT last_id FROM audit_sink_cursors WHERE sink=?)
+				AND NOT EXISTS (SELECT 1 FROM audit_sink_sent d WHERE d.sink=? AND d.audit_id=a.id)`, sk.name, sk.name).Scan(&n); err == nil { pending = n }
+			sk.mu.Lock()
+			e := map[string]any{"name": sk.name, "type": sk.scheme, "address": sk.addr, "signed": sk.secret != "", "pending": pending,
+				"delivered": sk.delivered, "failed": sk.failed, "last_error": sk.lastError, "last_attempt": sk.lastAt}
+			if sk.failures > 0 { e["retry_at"] = sk.retryAt.UTC().Format(time.RFC3339) }
+			sk.mu.Unlock()
+			out = append(out, e)
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i]["name"].(string) < out[j]["name"].(string) })
+		writeJSON(w, 200, out)
+	})
+}
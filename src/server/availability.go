@@ -0,0 +1,254 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ---- Availability windows ----
+// An image or a boot menu entry with availability windows can only be booted
+// while one of its windows is open; targets without windows are always
+// available. A window is a date range (from/until, inclusive, either side
+// open) optionally narrowed to weekdays and a daily HH:MM-HH:MM span, all in
+// tz (server local when empty) — e.g. an exam-mode image bookable Mon-Fri
+// 08:00-17:00 during the two exam weeks. Windows are enforced when the boot
+// script is rendered: closed entries leave the menu (the default moves to the
+// first open one), and a machine whose pending deployment uses a closed image
+// does not get the deploy entries until the window opens. Kiosk links only
+// offer open images, and deployment plans warn about closed ones.
+type AvailabilityWindow struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Kind    string   `json:"kind"`            // image|entry
+	Target  string   `json:"target"`          // image ID or entry name
+	From    string   `json:"from,omitempty"`  // YYYY-MM-DD, empty = open start
+	Until   string   `json:"until,omitempty"` // YYYY-MM-DD inclusive, empty = open end
+	Days    []string `json:"days,omitempty"`  // mon..sun, empty = every day
+	Start   string   `json:"start,omitempty"` // HH:MM, with End
+	End     string   `json:"end,omitempty"`   // HH:MM, before Start = wraps midnight
+	TZ      string   `json:"tz,omitempty"`    // IANA zone, empty = server local
+	Open    bool     `json:"open"`            // open right now (responses only)
+	Created string   `json:"created_at"`
+}
+
+func (aw *AvailabilityWindow) validateFields(v *validator) {
+	v.required("name", aw.Name)
+	v.oneOf("kind", aw.Kind, "image", "entry")
+	v.required("target", aw.Target)
+	for f, d := range map[string]string{"from": aw.From, "until": aw.Until} {
+		if _, err := time.Parse("2006-01-02", d); d != "" && err != nil { v.add(f, "must be a date (YYYY-MM-DD)") }
+	}
+	if aw.From != "" && aw.Until != "" && aw.Until < aw.From { v.add("until", "must not be before from") }
+	for _, d := range aw.Days {
+		if _, ok := weekdays[strings.ToLower(d)]; !ok { v.add("days", "invalid day %q", d) }
+	}
+	if (aw.Start == "") != (aw.End == "") { v.add("end", "start and end go together") }
+	if aw.Start != "" {
+		if _, err := hhmm(aw.Start); err != nil { v.add("start", "%v", err) }
+		if _, err := hhmm(aw.End); err != nil { v.add("end", "%v", err) }
+		if aw.Start == aw.End { v.add("end", "must differ from start") }
+	}
+	if aw.TZ != "" {
+		if _, err := time.LoadLocation(aw.TZ); err != nil { v.add("tz", "unknown time zone") }
+	}
+	if aw.From == "" && aw.Until == "" && len(aw.Days) == 0 && aw.Start == "" { v.add("", "window sets nothing: give from, until, days or start/end") }
+}
+
+func initAvailability(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS availability_windows (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		target TEXT NOT NULL,
+		from_date TEXT,
+		until_date TEXT,
+		days TEXT,
+		start_time TEXT,
+		end_time TEXT,
+		tz TEXT,
+		created_by INTEGER,
+		created_at TEXT NOT NULL
+	)`)
+	if err != nil { return err }
+	_, _ = db.Exec(`CREATE INDEX IF NOT EXISTS availability_windows_target ON availability_windows (kind, target)`)
+	return nil
+}
+
+// contains reports whether t falls inside the window. The date range is
+// checked on the local date of t; a daily span that wraps midnight belongs
+// to the day it starts on, like boot policy windows.
+func (aw *AvailabilityWindow) contains(t time.Time) bool {
+	if aw.TZ != "" {
+		if loc, err := time.LoadLocation(aw.TZ); err == nil { t = t.In(loc) }
+	}
+	date := t.Format("2006-01-02")
+	if (aw.From != "" && date < aw.From) || (aw.Until != "" && date > aw.Until) { return false }
+	if aw.Start != "" { return (&bootWindow{Days: aw.Days, Start: aw.Start, End: aw.End}).contains(t) }
+	if len(aw.Days) == 0 { return true }
+	for _, d := range aw.Days {
+		if weekdays[strings.ToLower(d)] == t.Weekday() { return true }
+	}
+	return false
+}
+
+const availabilityColumns = `id, name, kind, target, COALESCE(from_date,''), COALESCE(until_date,''), COALESCE(days,''), COALESCE(start_time,''), COALESCE(end_time,''), COALESCE(tz,''), created_at`
+
+func scanAvailabilityWindow(row interface{ Scan(...any) error }) (*AvailabilityWindow, error) {
+	var aw AvailabilityWindow
+	var days string
+	if err := row.Scan(&aw.ID, &aw.Name, &aw.Kind, &aw.Target, &aw.From, &aw.Until, &days, &aw.Start, &aw.End, &aw.TZ, &aw.Created); err != nil { return nil, err }
+	aw.Days = splitList(days)
+	aw.Open = aw.contains(time.Now())
+	return &aw, nil
+}
+
+func (s *Server) availabilityWindows(where string, args ...any) ([]*AvailabilityWindow, error) {
+	rows, err := s.DB.Query(`SELECT `+availabilityColumns+` FROM availability_windows`+where+` ORDER BY kind, target, from_date, name`, args...)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := []*AvailabilityWindow{}
+	for rows.Next() {
+		aw, err := scanAvailabilityWindow(rows)
+		if err != nil { return nil, err }
+		out = append(out, aw)
+	}
+	return out, rows.Err()
+}
+
+// closedTargets returns the targets of kind whose windows are all closed at t.
+func closedTargets(windows []*AvailabilityWindow, kind string, t time.Time) map[string]bool {
+	closed := map[string]bool{}
+	for _, aw := range windows {
+		if aw.Kind != kind { continue }
+		if _, seen := closed[aw.Target]; !seen { closed[aw.Target] = true }
+		if aw.contains(t) { closed[aw.Target] = false }
+	}
+	for k, v := range closed {
+		if !v { delete(closed, k) }
+	}
+	return closed
+}
+
+// imageAvailable reports whether image id may be booted at t.
+func (s *Server) imageAvailable(id string, t time.Time) (bool, error) {
+	windows, err := s.availabilityWindows(` WHERE kind='image' AND target=?`, id)
+	if err != nil { return false, err }
+	return !closedTargets(windows, "image", t)[id], nil
+}
+
+// applyAvailability returns the site to render for mac at t with closed menu
+// entries removed, leaving the shared site untouched. A pending deployment of
+// a closed image also removes the entries that run deployments.
+func (s *Server) applyAvailability(site *Site, mac string, t time.Time) *Site {
+	windows, err := s.availabilityWindows("")
+	if err != nil || len(windows) == 0 { return site }
+	hide := closedTargets(windows, "entry", t)
+	if mac != "" {
+		var image string
+		_ = s.DB.QueryRow(`SELECT COALESCE(image_id,'') FROM deployments WHERE mac=? AND status='pending' ORDER BY created_at DESC LIMIT 1`, mac).Scan(&image)
+		if image != "" && closedTargets(windows, "image", t)[image] {
+			for _, e := range bootEntries {
+				if e.Deploy { hide[e.Name] = true }
+			}
+		}
+	}
+	if len(hide) == 0 { return site }
+	var st Site
+	if site != nil { st = *site }
+	items := st.MenuItems
+	if len(items) == 0 {
+		for _, e := range bootEntries { items = append(items, e.Name) }
+	}
+	st.MenuItems = nil
+	for _, n := range items {
+		if !hide[n] { st.MenuItems = append(st.MenuItems, n) }
+	}
+	// an empty list would show every entry
+	if len(st.MenuItems) == 0 { st.MenuItems = []string{"next"} }
+	def := st.DefaultEntry
+	if def == "" { def = getenv("BOOTAH_IPXE_DEFAULT", "winpe") }
+	if hide[def] { st.DefaultEntry = st.MenuItems[0] }
+	return &st
+}
+
+// checkAvailabilityWindow validates the parts of a window that need the
+// database.
+func (s *Server) checkAvailabilityWindow(aw *AvailabilityWindow) error {
+	var v validator
+	switch aw.Kind {
+	case "image":
+		var n int
+		_ = s.DB.QueryRow(`SELECT COUNT(*) FROM images WHERE id=?`, aw.Target).Scan(&n)
+		if n == 0 { v.add("target", "unknown image") }
+	case "entry":
+		found := false
+		for _, e := range bootEntries { found = found || e.Name == aw.Target }
+		if !found { v.add("target", "unknown menu entry") }
+	}
+	for i, d := range aw.Days { aw.Days[i] = strings.ToLower(d) }
+	return v.err()
+}
+
+func (s *Server) availabilityRoutes() {
+	// GET lists windows (?kind=&target= filter); POST {name, kind, target,
+	// from?, until?, days?, start?, end?, tz?} creates one
+	s.Mux.HandleFunc("/api/v1/admin/availability_windows", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+			where, args := ` WHERE 1=1`, []any{}
+			if k := r.URL.Query().Get("kind"); k != "" { where, args = where+` AND kind=?`, append(args, k) }
+			if t := r.URL.Query().Get("target"); t != "" { where, args = where+` AND target=?`, append(args, t) }
+			out, err := s.availabilityWindows(where, args...)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			writeJSON(w, 200, out)
+		case http.MethodPost:
+			var aw AvailabilityWindow
+			if !decodeJSON(w, r, &aw) { return }
+			if err := s.checkAvailabilityWindow(&aw); err != nil { badRequest(w, err); return }
+			aw.ID, aw.Created = "avail-"+genID(), time.Now().UTC().Format(time.RFC3339)
+			_, err := s.DB.Exec(`INSERT INTO availability_windows (id, name, kind, target, from_date, until_date, days, start_time, end_time, tz, created_by, created_at)
+				VALUES (?,?,?,?,NULLIF(?,''),NULLIF(?,''),NULLIF(?,''),NULLIF(?,''),NULLIF(?,''),NULLIF(?,''),?,?)`,
+				aw.ID, aw.Name, aw.Kind, aw.Target, aw.From, aw.Until, strings.Join(aw.Days, ","), aw.Start, aw.End, aw.TZ, s.actorID(r), aw.Created)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			aw.Open = aw.contains(time.Now())
+			s.audit(s.actorID(r), "create", "availability_window", map[string]any{"id": aw.ID, "name": aw.Name, "kind": aw.Kind, "target": aw.Target})
+			writeJSON(w, 201, aw)
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// /api/v1/admin/availability_windows/{id}: GET, PUT (replace), DELETE
+	s.Mux.HandleFunc("/api/v1/admin/availability_windows/", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		id := strings.TrimPrefix(r.URL.Path, "/api/v1/admin/availability_windows/")
+		aw, err := scanAvailabilityWindow(s.DB.QueryRow(`SELECT `+availabilityColumns+` FROM availability_windows WHERE id=?`, id))
+		if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, 200, aw)
+		case http.MethodPut:
+			var body AvailabilityWindow
+			if !decodeJSON(w, r, &body) { return }
+			if err := s.checkAvailabilityWindow(&body); err != nil { badRequest(w, err); return }
+			_, err := s.DB.Exec(`UPDATE availability_windows SET name=?, kind=?, target=?, from_date=NULLIF(?,''), until_date=NULLIF(?,''), days=NULLIF(?,''),
+				start_time=NULLIF(?,''), end_time=NULLIF(?,''), tz=NULLIF(?,'') WHERE id=?`,
+				body.Name, body.Kind, body.Target, body.From, body.Until, strings.Join(body.Days, ","), body.Start, body.End, body.TZ, aw.ID)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			body.ID, body.Created, body.Open = aw.ID, aw.Created, body.contains(time.Now())
+			s.audit(s.actorID(r), "update", "availability_window", map[string]any{"id": aw.ID, "name": body.Name, "kind": body.Kind, "target": body.Target})
+			writeJSON(w, 200, body)
+		case http.MethodDelete:
+			if _, err := s.DB.Exec(`DELETE FROM availability_windows WHERE id=?`, aw.ID); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "delete", "availability_window", map[string]any{"id": aw.ID})
+			writeJSON(w, 200, map[string]any{"deleted": aw.ID})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+}
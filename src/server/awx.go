@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ---- Ansible / AWX handoff ----
+// When BOOTAH_AWX_URL, BOOTAH_AWX_TOKEN and BOOTAH_AWX_JOB_TEMPLATE are set,
+// a successful deployment launches that job template limited to the new
+// host, with hostname/IP/MAC/groups/custom fields as extra_vars. With
+// BOOTAH_AWX_INVENTORY the host is first added to that inventory. Plain
+// Ansible can instead read /api/v1/ansible/inventory as a dynamic inventory.
+func awxEnabled() bool {
+	return getenv("BOOTAH_AWX_URL", "") != "" && getenv("BOOTAH_AWX_JOB_TEMPLATE", "") != ""
+}
+
+// ansibleHost holds the facts handed to configuration management.
+type ansibleHost struct {
+	Name string
+	Vars map[string]any
+}
+
+// machineGroupNames maps machine group ids to names.
+func (s *Server) machineGroupNames() (map[string]string, error) {
+	rows, err := s.DB.Query(`SELECT id, name FROM machine_groups`)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := map[string]string{}
+	for rows.Next() {
+		var id, name string
+		if err := rows.Scan(&id, &name); err != nil { return nil, err }
+		out[id] = name
+	}
+	return out, rows.Err()
+}
+
+// ansibleHostFor builds the host entry for a finished deployment.
+func (s *Server) ansibleHostFor(deploymentID string) (*ansibleHost, []string, error) {
+	var mac, hostname, ip, image string
+	err := s.DB.QueryRow(`SELECT mac, COALESCE(hostname,''), COALESCE(ip,''), COALESCE(image_id,'') FROM deployments WHERE id=?`, deploymentID).
+		Scan(&mac, &hostname, &ip, &image)
+	if err != nil { return nil, nil, err }
+	name := hostname
+	if name == "" { name = ip }
+	if name == "" { return nil, nil, fmt.Errorf("deployment %s has neither hostname nor ip", deploymentID) }
+	vars := map[string]any{"bootah_mac": mac, "bootah_deployment": deploymentID, "bootah_image": image}
+	if ip != "" { vars["ansible_host"] = ip }
+	if hostname != "" { vars["bootah_hostname"] = hostname }
+	var groups []string
+	if vendor, model, err := s.machineModel(mac); err == nil {
+		vars["bootah_vendor"], vars["bootah_model"] = vendor, model
+	}
+	names, _ := s.machineGroupNames()
+	ids, _ := s.groupsForMachine(mac)
+	for _, id := range ids { groups = append(groups, names[id]) }
+	vars["bootah_groups"] = groups
+	if fields, err := s.machineFields(mac); err == nil && len(fields) > 0 { vars["bootah_fields"] = fields }
+	return &ansibleHost{Name: name, Vars: vars}, groups, nil
+}
+
+func awxRequest(ctx context.Context, method, path string, body any, out any) error {
+	js, _ := json.Marshal(body)
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(getenv("BOOTAH_AWX_URL", ""), "/")+path, bytes.NewReader(js))
+	if err != nil { return err }
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+getenv("BOOTAH_AWX_TOKEN", ""))
+	resp, err := (&http.Client{Timeout: 20 * time.Second}).Do(req)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &awxError{status: resp.StatusCode, msg: fmt.Sprintf("AWX %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))}
+	}
+	if out == nil { return nil }
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type awxError struct {
+	status int
+	msg    string
+}
+
+func (e *awxError) Error() string { return e.msg }
+
+// awxHandoff registers the host (if configured) and launches the job template.
+func (s *Server) awxHandoff(ctx context.Context, deploymentID string) (int64, error) {
+	host, _, err := s.ansibleHostFor(deploymentID)
+	if err != nil { return 0, err }
+	if inv := getenv("BOOTAH_AWX_INVENTORY", ""); inv != "" {
+		hv, _ := json.Marshal(host.Vars)
+		err := awxRequest(ctx, http.MethodPost, "/api/v2/inventories/"+inv+"/hosts/", map[string]any{"name": host.Name, "variables": string(hv)}, nil)
+		// 400 means the host already exists; the launch below still targets it
+		if ae, ok := err.(*awxError); err != nil && !(ok && ae.status == 400) { return 0, err }
+	}
+	var launched struct{ Job int64 `json:"job"` }
+	err = awxRequest(ctx, http.MethodPost, "/api/v2/job_templates/"+getenv("BOOTAH_AWX_JOB_TEMPLATE", "")+"/launch/",
+		map[string]any{"limit": host.Name, "extra_vars": host.Vars}, &launched)
+	if err != nil { return 0, err }
+	return launched.Job, nil
+}
+
+// awxPlugin hands successful deployments over to AWX.
+type awxPlugin struct{}
+
+func (awxPlugin) Name() string { return "awx" }
+
+func (awxPlugin) Handle(ctx context.Context, s *Server, ev Event) error {
+	if ev.Kind != "deployment.finished" || ev.Data["status"] != "succeeded" { return nil }
+	dep, _ := ev.Data["deployment_id"].(string)
+	job, err := s.awxHandoff(ctx, dep)
+	if err != nil {
+		s.notify("warning", "awx_handoff_failed", "AWX handoff for deployment "+dep+" failed", map[string]any{"deployment_id": dep, "error": err.Error()})
+		return err
+	}
+	if mac, _ := ev.Data["mac"].(string); mac != "" { _ = s.setMachineField(mac, "awx_last_job", fmt.Sprint(job), "awx") }
+	s.audit(nil, "launch", "awx_job", map[string]any{"deployment_id": dep, "job": job})
+	return nil
+}
+
+func init() {
+	if awxEnabled() { registerPlugin(awxPlugin{}) }
+}
+
+func (s *Server) awxRoutes() {
+	// Ansible dynamic inventory of successfully deployed machines
+	s.Mux.HandleFunc("/api/v1/ansible/inventory", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		rows, err := s.DB.Query(`SELECT d.id FROM deployments d WHERE d.status='succeeded' AND d.finished_at =
+			(SELECT MAX(l.finished_at) FROM deployments l WHERE l.mac=d.mac AND l.status='succeeded') ORDER BY d.hostname`)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		var ids []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil { rows.Close(); http.Error(w, err.Error(), 500); return }
+			ids = append(ids, id)
+		}
+		rows.Close()
+		hostvars := map[string]any{}
+		inv := map[string]any{"_meta": map[string]any{"hostvars": hostvars}}
+		all := []string{}
+		groups := map[string][]string{}
+		for _, id := range ids {
+			host, gs, err := s.ansibleHostFor(id)
+			if err != nil { continue }
+			hostvars[host.Name] = host.Vars
+			all = append(all, host.Name)
+			// groups whose names clean up the same share one Ansible group
+			for _, g := range gs { groups[ansibleGroupName(g)] = append(groups[ansibleGroupName(g)], host.Name) }
+		}
+		inv["all"] = map[string]any{"hosts": all}
+		for g, hosts := range groups { inv[g] = map[string]any{"hosts": hosts} }
+		writeJSON(w, 200, inv)
+	})
+
+	// Re-run the handoff for one deployment: {"deployment_id": "..."}
+	s.Mux.HandleFunc("/api/v1/admin/awx/launch", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		if !awxEnabled() { http.Error(w, "AWX is not configured", 409); return }
+		var body struct{ DeploymentID string `json:"deployment_id"` }
+		if !decodeJSON(w, r, &body) { return }
+		job, err := s.awxHandoff(r.Context(), body.DeploymentID)
+		if err == sql.ErrNoRows { http.NotFound(w, r); return }
+		if err != nil { http.Error(w, err.Error(), 502); return }
+		s.audit(s.actorID(r), "launch", "awx_job", map[string]any{"deployment_id": body.DeploymentID, "job": job})
+		writeJSON(w, 200, map[string]any{"job": job})
+	})
+}
+
+// ansibleReservedGroups can't be machine groups in the inventory: all and
+// ungrouped are Ansible's own, _meta carries the hostvars.
+var ansibleReservedGroups = map[string]bool{"all": true, "ungrouped": true, "_meta": true}
+
+// ansibleGroupName makes a machine group name a valid Ansible group name
+// that isn't one of ansibleReservedGroups.
+func ansibleGroupName(name string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(name) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '_' { b.WriteRune(c) } else { b.WriteByte('_') }
+	}
+	out := b.String()
+	if out == "" || (out[0] >= '0' && out[0] <= '9') || ansibleReservedGroups[out] { out = "g_" + out }
+	return out
+}
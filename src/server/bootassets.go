@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---- Boot assets ----
+// Managed files under the public /assets tree (kernels, initrds, boot.wim).
+// A boot asset is addressed by its path, e.g. "winpe/boot.wim" is served at
+// /assets/winpe/boot.wim, so templates and menu entries never change when
+// the content does. Content lives in Storage under "boot-assets/<id>/<name>";
+// each upload gets a fresh key and the row is repointed once the object is
+// complete, so a replace never exposes a half-written file. Registered assets
+// take precedence over files in the web root, which keep working unmanaged.
+//
+// Every publish is also a numbered version served at /assets/@v<N>/<path>,
+// and boot menus link the versioned URL, so a client that fetched its script
+// before a swap keeps downloading a consistent kernel/initrd pair. Replaced
+// and deleted versions stay downloadable for BOOTAH_ASSET_GRACE (default
+// 24h) before the leader removes them from Storage.
+type BootAsset struct {
+	Path        string   `json:"path"`
+	Size        int64    `json:"size"`
+	SHA256      string   `json:"sha256"`
+	ContentType string   `json:"content_type"`
+	Updated     string   `json:"updated"`
+	URL         string   `json:"url"`
+	Version     int64    `json:"version"`
+	VersionURL  string   `json:"version_url"`
+	Retired     string   `json:"retired_at,omitempty"`
+	Kind        string   `json:"kind,omitempty"`           // kernel, efi or initrd when recognised
+	Arch        string   `json:"arch,omitempty"`           // x86_64, i386 or arm64
+	KernelVer   string   `json:"kernel_version,omitempty"` // kernel release, or the modules an initrd carries
+	Distro      string   `json:"distro,omitempty"`         // admin label, e.g. "ubuntu-24.04"
+	Warnings    []string `json:"warnings,omitempty"`       // pairing problems, on upload
+	file        string
+}
+
+func initBootAssets(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS boot_assets (
+		path TEXT PRIMARY KEY,
+		file TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		updated TEXT NOT NULL
+	)`)
+	if err != nil { return err }
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS boot_asset_versions (
+		path TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		file TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		created TEXT NOT NULL,
+		retired_at TEXT,
+		PRIMARY KEY (path, version)
+	)`)
+	if err != nil { return err }
+	// the last version number handed out per path, so pruning or deleting
+	// versions never lets a versioned URL name a different file later
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS boot_asset_counters (
+		path TEXT PRIMARY KEY,
+		last_version INTEGER NOT NULL
+	)`)
+	return err
+}
+
+// nextAssetVersion takes the next version number for path. Paths versioned
+// before the counter existed continue from their highest known version.
+func nextAssetVersion(tx *sql.Tx, path string) (int64, error) {
+	var v int64
+	err := tx.QueryRow(`SELECT MAX(v) FROM (
+		SELECT COALESCE(MAX(last_version),0) AS v FROM boot_asset_counters WHERE path=?
+		UNION ALL SELECT COALESCE(MAX(version),0) FROM boot_asset_versions WHERE path=?
+		UNION ALL SELECT COALESCE(MAX(version),0) FROM boot_assets WHERE path=?) m`, path, path, path).Scan(&v)
+	if err != nil { return 0, err }
+	v++
+	_, err = tx.Exec(`INSERT INTO boot_asset_counters (path, last_version) VALUES (?,?)
+		ON CONFLICT(path) DO UPDATE SET last_version=excluded.last_version`, path, v)
+	return v, err
+}
+
+func assetGrace() time.Duration {
+	d, err := time.ParseDuration(getenv("BOOTAH_ASSET_GRACE", "24h"))
+	if err != nil || d < 0 { return 24 * time.Hour }
+	return d
+}
+
+func versionedAssetURL(p string, v int64) string { return fmt.Sprintf("/assets/@v%d/%s", v, p) }
+
+var versionedAssetRe = regexp.MustCompile(`^@v([0-9]+)/(.+)$`)
+
+var bootAssetPathRe = regexp.MustCompile(`^[A-Za-z0-9._-]+(/[A-Za-z0-9._-]+)*$`)
+
+// cleanAssetPath normalizes p (with or without a leading /assets/) to the
+// relative form stored in boot_assets.
+func cleanAssetPath(p string) (string, error) {
+	p = strings.TrimPrefix(strings.TrimPrefix(p, "/"), "assets/")
+	if !bootAssetPathRe.MatchString(p) || path.Clean(p) != p || strings.HasPrefix(p, "..") || strings.Contains(p, "/..") {
+		return "", fmt.Errorf("invalid asset path %q", p)
+	}
+	if strings.HasSuffix(p, ".sha256") { return "", errors.New("checksum sidecars are generated, not uploaded") }
+	return p, nil
+}
+
+const assetMetaColumns = `COALESCE(kind,''), COALESCE(arch,''), COALESCE(kernel_version,''), COALESCE(distro,'')`
+
+const bootAssetColumns = `path, file, size, sha256, content_type, updated, version, '', ` + assetMetaColumns + ` FROM boot_assets`
+
+const bootAssetVersionColumns = `path, file, size, sha256, content_type, created, version, COALESCE(retired_at,''), ` + assetMetaColumns + ` FROM boot_asset_versions`
+
+func scanBootAsset(row interface{ Scan(...any) error }) (*BootAsset, error) {
+	var a BootAsset
+	if err := row.Scan(&a.Path, &a.file, &a.Size, &a.SHA256, &a.ContentType, &a.Updated, &a.Version, &a.Retired, &a.Kind, &a.Arch, &a.KernelVer, &a.Distro); err != nil { return nil, err }
+	a.URL = "/assets/" + a.Path
+	a.VersionURL = versionedAssetURL(a.Path, a.Version)
+	return &a, nil
+}
+
+func (s *Server) bootAsset(p string) (*BootAsset, error) {
+	return scanBootAsset(s.DB.QueryRow(`SELECT `+bootAssetColumns+` WHERE path=?`, p))
+}
+
+// bootAssetVersion finds a version that has not been pruned yet.
+func (s *Server) bootAssetVersion(p string, v int64) (*BootAsset, error) {
+	return scanBootAsset(s.DB.QueryRow(`SELECT `+bootAssetVersionColumns+` WHERE path=? AND version=?`, p, v))
+}
+
+func (s *Server) bootAssetVersions(p string) ([]*BootAsset, error) {
+	rows, err := s.DB.Query(`SELECT `+bootAssetVersionColumns+` WHERE path=? ORDER BY version DESC`, p)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := []*BootAsset{}
+	for rows.Next() {
+		a, err := scanBootAsset(rows)
+		if err != nil { return nil, err }
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// assetPins maps each managed asset's stable URL to its current version URL.
+func (s *Server) assetPins() map[string]string {
+	rows, err := s.DB.Query(`SELECT path, version FROM boot_assets`)
+	if err != nil { return nil }
+	defer rows.Close()
+	pins := map[string]string{}
+	for rows.Next() {
+		var p string
+		var v int64
+		if rows.Scan(&p, &v) == nil { pins["/assets/"+p] = versionedAssetURL(p, v) }
+	}
+	return pins
+}
+
+func (s *Server) listBootAssets(prefix string) ([]*BootAsset, error) {
+	rows, err := s.DB.Query(`SELECT `+bootAssetColumns+` WHERE path LIKE ? ORDER BY path`, prefix+"%")
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := []*BootAsset{}
+	for rows.Next() {
+		a, err := scanBootAsset(rows)
+		if err != nil { return nil, err }
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// stageBootAsset uploads body as the next content of p without publishing
+// it. When want is set the upload is rejected unless its SHA-256 matches.
+// Kernels and initrds are recognised on the way through (see kernel pairs).
+func (s *Server) stageBootAsset(ctx context.Context, p string, body io.Reader, want string) (*BootAsset, error) {
+	a := &BootAsset{Path: p, URL: "/assets/" + p, Updated: time.Now().UTC().Format(time.RFC3339)}
+	a.file = "boot-assets/" + genID() + "/" + path.Base(p)
+	a.ContentType = mime.TypeByExtension(path.Ext(p))
+	if a.ContentType == "" { a.ContentType = "application/octet-stream" }
+	sn := newAssetSniffer()
+	size, sum, err := s.StorePut(ctx, a.file, io.TeeReader(body, sn))
+	sn.Close()
+	if err != nil { return nil, err }
+	a.Size, a.SHA256 = size, sum
+	a.Kind, a.Arch, a.KernelVer = sn.result()
+	if want != "" && !strings.EqualFold(want, a.SHA256) {
+		_ = s.Store.Delete(ctx, a.file)
+		return nil, fmt.Errorf("checksum mismatch: got %s", a.SHA256)
+	}
+	return a, nil
+}
+
+// commitBootAssets publishes staged assets in one transaction, so clients see
+// either all of the new files or none of them. Each becomes the next version
+// of its path; the version it replaces is retired, not deleted. It returns
+// the paths that already existed.
+func (s *Server) commitBootAssets(ctx context.Context, staged []*BootAsset) ([]string, error) {
+	discard := func() { for _, a := range staged { _ = s.Store.Delete(ctx, a.file) } }
+	tx, err := s.DB.Begin()
+	if err != nil { discard(); return nil, err }
+	defer tx.Rollback()
+	now := time.Now().UTC().Format(time.RFC3339)
+	var replaced []string
+	for _, a := range staged {
+		prev, err := scanBootAsset(tx.QueryRow(`SELECT `+bootAssetColumns+` WHERE path=?`, a.Path))
+		if err == nil {
+			replaced = append(replaced, a.Path)
+			if err := retireAssetVersion(tx, prev, now); err != nil { discard(); return nil, err }
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			discard(); return nil, err
+		}
+		if a.Version, err = nextAssetVersion(tx, a.Path); err != nil { discard(); return nil, err }
+		a.VersionURL = versionedAssetURL(a.Path, a.Version)
+		_, err = tx.Exec(`INSERT INTO boot_asset_versions (path, version, file, size, sha256, content_type, created, kind, arch, kernel_version, distro) VALUES (?,?,?,?,?,?,?,?,?,?,?)`,
+			a.Path, a.Version, a.file, a.Size, a.SHA256, a.ContentType, a.Updated, a.Kind, a.Arch, a.KernelVer, a.Distro)
+		if err != nil { discard(); return nil, err }
+		_, err = tx.Exec(`INSERT INTO boot_assets (path, file, size, sha256, content_type, updated, version, kind, arch, kernel_version, distro) VALUES (?,?,?,?,?,?,?,?,?,?,?)
+			ON CONFLICT(path) DO UPDATE SET file=excluded.file, size=excluded.size, sha256=excluded.sha256, content_type=excluded.content_type, updated=excluded.updated, version=excluded.version,
+			kind=excluded.kind, arch=excluded.arch, kernel_version=excluded.kernel_version, distro=excluded.distro`,
+			a.Path, a.file, a.Size, a.SHA256, a.ContentType, a.Updated, a.Version, a.Kind, a.Arch, a.KernelVer, a.Distro)
+		if err != nil { discard(); return nil, err }
+	}
+	if err := tx.Commit(); err != nil { discard(); return nil, err }
+	return replaced, nil
+}
+
+// retireAssetVersion starts the grace period of a current version. Assets
+// published before versioning have no version row yet and get one here.
+func retireAssetVersion(tx *sql.Tx, cur *BootAsset, now string) error {
+	res, err := tx.Exec(`UPDATE boot_asset_versions SET retired_at=? WHERE path=? AND version=?`, now, cur.Path, cur.Version)
+	if err != nil { return err }
+	if n, _ := res.RowsAffected(); n > 0 { return nil }
+	_, err = tx.Exec(`INSERT INTO boot_asset_versions (path, version, file, size, sha256, content_type, created, retired_at, kind, arch, kernel_version, distro) VALUES (?,?,?,?,?,?,?,?,?,?,?,?)`,
+		cur.Path, cur.Version, cur.file, cur.Size, cur.SHA256, cur.ContentType, cur.Updated, now, cur.Kind, cur.Arch, cur.KernelVer, cur.Distro)
+	return err
+}
+
+// assetVersionRef is a retired boot asset version due for pruning.
+type assetVersionRef struct {
+	Path      string `json:"path"`
+	Version   int64  `json:"version"`
+	Size      int64  `json:"size"`
+	RetiredAt string `json:"retired_at"`
+	file      string
+}
+
+// prunableAssetVersions lists retired versions whose grace period has passed.
+func (s *Server) prunableAssetVersions() ([]assetVersionRef, error) {
+	cutoff := time.Now().UTC().Add(-assetGrace()).Format(time.RFC3339)
+	rows, err := s.DB.Query(`SELECT path, version, file, size, retired_at FROM boot_asset_versions WHERE retired_at IS NOT NULL AND retired_at < ? ORDER BY path, version`, cutoff)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := []assetVersionRef{}
+	for rows.Next() {
+		var v assetVersionRef
+		if err := rows.Scan(&v.Path, &v.Version, &v.file, &v.Size, &v.RetiredAt); err != nil { return nil, err }
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+// pruneAssetVersions deletes versions whose grace period has passed and
+// returns the ones it deleted.
+func (s *Server) pruneAssetVersions() []assetVersionRef {
+	old, err := s.prunableAssetVersions()
+	if err != nil { log.Printf("prune boot assets: %v", err); return nil }
+	var done []assetVersionRef
+	for _, v := range old {
+		if err := s.Store.Delete(context.Background(), v.file); err != nil && !errors.Is(err, os.ErrNotExist) { log.Printf("prune boot asset %s@v%d: %v", v.Path, v.Version, err); continue }
+		_, _ = s.DB.Exec(`DELETE FROM boot_asset_versions WHERE path=? AND version=?`, v.Path, v.Version)
+		done = append(done, v)
+	}
+	return done
+}
+
+func (s *Server) startBootAssets(ctx context.Context) {
+	go s.runAsLeader(ctx, "boot-asset-prune", time.Hour, func() { s.pruneAssetVersions() })
+}
+
+// putBootAsset stores body as the content of p, creating or replacing it.
+// Non-empty fields of labels override what was detected.
+func (s *Server) putBootAsset(ctx context.Context, p string, body io.Reader, want string, labels BootAsset) (*BootAsset, bool, error) {
+	a, err := s.stageBootAsset(ctx, p, body, want)
+	if err != nil { return nil, false, err }
+	if labels.Arch != "" { a.Arch = labels.Arch }
+	if labels.KernelVer != "" { a.KernelVer = labels.KernelVer }
+	a.Distro = labels.Distro
+	replaced, err := s.commitBootAssets(ctx, []*BootAsset{a})
+	if err != nil { return nil, false, err }
+	return a, len(replaced) > 0, nil
+}
+
+// serveBootAsset answers an /assets request for a registered asset, either
+// its stable path or "@v<N>/<path>"; it returns false when rel is not managed
+// so the web root can serve it.
+func (s *Server) serveBootAsset(w http.ResponseWriter, r *http.Request, rel string) bool {
+	var version int64
+	if m := versionedAssetRe.FindStringSubmatch(rel); m != nil {
+		version, _ = strconv.ParseInt(m[1], 10, 64)
+		rel = m[2]
+	}
+	p, err := cleanAssetPath(strings.TrimSuffix(rel, ".sha256"))
+	if err != nil { return false }
+	var a *BootAsset
+	if version > 0 {
+		if a, err = s.bootAssetVersion(p, version); err != nil {
+			// assets published before versioning are current without a row
+			if a, err = s.bootAsset(p); err != nil || a.Version != version { http.NotFound(w, r); return true }
+		}
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else if a, err = s.bootAsset(p); err != nil {
+		return false
+	}
+	if strings.HasSuffix(rel, ".sha256") {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "%s  %s\n", a.SHA256, path.Base(a.Path))
+		return true
+	}
+	w.Header().Set("X-Checksum-Sha256", a.SHA256)
+	if lp, ok := s.Store.LocalPath(a.file); ok {
+		f, err := os.Open(lp)
+		if err != nil { http.Error(w, err.Error(), 500); return true }
+		defer f.Close()
+		updated, _ := time.Parse(time.RFC3339, a.Updated)
+		w.Header().Set("Content-Type", a.ContentType)
+		w.Header().Set("ETag", `"`+a.SHA256+`"`)
+		http.ServeContent(w, r, a.Path, updated, f)
+		return true
+	}
+	u, err := s.Store.Presign(r.Context(), a.file, 15*time.Minute)
+	if err != nil { http.Error(w, err.Error(), 500); return true }
+	http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+	return true
+}
+
+func (s *Server) bootAssetRoutes() {
+	// ?prefix=winpe/ narrows the listing
+	s.Mux.HandleFunc("/api/v1/admin/boot-assets", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		list, err := s.listBootAssets(strings.TrimPrefix(r.URL.Query().Get("prefix"), "/"))
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		writeJSON(w, 200, list)
+	})
+
+	// /api/v1/admin/boot-assets/{path}: GET metadata (?versions=1 adds the
+	// versions still downloadable), PUT raw body to create or replace
+	// (optional X-Checksum-Sha256 is verified; X-Asset-Arch,
+	// X-Asset-Kernel-Version and X-Asset-Distro label it), DELETE retires the
+	// asset. The PUT response warns about menu entries and profiles whose
+	// kernel and initrd no longer match.
+	s.Mux.HandleFunc("/api/v1/admin/boot-assets/", func(w http.ResponseWriter, r *http.Request) {
+		p, err := cleanAssetPath(strings.TrimPrefix(r.URL.Path, "/api/v1/admin/boot-assets/"))
+		if err != nil { http.Error(w, err.Error(), 400); return }
+		switch r.Method {
+		case http.MethodGet:
+			if !s.requireRole(w, r, "operator") { return }
+			a, err := s.bootAsset(p)
+			if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			if r.URL.Query().Get("versions") != "1" { writeJSON(w, 200, a); return }
+			versions, err := s.bootAssetVersions(p)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			writeJSON(w, 200, map[string]any{"asset": a, "versions": versions})
+		case http.MethodPut:
+			if !s.requireRole(w, r, "admin") || !s.requireDiskSpace(w, r) { return }
+			labels := BootAsset{Arch: normalizeArch(r.Header.Get("X-Asset-Arch")), KernelVer: strings.TrimSpace(r.Header.Get("X-Asset-Kernel-Version")),
+				Distro: strings.TrimSpace(r.Header.Get("X-Asset-Distro"))}
+			limitUploadBody(w, r)
+			a, replaced, err := s.putBootAsset(r.Context(), p, r.Body, strings.TrimSpace(r.Header.Get("X-Checksum-Sha256")), labels)
+			if err != nil {
+				if strings.HasPrefix(err.Error(), "checksum mismatch") { http.Error(w, err.Error(), 400); return }
+				uploadFailed(w, err, 500, ""); return
+			}
+			action, status := "create", 201
+			if replaced { action, status = "replace", 200 }
+			s.audit(s.actorID(r), action, "boot_asset", map[string]any{"path": a.Path, "size": a.Size, "sha256": a.SHA256})
+			for _, rep := range s.bootPairReports() {
+				for _, pr := range rep.Pairs {
+					if !pr.uses(a.Path) { continue }
+					for _, e := range append(pr.Errors, pr.Warnings...) { a.Warnings = append(a.Warnings, rep.Kind+" "+rep.Name+": "+e) }
+				}
+			}
+			writeJSON(w, status, a)
+		case http.MethodDelete:
+			if !s.requireRole(w, r, "admin") { return }
+			a, err := s.bootAsset(p)
+			if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			tx, err := s.DB.Begin()
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer tx.Rollback()
+			if err := retireAssetVersion(tx, a, time.Now().UTC().Format(time.RFC3339)); err != nil { http.Error(w, err.Error(), 500); return }
+			if _, err := tx.Exec(`DELETE FROM boot_assets WHERE path=?`, p); err != nil { http.Error(w, err.Error(), 500); return }
+			if err := tx.Commit(); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "delete", "boot_asset", map[string]any{"path": p, "version": a.Version})
+			writeJSON(w, 200, map[string]any{"deleted": p})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+}
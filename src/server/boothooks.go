@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ---- Boot decision hook ----
+// When BOOTAH_BOOT_HOOK_URL is set, rendering /ipxe/boot.ipxe POSTs the client
+// context to it and applies the returned decision, so site policy ("LAB-*
+// asset tags always get the wipe menu") lives outside the server. The body is
+// signed with BOOTAH_BOOT_HOOK_SECRET (X-Bootah-Signature: sha256=<hex>). The
+// hook fails open: a timeout, error or empty reply renders the normal menu.
+type bootContext struct {
+	MAC      string   `json:"mac"`
+	IP       string   `json:"ip"`
+	Arch     string   `json:"arch,omitempty"`
+	Site     string   `json:"site,omitempty"`
+	Vendor   string   `json:"vendor,omitempty"`
+	Model    string   `json:"model,omitempty"`
+	Serial   string   `json:"serial,omitempty"`
+	AssetTag string   `json:"asset_tag,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+	Boots    int64    `json:"boot_count"`
+	LastBoot string   `json:"last_boot_at,omitempty"`
+	Stale    bool     `json:"stale"`
+	Entries  []string `json:"entries"`
+}
+
+// bootDecision is the hook reply. Every field is optional: Default picks the
+// preselected entry, Entries restricts the menu, Script replaces it entirely.
+type bootDecision struct {
+	Default string   `json:"default"`
+	Entries []string `json:"entries"`
+	Script  string   `json:"script"`
+}
+
+func bootHookTimeout() time.Duration {
+	d, err := time.ParseDuration(getenv("BOOTAH_BOOT_HOOK_TIMEOUT", "2s"))
+	if err != nil || d <= 0 { return 2 * time.Second }
+	return d
+}
+
+// bootContextFor assembles what the hook is told about a booting client.
+func (s *Server) bootContextFor(r *http.Request, site *Site) bootContext {
+	bc := bootContext{MAC: normalizeMAC(r.URL.Query().Get("mac")), Arch: r.URL.Query().Get("arch")}
+	if ip := clientIP(r); ip != nil { bc.IP = ip.String() }
+	if site != nil { bc.Site = site.Name }
+	for _, e := range bootEntries { bc.Entries = append(bc.Entries, e.Name) }
+	if bc.MAC == "" { return bc }
+	var last *string
+	_ = s.DB.QueryRow(`SELECT boot_count, last_boot_at, stale FROM machines WHERE mac=?`, bc.MAC).Scan(&bc.Boots, &last, &bc.Stale)
+	bc.LastBoot = strOrEmpty(last)
+	bc.Groups, _ = s.groupsForMachine(bc.MAC)
+	var vendor, model, serial, asset *string
+	err := s.DB.QueryRow(`SELECT vendor, model, serial, asset_tag FROM inventory WHERE mac=? ORDER BY id DESC LIMIT 1`, bc.MAC).
+		Scan(&vendor, &model, &serial, &asset)
+	if err != nil { return bc }
+	bc.Vendor, bc.Model, bc.Serial, bc.AssetTag = strOrEmpty(vendor), strOrEmpty(model), strOrEmpty(serial), strOrEmpty(asset)
+	return bc
+}
+
+// callBootHook asks the configured hook for a decision; nil means "no opinion".
+func callBootHook(ctx context.Context, bc bootContext) (*bootDecision, error) {
+	hook := getenv("BOOTAH_BOOT_HOOK_URL", "")
+	if hook == "" { return nil, nil }
+	ctx, cancel := context.WithTimeout(ctx, bootHookTimeout())
+	defer cancel()
+	payload, _ := json.Marshal(bc)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook, bytes.NewReader(payload))
+	if err != nil { return nil, err }
+	req.Header.Set("Content-Type", "application/json")
+	if secret := getenv("BOOTAH_BOOT_HOOK_SECRET", ""); secret != "" {
+		m := hmac.New(sha256.New, []byte(secret))
+		m.Write(payload)
+		req.Header.Set("X-Bootah-Signature", "sha256="+hex.EncodeToString(m.Sum(nil)))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil { return nil, err }
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent { return nil, nil }
+	if resp.StatusCode != http.StatusOK { return nil, fmt.Errorf("hook returned %s", resp.Status) }
+	var d bootDecision
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&d); err != nil { return nil, err }
+	if d.Script != "" && !strings.HasPrefix(d.Script, "#!ipxe") { return nil, fmt.Errorf("hook script does not start with #!ipxe") }
+	known := map[string]bool{}
+	for _, e := range bootEntries { known[e.Name] = true }
+	if d.Default != "" && !known[d.Default] { return nil, fmt.Errorf("hook chose unknown entry %q", d.Default) }
+	for _, e := range d.Entries {
+		if !known[e] { return nil, fmt.Errorf("hook listed unknown entry %q", e) }
+	}
+	return &d, nil
+}
+
+// applyBootDecision returns the site to render with the decision folded in,
+// leaving the shared site untouched.
+func applyBootDecision(site *Site, d *bootDecision) *Site {
+	if d == nil || (d.Default == "" && len(d.Entries) == 0) { return site }
+	var st Site
+	if site != nil { st = *site }
+	if d.Default != "" { st.DefaultEntry = d.Default }
+	if len(d.Entries) > 0 { st.MenuItems = d.Entries }
+	if st.DefaultEntry != "" && len(st.MenuItems) > 0 {
+		found := false
+		for _, e := range st.MenuItems { if e == st.DefaultEntry { found = true } }
+		if !found { st.MenuItems = append(st.MenuItems, st.DefaultEntry) }
+	}
+	return &st
+}
+
+// bootScript renders the boot script for a request, consulting the hook.
+func (s *Server) bootScript(r *http.Request, site *Site, dlToken string) string {
+	mac := normalizeMAC(r.URL.Query().Get("mac"))
+	args, err := s.kernelArgsFor(mac, site)
+	if err != nil { log.Printf("kernel args: %v", err) }
+	pins := s.assetPins()
+	now := time.Now()
+	if policies, err := s.bootPoliciesFor(mac, now); err != nil {
+		log.Printf("boot policies: %v", err)
+	} else {
+		site = applyBootPolicies(site, policies)
+	}
+	profile, entry, err := s.bootProfileFor(mac)
+	if err != nil { log.Printf("boot profile (mac %s): %v", mac, err) }
+	if profile != nil && profile.Kind == "exam" { return s.renderExamProfile(r, profile, dlToken) }
+	if sc, ok := directBootScript(entry); ok { return sc }
+	if entry != "" { site = applyBootDecision(site, &bootDecision{Default: entry}) }
+	overlays := s.overlayPacks(mac)
+	render := func(site *Site) string {
+		site = s.applyAvailability(site, mac, now)
+		out := renderBootMenu(site, dlToken, args, pins)
+		if profile != nil {
+			if p, err := renderBootProfile(profile.Template, s.profileContextFor(r, site, out, bootAssetURL(site, dlToken, pins), args)); err != nil {
+				log.Printf("boot profile %s (mac %s): %v", profile.Name, mac, err)
+			} else {
+				out = p
+			}
+		}
+		return s.withInitrdOverlays(out, overlays, dlToken)
+	}
+	if getenv("BOOTAH_BOOT_HOOK_URL", "") == "" { return render(site) }
+	bc := s.bootContextFor(r, site)
+	d, err := callBootHook(r.Context(), bc)
+	if err != nil {
+		log.Printf("boot hook (mac %s): %v", bc.MAC, err)
+		return render(site)
+	}
+	if d != nil && d.Script != "" { return d.Script }
+	return render(applyBootDecision(site, d))
+}
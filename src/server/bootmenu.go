@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ---- iPXE boot menu ----
+type bootEntry struct {
+	Name   string
+	Key    string
+	Label  string
+	Args   string // default kernel command line; empty = entry takes none
+	Deploy bool   // runs pending deployments, see availability.go
+	Local  bool   // boots past Bootah; see directBootScript
+	Script func(asset func(path string) string, args string) string // asset maps /assets/... to a public URL
+}
+
+var bootEntries = []bootEntry{
+	{Name: "winpe", Key: "w", Label: "WinPE (Capture & Deploy)", Deploy: true, Script: func(asset func(string) string, _ string) string {
+		return "kernel " + asset("/assets/winpe/bootx64.efi") + "\ninitrd " + asset("/assets/winpe/boot.wim") + "\nboot\n"
+	}},
+	{Name: "ubuntu", Key: "u", Label: "Ubuntu 24.04 Live (ISO)", Args: "initrd=initrd boot=casper netboot=nfs nfsroot=${next-server}:/srv/bootah/images/ubuntu",
+		Script: func(asset func(string) string, args string) string {
+			return "kernel " + asset("/assets/ubuntu/vmlinuz") + "\ninitrd " + asset("/assets/ubuntu/initrd") + "\nimgargs vmlinuz " + args + "\nboot\n"
+		}},
+	// Fall-through entries for machines that PXE-boot first. BIOS boots the
+	// first hard disk (BOOTAH_LOCAL_BOOT_DRIVE, default 0x80) with sanboot;
+	// UEFI has no drive numbers, so it exits to the firmware boot manager,
+	// which tries the next option (normally the installed OS).
+	{Name: "local", Key: "l", Label: "Boot from local disk", Local: true, Script: func(func(string) string, string) string {
+		return "iseq ${platform} efi && exit ||\nsanboot --no-describe --drive " + getenv("BOOTAH_LOCAL_BOOT_DRIVE", "0x80") + " || goto menu\n"
+	}},
+	{Name: "next", Key: "n", Label: "Continue to next boot device", Local: true, Script: func(func(string) string, string) string {
+		return "exit\n"
+	}},
+}
+
+// directBootScript is the whole script for a machine whose boot profile is a
+// fall-through entry, as after reverting a deployment: it boots on without
+// showing a menu, which with no timeout would wait for a keypress forever.
+func directBootScript(entry string) (string, bool) {
+	for _, e := range bootEntries {
+		if e.Name == entry && e.Local { return "#!ipxe\n" + strings.ReplaceAll(e.Script(nil, ""), "goto menu", "exit"), true }
+	}
+	return "", false
+}
+
+// bootAssetURL maps /assets/... paths to the URL a client at site fetches.
+func bootAssetURL(site *Site, dlToken string, pins map[string]string) func(string) string {
+	origin := func(p string) string { return "http://${next-server}:" + p }
+	if cdnEnabled() {
+		// signed for the address the token is bound to, so the origin can
+		// check it behind the CDN
+		ip := downloadTokenIP(dlToken)
+		origin = func(p string) string { return cdnURL(p, ip) }
+	}
+	if site != nil && site.MirrorURL != "" {
+		base := strings.TrimRight(site.MirrorURL, "/")
+		origin = func(p string) string { return base + p }
+		pins = nil
+	}
+	return func(p string) string {
+		if v, ok := pins[p]; ok { p = v }
+		if dlToken != "" { p += "?dt=" + dlToken }
+		return origin(p)
+	}
+}
+
+// renderBootMenu builds the iPXE menu for a client. site may be nil, in which
+// case every entry is offered. Assets come from the site mirror, else the CDN,
+// else the boot server itself; a non-empty dlToken is appended to each URL.
+// args overrides an entry's default kernel arguments by entry name; pins maps
+// stable asset paths to versioned ones and is ignored for mirrored sites,
+// which only carry the stable tree. Title, MOTD, timeout and colours come from
+// the site's branding, with boot policies already folded in.
+func renderBootMenu(site *Site, dlToken string, args map[string]string, pins map[string]string) string {
+	asset := bootAssetURL(site, dlToken, pins)
+	def := getenv("BOOTAH_IPXE_DEFAULT", "winpe")
+	var show map[string]bool
+	if site != nil {
+		if site.DefaultEntry != "" { def = site.DefaultEntry }
+		if len(site.MenuItems) > 0 {
+			show = map[string]bool{}
+			for _, n := range site.MenuItems { show[n] = true }
+		}
+	}
+	var entries []bootEntry
+	for _, e := range bootEntries {
+		if show == nil || show[e.Name] { entries = append(entries, e) }
+	}
+	brand := menuBranding(site)
+	var b strings.Builder
+	fmt.Fprintf(&b, "#!ipxe\n%sset menu-default %s\n", brand.ipxeColours(), def)
+	if brand.AutoSelect { b.WriteString("prompt --key m --timeout 3000 Press M for the boot menu && goto menu || goto ${menu-default}\n") }
+	fmt.Fprintf(&b, ":menu\nmenu %s\n", ipxeText(brand.Title))
+	if site != nil && site.Name != "" { fmt.Fprintf(&b, "item --gap Site: %s\n", ipxeText(site.Name)) }
+	if brand.MOTD != "" {
+		for _, l := range strings.Split(strings.ReplaceAll(brand.MOTD, "\r\n", "\n"), "\n") { fmt.Fprintf(&b, "item --gap %s\n", ipxeText(l)) }
+		b.WriteString("item --gap\n")
+	}
+	for _, e := range entries { fmt.Fprintf(&b, "item --key %s %-6s %s\n", e.Key, e.Name, e.Label) }
+	timeout := ""
+	if brand.Timeout != nil && *brand.Timeout > 0 { timeout = fmt.Sprintf("--timeout %d ", *brand.Timeout*1000) }
+	fmt.Fprintf(&b, "item --key q %-6s %s\nchoose %s--default %s target && goto ${target}\n", "quit", "Quit", timeout, def)
+	for _, e := range entries {
+		a, ok := args[e.Name]
+		if !ok { a = e.Args }
+		fmt.Fprintf(&b, "\n:%s\n%s", e.Name, e.Script(asset, a))
+	}
+	b.WriteString("\n:quit\nexit\n")
+	return b.String()
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ---- Boot menu policies ----
+// A policy sets the preselected entry, the menu timeout and whether the menu
+// is skipped ("auto_select": boot the default after a short "press M for the
+// menu" prompt) for a machine group, optionally only inside a recurring
+// maintenance window. Typical use: a policy with a Tue/Thu 22:00-04:00
+// window that auto-selects the deploy entry, under a window-less one that
+// defaults to the "local" entry. Matching policies
+// are layered like kernel argument overlays: all machines < group, then
+// window-less < windowed, then by priority; a later layer overrides the
+// fields it sets. Policies apply before the boot hook, which still has the
+// last word.
+type bootWindow struct {
+	Days  []string `json:"days,omitempty"` // mon..sun, empty = every day
+	Start string   `json:"start"`          // HH:MM
+	End   string   `json:"end"`            // HH:MM, before Start = wraps midnight
+	TZ    string   `json:"tz,omitempty"`   // IANA zone, empty = server local
+}
+
+type BootPolicy struct {
+	ID         string      `json:"id"`
+	Name       string      `json:"name"`
+	GroupID    string      `json:"group_id"` // empty = all machines
+	Window     *bootWindow `json:"window,omitempty"`
+	Default    string      `json:"default,omitempty"` // entry name
+	Timeout    *int        `json:"timeout,omitempty"` // seconds, 0 = wait
+	AutoSelect *bool       `json:"auto_select,omitempty"`
+	Priority   int         `json:"priority"`
+	Updated    string      `json:"updated"`
+}
+
+var weekdays = map[string]time.Weekday{"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday}
+
+func initBootPolicies(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS boot_policies (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		group_id TEXT NOT NULL DEFAULT '',
+		schedule TEXT,
+		default_entry TEXT,
+		timeout INTEGER,
+		auto_select INTEGER,
+		priority INTEGER NOT NULL DEFAULT 0,
+		updated TEXT NOT NULL
+	)`)
+	return err
+}
+
+func hhmm(v string) (int, error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil { return 0, fmt.Errorf("invalid time %q (want HH:MM)", v) }
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether t falls inside the window. A window that wraps
+// midnight belongs to the day it starts on.
+func (w *bootWindow) contains(t time.Time) bool {
+	if w.TZ != "" {
+		if loc, err := time.LoadLocation(w.TZ); err == nil { t = t.In(loc) }
+	}
+	start, _ := hhmm(w.Start)
+	end, _ := hhmm(w.End)
+	now := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	switch {
+	case start <= end:
+		if now < start || now >= end { return false }
+	case now >= start:
+	case now < end:
+		day = (day + 6) % 7 // after midnight: the window opened yesterday
+	default:
+		return false
+	}
+	if len(w.Days) == 0 { return true }
+	for _, d := range w.Days {
+		if weekdays[strings.ToLower(d)] == day { return true }
+	}
+	return false
+}
+
+func validateBootPolicy(p BootPolicy) error {
+	if strings.TrimSpace(p.Name) == "" { return errors.New("name required") }
+	if p.Window != nil {
+		if _, err := hhmm(p.Window.Start); err != nil { return err }
+		if _, err := hhmm(p.Window.End); err != nil { return err }
+		if p.Window.Start == p.Window.End { return errors.New("window start and end must differ") }
+		for _, d := range p.Window.Days {
+			if _, ok := weekdays[strings.ToLower(d)]; !ok { return fmt.Errorf("invalid day %q", d) }
+		}
+		if p.Window.TZ != "" {
+			if _, err := time.LoadLocation(p.Window.TZ); err != nil { return fmt.Errorf("invalid tz %q", p.Window.TZ) }
+		}
+	}
+	if p.Default != "" {
+		found := false
+		for _, e := range bootEntries { if e.Name == p.Default { found = true } }
+		if !found { return fmt.Errorf("unknown entry %q", p.Default) }
+	}
+	if p.Timeout != nil && (*p.Timeout < 0 || *p.Timeout > 3600) { return errors.New("timeout must be between 0 and 3600 seconds") }
+	if p.Default == "" && p.Timeout == nil && p.AutoSelect == nil { return errors.New("policy sets nothing: give default, timeout or auto_select") }
+	return nil
+}
+
+func (s *Server) listBootPolicies() ([]BootPolicy, error) {
+	rows, err := s.DB.Query(`SELECT id, name, group_id, COALESCE(schedule,''), COALESCE(default_entry,''), timeout, auto_select, priority, updated FROM boot_policies ORDER BY priority, name`)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := []BootPolicy{}
+	for rows.Next() {
+		var p BootPolicy
+		var window string
+		var timeout sql.NullInt64
+		var auto sql.NullBool
+		if err := rows.Scan(&p.ID, &p.Name, &p.GroupID, &window, &p.Default, &timeout, &auto, &p.Priority, &p.Updated); err != nil { return nil, err }
+		if window != "" { _ = json.Unmarshal([]byte(window), &p.Window) }
+		if timeout.Valid { t := int(timeout.Int64); p.Timeout = &t }
+		if auto.Valid { p.AutoSelect = &auto.Bool }
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+func policyRank(p BootPolicy) int {
+	r := 0
+	if p.GroupID != "" { r += 2 }
+	if p.Window != nil { r++ }
+	return r
+}
+
+// bootPoliciesFor returns the policies in force for mac at t, lowest
+// precedence first.
+func (s *Server) bootPoliciesFor(mac string, t time.Time) ([]BootPolicy, error) {
+	all, err := s.listBootPolicies()
+	if err != nil || len(all) == 0 { return nil, err }
+	groups := map[string]bool{"": true}
+	if mac != "" {
+		ids, err := s.groupsForMachine(mac)
+		if err != nil { return nil, err }
+		for _, id := range ids { groups[id] = true }
+	}
+	var out []BootPolicy
+	for _, p := range all {
+		if groups[p.GroupID] && (p.Window == nil || p.Window.contains(t)) { out = append(out, p) }
+	}
+	// stable: equal ranks keep priority order from the query
+	for i := 1; i < len(out); i++ {
+		for j := i; j > 0 && policyRank(out[j]) < policyRank(out[j-1]); j-- { out[j], out[j-1] = out[j-1], out[j] }
+	}
+	return out, nil
+}
+
+// applyBootPolicies returns the site to render with the policies folded in,
+// leaving the shared site untouched.
+func applyBootPolicies(site *Site, policies []BootPolicy) *Site {
+	if len(policies) == 0 { return site }
+	var st Site
+	if site != nil { st = *site }
+	var b MenuBranding
+	if st.Branding != nil { b = *st.Branding }
+	for _, p := range policies {
+		if p.Default != "" { st.DefaultEntry = p.Default }
+		if p.Timeout != nil { b.Timeout = p.Timeout }
+		if p.AutoSelect != nil { b.AutoSelect = *p.AutoSelect }
+	}
+	st.Branding = &b
+	if st.DefaultEntry != "" && len(st.MenuItems) > 0 {
+		return applyBootDecision(&st, &bootDecision{Default: st.DefaultEntry})
+	}
+	return &st
+}
+
+func (s *Server) bootPolicyRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/boot_policies", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+			out, err := s.listBootPolicies()
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			writeJSON(w, 200, out)
+		case http.MethodPost, http.MethodPut:
+			var p BootPolicy
+			if !decodeJSON(w, r, &p) { return }
+			p.Default = strings.TrimSpace(p.Default)
+			if err := validateBootPolicy(p); err != nil { badRequest(w, err); return }
+			if p.GroupID != "" {
+				var n int
+				_ = s.DB.QueryRow(`SELECT COUNT(*) FROM machine_groups WHERE id=?`, p.GroupID).Scan(&n)
+				if n == 0 { http.Error(w, "unknown group_id", 400); return }
+			}
+			var window any
+			if p.Window != nil { js, _ := json.Marshal(p.Window); window = string(js) }
+			p.Updated = time.Now().Format(time.RFC3339)
+			if r.Method == http.MethodPut {
+				res, err := s.DB.Exec(`UPDATE boot_policies SET name=?, group_id=?, schedule=?, default_entry=?, timeout=?, auto_select=?, priority=?, updated=? WHERE id=?`,
+					p.Name, p.GroupID, window, p.Default, p.Timeout, p.AutoSelect, p.Priority, p.Updated, p.ID)
+				if err != nil { http.Error(w, err.Error(), 500); return }
+				if n, _ := res.RowsAffected(); n == 0 { http.NotFound(w, r); return }
+				s.audit(s.actorID(r), "update", "boot_policy", map[string]any{"id": p.ID, "name": p.Name})
+				writeJSON(w, 200, p)
+				return
+			}
+			p.ID = "bpol-" + genID()
+			_, err := s.DB.Exec(`INSERT INTO boot_policies (id, name, group_id, schedule, default_entry, timeout, auto_select, priority, updated) VALUES (?,?,?,?,?,?,?,?,?)`,
+				p.ID, p.Name, p.GroupID, window, p.Default, p.Timeout, p.AutoSelect, p.Priority, p.Updated)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "create", "boot_policy", map[string]any{"id": p.ID, "name": p.Name})
+			writeJSON(w, 201, p)
+		case http.MethodDelete:
+			var body struct{ ID string `json:"id"` }
+			if !decodeJSON(w, r, &body) { return }
+			if _, err := s.DB.Exec(`DELETE FROM boot_policies WHERE id=?`, body.ID); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "delete", "boot_policy", map[string]any{"id": body.ID})
+			writeJSON(w, 200, map[string]any{"deleted": body.ID})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// ?mac=&ip=&at=RFC3339 -> policies in force and the resulting menu
+	s.Mux.HandleFunc("/api/v1/admin/boot_policies/preview", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		at := time.Now()
+		if v := r.URL.Query().Get("at"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil { http.Error(w, "at must be RFC3339", 400); return }
+			at = t
+		}
+		mac := normalizeMAC(r.URL.Query().Get("mac"))
+		var site *Site
+		if ip := net.ParseIP(r.URL.Query().Get("ip")); ip != nil {
+			var err error
+			if site, err = s.siteForIP(ip); err != nil { http.Error(w, err.Error(), 500); return }
+		}
+		policies, err := s.bootPoliciesFor(mac, at)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if policies == nil { policies = []BootPolicy{} }
+		eff := s.applyAvailability(applyBootPolicies(site, policies), mac, at)
+		args, _ := s.kernelArgsFor(mac, site)
+		writeJSON(w, 200, map[string]any{"mac": mac, "at": at.Format(time.RFC3339), "policies": policies, "branding": menuBranding(eff), "script": renderBootMenu(eff, "", args, s.assetPins())})
+	})
+}
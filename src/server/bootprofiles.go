@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// ---- Boot profiles ----
+// A boot profile is an iPXE script template rendered in place of the stock
+// menu. /ipxe/boot.ipxe renders the profile assigned to the requesting
+// machine (machines.boot_profile), else the profile marked default, else the
+// stock menu; a boot entry name in machines.boot_profile is shorthand for the
+// stock menu with that entry preselected. Templates see MAC, UUID, Serial,
+// Hostname, IP, Site, ServerURL, Default (the preselected entry) and Menu (the
+// stock menu as it would have been served, so a profile can wrap it), plus
+// {{asset "/assets/..."}} for a fetchable URL (mirror, CDN, pinned version
+// and download token applied) and {{args "entry"}} for merged kernel
+// arguments. A template that fails to render falls back to the stock menu.
+// Saving checks the kernel/initrd pairs the template boots (see kernel
+// pairs) and refuses mismatches unless ?force=1. Exam profiles
+// (kind "exam") have no template; see examprofiles.go. A profile with a
+// site_id belongs to that site's admins (see site scopes).
+type BootProfile struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Kind         string   `json:"kind"` // template|exam
+	Template     string   `json:"template"`
+	ImageID      string   `json:"image_id,omitempty"`      // exam: pinned image
+	ImageVersion int      `json:"image_version,omitempty"` // exam: pinned version
+	ImageSHA256  string   `json:"image_sha256,omitempty"`  // exam: expected hash of that version
+	IsDefault    bool     `json:"is_default"`
+	SiteID       string   `json:"site_id,omitempty"` // owning site, empty for all
+	Notes        string   `json:"notes"`
+	Updated      string   `json:"updated"`
+	Warnings     []string `json:"warnings,omitempty"` // kernel/initrd pairing, on save
+}
+
+const bootProfileColumns = `id, name, kind, template, COALESCE(image_id,''), COALESCE(image_version,0), COALESCE(image_sha256,''), is_default, COALESCE(notes,''), updated, COALESCE(site_id,'')`
+
+func scanBootProfile(row interface{ Scan(...any) error }, extra ...any) (*BootProfile, error) {
+	var bp BootProfile
+	err := row.Scan(append([]any{&bp.ID, &bp.Name, &bp.Kind, &bp.Template, &bp.ImageID, &bp.ImageVersion, &bp.ImageSHA256, &bp.IsDefault, &bp.Notes, &bp.Updated, &bp.SiteID}, extra...)...)
+	return &bp, err
+}
+
+func initBootProfiles(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS boot_profiles (
+		id TEXT PRIMARY KEY,
+		name TEXT UNIQUE NOT NULL,
+		template TEXT NOT NULL,
+		is_default INTEGER NOT NULL DEFAULT 0,
+		notes TEXT,
+		updated TEXT NOT NULL
+	)`)
+	return err
+}
+
+// profileContext is what a boot profile template renders against.
+type profileContext struct {
+	Vars  map[string]string
+	Asset func(string) string
+	Args  map[string]string
+}
+
+func renderBootProfile(body string, pc profileContext) (string, error) {
+	args := func(entry string) (string, error) {
+		if a, ok := pc.Args[entry]; ok { return a, nil }
+		for _, e := range bootEntries { if e.Name == entry { return e.Args, nil } }
+		return "", fmt.Errorf("unknown entry %q", entry)
+	}
+	t, err := template.New("boot_profile").Option("missingkey=error").Funcs(template.FuncMap{"asset": pc.Asset, "args": args}).Parse(body)
+	if err != nil { return "", err }
+	var out bytes.Buffer
+	if err := t.Execute(&out, pc.Vars); err != nil { return "", err }
+	if !strings.HasPrefix(strings.TrimSpace(out.String()), "#!ipxe") { return "", errors.New("rendered script does not start with #!ipxe") }
+	return out.String(), nil
+}
+
+// scriptSerial returns serial for use in a boot script: at most 64 letters,
+// digits and . _ : / -, or "" for anything else (or a placeholder). The
+// query's serial is whatever the client sent, and a stored one may have come
+// from it.
+func scriptSerial(serial string) string {
+	serial = normalizeSerial(serial)
+	if len(serial) > 64 { return "" }
+	for _, c := range serial {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("._:/-", c)) { return "" }
+	}
+	return serial
+}
+
+// profileContextFor fills the template variables for the requesting client.
+// The uuid and serial from the query are checked against strict character
+// sets, as they are rendered into the script.
+func (s *Server) profileContextFor(r *http.Request, site *Site, menu string, asset func(string) string, args map[string]string) profileContext {
+	mac := normalizeMAC(r.URL.Query().Get("mac"))
+	vars := map[string]string{"MAC": mac, "UUID": normalizeUUID(r.URL.Query().Get("uuid")), "Serial": scriptSerial(r.URL.Query().Get("serial")), "Hostname": "", "IP": "",
+		"Site": "", "ServerURL": getenv("BOOTAH_PUBLIC_URL", ""), "Default": getenv("BOOTAH_IPXE_DEFAULT", "winpe"), "Menu": menu}
+	if ip := clientIP(r); ip != nil { vars["IP"] = ip.String() }
+	if site != nil {
+		vars["Site"] = site.Name
+		if site.DefaultEntry != "" { vars["Default"] = site.DefaultEntry }
+	}
+	if m, err := scanMachine(s.DB.QueryRow(`SELECT `+machineColumns+` WHERE m.mac=?`, mac)); err == nil {
+		vars["Hostname"] = m.Hostname
+		if vars["UUID"] == "" { vars["UUID"] = normalizeUUID(m.UUID) }
+		if vars["Serial"] == "" { vars["Serial"] = scriptSerial(m.Serial) }
+	}
+	return profileContext{Vars: vars, Asset: asset, Args: args}
+}
+
+// sampleProfileContext fills every variable so templates can be checked on save.
+func sampleProfileContext() profileContext {
+	return profileContext{
+		Vars: map[string]string{"MAC": "52:54:00:00:00:01", "UUID": "00000000-0000-0000-0000-000000000001", "Serial": "SAMPLE", "Hostname": "sample",
+			"IP": "192.0.2.10", "Site": "", "ServerURL": getenv("BOOTAH_PUBLIC_URL", ""), "Default": "winpe", "Menu": renderBootMenu(nil, "", nil, nil)},
+		Asset: bootAssetURL(nil, "", nil),
+	}
+}
+
+func validateBootProfile(p BootProfile) error {
+	if strings.TrimSpace(p.Name) == "" { return errors.New("name required") }
+	if p.Kind == "exam" { return validateExamProfile(p) }
+	if p.Kind != "template" { return errors.New("kind must be template or exam") }
+	if _, err := renderBootProfile(p.Template, sampleProfileContext()); err != nil { return fmt.Errorf("template: %w", err) }
+	return nil
+}
+
+// bootProfileFor returns the profile for mac, or nil for the stock menu. A
+// boot entry name assigned to the machine comes back as entry.
+func (s *Server) bootProfileFor(mac string) (p *BootProfile, entry string, err error) {
+	ref := ""
+	if mac != "" { ref = s.machineBootProfile(mac) }
+	for _, e := range bootEntries {
+		if ref != "" && e.Name == ref { return nil, ref, nil }
+	}
+	q, args := `SELECT `+bootProfileColumns+` FROM boot_profiles WHERE is_default=1 LIMIT 1`, []any{}
+	if ref != "" {
+		q, args = `SELECT `+bootProfileColumns+` FROM boot_profiles WHERE id=? OR is_default=1 ORDER BY id=? DESC LIMIT 1`, []any{ref, ref}
+	}
+	bp, err := scanBootProfile(s.DB.QueryRow(q, args...))
+	if errors.Is(err, sql.ErrNoRows) { return nil, "", nil }
+	if err != nil { return nil, "", err }
+	return bp, "", nil
+}
+
+// bootProfileExists reports whether ref names a profile or a boot entry.
+func (s *Server) bootProfileExists(ref string) bool {
+	for _, e := range bootEntries { if e.Name == ref { return true } }
+	var n int
+	_ = s.DB.QueryRow(`SELECT COUNT(*) FROM boot_profiles WHERE id=?`, ref).Scan(&n)
+	return n > 0
+}
+
+func (s *Server) saveBootProfile(p BootProfile, update bool) error {
+	tx, err := s.DB.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+	if p.IsDefault {
+		if _, err := tx.Exec(`UPDATE boot_profiles SET is_default=0 WHERE id<>?`, p.ID); err != nil { return err }
+	}
+	if update {
+		res, err := tx.Exec(`UPDATE boot_profiles SET name=?, kind=?, template=?, image_id=NULLIF(?,''), image_version=NULLIF(?,0), image_sha256=NULLIF(?,''), is_default=?, notes=?, updated=?, site_id=NULLIF(?,'') WHERE id=?`,
+			p.Name, p.Kind, p.Template, p.ImageID, p.ImageVersion, p.ImageSHA256, p.IsDefault, p.Notes, p.Updated, p.SiteID, p.ID)
+		if err != nil { return err }
+		if n, _ := res.RowsAffected(); n == 0 { return sql.ErrNoRows }
+	} else if _, err := tx.Exec(`INSERT INTO boot_profiles (id, name, kind, template, image_id, image_version, image_sha256, is_default, notes, updated, site_id) VALUES (?,?,?,?,NULLIF(?,''),NULLIF(?,0),NULLIF(?,''),?,?,?,NULLIF(?,''))`,
+		p.ID, p.Name, p.Kind, p.Template, p.ImageID, p.ImageVersion, p.ImageSHA256, p.IsDefault, p.Notes, p.Updated, p.SiteID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Server) bootProfileRoutes() {
+	s.Mux.HandleFunc("/api/v1/boot_profiles", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := s.DB.Query(`SELECT ` + bootProfileColumns + `, (SELECT COUNT(*) FROM machines m WHERE m.boot_profile=boot_profiles.id) FROM boot_profiles ORDER BY name`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			type listed struct {
+				BootProfile
+				Machines int `json:"machines"`
+			}
+			out := []listed{}
+			for rows.Next() {
+				var n int
+				bp, err := scanBootProfile(rows, &n)
+				if err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, listed{*bp, n})
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPost, http.MethodPut:
+			if !s.requireRole(w, r, "admin") { return }
+			var p BootProfile
+			if !decodeJSON(w, r, &p) { return }
+			p.Name = strings.TrimSpace(p.Name)
+			if p.Kind == "" { p.Kind = "template" }
+			if err := validateBootProfile(p); err != nil { badRequest(w, err); return }
+			if p.SiteID != "" {
+				var n int
+				_ = s.DB.QueryRow(`SELECT COUNT(*) FROM sites WHERE id=?`, p.SiteID).Scan(&n)
+				if n == 0 { http.Error(w, "unknown site_id", 400); return }
+			}
+			if p.Kind == "exam" {
+				if err := s.checkExamProfile(&p); err != nil { badRequest(w, err); return }
+			}
+			for _, pr := range s.profilePairs(p.Template, nil) {
+				if len(pr.Errors) > 0 && r.URL.Query().Get("force") != "1" { http.Error(w, strings.Join(pr.Errors, "; ")+" (save with ?force=1 to override)", 400); return }
+				p.Warnings = append(append(p.Warnings, pr.Errors...), pr.Warnings...)
+			}
+			p.Updated = time.Now().Format(time.RFC3339)
+			status, action := 200, "update"
+			if r.Method == http.MethodPost { p.ID, status, action = "bprof-"+genID(), 201, "create" }
+			if err := s.saveBootProfile(p, r.Method == http.MethodPut); err != nil {
+				if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+				http.Error(w, err.Error(), 500); return
+			}
+			meta := map[string]any{"id": p.ID, "name": p.Name, "default": p.IsDefault}
+			if p.Kind == "exam" { meta["image_id"], meta["image_version"], meta["image_sha256"] = p.ImageID, p.ImageVersion, p.ImageSHA256 }
+			s.audit(s.actorID(r), action, "boot_profile", meta)
+			writeJSON(w, status, p)
+		case http.MethodDelete:
+			if !s.requireRole(w, r, "admin") { return }
+			var body struct{ ID string `json:"id"` }
+			if !decodeJSON(w, r, &body) { return }
+			res, err := s.DB.Exec(`DELETE FROM boot_profiles WHERE id=?`, body.ID)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			if n, _ := res.RowsAffected(); n == 0 { http.NotFound(w, r); return }
+			// machines that used it fall back to the default profile
+			_, _ = s.DB.Exec(`UPDATE machines SET boot_profile=NULL WHERE boot_profile=?`, body.ID)
+			s.audit(s.actorID(r), "delete", "boot_profile", map[string]any{"id": body.ID})
+			writeJSON(w, 200, map[string]any{"deleted": body.ID})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ---- Boot menu branding ----
+// A site can give its boot menu its own title, message of the day (shown as
+// separator lines above the entries), auto-boot timeout and ANSI colours, so
+// a lab or customer environment is recognisable at boot. Unset fields fall
+// back to BOOTAH_MENU_TITLE, BOOTAH_MENU_MOTD and BOOTAH_MENU_TIMEOUT
+// (seconds, 0 = wait for a choice), then to the stock menu. Colours are ANSI
+// names or numbers 0-7 and map to iPXE colour pairs: foreground/background
+// for normal text, highlight_* for the selected entry. auto_select skips the
+// menu and boots the default unless M is pressed within three seconds.
+// Title and MOTD go into iPXE commands, so they are limited to letters,
+// digits, spaces and ipxeTextPunct; anything else, including what the
+// environment defaults carry, is replaced when the menu is rendered.
+type MenuBranding struct {
+	Title               string `json:"title,omitempty"`
+	MOTD                string `json:"motd,omitempty"`
+	Timeout             *int   `json:"timeout,omitempty"` // seconds; 0 = no timeout
+	Foreground          string `json:"foreground,omitempty"`
+	Background          string `json:"background,omitempty"`
+	HighlightForeground string `json:"highlight_foreground,omitempty"`
+	HighlightBackground string `json:"highlight_background,omitempty"`
+	AutoSelect          bool   `json:"auto_select,omitempty"`
+}
+
+var ansiColours = []string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+// ansiColour returns the ANSI index for a colour name or number, -1 for "".
+func ansiColour(c string) (int, error) {
+	c = strings.ToLower(strings.TrimSpace(c))
+	if c == "" { return -1, nil }
+	for i, n := range ansiColours { if n == c { return i, nil } }
+	if n, err := strconv.Atoi(c); err == nil && n >= 0 && n < len(ansiColours) { return n, nil }
+	return 0, fmt.Errorf("invalid colour %q (want %s or 0-7)", c, strings.Join(ansiColours, ", "))
+}
+
+func printableLine(s string) bool {
+	for _, r := range s { if unicode.IsControl(r) { return false } }
+	return true
+}
+
+// ipxeTextPunct is the punctuation allowed in menu text: none of it means
+// anything to the iPXE command line, unlike $, &, |, #, quotes or backslash.
+const ipxeTextPunct = ".,:;!?()[]/_+=@*%<>~^-"
+
+func ipxeTextRune(r rune) bool {
+	return r == ' ' || unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(ipxeTextPunct, r)
+}
+
+func ipxeSafeText(s string) bool {
+	for _, r := range s { if !ipxeTextRune(r) { return false } }
+	return true
+}
+
+// ipxeText makes one line of menu text safe to put after an iPXE command,
+// replacing any other character with '?'.
+func ipxeText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if ipxeTextRune(r) { return r }
+		return '?'
+	}, s)
+}
+
+func validateBranding(b *MenuBranding) error {
+	if b == nil { return nil }
+	if len(b.Title) > 80 || !printableLine(b.Title) { return fmt.Errorf("title must be a single line of at most 80 characters") }
+	if !ipxeSafeText(b.Title) || !ipxeSafeText(strings.NewReplacer("\r", "", "\n", "").Replace(b.MOTD)) {
+		return fmt.Errorf("title and motd may only contain letters, digits, spaces and %s", ipxeTextPunct)
+	}
+	lines := strings.Split(strings.ReplaceAll(b.MOTD, "\r\n", "\n"), "\n")
+	if len(lines) > 10 { return fmt.Errorf("motd may have at most 10 lines") }
+	for _, l := range lines {
+		if len(l) > 76 || !printableLine(l) { return fmt.Errorf("motd lines must be at most 76 printable characters") }
+	}
+	if b.Timeout != nil && (*b.Timeout < 0 || *b.Timeout > 3600) { return fmt.Errorf("timeout must be between 0 and 3600 seconds") }
+	for _, c := range []string{b.Foreground, b.Background, b.HighlightForeground, b.HighlightBackground} {
+		if _, err := ansiColour(c); err != nil { return err }
+	}
+	return nil
+}
+
+// menuBranding merges a site's branding over the BOOTAH_MENU_* defaults.
+func menuBranding(site *Site) MenuBranding {
+	b := MenuBranding{Title: getenv("BOOTAH_MENU_TITLE", "Bootah iPXE Menu"), MOTD: getenv("BOOTAH_MENU_MOTD", "")}
+	if t, err := strconv.Atoi(getenv("BOOTAH_MENU_TIMEOUT", "0")); err == nil && t > 0 { b.Timeout = &t }
+	if site == nil || site.Branding == nil { return b }
+	sb := site.Branding
+	if sb.Title != "" { b.Title = sb.Title }
+	if sb.MOTD != "" { b.MOTD = sb.MOTD }
+	if sb.Timeout != nil { b.Timeout = sb.Timeout }
+	b.AutoSelect = sb.AutoSelect
+	b.Foreground, b.Background, b.HighlightForeground, b.HighlightBackground = sb.Foreground, sb.Background, sb.HighlightForeground, sb.HighlightBackground
+	return b
+}
+
+// ipxeColours returns the cpair commands for b, empty when no colour is set.
+func (b MenuBranding) ipxeColours() string {
+	cpair := func(fg, bg string, pairs ...int) string {
+		f, _ := ansiColour(fg)
+		g, _ := ansiColour(bg)
+		if f < 0 && g < 0 { return "" }
+		var opts string
+		if f >= 0 { opts += fmt.Sprintf(" --foreground %d", f) }
+		if g >= 0 { opts += fmt.Sprintf(" --background %d", g) }
+		var out string
+		for _, p := range pairs { out += fmt.Sprintf("cpair%s %d\n", opts, p) }
+		return out
+	}
+	// iPXE pairs: 0 default, 1 normal, 2 selected, 3 separator
+	return cpair(b.Foreground, b.Background, 0, 1, 3) + cpair(b.HighlightForeground, b.HighlightBackground, 2)
+}
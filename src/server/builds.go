@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ---- Image build pipeline (Packer callbacks) ----
+// A build is the pending next version of an image. Packer (or any CI job)
+// creates it before building, streams its log to /log, and PUTs the artifact
+// when done, authenticating with the build token returned at creation. The
+// artifact is validated (non-empty, known type, sha256 if the builder sent
+// one) and then promoted to an image when the build asked for it or its name
+// matches BOOTAH_BUILD_AUTO_PROMOTE (comma-separated globs); otherwise it
+// waits in "validated" for an operator to promote it.
+const maxBuildLog = 8 << 20
+
+func initBuilds(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS image_builds (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		status TEXT NOT NULL,
+		replaces TEXT,
+		changelog TEXT,
+		ticket TEXT,
+		promote INTEGER NOT NULL DEFAULT 0,
+		token_hash TEXT NOT NULL,
+		file TEXT,
+		type TEXT,
+		size_mb INTEGER,
+		sha256 TEXT,
+		image_id TEXT,
+		error TEXT,
+		log TEXT NOT NULL DEFAULT '',
+		created_by INTEGER,
+		created_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL
+	)`)
+	return err
+}
+
+func buildFinished(status string) bool { return status == "promoted" || status == "failed" }
+
+func (s *Server) setBuildStatus(id, status, cause string) {
+	_, _ = s.DB.Exec(`UPDATE image_builds SET status=?, error=?, updated_at=? WHERE id=?`, status, cause, time.Now().Format(time.RFC3339), id)
+}
+
+// buildAuthorized accepts the build's own token or an operator session.
+func (s *Server) buildAuthorized(w http.ResponseWriter, r *http.Request, id string) bool {
+	if tok := r.Header.Get("X-Bootah-Build-Token"); tok != "" {
+		var hash string
+		if err := s.DB.QueryRow(`SELECT token_hash FROM image_builds WHERE id=?`, id).Scan(&hash); err == nil &&
+			subtle.ConstantTimeCompare([]byte(hashToken(tok)), []byte(hash)) == 1 {
+			return true
+		}
+		http.Error(w, "invalid build token", 401)
+		return false
+	}
+	return s.requireRole(w, r, "operator")
+}
+
+func autoPromote(name string) bool {
+	for _, pat := range splitList(getenv("BOOTAH_BUILD_AUTO_PROMOTE", "")) {
+		if ok, _ := path.Match(strings.ToLower(pat), strings.ToLower(name)); ok { return true }
+	}
+	return false
+}
+
+// storeBuildArtifact streams the artifact into storage, hashing it on the way.
+func (s *Server) storeBuildArtifact(ctx context.Context, filename string, body io.Reader) (string, int64, string, error) {
+	key := genID() + strings.ToLower(filepath.Ext(filename))
+	size, sum, err := s.StorePut(ctx, key, body)
+	if err != nil { return "", 0, "", err }
+	return key, size, sum, nil
+}
+
+// validateBuild applies the artifact checks, returning the first failure.
+func validateBuild(typ string, size int64, sum, expected string) error {
+	if size == 0 { return errors.New("artifact is empty") }
+	if typ == "" { return errors.New("artifact has no file extension to detect its type from") }
+	if expected != "" && !strings.EqualFold(expected, sum) { return fmt.Errorf("sha256 mismatch: builder reported %s, received %s", expected, sum) }
+	return nil
+}
+
+// promoteBuild turns a validated build into an image version.
+func (s *Server) promoteBuild(id string, actor *int64) (string, error) {
+	var name, status, replaces, changelog, ticket, file, typ, sum string
+	var size int64
+	var owner sql.NullInt64
+	err := s.DB.QueryRow(`SELECT name, status, COALESCE(replaces,''), COALESCE(changelog,''), COALESCE(ticket,''), COALESCE(file,''), COALESCE(type,''),
+		COALESCE(size_mb,0), COALESCE(sha256,''), created_by FROM image_builds WHERE id=?`, id).
+		Scan(&name, &status, &replaces, &changelog, &ticket, &file, &typ, &size, &sum, &owner)
+	if err != nil { return "", err }
+	if status != "validated" { return "", fmt.Errorf("build is %s, not validated", status) }
+	res, err := s.DB.Exec(`UPDATE image_builds SET status='promoting' WHERE id=? AND status='validated'`, id)
+	if err != nil { return "", err }
+	if n, _ := res.RowsAffected(); n == 0 { return "", errors.New("build is already being promoted") }
+	prevID, err := s.previousImageVersion(name, replaces)
+	if err == nil { err = checkChangelog(prevID, changelog, ticket) }
+	if err != nil { s.setBuildStatus(id, "validated", ""); return "", err }
+	imageID, version := prevID, 1
+	if prevID != "" {
+		version, err = s.addImageVersion(prevID, ImageVersion{File: file, Type: typ, SizeMB: size, SHA256: sum, Changelog: changelog, Ticket: ticket, Author: "build " + id})
+		if err != nil { s.setBuildStatus(id, "validated", ""); return "", err }
+		_ = s.DB.QueryRow(`SELECT name FROM images WHERE id=?`, imageID).Scan(&name)
+	} else {
+		imageID = genID()
+		var ownerID any
+		if owner.Valid { ownerID = owner.Int64 }
+		if _, err := s.DB.Exec(`INSERT INTO images (id, name, type, size_mb, updated, file, owner_id, sha256) VALUES (?,?,?,?,?,?,?,?)`,
+			imageID, name, typ, size, time.Now().Format("2006-01-02"), file, ownerID, sum); err != nil {
+			s.setBuildStatus(id, "validated", "")
+			return "", err
+		}
+		if err := s.recordFirstImageVersion(imageID, "build "+id); err != nil { log.Printf("image %s version: %v", imageID, err) }
+	}
+	_, _ = s.DB.Exec(`UPDATE image_builds SET status='promoted', image_id=?, updated_at=? WHERE id=?`, imageID, time.Now().Format(time.RFC3339), id)
+	event := "added"
+	if prevID != "" { event = "updated" }
+	s.imageStored(imageID, version, event, name, typ, map[string]any{"size_mb": size, "build_id": id})
+	s.queueImageInspection(imageID, version, typ)
+	s.audit(actor, "promote", "image_build", map[string]any{"id": id, "image_id": imageID, "version": version})
+	return imageID, nil
+}
+
+func (s *Server) handleBuildArtifact(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPut { http.Error(w, "method not allowed", 405); return }
+	var name, status string
+	var promote bool
+	if err := s.DB.QueryRow(`SELECT name, status, promote FROM image_builds WHERE id=?`, id).Scan(&name, &status, &promote); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+		http.Error(w, err.Error(), 500); return
+	}
+	filename := r.URL.Query().Get("filename")
+	if filename == "" { http.Error(w, "filename required", 400); return }
+	if !s.requireDiskSpace(w, r) { return }
+	res, err := s.DB.Exec(`UPDATE image_builds SET status='uploading', updated_at=? WHERE id=? AND status IN ('pending','building')`, time.Now().Format(time.RFC3339), id)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	if n, _ := res.RowsAffected(); n == 0 { http.Error(w, "build already has an artifact ("+status+")", 409); return }
+	limitUploadBody(w, r)
+	key, size, sum, err := s.storeBuildArtifact(r.Context(), filename, r.Body)
+	if err != nil { s.setBuildStatus(id, "failed", "store: "+err.Error()); uploadFailed(w, err, 500, "store put: "); return }
+	typ := detectType(filename)
+	_, _ = s.DB.Exec(`UPDATE image_builds SET file=?, type=?, size_mb=?, sha256=? WHERE id=?`, key, typ, size/(1024*1024), sum, id)
+	if err := validateBuild(typ, size, sum, r.URL.Query().Get("sha256")); err != nil {
+		_ = s.Store.Delete(r.Context(), key)
+		s.setBuildStatus(id, "failed", "validation: "+err.Error())
+		s.notify("error", "build_failed", "Build "+id+" of "+name+" failed validation", map[string]any{"build_id": id, "error": err.Error()})
+		writeJSON(w, 422, map[string]any{"id": id, "status": "failed", "error": err.Error()}); return
+	}
+	s.setBuildStatus(id, "validated", "")
+	out := map[string]any{"id": id, "status": "validated", "sha256": sum, "size_mb": size/(1024*1024)}
+	if promote || autoPromote(name) {
+		imageID, err := s.promoteBuild(id, nil)
+		if err != nil {
+			out["promotion_error"] = err.Error()
+		} else {
+			out["status"], out["image_id"] = "promoted", imageID
+		}
+	}
+	writeJSON(w, 200, out)
+}
+
+// buildLogSQL returns the expressions for the log's length in bytes and its
+// bytes from a 1-based offset; the text functions count characters.
+func buildLogSQL() (length, from string) {
+	if dbDriver == "postgres" { return `octet_length(log)`, `substr(convert_to(log, 'UTF8'), ?)` }
+	return `length(CAST(log AS BLOB))`, `substr(CAST(log AS BLOB), ?)`
+}
+
+// utf8Prefix returns how much of b ends on a whole UTF-8 sequence; the rest
+// is the start of a character the next read completes.
+func utf8Prefix(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if utf8.FullRune(b[i:]) { return len(b) }
+			return i
+		}
+	}
+	return len(b)
+}
+
+// handleBuildLog appends to (POST, streamed) or reads (GET) a build log.
+// Appends are cut at character boundaries (invalid bytes become U+FFFD), so
+// the log stays valid UTF-8 and a reader's byte offset always falls between
+// characters. GET ?follow=1 keeps the response open until the build
+// finishes.
+func (s *Server) handleBuildLog(w http.ResponseWriter, r *http.Request, id string) {
+	length, from := buildLogSQL()
+	switch r.Method {
+	case http.MethodPost:
+		buf := make([]byte, 32<<10)
+		var pending []byte
+		started := false
+		for {
+			n, err := r.Body.Read(buf)
+			pending = append(pending, buf[:n]...)
+			cut := utf8Prefix(pending)
+			if err != nil { cut = len(pending) }
+			if cut > 0 {
+				if !started {
+					_, _ = s.DB.Exec(`UPDATE image_builds SET status='building' WHERE id=? AND status='pending'`, id)
+					started = true
+				}
+				if _, err := s.DB.Exec(`UPDATE image_builds SET log = log || ?, updated_at=? WHERE id=? AND `+length+` < ?`,
+					strings.ToValidUTF8(string(pending[:cut]), "\uFFFD"), time.Now().Format(time.RFC3339), id, maxBuildLog); err != nil {
+					http.Error(w, err.Error(), 500); return
+				}
+				pending = append(pending[:0], pending[cut:]...)
+			}
+			if err == io.EOF { break }
+			if err != nil { http.Error(w, err.Error(), 400); return }
+		}
+		writeJSON(w, 200, map[string]any{"ok": true})
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		follow := r.URL.Query().Get("follow") == "1"
+		if follow { streamResponse(w) }
+		offset := 0
+		for {
+			var chunk []byte
+			var status string
+			if err := s.DB.QueryRow(`SELECT `+from+`, status FROM image_builds WHERE id=?`, offset+1, id).Scan(&chunk, &status); err != nil {
+				if offset == 0 { http.NotFound(w, r) }
+				return
+			}
+			if len(chunk) > 0 {
+				_, _ = w.Write(chunk)
+				offset += len(chunk)
+				if f, ok := w.(http.Flusher); ok { f.Flush() }
+			}
+			if !follow || buildFinished(status) { return }
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+func (s *Server) buildRoutes() {
+	s.Mux.HandleFunc("/api/v1/builds", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := s.DB.Query(`SELECT id, name, status, COALESCE(image_id,''), COALESCE(error,''), created_at, updated_at FROM image_builds ORDER BY created_at DESC LIMIT 200`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			out := []map[string]any{}
+			for rows.Next() {
+				var id, name, status, image, cause, created, updated string
+				if err := rows.Scan(&id, &name, &status, &image, &cause, &created, &updated); err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, map[string]any{"id": id, "name": name, "status": status, "image_id": image, "error": cause, "created_at": created, "updated_at": updated})
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPost:
+			// {"name": "win11-base", "replaces": "", "changelog": "...", "ticket": "", "promote": true}
+			var body struct {
+				Name      string `json:"name"`
+				Replaces  string `json:"replaces"`
+				Changelog string `json:"changelog"`
+				Ticket    string `json:"ticket"`
+				Promote   bool   `json:"promote"`
+			}
+			if !decodeJSON(w, r, &body) { return }
+			if strings.TrimSpace(body.Name) == "" { http.Error(w, "name required", 400); return }
+			prevID, err := s.previousImageVersion(body.Name, body.Replaces)
+			if err == nil { err = checkChangelog(prevID, body.Changelog, body.Ticket) }
+			if err != nil { http.Error(w, err.Error(), 400); return }
+			id := "bld-" + genID()
+			tok := randToken(32)
+			now := time.Now().Format(time.RFC3339)
+			_, err = s.DB.Exec(`INSERT INTO image_builds (id, name, status, replaces, changelog, ticket, promote, token_hash, created_by, created_at, updated_at) VALUES (?,?,?,?,?,?,?,?,?,?,?)`,
+				id, body.Name, "pending", body.Replaces, body.Changelog, body.Ticket, body.Promote, hashToken(tok), s.actorID(r), now, now)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "create", "image_build", map[string]any{"id": id, "name": body.Name})
+			writeJSON(w, 201, map[string]any{"id": id, "token": tok, "status": "pending", "replaces": prevID})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// /api/v1/builds/{id}, /log, /artifact, /fail, /promote
+	s.Mux.HandleFunc("/api/v1/builds/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/builds/"), "/"), "/")
+		id := parts[0]
+		if id == "" { http.NotFound(w, r); return }
+		action := ""
+		if len(parts) == 2 { action = parts[1] }
+		if action == "promote" {
+			if !s.requireRole(w, r, "operator") { return }
+		} else if !s.buildAuthorized(w, r, id) {
+			return
+		}
+		switch action {
+		case "":
+			if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+			var name, status, image, cause, sum, created, updated string
+			err := s.DB.QueryRow(`SELECT name, status, COALESCE(image_id,''), COALESCE(error,''), COALESCE(sha256,''), created_at, updated_at FROM image_builds WHERE id=?`, id).
+				Scan(&name, &status, &image, &cause, &sum, &created, &updated)
+			if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			writeJSON(w, 200, map[string]any{"id": id, "name": name, "status": status, "image_id": image, "error": cause, "sha256": sum, "created_at": created, "updated_at": updated})
+		case "log":
+			s.handleBuildLog(w, r, id)
+		case "artifact":
+			s.handleBuildArtifact(w, r, id)
+		case "fail":
+			if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+			var body struct{ Error string `json:"error"` }
+			if r.ContentLength != 0 && !decodeJSON(w, r, &body) { return }
+			if body.Error == "" { body.Error = "build failed" }
+			// a build that is being or has been promoted is an image now
+			res, err := s.DB.Exec(`UPDATE image_builds SET status='failed', error=?, updated_at=? WHERE id=? AND status NOT IN ('promoting','promoted','failed')`,
+				body.Error, time.Now().Format(time.RFC3339), id)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			if n, _ := res.RowsAffected(); n == 0 {
+				var status string
+				if err := s.DB.QueryRow(`SELECT status FROM image_builds WHERE id=?`, id).Scan(&status); err != nil { http.NotFound(w, r); return }
+				http.Error(w, "build is already "+status, 409); return
+			}
+			s.notify("error", "build_failed", "Build "+id+" failed: "+body.Error, map[string]any{"build_id": id})
+			writeJSON(w, 200, map[string]any{"id": id, "status": "failed"})
+		case "promote":
+			if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+			imageID, err := s.promoteBuild(id, s.actorID(r))
+			if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+			if err != nil { http.Error(w, err.Error(), 409); return }
+			writeJSON(w, 200, map[string]any{"id": id, "status": "promoted", "image_id": imageID})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ---- Configuration bundles ----
+// A bundle is a versioned JSON export of boot configuration (sites and their
+// menus, templates, task sequences, driver pack metadata, machine group
+// rules) for moving a tested setup from one environment to another. Import
+// matches rows on each section's natural key and either reports the diff
+// (?dry_run=1) or applies it in one transaction. Nothing is deleted.
+const bundleVersion = 1
+
+type bundleSection struct {
+	Name    string
+	Table   string
+	Key     string
+	Columns []string // first column is the id
+}
+
+var bundleSections = []bundleSection{
+	{"sites", "sites", "name", []string{"id", "name", "subnets", "mirror_url", "default_entry", "menu_items", "branding"}},
+	{"templates", "templates", "name", []string{"id", "name", "kind", "body", "updated"}},
+	{"task_sequences", "task_sequences", "name", []string{"id", "name", "steps", "updated"}},
+	{"driver_packs", "driver_packs", "id", []string{"id", "vendor", "model", "version", "url", "checksum", "notes"}},
+	{"machine_groups", "machine_groups", "name", []string{"id", "name", "match_vendor", "match_model", "notes"}},
+}
+
+type configBundle struct {
+	Format     string                          `json:"format"`
+	Version    int                             `json:"version"`
+	ExportedAt string                          `json:"exported_at"`
+	Source     string                          `json:"source,omitempty"`
+	Sections   map[string][]map[string]*string `json:"sections"`
+}
+
+func (s *Server) exportSection(q interface {
+	Query(string, ...any) (*sql.Rows, error)
+}, sec bundleSection) ([]map[string]*string, error) {
+	rows, err := q.Query(`SELECT ` + strings.Join(sec.Columns, ", ") + ` FROM ` + sec.Table + ` ORDER BY ` + sec.Key)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := []map[string]*string{}
+	for rows.Next() {
+		vals := make([]sql.NullString, len(sec.Columns))
+		ptrs := make([]any, len(vals))
+		for i := range vals { ptrs[i] = &vals[i] }
+		if err := rows.Scan(ptrs...); err != nil { return nil, err }
+		row := map[string]*string{}
+		for i, c := range sec.Columns {
+			if vals[i].Valid { v := vals[i].String; row[c] = &v } else { row[c] = nil }
+		}
+		out = append(out, row)
+	}
+	return out, rows.Err()
+}
+
+func (s *Server) exportBundle() (*configBundle, error) {
+	b := &configBundle{Format: "bootah-bundle", Version: bundleVersion, ExportedAt: time.Now().UTC().Format(time.RFC3339),
+		Source: getenv("BOOTAH_PUBLIC_URL", ""), Sections: map[string][]map[string]*string{}}
+	for _, sec := range bundleSections {
+		rows, err := s.exportSection(s.DB, sec)
+		if err != nil { return nil, fmt.Errorf("%s: %w", sec.Name, err) }
+		b.Sections[sec.Name] = rows
+	}
+	return b, nil
+}
+
+func strOrEmpty(p *string) string { if p == nil { return "" }; return *p }
+
+// validateBundleRow applies the same checks as the section's own API.
+func validateBundleRow(section string, row map[string]*string) error {
+	switch section {
+	case "templates":
+		if !templateKinds[strOrEmpty(row["kind"])] { return fmt.Errorf("invalid kind %q", strOrEmpty(row["kind"])) }
+	case "task_sequences":
+		var steps []TaskStep
+		if err := json.Unmarshal([]byte(strOrEmpty(row["steps"])), &steps); err != nil { return err }
+		return validateSteps(steps)
+	case "sites":
+		st := Site{Name: strOrEmpty(row["name"]), Subnets: splitList(strOrEmpty(row["subnets"]))}
+		if b := strOrEmpty(row["branding"]); b != "" {
+			if err := json.Unmarshal([]byte(b), &st.Branding); err != nil { return fmt.Errorf("branding: %w", err) }
+		}
+		return validateSite(st)
+	}
+	return nil
+}
+
+type bundleChange struct {
+	Section string   `json:"section"`
+	Key     string   `json:"key"`
+	Action  string   `json:"action"` // add|update
+	Fields  []string `json:"fields,omitempty"`
+}
+
+// importBundle diffs b against the database and, unless dryRun, applies it.
+func (s *Server) importBundle(b *configBundle, dryRun bool) ([]bundleChange, error) {
+	if b.Format != "bootah-bundle" { return nil, fmt.Errorf("not a bootah bundle") }
+	if b.Version > bundleVersion { return nil, fmt.Errorf("bundle version %d is newer than supported (%d)", b.Version, bundleVersion) }
+	tx, err := s.DB.Begin()
+	if err != nil { return nil, err }
+	defer tx.Rollback()
+	changes := []bundleChange{}
+	for _, sec := range bundleSections {
+		current, err := s.exportSection(tx, sec)
+		if err != nil { return nil, err }
+		byKey := map[string]map[string]*string{}
+		for _, row := range current { byKey[strOrEmpty(row[sec.Key])] = row }
+		for _, row := range b.Sections[sec.Name] {
+			key := strOrEmpty(row[sec.Key])
+			if key == "" { return nil, fmt.Errorf("%s: row without %s", sec.Name, sec.Key) }
+			if err := validateBundleRow(sec.Name, row); err != nil { return nil, fmt.Errorf("%s %q: %w", sec.Name, key, err) }
+			old, exists := byKey[key]
+			var diff []string
+			for _, c := range sec.Columns[1:] {
+				if c == "updated" { continue }
+				if exists && strOrEmpty(old[c]) == strOrEmpty(row[c]) { continue }
+				diff = append(diff, c)
+			}
+			if exists && len(diff) == 0 { continue }
+			ch := bundleChange{Section: sec.Name, Key: key, Action: "add"}
+			if exists { ch.Action, ch.Fields = "update", diff }
+			changes = append(changes, ch)
+			if dryRun { continue }
+			cols := sec.Columns[1:]
+			args := make([]any, 0, len(sec.Columns)+1)
+			for _, c := range cols { args = append(args, row[c]) }
+			if exists {
+				set := make([]string, len(cols))
+				for i, c := range cols { set[i] = c + "=?" }
+				_, err = tx.Exec(`UPDATE `+sec.Table+` SET `+strings.Join(set, ", ")+` WHERE `+sec.Key+`=?`, append(args, key)...)
+			} else {
+				id := strOrEmpty(row["id"])
+				var n int
+				_ = tx.QueryRow(`SELECT COUNT(*) FROM `+sec.Table+` WHERE id=?`, id).Scan(&n)
+				if id == "" || (n > 0 && sec.Key != "id") { id = genID() }
+				_, err = tx.Exec(`INSERT INTO `+sec.Table+` (id, `+strings.Join(cols, ", ")+`) VALUES (?`+strings.Repeat(",?", len(cols))+`)`, append([]any{id}, args...)...)
+			}
+			if err != nil { return nil, fmt.Errorf("%s %q: %w", sec.Name, key, err) }
+		}
+	}
+	if dryRun { return changes, nil }
+	return changes, tx.Commit()
+}
+
+func (s *Server) bundleRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/bundle/export", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		b, err := s.exportBundle()
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "bootah-bundle-"+time.Now().UTC().Format("20060102-150405")+".json"))
+		s.audit(s.actorID(r), "export", "bundle", map[string]any{})
+		writeJSON(w, 200, b)
+	})
+
+	// POST a bundle; ?dry_run=1 only reports the changes
+	s.Mux.HandleFunc("/api/v1/admin/bundle/import", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		var b configBundle
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 32<<20)).Decode(&b); err != nil { http.Error(w, err.Error(), 400); return }
+		dry := isDryRun(r)
+		changes, err := s.importBundle(&b, dry)
+		if err != nil { http.Error(w, err.Error(), 400); return }
+		if !dry { s.audit(s.actorID(r), "import", "bundle", map[string]any{"source": b.Source, "exported_at": b.ExportedAt, "changes": len(changes)}) }
+		writeJSON(w, 200, map[string]any{"dry_run": dry, "changes": changes})
+	})
+}
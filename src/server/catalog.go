@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---- Catalog change feed ----
+// Every image that enters or leaves the catalog gets a row in catalog_changes
+// with a monotonically increasing seq. /api/v1/catalog/changes?since=<seq>
+// lets mirrors poll incrementally; feed.atom and feed.rss render the latest
+// changes for humans and feed readers.
+type CatalogChange struct {
+	Seq     int64  `json:"seq"`
+	ImageID string `json:"image_id"`
+	Event   string `json:"event"` // added|derived|updated|removed
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	At      string `json:"at"`
+}
+
+func initCatalog(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS catalog_changes (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		image_id TEXT NOT NULL,
+		event TEXT NOT NULL,
+		name TEXT NOT NULL,
+		type TEXT NOT NULL,
+		at TEXT NOT NULL
+	)`)
+	return err
+}
+
+func (s *Server) recordCatalogChange(imageID, event, name, typ string) {
+	_, _ = s.DB.Exec(`INSERT INTO catalog_changes (image_id, event, name, type, at) VALUES (?,?,?,?,?)`,
+		imageID, event, name, typ, time.Now().UTC().Format(time.RFC3339))
+}
+
+func (s *Server) catalogChanges(since int64, limit int, newestFirst bool) ([]CatalogChange, error) {
+	order := "ASC"
+	if newestFirst { order = "DESC" }
+	rows, err := s.DB.Query(`SELECT seq, image_id, event, name, type, at FROM catalog_changes WHERE seq > ? ORDER BY seq `+order+` LIMIT ?`, since, limit)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := []CatalogChange{}
+	for rows.Next() {
+		var c CatalogChange
+		if err := rows.Scan(&c.Seq, &c.ImageID, &c.Event, &c.Name, &c.Type, &c.At); err != nil { return nil, err }
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func catalogBaseURL(r *http.Request) string {
+	if u := getenv("BOOTAH_PUBLIC_URL", ""); u != "" { return strings.TrimRight(u, "/") }
+	scheme := "http"
+	if r.TLS != nil { scheme = "https" }
+	return scheme + "://" + r.Host
+}
+
+func (c CatalogChange) title() string {
+	switch c.Event {
+	case "removed":
+		return "Removed: " + c.Name
+	case "derived":
+		return "Derived " + c.Type + ": " + c.Name
+	case "updated":
+		return "Updated " + c.Type + " image: " + c.Name
+	}
+	return "New " + c.Type + " image: " + c.Name
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+	Summary string   `xml:"summary"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title   string `xml:"title"`
+	Link    string `xml:"link"`
+	GUID    string `xml:"guid"`
+	PubDate string `xml:"pubDate"`
+}
+
+func (s *Server) catalogRoutes() {
+	// JSON changes since a cursor; next_since is the cursor for the following poll
+	s.Mux.HandleFunc("/api/v1/catalog/changes", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if limit <= 0 || limit > 500 { limit = 100 }
+		list, err := s.catalogChanges(since, limit, false)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		next := since
+		if len(list) > 0 { next = list[len(list)-1].Seq }
+		writeJSON(w, 200, map[string]any{"changes": list, "next_since": next, "more": len(list) == limit})
+	})
+
+	feed := func(w http.ResponseWriter, r *http.Request, format string) {
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		list, err := s.catalogChanges(0, 50, true)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		base := catalogBaseURL(r)
+		link := func(c CatalogChange) string {
+			if c.Event == "removed" { return base + "/api/v1/images" }
+			return base + "/api/v1/images/" + c.ImageID + "/download"
+		}
+		var out any
+		if format == "atom" {
+			updated := time.Now().UTC().Format(time.RFC3339)
+			if len(list) > 0 { updated = list[0].At }
+			f := atomFeed{Title: "Bootah image catalog", ID: base + "/api/v1/catalog/feed.atom", Updated: updated, Link: atomLink{Href: base + "/api/v1/catalog/feed.atom", Rel: "self"}}
+			for _, c := range list {
+				f.Entries = append(f.Entries, atomEntry{Title: c.title(), ID: base + "/api/v1/catalog/changes#" + strconv.FormatInt(c.Seq, 10), Updated: c.At, Link: atomLink{Href: link(c)}, Summary: c.Event + " " + c.ImageID})
+			}
+			w.Header().Set("Content-Type", "application/atom+xml")
+			out = f
+		} else {
+			ch := rssChannel{Title: "Bootah image catalog", Link: base + "/api/v1/images", Description: "Images added to and removed from the catalog"}
+			for _, c := range list {
+				pub := c.At
+				if t, err := time.Parse(time.RFC3339, c.At); err == nil { pub = t.Format(time.RFC1123Z) }
+				ch.Items = append(ch.Items, rssItem{Title: c.title(), Link: link(c), GUID: base + "/api/v1/catalog/changes#" + strconv.FormatInt(c.Seq, 10), PubDate: pub})
+			}
+			w.Header().Set("Content-Type", "application/rss+xml")
+			out = rssFeed{Version: "2.0", Channel: ch}
+		}
+		_, _ = w.Write([]byte(xml.Header))
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		_ = enc.Encode(out)
+	}
+	s.Mux.HandleFunc("/api/v1/catalog/feed.atom", func(w http.ResponseWriter, r *http.Request) { feed(w, r, "atom") })
+	s.Mux.HandleFunc("/api/v1/catalog/feed.rss", func(w http.ResponseWriter, r *http.Request) { feed(w, r, "rss") })
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	crand "crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---- Device certificate enrollment ----
+// Agents submit a PKCS#10 CSR as a task-sequence step. The server either signs
+// it with a local CA (BOOTAH_CA_CERT/BOOTAH_CA_KEY) or forwards it to an EST
+// server (BOOTAH_EST_URL); either way the issued cert is recorded per machine.
+// Only registered machines with an enrollment secret can enroll, and the
+// certificate names the machine as registered, whatever the CSR asks for.
+func initCerts(db *sql.DB) error {
+	ddl1 := `CREATE TABLE IF NOT EXISTS device_certs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		mac TEXT NOT NULL,
+		deployment_id TEXT,
+		serial TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		issuer TEXT NOT NULL,
+		not_before TEXT NOT NULL,
+		not_after TEXT NOT NULL,
+		source TEXT NOT NULL,
+		pem TEXT NOT NULL,
+		issued_at TEXT NOT NULL
+	);`
+	ddl2 := `CREATE INDEX IF NOT EXISTS device_certs_mac ON device_certs (mac, issued_at);`
+	for _, ddl := range []string{ddl1, ddl2} {
+		if _, err := db.Exec(ddl); err != nil { return err }
+	}
+	return nil
+}
+
+// loadCA reads the local signing CA. Files are read per request so a rotated
+// CA is picked up without a restart.
+func loadCA() (*x509.Certificate, crypto.Signer, error) {
+	certPath, keyPath := getenv("BOOTAH_CA_CERT", ""), getenv("BOOTAH_CA_KEY", "")
+	if certPath == "" || keyPath == "" { return nil, nil, errors.New("no CA configured") }
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil { return nil, nil, err }
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil { return nil, nil, err }
+	cb, _ := pem.Decode(certPEM)
+	kb, _ := pem.Decode(keyPEM)
+	if cb == nil || kb == nil { return nil, nil, errors.New("invalid CA PEM") }
+	cert, err := x509.ParseCertificate(cb.Bytes)
+	if err != nil { return nil, nil, err }
+	var key any
+	switch kb.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(kb.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(kb.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(kb.Bytes)
+	}
+	if err != nil { return nil, nil, err }
+	signer, ok := key.(crypto.Signer)
+	if !ok { return nil, nil, errors.New("unsupported CA key type") }
+	return cert, signer, nil
+}
+
+// deviceIdentity is what a machine's certificate names, taken from its
+// registered record rather than the CSR: the hostname as CN and DNS SAN, or
+// the MAC as CN when no hostname is set.
+type deviceIdentity struct {
+	CommonName string
+	DNSNames   []string
+}
+
+func (s *Server) deviceIdentity(mac string) (*deviceIdentity, error) {
+	var hostname string
+	if err := s.DB.QueryRow(`SELECT COALESCE(hostname,'') FROM machines WHERE mac=?`, mac).Scan(&hostname); err != nil { return nil, err }
+	if hostname == "" { return &deviceIdentity{CommonName: mac}, nil }
+	return &deviceIdentity{CommonName: hostname, DNSNames: []string{hostname}}, nil
+}
+
+// matches reports whether csr asks for exactly this identity. EST servers
+// issue what the CSR asks for, so CSRs forwarded there are checked instead.
+func (id *deviceIdentity) matches(csr *x509.CertificateRequest) bool {
+	if csr.Subject.CommonName != id.CommonName || len(csr.IPAddresses) > 0 || len(csr.URIs) > 0 || len(csr.EmailAddresses) > 0 { return false }
+	for _, n := range csr.DNSNames {
+		if !containsString(id.DNSNames, n) { return false }
+	}
+	return true
+}
+
+// signCSR issues a client-auth certificate for csr's key from the local CA,
+// naming id; the CSR's own subject and SANs are ignored.
+func signCSR(csr *x509.CertificateRequest, id *deviceIdentity) (*x509.Certificate, error) {
+	ca, key, err := loadCA()
+	if err != nil { return nil, err }
+	serial, err := crand.Int(crand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil { return nil, err }
+	days, _ := strconv.Atoi(getenv("BOOTAH_CERT_DAYS", "365"))
+	if days <= 0 { days = 365 }
+	now := time.Now()
+	tpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: id.CommonName},
+		DNSNames:     id.DNSNames,
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.AddDate(0, 0, days),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tpl, ca, csr.PublicKey, key)
+	if err != nil { return nil, err }
+	return x509.ParseCertificate(der)
+}
+
+// estEnroll forwards csr to an EST server's simpleenroll operation (RFC 7030)
+// and returns the first certificate of the certs-only PKCS#7 response.
+func estEnroll(csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	base := strings.TrimRight(getenv("BOOTAH_EST_URL", ""), "/")
+	body := base64.StdEncoding.EncodeToString(csr.Raw)
+	req, err := http.NewRequest(http.MethodPost, base+"/simpleenroll", strings.NewReader(body))
+	if err != nil { return nil, err }
+	req.Header.Set("Content-Type", "application/pkcs10")
+	req.Header.Set("Content-Transfer-Encoding", "base64")
+	if u := getenv("BOOTAH_EST_USER", ""); u != "" { req.SetBasicAuth(u, getenv("BOOTAH_EST_PASSWORD", "")) }
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil { return nil, err }
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil { return nil, err }
+	if resp.StatusCode != 200 { return nil, fmt.Errorf("est: %s: %s", resp.Status, bytes.TrimSpace(raw)) }
+	der, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(raw), nil)))
+	if err != nil { return nil, err }
+	return firstCertFromPKCS7(der)
+}
+
+// firstCertFromPKCS7 extracts the first certificate from a degenerate
+// (certs-only) PKCS#7 SignedData structure.
+func firstCertFromPKCS7(der []byte) (*x509.Certificate, error) {
+	var ci struct {
+		Type    asn1.ObjectIdentifier
+		Content asn1.RawValue `asn1:"explicit,tag:0"`
+	}
+	if _, err := asn1.Unmarshal(der, &ci); err != nil { return nil, err }
+	var sd struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      asn1.RawValue
+		Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil { return nil, err }
+	if len(sd.Certificates.Bytes) == 0 { return nil, errors.New("pkcs7: no certificates") }
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil { return nil, err }
+	return certs[0], nil
+}
+
+func (s *Server) certRoutes() {
+	// Agent enrollment: {"mac": "...", "csr": "-----BEGIN CERTIFICATE REQUEST-----..."}
+	s.Mux.HandleFunc("/api/v1/agent/enroll", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		if !s.requireAgent(w, r) { return }
+		var body struct{ MAC, CSR string }
+		if !decodeJSON(w, r, &body) { return }
+		mac := normalizeMAC(body.MAC)
+		if mac == "" { http.Error(w, "mac required", 400); return }
+		if !s.agentTaskMAC(w, r, mac) { return }
+		id, err := s.deviceIdentity(mac)
+		if errors.Is(err, sql.ErrNoRows) { http.Error(w, "machine not registered", 404); return }
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if !s.hasEnrollmentSecret(mac) { http.Error(w, "machine has no enrollment secret", 403); return }
+		if !s.requireEnrollment(w, r, mac) || !s.requireAttestation(w, r, mac) { return }
+		block, _ := pem.Decode([]byte(body.CSR))
+		if block == nil || block.Type != "CERTIFICATE REQUEST" { http.Error(w, "csr must be a PEM certificate request", 400); return }
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil { http.Error(w, "csr: "+err.Error(), 400); return }
+		if err := csr.CheckSignature(); err != nil { http.Error(w, "csr signature: "+err.Error(), 400); return }
+		var cert *x509.Certificate
+		source := "local-ca"
+		if getenv("BOOTAH_EST_URL", "") != "" {
+			source = "est"
+			if !id.matches(csr) { http.Error(w, fmt.Sprintf("csr must name CN=%s and no other SANs than %v", id.CommonName, id.DNSNames), 400); return }
+			cert, err = estEnroll(csr)
+		} else {
+			cert, err = signCSR(csr, id)
+		}
+		if err != nil { http.Error(w, "enroll: "+err.Error(), 502); return }
+		certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+		depID, _ := s.deploymentForAgentToken(r.Header.Get("X-Bootah-Agent-Token"))
+		_, err = s.DB.Exec(`INSERT INTO device_certs (mac, deployment_id, serial, subject, issuer, not_before, not_after, source, pem, issued_at) VALUES (?,?,?,?,?,?,?,?,?,?)`,
+			mac, depID, cert.SerialNumber.Text(16), cert.Subject.String(), cert.Issuer.String(), cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339), source, certPEM, time.Now().Format(time.RFC3339))
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		s.audit(nil, "enroll", "certificate", map[string]any{"mac": mac, "serial": cert.SerialNumber.Text(16), "subject": cert.Subject.String(), "source": source})
+		writeJSON(w, 201, map[string]any{"serial": cert.SerialNumber.Text(16), "not_after": cert.NotAfter.Format(time.RFC3339), "certificate": certPEM})
+	})
+
+	// Certificates issued to machines, newest first (?mac= to filter)
+	s.Mux.HandleFunc("/api/v1/admin/certificates", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		q := `SELECT id, mac, COALESCE(deployment_id,''), serial, subject, issuer, not_before, not_after, source, issued_at FROM device_certs`
+		var args []any
+		if mac := normalizeMAC(r.URL.Query().Get("mac")); mac != "" { q += ` WHERE mac=?`; args = append(args, mac) }
+		rows, err := s.DB.Query(q+` ORDER BY id DESC LIMIT 500`, args...)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		defer rows.Close()
+		var out []map[string]any
+		for rows.Next() {
+			var id int64; var mac, dep, serial, subject, issuer, nb, na, source, issued string
+			if err := rows.Scan(&id, &mac, &dep, &serial, &subject, &issuer, &nb, &na, &source, &issued); err != nil { http.Error(w, err.Error(), 500); return }
+			out = append(out, map[string]any{"id": id, "mac": mac, "deployment_id": dep, "serial": serial, "subject": subject, "issuer": issuer,
+				"not_before": nb, "not_after": na, "source": source, "issued_at": issued})
+		}
+		writeJSON(w, 200, out)
+	})
+}
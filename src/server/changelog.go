@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ---- Image changelog ----
+// Uploading an image whose name matches an existing one (or that names it in
+// the "replaces" form field) is a new version of it and must carry a
+// "changelog" entry, optionally with a "ticket" link, kept with the version
+// (see imageversions.go). Images from before versioning were separate records
+// whose entries chain through previous_id; the history walks both.
+type ChangelogEntry struct {
+	ImageID    string `json:"image_id"`
+	Version    int    `json:"version,omitempty"`
+	PreviousID string `json:"previous_id,omitempty"`
+	Summary    string `json:"summary"`
+	Ticket     string `json:"ticket,omitempty"`
+	Author     string `json:"author,omitempty"`
+	Created    string `json:"created"`
+}
+
+func initChangelog(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS image_changelog (
+		image_id TEXT PRIMARY KEY,
+		previous_id TEXT NOT NULL,
+		summary TEXT NOT NULL,
+		ticket TEXT,
+		author TEXT,
+		created TEXT NOT NULL
+	)`)
+	return err
+}
+
+// previousImageVersion returns the image an upload supersedes: the explicit
+// replaces id if given, else the newest image with the same name, else "".
+func (s *Server) previousImageVersion(name, replaces string) (string, error) {
+	var id string
+	if replaces != "" {
+		err := s.DB.QueryRow(`SELECT id FROM images WHERE id=?`, replaces).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) { return "", fmt.Errorf("replaces: image %s not found", replaces) }
+		return id, err
+	}
+	err := s.DB.QueryRow(`SELECT id FROM images WHERE LOWER(name)=LOWER(?) ORDER BY updated DESC LIMIT 1`, name).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) { return "", nil }
+	return id, err
+}
+
+// checkChangelog validates the changelog fields of a version upload.
+func checkChangelog(previousID, summary, ticket string) error {
+	if previousID == "" { return nil }
+	if strings.TrimSpace(summary) == "" { return fmt.Errorf("changelog required when uploading a new version of image %s", previousID) }
+	if strings.ContainsAny(ticket, " \t\n") {
+		return fmt.Errorf("ticket must be a URL or an issue key")
+	}
+	return nil
+}
+
+// imageChangelog lists the versions of id and then walks the lineage back
+// from it, newest first.
+func (s *Server) imageChangelog(id string) ([]ChangelogEntry, error) {
+	out := []ChangelogEntry{}
+	rows, err := s.DB.Query(`SELECT version, changelog, COALESCE(ticket,''), COALESCE(author,''), created FROM image_versions
+		WHERE image_id=? AND changelog IS NOT NULL ORDER BY version DESC`, id)
+	if err != nil { return nil, err }
+	for rows.Next() {
+		e := ChangelogEntry{ImageID: id}
+		if err := rows.Scan(&e.Version, &e.Summary, &e.Ticket, &e.Author, &e.Created); err != nil { rows.Close(); return nil, err }
+		out = append(out, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil { return nil, err }
+	seen := map[string]bool{}
+	for id != "" && !seen[id] {
+		seen[id] = true
+		var e ChangelogEntry
+		var ticket, author sql.NullString
+		err := s.DB.QueryRow(`SELECT image_id, previous_id, summary, ticket, author, created FROM image_changelog WHERE image_id=?`, id).
+			Scan(&e.ImageID, &e.PreviousID, &e.Summary, &ticket, &author, &e.Created)
+		if errors.Is(err, sql.ErrNoRows) { break }
+		if err != nil { return nil, err }
+		e.Ticket, e.Author = ticket.String, author.String
+		out = append(out, e)
+		id = e.PreviousID
+	}
+	return out, nil
+}
+
+func (s *Server) handleImageChangelog(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+	list, err := s.imageChangelog(id)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	writeJSON(w, 200, list)
+}
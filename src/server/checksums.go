@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---- Checksums ----
+// Image checksums are computed while the image is stored and kept in
+// images.sha256; downloads carry X-Checksum-Sha256 once it is known. GET
+// /api/v1/images/{id}/checksum, for signed-in users and agents, serves the
+// stored value; an older image without one is hashed in the background, once
+// however many ask, and answered 202 until done. GET
+// /api/v1/images/{id}/verify re-hashes the stored object and reports drift
+// from the recorded value, raising an image_drift notification when they
+// differ. Files under /assets get "<file>.sha256" sidecars in sha256sum
+// format, cached by size and mtime.
+var imageHashes = struct {
+	sync.Mutex
+	running map[string]bool   // image ids being hashed
+	sums    map[string]string // by object key; replicas can't record them
+}{running: map[string]bool{}, sums: map[string]string{}}
+
+// imageChecksum returns an image's recorded checksum, or "" after making
+// sure a background hash of its stored object is under way.
+func (s *Server) imageChecksum(id string) (string, error) {
+	var key, sum string
+	if err := s.DB.QueryRow(`SELECT file, COALESCE(sha256,'') FROM images WHERE id=?`, id).Scan(&key, &sum); err != nil { return "", err }
+	if sum != "" { return sum, nil }
+	imageHashes.Lock()
+	defer imageHashes.Unlock()
+	if sum := imageHashes.sums[key]; sum != "" { return sum, nil }
+	if !imageHashes.running[id] {
+		imageHashes.running[id] = true
+		go s.hashImage(id, key)
+	}
+	return "", nil
+}
+
+func (s *Server) hashImage(id, key string) {
+	defer func() {
+		imageHashes.Lock()
+		delete(imageHashes.running, id)
+		imageHashes.Unlock()
+	}()
+	rc, err := s.Store.Open(context.Background(), key)
+	if err != nil { log.Printf("checksum %s: %v", id, err); return }
+	defer rc.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil { log.Printf("checksum %s: %v", id, err); return }
+	sum := hex.EncodeToString(h.Sum(nil))
+	if replicaMode() {
+		imageHashes.Lock()
+		imageHashes.sums[key] = sum
+		imageHashes.Unlock()
+		return
+	}
+	if _, err := s.DB.Exec(`UPDATE images SET sha256=? WHERE id=? AND file=?`, sum, id, key); err != nil { log.Printf("checksum %s: %v", id, err) }
+	if _, err := s.DB.Exec(`UPDATE image_versions SET sha256=? WHERE file=? AND sha256 IS NULL`, sum, key); err != nil { log.Printf("checksum %s: %v", id, err) }
+}
+
+func (s *Server) handleImageChecksum(w http.ResponseWriter, r *http.Request, id string) {
+	if _, _, err := s.verifyAuth(r); err != nil && !s.requireAgent(w, r) { return }
+	sum, err := s.imageChecksum(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+		http.Error(w, err.Error(), 500); return
+	}
+	if sum == "" {
+		w.Header().Set("Retry-After", "30")
+		writeJSON(w, 202, map[string]any{"id": id, "algorithm": "sha256", "status": "hashing"})
+		return
+	}
+	if r.URL.Query().Get("format") == "text" {
+		var key string
+		_ = s.DB.QueryRow(`SELECT file FROM images WHERE id=?`, id).Scan(&key)
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "%s  %s\n", sum, key)
+		return
+	}
+	writeJSON(w, 200, map[string]any{"id": id, "algorithm": "sha256", "sha256": sum})
+}
+
+// verifyImage re-hashes an image's stored object against its recorded sum.
+func (s *Server) verifyImage(ctx context.Context, id string) (map[string]any, error) {
+	var key, recorded string
+	if err := s.DB.QueryRow(`SELECT file, COALESCE(sha256,'') FROM images WHERE id=?`, id).Scan(&key, &recorded); err != nil { return nil, err }
+	start := time.Now()
+	out := map[string]any{"id": id, "algorithm": "sha256", "sha256": recorded, "verified_at": start.UTC().Format(time.RFC3339)}
+	status, actual := "ok", ""
+	var size int64
+	rc, err := s.Store.Open(ctx, key)
+	if err != nil {
+		if ctx.Err() != nil { return nil, ctx.Err() }
+		status, out["error"] = "missing", err.Error()
+	} else {
+		h := sha256.New()
+		size, err = io.Copy(h, rc)
+		rc.Close()
+		if err != nil { return nil, err }
+		actual = hex.EncodeToString(h.Sum(nil))
+		if recorded != "" && !strings.EqualFold(recorded, actual) { status = "drift" }
+	}
+	out["actual"], out["size"], out["status"], out["match"] = actual, size, status, status == "ok"
+	out["duration_ms"] = time.Since(start).Milliseconds()
+	if !replicaMode() {
+		_, err = s.DB.Exec(`UPDATE images SET sha256=COALESCE(sha256, NULLIF(?,'')), verified_at=?, verify_status=? WHERE id=?`, actual, out["verified_at"], status, id)
+		if err != nil { return nil, err }
+	}
+	if status != "ok" {
+		s.notify("error", "image_drift", "Image "+id+" failed verification ("+status+")", map[string]any{"image_id": id, "expected": recorded, "actual": actual})
+	}
+	return out, nil
+}
+
+func (s *Server) handleVerifyImage(w http.ResponseWriter, r *http.Request, id string) {
+	out, err := s.verifyImage(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+		http.Error(w, err.Error(), 500); return
+	}
+	writeJSON(w, 200, out)
+}
+
+type assetSum struct {
+	size  int64
+	mtime time.Time
+	sum   string
+}
+
+var assetSums = struct {
+	sync.Mutex
+	m map[string]assetSum
+}{m: map[string]assetSum{}}
+
+// assetChecksum hashes a file under the web root, reusing the cached value
+// while its size and mtime are unchanged.
+func assetChecksum(p string) (string, error) {
+	fi, err := os.Stat(p)
+	if err != nil { return "", err }
+	if fi.IsDir() { return "", os.ErrNotExist }
+	assetSums.Lock()
+	c, ok := assetSums.m[p]
+	assetSums.Unlock()
+	if ok && c.size == fi.Size() && c.mtime.Equal(fi.ModTime()) { return c.sum, nil }
+	f, err := os.Open(p)
+	if err != nil { return "", err }
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil { return "", err }
+	sum := hex.EncodeToString(h.Sum(nil))
+	assetSums.Lock()
+	assetSums.m[p] = assetSum{size: fi.Size(), mtime: fi.ModTime(), sum: sum}
+	assetSums.Unlock()
+	return sum, nil
+}
+
+// handleAssets serves registered boot assets from Storage, then the asset
+// tree in the web root, and answers "<asset>.sha256" with a generated sidecar
+// unless one exists on disk.
+func (s *Server) handleAssets(w http.ResponseWriter, r *http.Request) {
+	if rejectBadCDNSignature(w, r) { return }
+	if !strings.HasSuffix(r.URL.Path, ".sha256") && !s.checkDownloadToken(w, r) { return }
+	rel := path.Clean("/" + r.URL.Path)
+	longTransfer(w)
+	if s.serveBootAsset(w, r, strings.TrimPrefix(rel, "/assets/")) { return }
+	p := filepath.Join(s.WebRoot, filepath.FromSlash(rel))
+	if strings.HasSuffix(rel, ".sha256") {
+		if _, err := os.Stat(p); err != nil {
+			target := strings.TrimSuffix(p, ".sha256")
+			sum, err := assetChecksum(target)
+			if err != nil {
+				if os.IsNotExist(err) { http.NotFound(w, r); return }
+				http.Error(w, err.Error(), 500); return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprintf(w, "%s  %s\n", sum, filepath.Base(target))
+			return
+		}
+	}
+	http.FileServer(http.Dir(s.WebRoot)).ServeHTTP(w, r)
+}
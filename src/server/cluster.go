@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ---- Clustering ----
+// Several instances may share one database and object store. Each node
+// heartbeats into cluster_nodes and runs queue workers; singleton schedulers
+// run only on the node holding the matching row in cluster_leases. The
+// scheduler requeues queued-kind jobs from nodes that stopped heartbeating
+// (up to BOOTAH_JOB_MAX_ATTEMPTS attempts) and fails in-process jobs that
+// died with their node.
+var nodeID = getenv("BOOTAH_NODE_ID", defaultNodeID())
+
+// dbDriver names the database in use (BOOTAH_DB_DRIVER, set by openStore);
+// some queries add dialect-specific clauses based on it.
+var dbDriver = "sqlite"
+
+// instanceID names the install: generated once into cluster_instance, so
+// every node, replica and promoted standby on the database shares it and no
+// other install has it.
+var instanceID string
+
+const (
+	nodeHeartbeat = 10 * time.Second
+	nodeDeadAfter = 45 * time.Second
+	leaseTTL      = 30 * time.Second
+)
+
+func defaultNodeID() string {
+	h, _ := os.Hostname()
+	if h == "" { h = "node" }
+	return h + "-" + strconv.Itoa(os.Getpid())
+}
+
+func initCluster(db *sql.DB) error {
+	ddl := []string{
+		`CREATE TABLE IF NOT EXISTS cluster_nodes (
+			id TEXT PRIMARY KEY,
+			started_at TEXT NOT NULL,
+			last_seen INTEGER NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS cluster_leases (
+			name TEXT PRIMARY KEY,
+			holder TEXT NOT NULL,
+			expires_at INTEGER NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS cluster_instance (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			instance_id TEXT NOT NULL,
+			created_at TEXT NOT NULL
+		)`,
+	}
+	for _, q := range ddl {
+		if _, err := db.Exec(q); err != nil { return err }
+	}
+	if !replicaMode() {
+		if _, err := db.Exec(`INSERT OR IGNORE INTO cluster_instance (id, instance_id, created_at) VALUES (1,?,?)`, randToken(16), time.Now().UTC().Format(time.RFC3339)); err != nil { return err }
+	}
+	err := db.QueryRow(`SELECT instance_id FROM cluster_instance WHERE id=1`).Scan(&instanceID)
+	if errors.Is(err, sql.ErrNoRows) { return errors.New("the database has no instance ID yet; start the primary on this release first") }
+	return err
+}
+
+func (s *Server) heartbeat() error {
+	_, err := s.DB.Exec(`INSERT INTO cluster_nodes (id, started_at, last_seen) VALUES (?,?,?)
+		ON CONFLICT(id) DO UPDATE SET last_seen=excluded.last_seen`, nodeID, time.Now().UTC().Format(time.RFC3339), time.Now().Unix())
+	return err
+}
+
+// acquireLease takes or renews the named lease for this node, reporting
+// whether this node now holds it.
+func (s *Server) acquireLease(name string) bool {
+	now := time.Now()
+	res, err := s.DB.Exec(`INSERT INTO cluster_leases (name, holder, expires_at) VALUES (?,?,?)
+		ON CONFLICT(name) DO UPDATE SET holder=excluded.holder, expires_at=excluded.expires_at
+		WHERE cluster_leases.holder=excluded.holder OR cluster_leases.expires_at < ?`,
+		name, nodeID, now.Add(leaseTTL).Unix(), now.Unix())
+	if err != nil { log.Printf("lease %s: %v", name, err); return false }
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+// reapJobs recovers jobs owned by nodes that stopped heartbeating.
+func (s *Server) reapJobs() {
+	cutoff := time.Now().Add(-nodeDeadAfter).Unix()
+	dead := `node NOT IN (SELECT id FROM cluster_nodes WHERE last_seen >= ?)`
+	_, _ = s.DB.Exec(`UPDATE jobs SET status='cancelled', result='cancelled' WHERE status='running' AND cancel_requested<>0 AND `+dead, cutoff)
+	res, err := s.DB.Exec(`UPDATE jobs SET status='queued', node=NULL WHERE status='running' AND payload IS NOT NULL AND attempts < ? AND `+dead, jobMaxAttempts(), cutoff)
+	if err != nil { log.Printf("reap jobs: %v", err); return }
+	requeued, _ := res.RowsAffected()
+	res, err = s.DB.Exec(`UPDATE jobs SET status='failed', result=? WHERE status='running' AND node IS NOT NULL AND `+dead, "node lost while running job", cutoff)
+	if err != nil { log.Printf("reap jobs: %v", err); return }
+	failed, _ := res.RowsAffected()
+	if requeued+failed > 0 { log.Printf("scheduler: requeued %d and failed %d job(s) from dead nodes", requeued, failed) }
+	_, _ = s.DB.Exec(`DELETE FROM cluster_nodes WHERE last_seen < ?`, time.Now().Add(-24*time.Hour).Unix())
+}
+
+// releaseLease gives up the named lease if this node holds it.
+func (s *Server) releaseLease(name string) {
+	_, _ = s.DB.Exec(`DELETE FROM cluster_leases WHERE name=? AND holder=?`, name, nodeID)
+}
+
+// runAsLeader calls fn every interval while this node holds the named lease.
+// The lease is renewed every leaseTTL/2 on its own, so neither an interval
+// longer than leaseTTL nor a slow fn lets it lapse to another node, and it is
+// released when ctx ends.
+func (s *Server) runAsLeader(ctx context.Context, name string, interval time.Duration, fn func()) {
+	var held atomic.Bool
+	held.Store(s.acquireLease(name))
+	go func() {
+		t := time.NewTicker(leaseTTL / 2)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				if held.Load() { s.releaseLease(name) }
+				return
+			case <-t.C:
+				held.Store(s.acquireLease(name))
+			}
+		}
+	}()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if held.Load() { fn() }
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// startCluster starts the heartbeat, queue workers and schedulers.
+func (s *Server) startCluster(ctx context.Context) {
+	if err := s.heartbeat(); err != nil { log.Printf("heartbeat: %v", err) }
+	go func() {
+		t := time.NewTicker(nodeHeartbeat)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if err := s.heartbeat(); err != nil { log.Printf("heartbeat: %v", err) }
+			}
+		}
+	}()
+	workers, err := strconv.Atoi(getenv("BOOTAH_JOB_WORKERS", "2"))
+	if err != nil || workers < 0 { workers = 2 }
+	for i := 0; i < workers; i++ { go s.jobWorker(ctx) }
+	go s.runAsLeader(ctx, "scheduler", leaseTTL/2, s.reapJobs)
+	log.Printf("cluster node %s started with %d job worker(s)", nodeID, workers)
+}
+
+func (s *Server) clusterRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/cluster", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		rows, err := s.DB.Query(`SELECT id, started_at, last_seen FROM cluster_nodes ORDER BY id`)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		defer rows.Close()
+		nodes := []map[string]any{}
+		for rows.Next() {
+			var id, started string
+			var seen int64
+			if err := rows.Scan(&id, &started, &seen); err != nil { http.Error(w, err.Error(), 500); return }
+			nodes = append(nodes, map[string]any{"id": id, "started_at": started, "last_seen": time.Unix(seen, 0).UTC().Format(time.RFC3339),
+				"alive": time.Since(time.Unix(seen, 0)) < nodeDeadAfter})
+		}
+		leases := map[string]any{}
+		lrows, err := s.DB.Query(`SELECT name, holder, expires_at FROM cluster_leases`)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		defer lrows.Close()
+		for lrows.Next() {
+			var name, holder string
+			var exp int64
+			if err := lrows.Scan(&name, &holder, &exp); err != nil { http.Error(w, err.Error(), 500); return }
+			leases[name] = map[string]any{"holder": holder, "expires_at": time.Unix(exp, 0).UTC().Format(time.RFC3339)}
+		}
+		var queued int
+		_ = s.DB.QueryRow(`SELECT COUNT(*) FROM jobs WHERE status='queued'`).Scan(&queued)
+		writeJSON(w, 200, map[string]any{"node": nodeID, "nodes": nodes, "leases": leases, "queued_jobs": queued})
+	})
+}
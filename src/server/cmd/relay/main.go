@@ -0,0 +1,319 @@
+// Command relay is the Bootah edge relay. It registers with a Bootah server,
+// mirrors the boot assets and TFTP files into a local cache, serves them on
+// the remote subnet over HTTP and TFTP (checking each client's download token
+// with the server first), and proxies boot-script and agent
+// requests to the server with the original client address attached. It also
+// sends the Wake-on-LAN packets the server queues for its subnet.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const version = "1"
+
+type relay struct {
+	upstream *url.URL
+	cache    string
+	key      string
+	client   *http.Client
+
+	mu       sync.Mutex
+	lastSync time.Time
+	syncErr  string
+	files    int
+	bytes    int64
+	allowed  map[string]time.Time // dt|client address → when the server's yes expires
+}
+
+type manifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func getenv(k, def string) string { if v := strings.TrimSpace(os.Getenv(k)); v != "" { return v }; return def }
+
+func main() {
+	server := getenv("BOOTAH_RELAY_SERVER", "")
+	if server == "" { log.Fatal("BOOTAH_RELAY_SERVER is required") }
+	u, err := url.Parse(strings.TrimRight(server, "/"))
+	if err != nil { log.Fatalf("server url: %v", err) }
+	rl := &relay{upstream: u, cache: getenv("BOOTAH_RELAY_CACHE", "./relay-cache"), client: &http.Client{Timeout: 30 * time.Minute}}
+	if err := os.MkdirAll(rl.cache, 0o755); err != nil { log.Fatal(err) }
+	if err := rl.register(getenv("BOOTAH_RELAY_TOKEN", "")); err != nil { log.Fatalf("register: %v", err) }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rl.syncLoop(ctx, 5*time.Minute)
+	if every, err := time.ParseDuration(getenv("BOOTAH_RELAY_WAKE_POLL", "10s")); err == nil && every > 0 {
+		go rl.wakeLoop(ctx, every, getenv("BOOTAH_RELAY_WOL_BROADCAST", "255.255.255.255:9"))
+	}
+
+	if addr := getenv("BOOTAH_RELAY_TFTP", ":69"); addr != "off" {
+		go func() {
+			if err := serveTFTP(ctx, addr, filepath.Join(rl.cache, "tftp")); err != nil { log.Printf("tftp: %v", err) }
+		}()
+	}
+
+	srv := &http.Server{Addr: getenv("BOOTAH_RELAY_HTTP", ":8080"), Handler: rl.handler()}
+	go func() {
+		log.Printf("Bootah relay listening on %s (upstream %s)", srv.Addr, rl.upstream)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed { log.Fatalf("http: %v", err) }
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	cancel()
+	sctx, scancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer scancel()
+	_ = srv.Shutdown(sctx)
+}
+
+// register loads the relay key saved by an earlier run, or exchanges the
+// registration token for one.
+func (rl *relay) register(token string) error {
+	keyFile := filepath.Join(rl.cache, "relay.key")
+	if b, err := os.ReadFile(keyFile); err == nil && len(bytes.TrimSpace(b)) > 0 {
+		rl.key = string(bytes.TrimSpace(b))
+		return nil
+	}
+	if token == "" { return fmt.Errorf("no saved key and BOOTAH_RELAY_TOKEN not set") }
+	js, _ := json.Marshal(map[string]string{"token": token, "version": version})
+	resp, err := rl.client.Post(rl.upstream.String()+"/api/v1/relay/register", "application/json", bytes.NewReader(js))
+	if err != nil { return err }
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 { b, _ := io.ReadAll(resp.Body); return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b))) }
+	var out struct{ ID, Key string }
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil { return err }
+	rl.key = out.Key
+	log.Printf("registered as relay %s", out.ID)
+	return os.WriteFile(keyFile, []byte(out.Key+"\n"), 0o600)
+}
+
+func (rl *relay) get(ctx context.Context, p string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rl.upstream.String()+p, nil)
+	if err != nil { return nil, err }
+	req.Header.Set("X-Bootah-Relay-Key", rl.key)
+	req.Header.Set("X-Bootah-Relay-Sync", "1")
+	resp, err := rl.client.Do(req)
+	if err != nil { return nil, err }
+	if resp.StatusCode != 200 { resp.Body.Close(); return nil, fmt.Errorf("GET %s: %s", p, resp.Status) }
+	return resp, nil
+}
+
+func (rl *relay) syncLoop(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		err := rl.sync(ctx)
+		rl.mu.Lock()
+		rl.syncErr = ""
+		if err != nil { rl.syncErr = err.Error(); log.Printf("sync: %v", err) } else { rl.lastSync = time.Now() }
+		rl.mu.Unlock()
+		rl.heartbeat(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// sync downloads every manifest file whose cached copy is missing or stale.
+func (rl *relay) sync(ctx context.Context) error {
+	resp, err := rl.get(ctx, "/api/v1/relay/manifest")
+	if err != nil { return err }
+	var m map[string][]manifestFile
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	resp.Body.Close()
+	if err != nil { return err }
+	var files int
+	var total int64
+	for section, list := range m {
+		for _, f := range list {
+			dst := filepath.Join(rl.cache, section, filepath.FromSlash(path.Clean("/"+strings.TrimPrefix(f.Path, "/assets"))))
+			src := f.Path
+			if section == "tftp" { src = "/api/v1/relay/tftp" + path.Clean("/"+f.Path) }
+			if fileSHA256(dst) != f.SHA256 {
+				if err := rl.fetch(ctx, src, dst, f.SHA256); err != nil { return err }
+			}
+			files++
+			total += f.Size
+		}
+	}
+	rl.mu.Lock()
+	rl.files, rl.bytes = files, total
+	rl.mu.Unlock()
+	return nil
+}
+
+func (rl *relay) fetch(ctx context.Context, src, dst, want string) error {
+	resp, err := rl.get(ctx, src)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil { return err }
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".fetch-*")
+	if err != nil { return err }
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), resp.Body); err != nil { tmp.Close(); return err }
+	if err := tmp.Close(); err != nil { return err }
+	if got := hex.EncodeToString(h.Sum(nil)); got != want { return fmt.Errorf("%s: checksum mismatch", src) }
+	log.Printf("cached %s", src)
+	return os.Rename(tmp.Name(), dst)
+}
+
+func fileSHA256(p string) string {
+	f, err := os.Open(p)
+	if err != nil { return "" }
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil { return "" }
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (rl *relay) heartbeat(ctx context.Context) {
+	rl.mu.Lock()
+	stats := map[string]any{"cached_files": rl.files, "cached_bytes": rl.bytes, "sync_error": rl.syncErr}
+	if !rl.lastSync.IsZero() { stats["last_sync"] = rl.lastSync.UTC().Format(time.RFC3339) }
+	rl.mu.Unlock()
+	js, _ := json.Marshal(map[string]any{"version": version, "stats": stats})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rl.upstream.String()+"/api/v1/relay/heartbeat", bytes.NewReader(js))
+	if err != nil { return }
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Bootah-Relay-Key", rl.key)
+	resp, err := rl.client.Do(req)
+	if err != nil { log.Printf("heartbeat: %v", err); return }
+	resp.Body.Close()
+}
+
+// wakeLoop collects queued Wake-on-LAN requests and broadcasts them on the
+// local segment.
+func (rl *relay) wakeLoop(ctx context.Context, every time.Duration, bcast string) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		resp, err := rl.get(ctx, "/api/v1/relay/wake")
+		if err != nil { log.Printf("wake poll: %v", err); continue }
+		var out struct{ Wake []string `json:"wake"` }
+		err = json.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+		if err != nil { log.Printf("wake poll: %v", err); continue }
+		for _, mac := range out.Wake {
+			if err := sendWake(mac, bcast); err != nil { log.Printf("wake %s: %v", mac, err) } else { log.Printf("woke %s via %s", mac, bcast) }
+		}
+	}
+}
+
+// sendWake broadcasts a Wake-on-LAN magic packet for mac to addr.
+func sendWake(mac, addr string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil { return err }
+	pkt := append(make([]byte, 0, 102), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	for i := 0; i < 16; i++ { pkt = append(pkt, hw...) }
+	conn, err := net.Dial("udp", addr)
+	if err != nil { return err }
+	defer conn.Close()
+	_, err = conn.Write(pkt)
+	return err
+}
+
+// authorize asks the server whether the client may download the cached
+// asset p, remembering a yes for a minute per token and client address.
+func (rl *relay) authorize(r *http.Request, p string) (int, error) {
+	dt := r.URL.Query().Get("dt")
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	auth := r.Header.Get("Authorization")
+	key := dt + "|" + host
+	rl.mu.Lock()
+	exp, ok := rl.allowed[key]
+	rl.mu.Unlock()
+	if ok && auth == "" && time.Now().Before(exp) { return 200, nil }
+	q := url.Values{"path": {p}}
+	if dt != "" { q.Set("dt", dt) }
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, rl.upstream.String()+"/api/v1/relay/authorize?"+q.Encode(), nil)
+	if err != nil { return 500, err }
+	req.Header.Set("X-Bootah-Relay-Key", rl.key)
+	req.Header.Set("X-Forwarded-For", host)
+	if auth != "" { req.Header.Set("Authorization", auth) }
+	resp, err := rl.client.Do(req)
+	if err != nil { return 502, err }
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("%s", strings.TrimSpace(string(b)))
+	}
+	if auth == "" {
+		rl.mu.Lock()
+		if rl.allowed == nil { rl.allowed = map[string]time.Time{} }
+		for k, t := range rl.allowed {
+			if time.Now().After(t) { delete(rl.allowed, k) }
+		}
+		rl.allowed[key] = time.Now().Add(time.Minute)
+		rl.mu.Unlock()
+	}
+	return 200, nil
+}
+
+// handler serves cached assets and forwards boot-script, image and agent
+// requests upstream, tagging them with the relay key and client address.
+func (rl *relay) handler() http.Handler {
+	proxy := httputil.NewSingleHostReverseProxy(rl.upstream)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Host = rl.upstream.Host
+		r.Header.Set("X-Bootah-Relay-Key", rl.key)
+		r.Header.Del("X-Bootah-Relay-Sync")
+	}
+	assets := http.FileServer(http.Dir(filepath.Join(rl.cache, "assets")))
+	mux := http.NewServeMux()
+	mux.Handle("/assets/", http.StripPrefix("/assets", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := os.Stat(filepath.Join(rl.cache, "assets", filepath.FromSlash(path.Clean("/"+r.URL.Path)))); err != nil {
+			r.URL.Path = "/assets" + r.URL.Path
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		if status, err := rl.authorize(r, "/assets"+r.URL.Path); err != nil { http.Error(w, err.Error(), status); return }
+		assets.ServeHTTP(w, r)
+	})))
+	for _, p := range []string{"/ipxe/", "/api/v1/agent/", "/api/v1/images/"} { mux.Handle(p, proxy) }
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": rl.syncErr == "", "cached_files": rl.files, "last_sync": rl.lastSync})
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil { r.Header.Set("X-Forwarded-For", host) }
+		mux.ServeHTTP(w, r)
+		log.Printf("%s %s %s", r.Method, r.URL.Path, time.Since(start))
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Minimal read-only TFTP server (RFC 1350) with the blksize and tsize options
+// (RFC 2348/2349), enough for PXE ROMs to fetch iPXE.
+const (
+	opRRQ   = 1
+	opDATA  = 3
+	opACK   = 4
+	opERROR = 5
+	opOACK  = 6
+)
+
+func serveTFTP(ctx context.Context, addr, root string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil { return err }
+	go func() { <-ctx.Done(); conn.Close() }()
+	log.Printf("tftp serving %s on %s", root, addr)
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil { return nil }
+			return err
+		}
+		if n < 4 || binary.BigEndian.Uint16(buf) != opRRQ { continue }
+		req := append([]byte(nil), buf[2:n]...)
+		go tftpTransfer(peer, root, req)
+	}
+}
+
+func tftpError(c net.PacketConn, peer net.Addr, code uint16, msg string) {
+	b := make([]byte, 4, 5+len(msg))
+	binary.BigEndian.PutUint16(b, opERROR)
+	binary.BigEndian.PutUint16(b[2:], code)
+	b = append(append(b, msg...), 0)
+	_, _ = c.WriteTo(b, peer)
+}
+
+// tftpTransfer answers one read request from its own ephemeral port.
+func tftpTransfer(peer net.Addr, root string, req []byte) {
+	fields := strings.Split(string(bytes.TrimRight(req, "\x00")), "\x00")
+	c, err := net.ListenPacket("udp", ":0")
+	if err != nil { return }
+	defer c.Close()
+	if len(fields) < 2 { tftpError(c, peer, 4, "malformed request"); return }
+	name := path.Clean("/" + strings.ReplaceAll(fields[0], "\\", "/"))
+	data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil { tftpError(c, peer, 1, "file not found"); return }
+
+	blksize := 512
+	var oack []byte
+	for i := 2; i+1 < len(fields); i += 2 {
+		switch strings.ToLower(fields[i]) {
+		case "blksize":
+			if v, err := strconv.Atoi(fields[i+1]); err == nil && v >= 8 {
+				if v > 1428 { v = 1428 }
+				blksize = v
+				oack = append(oack, "blksize\x00"+strconv.Itoa(v)+"\x00"...)
+			}
+		case "tsize":
+			oack = append(oack, "tsize\x00"+strconv.Itoa(len(data))+"\x00"...)
+		}
+	}
+	if len(oack) > 0 {
+		pkt := append([]byte{0, opOACK}, oack...)
+		if err := tftpSend(c, peer, pkt, 0); err != nil { return }
+	}
+	for block := 1; ; block++ {
+		start := (block - 1) * blksize
+		end := start + blksize
+		if end > len(data) { end = len(data) }
+		pkt := make([]byte, 4, 4+end-start)
+		binary.BigEndian.PutUint16(pkt, opDATA)
+		binary.BigEndian.PutUint16(pkt[2:], uint16(block))
+		pkt = append(pkt, data[start:end]...)
+		if err := tftpSend(c, peer, pkt, uint16(block)); err != nil {
+			log.Printf("tftp %s to %s: %v", name, peer, err)
+			return
+		}
+		if end-start < blksize { break }
+	}
+	log.Printf("tftp sent %s to %s (%d bytes)", name, peer, len(data))
+}
+
+// tftpSend writes pkt and waits for the ACK of block, retransmitting on timeout.
+func tftpSend(c net.PacketConn, peer net.Addr, pkt []byte, block uint16) error {
+	ack := make([]byte, 516)
+	for try := 0; try < 5; try++ {
+		if _, err := c.WriteTo(pkt, peer); err != nil { return err }
+		_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			n, from, err := c.ReadFrom(ack)
+			if err != nil { break }
+			if from.String() != peer.String() || n < 4 { continue }
+			op := binary.BigEndian.Uint16(ack)
+			if op == opERROR { return errors.New("client aborted transfer") }
+			if op == opACK && binary.BigEndian.Uint16(ack[2:]) == block { return nil }
+		}
+	}
+	return errors.New("timed out")
+}
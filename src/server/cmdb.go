@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ---- CMDB / ITSM connector ----
+// BOOTAH_CMDB selects netbox or servicenow (BOOTAH_CMDB_URL, BOOTAH_CMDB_TOKEN
+// or BOOTAH_CMDB_USER/BOOTAH_CMDB_PASSWORD). The connector is a compiled-in
+// plugin: machine.enrolled pushes the machine record and deployment.finished
+// its result. Owner and location are pulled back into machine_fields every
+// BOOTAH_CMDB_SYNC_INTERVAL (leader only) or when the CMDB calls
+// /api/v1/cmdb/webhook with BOOTAH_CMDB_WEBHOOK_SECRET.
+type cmdbMachine struct {
+	MAC, Serial, Vendor, Model, AssetTag, Hostname string
+}
+
+type cmdbConnector interface {
+	// push creates or updates the machine record and returns its remote id
+	push(ctx context.Context, m cmdbMachine) (string, error)
+	// result records a finished deployment against the remote record
+	result(ctx context.Context, remoteID, deploymentID, status, detail string) error
+	// pull returns asset metadata to map into machine fields
+	pull(ctx context.Context, remoteID string) (map[string]string, error)
+}
+
+func initCMDB(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS machine_fields (
+		mac TEXT NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		source TEXT NOT NULL,
+		updated TEXT NOT NULL,
+		PRIMARY KEY (mac, name)
+	)`)
+	return err
+}
+
+func cmdbKind() string { return strings.ToLower(getenv("BOOTAH_CMDB", "")) }
+
+func newCMDBConnector() (cmdbConnector, error) {
+	base := strings.TrimRight(getenv("BOOTAH_CMDB_URL", ""), "/")
+	if base == "" { return nil, fmt.Errorf("BOOTAH_CMDB_URL is required") }
+	c := cmdbClient{base: base, token: getenv("BOOTAH_CMDB_TOKEN", ""), user: getenv("BOOTAH_CMDB_USER", ""), password: getenv("BOOTAH_CMDB_PASSWORD", "")}
+	switch cmdbKind() {
+	case "netbox":
+		return netboxConnector{c}, nil
+	case "servicenow":
+		return serviceNowConnector{c}, nil
+	}
+	return nil, fmt.Errorf("unknown BOOTAH_CMDB %q (netbox|servicenow)", cmdbKind())
+}
+
+type cmdbClient struct{ base, token, user, password string }
+
+// do sends a JSON request and decodes a JSON reply into out (may be nil).
+func (c cmdbClient) do(ctx context.Context, method, path string, body, out any) error {
+	var rd io.Reader
+	if body != nil {
+		js, _ := json.Marshal(body)
+		rd = bytes.NewReader(js)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, rd)
+	if err != nil { return err }
+	req.Header.Set("Accept", "application/json")
+	if body != nil { req.Header.Set("Content-Type", "application/json") }
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	} else if c.token != "" {
+		if cmdbKind() == "netbox" { req.Header.Set("Authorization", "Token "+c.token) } else { req.Header.Set("Authorization", "Bearer "+c.token) }
+	}
+	resp, err := (&http.Client{Timeout: 20 * time.Second}).Do(req)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil { return nil }
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// NetBox: devices are matched by serial. Creating one needs the ids NetBox
+// requires (BOOTAH_NETBOX_DEVICE_TYPE, _ROLE, _SITE); without them only
+// existing devices are updated. Bootah data goes into custom fields
+// bootah_mac, bootah_last_deployment and bootah_last_status.
+type netboxConnector struct{ cmdbClient }
+
+func (n netboxConnector) push(ctx context.Context, m cmdbMachine) (string, error) {
+	var found struct {
+		Results []struct{ ID int64 `json:"id"` } `json:"results"`
+	}
+	if m.Serial == "" { return "", fmt.Errorf("netbox: machine %s has no serial", m.MAC) }
+	if err := n.do(ctx, http.MethodGet, "/api/dcim/devices/?serial="+url.QueryEscape(m.Serial), nil, &found); err != nil { return "", err }
+	fields := map[string]any{"custom_fields": map[string]any{"bootah_mac": m.MAC}}
+	if m.AssetTag != "" { fields["asset_tag"] = m.AssetTag }
+	if len(found.Results) > 0 {
+		id := fmt.Sprint(found.Results[0].ID)
+		return id, n.do(ctx, http.MethodPatch, "/api/dcim/devices/"+id+"/", fields, nil)
+	}
+	typ, role, site := getenv("BOOTAH_NETBOX_DEVICE_TYPE", ""), getenv("BOOTAH_NETBOX_DEVICE_ROLE", ""), getenv("BOOTAH_NETBOX_SITE", "")
+	if typ == "" || role == "" || site == "" { return "", fmt.Errorf("netbox: no device with serial %s and creation is not configured", m.Serial) }
+	name := m.Hostname
+	if name == "" { name = "bootah-" + strings.ReplaceAll(m.MAC, ":", "") }
+	fields["name"], fields["serial"], fields["device_type"], fields["role"], fields["site"] = name, m.Serial, typ, role, site
+	var created struct{ ID int64 `json:"id"` }
+	if err := n.do(ctx, http.MethodPost, "/api/dcim/devices/", fields, &created); err != nil { return "", err }
+	return fmt.Sprint(created.ID), nil
+}
+
+func (n netboxConnector) result(ctx context.Context, remoteID, deploymentID, status, detail string) error {
+	return n.do(ctx, http.MethodPatch, "/api/dcim/devices/"+remoteID+"/", map[string]any{"custom_fields": map[string]any{
+		"bootah_last_deployment": deploymentID, "bootah_last_status": status}}, nil)
+}
+
+func (n netboxConnector) pull(ctx context.Context, remoteID string) (map[string]string, error) {
+	type named struct{ Name string `json:"name"` }
+	var dev struct {
+		Tenant   *named `json:"tenant"`
+		Site     *named `json:"site"`
+		Location *named `json:"location"`
+		Rack     *named `json:"rack"`
+	}
+	if err := n.do(ctx, http.MethodGet, "/api/dcim/devices/"+remoteID+"/", nil, &dev); err != nil { return nil, err }
+	out := map[string]string{}
+	if dev.Tenant != nil { out["owner"] = dev.Tenant.Name }
+	loc := []string{}
+	for _, p := range []*named{dev.Site, dev.Location, dev.Rack} {
+		if p != nil && p.Name != "" { loc = append(loc, p.Name) }
+	}
+	if len(loc) > 0 { out["location"] = strings.Join(loc, " / ") }
+	return out, nil
+}
+
+// ServiceNow: records live in cmdb_ci_computer (BOOTAH_SNOW_TABLE) matched
+// by serial_number; deployment results are added to the work notes.
+type serviceNowConnector struct{ cmdbClient }
+
+func snowTable() string { return "/api/now/table/" + getenv("BOOTAH_SNOW_TABLE", "cmdb_ci_computer") }
+
+func (n serviceNowConnector) push(ctx context.Context, m cmdbMachine) (string, error) {
+	var found struct {
+		Result []struct{ SysID string `json:"sys_id"` } `json:"result"`
+	}
+	if m.Serial == "" { return "", fmt.Errorf("servicenow: machine %s has no serial", m.MAC) }
+	q := url.Values{"sysparm_query": {"serial_number=" + m.Serial}, "sysparm_limit": {"1"}, "sysparm_fields": {"sys_id"}}
+	if err := n.do(ctx, http.MethodGet, snowTable()+"?"+q.Encode(), nil, &found); err != nil { return "", err }
+	rec := map[string]any{"serial_number": m.Serial, "mac_address": m.MAC}
+	if m.AssetTag != "" { rec["asset_tag"] = m.AssetTag }
+	if m.Hostname != "" { rec["name"] = m.Hostname }
+	if len(found.Result) > 0 {
+		id := found.Result[0].SysID
+		return id, n.do(ctx, http.MethodPatch, snowTable()+"/"+id, rec, nil)
+	}
+	rec["manufacturer"], rec["model_number"] = m.Vendor, m.Model
+	if _, ok := rec["name"]; !ok { rec["name"] = "bootah-" + strings.ReplaceAll(m.MAC, ":", "") }
+	var created struct {
+		Result struct{ SysID string `json:"sys_id"` } `json:"result"`
+	}
+	if err := n.do(ctx, http.MethodPost, snowTable(), rec, &created); err != nil { return "", err }
+	return created.Result.SysID, nil
+}
+
+func (n serviceNowConnector) result(ctx context.Context, remoteID, deploymentID, status, detail string) error {
+	note := fmt.Sprintf("Bootah deployment %s %s", deploymentID, status)
+	if detail != "" { note += ": " + detail }
+	return n.do(ctx, http.MethodPatch, snowTable()+"/"+remoteID, map[string]any{"work_notes": note}, nil)
+}
+
+func (n serviceNowConnector) pull(ctx context.Context, remoteID string) (map[string]string, error) {
+	var rec struct {
+		Result struct {
+			AssignedTo string `json:"assigned_to"`
+			Location   string `json:"location"`
+			Department string `json:"department"`
+		} `json:"result"`
+	}
+	q := url.Values{"sysparm_display_value": {"true"}, "sysparm_fields": {"assigned_to,location,department"}}
+	if err := n.do(ctx, http.MethodGet, snowTable()+"/"+remoteID+"?"+q.Encode(), nil, &rec); err != nil { return nil, err }
+	out := map[string]string{}
+	if rec.Result.AssignedTo != "" { out["owner"] = rec.Result.AssignedTo }
+	if rec.Result.Location != "" { out["location"] = rec.Result.Location }
+	if rec.Result.Department != "" { out["department"] = rec.Result.Department }
+	return out, nil
+}
+
+// setMachineField stores one custom field value for a machine.
+func (s *Server) setMachineField(mac, name, value, source string) error {
+	_, err := s.DB.Exec(`INSERT INTO machine_fields (mac, name, value, source, updated) VALUES (?,?,?,?,?)
+		ON CONFLICT(mac, name) DO UPDATE SET value=excluded.value, source=excluded.source, updated=excluded.updated`,
+		mac, name, value, source, time.Now().Format(time.RFC3339))
+	return err
+}
+
+func (s *Server) machineFields(mac string) (map[string]string, error) {
+	rows, err := s.DB.Query(`SELECT name, value FROM machine_fields WHERE mac=? ORDER BY name`, mac)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := map[string]string{}
+	for rows.Next() {
+		var k, v string
+		if err := rows.Scan(&k, &v); err != nil { return nil, err }
+		out[k] = v
+	}
+	return out, rows.Err()
+}
+
+// cmdbMachineFor loads what the connector needs about a machine.
+func (s *Server) cmdbMachineFor(mac string) (cmdbMachine, error) {
+	m := cmdbMachine{MAC: mac}
+	var serial, vendor, model, asset *string
+	err := s.DB.QueryRow(`SELECT serial, vendor, model, asset_tag FROM inventory WHERE mac=? ORDER BY id DESC LIMIT 1`, mac).Scan(&serial, &vendor, &model, &asset)
+	if err != nil { return m, err }
+	m.Serial, m.Vendor, m.Model, m.AssetTag = strOrEmpty(serial), strOrEmpty(vendor), strOrEmpty(model), strOrEmpty(asset)
+	_ = s.DB.QueryRow(`SELECT COALESCE(hostname,'') FROM deployments WHERE mac=? ORDER BY created_at DESC LIMIT 1`, mac).Scan(&m.Hostname)
+	return m, nil
+}
+
+// cmdbRemoteID returns the machine's remote record id, pushing it first if the
+// connector has not seen it yet.
+func (s *Server) cmdbRemoteID(ctx context.Context, c cmdbConnector, mac string) (string, error) {
+	fields, err := s.machineFields(mac)
+	if err != nil { return "", err }
+	if id := fields["cmdb_id"]; id != "" { return id, nil }
+	m, err := s.cmdbMachineFor(mac)
+	if err != nil { return "", err }
+	id, err := c.push(ctx, m)
+	if err != nil { return "", err }
+	return id, s.setMachineField(mac, "cmdb_id", id, cmdbKind())
+}
+
+// cmdbPullMachine maps remote asset metadata into machine fields.
+func (s *Server) cmdbPullMachine(ctx context.Context, c cmdbConnector, mac string) (int, error) {
+	id, err := s.cmdbRemoteID(ctx, c, mac)
+	if err != nil { return 0, err }
+	vals, err := c.pull(ctx, id)
+	if err != nil { return 0, err }
+	for k, v := range vals {
+		if err := s.setMachineField(mac, k, v, cmdbKind()); err != nil { return 0, err }
+	}
+	return len(vals), nil
+}
+
+// cmdbSync pulls metadata for every inventoried machine.
+func (s *Server) cmdbSync(ctx context.Context) (string, error) {
+	c, err := newCMDBConnector()
+	if err != nil { return "", err }
+	rows, err := s.DB.Query(`SELECT DISTINCT mac FROM inventory ORDER BY mac`)
+	if err != nil { return "", err }
+	var macs []string
+	for rows.Next() {
+		var mac string
+		if err := rows.Scan(&mac); err != nil { rows.Close(); return "", err }
+		macs = append(macs, mac)
+	}
+	rows.Close()
+	synced, failed := 0, 0
+	for _, mac := range macs {
+		if ctx.Err() != nil { return "", ctx.Err() }
+		if _, err := s.cmdbPullMachine(ctx, c, mac); err != nil {
+			failed++
+			log.Printf("cmdb sync %s: %v", mac, err)
+			continue
+		}
+		synced++
+	}
+	return fmt.Sprintf("synced %d machine(s), %d failed", synced, failed), nil
+}
+
+// cmdbPlugin pushes lifecycle events to the configured CMDB.
+type cmdbPlugin struct{}
+
+func (cmdbPlugin) Name() string { return "cmdb" }
+
+func (cmdbPlugin) Handle(ctx context.Context, s *Server, ev Event) error {
+	c, err := newCMDBConnector()
+	if err != nil { return err }
+	mac, _ := ev.Data["mac"].(string)
+	if mac == "" { return nil }
+	switch ev.Kind {
+	case "machine.enrolled":
+		_, err := s.cmdbPullMachine(ctx, c, mac)
+		return err
+	case "deployment.finished":
+		id, err := s.cmdbRemoteID(ctx, c, mac)
+		if err != nil { return err }
+		dep, _ := ev.Data["deployment_id"].(string)
+		status, _ := ev.Data["status"].(string)
+		detail, _ := ev.Data["error"].(string)
+		return c.result(ctx, id, dep, status, detail)
+	}
+	return nil
+}
+
+func init() {
+	if cmdbKind() != "" { registerPlugin(cmdbPlugin{}) }
+	registerJobHandler("cmdb-sync", func(s *Server, ctx context.Context, payload json.RawMessage) (string, error) {
+		return s.cmdbSync(ctx)
+	})
+}
+
+// startCMDB schedules the periodic pull on the cluster leader.
+func (s *Server) startCMDB(ctx context.Context) {
+	if cmdbKind() == "" { return }
+	interval, err := time.ParseDuration(getenv("BOOTAH_CMDB_SYNC_INTERVAL", "1h"))
+	if err != nil || interval <= 0 { return }
+	go s.runAsLeader(ctx, "cmdb-sync", interval, func() {
+		if _, err := s.enqueueJob("cmdb-sync", struct{}{}); err != nil { log.Printf("cmdb sync: %v", err) }
+	})
+}
+
+func (s *Server) cmdbRoutes() {
+	// Custom fields for one machine (?mac=); PUT {"mac","name","value"} sets a local field
+	s.Mux.HandleFunc("/api/v1/admin/machines/fields", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		switch r.Method {
+		case http.MethodGet:
+			mac := normalizeMAC(r.URL.Query().Get("mac"))
+			if mac == "" { http.Error(w, "mac required", 400); return }
+			fields, err := s.machineFields(mac)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			writeJSON(w, 200, map[string]any{"mac": mac, "fields": fields})
+		case http.MethodPut:
+			var body struct{ MAC, Name, Value string }
+			if !decodeJSON(w, r, &body) { return }
+			body.MAC = normalizeMAC(body.MAC)
+			if body.MAC == "" || strings.TrimSpace(body.Name) == "" { http.Error(w, "mac and name required", 400); return }
+			if err := s.setMachineField(body.MAC, body.Name, body.Value, "local"); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "update", "machine_field", map[string]any{"mac": body.MAC, "name": body.Name})
+			writeJSON(w, 200, map[string]any{"ok": true})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	s.Mux.HandleFunc("/api/v1/admin/cmdb/sync", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		if cmdbKind() == "" { http.Error(w, "no CMDB configured", 409); return }
+		id, err := s.enqueueJob("cmdb-sync", struct{}{})
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		writeJSON(w, 202, map[string]any{"job": id, "status": "queued"})
+	})
+
+	// CMDB-side change notification: {"mac": "..."} or {"serial": "..."}
+	s.Mux.HandleFunc("/api/v1/cmdb/webhook", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		secret := getenv("BOOTAH_CMDB_WEBHOOK_SECRET", "")
+		if cmdbKind() == "" || secret == "" { http.NotFound(w, r); return }
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Bootah-Token")), []byte(secret)) != 1 { http.Error(w, "unauthorized", 401); return }
+		var body struct{ MAC, Serial string }
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&body); err != nil { http.Error(w, err.Error(), 400); return }
+		mac := normalizeMAC(body.MAC)
+		if mac == "" && body.Serial != "" {
+			_ = s.DB.QueryRow(`SELECT mac FROM inventory WHERE serial=? ORDER BY id DESC LIMIT 1`, body.Serial).Scan(&mac)
+		}
+		if mac == "" { http.Error(w, "unknown machine", 404); return }
+		c, err := newCMDBConnector()
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		n, err := s.cmdbPullMachine(r.Context(), c, mac)
+		if err != nil { http.Error(w, err.Error(), 502); return }
+		writeJSON(w, 200, map[string]any{"mac": mac, "updated": n})
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ---- Image conversion jobs ----
+// Conversions run external tooling over a local copy of the source image and
+// store the output as a new image linked through images.derived_from. Each
+// conversion is a ";"-separated list of commands with {src}, {dst} and {work}
+// placeholders, overridable with BOOTAH_CONVERT_<FROM>_<TO> (e.g.
+// BOOTAH_CONVERT_FFU_WIM). FFU/WIM conversions need Windows-side tooling, so
+// they have no default and must be configured.
+var conversionDefaults = map[string]string{
+	"iso:squashfs": "xorriso -osirrox on -indev {src} -extract / {work} ; mksquashfs {work} {dst} -comp xz -noappend",
+	"ffu:wim":      "",
+	"wim:ffu":      "",
+}
+
+func conversionCommands(from, to string) ([][]string, error) {
+	def, ok := conversionDefaults[from+":"+to]
+	if !ok { return nil, fmt.Errorf("unsupported conversion %s -> %s", from, to) }
+	spec := getenv("BOOTAH_CONVERT_"+strings.ToUpper(from)+"_"+strings.ToUpper(to), def)
+	if spec == "" { return nil, fmt.Errorf("conversion %s -> %s not configured (set BOOTAH_CONVERT_%s_%s)", from, to, strings.ToUpper(from), strings.ToUpper(to)) }
+	var cmds [][]string
+	for _, c := range strings.Split(spec, ";") {
+		if f := strings.Fields(c); len(f) > 0 { cmds = append(cmds, f) }
+	}
+	return cmds, nil
+}
+
+// stageObject copies a stored object into dir for tools that need a local file.
+func (s *Server) stageObject(ctx context.Context, key, dir string) (string, error) {
+	p := filepath.Join(dir, "source"+filepath.Ext(key))
+	rc, err := s.Store.Open(ctx, key)
+	if err != nil { return "", err }
+	defer rc.Close()
+	f, err := os.Create(p)
+	if err != nil { return "", err }
+	if _, err := io.Copy(f, rc); err != nil { f.Close(); return "", err }
+	return p, f.Close()
+}
+
+// convertImage runs a conversion and records the derived image, returning its id.
+func (s *Server) convertImage(ctx context.Context, srcID, target string, cmds [][]string) (string, error) {
+	var name, typ, key string
+	if err := s.DB.QueryRow(`SELECT name, type, file FROM images WHERE id=?`, srcID).Scan(&name, &typ, &key); err != nil { return "", err }
+	work, err := os.MkdirTemp("", "bootah-convert-")
+	if err != nil { return "", err }
+	defer os.RemoveAll(work)
+	src, err := s.stageObject(ctx, key, work)
+	if err != nil { return "", err }
+	dst := filepath.Join(work, "output."+target)
+	extract := filepath.Join(work, "tree")
+	if err := os.Mkdir(extract, 0o755); err != nil { return "", err }
+	repl := strings.NewReplacer("{src}", src, "{dst}", dst, "{work}", extract)
+	for _, c := range cmds {
+		args := make([]string, len(c))
+		for i, a := range c { args[i] = repl.Replace(a) }
+		out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+		if err != nil { return "", fmt.Errorf("%s: %v: %s", args[0], err, strings.TrimSpace(string(out))) }
+	}
+	in, err := os.Open(dst)
+	if err != nil { return "", fmt.Errorf("conversion produced no output: %w", err) }
+	defer in.Close()
+	id := genID()
+	newKey := id + "." + target
+	size, sum, err := s.StorePut(ctx, newKey, in)
+	if err != nil { return "", err }
+	_, err = s.DB.Exec(`INSERT INTO images (id, name, type, size_mb, updated, file, derived_from, sha256) VALUES (?,?,?,?,?,?,?,?)`,
+		id, name+" ("+target+")", target, size/(1024*1024), time.Now().Format("2006-01-02"), newKey, srcID, sum)
+	if err != nil { return "", err }
+	if err := s.recordFirstImageVersion(id, ""); err != nil { log.Printf("image %s version: %v", id, err) }
+	s.imageStored(id, 1, "derived", name+" ("+target+")", target, map[string]any{"size_mb": size/(1024*1024), "derived_from": srcID})
+	s.queueImageInspection(id, 1, target)
+	s.audit(nil, "convert", "image", map[string]any{"id": id, "source": srcID, "from": typ, "to": target})
+	return id, nil
+}
+
+type conversionJob struct {
+	ImageID string `json:"image_id"`
+	Target  string `json:"target"`
+}
+
+func init() {
+	registerJobHandler("convert-image", func(s *Server, ctx context.Context, payload json.RawMessage) (string, error) {
+		var j conversionJob
+		if err := json.Unmarshal(payload, &j); err != nil { return "", err }
+		var typ string
+		if err := s.DB.QueryRow(`SELECT type FROM images WHERE id=?`, j.ImageID).Scan(&typ); err != nil { return "", err }
+		cmds, err := conversionCommands(typ, j.Target)
+		if err != nil { return "", err }
+		id, err := s.convertImage(ctx, j.ImageID, j.Target, cmds)
+		if err != nil { return "", err }
+		return "image:" + id, nil
+	})
+}
+
+func (s *Server) conversionRoutes() {
+	// {"image_id": "...", "target": "wim|ffu|squashfs"}
+	s.Mux.HandleFunc("/api/v1/admin/images/convert", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		var body struct {
+			ImageID string `json:"image_id"`
+			Target  string `json:"target"`
+		}
+		if !decodeJSON(w, r, &body) { return }
+		var typ string
+		if err := s.DB.QueryRow(`SELECT type FROM images WHERE id=?`, body.ImageID).Scan(&typ); err != nil {
+			if err == sql.ErrNoRows { http.NotFound(w, r); return }
+			http.Error(w, err.Error(), 500); return
+		}
+		target := strings.ToLower(body.Target)
+		if _, err := conversionCommands(typ, target); err != nil { http.Error(w, err.Error(), 400); return }
+		jobID, err := s.enqueueJob("convert-image", conversionJob{ImageID: body.ImageID, Target: target})
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		s.audit(s.actorID(r), "convert_start", "image", map[string]any{"id": body.ImageID, "target": target, "job": jobID})
+		writeJSON(w, 202, map[string]any{"job": jobID, "status": "queued"})
+	})
+}
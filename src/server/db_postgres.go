@@ -0,0 +1,10 @@
+//go:build postgres
+
+package main
+
+// PostgreSQL driver for BOOTAH_DB_DRIVER=postgres. Build with
+//
+//	go build -tags postgres
+import _ "github.com/jackc/pgx/v5/stdlib"
+
+func init() { registerPostgres("pgx") }
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ---- Deployments & per-deployment credentials ----
+// Every deployment gets its own local-admin password and agent token. Both are
+// sealed in deployment_secrets and only ever rendered into that deployment's
+// answer file; the agent token is additionally stored hashed for lookup. The
+// installer environment collects the token once through /api/v1/agent/token
+// and the answer file is only served to the deployment's own token.
+func initDeployments(db *sql.DB) error {
+	ddl1 := `CREATE TABLE IF NOT EXISTS deployments (
+		id TEXT PRIMARY KEY,
+		mac TEXT NOT NULL,
+		hostname TEXT,
+		image_id TEXT,
+		template_id TEXT,
+		task_sequence_id TEXT,
+		status TEXT NOT NULL,
+		error TEXT,
+		started_at TEXT,
+		finished_at TEXT,
+		agent_token_hash TEXT UNIQUE,
+		created_by INTEGER,
+		created_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL
+	);`
+	ddl2 := `CREATE TABLE IF NOT EXISTS deployment_secrets (
+		deployment_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (deployment_id, name)
+	);`
+	ddl3 := `CREATE INDEX IF NOT EXISTS deployments_mac ON deployments (mac, created_at);`
+	for _, ddl := range []string{ddl1, ddl2, ddl3} {
+		if _, err := db.Exec(ddl); err != nil { return err }
+	}
+	return nil
+}
+
+const (
+	secretAdminPassword = "admin_password"
+	secretAgentToken    = "agent_token"
+)
+
+// deploymentActive reports whether a deployment status still allows its
+// answer file and agent token to be used.
+func deploymentActive(status string) bool { return status == "pending" || status == "running" || status == "validating" }
+
+// createDeployment records a deployment and generates its credentials.
+func (s *Server) createDeployment(mac, hostname, imageID, templateID, sequenceID string, actor *int64) (string, error) {
+	id := "dep-" + genID()
+	token := randToken(32)
+	secrets := map[string]string{secretAdminPassword: genStrongPassword(20), secretAgentToken: token}
+	tx, err := s.DB.Begin()
+	if err != nil { return "", err }
+	defer tx.Rollback()
+	now := time.Now().Format(time.RFC3339)
+	var createdBy any
+	if actor != nil { createdBy = *actor }
+	_, err = tx.Exec(`INSERT INTO deployments (id, mac, hostname, image_id, template_id, task_sequence_id, status, agent_token_hash, created_by, created_at, updated_at) VALUES (?,?,?,?,?,?,?,?,?,?,?)`,
+		id, mac, hostname, imageID, templateID, sequenceID, "pending", hashToken(token), createdBy, now, now)
+	if err != nil { return "", err }
+	for name, v := range secrets {
+		sealed, err := s.seal(v)
+		if err != nil { return "", err }
+		if _, err := tx.Exec(`INSERT INTO deployment_secrets (deployment_id, name, value) VALUES (?,?,?)`, id, name, sealed); err != nil { return "", err }
+	}
+	return id, tx.Commit()
+}
+
+// setDeploymentStatus moves a deployment to status. "running" stamps the start
+// time; succeeded/failed stamp the finish time and record the failure cause.
+func (s *Server) setDeploymentStatus(id, status, cause string) error {
+	now := time.Now().Format(time.RFC3339)
+	var err error
+	switch status {
+	case "running":
+		_, err = s.DB.Exec(`UPDATE deployments SET status=?, started_at=COALESCE(started_at, ?), updated_at=? WHERE id=?`, status, now, now, id)
+	case "succeeded", "failed":
+		_, err = s.DB.Exec(`UPDATE deployments SET status=?, error=?, finished_at=?, updated_at=? WHERE id=?`, status, cause, now, now, id)
+		if err == nil {
+			var mac, hostname, ip, image string
+			_ = s.DB.QueryRow(`SELECT mac, COALESCE(hostname,''), COALESCE(ip,''), COALESCE(image_id,'') FROM deployments WHERE id=?`, id).Scan(&mac, &hostname, &ip, &image)
+			if status == "succeeded" { s.recordDeployed(mac, image); s.scheduleProfileRevert(mac) }
+			s.emit("deployment.finished", map[string]any{"deployment_id": id, "status": status, "error": cause, "mac": mac, "hostname": hostname, "ip": ip, "image_id": image})
+		}
+	default:
+		_, err = s.DB.Exec(`UPDATE deployments SET status=?, updated_at=? WHERE id=?`, status, now, id)
+	}
+	return err
+}
+
+// deploymentSecrets unseals all secrets stored for a deployment.
+func (s *Server) deploymentSecrets(id string) (map[string]string, error) {
+	rows, err := s.DB.Query(`SELECT name, value FROM deployment_secrets WHERE deployment_id=?`, id)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := map[string]string{}
+	for rows.Next() {
+		var name, sealed string
+		if err := rows.Scan(&name, &sealed); err != nil { return nil, err }
+		v, err := s.unseal(sealed)
+		if err != nil { return nil, err }
+		out[name] = v
+	}
+	return out, rows.Err()
+}
+
+// deploymentForAgentToken resolves a per-deployment agent token to its
+// deployment id; only active deployments match.
+func (s *Server) deploymentForAgentToken(tok string) (string, bool) {
+	if tok == "" { return "", false }
+	var id, status string
+	if err := s.DB.QueryRow(`SELECT id, status FROM deployments WHERE agent_token_hash=?`, hashToken(tok)).Scan(&id, &status); err != nil { return "", false }
+	return id, deploymentActive(status)
+}
+
+// renderAnswerFile renders a deployment's template with its credentials and
+// resolves the template secrets it references.
+func (s *Server) renderAnswerFile(id string) (string, string, error) {
+	var mac, hostname, templateID string
+	err := s.DB.QueryRow(`SELECT mac, COALESCE(hostname,''), COALESCE(template_id,'') FROM deployments WHERE id=?`, id).Scan(&mac, &hostname, &templateID)
+	if err != nil { return "", "", err }
+	var kind, body string
+	if err := s.DB.QueryRow(`SELECT kind, body FROM templates WHERE id=?`, templateID).Scan(&kind, &body); err != nil { return "", "", err }
+	secrets, err := s.deploymentSecrets(id)
+	if err != nil { return "", "", err }
+	preset, err := s.regionalPresetFor(mac)
+	if err != nil { return "", "", err }
+	out, err := renderTemplate(kind, body, answerFileVars(id, mac, hostname, secrets, preset), s.secretResolver(id, mac, templateID, true))
+	return kind, out, err
+}
+
+// answerFileVars is the data answer-file templates are rendered with.
+func answerFileVars(id, mac, hostname string, secrets map[string]string, preset *RegionalPreset) map[string]string {
+	vars := map[string]string{
+		"DeploymentID":  id,
+		"MAC":           mac,
+		"Hostname":      hostname,
+		"ServerURL":     getenv("BOOTAH_PUBLIC_URL", ""),
+		"AdminPassword": secrets[secretAdminPassword],
+		"AgentToken":    secrets[secretAgentToken],
+	}
+	preset.addTemplateVars(vars)
+	return vars
+}
+
+func (s *Server) deploymentRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/deployments", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		switch r.Method {
+		case http.MethodGet:
+			macs, err := s.siteMACs(r)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			var out []map[string]any
+			if macs != nil && len(macs) == 0 { writeJSON(w, 200, out); return }
+			q, args := `SELECT id, mac, COALESCE(hostname,''), COALESCE(image_id,''), COALESCE(template_id,''), COALESCE(task_sequence_id,''), status, COALESCE(error,''), COALESCE(started_at,''), COALESCE(finished_at,''), created_at, updated_at FROM deployments`, []any{}
+			if macs != nil {
+				q += ` WHERE mac IN (` + strings.TrimSuffix(strings.Repeat("?,", len(macs)), ",") + `)`
+				for _, m := range macs { args = append(args, m) }
+			}
+			rows, err := s.DB.Query(q+` ORDER BY created_at DESC LIMIT 200`, args...)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			for rows.Next() {
+				var id, mac, hostname, image, tpl, seq, status, cause, started, finished, created, updated string
+				if err := rows.Scan(&id, &mac, &hostname, &image, &tpl, &seq, &status, &cause, &started, &finished, &created, &updated); err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, map[string]any{"id": id, "mac": mac, "hostname": hostname, "image_id": image, "template_id": tpl, "task_sequence_id": seq,
+					"status": status, "error": cause, "started_at": started, "finished_at": finished, "created_at": created, "updated_at": updated})
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPost:
+			var body struct {
+				MAC        string `json:"mac"`
+				Hostname   string `json:"hostname"`
+				ImageID    string `json:"image_id"`
+				TemplateID string `json:"template_id"`
+				SequenceID string `json:"task_sequence_id"`
+			}
+			if !decodeJSON(w, r, &body) { return }
+			mac := normalizeMAC(body.MAC)
+			if mac == "" { http.Error(w, "mac required", 400); return }
+			var n int
+			_ = s.DB.QueryRow(`SELECT COUNT(*) FROM templates WHERE id=?`, body.TemplateID).Scan(&n)
+			if n == 0 { http.Error(w, "unknown template", 400); return }
+			if body.SequenceID != "" {
+				if _, err := s.taskSequence(body.SequenceID); err != nil { http.Error(w, "unknown task sequence", 400); return }
+			}
+			if body.ImageID != "" {
+				if err := s.imageBootable(body.ImageID); err != nil { http.Error(w, err.Error(), 409); return }
+			}
+			actor := s.actorID(r)
+			id, err := s.createDeployment(mac, strings.TrimSpace(body.Hostname), body.ImageID, body.TemplateID, body.SequenceID, actor)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(actor, "create", "deployment", map[string]any{"id": id, "mac": mac, "template_id": body.TemplateID})
+			writeJSON(w, 201, map[string]any{"id": id, "status": "pending"})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// Reveal generated credentials (admin only, always audited)
+	s.Mux.HandleFunc("/api/v1/admin/deployments/credentials", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		id := r.URL.Query().Get("id")
+		var mac string
+		if err := s.DB.QueryRow(`SELECT mac FROM deployments WHERE id=?`, id).Scan(&mac); err != nil {
+			if err == sql.ErrNoRows { http.NotFound(w, r); return }
+			http.Error(w, err.Error(), 500); return
+		}
+		secrets, err := s.deploymentSecrets(id)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		s.audit(s.actorID(r), "reveal_credentials", "deployment", map[string]any{"id": id, "mac": mac})
+		writeJSON(w, 200, map[string]any{"id": id, "mac": mac, "admin_password": secrets[secretAdminPassword], "agent_token": secrets[secretAgentToken]})
+	})
+
+	// Agent: {"mac": "..."} hands the agent token of the machine's pending
+	// deployment to the installer environment, once; it authenticates the
+	// answer file fetch and everything the installed agent does after.
+	s.Mux.HandleFunc("/api/v1/agent/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		if !s.requireAgent(w, r) { return }
+		var body struct {
+			MAC string `json:"mac"`
+		}
+		if !decodeJSON(w, r, &body) { return }
+		mac := normalizeMAC(body.MAC)
+		if mac == "" { http.Error(w, "mac required", 400); return }
+		if !s.agentTaskMAC(w, r, mac) || !s.requireEnrollment(w, r, mac) || !s.requireAttestation(w, r, mac) { return }
+		var id string
+		err := s.DB.QueryRow(`SELECT id FROM deployments WHERE mac=? AND status='pending' ORDER BY created_at DESC LIMIT 1`, mac).Scan(&id)
+		if err == sql.ErrNoRows { http.Error(w, "no pending deployment", 404); return }
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		res, err := s.DB.Exec(`UPDATE deployments SET token_issued_at=? WHERE id=? AND token_issued_at IS NULL`, time.Now().Format(time.RFC3339), id)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if n, _ := res.RowsAffected(); n == 0 { http.Error(w, "agent token already issued", 409); return }
+		secrets, err := s.deploymentSecrets(id)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		s.audit(nil, "issue_token", "deployment", map[string]any{"id": id, "mac": mac, "ip": clientIP(r)})
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, 200, map[string]any{"deployment_id": id, "agent_token": secrets[secretAgentToken]})
+	})
+
+	// Rendered unattend.xml / cloud-init for an active deployment
+	// (?deployment=&mac=), only with that deployment's own agent token
+	s.Mux.HandleFunc("/api/v1/agent/answer", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		id := r.URL.Query().Get("deployment")
+		if dep, ok := s.deploymentForAgentToken(r.Header.Get("X-Bootah-Agent-Token")); !ok || dep != id {
+			http.Error(w, "unauthorized agent", 401); return
+		}
+		var status, mac string
+		if err := s.DB.QueryRow(`SELECT status, mac FROM deployments WHERE id=?`, id).Scan(&status, &mac); err != nil {
+			if err == sql.ErrNoRows { http.NotFound(w, r); return }
+			http.Error(w, err.Error(), 500); return
+		}
+		if normalizeMAC(r.URL.Query().Get("mac")) != mac { http.Error(w, "token not valid for this machine", 403); return }
+		if !deploymentActive(status) { http.Error(w, "deployment not active", 409); return }
+		if !s.requireEnrollment(w, r, mac) || !s.requireAttestation(w, r, mac) { return }
+		kind, out, err := s.renderAnswerFile(id)
+		if err != nil { http.Error(w, "render: "+err.Error(), 500); return }
+		if status == "pending" { _ = s.setDeploymentStatus(id, "running", "") }
+		s.audit(nil, "render_answer", "deployment", map[string]any{"id": id, "kind": kind})
+		if kind == "unattend" { w.Header().Set("Content-Type", "application/xml") } else { w.Header().Set("Content-Type", "text/yaml") }
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = w.Write([]byte(out))
+	})
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ---- DHCP / ProxyDHCP ----
+// BOOTAH_DHCP_MODE=proxy answers PXE clients alongside the existing DHCP
+// server without handing out addresses: the offer only carries the boot
+// server (option 66 / siaddr) and boot file (option 67), and boot-server
+// requests on port 4011 are acknowledged the same way. BOOTAH_DHCP_MODE=full
+// also leases addresses from BOOTAH_DHCP_RANGE ("first-last") to every
+// client, with BOOTAH_DHCP_NETMASK, BOOTAH_DHCP_ROUTER, BOOTAH_DHCP_DNS and
+// BOOTAH_DHCP_LEASE; run it on one node only. PXE ROMs get the BIOS or EFI
+// iPXE binary (BOOTAH_PXE_BIOS_FILE / BOOTAH_PXE_EFI_FILE) from the TFTP
+// server at BOOTAH_DHCP_TFTP_SERVER (default: this host); clients already
+// running iPXE get http://<server>:<port>/ipxe/boot.ipxe directly. The
+// server address defaults to the first IPv4 address of BOOTAH_DHCP_INTERFACE
+// (or of the host) and can be set with BOOTAH_DHCP_SERVER_IP; the sockets are
+// bound to that interface, which only works on Linux. Binding to ports 67 and
+// 4011 needs root or CAP_NET_BIND_SERVICE.
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpDecline  = 4
+	dhcpAck      = 5
+	dhcpNak      = 6
+	dhcpRelease  = 7
+	dhcpInform   = 8
+)
+
+var dhcpMagic = []byte{99, 130, 83, 99}
+
+type dhcpPacket struct {
+	Op      byte
+	XID     []byte
+	Flags   []byte
+	CIAddr  net.IP
+	YIAddr  net.IP
+	SIAddr  net.IP
+	GIAddr  net.IP
+	CHAddr  net.HardwareAddr
+	SName   string
+	File    string
+	Options map[byte][]byte
+}
+
+func parseDHCP(b []byte) (*dhcpPacket, error) {
+	if len(b) < 240 || !bytes.Equal(b[236:240], dhcpMagic) { return nil, errors.New("not a DHCP packet") }
+	hlen := int(b[2])
+	if hlen > 16 { hlen = 16 }
+	p := &dhcpPacket{Op: b[0], XID: b[4:8], Flags: b[10:12], CIAddr: net.IP(b[12:16]), YIAddr: net.IP(b[16:20]),
+		SIAddr: net.IP(b[20:24]), GIAddr: net.IP(b[24:28]), CHAddr: net.HardwareAddr(b[28 : 28+hlen]), Options: map[byte][]byte{}}
+	for i := 240; i < len(b); {
+		code := b[i]
+		if code == 255 { break }
+		if code == 0 { i++; continue }
+		if i+1 >= len(b) || i+2+int(b[i+1]) > len(b) { return nil, errors.New("truncated option") }
+		n := int(b[i+1])
+		p.Options[code] = append(p.Options[code], b[i+2:i+2+n]...) // split options concatenate (RFC 3396)
+		i += 2 + n
+	}
+	if len(p.Options[53]) != 1 { return nil, errors.New("missing message type") }
+	return p, nil
+}
+
+func (p *dhcpPacket) msgType() byte { return p.Options[53][0] }
+
+func (p *dhcpPacket) marshal() []byte {
+	b := make([]byte, 240, 576)
+	b[0], b[1], b[2] = p.Op, 1, byte(len(p.CHAddr))
+	copy(b[4:8], p.XID)
+	copy(b[10:12], p.Flags)
+	copy(b[12:16], p.CIAddr.To4())
+	copy(b[16:20], p.YIAddr.To4())
+	copy(b[20:24], p.SIAddr.To4())
+	copy(b[24:28], p.GIAddr.To4())
+	copy(b[28:44], p.CHAddr)
+	if len(p.SName) < 64 { copy(b[44:108], p.SName) }
+	if len(p.File) < 128 { copy(b[108:236], p.File) }
+	copy(b[236:240], dhcpMagic)
+	codes := make([]int, 0, len(p.Options))
+	for c := range p.Options { if c != 53 { codes = append(codes, int(c)) } }
+	sort.Ints(codes)
+	for _, c := range append([]int{53}, codes...) {
+		v := p.Options[byte(c)]
+		for len(v) > 255 { b = append(append(b, byte(c), 255), v[:255]...); v = v[255:] }
+		b = append(append(b, byte(c), byte(len(v))), v...)
+	}
+	b = append(b, 255)
+	for len(b) < 300 { b = append(b, 0) }
+	return b
+}
+
+// reply starts a server response to p.
+func (p *dhcpPacket) reply(msgType byte, server net.IP) *dhcpPacket {
+	return &dhcpPacket{Op: 2, XID: p.XID, Flags: p.Flags, GIAddr: p.GIAddr, CHAddr: p.CHAddr,
+		Options: map[byte][]byte{53: {msgType}, 54: server.To4()}}
+}
+
+func ip4u(ip net.IP) uint32 { return binary.BigEndian.Uint32(ip.To4()) }
+
+func u2ip4(v uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
+
+type dhcpConfig struct {
+	Mode       string // proxy|full
+	Iface      string
+	ServerIP   net.IP
+	TFTPServer net.IP
+	BootURL    string
+	RangeFirst net.IP
+	RangeLast  net.IP
+	Netmask    net.IPMask
+	Router     net.IP
+	DNS        []net.IP
+	Lease      time.Duration
+}
+
+func dhcpMode() string { return strings.ToLower(getenv("BOOTAH_DHCP_MODE", "off")) }
+
+func parseIP4(name, v string) (net.IP, error) {
+	ip := net.ParseIP(strings.TrimSpace(v)).To4()
+	if ip == nil { return nil, fmt.Errorf("%s: invalid IPv4 address %q", name, v) }
+	return ip, nil
+}
+
+// dhcpServerIP picks the address this server advertises to clients.
+func dhcpServerIP(iface string) (net.IP, error) {
+	if v := getenv("BOOTAH_DHCP_SERVER_IP", ""); v != "" { return parseIP4("BOOTAH_DHCP_SERVER_IP", v) }
+	var addrs []net.Addr
+	var err error
+	if iface != "" {
+		ifi, ierr := net.InterfaceByName(iface)
+		if ierr != nil { return nil, ierr }
+		addrs, err = ifi.Addrs()
+	} else {
+		addrs, err = net.InterfaceAddrs()
+	}
+	if err != nil { return nil, err }
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && n.IP.To4() != nil { return n.IP.To4(), nil }
+	}
+	return nil, errors.New("no IPv4 address found; set BOOTAH_DHCP_SERVER_IP")
+}
+
+func dhcpConfigFromEnv(httpPort string) (*dhcpConfig, error) {
+	c := &dhcpConfig{Mode: dhcpMode(), Iface: getenv("BOOTAH_DHCP_INTERFACE", "")}
+	if c.Mode != "proxy" && c.Mode != "full" { return nil, fmt.Errorf("BOOTAH_DHCP_MODE must be proxy, full or off, got %q", c.Mode) }
+	var err error
+	if c.ServerIP, err = dhcpServerIP(c.Iface); err != nil { return nil, err }
+	c.TFTPServer = c.ServerIP
+	if v := getenv("BOOTAH_DHCP_TFTP_SERVER", ""); v != "" {
+		if c.TFTPServer, err = parseIP4("BOOTAH_DHCP_TFTP_SERVER", v); err != nil { return nil, err }
+	}
+	c.BootURL = fmt.Sprintf("http://%s:%s/ipxe/boot.ipxe", c.ServerIP, httpPort)
+	if c.Mode == "proxy" { return c, nil }
+
+	first, last, ok := strings.Cut(getenv("BOOTAH_DHCP_RANGE", ""), "-")
+	if !ok { return nil, errors.New("BOOTAH_DHCP_RANGE (first-last) is required in full mode") }
+	if c.RangeFirst, err = parseIP4("BOOTAH_DHCP_RANGE", first); err != nil { return nil, err }
+	if c.RangeLast, err = parseIP4("BOOTAH_DHCP_RANGE", last); err != nil { return nil, err }
+	if ip4u(c.RangeLast) < ip4u(c.RangeFirst) { return nil, errors.New("BOOTAH_DHCP_RANGE: last address is before first") }
+	mask, err := parseIP4("BOOTAH_DHCP_NETMASK", getenv("BOOTAH_DHCP_NETMASK", "255.255.255.0"))
+	if err != nil { return nil, err }
+	c.Netmask = net.IPMask(mask)
+	if v := getenv("BOOTAH_DHCP_ROUTER", ""); v != "" {
+		if c.Router, err = parseIP4("BOOTAH_DHCP_ROUTER", v); err != nil { return nil, err }
+	}
+	for _, v := range splitList(getenv("BOOTAH_DHCP_DNS", "")) {
+		ip, err := parseIP4("BOOTAH_DHCP_DNS", v)
+		if err != nil { return nil, err }
+		c.DNS = append(c.DNS, ip)
+	}
+	c.Lease = envDuration("BOOTAH_DHCP_LEASE", 12*time.Hour)
+	if c.Lease < time.Minute { return nil, errors.New("BOOTAH_DHCP_LEASE must be at least 1m") }
+	return c, nil
+}
+
+func initDHCP(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS dhcp_leases (
+		ip TEXT PRIMARY KEY,
+		mac TEXT NOT NULL,
+		hostname TEXT,
+		expires TEXT NOT NULL
+	)`)
+	return err
+}
+
+type dhcpServer struct {
+	s   *Server
+	cfg *dhcpConfig
+}
+
+// dhcpListen opens a broadcast-capable UDP socket, bound to the configured
+// interface when there is one.
+func dhcpListen(ctx context.Context, addr, iface string) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: func(_, _ string, rc syscall.RawConn) error {
+		var serr error
+		err := rc.Control(func(fd uintptr) { serr = dhcpSocketOptions(fd, iface) })
+		if err != nil { return err }
+		return serr
+	}}
+	return lc.ListenPacket(ctx, "udp4", addr)
+}
+
+func (s *Server) startDHCP(ctx context.Context, httpPort string) error {
+	if dhcpMode() == "off" { return nil }
+	cfg, err := dhcpConfigFromEnv(httpPort)
+	if err != nil { return err }
+	if cfg.Mode == "full" && replicaMode() { return errors.New("full mode needs a writable database; use proxy mode on replicas") }
+	d := &dhcpServer{s: s, cfg: cfg}
+	for _, addr := range []string{":67", ":4011"} {
+		conn, err := dhcpListen(ctx, addr, cfg.Iface)
+		if err != nil { return fmt.Errorf("listen %s: %w", addr, err) }
+		go func() { <-ctx.Done(); conn.Close() }()
+		go d.serve(ctx, conn)
+	}
+	log.Printf("dhcp: %s mode, server %s, tftp %s, ipxe %s", cfg.Mode, cfg.ServerIP, cfg.TFTPServer, cfg.BootURL)
+	return nil
+}
+
+func (d *dhcpServer) serve(ctx context.Context, conn net.PacketConn) {
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil { log.Printf("dhcp: read: %v", err) }
+			return
+		}
+		req, err := parseDHCP(append([]byte(nil), buf[:n]...))
+		if err != nil || req.Op != 1 || len(req.CHAddr) != 6 { continue }
+		resp := d.handle(req, port)
+		if resp == nil { continue }
+		if _, err := conn.WriteTo(resp.marshal(), d.destination(req, peer, port)); err != nil { log.Printf("dhcp: reply to %s: %v", req.CHAddr, err) }
+	}
+}
+
+// destination follows RFC 2131 4.1: relay agent, then a configured client,
+// else broadcast. Port 4011 requests are answered where they came from.
+func (d *dhcpServer) destination(req *dhcpPacket, peer net.Addr, port int) net.Addr {
+	switch {
+	case port == 4011:
+		return peer
+	case !req.GIAddr.Equal(net.IPv4zero):
+		return &net.UDPAddr{IP: req.GIAddr, Port: 67}
+	case !req.CIAddr.Equal(net.IPv4zero):
+		return &net.UDPAddr{IP: req.CIAddr, Port: 68}
+	}
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+}
+
+// pxeClient reports whether p comes from a PXE ROM or iPXE, and its arch.
+func pxeClient(p *dhcpPacket) (pxe, ipxe bool, arch string) {
+	pxe = strings.HasPrefix(string(p.Options[60]), "PXEClient")
+	ipxe = bytes.Contains(p.Options[77], []byte("iPXE")) || len(p.Options[175]) > 0
+	arch = "bios"
+	if a := p.Options[93]; len(a) >= 2 && binary.BigEndian.Uint16(a) != 0 { arch = "efi" }
+	return pxe || ipxe, ipxe, arch
+}
+
+// bootOptions points resp at the iPXE binary over TFTP, or at the boot
+// script over HTTP when the client already runs iPXE.
+func (d *dhcpServer) bootOptions(req, resp *dhcpPacket) {
+	_, ipxe, arch := pxeClient(req)
+	if ipxe {
+		resp.SIAddr, resp.File = d.cfg.ServerIP, d.cfg.BootURL
+	} else {
+		resp.SIAddr, resp.File = d.cfg.TFTPServer, pxeBootFile(arch)
+		resp.SName = d.cfg.TFTPServer.String()
+		resp.Options[66] = []byte(resp.SName)
+	}
+	resp.Options[67] = []byte(resp.File)
+	resp.Options[60] = []byte("PXEClient")
+	// PXE discovery control: boot the file given, skip boot server discovery
+	resp.Options[43] = []byte{6, 1, 8, 255}
+	if g := req.Options[97]; len(g) > 0 { resp.Options[97] = g }
+}
+
+func (d *dhcpServer) handle(req *dhcpPacket, port int) *dhcpPacket {
+	pxe, _, _ := pxeClient(req)
+	if d.cfg.Mode == "proxy" || port == 4011 {
+		if !pxe { return nil }
+		var resp *dhcpPacket
+		switch {
+		case port == 4011 && req.msgType() == dhcpRequest:
+			resp = req.reply(dhcpAck, d.cfg.ServerIP)
+			resp.CIAddr = req.CIAddr
+		case port == 67 && req.msgType() == dhcpDiscover:
+			resp = req.reply(dhcpOffer, d.cfg.ServerIP)
+		default:
+			return nil
+		}
+		d.bootOptions(req, resp)
+		return resp
+	}
+	return d.handleFull(req, pxe)
+}
+
+// ---- full mode ----
+
+func (d *dhcpServer) inRange(ip net.IP) bool {
+	ip = ip.To4()
+	return ip != nil && ip4u(ip) >= ip4u(d.cfg.RangeFirst) && ip4u(ip) <= ip4u(d.cfg.RangeLast)
+}
+
+// leaseFor finds an address for mac: its current lease, the address it asked
+// for when free, else the lowest free address in the range.
+func (d *dhcpServer) leaseFor(mac string, want net.IP) (net.IP, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	var cur string
+	err := d.s.DB.QueryRow(`SELECT ip FROM dhcp_leases WHERE mac=? ORDER BY expires DESC LIMIT 1`, mac).Scan(&cur)
+	if err == nil && d.inRange(net.ParseIP(cur)) { return net.ParseIP(cur).To4(), nil }
+	if err != nil && err != sql.ErrNoRows { return nil, err }
+	taken := map[uint32]bool{}
+	rows, err := d.s.DB.Query(`SELECT ip FROM dhcp_leases WHERE expires > ? AND mac <> ?`, now, mac)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil { return nil, err }
+		if v := net.ParseIP(ip).To4(); v != nil { taken[ip4u(v)] = true }
+	}
+	if err := rows.Err(); err != nil { return nil, err }
+	reserved := func(v uint32) bool { return taken[v] || u2ip4(v).Equal(d.cfg.ServerIP) || (d.cfg.Router != nil && u2ip4(v).Equal(d.cfg.Router)) }
+	if d.inRange(want) && !reserved(ip4u(want)) { return want.To4(), nil }
+	for v := ip4u(d.cfg.RangeFirst); v <= ip4u(d.cfg.RangeLast); v++ {
+		if !reserved(v) { return u2ip4(v), nil }
+		if v == ^uint32(0) { break }
+	}
+	return nil, errors.New("address pool exhausted")
+}
+
+func (d *dhcpServer) saveLease(ip net.IP, mac, hostname string, ttl time.Duration) error {
+	tx, err := d.s.DB.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM dhcp_leases WHERE mac=? AND ip<>?`, mac, ip.String()); err != nil { return err }
+	_, err = tx.Exec(`INSERT INTO dhcp_leases (ip, mac, hostname, expires) VALUES (?,?,?,?)
+		ON CONFLICT(ip) DO UPDATE SET hostname=excluded.hostname,
+			expires=CASE WHEN mac=excluded.mac THEN max(expires, excluded.expires) ELSE excluded.expires END, mac=excluded.mac`,
+		ip.String(), mac, hostname, time.Now().Add(ttl).UTC().Format(time.RFC3339))
+	if err != nil { return err }
+	return tx.Commit()
+}
+
+func (d *dhcpServer) addressOptions(resp *dhcpPacket) {
+	secs := make([]byte, 4)
+	binary.BigEndian.PutUint32(secs, uint32(d.cfg.Lease/time.Second))
+	resp.Options[51] = secs
+	resp.Options[1] = []byte(d.cfg.Netmask)
+	if d.cfg.Router != nil { resp.Options[3] = d.cfg.Router }
+	var dns []byte
+	for _, ip := range d.cfg.DNS { dns = append(dns, ip...) }
+	if len(dns) > 0 { resp.Options[6] = dns }
+}
+
+func (d *dhcpServer) handleFull(req *dhcpPacket, pxe bool) *dhcpPacket {
+	mac := normalizeMAC(req.CHAddr.String())
+	hostname := string(req.Options[12])
+	switch req.msgType() {
+	case dhcpDiscover:
+		ip, err := d.leaseFor(mac, net.IP(req.Options[50]))
+		if err != nil { log.Printf("dhcp: offer for %s: %v", mac, err); return nil }
+		// hold the address briefly while the client decides
+		if err := d.saveLease(ip, mac, hostname, time.Minute); err != nil { log.Printf("dhcp: %v", err); return nil }
+		resp := req.reply(dhcpOffer, d.cfg.ServerIP)
+		resp.YIAddr = ip
+		d.addressOptions(resp)
+		if pxe { d.bootOptions(req, resp) }
+		return resp
+	case dhcpRequest:
+		if sid := req.Options[54]; len(sid) == 4 && !net.IP(sid).Equal(d.cfg.ServerIP) {
+			// the client took another server's offer
+			_, _ = d.s.DB.Exec(`DELETE FROM dhcp_leases WHERE mac=?`, mac)
+			return nil
+		}
+		want := net.IP(req.Options[50])
+		if len(want) != 4 { want = req.CIAddr }
+		ip, err := d.leaseFor(mac, want)
+		if err != nil || !ip.Equal(want) {
+			resp := req.reply(dhcpNak, d.cfg.ServerIP)
+			resp.Flags = []byte{0x80, 0}
+			return resp
+		}
+		if err := d.saveLease(ip, mac, hostname, d.cfg.Lease); err != nil { log.Printf("dhcp: %v", err); return nil }
+		d.s.emit("dhcp.lease", map[string]any{"mac": mac, "ip": ip.String(), "hostname": hostname, "pxe": pxe})
+		resp := req.reply(dhcpAck, d.cfg.ServerIP)
+		resp.YIAddr, resp.CIAddr = ip, req.CIAddr
+		d.addressOptions(resp)
+		if pxe { d.bootOptions(req, resp) }
+		return resp
+	case dhcpInform:
+		resp := req.reply(dhcpAck, d.cfg.ServerIP)
+		resp.CIAddr = req.CIAddr
+		d.addressOptions(resp)
+		delete(resp.Options, 51)
+		if pxe { d.bootOptions(req, resp) }
+		return resp
+	case dhcpRelease:
+		_, _ = d.s.DB.Exec(`DELETE FROM dhcp_leases WHERE mac=? AND ip=?`, mac, req.CIAddr.String())
+	case dhcpDecline:
+		// keep the conflicting address out of the pool for one lease time
+		if ip := net.IP(req.Options[50]); len(ip) == 4 {
+			_, _ = d.s.DB.Exec(`INSERT INTO dhcp_leases (ip, mac, expires) VALUES (?,?,?) ON CONFLICT(ip) DO UPDATE SET mac=excluded.mac, hostname=NULL, expires=excluded.expires`,
+				ip.String(), "declined", time.Now().Add(d.cfg.Lease).UTC().Format(time.RFC3339))
+			log.Printf("dhcp: %s declined %s (address in use)", mac, ip)
+		}
+	}
+	return nil
+}
+
+func (s *Server) dhcpRoutes() {
+	// GET -> mode and leases; DELETE {"ip": "..."} frees a lease
+	s.Mux.HandleFunc("/api/v1/admin/dhcp", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+			out := map[string]any{"mode": dhcpMode(), "node": nodeID}
+			if cfg, err := dhcpConfigFromEnv(getenv("BOOTAH_HTTP_PORT", "8080")); err == nil {
+				out["server_ip"], out["tftp_server"], out["boot_url"] = cfg.ServerIP.String(), cfg.TFTPServer.String(), cfg.BootURL
+				if cfg.Mode == "full" { out["range"] = cfg.RangeFirst.String() + "-" + cfg.RangeLast.String() }
+			} else if dhcpMode() != "off" {
+				out["error"] = err.Error()
+			}
+			rows, err := s.DB.Query(`SELECT ip, mac, COALESCE(hostname,''), expires FROM dhcp_leases WHERE expires > ? ORDER BY ip`, time.Now().UTC().Format(time.RFC3339))
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			leases := []map[string]any{}
+			for rows.Next() {
+				var ip, mac, host, exp string
+				if err := rows.Scan(&ip, &mac, &host, &exp); err != nil { http.Error(w, err.Error(), 500); return }
+				leases = append(leases, map[string]any{"ip": ip, "mac": mac, "hostname": host, "expires": exp})
+			}
+			out["leases"] = leases
+			writeJSON(w, 200, out)
+		case http.MethodDelete:
+			var body struct{ IP string `json:"ip"` }
+			if !decodeJSON(w, r, &body) { return }
+			res, err := s.DB.Exec(`DELETE FROM dhcp_leases WHERE ip=?`, body.IP)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			if n, _ := res.RowsAffected(); n == 0 { http.NotFound(w, r); return }
+			s.audit(s.actorID(r), "release", "dhcp_lease", map[string]any{"ip": body.IP})
+			writeJSON(w, 200, map[string]any{"released": body.IP})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+}
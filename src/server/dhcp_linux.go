@@ -0,0 +1,12 @@
+package main
+
+import "syscall"
+
+// dhcpSocketOptions makes a DHCP socket broadcast-capable and shareable and
+// binds it to iface when set.
+func dhcpSocketOptions(fd uintptr, iface string) error {
+	err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+	if err == nil { err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1) }
+	if err == nil && iface != "" { err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface) }
+	return err
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// dhcpSocketOptions makes a DHCP socket broadcast-capable and shareable.
+// Binding to an interface needs SO_BINDTODEVICE, which only Linux has.
+func dhcpSocketOptions(fd uintptr, iface string) error {
+	if iface != "" { return errors.New("BOOTAH_DHCP_INTERFACE binding is only supported on Linux") }
+	err := syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+	if err == nil { err = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1) }
+	return err
+}
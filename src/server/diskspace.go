@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---- Disk space ----
+// Free space is watched on the database volume, the resumable upload staging
+// directory and, with local storage, on ImageRoot. Each node checks its own
+// disks every five minutes and notifies once when a volume drops below
+// BOOTAH_DISK_WARN_PERCENT free (default 10) or below the
+// BOOTAH_DISK_MIN_FREE_MB floor (default 1024), and again on recovery.
+// Uploads are refused with 507 while a volume is under the floor, or would be
+// once the declared request body is written. Platforms without statfs report
+// their volumes as unknown and never refuse uploads.
+type diskVolume struct {
+	Name        string  `json:"name"`
+	Path        string  `json:"path"`
+	FreeBytes   uint64  `json:"free_bytes"`
+	TotalBytes  uint64  `json:"total_bytes"`
+	FreePercent float64 `json:"free_percent"`
+	State       string  `json:"state"` // ok|low|critical
+	Error       string  `json:"error,omitempty"`
+}
+
+func diskFloorBytes() uint64 {
+	mb, err := strconv.ParseUint(getenv("BOOTAH_DISK_MIN_FREE_MB", "1024"), 10, 64)
+	if err != nil { mb = 1024 }
+	return mb << 20
+}
+
+func diskWarnPercent() float64 {
+	p, err := strconv.ParseFloat(getenv("BOOTAH_DISK_WARN_PERCENT", "10"), 64)
+	if err != nil || p < 0 { return 10 }
+	return p
+}
+
+// diskVolumes measures the volumes this node writes to.
+func (s *Server) diskVolumes() []diskVolume {
+	paths := map[string]string{}
+	if dir, ok := dbOnDisk(); ok { paths["db"] = dir }
+	if _, ok := s.Store.(*LocalStorage); ok { paths["images"] = s.ImageRoot }
+	paths["uploads"] = uploadStagingDir()
+	floor, warn := diskFloorBytes(), diskWarnPercent()
+	var out []diskVolume
+	for name, p := range paths {
+		v := diskVolume{Name: name, Path: p, State: "ok"}
+		var err error
+		if v.FreeBytes, v.TotalBytes, err = diskUsage(p); err != nil {
+			v.Error, v.State = err.Error(), "unknown"
+			out = append(out, v)
+			continue
+		}
+		if v.TotalBytes > 0 { v.FreePercent = float64(v.FreeBytes) * 100 / float64(v.TotalBytes) }
+		switch {
+		case v.FreeBytes < floor:
+			v.State = "critical"
+		case v.FreePercent < warn:
+			v.State = "low"
+		}
+		out = append(out, v)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// requireDiskSpace writes 507 when an upload would leave a volume under the
+// floor.
+func (s *Server) requireDiskSpace(w http.ResponseWriter, r *http.Request) bool {
+	var need uint64
+	if r.ContentLength > 0 { need = uint64(r.ContentLength) }
+	if err := s.diskSpaceFor(need); err != nil { http.Error(w, err.Error(), http.StatusInsufficientStorage); return false }
+	return true
+}
+
+// diskSpaceFor reports a volume that would drop under the floor after need
+// more bytes.
+func (s *Server) diskSpaceFor(need uint64) error {
+	floor := diskFloorBytes()
+	for _, v := range s.diskVolumes() {
+		if v.Error != "" { continue }
+		if v.FreeBytes < floor+need {
+			return fmt.Errorf("insufficient disk space on %s volume: %d MB free, %d MB required (floor %d MB)",
+				v.Name, v.FreeBytes>>20, (floor+need)>>20, floor>>20)
+		}
+	}
+	return nil
+}
+
+var diskStates = struct {
+	sync.Mutex
+	m map[string]string
+}{m: map[string]string{}}
+
+func (s *Server) checkDiskSpace() {
+	for _, v := range s.diskVolumes() {
+		if v.Error != "" { continue }
+		diskStates.Lock()
+		prev := diskStates.m[v.Name]
+		diskStates.m[v.Name] = v.State
+		diskStates.Unlock()
+		if prev == v.State || (prev == "" && v.State == "ok") { continue }
+		meta := map[string]any{"node": nodeID, "volume": v.Name, "path": v.Path, "free_bytes": v.FreeBytes, "free_percent": v.FreePercent}
+		msg := fmt.Sprintf("%s volume on node %s: %d MB free (%.1f%%)", strings.ToUpper(v.Name[:1])+v.Name[1:], nodeID, v.FreeBytes>>20, v.FreePercent)
+		switch v.State {
+		case "critical":
+			s.notify("error", "disk_critical", msg+", below the upload floor", meta)
+		case "low":
+			s.notify("warning", "disk_low", msg, meta)
+		default:
+			s.notify("info", "disk_recovered", msg, meta)
+		}
+	}
+}
+
+func (s *Server) startDiskMonitor(ctx context.Context) {
+	go func() {
+		t := time.NewTicker(5 * time.Minute)
+		defer t.Stop()
+		for {
+			s.checkDiskSpace()
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+func (s *Server) diskRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/storage/disk", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		writeJSON(w, 200, map[string]any{"node": nodeID, "floor_bytes": diskFloorBytes(), "warn_percent": diskWarnPercent(), "volumes": s.diskVolumes()})
+	})
+}
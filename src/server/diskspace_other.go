@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "errors"
+
+// diskUsage is not implemented here; volumes show as unknown.
+func diskUsage(p string) (free, total uint64, err error) {
+	return 0, 0, errors.New("free space is not measured on this platform")
+}
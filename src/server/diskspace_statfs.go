@@ -0,0 +1,13 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import "syscall"
+
+// diskUsage returns the bytes available to this process and the size of the
+// volume holding p.
+func diskUsage(p string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil { return 0, 0, err }
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Blocks) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ---- Download tokens ----
+// Short-lived HMAC tokens bound to the requesting client IP (and MAC or
+// deployment when known). The boot-script renderer appends them to asset URLs
+// as ?dt=; asset and image handlers validate them according to
+// BOOTAH_DOWNLOAD_TOKENS: off (default), optional (validate when present) or
+// required (reject anonymous downloads without one).
+type downloadClaims struct {
+	MAC          string `json:"mac,omitempty"`
+	DeploymentID string `json:"dep,omitempty"`
+	IP           string `json:"ip"`
+	Exp          int64  `json:"exp"`
+}
+
+func downloadTokenMode() string { return strings.ToLower(getenv("BOOTAH_DOWNLOAD_TOKENS", "off")) }
+
+func (s *Server) issueDownloadToken(c downloadClaims) string {
+	if c.Exp == 0 {
+		ttl, err := time.ParseDuration(getenv("BOOTAH_DOWNLOAD_TOKEN_TTL", "2h"))
+		if err != nil { ttl = 2 * time.Hour }
+		c.Exp = time.Now().Add(ttl).Unix()
+	}
+	js, _ := json.Marshal(c)
+	payload := base64.RawURLEncoding.EncodeToString(js)
+	return payload + "." + s.downloadTokenMAC(payload)
+}
+
+func (s *Server) downloadTokenMAC(payload string) string {
+	m := hmac.New(sha256.New, s.encryptionKey())
+	m.Write([]byte("dl:" + payload))
+	return hex.EncodeToString(m.Sum(nil))[:40]
+}
+
+func (s *Server) parseDownloadToken(tok string) (*downloadClaims, error) {
+	payload, sig, ok := strings.Cut(tok, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.downloadTokenMAC(payload))) { return nil, errors.New("bad signature") }
+	js, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil { return nil, err }
+	var c downloadClaims
+	if err := json.Unmarshal(js, &c); err != nil { return nil, err }
+	if time.Now().Unix() > c.Exp { return nil, errors.New("expired") }
+	return &c, nil
+}
+
+// downloadTokenIP returns the address a token this server just issued is
+// bound to, without checking it.
+func downloadTokenIP(tok string) string {
+	payload, _, _ := strings.Cut(tok, ".")
+	js, _ := base64.RawURLEncoding.DecodeString(payload)
+	var c downloadClaims
+	_ = json.Unmarshal(js, &c)
+	return c.IP
+}
+
+// checkDownloadToken enforces the download-token policy for an asset or image
+// request, writing a 403 and returning false when it fails. Authenticated
+// API users are exempt from the requirement, and so are CDN pulls signed
+// for a client address, which the edge binds as a token would be.
+func (s *Server) checkDownloadToken(w http.ResponseWriter, r *http.Request) bool {
+	mode := downloadTokenMode()
+	if mode == "off" { return true }
+	signedIP, signed := cdnSignedIP(r)
+	tok := r.URL.Query().Get("dt")
+	if tok == "" {
+		if mode != "required" || signed && signedIP != "" { return true }
+		if s.relaySync(r) { return true }
+		if _, _, err := s.verifyAuth(r); err == nil { return true }
+		http.Error(w, "download token required", 403); return false
+	}
+	c, err := s.parseDownloadToken(tok)
+	if err != nil { http.Error(w, "invalid download token: "+err.Error(), 403); return false }
+	if c.IP != "" {
+		// a pull through the CDN comes from the edge, which checked signedIP
+		got := signedIP
+		if !signed || got == "" {
+			if ip := clientIP(r); ip != nil { got = ip.String() }
+		}
+		if got != c.IP {
+			s.audit(nil, "download_token_rejected", "download", map[string]any{"path": r.URL.Path, "ip": got, "bound_ip": c.IP, "mac": c.MAC})
+			http.Error(w, "download token not valid for this host", 403); return false
+		}
+	}
+	return true
+}
+
+func (s *Server) downloadTokenRoutes() {
+	// Agent: token for image downloads bound to its machine/deployment
+	s.Mux.HandleFunc("/api/v1/agent/download_token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		if !s.requireAgent(w, r) { return }
+		var body struct {
+			MAC          string `json:"mac"`
+			DeploymentID string `json:"deployment_id"`
+		}
+		if !decodeJSON(w, r, &body) { return }
+		if tokDep, ok := s.deploymentForAgentToken(r.Header.Get("X-Bootah-Agent-Token")); ok { body.DeploymentID = tokDep }
+		ip := clientIP(r)
+		if ip == nil { http.Error(w, "cannot determine client address", 400); return }
+		c := downloadClaims{MAC: normalizeMAC(body.MAC), DeploymentID: body.DeploymentID, IP: ip.String()}
+		tok := s.issueDownloadToken(c)
+		writeJSON(w, 201, map[string]any{"token": tok, "param": "dt"})
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"math/big"
+)
+
+// ---- Secret encryption ----
+// Secrets stored in the DB (deployment credentials etc.) are sealed with
+// AES-256-GCM. The key is derived from BOOTAH_ENCRYPTION_KEY, falling back to
+// the JWT secret so a dev install works without extra configuration.
+func (s *Server) encryptionKey() []byte {
+	k := sha256.Sum256([]byte(getenv("BOOTAH_ENCRYPTION_KEY", s.JWTSecret)))
+	return k[:]
+}
+
+func (s *Server) seal(plain string) (string, error) {
+	block, err := aes.NewCipher(s.encryptionKey())
+	if err != nil { return "", err }
+	gcm, err := cipher.NewGCM(block)
+	if err != nil { return "", err }
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := crand.Read(nonce); err != nil { return "", err }
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(plain), nil)), nil
+}
+
+func (s *Server) unseal(sealed string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil { return "", err }
+	block, err := aes.NewCipher(s.encryptionKey())
+	if err != nil { return "", err }
+	gcm, err := cipher.NewGCM(block)
+	if err != nil { return "", err }
+	if len(raw) < gcm.NonceSize() { return "", errors.New("sealed value too short") }
+	plain, err := gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], nil)
+	if err != nil { return "", err }
+	return string(plain), nil
+}
+
+// randToken returns n random bytes, URL-safe base64 encoded.
+func randToken(n int) string {
+	b := make([]byte, n)
+	_, _ = crand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashToken is used for bearer secrets that only ever need to be compared.
+func hashToken(tok string) string {
+	h := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(h[:])
+}
+
+// genStrongPassword returns a password satisfying Windows complexity rules
+// (upper, lower, digit and symbol) using crypto/rand.
+func genStrongPassword(n int) string {
+	classes := []string{"ABCDEFGHJKLMNPQRSTUVWXYZ", "abcdefghijkmnopqrstuvwxyz", "23456789", "!@#%+=?"}
+	all := classes[0] + classes[1] + classes[2] + classes[3]
+	pick := func(set string) byte { i, _ := crand.Int(crand.Reader, big.NewInt(int64(len(set)))); return set[i.Int64()] }
+	b := make([]byte, n)
+	for i := range b {
+		if i < len(classes) { b[i] = pick(classes[i]) } else { b[i] = pick(all) }
+	}
+	for i := len(b) - 1; i > 0; i-- {
+		j, _ := crand.Int(crand.Reader, big.NewInt(int64(i+1)))
+		b[i], b[j.Int64()] = b[j.Int64()], b[i]
+	}
+	return string(b)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+)
+
+// ---- Enrollment secrets ----
+// A MAC address alone is easy to spoof, so a machine can be given an
+// enrollment secret that the agent must present (X-Bootah-Enrollment-Secret)
+// before the server hands out anything machine-specific: the rendered answer
+// file with its credentials and device certificates. The secret reaches the
+// agent out of band - an iPXE variable baked into the machine's embedded
+// script, or the SMBIOS asset tag, in which case the admin sets the secret to
+// the tag value instead of generating one. Only a hash is stored. Machines
+// without a secret pass unless BOOTAH_ENROLLMENT_REQUIRED=1.
+// requireEnrollment checks the enrollment secret presented for mac and
+// writes 403 when it is missing or wrong.
+func (s *Server) requireEnrollment(w http.ResponseWriter, r *http.Request, mac string) bool {
+	var want string
+	_ = s.DB.QueryRow(`SELECT COALESCE(enroll_secret_hash,'') FROM machines WHERE mac=?`, mac).Scan(&want)
+	got := r.Header.Get("X-Bootah-Enrollment-Secret")
+	if want == "" {
+		if getenv("BOOTAH_ENROLLMENT_REQUIRED", "") != "1" { return true }
+		http.Error(w, "machine has no enrollment secret", 403); return false
+	}
+	if got != "" && subtle.ConstantTimeCompare([]byte(hashToken(got)), []byte(want)) == 1 { return true }
+	ip := clientIP(r)
+	s.audit(nil, "enrollment_rejected", "machine", map[string]any{"mac": mac, "path": r.URL.Path, "ip": ip.String(), "presented": got != ""})
+	s.notify("warning", "enrollment_rejected", "Request for "+mac+" from "+ip.String()+" failed the enrollment secret check", map[string]any{"mac": mac, "path": r.URL.Path})
+	http.Error(w, "enrollment secret required", 403)
+	return false
+}
+
+// hasEnrollmentSecret reports whether mac has an enrollment secret set.
+func (s *Server) hasEnrollmentSecret(mac string) bool {
+	var n int
+	_ = s.DB.QueryRow(`SELECT COUNT(*) FROM machines WHERE mac=? AND enroll_secret_hash IS NOT NULL`, mac).Scan(&n)
+	return n > 0
+}
+
+func (s *Server) enrollmentRoutes() {
+	// GET lists machines with a secret; POST {"mac": "...", "secret": ""} sets
+	// one (generated when empty, returned once); DELETE {"mac": "..."} clears it
+	s.Mux.HandleFunc("/api/v1/admin/machines/enrollment", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := s.DB.Query(`SELECT mac, COALESCE(enroll_secret_set_at,'') FROM machines WHERE enroll_secret_hash IS NOT NULL ORDER BY mac`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			out := []map[string]any{}
+			for rows.Next() {
+				var mac, set string
+				if err := rows.Scan(&mac, &set); err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, map[string]any{"mac": mac, "set_at": set})
+			}
+			writeJSON(w, 200, map[string]any{"required": getenv("BOOTAH_ENROLLMENT_REQUIRED", "") == "1", "machines": out})
+		case http.MethodPost:
+			var body struct {
+				MAC    string `json:"mac"`
+				Secret string `json:"secret"`
+			}
+			if !decodeJSON(w, r, &body) { return }
+			mac := normalizeMAC(body.MAC)
+			if mac == "" { http.Error(w, "mac required", 400); return }
+			source := "provided"
+			if body.Secret == "" { body.Secret, source = randToken(24), "generated" }
+			if len(body.Secret) < 8 { http.Error(w, "secret must be at least 8 characters", 400); return }
+			now := time.Now().UTC().Format(time.RFC3339)
+			_, err := s.DB.Exec(`INSERT INTO machines (mac, first_seen, enroll_secret_hash, enroll_secret_set_at) VALUES (?,?,?,?)
+				ON CONFLICT(mac) DO UPDATE SET enroll_secret_hash=excluded.enroll_secret_hash, enroll_secret_set_at=excluded.enroll_secret_set_at`,
+				mac, now, hashToken(body.Secret), now)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "set_enrollment_secret", "machine", map[string]any{"mac": mac, "source": source})
+			out := map[string]any{"mac": mac, "set_at": now}
+			if source == "generated" { out["secret"] = body.Secret }
+			writeJSON(w, 200, out)
+		case http.MethodDelete:
+			var body struct{ MAC string `json:"mac"` }
+			if !decodeJSON(w, r, &body) { return }
+			mac := normalizeMAC(body.MAC)
+			res, err := s.DB.Exec(`UPDATE machines SET enroll_secret_hash=NULL, enroll_secret_set_at=NULL WHERE mac=? AND enroll_secret_hash IS NOT NULL`, mac)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			if n, _ := res.RowsAffected(); n == 0 { http.NotFound(w, r); return }
+			s.audit(s.actorID(r), "clear_enrollment_secret", "machine", map[string]any{"mac": mac})
+			writeJSON(w, 200, map[string]any{"mac": mac, "cleared": true})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---- Exam profiles ----
+// An exam profile (boot profile kind "exam") boots one image version, pinned
+// by version number and SHA-256, with no menu and no prompt: ISO and IMG
+// images are sanbooted, WIM images are booted with wimboot
+// (/assets/wimboot). Before every boot the pinned version must still exist,
+// be published, carry the pinned hash (and, when it is the active version,
+// not have failed verification) and be inside its availability windows;
+// otherwise the machine is shown why and rebooted after a minute, and a
+// warning notification is raised. Boot hooks, boot policies and menu
+// settings do not apply to machines on an exam profile. Every boot is
+// written to exam_boots with the machine's MAC, UUID, serial, hostname and
+// IP and audited as boot_profile.exam_boot; GET /api/v1/exam_boots lists
+// them (?profile=, ?mac=, ?since=RFC3339).
+var examImageTypes = map[string]bool{"iso": true, "img": true, "wim": true}
+
+func initExamProfiles(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS exam_boots (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		profile_id TEXT NOT NULL,
+		mac TEXT NOT NULL,
+		uuid TEXT,
+		serial TEXT,
+		hostname TEXT,
+		ip TEXT,
+		image_id TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		result TEXT NOT NULL,
+		detail TEXT,
+		at TEXT NOT NULL
+	)`)
+	if err != nil { return err }
+	_, _ = db.Exec(`CREATE INDEX IF NOT EXISTS exam_boots_at ON exam_boots (at)`)
+	return nil
+}
+
+func validateExamProfile(p BootProfile) error {
+	var v validator
+	if p.Template != "" { v.add("template", "exam profiles have no template") }
+	v.required("image_id", p.ImageID)
+	if p.ImageVersion <= 0 { v.add("image_version", "required") }
+	if v.required("image_sha256", p.ImageSHA256) { v.sha256("image_sha256", p.ImageSHA256) }
+	return v.err()
+}
+
+// checkExamProfile checks the pin against the stored version.
+func (s *Server) checkExamProfile(p *BootProfile) error {
+	p.ImageSHA256 = strings.ToLower(p.ImageSHA256)
+	_, err := s.examImage(p)
+	return err
+}
+
+// examImage resolves the pinned version of an exam profile and returns its
+// stored file and type, or why it must not be booted.
+func (s *Server) examImage(p *BootProfile) (struct{ Name, File, Type string }, error) {
+	var out struct{ Name, File, Type string }
+	var sum, status, verify string
+	var active int
+	err := s.DB.QueryRow(`SELECT i.name, v.file, v.type, COALESCE(v.sha256,''), v.status, COALESCE(i.version,1), COALESCE(i.verify_status,'')
+		FROM image_versions v JOIN images i ON i.id=v.image_id WHERE v.image_id=? AND v.version=?`, p.ImageID, p.ImageVersion).
+		Scan(&out.Name, &out.File, &out.Type, &sum, &status, &active, &verify)
+	if errors.Is(err, sql.ErrNoRows) { return out, fmt.Errorf("image %s has no version %d", p.ImageID, p.ImageVersion) }
+	if err != nil { return out, err }
+	switch {
+	case !examImageTypes[out.Type]:
+		return out, fmt.Errorf("exam profiles boot iso, img or wim images, not %s", out.Type)
+	case status != "published":
+		return out, fmt.Errorf("version %d of image %s is not published", p.ImageVersion, p.ImageID)
+	case sum == "":
+		return out, fmt.Errorf("version %d of image %s has no recorded SHA-256", p.ImageVersion, p.ImageID)
+	case sum != p.ImageSHA256:
+		return out, fmt.Errorf("version %d of image %s has SHA-256 %s, profile pins %s", p.ImageVersion, p.ImageID, sum, p.ImageSHA256)
+	case active == p.ImageVersion && (verify == "drift" || verify == "missing"):
+		return out, fmt.Errorf("stored file of image %s failed verification (%s)", p.ImageID, verify)
+	}
+	return out, nil
+}
+
+// renderExamProfile returns the auto-boot script for an exam profile and
+// records the boot.
+func (s *Server) renderExamProfile(r *http.Request, p *BootProfile, dlToken string) string {
+	q := r.URL.Query()
+	mac := normalizeMAC(q.Get("mac"))
+	var ip, hostname string
+	if c := clientIP(r); c != nil { ip = c.String() }
+	_ = s.DB.QueryRow(`SELECT COALESCE(hostname,'') FROM machines WHERE mac=?`, mac).Scan(&hostname)
+	im, err := s.examImage(p)
+	if err == nil {
+		if ok, _ := s.imageAvailable(p.ImageID, time.Now()); !ok { err = fmt.Errorf("image %s is outside its availability windows", p.ImageID) }
+	}
+	result, detail := "booted", ""
+	if err != nil { result, detail = "refused", err.Error() }
+	_, dbErr := s.DB.Exec(`INSERT INTO exam_boots (profile_id, mac, uuid, serial, hostname, ip, image_id, version, sha256, result, detail, at) VALUES (?,?,NULLIF(?,''),NULLIF(?,''),NULLIF(?,''),?,?,?,?,?,NULLIF(?,''),?)`,
+		p.ID, mac, normalizeUUID(q.Get("uuid")), normalizeSerial(q.Get("serial")), hostname, ip, p.ImageID, p.ImageVersion, p.ImageSHA256, result, detail, time.Now().UTC().Format(time.RFC3339))
+	if dbErr != nil { log.Printf("exam boot %s: %v", mac, dbErr) }
+	s.audit(nil, "exam_boot", "boot_profile", map[string]any{"id": p.ID, "mac": mac, "image_id": p.ImageID, "version": p.ImageVersion, "result": result, "ip": ip})
+	clean := strings.NewReplacer("$", "", "\n", " ").Replace
+	var b strings.Builder
+	fmt.Fprintf(&b, "#!ipxe\necho Exam mode: %s\n", clean(p.Name))
+	if err != nil {
+		s.notify("warning", "exam_integrity", fmt.Sprintf("Exam profile %s refused to boot %s: %v", p.Name, mac, err), map[string]any{"profile_id": p.ID, "mac": mac, "error": err.Error()})
+		fmt.Fprintf(&b, "echo Boot refused: %s\necho Ask the exam supervisor.\nsleep 60\nreboot\n", clean(err.Error()))
+		return b.String()
+	}
+	u := strings.TrimRight(getenv("BOOTAH_PUBLIC_URL", "http://${next-server}"), "/") + "/api/v1/images/" + p.ImageID + "/download?version=" + strconv.Itoa(p.ImageVersion)
+	if dlToken != "" { u += "&dt=" + dlToken }
+	fmt.Fprintf(&b, "echo %s version %d (sha256 %s)\n", clean(im.Name), p.ImageVersion, p.ImageSHA256[:12])
+	if im.Type == "wim" {
+		fmt.Fprintf(&b, "kernel %s\ninitrd -n boot.wim %s\nboot\n", bootAssetURL(nil, dlToken, nil)("/assets/wimboot"), u)
+	} else {
+		fmt.Fprintf(&b, "sanboot --no-describe %s\n", u)
+	}
+	b.WriteString("echo Boot failed.\nsleep 60\nreboot\n")
+	return b.String()
+}
+
+func (s *Server) examProfileRoutes() {
+	s.Mux.HandleFunc("/api/v1/exam_boots", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		q := r.URL.Query()
+		where, args := ` WHERE 1=1`, []any{}
+		if v := q.Get("profile"); v != "" { where, args = where+` AND profile_id=?`, append(args, v) }
+		if v := normalizeMAC(q.Get("mac")); v != "" { where, args = where+` AND mac=?`, append(args, v) }
+		if v := q.Get("since"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil { http.Error(w, "since must be RFC3339", 400); return }
+			where, args = where+` AND at>=?`, append(args, t.UTC().Format(time.RFC3339))
+		}
+		rows, err := s.DB.Query(`SELECT id, profile_id, mac, COALESCE(uuid,''), COALESCE(serial,''), COALESCE(hostname,''), COALESCE(ip,''), image_id, version, sha256, result, COALESCE(detail,''), at
+			FROM exam_boots`+where+` ORDER BY id DESC LIMIT 1000`, args...)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		defer rows.Close()
+		out := []map[string]any{}
+		for rows.Next() {
+			var id int64
+			var version int
+			var profile, mac, uuid, serial, hostname, ip, image, sum, result, detail, at string
+			if err := rows.Scan(&id, &profile, &mac, &uuid, &serial, &hostname, &ip, &image, &version, &sum, &result, &detail, &at); err != nil { http.Error(w, err.Error(), 500); return }
+			out = append(out, map[string]any{"id": id, "profile_id": profile, "mac": mac, "uuid": uuid, "serial": serial, "hostname": hostname, "ip": ip,
+				"image_id": image, "version": version, "sha256": sum, "result": result, "detail": detail, "at": at})
+		}
+		writeJSON(w, 200, out)
+	})
+}
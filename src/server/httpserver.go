@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ---- HTTP server limits ----
+// Every connection is bounded by BOOTAH_HTTP_READ_HEADER_TIMEOUT (default
+// 30s), BOOTAH_HTTP_READ_TIMEOUT (5m, whole request including its body),
+// BOOTAH_HTTP_WRITE_TIMEOUT (5m, from the end of the request headers to the
+// end of the response), BOOTAH_HTTP_IDLE_TIMEOUT (2m between keep-alive
+// requests) and BOOTAH_HTTP_MAX_HEADER_BYTES (64 KiB); a timeout of "0"
+// turns it off. Handlers that move large files lift the limits for their own
+// request: downloads get BOOTAH_HTTP_TRANSFER_TIMEOUT (default 12h) to send
+// the body (longTransfer), event and log streams have no write deadline
+// (streamResponse), and upload bodies run under the idle and total deadlines
+// of uploadtimeouts.go.
+func newHTTPServer(addr string, h http.Handler) *http.Server {
+	maxHeader, err := strconv.Atoi(getenv("BOOTAH_HTTP_MAX_HEADER_BYTES", ""))
+	if err != nil || maxHeader <= 0 { maxHeader = 64 << 10 }
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: envTimeout("BOOTAH_HTTP_READ_HEADER_TIMEOUT", 30*time.Second),
+		ReadTimeout:       envTimeout("BOOTAH_HTTP_READ_TIMEOUT", 5*time.Minute),
+		WriteTimeout:      envTimeout("BOOTAH_HTTP_WRITE_TIMEOUT", 5*time.Minute),
+		IdleTimeout:       envTimeout("BOOTAH_HTTP_IDLE_TIMEOUT", 2*time.Minute),
+		MaxHeaderBytes:    maxHeader,
+	}
+}
+
+// envTimeout is envDuration that also accepts "0" to disable the timeout.
+func envTimeout(key string, def time.Duration) time.Duration {
+	if getenv(key, "") == "0" { return 0 }
+	return envDuration(key, def)
+}
+
+// longTransfer gives a download handler BOOTAH_HTTP_TRANSFER_TIMEOUT to
+// write its response instead of the server-wide write timeout.
+func longTransfer(w http.ResponseWriter) {
+	var deadline time.Time
+	if d := envTimeout("BOOTAH_HTTP_TRANSFER_TIMEOUT", 12*time.Hour); d > 0 { deadline = time.Now().Add(d) }
+	_ = http.NewResponseController(w).SetWriteDeadline(deadline)
+}
+
+// streamResponse removes the write deadline of a long-lived stream; the
+// handler ends it when the client goes away or the stream is done.
+func streamResponse(w http.ResponseWriter) {
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
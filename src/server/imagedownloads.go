@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---- Image download history ----
+// Every image download is recorded with the client address, the machine and
+// deployment from its download token or ?mac=, and the API principal when
+// authenticated, so that when a bad image version turns up the machines that
+// pulled it can be found. Resumed ranged requests and CDN origin pulls are
+// not counted; replicas serve from a read-only database and record nothing.
+// History older than BOOTAH_DOWNLOAD_HISTORY_DAYS (default 365) is pruned by
+// the leader once a day.
+//
+// Privacy: with BOOTAH_DOWNLOAD_ANONYMIZE_DAYS=N the same daily job replaces
+// the fields in BOOTAH_DOWNLOAD_ANONYMIZE_FIELDS (default ip,principal; mac
+// may be added) of entries older than N days by a keyed hash ("anon-..."),
+// so the same address still counts once but can't be traced back without the
+// encryption key. BOOTAH_DOWNLOAD_EXPORT controls what leaves the server:
+// full (default), anonymized (those fields are hashed in every response,
+// however fresh the entry) or off (the raw history is not served and the
+// consumers report shows no addresses). Every read of the raw history,
+// including its CSV export (?format=csv), is audited. GET
+// /api/v1/admin/image_downloads/policy shows the settings in effect.
+func initImageDownloads(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS image_downloads (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		image_id TEXT NOT NULL,
+		ip TEXT,
+		mac TEXT,
+		deployment_id TEXT,
+		principal TEXT,
+		created TEXT NOT NULL
+	)`)
+	if err != nil { return err }
+	_, _ = db.Exec(`CREATE INDEX IF NOT EXISTS image_downloads_image ON image_downloads (image_id, created)`)
+	_, _ = db.Exec(`CREATE INDEX IF NOT EXISTS image_downloads_mac ON image_downloads (mac)`)
+	return nil
+}
+
+// recordImageDownload notes a download of image id that passed the token check.
+func (s *Server) recordImageDownload(r *http.Request, id string) {
+	if replicaMode() || r.Method != http.MethodGet || cdnSigned(r) { return }
+	if rg := r.Header.Get("Range"); rg != "" && !strings.HasPrefix(rg, "bytes=0-") { return }
+	var ip, mac, dep string
+	if c := clientIP(r); c != nil { ip = c.String() }
+	mac = normalizeMAC(r.URL.Query().Get("mac"))
+	if tok := r.URL.Query().Get("dt"); tok != "" {
+		if c, err := s.parseDownloadToken(tok); err == nil {
+			if c.MAC != "" { mac = c.MAC }
+			dep = c.DeploymentID
+		}
+	}
+	principal, _ := s.requestPrincipal(r)
+	_, err := s.DB.Exec(`INSERT INTO image_downloads (image_id, ip, mac, deployment_id, principal, created) VALUES (?,NULLIF(?,''),NULLIF(?,''),NULLIF(?,''),NULLIF(?,''),?)`,
+		id, ip, mac, dep, principal, time.Now().UTC().Format(time.RFC3339))
+	if err != nil { log.Printf("record image download %s: %v", id, err) }
+}
+
+// downloadPrivacy is the privacy configuration of the download history.
+type downloadPrivacy struct {
+	RetentionDays   int      `json:"retention_days"`
+	AnonymizeAfter  int      `json:"anonymize_after_days"`
+	AnonymizeFields []string `json:"anonymize_fields"`
+	Export          string   `json:"export"`
+}
+
+func downloadPrivacyConfig() downloadPrivacy {
+	p := downloadPrivacy{Export: "full"}
+	p.RetentionDays, _ = strconv.Atoi(getenv("BOOTAH_DOWNLOAD_HISTORY_DAYS", "365"))
+	p.AnonymizeAfter, _ = strconv.Atoi(getenv("BOOTAH_DOWNLOAD_ANONYMIZE_DAYS", "0"))
+	if p.RetentionDays < 0 { p.RetentionDays = 0 }
+	if p.AnonymizeAfter < 0 { p.AnonymizeAfter = 0 }
+	for _, f := range splitList(getenv("BOOTAH_DOWNLOAD_ANONYMIZE_FIELDS", "ip,principal")) {
+		if f == "ip" || f == "mac" || f == "principal" { p.AnonymizeFields = append(p.AnonymizeFields, f) }
+	}
+	if e := getenv("BOOTAH_DOWNLOAD_EXPORT", "full"); e == "anonymized" || e == "off" { p.Export = e }
+	return p
+}
+
+func (p downloadPrivacy) hashes(field string) bool {
+	for _, f := range p.AnonymizeFields {
+		if f == field { return true }
+	}
+	return false
+}
+
+// pseudonymize replaces a personal value by a stable keyed hash; values that
+// already are pseudonyms pass through.
+func (s *Server) pseudonymize(v string) string {
+	if v == "" || strings.HasPrefix(v, "anon-") { return v }
+	mac := hmac.New(sha256.New, s.encryptionKey())
+	mac.Write([]byte("image-downloads:" + v))
+	return "anon-" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// anonymizeDownloads hashes the configured fields of entries older than the
+// anonymization age, in batches.
+func (s *Server) anonymizeDownloads(p downloadPrivacy) error {
+	if p.AnonymizeAfter <= 0 || len(p.AnonymizeFields) == 0 { return nil }
+	cutoff := time.Now().UTC().AddDate(0, 0, -p.AnonymizeAfter).Format(time.RFC3339)
+	for {
+		rows, err := s.DB.Query(`SELECT id, COALESCE(ip,''), COALESCE(mac,''), COALESCE(principal,'') FROM image_downloads WHERE created < ? AND anonymized_at IS NULL ORDER BY id LIMIT 500`, cutoff)
+		if err != nil { return err }
+		type entry struct {
+			id                 int64
+			ip, mac, principal string
+		}
+		var batch []entry
+		for rows.Next() {
+			var e entry
+			if err := rows.Scan(&e.id, &e.ip, &e.mac, &e.principal); err != nil { rows.Close(); return err }
+			batch = append(batch, e)
+		}
+		rows.Close()
+		if len(batch) == 0 { return nil }
+		tx, err := s.DB.Begin()
+		if err != nil { return err }
+		now := time.Now().UTC().Format(time.RFC3339)
+		for _, e := range batch {
+			if p.hashes("ip") { e.ip = s.pseudonymize(e.ip) }
+			if p.hashes("mac") { e.mac = s.pseudonymize(e.mac) }
+			if p.hashes("principal") { e.principal = s.pseudonymize(e.principal) }
+			if _, err := tx.Exec(`UPDATE image_downloads SET ip=NULLIF(?,''), mac=NULLIF(?,''), principal=NULLIF(?,''), anonymized_at=? WHERE id=?`, e.ip, e.mac, e.principal, now, e.id); err != nil { tx.Rollback(); return err }
+		}
+		if err := tx.Commit(); err != nil { return err }
+		if len(batch) < 500 { return nil }
+	}
+}
+
+func (s *Server) startImageDownloads(ctx context.Context) {
+	go s.runAsLeader(ctx, "download-history", 24*time.Hour, func() {
+		if _, err := s.applyDownloadRetention(downloadPrivacyConfig(), false); err != nil { log.Printf("download history retention: %v", err) }
+	})
+}
+
+// applyDownloadRetention deletes history past the retention period and
+// anonymizes entries past the anonymization age. With dryRun it only counts
+// them.
+func (s *Server) applyDownloadRetention(p downloadPrivacy, dryRun bool) (map[string]any, error) {
+	out := map[string]any{"retention_days": p.RetentionDays, "anonymize_after_days": p.AnonymizeAfter, "anonymize_fields": p.AnonymizeFields, "delete": 0, "anonymize": 0}
+	if p.RetentionDays > 0 {
+		cutoff := time.Now().UTC().AddDate(0, 0, -p.RetentionDays).Format(time.RFC3339)
+		var n int64
+		var oldest string
+		if err := s.DB.QueryRow(`SELECT COUNT(*), COALESCE(MIN(created),'') FROM image_downloads WHERE created < ?`, cutoff).Scan(&n, &oldest); err != nil { return nil, err }
+		out["delete"], out["delete_before"] = n, cutoff
+		if oldest != "" { out["oldest"] = oldest }
+		if !dryRun && n > 0 {
+			res, err := s.DB.Exec(`DELETE FROM image_downloads WHERE created < ?`, cutoff)
+			if err != nil { return nil, err }
+			out["delete"], _ = res.RowsAffected()
+		}
+	}
+	if p.AnonymizeAfter > 0 && len(p.AnonymizeFields) > 0 {
+		cutoff := time.Now().UTC().AddDate(0, 0, -p.AnonymizeAfter).Format(time.RFC3339)
+		var n int64
+		if err := s.DB.QueryRow(`SELECT COUNT(*) FROM image_downloads WHERE created < ? AND anonymized_at IS NULL`, cutoff).Scan(&n); err != nil { return nil, err }
+		out["anonymize"] = n
+		if !dryRun && n > 0 {
+			if err := s.anonymizeDownloads(p); err != nil { return nil, err }
+		}
+	}
+	return out, nil
+}
+
+type imageConsumer struct {
+	ImageID     string   `json:"image_id"`
+	MAC         string   `json:"mac,omitempty"`
+	IP          string   `json:"ip,omitempty"`
+	Hostname    string   `json:"hostname,omitempty"`
+	Downloads   int      `json:"downloads"`
+	Deployments []string `json:"deployments,omitempty"`
+	First       string   `json:"first"`
+	Last        string   `json:"last"`
+}
+
+// handleImageConsumers reports who downloaded an image: one row per machine
+// (or per address for downloads without one), most recent first.
+// ?lineage=1 covers every earlier version in the image's changelog too, and
+// ?since=RFC3339 limits the window.
+func (s *Server) handleImageConsumers(w http.ResponseWriter, r *http.Request, id string) {
+	if !s.requireRole(w, r, "operator") { return }
+	if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+	ids := []string{id}
+	if r.URL.Query().Get("lineage") == "1" {
+		list, err := s.imageChangelog(id)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		for _, e := range list { ids = append(ids, e.PreviousID) }
+	}
+	since := r.URL.Query().Get("since")
+	if since != "" {
+		if _, err := time.Parse(time.RFC3339, since); err != nil { http.Error(w, "since must be RFC3339", 400); return }
+	}
+	args := []any{since}
+	for _, i := range ids { args = append(args, i) }
+	rows, err := s.DB.Query(`SELECT d.image_id, COALESCE(d.mac,''), COALESCE(MAX(d.ip),''),
+		COALESCE(MAX(m.hostname),''), COUNT(*), COALESCE(GROUP_CONCAT(DISTINCT d.deployment_id),''), MIN(d.created), MAX(d.created)
+		FROM image_downloads d LEFT JOIN machines m ON m.mac=d.mac
+		WHERE d.created >= ? AND d.image_id IN (?`+strings.Repeat(",?", len(ids)-1)+`)
+		GROUP BY d.image_id, COALESCE(d.mac, 'ip:'||COALESCE(d.ip,'')) ORDER BY MAX(d.created) DESC`, args...)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	defer rows.Close()
+	out := []imageConsumer{}
+	total := 0
+	privacy := downloadPrivacyConfig()
+	for rows.Next() {
+		var c imageConsumer
+		var deps string
+		if err := rows.Scan(&c.ImageID, &c.MAC, &c.IP, &c.Hostname, &c.Downloads, &deps, &c.First, &c.Last); err != nil { http.Error(w, err.Error(), 500); return }
+		if deps != "" { c.Deployments = strings.Split(deps, ",") }
+		switch privacy.Export {
+		case "off":
+			c.IP = ""
+		case "anonymized":
+			if privacy.hashes("ip") { c.IP = s.pseudonymize(c.IP) }
+			if privacy.hashes("mac") { c.MAC, c.Hostname = s.pseudonymize(c.MAC), "" }
+		}
+		total += c.Downloads
+		out = append(out, c)
+	}
+	writeJSON(w, 200, map[string]any{"image_id": id, "versions": ids, "downloads": total, "consumers": out})
+}
+
+func (s *Server) imageDownloadRoutes() {
+	// Raw history, newest first (?image_id=&mac=&ip=&since=&limit=, ?format=csv)
+	s.Mux.HandleFunc("/api/v1/admin/image_downloads", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		privacy := downloadPrivacyConfig()
+		if privacy.Export == "off" { http.Error(w, "download history export is disabled (BOOTAH_DOWNLOAD_EXPORT=off)", 403); return }
+		csvOut := r.URL.Query().Get("format") == "csv"
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if csvOut {
+			if err != nil || limit <= 0 || limit > 100000 { limit = 100000 }
+		} else if err != nil || limit <= 0 || limit > 1000 {
+			limit = 100
+		}
+		q := `SELECT id, image_id, COALESCE(ip,''), COALESCE(mac,''), COALESCE(deployment_id,''), COALESCE(principal,''), created FROM image_downloads WHERE 1=1`
+		var args []any
+		for _, f := range []struct{ param, col string }{{"image_id", "image_id"}, {"mac", "mac"}, {"ip", "ip"}} {
+			v := r.URL.Query().Get(f.param)
+			if f.param == "mac" { v = normalizeMAC(v) }
+			if v != "" { q += ` AND ` + f.col + `=?`; args = append(args, v) }
+		}
+		if v := r.URL.Query().Get("since"); v != "" {
+			if _, err := time.Parse(time.RFC3339, v); err != nil { http.Error(w, "since must be RFC3339", 400); return }
+			q += ` AND created >= ?`; args = append(args, v)
+		}
+		rows, err := s.DB.Query(q+` ORDER BY id DESC LIMIT ?`, append(args, limit)...)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		defer rows.Close()
+		out := []map[string]any{}
+		var records [][]string
+		for rows.Next() {
+			var id int64
+			var image, ip, mac, dep, principal, created string
+			if err := rows.Scan(&id, &image, &ip, &mac, &dep, &principal, &created); err != nil { http.Error(w, err.Error(), 500); return }
+			if privacy.Export == "anonymized" {
+				if privacy.hashes("ip") { ip = s.pseudonymize(ip) }
+				if privacy.hashes("mac") { mac = s.pseudonymize(mac) }
+				if privacy.hashes("principal") { principal = s.pseudonymize(principal) }
+			}
+			if csvOut {
+				records = append(records, []string{strconv.FormatInt(id, 10), image, ip, mac, dep, principal, created})
+				continue
+			}
+			out = append(out, map[string]any{"id": id, "image_id": image, "ip": ip, "mac": mac, "deployment_id": dep, "principal": principal, "created": created})
+		}
+		format := "json"
+		if csvOut { format = "csv" }
+		s.audit(s.actorID(r), "export", "image_download", map[string]any{"format": format, "filters": r.URL.Query().Encode(), "rows": len(out) + len(records), "mode": privacy.Export})
+		if !csvOut { writeJSON(w, 200, out); return }
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="bootah-image-downloads.csv"`)
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"id", "image_id", "ip", "mac", "deployment_id", "principal", "created"})
+		_ = cw.WriteAll(records)
+	})
+
+	s.Mux.HandleFunc("/api/v1/admin/image_downloads/policy", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		p := downloadPrivacyConfig()
+		var pending int
+		if p.AnonymizeAfter > 0 {
+			_ = s.DB.QueryRow(`SELECT COUNT(*) FROM image_downloads WHERE created < ? AND anonymized_at IS NULL`, time.Now().UTC().AddDate(0, 0, -p.AnonymizeAfter).Format(time.RFC3339)).Scan(&pending)
+		}
+		writeJSON(w, 200, map[string]any{"policy": p, "awaiting_anonymization": pending})
+	})
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// ---- Image inspection ----
+// Every stored version of a wim/esd, iso or ffu image is inspected by an
+// "image-inspect" job that reads only the headers it needs: the WIM XML
+// metadata (image count and, per image, edition, OS version, architecture and
+// languages), the ISO 9660 volume descriptors (labels, size, UDF and El Torito
+// BIOS/UEFI boot entries) or the FFU security and image headers with their
+// manifest. Results land in image_metadata per version; GET
+// /api/v1/images/{id} shows those of the active version and POST
+// /api/v1/images/{id}/inspect runs the inspection again.
+type ImageMetadata struct {
+	Version     int            `json:"version"`
+	Format      string         `json:"format"`
+	InspectedAt string         `json:"inspected_at"`
+	Error       string         `json:"error,omitempty"`
+	ImageCount  int            `json:"image_count,omitempty"`
+	Editions    []WIMEdition   `json:"editions,omitempty"`
+	OSVersion   string         `json:"os_version,omitempty"`
+	Arch        string         `json:"arch,omitempty"`
+	VolumeLabel string         `json:"volume_label,omitempty"`
+	Boot        []string       `json:"boot,omitempty"` // bios|uefi
+	Details     map[string]any `json:"details,omitempty"`
+}
+
+type WIMEdition struct {
+	Index            int      `json:"index"`
+	Name             string   `json:"name"`
+	Description      string   `json:"description,omitempty"`
+	EditionID        string   `json:"edition_id,omitempty"`
+	ProductName      string   `json:"product_name,omitempty"`
+	InstallationType string   `json:"installation_type,omitempty"`
+	OSVersion        string   `json:"os_version,omitempty"`
+	Arch             string   `json:"arch,omitempty"`
+	Languages        []string `json:"languages,omitempty"`
+	SizeBytes        int64    `json:"size_bytes,omitempty"`
+}
+
+// inspectFormats maps image types to the parser that reads them.
+var inspectFormats = map[string]func(io.ReaderAt, int64) (*ImageMetadata, error){
+	"wim": inspectWIM, "esd": inspectWIM, "swm": inspectWIM,
+	"iso": inspectISO,
+	"ffu": inspectFFU,
+}
+
+func initImageMetadata(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS image_metadata (
+		image_id TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		format TEXT NOT NULL,
+		data TEXT NOT NULL,
+		inspected_at TEXT NOT NULL,
+		PRIMARY KEY (image_id, version)
+	)`)
+	return err
+}
+
+// ---- WIM ----
+
+var wimArches = map[int]string{0: "x86", 5: "arm", 6: "ia64", 9: "amd64", 12: "arm64"}
+
+type wimXML struct {
+	Images []struct {
+		Index       int    `xml:"INDEX,attr"`
+		Name        string `xml:"NAME"`
+		Description string `xml:"DESCRIPTION"`
+		DisplayName string `xml:"DISPLAYNAME"`
+		Flags       string `xml:"FLAGS"`
+		TotalBytes  int64  `xml:"TOTALBYTES"`
+		Windows     struct {
+			Arch             *int     `xml:"ARCH"`
+			ProductName      string   `xml:"PRODUCTNAME"`
+			EditionID        string   `xml:"EDITIONID"`
+			InstallationType string   `xml:"INSTALLATIONTYPE"`
+			Languages        []string `xml:"LANGUAGES>LANGUAGE"`
+			Version          *struct {
+				Major   int `xml:"MAJOR"`
+				Minor   int `xml:"MINOR"`
+				Build   int `xml:"BUILD"`
+				SPBuild int `xml:"SPBUILD"`
+			} `xml:"VERSION"`
+		} `xml:"WINDOWS"`
+	} `xml:"IMAGE"`
+}
+
+// inspectWIM reads the header and XML metadata resource of a WIM (or ESD/SWM).
+func inspectWIM(r io.ReaderAt, size int64) (*ImageMetadata, error) {
+	hdr := make([]byte, 208)
+	if _, err := r.ReadAt(hdr, 0); err != nil { return nil, fmt.Errorf("wim header: %w", err) }
+	if string(hdr[:8]) != "MSWIM\x00\x00\x00" { return nil, errors.New("not a WIM file (bad signature)") }
+	le := binary.LittleEndian
+	count := int(le.Uint32(hdr[44:48]))
+	xmlSize := int64(le.Uint64(hdr[72:80]) & (1<<56 - 1))
+	xmlOff := int64(le.Uint64(hdr[80:88]))
+	if xmlSize <= 0 || xmlSize > 32<<20 || xmlOff <= 0 || xmlOff+xmlSize > size { return nil, errors.New("wim: no readable XML metadata") }
+	raw := make([]byte, xmlSize)
+	if _, err := r.ReadAt(raw, xmlOff); err != nil { return nil, fmt.Errorf("wim xml: %w", err) }
+	var doc wimXML
+	if err := xml.Unmarshal([]byte(utf16LE(raw)), &doc); err != nil { return nil, fmt.Errorf("wim xml: %w", err) }
+	md := &ImageMetadata{Format: "wim", ImageCount: count, Details: map[string]any{
+		"wim_version": le.Uint32(hdr[12:16]), "part": le.Uint16(hdr[40:42]), "total_parts": le.Uint16(hdr[42:44]), "boot_index": le.Uint32(hdr[120:124])}}
+	for _, im := range doc.Images {
+		e := WIMEdition{Index: im.Index, Name: im.Name, Description: im.Description, EditionID: im.Windows.EditionID, ProductName: im.Windows.ProductName,
+			InstallationType: im.Windows.InstallationType, Languages: im.Windows.Languages, SizeBytes: im.TotalBytes}
+		if e.Name == "" { e.Name = im.DisplayName }
+		if e.EditionID == "" { e.EditionID = im.Flags }
+		if v := im.Windows.Version; v != nil { e.OSVersion = fmt.Sprintf("%d.%d.%d.%d", v.Major, v.Minor, v.Build, v.SPBuild) }
+		if a := im.Windows.Arch; a != nil {
+			if e.Arch = wimArches[*a]; e.Arch == "" { e.Arch = fmt.Sprintf("unknown(%d)", *a) }
+		}
+		md.Editions = append(md.Editions, e)
+	}
+	if len(md.Editions) > 0 { md.OSVersion, md.Arch = md.Editions[0].OSVersion, md.Editions[0].Arch }
+	return md, nil
+}
+
+// utf16LE decodes the UTF-16LE (optionally BOM-prefixed) text WIM XML uses.
+func utf16LE(b []byte) string {
+	if len(b) >= 2 && b[0] == 0xff && b[1] == 0xfe { b = b[2:] }
+	u := make([]uint16, len(b)/2)
+	for i := range u { u[i] = binary.LittleEndian.Uint16(b[2*i:]) }
+	return string(utf16.Decode(u))
+}
+
+// ---- ISO 9660 ----
+
+// inspectISO walks the volume descriptor set starting at sector 16.
+func inspectISO(r io.ReaderAt, size int64) (*ImageMetadata, error) {
+	const sector = 2048
+	md := &ImageMetadata{Format: "iso", Details: map[string]any{}}
+	found := false
+	for n := int64(16); n < 64 && (n+1)*sector <= size; n++ {
+		d := make([]byte, sector)
+		if _, err := r.ReadAt(d, n*sector); err != nil { return nil, fmt.Errorf("iso descriptor: %w", err) }
+		id := string(d[1:6])
+		switch id {
+		case "BEA01", "NSR02", "NSR03", "TEA01":
+			if id == "NSR02" || id == "NSR03" { md.Details["udf"] = true }
+			continue
+		case "CD001":
+		default:
+			if !found { return nil, errors.New("not an ISO 9660 image (no volume descriptors)") }
+			continue
+		}
+		found = true
+		switch d[0] {
+		case 0:
+			if strings.HasPrefix(string(d[7:39]), "EL TORITO SPECIFICATION") {
+				md.Boot = isoBootPlatforms(r, int64(binary.LittleEndian.Uint32(d[71:75]))*sector)
+			}
+		case 1:
+			md.VolumeLabel = isoString(d[40:72])
+			md.Details["system_id"] = isoString(d[8:40])
+			md.Details["volume_set_id"] = isoString(d[190:318])
+			md.Details["publisher"] = isoString(d[318:446])
+			md.Details["application_id"] = isoString(d[574:702])
+			md.Details["volume_size_bytes"] = int64(binary.LittleEndian.Uint32(d[80:84])) * int64(binary.LittleEndian.Uint16(d[128:130]))
+			if t := isoTime(d[813:830]); t != "" { md.Details["created"] = t }
+		case 255:
+			n = 64
+		}
+	}
+	if !found { return nil, errors.New("not an ISO 9660 image (no volume descriptors)") }
+	for k, v := range md.Details {
+		if v == "" { delete(md.Details, k) }
+	}
+	return md, nil
+}
+
+// isoBootPlatforms reads the El Torito boot catalog: platform 0 is BIOS,
+// 0xEF UEFI.
+func isoBootPlatforms(r io.ReaderAt, off int64) []string {
+	cat := make([]byte, 2048)
+	if _, err := r.ReadAt(cat, off); err != nil || cat[0] != 1 { return nil }
+	seen := map[string]bool{}
+	var out []string
+	add := func(p byte) {
+		name := map[byte]string{0: "bios", 0xef: "uefi"}[p]
+		if name != "" && !seen[name] { seen[name] = true; out = append(out, name) }
+	}
+	add(cat[1])
+	for e := 64; e+32 <= len(cat); e += 32 {
+		if cat[e] == 0x90 || cat[e] == 0x91 { add(cat[e+1]) } else if cat[e] == 0 && cat[e+1] == 0 { break }
+	}
+	return out
+}
+
+// isoString trims the space (or NUL) padding of a descriptor field.
+func isoString(b []byte) string { return strings.TrimRight(string(b), " \x00") }
+
+func isoTime(b []byte) string {
+	s := string(b[:14])
+	t, err := time.Parse("20060102150405", s)
+	if err != nil || t.Year() < 1970 { return "" }
+	return t.Add(-time.Duration(int8(b[16])) * 15 * time.Minute).UTC().Format(time.RFC3339)
+}
+
+// ---- FFU ----
+
+// inspectFFU reads the security header, skips the catalog and hash table to
+// the image header and parses its manifest.
+func inspectFFU(r io.ReaderAt, size int64) (*ImageMetadata, error) {
+	le := binary.LittleEndian
+	sec := make([]byte, 32)
+	if _, err := r.ReadAt(sec, 0); err != nil { return nil, fmt.Errorf("ffu header: %w", err) }
+	if string(sec[4:16]) != "SignedImage " { return nil, errors.New("not an FFU file (bad signature)") }
+	chunk := int64(le.Uint32(sec[16:20])) * 1024
+	if chunk <= 0 { return nil, errors.New("ffu: invalid chunk size") }
+	off := int64(le.Uint32(sec[0:4])) + int64(le.Uint32(sec[24:28])) + int64(le.Uint32(sec[28:32]))
+	off = (off + chunk - 1) / chunk * chunk
+	img := make([]byte, 24)
+	if off+24 > size { return nil, errors.New("ffu: truncated before image header") }
+	if _, err := r.ReadAt(img, off); err != nil { return nil, fmt.Errorf("ffu image header: %w", err) }
+	if string(img[4:16]) != "ImageFlash  " { return nil, errors.New("ffu: image header not found") }
+	mlen := int64(le.Uint32(img[16:20]))
+	if mlen <= 0 || mlen > 1<<20 { return nil, errors.New("ffu: invalid manifest length") }
+	manifest := make([]byte, mlen)
+	if _, err := r.ReadAt(manifest, off+int64(le.Uint32(img[0:4]))); err != nil { return nil, fmt.Errorf("ffu manifest: %w", err) }
+	md := &ImageMetadata{Format: "ffu", Details: map[string]any{"chunk_size_kb": chunk / 1024, "hash_algorithm": le.Uint32(sec[20:24])}}
+	manifestDetails := map[string]any{}
+	section := ""
+	sc := bufio.NewScanner(bytes.NewReader(bytes.TrimRight(manifest, "\x00")))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") { section = strings.Trim(line, "[]"); continue }
+		k, v, ok := strings.Cut(line, "=")
+		if !ok || section == "" { continue }
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if _, dup := manifestDetails[section+"."+k]; !dup { manifestDetails[section+"."+k] = v }
+		if section == "FullFlash" && k == "OSVersion" { md.OSVersion = v }
+	}
+	md.Details["manifest"] = manifestDetails
+	return md, nil
+}
+
+// ---- job & API ----
+
+type inspectJob struct {
+	ImageID string `json:"image_id"`
+	Version int    `json:"version"`
+}
+
+func init() {
+	registerJobHandler("image-inspect", func(s *Server, ctx context.Context, payload json.RawMessage) (string, error) {
+		var j inspectJob
+		if err := json.Unmarshal(payload, &j); err != nil { return "", err }
+		md, err := s.inspectImage(ctx, j.ImageID, j.Version)
+		if err != nil { return "", err }
+		if md.Error != "" { return "", errors.New(md.Error) }
+		return fmt.Sprintf("%s, %d edition(s)", md.Format, len(md.Editions)), nil
+	})
+}
+
+// queueImageInspection enqueues inspection of a version when its type is
+// one we can read.
+func (s *Server) queueImageInspection(imageID string, version int, typ string) string {
+	if _, ok := inspectFormats[typ]; !ok { return "" }
+	id, err := s.enqueueJob("image-inspect", inspectJob{ImageID: imageID, Version: version})
+	if err != nil { log.Printf("image %s inspect: %v", imageID, err) }
+	return id
+}
+
+// inspectImage parses one version of an image and stores the result; a file
+// that does not parse is recorded with its error.
+func (s *Server) inspectImage(ctx context.Context, imageID string, version int) (*ImageMetadata, error) {
+	var key, typ string
+	err := s.DB.QueryRow(`SELECT file, type FROM image_versions WHERE image_id=? AND version=?`, imageID, version).Scan(&key, &typ)
+	if err != nil { return nil, err }
+	parse, ok := inspectFormats[typ]
+	if !ok { return nil, fmt.Errorf("inspection not supported for %s images", typ) }
+	ra, size, done, err := s.openReaderAt(ctx, key)
+	if err != nil { return nil, err }
+	md, perr := parse(ra, size)
+	done()
+	if perr != nil { md = &ImageMetadata{Format: typ, Error: perr.Error()} }
+	md.Version = version
+	md.InspectedAt = time.Now().UTC().Format(time.RFC3339)
+	js, _ := json.Marshal(md)
+	_, err = s.DB.Exec(`INSERT INTO image_metadata (image_id, version, format, data, inspected_at) VALUES (?,?,?,?,?)
+		ON CONFLICT(image_id, version) DO UPDATE SET format=excluded.format, data=excluded.data, inspected_at=excluded.inspected_at`,
+		imageID, version, md.Format, string(js), md.InspectedAt)
+	return md, err
+}
+
+// openReaderAt gives random access to a stored object: the file itself for
+// local storage, a seekable remote reader, or else a staged temporary copy.
+func (s *Server) openReaderAt(ctx context.Context, key string) (io.ReaderAt, int64, func(), error) {
+	if p, ok := s.Store.LocalPath(key); ok {
+		f, err := os.Open(p)
+		if err != nil { return nil, 0, nil, err }
+		st, err := f.Stat()
+		if err != nil { f.Close(); return nil, 0, nil, err }
+		return f, st.Size(), func() { f.Close() }, nil
+	}
+	rc, err := s.Store.Open(ctx, key)
+	if err != nil { return nil, 0, nil, err }
+	if rs, ok := rc.(interface{ io.ReaderAt; io.Seeker }); ok {
+		if size, err := rs.Seek(0, io.SeekEnd); err == nil { return rs, size, func() { rc.Close() }, nil }
+	}
+	rc.Close()
+	dir, err := os.MkdirTemp("", "bootah-inspect-")
+	if err != nil { return nil, 0, nil, err }
+	p, err := s.stageObject(ctx, key, dir)
+	if err != nil { os.RemoveAll(dir); return nil, 0, nil, err }
+	f, err := os.Open(p)
+	if err != nil { os.RemoveAll(dir); return nil, 0, nil, err }
+	st, _ := f.Stat()
+	return f, st.Size(), func() { f.Close(); os.RemoveAll(dir) }, nil
+}
+
+// imageMetadata returns the stored inspection of a version, or nil.
+func (s *Server) imageMetadata(imageID string, version int) (*ImageMetadata, error) {
+	var data string
+	err := s.DB.QueryRow(`SELECT data FROM image_metadata WHERE image_id=? AND version=?`, imageID, version).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) { return nil, nil }
+	if err != nil { return nil, err }
+	var md ImageMetadata
+	if err := json.Unmarshal([]byte(data), &md); err != nil { return nil, err }
+	return &md, nil
+}
+
+// handleImageInspect queues a new inspection of the active version (POST).
+func (s *Server) handleImageInspect(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+	if !s.requireRole(w, r, "operator") { return }
+	var version int
+	var typ string
+	if err := s.DB.QueryRow(`SELECT COALESCE(version,1), type FROM images WHERE id=?`, id).Scan(&version, &typ); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+		http.Error(w, err.Error(), 500); return
+	}
+	if _, ok := inspectFormats[typ]; !ok { http.Error(w, "inspection not supported for "+typ+" images", 400); return }
+	jobID, err := s.enqueueJob("image-inspect", inspectJob{ImageID: id, Version: version})
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	s.audit(s.actorID(r), "inspect_start", "image", map[string]any{"id": id, "version": version, "job": jobID})
+	writeJSON(w, 202, map[string]any{"job": jobID, "status": "queued"})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ---- Image publishing ----
+// A stored image version is either a draft or published. Uploads, promoted
+// builds and conversions store their version as a draft: a new version of an
+// existing image is kept but not activated, and a brand-new image cannot be
+// chosen for deployments, rollouts or kiosk links until it is published.
+// POST /api/v1/images/{id}/versions/{n}/publish (admin) publishes version n
+// and makes it the active one; the publish is audited, enters the catalog
+// feed, is emitted to plugins as image.published and posted to the
+// notification webhook. Versions stored before publishing existed count as
+// published. BOOTAH_IMAGE_AUTO_PUBLISH=true publishes every new version as
+// soon as it is stored.
+func autoPublishImages() bool { return getenv("BOOTAH_IMAGE_AUTO_PUBLISH", "false") == "true" }
+
+// newVersionStatus is the status a freshly stored version starts in.
+func newVersionStatus() string {
+	if autoPublishImages() { return "published" }
+	return "draft"
+}
+
+// imagePublishedSQL is true for an images row whose active version is
+// published; imageDraftsSQL counts its draft versions.
+const (
+	imagePublishedSQL = `COALESCE((SELECT v.status FROM image_versions v WHERE v.image_id=images.id AND v.version=COALESCE(images.version,1)),'published')='published'`
+	imageDraftsSQL    = `(SELECT COUNT(*) FROM image_versions v WHERE v.image_id=images.id AND v.status='draft')`
+)
+
+// imageBootable reports why image id cannot be deployed, or nil if it can.
+func (s *Server) imageBootable(id string) error {
+	var published bool
+	err := s.DB.QueryRow(`SELECT `+imagePublishedSQL+` FROM images WHERE id=?`, id).Scan(&published)
+	if errors.Is(err, sql.ErrNoRows) { return fmt.Errorf("unknown image %s", id) }
+	if err != nil { return err }
+	if !published { return fmt.Errorf("image %s is a draft; publish a version first", id) }
+	return nil
+}
+
+// imageStored announces a version that was just stored: a draft is emitted
+// as image.uploaded only, a published one enters the catalog feed (event)
+// and is emitted as image.published.
+func (s *Server) imageStored(id string, version int, event, name, typ string, data map[string]any) {
+	var status string
+	_ = s.DB.QueryRow(`SELECT status FROM image_versions WHERE image_id=? AND version=?`, id, version).Scan(&status)
+	data["image_id"], data["name"], data["type"], data["version"], data["status"] = id, name, typ, version, status
+	if status == "draft" {
+		s.emit("image.uploaded", data)
+		return
+	}
+	s.recordCatalogChange(id, event, name, typ)
+	s.emit("image.published", data)
+}
+
+// publishImageVersion publishes version of image id and activates it. It
+// returns the version that was active before.
+func (s *Server) publishImageVersion(id string, version int, actor string) (int, error) {
+	tx, err := s.DB.Begin()
+	if err != nil { return 0, err }
+	defer tx.Rollback()
+	var active int
+	if err := tx.QueryRow(`SELECT COALESCE(version,1) FROM images WHERE id=?`, id).Scan(&active); err != nil { return 0, err }
+	var status string
+	err = tx.QueryRow(`SELECT status FROM image_versions WHERE image_id=? AND version=?`, id, version).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) { return 0, fmt.Errorf("image %s has no version %d", id, version) }
+	if err != nil { return 0, err }
+	if status != "draft" { return 0, fmt.Errorf("version %d of image %s is already published", version, id) }
+	if _, err := tx.Exec(`UPDATE image_versions SET status='published', published_at=?, published_by=NULLIF(?,'') WHERE image_id=? AND version=?`,
+		time.Now().UTC().Format(time.RFC3339), actor, id, version); err != nil {
+		return 0, err
+	}
+	if version != active {
+		if err := activateImageVersion(tx, id, version); err != nil { return 0, err }
+	}
+	return active, tx.Commit()
+}
+
+// handlePublishImageVersion serves POST /api/v1/images/{id}/versions/{n}/publish.
+func (s *Server) handlePublishImageVersion(w http.ResponseWriter, r *http.Request, id, name, typ string, version int) {
+	if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+	if !s.requireRole(w, r, "admin") { return }
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength > 0 && !decodeJSON(w, r, &body) { return }
+	var actor string
+	if _, c, err := s.verifyAuth(r); err == nil { actor, _ = c["email"].(string) }
+	var earlier int
+	var derived bool
+	_ = s.DB.QueryRow(`SELECT (SELECT COUNT(*) FROM image_versions WHERE image_id=? AND status='published'), derived_from IS NOT NULL FROM images WHERE id=?`, id, id).Scan(&earlier, &derived)
+	prev, err := s.publishImageVersion(id, version, actor)
+	if err != nil { http.Error(w, err.Error(), 409); return }
+	_ = s.DB.QueryRow(`SELECT type FROM images WHERE id=?`, id).Scan(&typ)
+	event := "updated"
+	if earlier == 0 && derived { event = "derived" } else if earlier == 0 { event = "added" }
+	s.imageStored(id, version, event, name, typ, map[string]any{"previous_version": prev, "published_by": actor})
+	s.notify("info", "image_published", fmt.Sprintf("Version %d of image %s was published", version, name),
+		map[string]any{"image_id": id, "version": version, "previous_version": prev, "published_by": actor})
+	s.audit(s.actorID(r), "publish", "image", map[string]any{"id": id, "version": version, "from": prev, "reason": body.Reason})
+	writeJSON(w, 200, map[string]any{"id": id, "version": version, "previous_version": prev, "status": "published"})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ---- Image tags & listing ----
+// Images carry free-form tags (same syntax as machine tags) set with the
+// "tags" upload field, PUT /api/v1/images/{id}/tags or in bulk through
+// /api/v1/image_tags. GET /api/v1/images filters with ?type= and ?tag= (both
+// repeatable or comma-separated; every tag must match), ?q= (substring of
+// name or id, sha256 prefix, or tag) and ?published=true|false (whether the
+// active version is published), sorts with ?sort=updated|name|size (prefix
+// "-" for descending) and pages with ?limit=&offset=. The total
+// number of matches is returned in X-Total-Count.
+func initImageTags(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS image_tags (
+		image_id TEXT NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY (image_id, tag)
+	)`)
+	if err != nil { return err }
+	_, _ = db.Exec(`CREATE INDEX IF NOT EXISTS image_tags_tag ON image_tags (tag)`)
+	return nil
+}
+
+var imageSorts = map[string]string{"updated": "updated", "name": "LOWER(name)", "size": "size_mb", "type": "type"}
+
+// imageListFilter turns the list query parameters into a WHERE clause,
+// ORDER BY and LIMIT/OFFSET.
+func imageListFilter(r *http.Request) (where string, args []any, order string, limit, offset int, err error) {
+	q := r.URL.Query()
+	where = ` WHERE 1=1`
+	if types := splitList(strings.Join(q["type"], ",")); len(types) > 0 {
+		where += ` AND type IN (` + strings.TrimSuffix(strings.Repeat("?,", len(types)), ",") + `)`
+		for _, t := range types { args = append(args, strings.ToLower(t)) }
+	}
+	tags, err := normalizeTags(splitList(strings.Join(q["tag"], ",")))
+	if err != nil { return }
+	for _, t := range tags {
+		where += ` AND id IN (SELECT image_id FROM image_tags WHERE tag=?)`
+		args = append(args, t)
+	}
+	if s := strings.ToLower(strings.TrimSpace(q.Get("q"))); s != "" {
+		like := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s) + "%"
+		where += ` AND (LOWER(name) LIKE ? ESCAPE '\' OR id LIKE ? ESCAPE '\' OR LOWER(COALESCE(sha256,'')) LIKE ? ESCAPE '\'
+			OR id IN (SELECT image_id FROM image_tags WHERE tag LIKE ? ESCAPE '\'))`
+		args = append(args, like, like, strings.TrimPrefix(like, "%"), like)
+	}
+	switch q.Get("published") {
+	case "":
+	case "true":
+		where += ` AND ` + imagePublishedSQL
+	case "false":
+		where += ` AND NOT ` + imagePublishedSQL
+	default:
+		err = errors.New("published must be true or false"); return
+	}
+	sortKey := q.Get("sort")
+	desc := strings.HasPrefix(sortKey, "-")
+	sortKey = strings.TrimPrefix(sortKey, "-")
+	if sortKey == "" { sortKey, desc = "updated", true }
+	col, ok := imageSorts[sortKey]
+	if !ok { err = errors.New("sort must be one of updated, name, size, type"); return }
+	order = ` ORDER BY ` + col
+	if desc { order += ` DESC` }
+	order += `, id`
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > 1000 { err = errors.New("limit must be 1-1000"); return }
+	}
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 { err = errors.New("offset must be a non-negative integer"); return }
+	}
+	return
+}
+
+// imageTagMap returns the tags of every image that has any.
+func (s *Server) imageTagMap() (map[string][]string, error) {
+	rows, err := s.DB.Query(`SELECT image_id, tag FROM image_tags ORDER BY tag`)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := map[string][]string{}
+	for rows.Next() {
+		var id, tag string
+		if err := rows.Scan(&id, &tag); err != nil { return nil, err }
+		out[id] = append(out[id], tag)
+	}
+	return out, rows.Err()
+}
+
+func (s *Server) imageTags(id string) ([]string, error) {
+	rows, err := s.DB.Query(`SELECT tag FROM image_tags WHERE image_id=? ORDER BY tag`, id)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := []string{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil { return nil, err }
+		out = append(out, tag)
+	}
+	return out, rows.Err()
+}
+
+// setImageTags replaces the tags of an image.
+func (s *Server) setImageTags(id string, tags []string) error {
+	tx, err := s.DB.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM image_tags WHERE image_id=?`, id); err != nil { return err }
+	for _, t := range tags {
+		if _, err := tx.Exec(`INSERT INTO image_tags (image_id, tag) VALUES (?,?)`, id, t); err != nil { return err }
+	}
+	return tx.Commit()
+}
+
+// handleImageTags serves GET/PUT /api/v1/images/{id}/tags.
+func (s *Server) handleImageTags(w http.ResponseWriter, r *http.Request, id string) {
+	var n int
+	if err := s.DB.QueryRow(`SELECT COUNT(*) FROM images WHERE id=?`, id).Scan(&n); err != nil { http.Error(w, err.Error(), 500); return }
+	if n == 0 { http.NotFound(w, r); return }
+	switch r.Method {
+	case http.MethodGet:
+		tags, err := s.imageTags(id)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		writeJSON(w, 200, map[string]any{"id": id, "tags": tags})
+	case http.MethodPut:
+		if !s.requireRole(w, r, "operator") { return }
+		var body struct{ Tags []string `json:"tags"` }
+		if !decodeJSON(w, r, &body) { return }
+		tags, err := normalizeTags(body.Tags)
+		if err != nil { http.Error(w, err.Error(), 400); return }
+		if err := s.setImageTags(id, tags); err != nil { http.Error(w, err.Error(), 500); return }
+		s.audit(s.actorID(r), "tag", "image", map[string]any{"images": []string{id}, "tags": tags})
+		writeJSON(w, 200, map[string]any{"id": id, "tags": tags})
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+func (s *Server) imageTagRoutes() {
+	// GET: every tag with its image count. POST {images, add, remove} tags
+	// images in bulk.
+	s.Mux.HandleFunc("/api/v1/image_tags", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := s.DB.Query(`SELECT tag, COUNT(*) FROM image_tags GROUP BY tag ORDER BY tag`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			out := []map[string]any{}
+			for rows.Next() {
+				var tag string; var n int
+				if err := rows.Scan(&tag, &n); err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, map[string]any{"tag": tag, "images": n})
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPost:
+			if !s.requireRole(w, r, "operator") { return }
+			var body struct {
+				Images []string `json:"images"`
+				Add    []string `json:"add"`
+				Remove []string `json:"remove"`
+			}
+			if !decodeJSON(w, r, &body) { return }
+			add, err := normalizeTags(body.Add)
+			if err != nil { http.Error(w, err.Error(), 400); return }
+			remove, err := normalizeTags(body.Remove)
+			if err != nil { http.Error(w, err.Error(), 400); return }
+			if len(body.Images) == 0 || len(add)+len(remove) == 0 { http.Error(w, "images and add or remove required", 400); return }
+			for _, id := range body.Images {
+				var n int
+				if err := s.DB.QueryRow(`SELECT COUNT(*) FROM images WHERE id=?`, id).Scan(&n); err != nil { http.Error(w, err.Error(), 500); return }
+				if n == 0 { http.Error(w, "unknown image "+id, 400); return }
+			}
+			tx, err := s.DB.Begin()
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer tx.Rollback()
+			for _, id := range body.Images {
+				for _, t := range add {
+					if _, err := tx.Exec(`INSERT OR IGNORE INTO image_tags (image_id, tag) VALUES (?,?)`, id, t); err != nil { http.Error(w, err.Error(), 500); return }
+				}
+				for _, t := range remove {
+					if _, err := tx.Exec(`DELETE FROM image_tags WHERE image_id=? AND tag=?`, id, t); err != nil { http.Error(w, err.Error(), 500); return }
+				}
+			}
+			if err := tx.Commit(); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "tag", "image", map[string]any{"images": body.Images, "add": add, "remove": remove})
+			writeJSON(w, 200, map[string]any{"images": len(body.Images), "added": add, "removed": remove})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---- Image versions ----
+// An image ID names a logical image. Uploading (or promoting a build) under
+// the name of an existing image, or with replaces=<id>, adds a numbered
+// version to that image instead of creating a new record. The images row
+// always describes the active version (file, type, size, sha256), so boot
+// profiles, deployments and download links that hold the ID follow whichever
+// version is active. A new version starts as a draft and becomes active when
+// it is published (imagepublish.go);
+// POST /api/v1/images/{id}/versions/{n}/promote activates any kept published
+// version and POST /api/v1/images/{id}/rollback returns to the newest
+// published version below the active one. Inactive versions can be deleted to
+// free storage.
+type ImageVersion struct {
+	Version     int    `json:"version"`
+	File        string `json:"file"`
+	Type        string `json:"type"`
+	SizeMB      int64  `json:"sizeMB"`
+	SHA256      string `json:"sha256,omitempty"`
+	Changelog   string `json:"changelog,omitempty"`
+	Ticket      string `json:"ticket,omitempty"`
+	Author      string `json:"author,omitempty"`
+	Created     string `json:"created"`
+	Active      bool   `json:"active"`
+	Status      string `json:"status"` // draft|published
+	PublishedAt string `json:"published_at,omitempty"`
+	PublishedBy string `json:"published_by,omitempty"`
+}
+
+func initImageVersions(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS image_versions (
+		image_id TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		file TEXT NOT NULL,
+		type TEXT NOT NULL,
+		size_mb INTEGER NOT NULL,
+		sha256 TEXT,
+		changelog TEXT,
+		ticket TEXT,
+		author TEXT,
+		created TEXT NOT NULL,
+		PRIMARY KEY (image_id, version)
+	)`)
+	return err
+}
+
+// recordFirstImageVersion makes the current contents of a new images row its
+// version 1.
+func (s *Server) recordFirstImageVersion(id, author string) error {
+	_, err := s.DB.Exec(`INSERT INTO image_versions (image_id, version, file, type, size_mb, sha256, author, created, status)
+		SELECT id, 1, file, type, size_mb, sha256, NULLIF(?,''), ?, ? FROM images WHERE id=?`, author, time.Now().UTC().Format(time.RFC3339), newVersionStatus(), id)
+	if err != nil { return err }
+	_, err = s.DB.Exec(`UPDATE images SET version=1 WHERE id=?`, id)
+	return err
+}
+
+// addImageVersion records v as the next version of image id. The version is
+// activated only when it starts out published.
+func (s *Server) addImageVersion(id string, v ImageVersion) (int, error) {
+	tx, err := s.DB.Begin()
+	if err != nil { return 0, err }
+	defer tx.Rollback()
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version),0)+1 FROM image_versions WHERE image_id=?`, id).Scan(&v.Version); err != nil { return 0, err }
+	v.Created = time.Now().UTC().Format(time.RFC3339)
+	v.Status = newVersionStatus()
+	if _, err := tx.Exec(`INSERT INTO image_versions (image_id, version, file, type, size_mb, sha256, changelog, ticket, author, created, status) VALUES (?,?,?,?,?,NULLIF(?,''),NULLIF(?,''),NULLIF(?,''),NULLIF(?,''),?,?)`,
+		id, v.Version, v.File, v.Type, v.SizeMB, v.SHA256, strings.TrimSpace(v.Changelog), v.Ticket, v.Author, v.Created, v.Status); err != nil {
+		return 0, err
+	}
+	if v.Status == "published" {
+		if err := activateImageVersion(tx, id, v.Version); err != nil { return 0, err }
+	}
+	if err := tx.Commit(); err != nil { return 0, err }
+	meta := map[string]any{"image_id": id, "version": v.Version, "changelog": v.Changelog, "status": v.Status}
+	if v.Ticket != "" { meta["ticket"] = v.Ticket }
+	s.notify("info", "image_version", fmt.Sprintf("Version %d of image %s: %s", v.Version, id, v.Changelog), meta)
+	return v.Version, nil
+}
+
+// activateImageVersion points the images row at a stored version.
+func activateImageVersion(tx *sql.Tx, id string, version int) error {
+	var file, typ string
+	var size int64
+	var sum sql.NullString
+	err := tx.QueryRow(`SELECT file, type, size_mb, sha256 FROM image_versions WHERE image_id=? AND version=?`, id, version).Scan(&file, &typ, &size, &sum)
+	if err != nil { return err }
+	_, err = tx.Exec(`UPDATE images SET file=?, type=?, size_mb=?, sha256=?, version=?, updated=?, verified_at=NULL, verify_status=NULL WHERE id=?`,
+		file, typ, size, sum, version, time.Now().Format("2006-01-02"), id)
+	return err
+}
+
+func (s *Server) imageVersions(id string) ([]ImageVersion, error) {
+	var active int
+	if err := s.DB.QueryRow(`SELECT COALESCE(version,1) FROM images WHERE id=?`, id).Scan(&active); err != nil { return nil, err }
+	rows, err := s.DB.Query(`SELECT version, file, type, size_mb, COALESCE(sha256,''), COALESCE(changelog,''), COALESCE(ticket,''), COALESCE(author,''), created,
+		status, COALESCE(published_at,''), COALESCE(published_by,'')
+		FROM image_versions WHERE image_id=? ORDER BY version DESC`, id)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := []ImageVersion{}
+	for rows.Next() {
+		var v ImageVersion
+		if err := rows.Scan(&v.Version, &v.File, &v.Type, &v.SizeMB, &v.SHA256, &v.Changelog, &v.Ticket, &v.Author, &v.Created, &v.Status, &v.PublishedAt, &v.PublishedBy); err != nil { return nil, err }
+		v.Active = v.Version == active
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+// switchImageVersion activates published version of image id (0 means the
+// newest published version below the active one) and returns the version it
+// replaced.
+func (s *Server) switchImageVersion(id string, version int) (int, int, error) {
+	tx, err := s.DB.Begin()
+	if err != nil { return 0, 0, err }
+	defer tx.Rollback()
+	var active int
+	if err := tx.QueryRow(`SELECT COALESCE(version,1) FROM images WHERE id=?`, id).Scan(&active); err != nil { return 0, 0, err }
+	if version == 0 {
+		err := tx.QueryRow(`SELECT version FROM image_versions WHERE image_id=? AND version<? AND status='published' ORDER BY version DESC LIMIT 1`, id, active).Scan(&version)
+		if errors.Is(err, sql.ErrNoRows) { return 0, 0, fmt.Errorf("image %s has no published version before %d", id, active) }
+		if err != nil { return 0, 0, err }
+	}
+	if version == active { return version, active, nil }
+	var status string
+	if err := tx.QueryRow(`SELECT status FROM image_versions WHERE image_id=? AND version=?`, id, version).Scan(&status); err == nil && status != "published" {
+		return 0, 0, fmt.Errorf("version %d of image %s is a draft; publish it instead", version, id)
+	}
+	if err := activateImageVersion(tx, id, version); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { return 0, 0, fmt.Errorf("image %s has no version %d", id, version) }
+		return 0, 0, err
+	}
+	return version, active, tx.Commit()
+}
+
+// handleImageVersions serves /api/v1/images/{id}/versions[/{n}[/promote|/publish]]
+// and /api/v1/images/{id}/rollback (rest = ["rollback"]).
+func (s *Server) handleImageVersions(w http.ResponseWriter, r *http.Request, id string, rest []string) {
+	var name, typ string
+	if err := s.DB.QueryRow(`SELECT name, type FROM images WHERE id=?`, id).Scan(&name, &typ); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+		http.Error(w, err.Error(), 500); return
+	}
+	if len(rest) == 0 {
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		list, err := s.imageVersions(id)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		writeJSON(w, 200, list)
+		return
+	}
+	version := 0
+	action := "rollback"
+	if rest[0] != "rollback" {
+		n, err := strconv.Atoi(rest[0])
+		if err != nil || n <= 0 || len(rest) > 2 || (len(rest) == 2 && rest[1] != "promote" && rest[1] != "publish") { http.NotFound(w, r); return }
+		version, action = n, "promote"
+		if len(rest) == 2 && rest[1] == "publish" { s.handlePublishImageVersion(w, r, id, name, typ, n); return }
+		if len(rest) == 1 {
+			if r.Method != http.MethodDelete { http.Error(w, "method not allowed", 405); return }
+			s.deleteImageVersion(w, r, id, n)
+			return
+		}
+	}
+	if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+	if !s.requireRole(w, r, "operator") { return }
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil { http.Error(w, "invalid json", 400); return }
+	}
+	version, prev, err := s.switchImageVersion(id, version)
+	if err != nil { http.Error(w, err.Error(), 409); return }
+	if version != prev {
+		s.recordCatalogChange(id, "updated", name, typ)
+		s.emit("image.version_activated", map[string]any{"image_id": id, "version": version, "previous_version": prev, "action": action})
+		s.audit(s.actorID(r), action, "image", map[string]any{"id": id, "version": version, "from": prev, "reason": body.Reason})
+	}
+	writeJSON(w, 200, map[string]any{"id": id, "version": version, "previous_version": prev})
+}
+
+// deleteImageVersion removes an inactive version and its stored file.
+func (s *Server) deleteImageVersion(w http.ResponseWriter, r *http.Request, id string, version int) {
+	if !s.requireRole(w, r, "admin") { return }
+	var active int
+	var file string
+	err := s.DB.QueryRow(`SELECT COALESCE(i.version,1), v.file FROM images i JOIN image_versions v ON v.image_id=i.id WHERE i.id=? AND v.version=?`, id, version).Scan(&active, &file)
+	if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	if version == active { http.Error(w, "cannot delete the active version; promote another first", 409); return }
+	if _, err := s.DB.Exec(`DELETE FROM image_versions WHERE image_id=? AND version=?`, id, version); err != nil { http.Error(w, err.Error(), 500); return }
+	_, _ = s.DB.Exec(`DELETE FROM image_metadata WHERE image_id=? AND version=?`, id, version)
+	var shared int
+	_ = s.DB.QueryRow(`SELECT COUNT(*) FROM image_versions WHERE file=?`, file).Scan(&shared)
+	if shared == 0 { _ = s.Store.Delete(r.Context(), file) }
+	s.audit(s.actorID(r), "version_delete", "image", map[string]any{"id": id, "version": version})
+	writeJSON(w, 200, map[string]any{"deleted": version})
+}
+
+// deleteImageVersionFiles removes the stored files of every version of an
+// image other than skip (used on image delete).
+func (s *Server) deleteImageVersionFiles(r *http.Request, id, skip string) {
+	rows, err := s.DB.Query(`SELECT DISTINCT file FROM image_versions WHERE image_id=? AND file<>?`, id, skip)
+	if err != nil { return }
+	var files []string
+	for rows.Next() {
+		var f string
+		if rows.Scan(&f) == nil { files = append(files, f) }
+	}
+	rows.Close()
+	for _, f := range files { _ = s.Store.Delete(r.Context(), f) }
+	_, _ = s.DB.Exec(`DELETE FROM image_versions WHERE image_id=?`, id)
+	_, _ = s.DB.Exec(`DELETE FROM image_metadata WHERE image_id=?`, id)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ---- Impersonation ----
+// Admins can obtain a short-lived access token acting as another user to
+// reproduce permission problems. The token carries the admin's id in the
+// "imp" claim, cannot be refreshed or used to impersonate again, and every
+// state-changing request made with it is audited under the admin's id.
+const impersonationTTL = 15 * time.Minute
+
+func (s *Server) issueImpersonationToken(adminID, userID int64, email, role string) (string, error) {
+	now := time.Now()
+	t := jwt.NewWithClaims(jwt.SigningMethodHS256, jwtClaims{
+		Sub: userID, Email: email, Role: role, Impersonator: adminID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer(),
+			Audience:  jwt.ClaimStrings{jwtAudience()},
+			ExpiresAt: jwt.NewNumericDate(now.Add(impersonationTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        genID(),
+		},
+	})
+	return t.SignedString([]byte(s.JWTSecret))
+}
+
+// impersonationAudit records non-GET requests made with impersonation tokens.
+func (s *Server) impersonationAudit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions {
+			if _, c, err := s.verifyAuth(r); err == nil {
+				if imp, ok := c["impersonator"].(int64); ok {
+					s.audit(&imp, "impersonated_request", "auth", map[string]any{"as_user": c["sub"], "method": r.Method, "path": r.URL.Path})
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) impersonationRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/impersonate/", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireAdmin(w, r) { return }
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		_, claims, _ := s.verifyAuth(r)
+		if _, nested := claims["impersonator"]; nested { http.Error(w, "cannot impersonate from an impersonated session", 403); return }
+		adminID, _ := claims["sub"].(int64)
+		uid, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/v1/admin/impersonate/"), 10, 64)
+		if err != nil { http.Error(w, "invalid user id", 400); return }
+		if uid == adminID { http.Error(w, "cannot impersonate yourself", 400); return }
+		var email, role string
+		if err := s.DB.QueryRow(`SELECT email, role FROM users WHERE id=?`, uid).Scan(&email, &role); err != nil { http.NotFound(w, r); return }
+		if role == rolePending { http.Error(w, errAccountPending.Error(), 400); return }
+		tok, err := s.issueImpersonationToken(adminID, uid, email, role)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		s.audit(&adminID, "impersonate", "user", map[string]any{"id": uid, "email": email, "role": role, "ttl": impersonationTTL.String()})
+		s.notify("warning", "impersonation", claims["email"].(string)+" is impersonating "+email, map[string]any{"admin_id": adminID, "user_id": uid})
+		writeJSON(w, 201, map[string]any{"token": tok, "user_id": uid, "email": email, "role": role, "expires_at": time.Now().Add(impersonationTTL).UTC().Format(time.RFC3339)})
+	})
+}
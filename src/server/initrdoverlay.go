@@ -0,0 +1,415 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---- Initrd driver overlays ----
+// A driver pack can carry a Linux overlay: the boot assets under its
+// "overlay" prefix (e.g. overlays/r750/lib/modules/<release>/updates/x.ko,
+// overlays/r750/lib/firmware/...) are packed on the fly into a newc cpio
+// archive that the kernel unpacks over the distro initrd, so out-of-tree
+// drivers need no rebuilt vendor initrd. Machines whose model matches such a
+// pack get the overlay added to every initrd line of their boot script that
+// loads a recognised initrd (see kernel pairs), according to
+// BOOTAH_INITRD_OVERLAY:
+//
+//	concat (default) the line points at /ipxe/initrd/<asset>?packs=..., which
+//	                 streams the initrd followed by the overlays, so entries
+//	                 that name their initrd (initrd=initrd) keep working
+//	lines            an extra initrd line per overlay, for iPXE builds that
+//	                 pass several initrds to the kernel
+//	off              no overlays
+//
+// Either way the overlays come from the boot server, also for sites with a
+// mirror.
+// Overlays are also served alone at /ipxe/overlay/<pack>.cpio and, gzip
+// compressed, at /ipxe/overlay/<pack>.cpio.gz.
+//
+// Packs attached to an image (image_driver_packs) apply as well to machines
+// whose active deployment installs that image, whatever their model. The
+// files packed can be narrowed to an include list of globs relative to the
+// prefix ("lib/firmware/bnx2x/*", or a directory such as "lib/modules").
+// The "initrd-overlay" job prebuilds a pack's overlay into the gzip boot
+// asset <prefix>.cpio.gz; it is used while the selected files are the ones it
+// was built from, otherwise the overlay is packed on the fly again.
+func initrdOverlayMode() string {
+	switch m := strings.ToLower(getenv("BOOTAH_INITRD_OVERLAY", "concat")); m {
+	case "lines", "off":
+		return m
+	}
+	return "concat"
+}
+
+// overlayPacks returns the ids of the driver packs with an overlay that
+// match the machine's model or are attached to the image of its active
+// deployment, in id order so URLs are stable.
+func (s *Server) overlayPacks(mac string) []string {
+	if mac == "" { return nil }
+	vendor, model, err := s.machineModel(mac)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) { return nil }
+	var image string
+	_ = s.DB.QueryRow(`SELECT COALESCE(image_id,'') FROM deployments WHERE mac=? AND status IN ('pending','running') ORDER BY created_at DESC LIMIT 1`, mac).Scan(&image)
+	rows, err := s.DB.Query(`SELECT id, vendor, model, EXISTS (SELECT 1 FROM image_driver_packs m WHERE m.pack_id=driver_packs.id AND m.image_id=?)
+		FROM driver_packs WHERE COALESCE(overlay,'')<>'' ORDER BY id`, image)
+	if err != nil { log.Printf("initrd overlays: %v", err); return nil }
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var id, pv, pm string
+		var attached bool
+		if rows.Scan(&id, &pv, &pm, &attached) != nil { continue }
+		if attached || (model != "" && matchModel(pv, pm, vendor, model)) { out = append(out, id) }
+	}
+	return out
+}
+
+// overlayFiles lists the boot assets packed into a driver pack's overlay.
+func (s *Server) overlayFiles(packID string) (prefix string, files []*BootAsset, err error) {
+	var include string
+	if err = s.DB.QueryRow(`SELECT COALESCE(overlay,''), COALESCE(overlay_include,'') FROM driver_packs WHERE id=?`, packID).Scan(&prefix, &include); err != nil { return "", nil, err }
+	if prefix == "" { return "", nil, sql.ErrNoRows }
+	all, err := s.listBootAssets(prefix + "/")
+	if err != nil || include == "" { return prefix, all, err }
+	for _, f := range all {
+		if overlayIncluded(strings.TrimPrefix(f.Path, prefix+"/"), splitList(include)) { files = append(files, f) }
+	}
+	return prefix, files, nil
+}
+
+// overlayIncluded matches a path relative to the overlay prefix against the
+// include globs; a glob also selects everything below a matching directory.
+func overlayIncluded(rel string, include []string) bool {
+	for _, g := range include {
+		g = strings.Trim(g, "/")
+		for p := rel; p != "."; p = path.Dir(p) {
+			if ok, _ := path.Match(g, p); ok { return true }
+		}
+	}
+	return false
+}
+
+// overlaySource is what gets appended for one pack: the prebuilt overlay
+// when it is current, else the entries to pack on the fly.
+type overlaySource struct {
+	built   *BootAsset
+	entries []cpioEntry
+}
+
+func (s *Server) overlaySource(packID string) (*overlaySource, error) {
+	prefix, files, err := s.overlayFiles(packID)
+	if err != nil { return nil, err }
+	var asset, sig string
+	_ = s.DB.QueryRow(`SELECT COALESCE(overlay_asset,''), COALESCE(overlay_sig,'') FROM driver_packs WHERE id=?`, packID).Scan(&asset, &sig)
+	if asset != "" && sig == overlaySignature(files) {
+		if a, err := s.bootAsset(asset); err == nil { return &overlaySource{built: a}, nil }
+	}
+	return &overlaySource{entries: s.overlayEntries(prefix, files)}, nil
+}
+
+// overlaySignature identifies the set of files an overlay is packed from.
+func overlaySignature(files []*BootAsset) string {
+	h := sha256.New()
+	for _, f := range files { fmt.Fprintf(h, "%s %s\n", f.Path, f.SHA256) }
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (o *overlaySource) size() int64 {
+	if o.built != nil { return o.built.Size + cpioPad(o.built.Size) }
+	return cpioSize(o.entries)
+}
+
+// write streams the overlay, padded so the next archive starts aligned.
+func (s *Server) writeOverlay(ctx context.Context, w io.Writer, o *overlaySource) error {
+	if o.built == nil { return writeCpio(w, o.entries) }
+	rc, err := s.Store.Open(ctx, o.built.file)
+	if err != nil { return err }
+	defer rc.Close()
+	n, err := io.Copy(w, rc)
+	if err == nil && n != o.built.Size { err = errors.New("short read") }
+	if err == nil { _, err = w.Write(make([]byte, cpioPad(o.built.Size))) }
+	return err
+}
+
+type overlayBuildJob struct {
+	PackID string `json:"pack_id"`
+}
+
+// buildOverlay packs a driver pack's overlay into the boot asset
+// <prefix>.cpio.gz and records it on the pack.
+func (s *Server) buildOverlay(ctx context.Context, packID string) (*BootAsset, error) {
+	prefix, files, err := s.overlayFiles(packID)
+	if err != nil { return nil, err }
+	if len(files) == 0 { return nil, errors.New("overlay " + prefix + " has no files") }
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		zw.ModTime = time.Unix(0, 0)
+		err := writeCpio(zw, s.overlayEntries(prefix, files))
+		if err == nil { err = zw.Close() }
+		pw.CloseWithError(err)
+	}()
+	a, _, err := s.putBootAsset(ctx, prefix+".cpio.gz", pr, "", BootAsset{})
+	pr.Close()
+	if err != nil { return nil, err }
+	_, err = s.DB.Exec(`UPDATE driver_packs SET overlay_asset=?, overlay_built_at=?, overlay_sig=? WHERE id=?`, a.Path, time.Now().UTC().Format(time.RFC3339), overlaySignature(files), packID)
+	if err != nil { return nil, err }
+	s.emit("driver_pack.overlay_built", map[string]any{"pack_id": packID, "asset": a.Path, "version": a.Version, "files": len(files), "size": a.Size})
+	return a, nil
+}
+
+func init() {
+	registerJobHandler("initrd-overlay", func(s *Server, ctx context.Context, payload json.RawMessage) (string, error) {
+		var j overlayBuildJob
+		if err := json.Unmarshal(payload, &j); err != nil { return "", err }
+		a, err := s.buildOverlay(ctx, j.PackID)
+		if err != nil { return "", err }
+		return "asset:" + a.Path, nil
+	})
+}
+
+type cpioEntry struct {
+	name string
+	mode uint32
+	size int64
+	open func() (io.ReadCloser, error) // nil for directories and the trailer
+}
+
+// overlayEntries turns the files into cpio entries, each parent directory
+// first.
+func (s *Server) overlayEntries(prefix string, files []*BootAsset) []cpioEntry {
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	var out []cpioEntry
+	dirs := map[string]bool{}
+	for _, f := range files {
+		rel := strings.TrimPrefix(f.Path, prefix+"/")
+		var parents []string
+		for d := path.Dir(rel); d != "." && !dirs[d]; d = path.Dir(d) { dirs[d] = true; parents = append(parents, d) }
+		for i := len(parents) - 1; i >= 0; i-- { out = append(out, cpioEntry{name: parents[i], mode: 0o40755}) }
+		mode := uint32(0o100644)
+		if strings.Contains("/"+rel, "/bin/") || strings.Contains("/"+rel, "/sbin/") { mode = 0o100755 }
+		file := f.file
+		out = append(out, cpioEntry{name: rel, mode: mode, size: f.Size, open: func() (io.ReadCloser, error) { return s.Store.Open(context.Background(), file) }})
+	}
+	return append(out, cpioEntry{name: "TRAILER!!!"})
+}
+
+func cpioPad(n int64) int64 { return (4 - n%4) % 4 }
+
+// cpioSize is the length writeCpio will produce.
+func cpioSize(entries []cpioEntry) int64 {
+	var n int64
+	for _, e := range entries {
+		h := int64(110 + len(e.name) + 1)
+		n += h + cpioPad(h) + e.size + cpioPad(e.size)
+	}
+	return n
+}
+
+func writeCpio(w io.Writer, entries []cpioEntry) error {
+	zero := make([]byte, 4)
+	for i, e := range entries {
+		nlink := 1
+		if e.mode&0o40000 != 0 { nlink = 2 }
+		h := fmt.Sprintf("070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%s\x00", i+1, e.mode, 0, 0, nlink, 0, e.size, 0, 0, 0, 0, len(e.name)+1, 0, e.name)
+		if _, err := io.WriteString(w, h); err != nil { return err }
+		if _, err := w.Write(zero[:cpioPad(int64(len(h)))]); err != nil { return err }
+		if e.open == nil { continue }
+		rc, err := e.open()
+		if err != nil { return err }
+		n, err := io.Copy(w, io.LimitReader(rc, e.size))
+		rc.Close()
+		if err != nil { return err }
+		if n != e.size { return fmt.Errorf("%s: short read", e.name) }
+		if _, err := w.Write(zero[:cpioPad(e.size)]); err != nil { return err }
+	}
+	return nil
+}
+
+// withInitrdOverlays rewrites the initrd lines of a rendered script to
+// bring in the overlays for packs.
+func (s *Server) withInitrdOverlays(script string, packs []string, dlToken string) string {
+	mode := initrdOverlayMode()
+	if len(packs) == 0 || mode == "off" { return script }
+	q := "?packs=" + strings.Join(packs, ",")
+	if dlToken != "" { q += "&dt=" + dlToken }
+	origin := "http://${next-server}:"
+	lines := strings.Split(script, "\n")
+	var out []string
+	for _, line := range lines {
+		out = append(out, line)
+		f := strings.Fields(line)
+		if len(f) < 2 || f[0] != "initrd" { continue }
+		var u string
+		for _, a := range f[1:] { if !strings.HasPrefix(a, "-") { u = a; break } }
+		p, v, ok := scriptAssetPath(u)
+		if !ok { continue }
+		if a, err := s.bootAsset(p); err != nil || a.Kind != "initrd" { continue }
+		if mode == "lines" {
+			for _, id := range packs {
+				ov := origin + "/ipxe/overlay/" + id + ".cpio.gz"
+				if dlToken != "" { ov += "?dt=" + dlToken }
+				out = append(out, "initrd "+ov)
+			}
+			continue
+		}
+		rel := p
+		if v > 0 { rel = fmt.Sprintf("@v%d/%s", v, p) }
+		out[len(out)-1] = strings.Replace(line, u, origin+"/ipxe/initrd/"+rel+q, 1)
+	}
+	return strings.Join(out, "\n")
+}
+
+func (s *Server) initrdOverlayRoutes() {
+	// /ipxe/initrd/[@v<N>/]<asset>?packs=a,b: the initrd with the overlays appended
+	s.Mux.HandleFunc("/ipxe/initrd/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead { http.Error(w, "method not allowed", 405); return }
+		if !s.checkDownloadToken(w, r) { return }
+		longTransfer(w)
+		rel := strings.TrimPrefix(r.URL.Path, "/ipxe/initrd/")
+		var version int64
+		if m := versionedAssetRe.FindStringSubmatch(rel); m != nil {
+			version, _ = strconv.ParseInt(m[1], 10, 64)
+			rel = m[2]
+		}
+		p, err := cleanAssetPath(rel)
+		if err != nil { http.Error(w, err.Error(), 400); return }
+		var base *BootAsset
+		if version > 0 { base, err = s.bootAssetVersion(p, version) }
+		if base == nil { base, err = s.bootAsset(p) }
+		if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		var overlays []*overlaySource
+		for _, id := range splitList(r.URL.Query().Get("packs")) {
+			o, err := s.overlaySource(id)
+			if errors.Is(err, sql.ErrNoRows) { http.Error(w, "unknown overlay "+id, 404); return }
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			overlays = append(overlays, o)
+		}
+		size := base.Size + cpioPad(base.Size)
+		for _, o := range overlays { size += o.size() }
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method == http.MethodHead { return }
+		rc, err := s.Store.Open(r.Context(), base.file)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		n, err := io.Copy(w, rc)
+		rc.Close()
+		if err == nil && n != base.Size { err = errors.New("short read") }
+		if err == nil { _, err = w.Write(make([]byte, cpioPad(base.Size))) }
+		for _, o := range overlays {
+			if err != nil { break }
+			err = s.writeOverlay(r.Context(), w, o)
+		}
+		if err != nil { log.Printf("initrd %s with overlays: %v", p, err) }
+	})
+
+	// Overlay of a pack (?pack_id=); POST {"pack_id": "", "include": ["lib/firmware/bnx2x"]}
+	// sets the include list when given and queues a build
+	s.Mux.HandleFunc("/api/v1/admin/driver_packs/overlay", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+			st, err := s.overlayStatus(r.URL.Query().Get("pack_id"))
+			if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			writeJSON(w, 200, st)
+		case http.MethodPost:
+			var body struct {
+				PackID  string    `json:"pack_id"`
+				Include *[]string `json:"include"`
+			}
+			if !decodeJSON(w, r, &body) { return }
+			if body.Include != nil {
+				for _, g := range *body.Include {
+					if _, err := path.Match(g, ""); err != nil || strings.Contains(g, ",") { http.Error(w, "invalid include pattern "+g, 400); return }
+				}
+				if _, err := s.DB.Exec(`UPDATE driver_packs SET overlay_include=NULLIF(?,'') WHERE id=?`, strings.Join(*body.Include, ","), body.PackID); err != nil { http.Error(w, err.Error(), 500); return }
+			}
+			if _, files, err := s.overlayFiles(body.PackID); errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "driver pack has no overlay", 404); return
+			} else if err != nil {
+				http.Error(w, err.Error(), 500); return
+			} else if len(files) == 0 {
+				http.Error(w, "overlay has no files", 400); return
+			}
+			jobID, err := s.enqueueJob("initrd-overlay", overlayBuildJob{PackID: body.PackID})
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "overlay_build", "driver_pack", map[string]any{"id": body.PackID, "job": jobID})
+			writeJSON(w, 202, map[string]any{"job": jobID, "status": "queued"})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// /ipxe/overlay/<pack>.cpio[.gz]
+	s.Mux.HandleFunc("/ipxe/overlay/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead { http.Error(w, "method not allowed", 405); return }
+		if !s.checkDownloadToken(w, r) { return }
+		name := strings.TrimPrefix(r.URL.Path, "/ipxe/overlay/")
+		id, gz := strings.CutSuffix(name, ".cpio.gz")
+		if !gz {
+			var ok bool
+			if id, ok = strings.CutSuffix(name, ".cpio"); !ok { http.NotFound(w, r); return }
+		}
+		o, err := s.overlaySource(id)
+		if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		if gz && o.built != nil {
+			w.Header().Set("Content-Length", strconv.FormatInt(o.size(), 10))
+			if r.Method == http.MethodHead { return }
+			if err := s.writeOverlay(r.Context(), w, o); err != nil { log.Printf("overlay %s: %v", id, err) }
+			return
+		}
+		entries := o.entries
+		if entries == nil {
+			prefix, files, err := s.overlayFiles(id)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			entries = s.overlayEntries(prefix, files)
+		}
+		if !gz { w.Header().Set("Content-Length", strconv.FormatInt(cpioSize(entries), 10)) }
+		if r.Method == http.MethodHead { return }
+		var out io.Writer = w
+		var zw *gzip.Writer
+		if gz { zw = gzip.NewWriter(w); zw.ModTime = time.Unix(0, 0); out = zw }
+		err = writeCpio(out, entries)
+		if zw != nil && err == nil { err = zw.Close() }
+		if err != nil { log.Printf("overlay %s: %v", id, err) }
+	})
+}
+
+// overlayStatus describes a pack's overlay for the admin API.
+func (s *Server) overlayStatus(packID string) (map[string]any, error) {
+	prefix, files, err := s.overlayFiles(packID)
+	if err != nil { return nil, err }
+	var include, asset, builtAt, sig string
+	_ = s.DB.QueryRow(`SELECT COALESCE(overlay_include,''), COALESCE(overlay_asset,''), COALESCE(overlay_built_at,''), COALESCE(overlay_sig,'') FROM driver_packs WHERE id=?`, packID).
+		Scan(&include, &asset, &builtAt, &sig)
+	paths := []string{}
+	for _, f := range files { paths = append(paths, strings.TrimPrefix(f.Path, prefix+"/")) }
+	return map[string]any{"pack_id": packID, "overlay": prefix, "include": splitList(include), "files": paths,
+		"asset": asset, "built_at": builtAt, "current": asset != "" && sig == overlaySignature(files)}, nil
+}
+// overlayPrefixValid checks a driver pack's overlay prefix.
+func overlayPrefixValid(p string) (string, error) {
+	if p == "" { return "", nil }
+	return cleanAssetPath(strings.TrimSuffix(p, "/"))
+}
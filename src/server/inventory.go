@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ---- Hardware Inventory ----
+type InventorySMBIOS struct {
+	Manufacturer string `json:"manufacturer"`
+	Product      string `json:"product"`
+	Serial       string `json:"serial"`
+	UUID         string `json:"uuid"`
+	AssetTag     string `json:"asset_tag"`
+	BIOSVersion  string `json:"bios_version"`
+	BIOSDate     string `json:"bios_date"`
+}
+
+type InventoryPCI struct {
+	VendorID    string `json:"vendor_id"`
+	DeviceID    string `json:"device_id"`
+	Class       string `json:"class"`
+	Description string `json:"description"`
+}
+
+type InventoryDisk struct {
+	Name      string `json:"name"`
+	Model     string `json:"model"`
+	Serial    string `json:"serial"`
+	SizeBytes int64  `json:"size_bytes"`
+	Bus       string `json:"bus"` // sata|nvme|usb|...
+}
+
+type InventoryReport struct {
+	MAC    string          `json:"mac"`
+	Agent  string          `json:"agent"` // winpe|linux
+	SMBIOS InventorySMBIOS `json:"smbios"`
+	PCI    []InventoryPCI  `json:"pci"`
+	Disks  []InventoryDisk `json:"disks"`
+}
+
+func initInventory(db *sql.DB) error {
+	ddl1 := `CREATE TABLE IF NOT EXISTS inventory (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		mac TEXT NOT NULL,
+		uuid TEXT,
+		serial TEXT,
+		vendor TEXT,
+		model TEXT,
+		asset_tag TEXT,
+		agent TEXT,
+		collected_at TEXT NOT NULL,
+		data TEXT NOT NULL
+	);`
+	ddl2 := `CREATE INDEX IF NOT EXISTS inventory_mac ON inventory (mac, collected_at);`
+	ddl3 := `CREATE TABLE IF NOT EXISTS machine_groups (
+		id TEXT PRIMARY KEY,
+		name TEXT UNIQUE NOT NULL,
+		match_vendor TEXT,
+		match_model TEXT,
+		notes TEXT
+	);`
+	for _, ddl := range []string{ddl1, ddl2, ddl3} {
+		if _, err := db.Exec(ddl); err != nil { return err }
+	}
+	return nil
+}
+
+// normalizeMAC lowercases a MAC and converts '-' separators to ':' so agents,
+// iPXE (${net0/mac}) and CSV imports all key the same machine identically.
+func normalizeMAC(mac string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(mac)), "-", ":")
+}
+
+// requireAgent checks agent credentials: the shared BOOTAH_AGENT_TOKEN, a
+// per-deployment agent token issued with an active deployment, or an API key
+// with the agent:checkin scope. Without BOOTAH_AGENT_TOKEN only the latter
+// two are accepted; nothing is let through unauthenticated.
+func (s *Server) requireAgent(w http.ResponseWriter, r *http.Request) bool {
+	tok := r.Header.Get("X-Bootah-Agent-Token")
+	if _, ok := s.deploymentForAgentToken(tok); ok { return true }
+	if s.agentAPIKey(r) { return true }
+	want := getenv("BOOTAH_AGENT_TOKEN", "")
+	if want == "" || subtle.ConstantTimeCompare([]byte(tok), []byte(want)) != 1 {
+		http.Error(w, "unauthorized agent", 401); return false
+	}
+	return true
+}
+
+// requireAgentFor is requireAgent for a request that reports about or acts as
+// one machine: a per-deployment token only speaks for its own deployment's
+// machine, and the machine's enrollment secret is checked.
+func (s *Server) requireAgentFor(w http.ResponseWriter, r *http.Request, mac string) bool {
+	return s.requireAgent(w, r) && s.agentTaskMAC(w, r, mac) && s.requireEnrollment(w, r, mac)
+}
+
+// latestInventory returns the most recent SMBIOS summary for every machine.
+func (s *Server) latestInventory() ([]map[string]any, error) {
+	rows, err := s.DB.Query(`SELECT i.mac, i.uuid, i.serial, i.vendor, i.model, i.asset_tag, i.agent, i.collected_at, i.data,
+		(SELECT MIN(collected_at) FROM inventory f WHERE f.mac=i.mac)
+		FROM inventory i WHERE i.id = (SELECT MAX(id) FROM inventory l WHERE l.mac=i.mac) ORDER BY i.vendor, i.model, i.mac`)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	var out []map[string]any
+	for rows.Next() {
+		var mac, uuid, serial, vendor, model, asset, agent, collected, data, first string
+		if err := rows.Scan(&mac, &uuid, &serial, &vendor, &model, &asset, &agent, &collected, &data, &first); err != nil { return nil, err }
+		var rep InventoryReport
+		_ = json.Unmarshal([]byte(data), &rep)
+		out = append(out, map[string]any{"mac": mac, "uuid": uuid, "serial": serial, "vendor": vendor, "model": model,
+			"asset_tag": asset, "agent": agent, "collected_at": collected, "first_seen": first,
+			"bios_version": rep.SMBIOS.BIOSVersion, "disks": rep.Disks, "pci_count": len(rep.PCI)})
+	}
+	return out, rows.Err()
+}
+
+// machineModel returns the vendor/model last reported for a MAC.
+func (s *Server) machineModel(mac string) (string, string, error) {
+	var vendor, model string
+	err := s.DB.QueryRow(`SELECT vendor, model FROM inventory WHERE mac=? ORDER BY id DESC LIMIT 1`, normalizeMAC(mac)).Scan(&vendor, &model)
+	return vendor, model, err
+}
+
+// matchModel reports whether a vendor/model pair satisfies a rule; empty rule
+// fields match anything and model rules are case-insensitive prefixes.
+func matchModel(ruleVendor, ruleModel, vendor, model string) bool {
+	if ruleVendor != "" && !strings.EqualFold(strings.TrimSpace(ruleVendor), strings.TrimSpace(vendor)) { return false }
+	if ruleModel != "" && !strings.HasPrefix(strings.ToLower(model), strings.ToLower(strings.TrimSpace(ruleModel))) { return false }
+	return true
+}
+
+// driverPacksForModel returns driver packs whose vendor/model match the hardware.
+func (s *Server) driverPacksForModel(vendor, model string) ([]map[string]any, error) {
+	rows, err := s.DB.Query(`SELECT id, vendor, model, version, url FROM driver_packs ORDER BY version DESC`)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	var out []map[string]any
+	for rows.Next() {
+		var id, pv, pm, version, url string
+		if err := rows.Scan(&id, &pv, &pm, &version, &url); err != nil { return nil, err }
+		if matchModel(pv, pm, vendor, model) {
+			out = append(out, map[string]any{"id": id, "vendor": pv, "model": pm, "version": version, "url": url})
+		}
+	}
+	return out, rows.Err()
+}
+
+func (s *Server) inventoryRoutes() {
+	// Agent submission (WinPE/Linux)
+	s.Mux.HandleFunc("/api/v1/agent/inventory", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		if !s.requireAgent(w, r) { return }
+		var rep InventoryReport
+		if !decodeJSON(w, r, &rep) { return }
+		rep.MAC = normalizeMAC(rep.MAC)
+		if rep.MAC == "" { http.Error(w, "mac required", 400); return }
+		if !s.requireAgentFor(w, r, rep.MAC) { return }
+		js, _ := json.Marshal(rep)
+		now := time.Now().Format(time.RFC3339)
+		var seen int
+		_ = s.DB.QueryRow(`SELECT COUNT(*) FROM inventory WHERE mac=?`, rep.MAC).Scan(&seen)
+		_, err := s.DB.Exec(`INSERT INTO inventory (mac, uuid, serial, vendor, model, asset_tag, agent, collected_at, data) VALUES (?,?,?,?,?,?,?,?,?)`,
+			rep.MAC, rep.SMBIOS.UUID, rep.SMBIOS.Serial, rep.SMBIOS.Manufacturer, rep.SMBIOS.Product, rep.SMBIOS.AssetTag, rep.Agent, now, string(js))
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		packs, _ := s.driverPacksForModel(rep.SMBIOS.Manufacturer, rep.SMBIOS.Product)
+		groups, _ := s.groupsForMachine(rep.MAC)
+		if seen == 0 {
+			s.emit("machine.enrolled", map[string]any{"mac": rep.MAC, "vendor": rep.SMBIOS.Manufacturer, "model": rep.SMBIOS.Product,
+				"serial": rep.SMBIOS.Serial, "asset_tag": rep.SMBIOS.AssetTag, "groups": groups})
+		}
+		writeJSON(w, 201, map[string]any{"ok": true, "driver_packs": packs, "groups": groups})
+	})
+
+	// Latest inventory per machine, or history for one machine (?mac=)
+	s.Mux.HandleFunc("/api/v1/admin/inventory", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		mac := normalizeMAC(r.URL.Query().Get("mac"))
+		if mac == "" {
+			out, err := s.latestInventory()
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			writeJSON(w, 200, out)
+			return
+		}
+		rows, err := s.DB.Query(`SELECT id, collected_at, agent, data FROM inventory WHERE mac=? ORDER BY id DESC LIMIT 100`, mac)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		defer rows.Close()
+		var out []map[string]any
+		for rows.Next() {
+			var id int64; var collected, agent, data string
+			if err := rows.Scan(&id, &collected, &agent, &data); err != nil { http.Error(w, err.Error(), 500); return }
+			out = append(out, map[string]any{"id": id, "collected_at": collected, "agent": agent, "report": json.RawMessage(data)})
+		}
+		writeJSON(w, 200, out)
+	})
+
+	// Driver packs matching a machine's reported model
+	s.Mux.HandleFunc("/api/v1/admin/inventory/drivers", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		vendor, model, err := s.machineModel(r.URL.Query().Get("mac"))
+		if err != nil {
+			if err == sql.ErrNoRows { http.NotFound(w, r); return }
+			http.Error(w, err.Error(), 500); return
+		}
+		packs, err := s.driverPacksForModel(vendor, model)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		writeJSON(w, 200, map[string]any{"vendor": vendor, "model": model, "driver_packs": packs})
+	})
+
+	// Warranty/asset export (CSV by default, JSON with ?format=json)
+	s.Mux.HandleFunc("/api/v1/admin/inventory/export", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		out, err := s.latestInventory()
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if r.URL.Query().Get("format") == "json" { writeJSON(w, 200, out); return }
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="bootah-assets.csv"`)
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"mac", "vendor", "model", "serial", "asset_tag", "uuid", "bios_version", "first_seen", "last_seen"})
+		for _, m := range out {
+			_ = cw.Write([]string{m["mac"].(string), m["vendor"].(string), m["model"].(string), m["serial"].(string), m["asset_tag"].(string),
+				m["uuid"].(string), m["bios_version"].(string), m["first_seen"].(string), m["collected_at"].(string)})
+		}
+		cw.Flush()
+	})
+
+	// Machine groups with model rules and/or a saved search (admin)
+	s.Mux.HandleFunc("/api/v1/admin/groups", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := s.DB.Query(`SELECT id, name, COALESCE(match_vendor,''), COALESCE(match_model,''), COALESCE(notes,''), require_attestation, COALESCE(search_id,'') FROM machine_groups ORDER BY name`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			var out []map[string]any
+			for rows.Next() {
+				var id, name, vendor, model, notes, search string
+				var attest bool
+				if err := rows.Scan(&id, &name, &vendor, &model, &notes, &attest, &search); err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, map[string]any{"id": id, "name": name, "match_vendor": vendor, "match_model": model, "notes": notes, "require_attestation": attest, "search_id": search})
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPost:
+			var body struct {
+				Name, MatchVendor, MatchModel, Notes string
+				RequireAttestation bool   `json:"require_attestation"`
+				SearchID           string `json:"search_id"`
+			}
+			if !decodeJSON(w, r, &body) { return }
+			if strings.TrimSpace(body.Name) == "" { http.Error(w, "name required", 400); return }
+			if body.SearchID != "" {
+				var n int
+				_ = s.DB.QueryRow(`SELECT COUNT(*) FROM saved_searches WHERE id=?`, body.SearchID).Scan(&n)
+				if n == 0 { http.Error(w, "unknown search_id", 400); return }
+			}
+			id := "grp-" + genID()
+			_, err := s.DB.Exec(`INSERT INTO machine_groups (id, name, match_vendor, match_model, notes, require_attestation, search_id) VALUES (?,?,?,?,?,?,NULLIF(?,''))`,
+				id, body.Name, body.MatchVendor, body.MatchModel, body.Notes, body.RequireAttestation, body.SearchID)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(nil, "create", "group", map[string]any{"id": id, "name": body.Name})
+			writeJSON(w, 201, map[string]any{"id": id})
+		case http.MethodDelete:
+			var body struct{ ID string `json:"id"` }
+			if !decodeJSON(w, r, &body) { return }
+			if _, err := s.DB.Exec(`DELETE FROM machine_groups WHERE id=?`, body.ID); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(nil, "delete", "group", map[string]any{"id": body.ID})
+			writeJSON(w, 200, map[string]any{"deleted": body.ID})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// Machines matching a group's model rules or saved search, with their
+	// latest inventory when there is one
+	s.Mux.HandleFunc("/api/v1/admin/groups/members", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		macs, err := s.groupMembers(r.URL.Query().Get("id"))
+		if err != nil {
+			if err == sql.ErrNoRows { http.NotFound(w, r); return }
+			http.Error(w, err.Error(), 500); return
+		}
+		all, err := s.latestInventory()
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		inv := map[string]map[string]any{}
+		for _, m := range all { inv[m["mac"].(string)] = m }
+		var out []map[string]any
+		for _, mac := range macs {
+			if m, ok := inv[mac]; ok { out = append(out, m) } else { out = append(out, map[string]any{"mac": mac}) }
+		}
+		writeJSON(w, 200, out)
+	})
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---- Background jobs ----
+// runJob records a job row and runs fn in the background, storing its result
+// (or error) when it finishes. The returned id can be polled via the jobs API.
+//
+// A job goes queued -> running -> succeeded, failed or cancelled. Handlers
+// get a context that is cancelled when an admin cancels the job (on any
+// node: the flag is in the database) and may report progress with
+// jobProgress. Queued jobs that fail are retried up to
+// BOOTAH_JOB_MAX_ATTEMPTS times (default 3), waiting BOOTAH_JOB_RETRY_BACKOFF
+// (default 30s) after the first failure and twice as long after each next
+// one; errors wrapped with permanent are not retried.
+func (s *Server) runJob(kind string, fn func(ctx context.Context) (string, error)) (string, error) {
+	id := "job-" + genID()
+	now := time.Now().Format(time.RFC3339)
+	if _, err := s.DB.Exec(`INSERT INTO jobs (id, kind, status, created_at, result, node, updated_at) VALUES (?,?,?,?,?,?,?)`, id, kind, "running", now, "", nodeID, now); err != nil {
+		return "", err
+	}
+	go s.finishJob(id, kind, fn)
+	return id, nil
+}
+
+func jobMaxAttempts() int {
+	n, err := strconv.Atoi(getenv("BOOTAH_JOB_MAX_ATTEMPTS", "3"))
+	if err != nil || n < 1 { return 3 }
+	return n
+}
+
+// jobRetryDelay is the wait before the next attempt after attempt n failed.
+func jobRetryDelay(n int) time.Duration {
+	d := envDuration("BOOTAH_JOB_RETRY_BACKOFF", 30*time.Second)
+	for i := 1; i < n && d < time.Hour; i++ { d *= 2 }
+	if d > time.Hour { d = time.Hour }
+	return d
+}
+
+type permanentError struct{ error }
+
+func (e permanentError) Unwrap() error { return e.error }
+
+// permanent marks a job error that retrying cannot fix.
+func permanent(err error) error { return permanentError{err} }
+
+type jobCtxKey struct{}
+
+type jobRef struct {
+	s  *Server
+	id string
+}
+
+// runningJobs maps the ids of jobs running on this node to their cancel funcs.
+var runningJobs sync.Map
+
+// jobProgress records how far the job running under ctx has got; it does
+// nothing outside a job.
+func jobProgress(ctx context.Context, percent int, msg string) {
+	j, ok := ctx.Value(jobCtxKey{}).(*jobRef)
+	if !ok { return }
+	if percent < 0 { percent = 0 }
+	if percent > 100 { percent = 100 }
+	_, err := j.s.DB.Exec(`UPDATE jobs SET progress=?, progress_msg=?, updated_at=? WHERE id=?`, percent, msg, time.Now().Format(time.RFC3339), j.id)
+	if err != nil { log.Printf("job %s progress: %v", j.id, err) }
+}
+
+// watchJobCancel cancels a running job once cancellation is requested.
+func (s *Server) watchJobCancel(ctx context.Context, id string, cancel context.CancelFunc) {
+	t := time.NewTicker(2 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			var flag int
+			if s.DB.QueryRow(`SELECT cancel_requested FROM jobs WHERE id=?`, id).Scan(&flag) == nil && flag != 0 { cancel(); return }
+		}
+	}
+}
+
+func (s *Server) finishJob(id, kind string, fn func(ctx context.Context) (string, error)) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), jobCtxKey{}, &jobRef{s: s, id: id}))
+	defer cancel()
+	runningJobs.Store(id, cancel)
+	defer runningJobs.Delete(id)
+	go s.watchJobCancel(ctx, id, cancel)
+	result, err := fn(ctx)
+	var cancelled, attempts int
+	var queued bool
+	_ = s.DB.QueryRow(`SELECT cancel_requested, COALESCE(attempts,0), payload IS NOT NULL FROM jobs WHERE id=?`, id).Scan(&cancelled, &attempts, &queued)
+	now := time.Now()
+	status := "succeeded"
+	switch {
+	case cancelled != 0:
+		status, result = "cancelled", "cancelled"
+		if err != nil { result += ": " + err.Error() }
+	case err != nil && queued && attempts < jobMaxAttempts() && !errors.As(err, new(permanentError)):
+		delay := jobRetryDelay(attempts)
+		log.Printf("job %s (%s) attempt %d failed, retrying in %s: %v", id, kind, attempts, delay, err)
+		_, _ = s.DB.Exec(`UPDATE jobs SET status='queued', node=NULL, result=?, run_after=?, updated_at=? WHERE id=?`, err.Error(), now.Add(delay).Unix(), now.Format(time.RFC3339), id)
+		return
+	case err != nil:
+		status, result = "failed", err.Error()
+		log.Printf("job %s (%s) failed: %v", id, kind, err)
+	}
+	_, _ = s.DB.Exec(`UPDATE jobs SET status=?, result=?, updated_at=?, finished_at=? WHERE id=?`, status, result, now.Format(time.RFC3339), now.Format(time.RFC3339), id)
+	s.emit("job.finished", map[string]any{"job": id, "kind": kind, "status": status, "result": result})
+}
+
+// Queued jobs carry a JSON payload instead of a closure, so any node in the
+// cluster can claim them and the scheduler can requeue them when the node
+// running them disappears. Handlers are registered at init time by kind.
+type jobHandler func(s *Server, ctx context.Context, payload json.RawMessage) (string, error)
+
+var jobHandlers = map[string]jobHandler{}
+
+func registerJobHandler(kind string, h jobHandler) { jobHandlers[kind] = h }
+
+// enqueueJob stores a job for the shared queue; kind must have a handler.
+func (s *Server) enqueueJob(kind string, payload any) (string, error) {
+	if _, ok := jobHandlers[kind]; !ok { return "", errors.New("no handler for job kind " + kind) }
+	js, err := json.Marshal(payload)
+	if err != nil { return "", err }
+	id := "job-" + genID()
+	now := time.Now().Format(time.RFC3339)
+	_, err = s.DB.Exec(`INSERT INTO jobs (id, kind, status, created_at, result, payload) VALUES (?,?,?,?,?,?)`, id, kind, "queued", now, "", string(js))
+	return id, err
+}
+
+// claimJob takes the oldest queued job for this node. The claim is a
+// conditional UPDATE, so two nodes racing for the same row cannot both win;
+// where the database supports it the candidate row is also locked with
+// SKIP LOCKED so concurrent claimers move on to the next job.
+func (s *Server) claimJob() (id, kind string, payload json.RawMessage, ok bool) {
+	kinds := make([]string, 0, len(jobHandlers))
+	args := []any{}
+	for k := range jobHandlers { kinds = append(kinds, "?"); args = append(args, k) }
+	if len(kinds) == 0 { return "", "", nil, false }
+	tx, err := s.DB.Begin()
+	if err != nil { return "", "", nil, false }
+	defer tx.Rollback()
+	var p string
+	q := `SELECT id, kind, payload FROM jobs WHERE status='queued' AND COALESCE(run_after,0) <= ? AND kind IN (` + strings.Join(kinds, ",") + `) ORDER BY created_at LIMIT 1`
+	if dbDriver == "postgres" { q += ` FOR UPDATE SKIP LOCKED` }
+	if err := tx.QueryRow(q, append([]any{time.Now().Unix()}, args...)...).Scan(&id, &kind, &p); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) { log.Printf("claim job: %v", err) }
+		return "", "", nil, false
+	}
+	res, err := tx.Exec(`UPDATE jobs SET status='running', node=?, attempts=COALESCE(attempts,0)+1, updated_at=? WHERE id=? AND status='queued'`, nodeID, time.Now().Format(time.RFC3339), id)
+	if err != nil { return "", "", nil, false }
+	if n, _ := res.RowsAffected(); n == 0 { return "", "", nil, false }
+	if err := tx.Commit(); err != nil { return "", "", nil, false }
+	return id, kind, json.RawMessage(p), true
+}
+
+// jobWorker claims and runs queued jobs until ctx ends.
+func (s *Server) jobWorker(ctx context.Context) {
+	t := time.NewTicker(2 * time.Second)
+	defer t.Stop()
+	for {
+		for {
+			id, kind, payload, ok := s.claimJob()
+			if !ok { break }
+			h := jobHandlers[kind]
+			s.finishJob(id, kind, func(ctx context.Context) (string, error) { return h(s, ctx, payload) })
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+type Job struct {
+	ID          string `json:"id"`
+	Kind        string `json:"kind"`
+	Status      string `json:"status"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at,omitempty"`
+	FinishedAt  string `json:"finished_at,omitempty"`
+	Result      string `json:"result"`
+	Node        string `json:"node"`
+	Attempts    int    `json:"attempts"`
+	Progress    int    `json:"progress"`
+	ProgressMsg string `json:"progress_msg,omitempty"`
+	RetryAt     string `json:"retry_at,omitempty"`
+	Cancelling  bool   `json:"cancelling,omitempty"`
+}
+
+const jobColumns = `id, kind, status, created_at, COALESCE(updated_at,''), COALESCE(finished_at,''), COALESCE(result,''), COALESCE(node,''), COALESCE(attempts,0),
+	COALESCE(progress,0), COALESCE(progress_msg,''), COALESCE(run_after,0), COALESCE(cancel_requested,0) FROM jobs`
+
+func scanJob(row interface{ Scan(...any) error }) (*Job, error) {
+	var j Job
+	var runAfter int64
+	var cancel int
+	if err := row.Scan(&j.ID, &j.Kind, &j.Status, &j.CreatedAt, &j.UpdatedAt, &j.FinishedAt, &j.Result, &j.Node, &j.Attempts, &j.Progress, &j.ProgressMsg, &runAfter, &cancel); err != nil { return nil, err }
+	if j.Status == "queued" && runAfter > time.Now().Unix() { j.RetryAt = time.Unix(runAfter, 0).UTC().Format(time.RFC3339) }
+	j.Cancelling = cancel != 0 && j.Status == "running"
+	if j.Status == "succeeded" { j.Progress = 100 }
+	return &j, nil
+}
+
+// listJobs returns the newest jobs, optionally of one status and kind.
+func (s *Server) listJobs(status, kind string) ([]Job, error) {
+	q, args := `SELECT `+jobColumns+` WHERE 1=1`, []any{}
+	if status != "" { q += ` AND status=?`; args = append(args, status) }
+	if kind != "" { q += ` AND kind=?`; args = append(args, kind) }
+	rows, err := s.DB.Query(q+` ORDER BY created_at DESC LIMIT 100`, args...)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := []Job{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil { return nil, err }
+		out = append(out, *j)
+	}
+	return out, rows.Err()
+}
+
+// cancelJob cancels a queued job outright and asks the node running a
+// running one to stop it.
+func (s *Server) cancelJob(id string) (string, error) {
+	now := time.Now().Format(time.RFC3339)
+	res, err := s.DB.Exec(`UPDATE jobs SET status='cancelled', result='cancelled', cancel_requested=1, updated_at=?, finished_at=? WHERE id=? AND status='queued'`, now, now, id)
+	if err != nil { return "", err }
+	if n, _ := res.RowsAffected(); n > 0 { return "cancelled", nil }
+	res, err = s.DB.Exec(`UPDATE jobs SET cancel_requested=1, updated_at=? WHERE id=? AND status='running'`, now, id)
+	if err != nil { return "", err }
+	if n, _ := res.RowsAffected(); n == 0 {
+		var status string
+		if err := s.DB.QueryRow(`SELECT status FROM jobs WHERE id=?`, id).Scan(&status); err != nil { return "", err }
+		return status, errJobFinished
+	}
+	if c, ok := runningJobs.Load(id); ok { c.(context.CancelFunc)() }
+	return "cancelling", nil
+}
+
+var errJobFinished = errors.New("job already finished")
+
+func jobDone(status string) bool { return status == "succeeded" || status == "failed" || status == "cancelled" }
+
+func (s *Server) jobRoutes() {
+	// Jobs, newest first (?status=&kind=)
+	s.Mux.HandleFunc("/api/v1/admin/jobs", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		out, err := s.listJobs(r.URL.Query().Get("status"), r.URL.Query().Get("kind"))
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		writeJSON(w, 200, out)
+	})
+
+	// /api/v1/admin/jobs/{id}: GET the job, DELETE cancels it; /api/v1/admin/jobs/{id}/events streams progress
+	s.Mux.HandleFunc("/api/v1/admin/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/admin/jobs/"), "/")
+		job, err := scanJob(s.DB.QueryRow(`SELECT `+jobColumns+` WHERE id=?`, id))
+		if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		switch {
+		case sub == "" && r.Method == http.MethodGet:
+			writeJSON(w, 200, job)
+		case sub == "" && r.Method == http.MethodDelete:
+			status, err := s.cancelJob(id)
+			if errors.Is(err, errJobFinished) { http.Error(w, "job is "+status, 409); return }
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "cancel", "job", map[string]any{"id": id, "kind": job.Kind})
+			writeJSON(w, 202, map[string]any{"id": id, "status": status})
+		case sub == "events" && r.Method == http.MethodGet:
+			fl, ok := w.(http.Flusher)
+			if !ok { http.Error(w, "streaming unsupported", 500); return }
+			w.Header().Set("Content-Type", "text/event-stream")
+			streamResponse(w)
+			w.Header().Set("Cache-Control", "no-cache")
+			t := time.NewTicker(time.Second)
+			defer t.Stop()
+			last := ""
+			for {
+				js, _ := json.Marshal(job)
+				if string(js) != last {
+					fmt.Fprintf(w, "event: progress\ndata: %s\n\n", js)
+					fl.Flush()
+					last = string(js)
+				}
+				if jobDone(job.Status) { return }
+				select {
+				case <-r.Context().Done():
+					return
+				case <-t.C:
+				}
+				if job, err = scanJob(s.DB.QueryRow(`SELECT `+jobColumns+` WHERE id=?`, id)); err != nil { return }
+			}
+		case sub == "":
+			http.Error(w, "method not allowed", 405)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ---- Kernel argument overlays ----
+// Overlays adjust a boot entry's kernel command line for a site, machine
+// group or single machine (entry "" applies to every entry that takes
+// arguments). Layers apply global < site < group < machine: a layer that
+// sets key=... replaces every earlier occurrence of that key, bare flags are
+// added once, and "-key" removes it. Entries without default arguments
+// (WinPE) ignore overlays. /api/v1/admin/kernel_args/preview shows the merge.
+var kernelArgScopes = map[string]int{"global": 0, "site": 1, "group": 2, "machine": 3}
+
+type KernelArgs struct {
+	ID      string `json:"id"`
+	Scope   string `json:"scope"`
+	Target  string `json:"target"` // site id, group id or MAC; empty for global
+	Entry   string `json:"entry"`
+	Args    string `json:"args"`
+	Notes   string `json:"notes"`
+	Updated string `json:"updated"`
+}
+
+func initKernelArgs(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS kernel_args (
+		id TEXT PRIMARY KEY,
+		scope TEXT NOT NULL,
+		target TEXT NOT NULL DEFAULT '',
+		entry TEXT NOT NULL DEFAULT '',
+		args TEXT NOT NULL,
+		notes TEXT,
+		updated TEXT NOT NULL
+	)`)
+	return err
+}
+
+func validateKernelArgs(k KernelArgs) error {
+	if _, ok := kernelArgScopes[k.Scope]; !ok { return fmt.Errorf("invalid scope %q", k.Scope) }
+	if (k.Scope == "global") != (k.Target == "") { return errors.New("target is required for site, group and machine scopes only") }
+	if k.Scope == "machine" {
+		if _, err := net.ParseMAC(k.Target); err != nil { return fmt.Errorf("invalid mac %q", k.Target) }
+	}
+	if k.Entry != "" {
+		found := false
+		for _, e := range bootEntries { if e.Name == k.Entry { found = e.Args != "" } }
+		if !found { return fmt.Errorf("entry %q does not exist or takes no kernel arguments", k.Entry) }
+	}
+	if strings.TrimSpace(k.Args) == "" { return errors.New("args required") }
+	if strings.ContainsAny(k.Args, "\r\n") { return errors.New("args must be a single line") }
+	return nil
+}
+
+func argKey(tok string) string {
+	k, _, _ := strings.Cut(strings.TrimPrefix(tok, "-"), "=")
+	return k
+}
+
+// mergeKernelArgs applies overlay layers, lowest precedence first, to base.
+func mergeKernelArgs(base string, layers []string) string {
+	out := strings.Fields(base)
+	for _, layer := range layers {
+		toks := strings.Fields(layer)
+		drop := map[string]bool{}
+		for _, t := range toks { drop[argKey(t)] = true }
+		kept := out[:0:0]
+		for _, t := range out {
+			if !drop[argKey(t)] { kept = append(kept, t) }
+		}
+		seen := map[string]bool{}
+		for _, t := range toks {
+			if strings.HasPrefix(t, "-") { continue }
+			if !strings.Contains(t, "=") {
+				if seen[t] { continue }
+				seen[t] = true
+			}
+			kept = append(kept, t)
+		}
+		out = kept
+	}
+	return strings.Join(out, " ")
+}
+
+// kernelArgLayers returns the overlays that apply to mac at site, ordered by
+// precedence.
+func (s *Server) kernelArgLayers(mac string, site *Site) ([]KernelArgs, error) {
+	targets := map[string]map[string]bool{"global": {"": true}, "site": {}, "group": {}, "machine": {}}
+	if site != nil { targets["site"][site.ID] = true }
+	if mac != "" {
+		targets["machine"][mac] = true
+		ids, err := s.groupsForMachine(mac)
+		if err != nil { return nil, err }
+		for _, id := range ids { targets["group"][id] = true }
+	}
+	rows, err := s.DB.Query(`SELECT id, scope, target, entry, args, COALESCE(notes,''), updated FROM kernel_args ORDER BY updated`)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	var out []KernelArgs
+	for rows.Next() {
+		var k KernelArgs
+		if err := rows.Scan(&k.ID, &k.Scope, &k.Target, &k.Entry, &k.Args, &k.Notes, &k.Updated); err != nil { return nil, err }
+		if targets[k.Scope][k.Target] { out = append(out, k) }
+	}
+	if err := rows.Err(); err != nil { return nil, err }
+	// stable: same-scope layers keep update order
+	for i := 1; i < len(out); i++ {
+		for j := i; j > 0 && kernelArgScopes[out[j].Scope] < kernelArgScopes[out[j-1].Scope]; j-- { out[j], out[j-1] = out[j-1], out[j] }
+	}
+	return out, nil
+}
+
+// kernelArgsFor returns the merged kernel arguments per entry for a client;
+// nil when no overlay applies.
+func (s *Server) kernelArgsFor(mac string, site *Site) (map[string]string, error) {
+	layers, err := s.kernelArgLayers(mac, site)
+	if err != nil || len(layers) == 0 { return nil, err }
+	out := map[string]string{}
+	for _, e := range bootEntries {
+		if e.Args == "" { continue }
+		var apply []string
+		for _, l := range layers {
+			if l.Entry == "" || l.Entry == e.Name { apply = append(apply, l.Args) }
+		}
+		out[e.Name] = mergeKernelArgs(e.Args, apply)
+	}
+	return out, nil
+}
+
+func (s *Server) kernelArgRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/kernel_args", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := s.DB.Query(`SELECT id, scope, target, entry, args, COALESCE(notes,''), updated FROM kernel_args ORDER BY scope, target, entry`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			out := []KernelArgs{}
+			for rows.Next() {
+				var k KernelArgs
+				if err := rows.Scan(&k.ID, &k.Scope, &k.Target, &k.Entry, &k.Args, &k.Notes, &k.Updated); err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, k)
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPost, http.MethodPut:
+			var k KernelArgs
+			if !decodeJSON(w, r, &k) { return }
+			k.Scope = strings.ToLower(strings.TrimSpace(k.Scope))
+			if k.Scope == "machine" { k.Target = normalizeMAC(k.Target) }
+			k.Args = strings.TrimSpace(k.Args)
+			if err := validateKernelArgs(k); err != nil { badRequest(w, err); return }
+			k.Updated = time.Now().Format(time.RFC3339)
+			if r.Method == http.MethodPut {
+				res, err := s.DB.Exec(`UPDATE kernel_args SET scope=?, target=?, entry=?, args=?, notes=?, updated=? WHERE id=?`, k.Scope, k.Target, k.Entry, k.Args, k.Notes, k.Updated, k.ID)
+				if err != nil { http.Error(w, err.Error(), 500); return }
+				if n, _ := res.RowsAffected(); n == 0 { http.NotFound(w, r); return }
+				s.audit(s.actorID(r), "update", "kernel_args", map[string]any{"id": k.ID, "scope": k.Scope, "target": k.Target, "args": k.Args})
+				writeJSON(w, 200, k)
+				return
+			}
+			k.ID = "karg-" + genID()
+			if _, err := s.DB.Exec(`INSERT INTO kernel_args (id, scope, target, entry, args, notes, updated) VALUES (?,?,?,?,?,?,?)`, k.ID, k.Scope, k.Target, k.Entry, k.Args, k.Notes, k.Updated); err != nil {
+				http.Error(w, err.Error(), 500); return
+			}
+			s.audit(s.actorID(r), "create", "kernel_args", map[string]any{"id": k.ID, "scope": k.Scope, "target": k.Target, "args": k.Args})
+			writeJSON(w, 201, k)
+		case http.MethodDelete:
+			var body struct{ ID string `json:"id"` }
+			if !decodeJSON(w, r, &body) { return }
+			if _, err := s.DB.Exec(`DELETE FROM kernel_args WHERE id=?`, body.ID); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "delete", "kernel_args", map[string]any{"id": body.ID})
+			writeJSON(w, 200, map[string]any{"deleted": body.ID})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// ?mac=&ip= -> merged arguments per entry, the layers used, and the script
+	s.Mux.HandleFunc("/api/v1/admin/kernel_args/preview", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		mac := normalizeMAC(r.URL.Query().Get("mac"))
+		var site *Site
+		if ip := net.ParseIP(r.URL.Query().Get("ip")); ip != nil {
+			var err error
+			if site, err = s.siteForIP(ip); err != nil { http.Error(w, err.Error(), 500); return }
+		}
+		layers, err := s.kernelArgLayers(mac, site)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		args, _ := s.kernelArgsFor(mac, site)
+		entries := []map[string]any{}
+		for _, e := range bootEntries {
+			if e.Args == "" { continue }
+			applied := []KernelArgs{}
+			for _, l := range layers {
+				if l.Entry == "" || l.Entry == e.Name { applied = append(applied, l) }
+			}
+			merged := e.Args
+			if a, ok := args[e.Name]; ok { merged = a }
+			entries = append(entries, map[string]any{"entry": e.Name, "base": e.Args, "layers": applied, "args": merged})
+		}
+		out := map[string]any{"mac": mac, "entries": entries, "script": renderBootMenu(site, "", args, s.assetPins())}
+		if site != nil { out["site"] = site.Name }
+		writeJSON(w, 200, out)
+	})
+}
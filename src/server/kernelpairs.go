@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ---- Kernel/initrd pairing ----
+// A Linux kernel booted with an initrd built for another release or
+// architecture hangs when the initrd cannot load its modules, with nothing on
+// screen to say why. Boot assets are recognised as they are uploaded: x86
+// bzImage and arm64 Image kernels and EFI binaries give their architecture
+// (bzImage also its release), and initrds (newc cpio, plain or gzip, early
+// microcode archives skipped) give the release of the modules they carry,
+// which usually names the architecture too. Admins can label what cannot be
+// detected (zstd/xz initrds) and a distro on upload. Every kernel line in the
+// stock menu and in boot profiles is then checked against the initrd lines
+// that follow it: a missing asset, an architecture, release or distro
+// mismatch is an error; what cannot be verified is a warning. Boot profiles
+// with errors are refused unless saved with ?force=1, publications are
+// refused outright, and uploads report what they broke.
+var (
+	linuxVersionRe = regexp.MustCompile(`Linux version ([0-9][^ \x00]*)`)
+	modulesDirRe   = regexp.MustCompile(`^(?:\./)?(?:usr/)?lib/modules/([0-9][^/]*)`)
+)
+
+// normalizeArch maps the common spellings onto one name.
+func normalizeArch(a string) string {
+	switch a = strings.ToLower(strings.TrimSpace(a)); a {
+	case "amd64", "x64", "x86-64":
+		return "x86_64"
+	case "aarch64":
+		return "arm64"
+	case "i686", "i586", "x86", "ia32":
+		return "i386"
+	}
+	return a
+}
+
+// archFromRelease guesses the architecture from a kernel release suffix
+// ("6.1.0-18-amd64", "5.14.0-362.el9.aarch64").
+func archFromRelease(v string) string {
+	for _, a := range []string{"x86_64", "amd64", "aarch64", "arm64", "i686", "i386"} {
+		if strings.Contains(v, a) { return normalizeArch(a) }
+	}
+	return ""
+}
+
+// assetSniffer watches an upload go by and recognises kernels and initrds.
+// It keeps the first 64 KiB for headers and feeds the whole stream to a
+// scanner looking for the kernel release.
+type assetSniffer struct {
+	head []byte
+	pw   *io.PipeWriter
+	ver  chan string
+}
+
+func newAssetSniffer() *assetSniffer {
+	pr, pw := io.Pipe()
+	sn := &assetSniffer{pw: pw, ver: make(chan string, 1)}
+	go func() {
+		sn.ver <- scanRelease(pr)
+		_, _ = io.Copy(io.Discard, pr)
+	}()
+	return sn
+}
+
+func (sn *assetSniffer) Write(p []byte) (int, error) {
+	if n := 64<<10 - len(sn.head); n > 0 {
+		if n > len(p) { n = len(p) }
+		sn.head = append(sn.head, p[:n]...)
+	}
+	_, _ = sn.pw.Write(p)
+	return len(p), nil
+}
+
+func (sn *assetSniffer) Close() error { return sn.pw.Close() }
+
+// result reports kind, architecture and release; call after Close.
+func (sn *assetSniffer) result() (kind, arch, release string) {
+	release = <-sn.ver
+	h := sn.head
+	switch {
+	case len(h) >= 0x240 && string(h[0x202:0x206]) == "HdrS":
+		kind, arch = "kernel", "i386"
+		if binary.LittleEndian.Uint16(h[0x206:]) >= 0x20c && h[0x236]&1 != 0 { arch = "x86_64" }
+		if off := int(binary.LittleEndian.Uint16(h[0x20e:])) + 0x200; off > 0x200 && off < len(h) {
+			if f := strings.Fields(string(bytes.SplitN(h[off:], []byte{0}, 2)[0])); len(f) > 0 { release = f[0] }
+		}
+	case len(h) >= 0x40 && string(h[0x38:0x3c]) == "ARM\x64":
+		kind, arch = "kernel", "arm64"
+	case len(h) >= 0x40 && string(h[:2]) == "MZ":
+		kind = "efi"
+		if off := int(binary.LittleEndian.Uint32(h[0x3c:])); off > 0 && off+6 <= len(h) && string(h[off:off+4]) == "PE\x00\x00" {
+			arch = map[uint16]string{0x8664: "x86_64", 0xaa64: "arm64", 0x14c: "i386"}[binary.LittleEndian.Uint16(h[off+4:])]
+		}
+	case bytes.HasPrefix(h, []byte("07070")), bytes.HasPrefix(h, []byte{0x1f, 0x8b}), bytes.HasPrefix(h, []byte{0x28, 0xb5, 0x2f, 0xfd}),
+		bytes.HasPrefix(h, []byte("\xfd7zXZ\x00")), bytes.HasPrefix(h, []byte{0x02, 0x21, 0x4c, 0x18}):
+		kind = "initrd"
+		arch = archFromRelease(release)
+	default:
+		return "", "", ""
+	}
+	return kind, arch, release
+}
+
+// scanRelease finds the kernel release in a stream: the modules directory of
+// a cpio initrd, else a "Linux version" banner.
+func scanRelease(r io.Reader) string {
+	br := bufio.NewReaderSize(r, 64<<10)
+	magic, _ := br.Peek(6)
+	switch {
+	case bytes.HasPrefix(magic, []byte("07070")), bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return scanCpio(br)
+	}
+	var tail []byte
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := br.Read(buf)
+		chunk := append(tail, buf[:n]...)
+		// a match running to the end of the chunk may continue in the next
+		if m := linuxVersionRe.FindSubmatchIndex(chunk); m != nil && (m[1] < len(chunk) || err != nil) { return string(chunk[m[2]:m[3]]) }
+		if len(chunk) > 256 { tail = append([]byte(nil), chunk[len(chunk)-256:]...) } else { tail = chunk }
+		if err != nil { return "" }
+	}
+}
+
+// scanCpio walks concatenated newc archives, plain or gzip-compressed, for a
+// lib/modules/<release> entry.
+func scanCpio(br *bufio.Reader) string {
+	for {
+		// archives are padded with zeros between each other
+		for {
+			b, err := br.Peek(1)
+			if err != nil { return "" }
+			if b[0] != 0 { break }
+			_, _ = br.ReadByte()
+		}
+		magic, _ := br.Peek(6)
+		if bytes.HasPrefix(magic, []byte{0x1f, 0x8b}) {
+			gz, err := gzip.NewReader(br)
+			if err != nil { return "" }
+			br = bufio.NewReaderSize(gz, 64<<10)
+			continue
+		}
+		if !bytes.HasPrefix(magic, []byte("07070")) { return "" }
+		for {
+			var hdr [110]byte
+			if _, err := io.ReadFull(br, hdr[:]); err != nil || !bytes.HasPrefix(hdr[:], []byte("07070")) { return "" }
+			size, err1 := strconv.ParseUint(string(hdr[54:62]), 16, 32)
+			nlen, err2 := strconv.ParseUint(string(hdr[94:102]), 16, 32)
+			if err1 != nil || err2 != nil || nlen == 0 || nlen > 4096 { return "" }
+			name := make([]byte, nlen+(4-(110+nlen)%4)%4)
+			if _, err := io.ReadFull(br, name); err != nil { return "" }
+			n := string(name[:nlen-1])
+			if m := modulesDirRe.FindStringSubmatch(n); m != nil { return m[1] }
+			if _, err := br.Discard(int(size + (4-size%4)%4)); err != nil { return "" }
+			if n == "TRAILER!!!" { break }
+		}
+	}
+}
+
+// sniffAssetFile recognises an unmanaged file from the web root.
+func sniffAssetFile(p string) (kind, arch, release string) {
+	f, err := os.Open(p)
+	if err != nil { return "", "", "" }
+	defer f.Close()
+	sn := newAssetSniffer()
+	_, _ = io.Copy(sn, f)
+	sn.Close()
+	return sn.result()
+}
+
+// bootPair is one kernel line of a script with the initrds loaded for it.
+type bootPair struct {
+	Kernel   string   `json:"kernel"`
+	Initrds  []string `json:"initrds"`
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+}
+
+func (p bootPair) uses(path string) bool {
+	if p.Kernel == path { return true }
+	for _, i := range p.Initrds { if i == path { return true } }
+	return false
+}
+
+// scriptAssetPath maps an asset URL in a rendered script back to its asset
+// path and pinned version (0 = current); ok is false for other URLs.
+func scriptAssetPath(u string) (string, int64, bool) {
+	i := strings.Index(u, "/assets/")
+	if i < 0 { return "", 0, false }
+	rel, _, _ := strings.Cut(u[i+len("/assets/"):], "?")
+	var v int64
+	if m := versionedAssetRe.FindStringSubmatch(rel); m != nil {
+		v, _ = strconv.ParseInt(m[1], 10, 64)
+		rel = m[2]
+	}
+	p, err := cleanAssetPath(rel)
+	return p, v, err == nil
+}
+
+// assetLookup returns what is known about an asset; staged assets about to
+// be published shadow the stored ones.
+func (s *Server) assetLookup(staged map[string]*BootAsset) func(p string, v int64) (*BootAsset, bool) {
+	return func(p string, v int64) (*BootAsset, bool) {
+		if a, ok := staged[p]; ok { return a, true }
+		var a *BootAsset
+		var err error
+		if v > 0 {
+			a, err = s.bootAssetVersion(p, v)
+		}
+		if a == nil { a, err = s.bootAsset(p) }
+		if err == nil { return a, true }
+		fp := filepath.Join(s.WebRoot, "assets", filepath.FromSlash(p))
+		if _, err := os.Stat(fp); err != nil { return nil, false }
+		a = &BootAsset{Path: p}
+		a.Kind, a.Arch, a.KernelVer = sniffAssetFile(fp)
+		return a, true
+	}
+}
+
+// checkBootPairs checks every kernel in an iPXE script against its initrds.
+func checkBootPairs(script string, lookup func(string, int64) (*BootAsset, bool)) []bootPair {
+	var out []bootPair
+	var cur *bootPair
+	var kernel *BootAsset
+	flush := func() {
+		if cur != nil { out = append(out, *cur) }
+		cur, kernel = nil, nil
+	}
+	for _, line := range strings.Split(script, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 { continue }
+		if strings.HasPrefix(f[0], ":") || f[0] == "boot" { flush(); continue }
+		if f[0] != "kernel" && f[0] != "initrd" { continue }
+		var u string
+		for _, a := range f[1:] {
+			if !strings.HasPrefix(a, "-") { u = a; break }
+		}
+		p, v, ok := scriptAssetPath(u)
+		if !ok { continue }
+		a, found := lookup(p, v)
+		if f[0] == "kernel" {
+			flush()
+			cur = &bootPair{Kernel: p, Initrds: []string{}, Errors: []string{}, Warnings: []string{}}
+			if !found { cur.Errors = append(cur.Errors, "kernel "+p+" does not exist"); continue }
+			kernel = a
+			continue
+		}
+		if cur == nil { continue }
+		cur.Initrds = append(cur.Initrds, p)
+		if !found { cur.Errors = append(cur.Errors, "initrd "+p+" does not exist"); continue }
+		if kernel == nil || kernel.Kind != "kernel" { continue } // WinPE, wimboot and other EFI loaders
+		if a.Kind != "initrd" && a.KernelVer == "" { continue }    // microcode, firmware blobs
+		switch {
+		case kernel.Arch != "" && a.Arch != "" && kernel.Arch != a.Arch:
+			cur.Errors = append(cur.Errors, fmt.Sprintf("initrd %s is %s but kernel %s is %s", p, a.Arch, cur.Kernel, kernel.Arch))
+		case (kernel.Arch == "" || a.Arch == "") && (kernel.KernelVer == "" || kernel.KernelVer != a.KernelVer): // the same release is the same build
+			cur.Warnings = append(cur.Warnings, fmt.Sprintf("cannot verify the architecture of %s against %s", p, cur.Kernel))
+		}
+		switch {
+		case kernel.KernelVer != "" && a.KernelVer != "" && kernel.KernelVer != a.KernelVer:
+			cur.Errors = append(cur.Errors, fmt.Sprintf("initrd %s carries modules for %s but kernel %s is %s", p, a.KernelVer, cur.Kernel, kernel.KernelVer))
+		case kernel.KernelVer == "" || a.KernelVer == "":
+			cur.Warnings = append(cur.Warnings, fmt.Sprintf("cannot verify the kernel release of %s against %s", p, cur.Kernel))
+		}
+		if kernel.Distro != "" && a.Distro != "" && kernel.Distro != a.Distro {
+			cur.Errors = append(cur.Errors, fmt.Sprintf("initrd %s is from %s but kernel %s is from %s", p, a.Distro, cur.Kernel, kernel.Distro))
+		}
+	}
+	flush()
+	return out
+}
+
+// bootPairReport is the pairing check of one menu entry or boot profile.
+type bootPairReport struct {
+	Kind  string     `json:"kind"` // entry or profile
+	Name  string     `json:"name"`
+	Pairs []bootPair `json:"pairs"`
+	OK    bool       `json:"ok"`
+}
+
+func pairsOK(pairs []bootPair) bool {
+	for _, p := range pairs { if len(p.Errors) > 0 { return false } }
+	return true
+}
+
+// profilePairs checks a boot profile template rendered with sample values.
+// The stock menu is left out, it is checked on its own.
+func (s *Server) profilePairs(body string, staged map[string]*BootAsset) []bootPair {
+	pc := sampleProfileContext()
+	pc.Vars["Menu"] = ""
+	pc.Asset = bootAssetURL(nil, "", s.assetPins())
+	out, err := renderBootProfile(body, pc)
+	if err != nil { return nil }
+	return checkBootPairs(out, s.assetLookup(staged))
+}
+
+// bootPairReports checks the stock entries and every boot profile.
+func (s *Server) bootPairReports() []bootPairReport {
+	return s.bootPairReportsWith(nil)
+}
+
+func (s *Server) bootPairReportsWith(staged map[string]*BootAsset) []bootPairReport {
+	asset := bootAssetURL(nil, "", s.assetPins())
+	lookup := s.assetLookup(staged)
+	var out []bootPairReport
+	for _, e := range bootEntries {
+		pairs := checkBootPairs(e.Script(asset, e.Args), lookup)
+		if len(pairs) > 0 { out = append(out, bootPairReport{Kind: "entry", Name: e.Name, Pairs: pairs, OK: pairsOK(pairs)}) }
+	}
+	rows, err := s.DB.Query(`SELECT name, template FROM boot_profiles ORDER BY name`)
+	if err != nil { return out }
+	defer rows.Close()
+	for rows.Next() {
+		var name, body string
+		if rows.Scan(&name, &body) != nil { continue }
+		pairs := s.profilePairs(body, staged)
+		if len(pairs) > 0 { out = append(out, bootPairReport{Kind: "profile", Name: name, Pairs: pairs, OK: pairsOK(pairs)}) }
+	}
+	return out
+}
+
+func (s *Server) kernelPairRoutes() {
+	// Pairing check of every stock entry and boot profile
+	s.Mux.HandleFunc("/api/v1/admin/boot-pairs", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		out := s.bootPairReports()
+		if out == nil { out = []bootPairReport{} }
+		writeJSON(w, 200, out)
+	})
+}
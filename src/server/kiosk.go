@@ -0,0 +1,168 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ---- Deploy kiosk links ----
+// An operator issues a time-boxed link (the URL is meant to be shown as a QR
+// code) that lets a field technician start deployments of pre-approved images
+// without Bootah credentials. Only the token hash is stored; deployments
+// started through a link are attributed to the operator who created it.
+func initKiosk(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS deploy_links (
+		id TEXT PRIMARY KEY,
+		token_hash TEXT UNIQUE NOT NULL,
+		image_ids TEXT NOT NULL,
+		template_id TEXT NOT NULL,
+		task_sequence_id TEXT,
+		note TEXT,
+		max_uses INTEGER NOT NULL DEFAULT 0,
+		uses INTEGER NOT NULL DEFAULT 0,
+		expires_at TEXT NOT NULL,
+		revoked INTEGER NOT NULL DEFAULT 0,
+		created_by INTEGER,
+		created_at TEXT NOT NULL
+	)`)
+	return err
+}
+
+type deployLink struct {
+	ID         string
+	ImageIDs   []string
+	TemplateID string
+	SequenceID string
+	MaxUses    int
+	Uses       int
+	ExpiresAt  time.Time
+	CreatedBy  *int64
+}
+
+// kioskLink resolves an unexpired, unrevoked link with uses left.
+func (s *Server) kioskLink(token string) (*deployLink, bool) {
+	var l deployLink
+	var images, exp string
+	var seq sql.NullString
+	var by sql.NullInt64
+	err := s.DB.QueryRow(`SELECT id, image_ids, template_id, task_sequence_id, max_uses, uses, expires_at, created_by FROM deploy_links WHERE token_hash=? AND revoked=0`, hashToken(token)).
+		Scan(&l.ID, &images, &l.TemplateID, &seq, &l.MaxUses, &l.Uses, &exp, &by)
+	if err != nil { return nil, false }
+	l.ImageIDs, l.SequenceID = splitList(images), seq.String
+	if by.Valid { l.CreatedBy = &by.Int64 }
+	l.ExpiresAt, _ = time.Parse(time.RFC3339, exp)
+	if time.Now().After(l.ExpiresAt) || (l.MaxUses > 0 && l.Uses >= l.MaxUses) { return nil, false }
+	return &l, true
+}
+
+func (s *Server) kioskRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/deploy_links", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := s.DB.Query(`SELECT id, image_ids, template_id, COALESCE(task_sequence_id,''), COALESCE(note,''), max_uses, uses, expires_at, revoked, created_at FROM deploy_links ORDER BY created_at DESC LIMIT 200`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			out := []map[string]any{}
+			for rows.Next() {
+				var id, images, tpl, seq, note, exp, created string
+				var maxUses, uses, revoked int
+				if err := rows.Scan(&id, &images, &tpl, &seq, &note, &maxUses, &uses, &exp, &revoked, &created); err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, map[string]any{"id": id, "image_ids": splitList(images), "template_id": tpl, "task_sequence_id": seq, "note": note,
+					"max_uses": maxUses, "uses": uses, "expires_at": exp, "revoked": revoked == 1, "created_at": created})
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPost:
+			var body struct {
+				ImageIDs   []string `json:"image_ids"`
+				TemplateID string   `json:"template_id"`
+				SequenceID string   `json:"task_sequence_id"`
+				Note       string   `json:"note"`
+				TTL        string   `json:"ttl"`
+				MaxUses    int      `json:"max_uses"`
+			}
+			if !decodeJSON(w, r, &body) { return }
+			if len(body.ImageIDs) == 0 { http.Error(w, "image_ids required", 400); return }
+			for _, id := range body.ImageIDs {
+				var n int
+				_ = s.DB.QueryRow(`SELECT COUNT(*) FROM images WHERE id=?`, id).Scan(&n)
+				if n == 0 || strings.Contains(id, ",") { http.Error(w, "unknown image "+id, 400); return }
+				if err := s.imageBootable(id); err != nil { http.Error(w, err.Error(), 409); return }
+			}
+			var n int
+			_ = s.DB.QueryRow(`SELECT COUNT(*) FROM templates WHERE id=?`, body.TemplateID).Scan(&n)
+			if n == 0 { http.Error(w, "unknown template", 400); return }
+			if body.SequenceID != "" {
+				if _, err := s.taskSequence(body.SequenceID); err != nil { http.Error(w, "unknown task sequence", 400); return }
+			}
+			if body.TTL == "" { body.TTL = "8h" }
+			ttl, err := time.ParseDuration(body.TTL)
+			if err != nil || ttl <= 0 || ttl > 7*24*time.Hour { http.Error(w, "ttl must be a duration up to 168h", 400); return }
+			actor := s.actorID(r)
+			var createdBy any
+			if actor != nil { createdBy = *actor }
+			id, token := "kl-"+genID(), randToken(24)
+			exp := time.Now().Add(ttl).UTC().Format(time.RFC3339)
+			_, err = s.DB.Exec(`INSERT INTO deploy_links (id, token_hash, image_ids, template_id, task_sequence_id, note, max_uses, expires_at, created_by, created_at) VALUES (?,?,?,?,?,?,?,?,?,?)`,
+				id, hashToken(token), strings.Join(body.ImageIDs, ","), body.TemplateID, body.SequenceID, body.Note, body.MaxUses, exp, createdBy, time.Now().UTC().Format(time.RFC3339))
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(actor, "create", "deploy_link", map[string]any{"id": id, "image_ids": body.ImageIDs, "expires_at": exp})
+			writeJSON(w, 201, map[string]any{"id": id, "token": token, "url": catalogBaseURL(r) + "/kiosk?t=" + token, "expires_at": exp})
+		case http.MethodDelete:
+			id := r.URL.Query().Get("id")
+			res, err := s.DB.Exec(`UPDATE deploy_links SET revoked=1 WHERE id=?`, id)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			if n, _ := res.RowsAffected(); n == 0 { http.NotFound(w, r); return }
+			s.audit(s.actorID(r), "revoke", "deploy_link", map[string]any{"id": id})
+			writeJSON(w, 200, map[string]any{"revoked": id})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// Kiosk side: GET /api/v1/kiosk/{token} lists the approved images,
+	// POST /api/v1/kiosk/{token}/deploy {mac, hostname, image_id} starts one.
+	s.Mux.HandleFunc("/api/v1/kiosk/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/kiosk/"), "/")
+		l, ok := s.kioskLink(parts[0])
+		if !ok { http.Error(w, "link invalid or expired", 403); return }
+		switch {
+		case len(parts) == 1 && r.Method == http.MethodGet:
+			images := []map[string]any{}
+			for _, id := range l.ImageIDs {
+				var name, typ string
+				if err := s.DB.QueryRow(`SELECT name, type FROM images WHERE id=? AND `+imagePublishedSQL, id).Scan(&name, &typ); err != nil { continue }
+				if ok, _ := s.imageAvailable(id, time.Now()); !ok { continue }
+				images = append(images, map[string]any{"id": id, "name": name, "type": typ})
+			}
+			out := map[string]any{"images": images, "expires_at": l.ExpiresAt.Format(time.RFC3339)}
+			if l.MaxUses > 0 { out["uses_left"] = l.MaxUses - l.Uses }
+			writeJSON(w, 200, out)
+		case len(parts) == 2 && parts[1] == "deploy" && r.Method == http.MethodPost:
+			var body struct {
+				MAC      string `json:"mac"`
+				Hostname string `json:"hostname"`
+				ImageID  string `json:"image_id"`
+			}
+			if !decodeJSON(w, r, &body) { return }
+			mac := normalizeMAC(body.MAC)
+			if mac == "" { http.Error(w, "mac required", 400); return }
+			allowed := false
+			for _, id := range l.ImageIDs { allowed = allowed || id == body.ImageID }
+			if !allowed { http.Error(w, "image not approved for this link", 403); return }
+			if err := s.imageBootable(body.ImageID); err != nil { http.Error(w, err.Error(), 409); return }
+			if ok, _ := s.imageAvailable(body.ImageID, time.Now()); !ok { http.Error(w, "image is outside its availability window", 409); return }
+			res, err := s.DB.Exec(`UPDATE deploy_links SET uses=uses+1 WHERE id=? AND (max_uses=0 OR uses<max_uses)`, l.ID)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			if n, _ := res.RowsAffected(); n == 0 { http.Error(w, "link invalid or expired", 403); return }
+			id, err := s.createDeployment(mac, strings.TrimSpace(body.Hostname), body.ImageID, l.TemplateID, l.SequenceID, l.CreatedBy)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(l.CreatedBy, "create", "deployment", map[string]any{"id": id, "mac": mac, "image_id": body.ImageID, "deploy_link": l.ID, "ip": r.RemoteAddr})
+			writeJSON(w, 201, map[string]any{"id": id, "status": "pending"})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ---- LDAP / Active Directory login ----
+// With BOOTAH_LDAP_URL set (ldaps://dc.corp.example:636, or ldap://... which
+// is upgraded with StartTLS unless BOOTAH_LDAP_STARTTLS=false),
+// /api/v1/auth/login also accepts directory accounts. Users with a local
+// password keep logging in locally; anyone else is looked up under
+// BOOTAH_LDAP_BASE_DN with BOOTAH_LDAP_USER_FILTER ({user} is the login name,
+// escaped; the default matches sAMAccountName, userPrincipalName or mail),
+// binding first as BOOTAH_LDAP_BIND_DN / BOOTAH_LDAP_BIND_PASSWORD (anonymous
+// when unset), and then as the user found, with their password.
+//
+// Roles come from group filters, BOOTAH_LDAP_ROLE_FILTERS="role=filter;...",
+// tried in order against the user's entry; the first that matches gives the
+// role, e.g. admin=(memberOf:1.2.840.113556.1.4.1941:=CN=Bootah
+// Admins,OU=Groups,DC=corp,DC=example) for membership through nested AD
+// groups. Users matching none get BOOTAH_LDAP_DEFAULT_ROLE, or are refused when
+// it is unset. Startup fails when a filter or the default names a role that
+// doesn't exist; one deleted later refuses the users mapped to it. The account
+// is created on first login with the email from BOOTAH_LDAP_EMAIL_ATTR (default
+// mail, falling back to userPrincipalName) and marked as a directory account
+// (users.source); accounts created any other way are never taken over, whatever
+// the case of their email. Every token refresh looks the entry up again with
+// the service bind: an entry that is gone, fails BOOTAH_LDAP_ACTIVE_FILTER (by
+// default not disabled in AD) or no longer maps to a role ends the session, and
+// a changed role applies at once. BOOTAH_LDAP_CA_FILE adds a CA for the
+// directory's certificate.
+var errLDAPInvalid = errors.New("invalid directory credentials")
+
+func ldapConfigured() bool { return getenv("BOOTAH_LDAP_URL", "") != "" && getenv("BOOTAH_LDAP_BASE_DN", "") != "" }
+
+const ldapDefaultActiveFilter = "(|(!(userAccountControl=*))(!(userAccountControl:1.2.840.113556.1.4.803:=2)))"
+
+func ldapTLSConfig(host string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	if f := getenv("BOOTAH_LDAP_CA_FILE", ""); f != "" {
+		pem, err := os.ReadFile(f)
+		if err != nil { return nil, err }
+		pool, err := x509.SystemCertPool()
+		if err != nil { pool = x509.NewCertPool() }
+		if !pool.AppendCertsFromPEM(pem) { return nil, fmt.Errorf("BOOTAH_LDAP_CA_FILE %s: no certificates", f) }
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// dialLDAP connects to the directory and binds as the service account, if
+// one is configured.
+func dialLDAP() (*ldap.Conn, error) {
+	u, err := url.Parse(getenv("BOOTAH_LDAP_URL", ""))
+	if err != nil { return nil, err }
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" { return nil, fmt.Errorf("BOOTAH_LDAP_URL: unsupported scheme %q", u.Scheme) }
+	tcfg, err := ldapTLSConfig(u.Hostname())
+	if err != nil { return nil, err }
+	l, err := ldap.DialURL(u.String(), ldap.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}), ldap.DialWithTLSConfig(tcfg))
+	if err != nil { return nil, err }
+	l.SetTimeout(30 * time.Second)
+	if u.Scheme == "ldap" && getenv("BOOTAH_LDAP_STARTTLS", "true") == "true" {
+		if err := l.StartTLS(tcfg); err != nil { l.Close(); return nil, err }
+	}
+	if err := ldapServiceBind(l); err != nil { l.Close(); return nil, err }
+	return l, nil
+}
+
+func ldapServiceBind(l *ldap.Conn) error {
+	dn := getenv("BOOTAH_LDAP_BIND_DN", "")
+	if dn == "" { return nil }
+	if err := l.Bind(dn, getenv("BOOTAH_LDAP_BIND_PASSWORD", "")); err != nil { return fmt.Errorf("ldap service bind: %w", err) }
+	return nil
+}
+
+// ldapSearch runs a search returning at most limit entries; running into the
+// limit or a missing base still returns what was found.
+func ldapSearch(l *ldap.Conn, base string, scope int, filter string, limit int, attrs ...string) ([]*ldap.Entry, error) {
+	res, err := l.Search(ldap.NewSearchRequest(base, scope, ldap.NeverDerefAliases, limit, 10, false, filter, attrs, nil))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) && !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) { return nil, err }
+	if res == nil { return nil, nil }
+	return res.Entries, nil
+}
+
+// ldapRoleFilters parses BOOTAH_LDAP_ROLE_FILTERS in order.
+func ldapRoleFilters() [][2]string {
+	var out [][2]string
+	for _, part := range strings.Split(getenv("BOOTAH_LDAP_ROLE_FILTERS", ""), ";") {
+		role, filter, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok && role != "" && filter != "" { out = append(out, [2]string{strings.TrimSpace(role), strings.TrimSpace(filter)}) }
+	}
+	return out
+}
+
+// checkLDAPRoles makes sure every role BOOTAH_LDAP_ROLE_FILTERS and
+// BOOTAH_LDAP_DEFAULT_ROLE map to exists.
+func (s *Server) checkLDAPRoles() error {
+	for _, rf := range ldapRoleFilters() {
+		if !s.roleExists(rf[0]) { return fmt.Errorf("BOOTAH_LDAP_ROLE_FILTERS: unknown role %q", rf[0]) }
+	}
+	if role := getenv("BOOTAH_LDAP_DEFAULT_ROLE", ""); role != "" && !s.roleExists(role) { return fmt.Errorf("BOOTAH_LDAP_DEFAULT_ROLE: unknown role %q", role) }
+	return nil
+}
+
+// ldapRole maps the entry at dn to a role, or returns errLDAPInvalid when
+// no filter matches and there is no default role, or the role it maps to
+// no longer exists.
+func (s *Server) ldapRole(l *ldap.Conn, dn string) (string, error) {
+	for _, rf := range ldapRoleFilters() {
+		found, err := ldapSearch(l, dn, ldap.ScopeBaseObject, rf[1], 1)
+		if err != nil { return "", fmt.Errorf("role filter for %s: %w", rf[0], err) }
+		if len(found) == 0 { continue }
+		if !s.roleExists(rf[0]) { return "", errLDAPInvalid }
+		return rf[0], nil
+	}
+	role := getenv("BOOTAH_LDAP_DEFAULT_ROLE", "")
+	if role == "" || !s.roleExists(role) { return "", errLDAPInvalid }
+	return role, nil
+}
+
+// ldapAuthenticate checks login and password against the directory and
+// returns the user's email, DN and mapped role.
+func (s *Server) ldapAuthenticate(login, password string) (string, string, string, error) {
+	// an empty password would be an unauthenticated bind, which succeeds
+	if strings.TrimSpace(login) == "" || password == "" { return "", "", "", errLDAPInvalid }
+	l, err := dialLDAP()
+	if err != nil { return "", "", "", err }
+	defer l.Close()
+	filter := strings.ReplaceAll(getenv("BOOTAH_LDAP_USER_FILTER", "(&(objectClass=user)(|(sAMAccountName={user})(userPrincipalName={user})(mail={user})))"), "{user}", ldap.EscapeFilter(login))
+	emailAttr := getenv("BOOTAH_LDAP_EMAIL_ATTR", "mail")
+	entries, err := ldapSearch(l, getenv("BOOTAH_LDAP_BASE_DN", ""), ldap.ScopeWholeSubtree, filter, 2, emailAttr, "userPrincipalName")
+	if err != nil { return "", "", "", err }
+	if len(entries) != 1 { return "", "", "", errLDAPInvalid }
+	user := entries[0]
+	if err := l.Bind(user.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) { return "", "", "", errLDAPInvalid }
+		return "", "", "", err
+	}
+	if err := ldapServiceBind(l); err != nil { return "", "", "", err }
+	email := ""
+	for _, a := range []string{emailAttr, "userPrincipalName"} {
+		if v := user.GetEqualFoldAttributeValue(a); strings.Contains(v, "@") { email = strings.ToLower(v); break }
+	}
+	if email == "" { return "", "", "", fmt.Errorf("directory entry %s has no %s", user.DN, emailAttr) }
+	role, err := s.ldapRole(l, user.DN)
+	if errors.Is(err, errLDAPInvalid) { return "", "", "", fmt.Errorf("%s is not in any group that grants a Bootah role", email) }
+	if err != nil { return "", "", "", err }
+	return email, user.DN, role, nil
+}
+
+// ldapRecheck looks a directory account up again without its password and
+// returns its current role; errLDAPInvalid means it is gone, disabled or no
+// longer maps to a role.
+func (s *Server) ldapRecheck(dn string) (string, error) {
+	if dn == "" { return "", errLDAPInvalid }
+	l, err := dialLDAP()
+	if err != nil { return "", err }
+	defer l.Close()
+	found, err := ldapSearch(l, dn, ldap.ScopeBaseObject, getenv("BOOTAH_LDAP_ACTIVE_FILTER", ldapDefaultActiveFilter), 1)
+	if err != nil { return "", err }
+	if len(found) == 0 { return "", errLDAPInvalid }
+	return s.ldapRole(l, dn)
+}
+
+// provisionLDAPUser creates the account of a directory user on first login
+// and keeps its DN and role current. It returns errLDAPInvalid for accounts
+// that were not created from the directory.
+func (s *Server) provisionLDAPUser(email, dn, role string) (int64, error) {
+	var id int64
+	var source string
+	err := s.DB.QueryRow(`SELECT id, source FROM users WHERE LOWER(email)=?`, strings.ToLower(email)).Scan(&id, &source)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = s.DB.QueryRow(`INSERT INTO users (email, passhash, role, source, directory_dn, created_at) VALUES (?,?,?,'ldap',?,?) RETURNING id`, email, "", role, dn, time.Now().Format(time.RFC3339)).Scan(&id)
+		if err != nil { return 0, err }
+		s.audit(&id, "provision", "user", map[string]any{"email": email, "role": role, "source": "ldap"})
+		s.notify("info", "user_created", "New directory account "+email+" created with role "+role, map[string]any{"user_id": id, "email": email, "role": role})
+		return id, nil
+	}
+	if err != nil { return 0, err }
+	if source != "ldap" { return 0, errLDAPInvalid }
+	if _, err := s.DB.Exec(`UPDATE users SET directory_dn=? WHERE id=?`, dn, id); err != nil { return 0, err }
+	return id, s.syncLDAPRole(id, role)
+}
+
+// syncLDAPRole applies a directory user's current role, ending their
+// sessions when it changed.
+func (s *Server) syncLDAPRole(id int64, role string) error {
+	res, err := s.DB.Exec(`UPDATE users SET role=? WHERE id=? AND role<>?`, role, id, role)
+	if err != nil { return err }
+	if n, _ := res.RowsAffected(); n > 0 {
+		s.revokeSessions(id, "", "role_change")
+		s.audit(nil, "role_update", "user", map[string]any{"id": id, "role": role})
+	}
+	return nil
+}
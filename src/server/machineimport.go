@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ---- Bulk machine import ----
+// POST /api/v1/machines/import registers machines in bulk from a CSV file
+// (header row; mac, hostname, ip, uuid, serial, model, boot_profile and tags
+// columns, Kea's lease CSV works as is), an ISC dhcpd.leases or dhcpd.conf
+// host list, or a Kea lease4-get-all JSON reply. ?format=csv|dhcpd|kea picks
+// the parser, otherwise it is guessed from the body. Rows are keyed by MAC:
+// repeats within the file merge (later rows win) and machines already on
+// record only get their empty fields filled, unless ?overwrite=1. Tags are
+// added, never removed; the address is kept as the ip_address machine field.
+// ?dry_run=1 reports what would change without writing.
+type importedMachine struct {
+	Line                                            int
+	MAC, Hostname, IP, UUID, Serial, Model, Profile string
+	Tags                                            []string
+}
+
+type importError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+const machineImportMax = 32 << 20
+
+// machineImportSnapshot renders what an import can change on one machine,
+// to tell updated records from unchanged ones.
+const machineImportSnapshot = `SELECT COALESCE(uuid,'')||'|'||COALESCE(serial,'')||'|'||COALESCE(hostname,'')||'|'||COALESCE(model,'')||'|'||COALESCE(boot_profile,'')||'|'||
+	COALESCE((SELECT value FROM machine_fields f WHERE f.mac=machines.mac AND f.name='ip_address'),'')||'|'||
+	COALESCE((SELECT group_concat(tag) FROM (SELECT tag FROM machine_tags t WHERE t.mac=machines.mac ORDER BY tag) o),'') FROM machines WHERE mac=?`
+
+var dhcpdBlockRe = regexp.MustCompile(`^(lease|host)\s+("[^"]*"|\S+)\s*\{`)
+
+// merge copies the non-empty fields of o over m.
+func (m *importedMachine) merge(o importedMachine) {
+	for _, f := range []struct{ dst *string; v string }{{&m.Hostname, o.Hostname}, {&m.IP, o.IP}, {&m.UUID, o.UUID}, {&m.Serial, o.Serial}, {&m.Model, o.Model}, {&m.Profile, o.Profile}} {
+		if f.v != "" { *f.dst = f.v }
+	}
+	m.Tags = append(m.Tags, o.Tags...)
+	m.Line = o.Line
+}
+
+// check normalizes and validates one row.
+func (m *importedMachine) check() error {
+	m.MAC = normalizeMAC(m.MAC)
+	if _, err := net.ParseMAC(m.MAC); err != nil || m.MAC == "" { return fmt.Errorf("invalid mac %q", m.MAC) }
+	m.Hostname = strings.TrimSuffix(strings.TrimSpace(m.Hostname), ".")
+	if len(m.Hostname) > 253 { return fmt.Errorf("hostname too long") }
+	if m.IP = strings.TrimSpace(m.IP); m.IP != "" && net.ParseIP(m.IP) == nil { return fmt.Errorf("invalid ip %q", m.IP) }
+	if m.UUID = strings.TrimSpace(m.UUID); m.UUID != "" {
+		if len(strings.ReplaceAll(m.UUID, "-", "")) != 32 { return fmt.Errorf("invalid uuid") }
+		m.UUID = normalizeUUID(m.UUID) // placeholders are dropped
+	}
+	m.Serial, m.Model, m.Profile = normalizeSerial(m.Serial), strings.TrimSpace(m.Model), strings.TrimSpace(m.Profile)
+	tags, err := normalizeTags(m.Tags)
+	if err != nil { return err }
+	m.Tags = tags
+	return nil
+}
+
+// detectImportFormat guesses the format of an import body.
+func detectImportFormat(body []byte) string {
+	t := bytes.TrimSpace(body)
+	if len(t) > 0 && (t[0] == '{' || t[0] == '[') { return "kea" }
+	sc := bufio.NewScanner(bytes.NewReader(t))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") { continue }
+		if dhcpdBlockRe.MatchString(line) || strings.HasPrefix(line, "authoring-byte-order") || strings.HasPrefix(line, "server-duid") { return "dhcpd" }
+		break
+	}
+	return "csv"
+}
+
+// parseImportCSV reads a CSV with a header row. Column names are matched
+// case-insensitively, with Kea's names (hwaddr, address) as aliases.
+func parseImportCSV(body []byte) ([]importedMachine, []importError) {
+	cr := csv.NewReader(bytes.NewReader(body))
+	cr.FieldsPerRecord, cr.TrimLeadingSpace, cr.Comment = -1, true, '#'
+	header, err := cr.Read()
+	if err != nil { return nil, []importError{{1, "header row: " + err.Error()}} }
+	cols := map[string]int{}
+	aliases := map[string]string{"hwaddr": "mac", "mac_address": "mac", "hw-address": "mac", "address": "ip", "ip_address": "ip", "ip-address": "ip",
+		"host": "hostname", "name": "hostname", "profile": "boot_profile"}
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+		if a, ok := aliases[h]; ok { h = a }
+		if _, dup := cols[h]; !dup { cols[h] = i }
+	}
+	if _, ok := cols["mac"]; !ok { return nil, []importError{{1, "no mac column"}} }
+	_, keaState := cols["state"]
+	var out []importedMachine
+	var errs []importError
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF { break }
+		line, _ := cr.FieldPos(0)
+		if err != nil { errs = append(errs, importError{line, err.Error()}); continue }
+		get := func(c string) string {
+			if i, ok := cols[c]; ok && i < len(rec) { return strings.TrimSpace(rec[i]) }
+			return ""
+		}
+		if keaState && get("state") == "1" { continue } // declined address
+		m := importedMachine{Line: line, MAC: get("mac"), Hostname: get("hostname"), IP: get("ip"), UUID: get("uuid"), Serial: get("serial"),
+			Model: get("model"), Profile: get("boot_profile")}
+		if t := get("tags"); t != "" { m.Tags = strings.FieldsFunc(t, func(r rune) bool { return r == ';' || r == ' ' || r == '|' }) }
+		out = append(out, m)
+	}
+	return out, errs
+}
+
+// parseDHCPDLeases reads lease blocks from dhcpd.leases and host blocks
+// from dhcpd.conf; later blocks for the same MAC win, as in the lease file.
+func parseDHCPDLeases(body []byte) ([]importedMachine, []importError) {
+	var out []importedMachine
+	var errs []importError
+	var cur *importedMachine
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	split := strings.NewReplacer("{", "{\n", "}", "\n}\n", ";", ";\n")
+	for n := 1; sc.Scan(); n++ {
+		text := sc.Text()
+		if i := strings.Index(text, "#"); i >= 0 && !strings.Contains(text[:i], `"`) { text = text[:i] }
+		for _, line := range strings.Split(split.Replace(text), "\n") {
+			if line = strings.TrimSpace(line); line == "" { continue }
+			if m := dhcpdBlockRe.FindStringSubmatch(line); m != nil {
+				if cur != nil { errs = append(errs, importError{cur.Line, "unterminated block"}) }
+				cur = &importedMachine{Line: n}
+				if m[1] == "lease" { cur.IP = m[2] } else { cur.Hostname = strings.Trim(m[2], `"`) }
+				continue
+			}
+			if cur == nil { continue }
+			if line == "}" {
+				if cur.MAC != "" { out = append(out, *cur) }
+				cur = nil
+				continue
+			}
+			switch f := strings.Fields(strings.TrimSuffix(line, ";")); {
+			case len(f) == 3 && f[0] == "hardware" && f[1] == "ethernet":
+				cur.MAC = f[2]
+			case len(f) == 2 && f[0] == "client-hostname":
+				cur.Hostname = strings.Trim(f[1], `"`)
+			case len(f) == 2 && f[0] == "fixed-address":
+				cur.IP = f[1]
+			case len(f) >= 3 && f[0] == "option" && f[1] == "host-name":
+				cur.Hostname = strings.Trim(strings.Join(f[2:], " "), `"`)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil { errs = append(errs, importError{0, err.Error()}) }
+	if cur != nil { errs = append(errs, importError{cur.Line, "unterminated block"}) }
+	return out, errs
+}
+
+// parseKeaLeases reads a lease4-get-all reply (optionally wrapped in the
+// control agent's array) or a bare lease array.
+func parseKeaLeases(body []byte) ([]importedMachine, []importError) {
+	type keaLease struct {
+		HWAddress string `json:"hw-address"`
+		IPAddress string `json:"ip-address"`
+		Hostname  string `json:"hostname"`
+		State     int    `json:"state"`
+	}
+	type keaReply struct {
+		Arguments struct{ Leases []keaLease `json:"leases"` } `json:"arguments"`
+	}
+	var leases []keaLease
+	var one keaReply
+	var many []keaReply
+	switch {
+	case json.Unmarshal(body, &one) == nil:
+		leases = one.Arguments.Leases
+	case json.Unmarshal(body, &many) == nil && len(many) > 0 && many[0].Arguments.Leases != nil:
+		for _, r := range many { leases = append(leases, r.Arguments.Leases...) }
+	default:
+		if err := json.Unmarshal(body, &leases); err != nil { return nil, []importError{{0, "invalid Kea JSON: " + err.Error()}} }
+	}
+	var out []importedMachine
+	for i, l := range leases {
+		if l.State == 1 || l.HWAddress == "" { continue }
+		out = append(out, importedMachine{Line: i + 1, MAC: l.HWAddress, IP: l.IPAddress, Hostname: l.Hostname})
+	}
+	return out, nil
+}
+
+// importMachines validates and merges rows, then creates or fills in the
+// machine records. Counts are returned as created, updated and unchanged.
+func (s *Server) importMachines(rows []importedMachine, overwrite, dryRun bool) (map[string]int, []importError, error) {
+	var errs []importError
+	byMAC := map[string]*importedMachine{}
+	var order []string
+	for _, m := range rows {
+		if err := m.check(); err != nil { errs = append(errs, importError{m.Line, err.Error()}); continue }
+		if m.Profile != "" && !s.bootProfileExists(m.Profile) { errs = append(errs, importError{m.Line, "unknown boot_profile " + m.Profile}); continue }
+		if prev, ok := byMAC[m.MAC]; ok { prev.merge(m); continue }
+		mm := m
+		byMAC[m.MAC], order = &mm, append(order, m.MAC)
+	}
+	counts := map[string]int{"created": 0, "updated": 0, "unchanged": 0}
+	tx, err := s.DB.Begin()
+	if err != nil { return nil, nil, err }
+	defer tx.Rollback()
+	now := time.Now().UTC().Format(time.RFC3339)
+	set := "COALESCE(machines.%[1]s, excluded.%[1]s)"
+	if overwrite { set = "COALESCE(excluded.%[1]s, machines.%[1]s)" }
+	var assigns []string
+	for _, c := range []string{"uuid", "serial", "hostname", "model", "boot_profile"} { assigns = append(assigns, c+"="+fmt.Sprintf(set, c)) }
+	upsert := `INSERT INTO machines (mac, first_seen, uuid, serial, hostname, model, boot_profile) VALUES (?,?,NULLIF(?,''),NULLIF(?,''),NULLIF(?,''),NULLIF(?,''),NULLIF(?,''))
+		ON CONFLICT(mac) DO UPDATE SET ` + strings.Join(assigns, ", ")
+	for _, mac := range order {
+		m := byMAC[mac]
+		var before string
+		err := tx.QueryRow(machineImportSnapshot, mac).Scan(&before)
+		exists := err == nil
+		if _, err := tx.Exec(upsert, mac, now, m.UUID, m.Serial, m.Hostname, m.Model, m.Profile); err != nil { return nil, nil, err }
+		if m.IP != "" {
+			cond := ""
+			if !overwrite { cond = " WHERE machine_fields.value=''" }
+			if _, err := tx.Exec(`INSERT INTO machine_fields (mac, name, value, source, updated) VALUES (?,'ip_address',?,'import',?)
+				ON CONFLICT(mac, name) DO UPDATE SET value=excluded.value, source=excluded.source, updated=excluded.updated`+cond, mac, m.IP, now); err != nil { return nil, nil, err }
+		}
+		for _, t := range m.Tags {
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO machine_tags (mac, tag) VALUES (?,?)`, mac, t); err != nil { return nil, nil, err }
+		}
+		if !exists { counts["created"]++; continue }
+		var after string
+		_ = tx.QueryRow(machineImportSnapshot, mac).Scan(&after)
+		if after != before { counts["updated"]++ } else { counts["unchanged"]++ }
+	}
+	if dryRun { return counts, errs, nil }
+	return counts, errs, tx.Commit()
+}
+
+func (s *Server) machineImportRoutes() {
+	s.Mux.HandleFunc("/api/v1/machines/import", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		body, err := io.ReadAll(io.LimitReader(r.Body, machineImportMax+1))
+		if err != nil { http.Error(w, err.Error(), 400); return }
+		if len(body) > machineImportMax { http.Error(w, "import too large", 413); return }
+		q := r.URL.Query()
+		format := strings.ToLower(q.Get("format"))
+		if format == "" { format = detectImportFormat(body) }
+		var rows []importedMachine
+		var errs []importError
+		switch format {
+		case "csv":
+			rows, errs = parseImportCSV(body)
+		case "dhcpd":
+			rows, errs = parseDHCPDLeases(body)
+		case "kea":
+			rows, errs = parseKeaLeases(body)
+		default:
+			http.Error(w, "format must be csv, dhcpd or kea", 400); return
+		}
+		dryRun := isDryRun(r)
+		counts, rowErrs, err := s.importMachines(rows, q.Get("overwrite") == "1", dryRun)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		errs = append(errs, rowErrs...)
+		if !dryRun {
+			s.audit(s.actorID(r), "import", "machine", map[string]any{"format": format, "created": counts["created"], "updated": counts["updated"], "errors": len(errs)})
+		}
+		writeJSON(w, 200, map[string]any{"format": format, "dry_run": dryRun, "rows": len(rows), "created": counts["created"], "updated": counts["updated"],
+			"unchanged": counts["unchanged"], "errors": errs})
+	})
+}
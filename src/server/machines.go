@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---- Machine records ----
+// Every boot script request carrying ?mac= upserts the machine: boot count,
+// last boot time and address, plus the SMBIOS UUID and serial when iPXE
+// passes them (a request without ?mac= is answered with a chain to itself
+// carrying ${net0/mac}, ${uuid} and ${serial}). Machines can also be
+// registered ahead of their first boot through /api/v1/machines, with a
+// hostname, model and boot profile (see boot profiles). Successful
+// deployments stamp the image they installed, and can switch the machine
+// back to local boot (see profile reversion). Machines not seen for
+// BOOTAH_MACHINE_STALE_DAYS (default 90) are flagged stale by the leader
+// every six hours, with one notification per machine; booting again clears
+// the flag.
+func initMachines(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS machines (
+		mac TEXT PRIMARY KEY,
+		first_seen TEXT NOT NULL,
+		last_boot_at TEXT,
+		last_boot_ip TEXT,
+		boot_count INTEGER NOT NULL DEFAULT 0,
+		last_image_id TEXT,
+		last_deployed_at TEXT,
+		stale INTEGER NOT NULL DEFAULT 0
+	)`)
+	return err
+}
+
+type Machine struct {
+	MAC            string            `json:"mac"`
+	UUID           string            `json:"uuid,omitempty"`
+	Hostname       string            `json:"hostname,omitempty"`
+	BootProfile    string            `json:"boot_profile,omitempty"`
+	BootProfileOnce bool             `json:"boot_profile_once,omitempty"`
+	RevertAt       string            `json:"revert_at,omitempty"`
+	FirstSeen      string            `json:"first_seen"`
+	LastBootAt     string            `json:"last_boot_at,omitempty"`
+	LastBootIP     string            `json:"last_boot_ip,omitempty"`
+	BootCount      int64             `json:"boot_count"`
+	LastImageID    string            `json:"last_image_id,omitempty"`
+	LastDeployedAt string            `json:"last_deployed_at,omitempty"`
+	Stale          bool              `json:"stale"`
+	Vendor         string            `json:"vendor,omitempty"`
+	Model          string            `json:"model,omitempty"`
+	Serial         string            `json:"serial,omitempty"`
+	Fields         map[string]string `json:"fields,omitempty"`
+	Tags           []string          `json:"tags,omitempty"`
+}
+
+func machineStaleDays() int {
+	n, err := strconv.Atoi(getenv("BOOTAH_MACHINE_STALE_DAYS", "90"))
+	if err != nil || n <= 0 { return 90 }
+	return n
+}
+
+// normalizeUUID lower-cases a SMBIOS UUID; "" when it is missing, not 32
+// hex digits (dashes aside) or one of the placeholder values firmware
+// reports when it has none.
+func normalizeUUID(v string) string {
+	v = strings.ToLower(strings.TrimSpace(v))
+	h := strings.ReplaceAll(v, "-", "")
+	if _, err := hex.DecodeString(h); err != nil || len(h) != 32 || strings.Count(h, h[:1]) == len(h) || placeholderUUIDs[h] { return "" }
+	return v
+}
+
+// normalizeSerial trims a serial number; "" when it is missing or a
+// placeholder. Firmware whose vendor never set a serial reports the same
+// stand-in on every board, so matching on one would tie unrelated machines
+// together.
+func normalizeSerial(v string) string {
+	v = strings.TrimSpace(v)
+	k := strings.ToLower(strings.Join(strings.Fields(v), " "))
+	if k == "" || strings.Count(k, k[:1]) == len(k) || placeholderSerials[k] { return "" }
+	return v
+}
+
+// placeholderUUIDs and placeholderSerials are stand-ins seen in the wild,
+// besides all-zero, all-F and other single-character values. Serials are
+// lower-cased with runs of spaces collapsed.
+var (
+	placeholderUUIDs = map[string]bool{
+		"03000200040005000006000700080009": true, // AMI board template
+		"00020003000400050006000700080009": true,
+		"0123456789abcdef0123456789abcdef": true,
+		"12345678123456781234567812345678": true,
+	}
+	placeholderSerials = map[string]bool{
+		"to be filled by o.e.m.": true, "to be filled by oem": true, "default string": true, "default": true,
+		"system serial number": true, "chassis serial number": true, "base board serial number": true, "serial number": true,
+		"not specified": true, "not applicable": true, "not available": true, "none": true, "n/a": true, "na": true,
+		"unknown": true, "invalid": true, "empty": true, "oem": true, "o.e.m.": true,
+		"0123456789": true, "123456789": true, "1234567890": true, "123456789012": true,
+	}
+)
+
+// recordBoot counts a boot script request for mac; empty uuid or serial
+// leave the stored values alone.
+func (s *Server) recordBoot(mac, ip, uuid, serial string) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	_, err := s.DB.Exec(`INSERT INTO machines (mac, first_seen, last_boot_at, last_boot_ip, boot_count, uuid, serial) VALUES (?,?,?,?,1,NULLIF(?,''),NULLIF(?,''))
+		ON CONFLICT(mac) DO UPDATE SET last_boot_at=excluded.last_boot_at, last_boot_ip=excluded.last_boot_ip, boot_count=machines.boot_count+1, stale=0,
+			uuid=COALESCE(excluded.uuid, machines.uuid), serial=COALESCE(excluded.serial, machines.serial)`,
+		mac, now, now, ip, normalizeUUID(uuid), normalizeSerial(serial))
+	if err != nil { log.Printf("record boot %s: %v", mac, err) }
+}
+
+// recordDeployed stamps the image a successful deployment installed.
+func (s *Server) recordDeployed(mac, imageID string) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	_, _ = s.DB.Exec(`INSERT INTO machines (mac, first_seen, last_image_id, last_deployed_at) VALUES (?,?,?,?)
+		ON CONFLICT(mac) DO UPDATE SET last_image_id=excluded.last_image_id, last_deployed_at=excluded.last_deployed_at`, mac, now, imageID, now)
+}
+
+// flagStaleMachines marks machines unseen for the configured period.
+func (s *Server) flagStaleMachines() {
+	days := machineStaleDays()
+	cutoff := time.Now().UTC().AddDate(0, 0, -days).Format(time.RFC3339)
+	rows, err := s.DB.Query(`SELECT mac FROM machines WHERE stale=0 AND COALESCE(last_boot_at, first_seen) < ?`, cutoff)
+	if err != nil { log.Printf("stale machines: %v", err); return }
+	var macs []string
+	for rows.Next() {
+		var mac string
+		if rows.Scan(&mac) == nil { macs = append(macs, mac) }
+	}
+	rows.Close()
+	for _, mac := range macs {
+		if _, err := s.DB.Exec(`UPDATE machines SET stale=1 WHERE mac=?`, mac); err != nil { continue }
+		s.notify("info", "machine_stale", "Machine "+mac+" has not booted in "+strconv.Itoa(days)+" days", map[string]any{"mac": mac})
+	}
+}
+
+// Model and serial set on the machine win over the latest inventory report.
+const machineColumns = `m.mac, m.first_seen, COALESCE(m.last_boot_at,''), COALESCE(m.last_boot_ip,''), m.boot_count, COALESCE(m.last_image_id,''),
+	COALESCE(m.last_deployed_at,''), m.stale, COALESCE(i.vendor,''), COALESCE(m.model, i.model, ''), COALESCE(m.serial, i.serial, ''),
+	COALESCE(m.uuid, i.uuid, ''), COALESCE(m.hostname,''), COALESCE(m.boot_profile,''), COALESCE(m.boot_profile_once,0)=1, COALESCE(m.revert_at,'')
+	FROM machines m LEFT JOIN inventory i ON i.id = (SELECT MAX(id) FROM inventory l WHERE l.mac=m.mac)`
+
+func scanMachine(row interface{ Scan(...any) error }) (*Machine, error) {
+	var m Machine
+	err := row.Scan(&m.MAC, &m.FirstSeen, &m.LastBootAt, &m.LastBootIP, &m.BootCount, &m.LastImageID, &m.LastDeployedAt, &m.Stale, &m.Vendor, &m.Model, &m.Serial,
+		&m.UUID, &m.Hostname, &m.BootProfile, &m.BootProfileOnce, &m.RevertAt)
+	return &m, err
+}
+
+// machineBootProfile returns the boot profile id or entry name assigned to
+// mac, "" for none.
+func (s *Server) machineBootProfile(mac string) string {
+	var p string
+	_ = s.DB.QueryRow(`SELECT COALESCE(boot_profile,'') FROM machines WHERE mac=?`, mac).Scan(&p)
+	return p
+}
+
+// machineRegistration is the writable part of a machine record. Pointer
+// fields left out of a PATCH keep their value; "" clears one.
+type machineRegistration struct {
+	MAC         string  `json:"mac"`
+	UUID        *string `json:"uuid"`
+	Serial      *string `json:"serial"`
+	Hostname    *string `json:"hostname"`
+	Model       *string `json:"model"`
+	BootProfile *string `json:"boot_profile"`
+	Once        *bool     `json:"boot_profile_once"` // revert after the next successful deployment
+	Tags        *[]string `json:"tags"`               // replaces every tag
+}
+
+func (m *machineRegistration) validate() error {
+	if m.UUID != nil && *m.UUID != "" {
+		if u := normalizeUUID(*m.UUID); u == "" { return fmt.Errorf("invalid uuid %q", *m.UUID) } else { m.UUID = &u }
+	}
+	if m.Serial != nil && strings.TrimSpace(*m.Serial) != "" {
+		if v := normalizeSerial(*m.Serial); v == "" { return fmt.Errorf("serial %q is a firmware placeholder", *m.Serial) } else { m.Serial = &v }
+	}
+	if m.Hostname != nil && len(*m.Hostname) > 253 { return errors.New("hostname too long") }
+	if m.Tags != nil {
+		tags, err := normalizeTags(*m.Tags)
+		if err != nil { return err }
+		m.Tags = &tags
+	}
+	return nil
+}
+
+// lookupMachineMAC resolves a MAC, SMBIOS UUID or serial to a machine MAC.
+func (s *Server) lookupMachineMAC(id string) (string, error) {
+	var mac string
+	err := s.DB.QueryRow(`SELECT m.mac FROM machines m WHERE m.mac=? OR m.uuid=NULLIF(?,'') OR m.serial=NULLIF(?,'') ORDER BY m.mac=? DESC LIMIT 1`,
+		normalizeMAC(id), normalizeUUID(id), normalizeSerial(id), normalizeMAC(id)).Scan(&mac)
+	return mac, err
+}
+
+func (s *Server) startMachines(ctx context.Context) {
+	go s.runAsLeader(ctx, "stale-machines", 6*time.Hour, s.flagStaleMachines)
+	go s.runAsLeader(ctx, "profile-revert", time.Minute, s.revertDueProfiles)
+}
+
+func (s *Server) machineRoutes() {
+	// GET ?stale=1 only flagged machines; ?unseen_days=N machines not booted in
+	// N days; ?uuid=, ?serial=, ?hostname=, ?tag= exact matches; ?q= a machine
+	// query and ?search= a saved search by id or name. POST registers one.
+	s.Mux.HandleFunc("/api/v1/machines", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		if r.Method == http.MethodPost {
+			var body machineRegistration
+			if !decodeJSON(w, r, &body) { return }
+			mac := normalizeMAC(body.MAC)
+			if mac == "" { http.Error(w, "valid mac required", 400); return }
+			if err := body.validate(); err != nil { badRequest(w, err); return }
+			if body.BootProfile != nil && *body.BootProfile != "" && !s.bootProfileExists(*body.BootProfile) { http.Error(w, "unknown boot_profile", 400); return }
+			var n int
+			_ = s.DB.QueryRow(`SELECT COUNT(*) FROM machines WHERE mac=?`, mac).Scan(&n)
+			if n > 0 { http.Error(w, "machine already registered", 409); return }
+			str := func(p *string) any { if p == nil || *p == "" { return nil }; return *p }
+			_, err := s.DB.Exec(`INSERT INTO machines (mac, first_seen, uuid, serial, hostname, model, boot_profile, boot_profile_once) VALUES (?,?,?,?,?,?,?,?)`,
+				mac, time.Now().UTC().Format(time.RFC3339), str(body.UUID), str(body.Serial), str(body.Hostname), str(body.Model), str(body.BootProfile), body.Once != nil && *body.Once)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			if body.Tags != nil {
+				if err := s.setMachineTags(mac, *body.Tags); err != nil { http.Error(w, err.Error(), 500); return }
+			}
+			s.audit(s.actorID(r), "register", "machine", map[string]any{"mac": mac})
+			m, err := scanMachine(s.DB.QueryRow(`SELECT `+machineColumns+` WHERE m.mac=?`, mac))
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			if body.Tags != nil && len(*body.Tags) > 0 { m.Tags = *body.Tags }
+			writeJSON(w, 201, m)
+			return
+		}
+		if r.Method == http.MethodDelete { s.handleDeleteMachines(w, r); return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		q := `SELECT ` + machineColumns + ` WHERE 1=1`
+		var args []any
+		if r.URL.Query().Get("stale") == "1" { q += ` AND m.stale=1` }
+		if v := r.URL.Query().Get("uuid"); v != "" { q += ` AND COALESCE(m.uuid, i.uuid)=?`; args = append(args, normalizeUUID(v)) }
+		if v := r.URL.Query().Get("serial"); v != "" { q += ` AND COALESCE(m.serial, i.serial)=?`; args = append(args, v) }
+		if v := r.URL.Query().Get("hostname"); v != "" { q += ` AND m.hostname=?`; args = append(args, v) }
+		if v := r.URL.Query().Get("tag"); v != "" { q += ` AND m.mac IN (SELECT mac FROM machine_tags WHERE tag=?)`; args = append(args, strings.ToLower(v)) }
+		expr := r.URL.Query().Get("q")
+		if ref := r.URL.Query().Get("search"); ref != "" {
+			saved, err := s.savedSearchQuery(ref)
+			if errors.Is(err, sql.ErrNoRows) { http.Error(w, "unknown saved search", 400); return }
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			expr = strings.TrimSpace(expr + " " + saved)
+		}
+		var matched map[string]bool
+		if expr != "" {
+			mq, err := parseMachineQuery(expr)
+			if err != nil { http.Error(w, "invalid query: "+err.Error(), 400); return }
+			if matched, err = s.searchMachines(mq); err != nil { http.Error(w, err.Error(), 500); return }
+		}
+		if d, err := strconv.Atoi(r.URL.Query().Get("unseen_days")); err == nil && d > 0 {
+			q += ` AND COALESCE(m.last_boot_at, m.first_seen) < ?`
+			args = append(args, time.Now().UTC().AddDate(0, 0, -d).Format(time.RFC3339))
+		}
+		rows, err := s.DB.Query(q+` ORDER BY m.mac`, args...)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		defer rows.Close()
+		tags, err := s.machineTags("")
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		inScope, err := s.siteFilter(r)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		out := []*Machine{}
+		for rows.Next() {
+			m, err := scanMachine(rows)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			if matched != nil && !matched[m.MAC] { continue }
+			if inScope != nil && !inScope(m.LastBootIP) { continue }
+			m.Tags = tags[m.MAC]
+			out = append(out, m)
+		}
+		writeJSON(w, 200, out)
+	})
+
+	// /api/v1/machines/{mac|uuid|serial}: GET, PATCH (operator), DELETE (admin);
+	// POST .../wake sends a Wake-on-LAN packet
+	s.Mux.HandleFunc("/api/v1/machines/", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		ref, wake := strings.CutSuffix(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/machines/"), "/"), "/wake")
+		mac, err := s.lookupMachineMAC(ref)
+		if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if wake { s.handleMachineWake(w, r, mac); return }
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPatch, http.MethodPut:
+			var body machineRegistration
+			if !decodeJSON(w, r, &body) { return }
+			if err := body.validate(); err != nil { badRequest(w, err); return }
+			if body.BootProfile != nil && *body.BootProfile != "" && !s.bootProfileExists(*body.BootProfile) { http.Error(w, "unknown boot_profile", 400); return }
+			var set []string
+			var args []any
+			var changed []string
+			for _, f := range []struct {
+				col string
+				v   *string
+			}{{"uuid", body.UUID}, {"serial", body.Serial}, {"hostname", body.Hostname}, {"model", body.Model}, {"boot_profile", body.BootProfile}} {
+				if f.v == nil { continue }
+				set, args, changed = append(set, f.col+"=NULLIF(?,'')"), append(args, *f.v), append(changed, f.col)
+			}
+			if body.BootProfile != nil { set = append(set, "revert_at=NULL") }
+			if body.Once != nil { set, args, changed = append(set, "boot_profile_once=?"), append(args, *body.Once), append(changed, "boot_profile_once") }
+			if len(set) == 0 && body.Tags == nil { http.Error(w, "nothing to update", 400); return }
+			if len(set) > 0 {
+				if _, err := s.DB.Exec(`UPDATE machines SET `+strings.Join(set, ", ")+` WHERE mac=?`, append(args, mac)...); err != nil { http.Error(w, err.Error(), 500); return }
+			}
+			if body.Tags != nil {
+				if err := s.setMachineTags(mac, *body.Tags); err != nil { http.Error(w, err.Error(), 500); return }
+				changed = append(changed, "tags")
+			}
+			s.audit(s.actorID(r), "update", "machine", map[string]any{"mac": mac, "fields": changed})
+		case http.MethodDelete:
+			if !s.requireRole(w, r, "admin") { return }
+			if _, err := s.DB.Exec(`DELETE FROM machines WHERE mac=?`, mac); err != nil { http.Error(w, err.Error(), 500); return }
+			_, _ = s.DB.Exec(`DELETE FROM machine_tags WHERE mac=?`, mac)
+			s.audit(s.actorID(r), "delete", "machine", map[string]any{"mac": mac})
+			writeJSON(w, 200, map[string]any{"deleted": mac})
+			return
+		default:
+			http.Error(w, "method not allowed", 405); return
+		}
+		m, err := scanMachine(s.DB.QueryRow(`SELECT `+machineColumns+` WHERE m.mac=?`, mac))
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if fields, err := s.machineFields(mac); err == nil && len(fields) > 0 { m.Fields = fields }
+		if tags, err := s.machineTags(mac); err == nil { m.Tags = tags[mac] }
+		writeJSON(w, 200, m)
+	})
+}
+
+// handleDeleteMachines serves DELETE /api/v1/machines {"macs": [...]} (admin),
+// deleting the machines and their tags in one transaction. Each machine is
+// listed with its hostname and active deployments; ?dry_run=1 only lists them.
+func (s *Server) handleDeleteMachines(w http.ResponseWriter, r *http.Request) {
+	if !s.requireRole(w, r, "admin") { return }
+	var body struct {
+		MACs []string `json:"macs"`
+	}
+	if !decodeJSON(w, r, &body) { return }
+	if len(body.MACs) == 0 { http.Error(w, "macs required", 400); return }
+	var macs []string
+	out := []map[string]any{}
+	for _, m := range body.MACs {
+		mac, err := s.lookupMachineMAC(m)
+		if errors.Is(err, sql.ErrNoRows) { http.Error(w, "unknown machine "+m, 400); return }
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		var hostname string
+		var active int
+		_ = s.DB.QueryRow(`SELECT COALESCE(hostname,'') FROM machines WHERE mac=?`, mac).Scan(&hostname)
+		_ = s.DB.QueryRow(`SELECT COUNT(*) FROM deployments WHERE mac=? AND status IN ('pending','running','validating')`, mac).Scan(&active)
+		macs = append(macs, mac)
+		out = append(out, map[string]any{"mac": mac, "hostname": hostname, "active_deployments": active})
+	}
+	dry := isDryRun(r)
+	if !dry {
+		tx, err := s.DB.Begin()
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		defer tx.Rollback()
+		for _, mac := range macs {
+			if _, err := tx.Exec(`DELETE FROM machines WHERE mac=?`, mac); err != nil { http.Error(w, err.Error(), 500); return }
+			if _, err := tx.Exec(`DELETE FROM machine_tags WHERE mac=?`, mac); err != nil { http.Error(w, err.Error(), 500); return }
+		}
+		if err := tx.Commit(); err != nil { http.Error(w, err.Error(), 500); return }
+		s.audit(s.actorID(r), "bulk_delete", "machine", map[string]any{"macs": macs})
+	}
+	writeJSON(w, 200, map[string]any{"dry_run": dry, "deleted": len(macs), "machines": out})
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ---- Machine tags & saved searches ----
+// Machines carry free-form lower-case tags. A saved search is a named query
+// over tags, vendor/model, site and state; a machine group may point at one
+// (search_id) and then counts every machine the query matches as a member,
+// alongside any vendor/model rule. The same query language filters
+// GET /api/v1/machines (?q= inline, ?search= by saved search id or name).
+//
+// Terms are separated by whitespace and all must match. A term is key:value
+// with keys tag, vendor, model (prefix), site (id or name), state (stale,
+// active, new, deploying, deployed, failed), hostname and mac; a bare word
+// matches a tag or part of the MAC or hostname. Values are case-insensitive,
+// may be quoted, list alternatives with commas and use * and ? globs; a
+// leading - negates the term.
+func initMachineTags(db *sql.DB) error {
+	ddl1 := `CREATE TABLE IF NOT EXISTS machine_tags (
+		mac TEXT NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY (mac, tag)
+	);`
+	ddl2 := `CREATE INDEX IF NOT EXISTS machine_tags_tag ON machine_tags (tag);`
+	ddl3 := `CREATE TABLE IF NOT EXISTS saved_searches (
+		id TEXT PRIMARY KEY,
+		name TEXT UNIQUE NOT NULL,
+		query TEXT NOT NULL,
+		notes TEXT,
+		created_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL
+	);`
+	for _, ddl := range []string{ddl1, ddl2, ddl3} {
+		if _, err := db.Exec(ddl); err != nil { return err }
+	}
+	return nil
+}
+
+var machineTagRe = regexp.MustCompile(`^[a-z0-9][a-z0-9._:/-]{0,63}$`)
+
+// normalizeTags lower-cases, validates and de-duplicates tags.
+func normalizeTags(tags []string) ([]string, error) {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] { continue }
+		if !machineTagRe.MatchString(t) { return nil, fmt.Errorf("invalid tag %q", t) }
+		seen[t] = true
+		out = append(out, t)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// machineTags returns the tags of every machine, or only mac's when set.
+func (s *Server) machineTags(mac string) (map[string][]string, error) {
+	rows, err := s.DB.Query(`SELECT mac, tag FROM machine_tags WHERE ?='' OR mac=? ORDER BY mac, tag`, mac, mac)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := map[string][]string{}
+	for rows.Next() {
+		var m, t string
+		if err := rows.Scan(&m, &t); err != nil { return nil, err }
+		out[m] = append(out[m], t)
+	}
+	return out, rows.Err()
+}
+
+// setMachineTags replaces mac's tags.
+func (s *Server) setMachineTags(mac string, tags []string) error {
+	tx, err := s.DB.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM machine_tags WHERE mac=?`, mac); err != nil { return err }
+	for _, t := range tags {
+		if _, err := tx.Exec(`INSERT INTO machine_tags (mac, tag) VALUES (?,?)`, mac, t); err != nil { return err }
+	}
+	return tx.Commit()
+}
+
+// machineFacts is what a machine query is evaluated against.
+type machineFacts struct {
+	MAC, Hostname, Vendor, Model string
+	SiteID, SiteName             string
+	Tags                         []string
+	States                       []string
+}
+
+// loadMachineFacts gathers facts for every known machine (registered,
+// booted or inventoried), or only mac's when set.
+func (s *Server) loadMachineFacts(mac string) ([]*machineFacts, error) {
+	rows, err := s.DB.Query(`SELECT m.mac, COALESCE(m.hostname,''), COALESCE(i.vendor,''), COALESCE(m.model, i.model, ''), COALESCE(m.last_boot_ip,''),
+			m.stale, COALESCE(m.last_deployed_at,''), COALESCE((SELECT status FROM deployments d WHERE d.mac=m.mac ORDER BY created_at DESC LIMIT 1),'')
+		FROM machines m LEFT JOIN inventory i ON i.id = (SELECT MAX(id) FROM inventory l WHERE l.mac=m.mac) WHERE ?='' OR m.mac=?
+		UNION ALL SELECT i.mac, '', COALESCE(i.vendor,''), COALESCE(i.model,''), '', 0, '', COALESCE((SELECT status FROM deployments d WHERE d.mac=i.mac ORDER BY created_at DESC LIMIT 1),'')
+		FROM inventory i WHERE i.id = (SELECT MAX(id) FROM inventory l WHERE l.mac=i.mac) AND i.mac NOT IN (SELECT mac FROM machines) AND (?='' OR i.mac=?)
+		ORDER BY 1`, mac, mac, mac, mac)
+	if err != nil { return nil, err }
+	var out []*machineFacts
+	var ips []string
+	for rows.Next() {
+		var f machineFacts
+		var ip, deployed, status string
+		var stale bool
+		if err := rows.Scan(&f.MAC, &f.Hostname, &f.Vendor, &f.Model, &ip, &stale, &deployed, &status); err != nil { rows.Close(); return nil, err }
+		if stale { f.States = append(f.States, "stale") } else { f.States = append(f.States, "active") }
+		switch {
+		case deploymentActive(status):
+			f.States = append(f.States, "deploying")
+		case status == "failed":
+			f.States = append(f.States, "failed")
+		}
+		if deployed != "" { f.States = append(f.States, "deployed") } else if status == "" { f.States = append(f.States, "new") }
+		out, ips = append(out, &f), append(ips, ip)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil { return nil, err }
+	if len(out) == 0 { return out, nil }
+	tags, err := s.machineTags(mac)
+	if err != nil { return nil, err }
+	sites, err := s.listSites()
+	if err != nil { return nil, err }
+	for i, f := range out {
+		f.Tags = tags[f.MAC]
+		if st := matchSite(sites, net.ParseIP(ips[i])); st != nil { f.SiteID, f.SiteName = st.ID, st.Name }
+	}
+	return out, nil
+}
+
+type machineQueryTerm struct {
+	Key    string
+	Values []string
+	Negate bool
+}
+
+// machineQuery is a parsed search; every term must match.
+type machineQuery []machineQueryTerm
+
+var machineQueryKeys = map[string]bool{"tag": true, "vendor": true, "model": true, "site": true, "state": true, "hostname": true, "mac": true}
+var machineStates = map[string]bool{"stale": true, "active": true, "new": true, "deploying": true, "deployed": true, "failed": true}
+
+// splitQuery splits on whitespace outside double quotes and drops the quotes.
+func splitQuery(q string) ([]string, error) {
+	var out []string
+	var cur strings.Builder
+	quoted, started := false, false
+	for _, c := range q {
+		switch {
+		case c == '"':
+			quoted, started = !quoted, true
+		case !quoted && (c == ' ' || c == '\t' || c == '\n' || c == '\r'):
+			if started { out = append(out, cur.String()) }
+			cur.Reset()
+			started = false
+		default:
+			cur.WriteRune(c)
+			started = true
+		}
+	}
+	if quoted { return nil, errors.New("unterminated quote") }
+	if started { out = append(out, cur.String()) }
+	return out, nil
+}
+
+// parseMachineQuery parses the saved search language described above.
+func parseMachineQuery(q string) (machineQuery, error) {
+	words, err := splitQuery(q)
+	if err != nil { return nil, err }
+	var out machineQuery
+	for _, w := range words {
+		var t machineQueryTerm
+		if strings.HasPrefix(w, "-") { t.Negate, w = true, w[1:] }
+		if k, v, ok := strings.Cut(w, ":"); ok && machineQueryKeys[strings.ToLower(k)] {
+			t.Key, w = strings.ToLower(k), v
+		}
+		for _, v := range strings.Split(w, ",") {
+			if v = strings.ToLower(strings.TrimSpace(v)); v == "" { continue }
+			if _, err := path.Match(v, ""); err != nil { return nil, fmt.Errorf("invalid pattern %q", v) }
+			if t.Key == "state" && !machineStates[v] { return nil, fmt.Errorf("unknown state %q", v) }
+			if t.Key == "mac" { v = normalizeMAC(v) }
+			t.Values = append(t.Values, v)
+		}
+		if len(t.Values) == 0 { return nil, fmt.Errorf("empty term %q", w) }
+		out = append(out, t)
+	}
+	if len(out) == 0 { return nil, errors.New("empty query") }
+	return out, nil
+}
+
+// queryValueMatch compares a lower-cased pattern with one field value.
+func queryValueMatch(pattern, v string, prefix bool) bool {
+	v = strings.ToLower(v)
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, _ := path.Match(pattern, v)
+		return ok
+	}
+	if prefix { return strings.HasPrefix(v, pattern) }
+	return v == pattern
+}
+
+func (t machineQueryTerm) match(f *machineFacts) bool {
+	for _, p := range t.Values {
+		var fields []string
+		prefix := false
+		switch t.Key {
+		case "tag":
+			fields = f.Tags
+		case "vendor":
+			fields = []string{strings.TrimSpace(f.Vendor)}
+		case "model":
+			fields, prefix = []string{f.Model}, true
+		case "site":
+			fields = []string{f.SiteID, f.SiteName}
+		case "state":
+			fields = f.States
+		case "hostname":
+			fields = []string{f.Hostname}
+		case "mac":
+			fields = []string{f.MAC}
+		default:
+			if strings.Contains(f.MAC, p) || strings.Contains(strings.ToLower(f.Hostname), p) { return true }
+			fields = f.Tags
+		}
+		for _, v := range fields {
+			if v != "" && queryValueMatch(p, v, prefix) { return true }
+		}
+	}
+	return false
+}
+
+func (q machineQuery) match(f *machineFacts) bool {
+	for _, t := range q {
+		if t.match(f) == t.Negate { return false }
+	}
+	return true
+}
+
+// savedSearchQuery returns the query of a saved search looked up by id or name.
+func (s *Server) savedSearchQuery(ref string) (string, error) {
+	var q string
+	err := s.DB.QueryRow(`SELECT query FROM saved_searches WHERE id=? OR name=? ORDER BY id=? DESC LIMIT 1`, ref, ref, ref).Scan(&q)
+	return q, err
+}
+
+// groupsForMachine returns the ids of machine groups mac belongs to, either
+// through a vendor/model rule (which needs a known model) or a saved search.
+func (s *Server) groupsForMachine(mac string) ([]string, error) {
+	facts, err := s.loadMachineFacts(normalizeMAC(mac))
+	if err != nil || len(facts) == 0 { return nil, err }
+	return s.matchGroups(facts[0])
+}
+
+type groupRule struct {
+	ID, Vendor, Model string
+	Query             machineQuery
+}
+
+func (s *Server) groupRules() ([]groupRule, error) {
+	rows, err := s.DB.Query(`SELECT g.id, COALESCE(g.match_vendor,''), COALESCE(g.match_model,''), COALESCE(ss.query,'')
+		FROM machine_groups g LEFT JOIN saved_searches ss ON ss.id=g.search_id ORDER BY g.name`)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	var out []groupRule
+	for rows.Next() {
+		var g groupRule
+		var q string
+		if err := rows.Scan(&g.ID, &g.Vendor, &g.Model, &q); err != nil { return nil, err }
+		if q != "" { g.Query, _ = parseMachineQuery(q) }
+		out = append(out, g)
+	}
+	return out, rows.Err()
+}
+
+func (g groupRule) match(f *machineFacts) bool {
+	if (g.Vendor != "" || g.Model != "") && (f.Vendor != "" || f.Model != "") && matchModel(g.Vendor, g.Model, f.Vendor, f.Model) { return true }
+	return g.Query != nil && g.Query.match(f)
+}
+
+func (s *Server) matchGroups(f *machineFacts) ([]string, error) {
+	rules, err := s.groupRules()
+	if err != nil { return nil, err }
+	var out []string
+	for _, g := range rules {
+		if g.match(f) { out = append(out, g.ID) }
+	}
+	return out, nil
+}
+
+// groupMembers returns the MACs of every machine in a group.
+func (s *Server) groupMembers(groupID string) ([]string, error) {
+	rules, err := s.groupRules()
+	if err != nil { return nil, err }
+	var rule *groupRule
+	for i := range rules {
+		if rules[i].ID == groupID { rule = &rules[i] }
+	}
+	if rule == nil { return nil, sql.ErrNoRows }
+	facts, err := s.loadMachineFacts("")
+	if err != nil { return nil, err }
+	out := []string{}
+	for _, f := range facts {
+		if rule.match(f) { out = append(out, f.MAC) }
+	}
+	return out, nil
+}
+
+// searchMachines returns the MACs matching q.
+func (s *Server) searchMachines(q machineQuery) (map[string]bool, error) {
+	facts, err := s.loadMachineFacts("")
+	if err != nil { return nil, err }
+	out := map[string]bool{}
+	for _, f := range facts {
+		if q.match(f) { out[f.MAC] = true }
+	}
+	return out, nil
+}
+
+type SavedSearch struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Query     string `json:"query"`
+	Notes     string `json:"notes"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+func (s *Server) machineTagRoutes() {
+	// GET: every tag with its machine count. POST {macs, add, remove} tags
+	// machines in bulk.
+	s.Mux.HandleFunc("/api/v1/machine_tags", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := s.DB.Query(`SELECT tag, COUNT(*) FROM machine_tags GROUP BY tag ORDER BY tag`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			out := []map[string]any{}
+			for rows.Next() {
+				var tag string; var n int
+				if err := rows.Scan(&tag, &n); err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, map[string]any{"tag": tag, "machines": n})
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPost:
+			var body struct {
+				MACs   []string `json:"macs"`
+				Add    []string `json:"add"`
+				Remove []string `json:"remove"`
+			}
+			if !decodeJSON(w, r, &body) { return }
+			add, err := normalizeTags(body.Add)
+			if err != nil { http.Error(w, err.Error(), 400); return }
+			remove, err := normalizeTags(body.Remove)
+			if err != nil { http.Error(w, err.Error(), 400); return }
+			if len(body.MACs) == 0 || len(add)+len(remove) == 0 { http.Error(w, "macs and add or remove required", 400); return }
+			var macs []string
+			for _, m := range body.MACs {
+				mac, err := s.lookupMachineMAC(m)
+				if errors.Is(err, sql.ErrNoRows) { http.Error(w, "unknown machine "+m, 400); return }
+				if err != nil { http.Error(w, err.Error(), 500); return }
+				macs = append(macs, mac)
+			}
+			tx, err := s.DB.Begin()
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer tx.Rollback()
+			for _, mac := range macs {
+				for _, t := range add {
+					if _, err := tx.Exec(`INSERT OR IGNORE INTO machine_tags (mac, tag) VALUES (?,?)`, mac, t); err != nil { http.Error(w, err.Error(), 500); return }
+				}
+				for _, t := range remove {
+					if _, err := tx.Exec(`DELETE FROM machine_tags WHERE mac=? AND tag=?`, mac, t); err != nil { http.Error(w, err.Error(), 500); return }
+				}
+			}
+			if err := tx.Commit(); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "tag", "machine", map[string]any{"macs": macs, "add": add, "remove": remove})
+			writeJSON(w, 200, map[string]any{"machines": len(macs), "added": add, "removed": remove})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// Saved searches (admin). GET ?id= also returns the matching MACs.
+	s.Mux.HandleFunc("/api/v1/admin/saved_searches", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+			if id := r.URL.Query().Get("id"); id != "" {
+				var ss SavedSearch
+				err := s.DB.QueryRow(`SELECT id, name, query, COALESCE(notes,''), created_at, updated_at FROM saved_searches WHERE id=?`, id).
+					Scan(&ss.ID, &ss.Name, &ss.Query, &ss.Notes, &ss.CreatedAt, &ss.UpdatedAt)
+				if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+				if err != nil { http.Error(w, err.Error(), 500); return }
+				q, err := parseMachineQuery(ss.Query)
+				if err != nil { http.Error(w, err.Error(), 500); return }
+				set, err := s.searchMachines(q)
+				if err != nil { http.Error(w, err.Error(), 500); return }
+				macs := []string{}
+				for m := range set { macs = append(macs, m) }
+				sort.Strings(macs)
+				writeJSON(w, 200, map[string]any{"search": ss, "machines": macs})
+				return
+			}
+			rows, err := s.DB.Query(`SELECT id, name, query, COALESCE(notes,''), created_at, updated_at FROM saved_searches ORDER BY name`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			out := []SavedSearch{}
+			for rows.Next() {
+				var ss SavedSearch
+				if err := rows.Scan(&ss.ID, &ss.Name, &ss.Query, &ss.Notes, &ss.CreatedAt, &ss.UpdatedAt); err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, ss)
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPost, http.MethodPut:
+			var body SavedSearch
+			if !decodeJSON(w, r, &body) { return }
+			body.Name = strings.TrimSpace(body.Name)
+			if body.Name == "" { http.Error(w, "name required", 400); return }
+			if _, err := parseMachineQuery(body.Query); err != nil { http.Error(w, "invalid query: "+err.Error(), 400); return }
+			now := time.Now().UTC().Format(time.RFC3339)
+			if r.Method == http.MethodPut {
+				res, err := s.DB.Exec(`UPDATE saved_searches SET name=?, query=?, notes=?, updated_at=? WHERE id=?`, body.Name, body.Query, body.Notes, now, body.ID)
+				if err != nil { http.Error(w, err.Error(), 500); return }
+				if n, _ := res.RowsAffected(); n == 0 { http.NotFound(w, r); return }
+				s.audit(s.actorID(r), "update", "saved_search", map[string]any{"id": body.ID, "name": body.Name})
+				writeJSON(w, 200, map[string]any{"id": body.ID})
+				return
+			}
+			id := "search-" + genID()
+			_, err := s.DB.Exec(`INSERT INTO saved_searches (id, name, query, notes, created_at, updated_at) VALUES (?,?,?,?,?,?)`, id, body.Name, body.Query, body.Notes, now, now)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "create", "saved_search", map[string]any{"id": id, "name": body.Name})
+			writeJSON(w, 201, map[string]any{"id": id})
+		case http.MethodDelete:
+			var body struct{ ID string `json:"id"` }
+			if !decodeJSON(w, r, &body) { return }
+			var n int
+			_ = s.DB.QueryRow(`SELECT COUNT(*) FROM machine_groups WHERE search_id=?`, body.ID).Scan(&n)
+			if n > 0 { http.Error(w, "saved search is used by a machine group", 409); return }
+			if _, err := s.DB.Exec(`DELETE FROM saved_searches WHERE id=?`, body.ID); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "delete", "saved_search", map[string]any{"id": body.ID})
+			writeJSON(w, 200, map[string]any{"deleted": body.ID})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -27,7 +29,6 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
-	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/oauth2"
 	_ "modernc.org/sqlite"
 )
@@ -40,6 +41,16 @@ type Image struct {
 	SizeMB  int64  `json:"sizeMB"`
 	Updated string `json:"updated"`
 	File    string `json:"file"` // local filename or s3 key
+	DerivedFrom string `json:"derived_from,omitempty"`
+	Attachments int    `json:"attachments"`
+	SHA256       string `json:"sha256,omitempty"`
+	VerifiedAt   string `json:"verified_at,omitempty"`
+	VerifyStatus string `json:"verify_status,omitempty"` // ok|drift|missing
+	Version      int    `json:"version"`                 // active version, see imageversions.go
+	Tags         []string `json:"tags"`
+	Metadata     *ImageMetadata `json:"metadata,omitempty"` // detail view only, see imageinspect.go
+	Published    bool   `json:"published"`                 // active version is published, see imagepublish.go
+	Drafts       int    `json:"drafts,omitempty"`          // versions awaiting publish
 }
 
 type User struct {
@@ -55,6 +66,7 @@ type Storage interface {
 	Delete(ctx context.Context, key string) error
 	Presign(ctx context.Context, key string, expiry time.Duration) (string, error)
 	LocalPath(key string) (string, bool) // returns path and true if local storage
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
 }
 
 // Local storage implementation
@@ -82,6 +94,9 @@ func (s *LocalStorage) Presign(ctx context.Context, key string, expiry time.Dura
 func (s *LocalStorage) LocalPath(key string) (string, bool) {
 	return filepath.Join(s.Root, key), true
 }
+func (s *LocalStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.Root, key))
+}
 
 // S3 storage implementation
 type S3Storage struct {
@@ -104,7 +119,23 @@ func (s *S3Storage) Presign(ctx context.Context, key string, expiry time.Duratio
 	if err != nil { return "", err }
 	return u.String(), nil
 }
+// PresignRange presigns a GET or HEAD for key that names the download and,
+// when rng is set, carries the Range header in its signature, so a resumed
+// download fetches only the remainder after following the redirect.
+func (s *S3Storage) PresignRange(ctx context.Context, method, key, filename string, expiry time.Duration, rng string) (string, error) {
+	reqParams := make(url.Values)
+	if filename != "" { reqParams.Set("response-content-disposition", fmt.Sprintf("attachment; filename=%q", filename)) }
+	hdr := make(http.Header)
+	if rng != "" { hdr.Set("Range", rng) }
+	if method != http.MethodHead { method = http.MethodGet }
+	u, err := s.Client.PresignHeader(ctx, method, s.Bucket, key, expiry, reqParams, hdr)
+	if err != nil { return "", err }
+	return u.String(), nil
+}
 func (s *S3Storage) LocalPath(key string) (string, bool) { return "", false }
+func (s *S3Storage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.Client.GetObject(ctx, s.Bucket, key, minio.GetObjectOptions{})
+}
 
 // ---- Server ----
 type Server struct {
@@ -126,7 +157,6 @@ type Server struct {
 func main() {
 	port := getenv("BOOTAH_HTTP_PORT", "8080")
 	webRoot := getenv("BOOTAH_WEB_ROOT", "./webui")
-	dbPath := getenv("BOOTAH_DB_PATH", "./data/bootah.db")
 	imagesDir := getenv("BOOTAH_IMAGES_DIR", "./data/images")
 	jwtSecret := getenv("BOOTAH_JWT_SECRET", "dev-secret-change-me")
 
@@ -164,15 +194,70 @@ func main() {
 		store = &LocalStorage{Root: imagesDir}
 	}
 
-	if err := os.MkdirAll(filepath.Dir(dbPath), 0o755); err != nil { log.Fatal(err) }
-	db, err := sql.Open("sqlite", dbPath)
+	if replicaMode() {
+		if dir := getenv("BOOTAH_REPLICA_CACHE_DIR", ""); dir != "" { store = &CachingStorage{Inner: store, Dir: dir} }
+	}
+	if standbyMode() {
+		if err := waitAsStandby(port); err != nil { log.Fatalf("standby: %v", err) }
+	}
+	db, err := openStore()
 	if err != nil { log.Fatalf("open db: %v", err) }
 	defer db.Close()
 	must(initDB(db))
 	must(initAuth(db))
 	must(initAudit(db))
 	must(initJobs(db))
+	must(initCluster(db))
 	must(initDrivers(db))
+	must(initInventory(db))
+	must(initTemplates(db))
+	must(initDeployments(db))
+	must(initCerts(db))
+	must(initNotifications(db))
+	must(initTasks(db))
+	must(initValidation(db))
+	must(initWipe(db))
+	must(initUpdates(db))
+	must(initSoftware(db))
+	must(initSites(db))
+	must(initBootPolicies(db))
+	must(initBootProfiles(db))
+	must(initImageDownloads(db))
+	must(initAttachments(db))
+	must(initCatalog(db))
+	must(initChangelog(db))
+	must(initKiosk(db))
+	must(initRelays(db))
+	must(initUsage(db))
+	must(initCMDB(db))
+	must(initBuilds(db))
+	must(initRollouts(db))
+	must(initMachines(db))
+	must(initKernelArgs(db))
+	must(initBootAssets(db))
+	must(initAttestation(db))
+	must(initStorageHealth(db))
+	must(initDHCP(db))
+	must(initTaskRuns(db))
+	must(initTaskSteps(db))
+	must(initMachineTags(db))
+	must(initUploadSessions(db))
+	must(initImageVersions(db))
+	must(initImageTags(db))
+	must(initImageMetadata(db))
+	must(initWake(db))
+	must(initAvailability(db))
+	must(initExamProfiles(db))
+	must(initAPIKeys(db))
+	must(initRegionalPresets(db))
+	must(initSessions(db))
+	must(initTemplateSecrets(db))
+	must(initMFA(db))
+	must(initRoles(db))
+	must(initReportLinks(db))
+	must(initSiteScopes(db))
+	must(initAuditSinks(db))
+	must(migrateDB(db))
 
 	issuer := getenv("BOOTAH_OIDC_ISSUER", "")
 	clientID := getenv("BOOTAH_OIDC_CLIENT_ID", "")
@@ -205,42 +290,137 @@ func main() {
 		s.OIDCVerifier = provider.Verifier(&oidc.Config{ClientID: clientID})
 	}
 
+	if err := loadPlugins(); err != nil { log.Fatalf("plugins: %v", err) }
+	if err := loadAuditSinks(); err != nil { log.Fatalf("audit sinks: %v", err) }
+	if err := loadStandbyTargets(); err != nil { log.Fatalf("standby: %v", err) }
+	if ldapConfigured() {
+		if err := s.checkLDAPRoles(); err != nil { log.Fatalf("ldap: %v", err) }
+	}
 	s.routes()
-
-	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: corsMiddleware(loggingMiddleware(s.Mux)),
+	if promotion != nil { s.audit(nil, "promote", "standby", promotion) }
+	clusterCtx, stopCluster := context.WithCancel(context.Background())
+	defer stopCluster()
+	if err := s.startDHCP(clusterCtx, port); err != nil { log.Fatalf("dhcp: %v", err) }
+	var handler http.Handler = s.relayForwarding(s.Mux)
+	if replicaMode() {
+		handler = replicaMiddleware(handler)
+		log.Printf("read-only replica mode: serving boot and download traffic only")
+	} else {
+		handler = s.usageAccounting(s.impersonationAudit(handler))
+		s.startCluster(clusterCtx)
+		s.startUsageFlusher(clusterCtx)
+		s.startPlugins(clusterCtx)
+		s.startAuditSinks(clusterCtx)
+		s.startStandbyShipping(clusterCtx)
+		s.startCMDB(clusterCtx)
+		s.startRollouts(clusterCtx)
+		s.startMachines(clusterCtx)
+		s.startBootAssets(clusterCtx)
+		s.startStorageHealth(clusterCtx)
+		s.startDiskMonitor(clusterCtx)
+		s.startUploadSessions(clusterCtx)
+		s.startImageDownloads(clusterCtx)
+		s.startWakeSchedules(clusterCtx)
 	}
 
-	go func() {
-		log.Printf("Bootah v8 listening on http://localhost:%s (storage=%s, oidc=%v)", port, storageMode, oidcEnabled)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("server error: %v", err)
-		}
-	}()
+	log.Printf("Bootah v8 starting (storage=%s, oidc=%v, tls=%s)", storageMode, oidcEnabled, tlsMode())
+	servers, err := serveHTTP(corsMiddleware(loggingMiddleware(errorEnvelope(apiVersioning(handler)))), port)
+	if err != nil { log.Fatalf("http: %v", err) }
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 	<-stop
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	_ = srv.Shutdown(ctx)
+	for _, srv := range servers { _ = srv.Shutdown(ctx) }
+	s.flushUsage()
 	log.Println("Bootah stopped")
 }
 
 func (s *Server) routes() {
-	s.Mux.Handle("/", http.FileServer(http.Dir(s.WebRoot)))
+	s.Mux.Handle("/", staticHandler(s.WebRoot))
+	s.Mux.HandleFunc("/assets/", s.handleAssets)
 
-	s.Mux.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
+	health := func(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusOK, map[string]any{"ok": true, "ts": time.Now()})
-	})
+	}
+	s.Mux.HandleFunc("/api/health", health)
+	s.Mux.HandleFunc("/api/v1/health", health)
 
 	s.authRoutes()
 	s.adminUserRoutes()
 	s.adminAuditRoutes()
+	s.auditEventRoutes()
 	s.adminStorageRoutes()
 	s.winpeRoutes()
 	s.driverRoutes()
+	s.inventoryRoutes()
+	s.templateRoutes()
+	s.templateLintRoutes()
+	s.deploymentRoutes()
+	s.certRoutes()
+	s.notificationRoutes()
+	s.taskRoutes()
+	s.validationRoutes()
+	s.wipeRoutes()
+	s.updateRoutes()
+	s.softwareRoutes()
+	s.metricsRoutes()
+	s.siteRoutes()
+	s.downloadTokenRoutes()
+	s.uploadRoutes()
+	s.conversionRoutes()
+	s.catalogRoutes()
+	s.kioskRoutes()
+	s.simulateRoutes()
+	s.clusterRoutes()
+	s.jobRoutes()
+	s.relayRoutes()
+	s.provisioningRoutes()
+	s.usageRoutes()
+	s.impersonationRoutes()
+	s.bundleRoutes()
+	s.pluginRoutes()
+	s.cmdbRoutes()
+	s.awxRoutes()
+	s.buildRoutes()
+	s.planRoutes()
+	s.rolloutRoutes()
+	s.machineRoutes()
+	s.machineTagRoutes()
+	s.imageTagRoutes()
+	s.wakeRoutes()
+	s.availabilityRoutes()
+	s.examProfileRoutes()
+	s.migrationRoutes()
+	s.apiKeyRoutes()
+	s.regionalPresetRoutes()
+	s.sessionRoutes()
+	s.templateSecretRoutes()
+	s.passwordRoutes()
+	s.mfaRoutes()
+	s.roleRoutes()
+	s.reportLinkRoutes()
+	s.siteScopeRoutes()
+	s.auditSinkRoutes()
+	s.standbyRoutes()
+	s.maintenanceRoutes()
+	s.machineImportRoutes()
+	s.kernelArgRoutes()
+	s.bootAssetRoutes()
+	s.assetPublishRoutes()
+	s.enrollmentRoutes()
+	s.attestationRoutes()
+	s.storageHealthRoutes()
+	s.diskRoutes()
+	s.dhcpRoutes()
+	s.bootPolicyRoutes()
+	s.bootProfileRoutes()
+	s.imageDownloadRoutes()
+	s.taskRunRoutes()
+	s.agentCheckinRoutes()
+	s.kernelPairRoutes()
+	s.initrdOverlayRoutes()
 
 	s.Mux.HandleFunc("/api/v1/images", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
@@ -265,97 +445,204 @@ func (s *Server) routes() {
 			s.handleDeleteImage(w, r, id)
 			return
 		}
+		if len(parts) == 1 && r.Method == http.MethodGet {
+			im, err := scanImage(s.DB.QueryRow(`SELECT `+imageColumns+` FROM images WHERE id=?`, id))
+			if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			if im.Tags, err = s.imageTags(id); err != nil { http.Error(w, err.Error(), 500); return }
+			if im.Metadata, err = s.imageMetadata(id, im.Version); err != nil { http.Error(w, err.Error(), 500); return }
+			writeJSON(w, 200, im)
+			return
+		}
+		if len(parts) == 2 && parts[1] == "tags" {
+			s.handleImageTags(w, r, id)
+			return
+		}
 		if len(parts) == 2 && parts[1] == "download" && r.Method == http.MethodGet {
 			s.handleDownloadImage(w, r, id)
 			return
 		}
+		if len(parts) == 2 && parts[1] == "checksum" && r.Method == http.MethodGet {
+			s.handleImageChecksum(w, r, id)
+			return
+		}
+		if len(parts) == 2 && parts[1] == "verify" && r.Method == http.MethodGet {
+			if !s.requireRole(w, r, "operator") { return }
+			s.handleVerifyImage(w, r, id)
+			return
+		}
+		if len(parts) == 2 && parts[1] == "inspect" {
+			s.handleImageInspect(w, r, id)
+			return
+		}
+		if len(parts) == 2 && parts[1] == "consumers" {
+			s.handleImageConsumers(w, r, id)
+			return
+		}
+		if len(parts) >= 2 && parts[1] == "versions" {
+			s.handleImageVersions(w, r, id, parts[2:])
+			return
+		}
+		if len(parts) == 2 && parts[1] == "rollback" {
+			s.handleImageVersions(w, r, id, parts[1:])
+			return
+		}
+		if len(parts) == 2 && parts[1] == "changelog" {
+			s.handleImageChangelog(w, r, id)
+			return
+		}
+		if len(parts) == 2 && parts[1] == "sbom" {
+			s.handleImageSBOM(w, r, id)
+			return
+		}
+		if len(parts) >= 2 && parts[1] == "attachments" {
+			s.handleImageAttachments(w, r, id, parts[2:])
+			return
+		}
 		http.NotFound(w, r)
 	})
 
 	s.Mux.HandleFunc("/ipxe/boot.ipxe", func(w http.ResponseWriter, r *http.Request) {
+		site, err := s.siteForIP(clientIP(r))
+		if err != nil { log.Printf("site lookup: %v", err) }
+		// without ?mac= (e.g. a DHCP filename URL) chain back with the identifiers
+		// only iPXE can fill in
+		if !r.URL.Query().Has("mac") {
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = w.Write([]byte("#!ipxe\nchain /ipxe/boot.ipxe?mac=${net0/mac}&uuid=${uuid}&serial=${serial:uristring}\n"))
+			return
+		}
+		if mac := normalizeMAC(r.URL.Query().Get("mac")); mac != "" && !replicaMode() {
+			var ip string
+			if c := clientIP(r); c != nil { ip = c.String() }
+			s.recordBoot(mac, ip, r.URL.Query().Get("uuid"), r.URL.Query().Get("serial"))
+		}
+		var dt string
+		if ip := clientIP(r); ip != nil && downloadTokenMode() != "off" {
+			dt = s.issueDownloadToken(downloadClaims{MAC: normalizeMAC(r.URL.Query().Get("mac")), IP: ip.String()})
+		}
 		w.Header().Set("Content-Type", "text/plain")
-		fmt.Fprintf(w, `#!ipxe
-set menu-default winpe
-:menu
-menu Bootah iPXE Menu
-item --key w winpe  WinPE (Capture & Deploy)
-item --key u ubuntu Ubuntu 24.04 Live (ISO)
-item --key q quit   Quit
-choose --default %s target && goto ${target}
-
-:winpe
-kernel http://${next-server}:/assets/winpe/bootx64.efi
-initrd http://${next-server}:/assets/winpe/boot.wim
-boot
-
-:ubuntu
-kernel http://${next-server}:/assets/ubuntu/vmlinuz
-initrd http://${next-server}:/assets/ubuntu/initrd
-imgargs vmlinuz initrd=initrd boot=casper netboot=nfs nfsroot=${next-server}:/srv/bootah/images/ubuntu
-boot
-
-:quit
-exit
-`, getenv("BOOTAH_IPXE_DEFAULT", "winpe"))
+		_, _ = w.Write([]byte(s.bootScript(r, site, dt)))
 	})
 
 	if s.OIDCEnabled {
-		s.Mux.HandleFunc("/api/auth/oidc/start", s.oidcStart)
-		s.Mux.HandleFunc("/api/auth/oidc/callback", s.oidcCallback)
+		s.Mux.HandleFunc("/api/v1/auth/oidc/start", s.oidcStart)
+		s.Mux.HandleFunc("/api/v1/auth/oidc/callback", s.oidcCallback)
 	}
 }
 
+const imageColumns = `id, name, type, size_mb, updated, file, COALESCE(derived_from,''), (SELECT COUNT(*) FROM image_attachments a WHERE a.image_id=images.id),
+	COALESCE(sha256,''), COALESCE(verified_at,''), COALESCE(verify_status,''), COALESCE(version,1), ` + imagePublishedSQL + `, ` + imageDraftsSQL
+
+func scanImage(row interface{ Scan(...any) error }) (Image, error) {
+	var im Image
+	err := row.Scan(&im.ID, &im.Name, &im.Type, &im.SizeMB, &im.Updated, &im.File, &im.DerivedFrom, &im.Attachments, &im.SHA256, &im.VerifiedAt, &im.VerifyStatus, &im.Version, &im.Published, &im.Drafts)
+	return im, err
+}
+
 func (s *Server) handleListImages(w http.ResponseWriter, r *http.Request) {
-	rows, err := s.DB.Query(`SELECT id, name, type, size_mb, updated, file FROM images ORDER BY updated DESC`)
+	where, args, order, limit, offset, err := imageListFilter(r)
+	if err != nil { http.Error(w, err.Error(), 400); return }
+	var total int
+	if err := s.DB.QueryRow(`SELECT COUNT(*) FROM images`+where, args...).Scan(&total); err != nil { http.Error(w, err.Error(), 500); return }
+	page := ""
+	if limit > 0 { page = fmt.Sprintf(` LIMIT %d OFFSET %d`, limit, offset) } else if offset > 0 { page = fmt.Sprintf(` LIMIT -1 OFFSET %d`, offset) }
+	rows, err := s.DB.Query(`SELECT `+imageColumns+` FROM images`+where+order+page, args...)
 	if err != nil { http.Error(w, err.Error(), 500); return }
 	defer rows.Close()
-	var out []Image
+	tags, err := s.imageTagMap()
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	out := []Image{}
 	for rows.Next() {
-		var im Image
-		if err := rows.Scan(&im.ID, &im.Name, &im.Type, &im.SizeMB, &im.Updated, &im.File); err != nil {
-			http.Error(w, err.Error(), 500); return
-		}
+		im, err := scanImage(rows)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		im.Tags = tags[im.ID]
+		if im.Tags == nil { im.Tags = []string{} }
 		out = append(out, im)
 	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
 	writeJSON(w, 200, out)
 }
 
 func (s *Server) handleUploadImage(w http.ResponseWriter, r *http.Request) {
+	if !s.requireDiskSpace(w, r) { return }
+	limitUploadBody(w, r)
+	prog, err := trackUpload(r)
+	if err != nil { http.Error(w, err.Error(), 400); return }
 	if err := r.ParseMultipartForm(1 << 31); err != nil {
-		http.Error(w, "invalid multipart: "+err.Error(), 400); return
+		prog.finish("", err)
+		uploadFailed(w, err, 400, "invalid multipart: "); return
 	}
 	name := r.FormValue("name")
 	fh, hdr, err := getFilePart(r, "file")
-	if err != nil { http.Error(w, "file required: "+err.Error(), 400); return }
+	if err != nil { prog.finish("", err); uploadFailed(w, err, 400, "file required: "); return }
 	defer fh.Close()
 	if name == "" { name = hdr.Filename }
 	typ := detectType(hdr.Filename)
+	prevID, err := s.previousImageVersion(name, r.FormValue("replaces"))
+	if err == nil { err = checkChangelog(prevID, r.FormValue("changelog"), r.FormValue("ticket")) }
+	tags, terr := normalizeTags(splitList(r.FormValue("tags")))
+	if err == nil { err = terr }
+	if err != nil { prog.finish("", err); http.Error(w, err.Error(), 400); return }
 
 	id := genID()
 	key := id + strings.ToLower(filepath.Ext(hdr.Filename))
 
-	size, err := s.StorePut(r.Context(), key, fh)
-	if err != nil { http.Error(w, "store put: "+err.Error(), 500); return }
+	prog.setStatus("storing")
+	size, sum, err := s.StorePut(r.Context(), key, fh)
+	if err != nil { prog.finish("", err); uploadFailed(w, err, 500, "store put: "); return }
+	id, now, err := s.addUploadedImage(r, id, key, name, typ, size, sum, prevID, r.FormValue("changelog"), r.FormValue("ticket"))
+	if err != nil { prog.finish("", err); http.Error(w, "db insert: "+err.Error(), 500); return }
+	for _, t := range tags { _, _ = s.DB.Exec(`INSERT OR IGNORE INTO image_tags (image_id, tag) VALUES (?,?)`, id, t) }
+	prog.finish(id, nil)
+	writeJSON(w, 201, map[string]any{"id": id, "name": name, "type": typ, "sizeMB": size/(1024*1024), "updated": now})
+}
+
+// addUploadedImage records an image already written to storage under key,
+// with its SHA-256, catalog entry, changelog and audit trail. With prevID set
+// the upload becomes the next version of that image and its ID is returned
+// instead of id.
+func (s *Server) addUploadedImage(r *http.Request, id, key, name, typ string, size int64, sum, prevID, changelog, ticket string) (string, string, error) {
 	now := time.Now().Format("2006-01-02")
-	if _, err := s.DB.Exec(`INSERT INTO images (id, name, type, size_mb, updated, file) VALUES (?,?,?,?,?,?)`, id, name, typ, size/(1024*1024), now, key); err != nil {
-		http.Error(w, "db insert: "+err.Error(), 500); return
+	var author string
+	if _, c, err := s.verifyAuth(r); err == nil { author, _ = c["email"].(string) }
+	version := 1
+	if prevID != "" {
+		var err error
+		version, err = s.addImageVersion(prevID, ImageVersion{File: key, Type: typ, SizeMB: size/(1024*1024), SHA256: sum, Changelog: changelog, Ticket: ticket, Author: author})
+		if err != nil { return "", "", err }
+		id = prevID
+		_ = s.DB.QueryRow(`SELECT name FROM images WHERE id=?`, id).Scan(&name)
+	} else {
+		if _, err := s.DB.Exec(`INSERT INTO images (id, name, type, size_mb, updated, file, owner_id, sha256) VALUES (?,?,?,?,?,?,?,NULLIF(?,''))`, id, name, typ, size/(1024*1024), now, key, s.actorID(r), sum); err != nil {
+			return "", "", err
+		}
+		if err := s.recordFirstImageVersion(id, author); err != nil { log.Printf("image %s version: %v", id, err) }
 	}
+	event := "added"
+	if prevID != "" { event = "updated" }
+	s.imageStored(id, version, event, name, typ, map[string]any{"size_mb": size/(1024*1024)})
+	s.queueImageInspection(id, version, typ)
 	var actorID *int64 = nil
 	if _, c, err := s.verifyAuth(r); err==nil {
 		if v,ok := c["sub"].(float64); ok { vv := int64(v); actorID = &vv }
 	}
-	s.audit(actorID, "upload", "image", map[string]any{"id": id, "name": name, "sizeMB": size/(1024*1024)})
-	writeJSON(w, 201, map[string]any{"id": id, "name": name, "type": typ, "sizeMB": size/(1024*1024), "updated": now})
+	s.audit(actorID, "upload", "image", map[string]any{"id": id, "name": name, "sizeMB": size/(1024*1024), "version": version})
+	return id, now, nil
 }
 
 func (s *Server) handleDeleteImage(w http.ResponseWriter, r *http.Request, id string) {
-	var key string
-	err := s.DB.QueryRow(`SELECT file FROM images WHERE id=?`, id).Scan(&key)
+	var key, name, typ string
+	err := s.DB.QueryRow(`SELECT file, name, type FROM images WHERE id=?`, id).Scan(&key, &name, &typ)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
 		http.Error(w, err.Error(), 500); return
 	}
 	_ = s.Store.Delete(r.Context(), key)
+	s.deleteImageVersionFiles(r, id, key)
+	s.deleteAttachments(r.Context(), id)
+	_, _ = s.DB.Exec(`DELETE FROM image_tags WHERE image_id=?`, id)
+	_, _ = s.DB.Exec(`DELETE FROM availability_windows WHERE kind='image' AND target=?`, id)
 	if _, err := s.DB.Exec(`DELETE FROM images WHERE id=?`, id); err != nil {
 		http.Error(w, err.Error(), 500); return
 	}
@@ -363,6 +650,8 @@ func (s *Server) handleDeleteImage(w http.ResponseWriter, r *http.Request, id st
 	if _, c, err := s.verifyAuth(r); err==nil {
 		if v,ok := c["sub"].(float64); ok { vv := int64(v); actorID = &vv }
 	}
+	s.recordCatalogChange(id, "removed", name, typ)
+	s.emit("image.deleted", map[string]any{"image_id": id, "name": name, "type": typ})
 	s.audit(actorID, "delete", "image", map[string]any{"id": id})
 	writeJSON(w, 200, map[string]any{"deleted": id})
 }
@@ -374,25 +663,110 @@ func (s *Server) handleDownloadImage(w http.ResponseWriter, r *http.Request, id
 		if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
 		http.Error(w, err.Error(), 500); return
 	}
+	if rejectBadCDNSignature(w, r) { return }
+	if !s.checkDownloadToken(w, r) { return }
+	// ?version=n serves a kept version instead of the active one
+	var version int
+	if v := r.URL.Query().Get("version"); v != "" {
+		var created string
+		n, err := strconv.Atoi(v)
+		if err == nil { err = s.DB.QueryRow(`SELECT file, created FROM image_versions WHERE image_id=? AND version=?`, id, n).Scan(&key, &created) }
+		if err != nil { http.NotFound(w, r); return }
+		version = n
+	}
+	s.recordImageDownload(r, id)
+	if getenv("BOOTAH_CDN_SIGNING_KEY", "") != "" && !cdnSigned(r) {
+		p := r.URL.Path
+		if version > 0 { p += "?version=" + strconv.Itoa(version) }
+		// bound to the address that passed the token check
+		var ip string
+		if downloadTokenMode() != "off" {
+			if cip := clientIP(r); cip != nil { ip = cip.String() }
+		}
+		if u := cdnURL(p, ip); u != "" { http.Redirect(w, r, u, http.StatusTemporaryRedirect); return }
+	}
+	var sum, updated string
+	_ = s.DB.QueryRow(`SELECT COALESCE(sha256,''), updated FROM images WHERE id=?`, id).Scan(&sum, &updated)
+	if version > 0 {
+		_ = s.DB.QueryRow(`SELECT COALESCE(sha256,''), created FROM image_versions WHERE image_id=? AND version=?`, id, version).Scan(&sum, &updated)
+		if len(updated) >= 10 { updated = updated[:10] }
+	}
+	if sum != "" { w.Header().Set("X-Checksum-Sha256", sum) }
+	meta := objectMeta{ETag: sum}
+	meta.Modified, _ = time.Parse("2006-01-02", updated)
+	s.serveObject(w, r, key, name+filepath.Ext(key), meta)
+}
+
+// objectMeta is what serveObject advertises for conditional and resumed
+// downloads: a strong ETag (the stored SHA-256) and the stored modification
+// time. Zero values fall back to the file's mtime and no ETag.
+type objectMeta struct {
+	ETag     string
+	Modified time.Time
+}
+
+// serveObject streams a stored object from local storage, honouring Range,
+// If-Range and the other conditional headers, or redirects to a presigned
+// URL for S3 with the requested range signed in.
+func (s *Server) serveObject(w http.ResponseWriter, r *http.Request, key, filename string, meta objectMeta) {
+	h := w.Header()
+	if meta.ETag != "" { h.Set("ETag", `"`+meta.ETag+`"`) }
+	longTransfer(w)
 	if p, ok := s.Store.LocalPath(key); ok {
 		f, err := os.Open(p)
 		if err != nil { http.Error(w, err.Error(), 500); return }
 		defer f.Close()
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+filepath.Ext(key)))
-		http.ServeContent(w, r, key, time.Now(), f)
+		if meta.Modified.IsZero() { if st, err := f.Stat(); err == nil { meta.Modified = st.ModTime() } }
+		h.Set("Accept-Ranges", "bytes")
+		h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		http.ServeContent(w, r, key, meta.Modified, f)
 		return
 	}
-	u, err := s.Store.Presign(r.Context(), key, 15*time.Minute)
+	if !meta.Modified.IsZero() { h.Set("Last-Modified", meta.Modified.UTC().Format(http.TimeFormat)) }
+	var u string
+	var err error
+	if rp, ok := s.Store.(rangePresigner); ok {
+		u, err = rp.PresignRange(r.Context(), r.Method, key, filename, 15*time.Minute, downloadRange(r, meta))
+	} else {
+		u, err = s.Store.Presign(r.Context(), key, 15*time.Minute)
+	}
 	if err != nil { http.Error(w, err.Error(), 500); return }
 	http.Redirect(w, r, u, http.StatusTemporaryRedirect)
 }
 
-func (s *Server) StorePut(ctx context.Context, key string, r io.Reader) (int64, error) {
+// rangePresigner is implemented by stores that can presign a request with
+// extra signed headers.
+type rangePresigner interface {
+	PresignRange(ctx context.Context, method, key, filename string, expiry time.Duration, rng string) (string, error)
+}
+
+// downloadRange returns the Range header to forward to the object store: a
+// single byte range, dropped when If-Range no longer matches the object.
+func downloadRange(r *http.Request, meta objectMeta) string {
+	rng := strings.TrimSpace(r.Header.Get("Range"))
+	if !strings.HasPrefix(rng, "bytes=") || strings.Contains(rng, ",") { return "" }
+	if ir := strings.TrimSpace(r.Header.Get("If-Range")); ir != "" {
+		if strings.HasPrefix(ir, `"`) {
+			if meta.ETag == "" || ir != `"`+meta.ETag+`"` { return "" }
+		} else if t, err := http.ParseTime(ir); err != nil || meta.Modified.IsZero() || !meta.Modified.Truncate(time.Second).Equal(t) {
+			return ""
+		}
+	}
+	return rng
+}
+
+// StorePut streams r into storage and returns its size and SHA-256. A read
+// error on r fails the Put rather than storing a truncated object.
+func (s *Server) StorePut(ctx context.Context, key string, r io.Reader) (int64, string, error) {
 	pr, pw := io.Pipe()
-	var size int64
-	go func() { defer pw.Close(); n, _ := io.Copy(pw, r); size = n }()
-	if err := s.Store.Put(ctx, key, pr, -1); err != nil { return 0, err }
-	return size, nil
+	h := sha256.New()
+	done := make(chan int64, 1)
+	go func() { n, err := io.Copy(pw, io.TeeReader(r, h)); pw.CloseWithError(err); done <- n }()
+	err := s.Store.Put(ctx, key, pr, -1)
+	pr.CloseWithError(io.ErrClosedPipe) // unblock the copy if Put stopped reading early
+	size := <-done
+	if err != nil { return 0, "", err }
+	return size, hex.EncodeToString(h.Sum(nil)), nil
 }
 
 // ---- Auth ----
@@ -405,82 +779,131 @@ func initAuth(db *sql.DB) error {
 		created_at TEXT NOT NULL
 	);`
 	if _, err := db.Exec(ddl); err != nil { return err }
-	_, _ = db.Exec(`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'viewer'`)
 	return nil
 }
 
 func (s *Server) authRoutes() {
-	secret := s.JWTSecret
-
-	s.Mux.HandleFunc("/api/auth/register", func(w http.ResponseWriter, r *http.Request) {
+	s.Mux.HandleFunc("/api/v1/auth/register", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
 		var body struct{ Email, Password string }
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil { http.Error(w, err.Error(), 400); return }
-		if strings.TrimSpace(body.Email) == "" || strings.TrimSpace(body.Password) == "" {
-			http.Error(w, "email and password required", 400); return
-		}
-		hash, _ := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
+		if !decodeJSON(w, r, &body) { return }
+		body.Email = strings.TrimSpace(body.Email)
+		var v validator
+		v.email("email", body.Email)
+		v.password("password", body.Password)
+		if err := v.err(); err != nil { badRequest(w, err); return }
+		hash, err := hashPassword(body.Password)
+		if err != nil { http.Error(w, err.Error(), 500); return }
 		var cnt int
 		_ = s.DB.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&cnt)
 		role := "viewer"
 		if cnt == 0 { role = "admin" }
-		_, err := s.DB.Exec(`INSERT INTO users (email, passhash, role, created_at) VALUES (?,?,?,?)`,
-			body.Email, string(hash), role, time.Now().Format(time.RFC3339))
+		_, err = s.DB.Exec(`INSERT INTO users (email, passhash, role, created_at) VALUES (?,?,?,?)`,
+			body.Email, hash, role, time.Now().Format(time.RFC3339))
 		if err != nil { http.Error(w, "cannot register: "+err.Error(), 400); return }
 		writeJSON(w, 201, map[string]any{"ok": true})
 	})
 
-	s.Mux.HandleFunc("/api/auth/login", func(w http.ResponseWriter, r *http.Request) {
+	s.Mux.HandleFunc("/api/v1/auth/login", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
-		var body struct{ Email, Password string }
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil { http.Error(w, err.Error(), 400); return }
-		var id int64; var passhash, role string
-		err := s.DB.QueryRow(`SELECT id, passhash, role FROM users WHERE email=?`, body.Email).Scan(&id, &passhash, &role)
-		if err != nil || bcrypt.CompareHashAndPassword([]byte(passhash), []byte(body.Password)) != nil {
-			http.Error(w, "invalid credentials", 401); return
+		var body struct{ Email, Password, Code string }
+		if !decodeJSON(w, r, &body) { return }
+		var id int64; var passhash, role, tempExpires string
+		err := s.DB.QueryRow(`SELECT id, passhash, role, COALESCE(temp_password_expires_at,'') FROM users WHERE email=?`, body.Email).Scan(&id, &passhash, &role, &tempExpires)
+		factor := "password"
+		if (err != nil || passhash == "") && ldapConfigured() {
+			// no local password: try the directory (see ldap.go)
+			email, dn, lrole, lerr := s.ldapAuthenticate(body.Email, body.Password)
+			if lerr == nil { id, lerr = s.provisionLDAPUser(email, dn, lrole) }
+			if lerr != nil {
+				if !errors.Is(lerr, errLDAPInvalid) { log.Printf("ldap login %s: %v", body.Email, lerr) }
+				http.Error(w, "invalid credentials", 401); return
+			}
+			body.Email, role, tempExpires, factor = email, lrole, "", "ldap"
+		} else {
+			// the password is verified, against a stand-in hash when there is
+			// no account, before anything tells accounts apart
+			hash := passhash
+			if err != nil || hash == "" { hash = dummyPasswordHash() }
+			if !checkPassword(hash, body.Password) || err != nil || passhash == "" { http.Error(w, "invalid credentials", 401); return }
 		}
-		access, refresh, err := s.issueTokens(id, body.Email, role)
+		if tempExpires != "" && tempExpires <= time.Now().UTC().Format(time.RFC3339) { http.Error(w, "temporary password expired; ask an admin to reset it again", 401); return }
+		if role == rolePending { http.Error(w, errAccountPending.Error(), 403); return }
+		method, ok := s.loginMFA(w, id, body.Email, role, factor, body.Code)
+		if !ok { return }
+		if factor == "password" { s.upgradePasswordHash(id, passhash, body.Password) }
+		access, refresh, err := s.startSession(r, id, body.Email, role, method)
 		if err != nil { http.Error(w, err.Error(), 500); return }
-		http.SetCookie(w, &http.Cookie{Name:"bootah_refresh", Value:refresh, HttpOnly:true, Secure:false, Path:"/", SameSite:http.SameSiteLaxMode, MaxAge:int(30*24*time.Hour/time.Second)})
-		s.audit(&id, "login", "auth", map[string]any{"email": body.Email})
+		s.setRefreshCookie(w, r, refresh)
+		s.audit(&id, "login", "auth", map[string]any{"email": body.Email, "method": method})
 		writeJSON(w, 200, map[string]any{"token": access})
 	})
 
-	s.Mux.HandleFunc("/api/auth/change_password", func(w http.ResponseWriter, r *http.Request) {
+	s.Mux.HandleFunc("/api/v1/auth/change_password", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
 		_, claims, err := s.verifyAuth(r)
 		if err != nil { http.Error(w, "unauthorized", 401); return }
-		uid := int64(claims["sub"].(float64))
+		uid, _ := claims["sub"].(int64)
 		var body struct{ Current, New string }
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil { http.Error(w, err.Error(), 400); return }
+		if !decodeJSON(w, r, &body) { return }
+		var v validator
+		v.required("current", body.Current)
+		v.password("new", body.New)
+		if err := v.err(); err != nil { badRequest(w, err); return }
 		var hash string
 		if err := s.DB.QueryRow(`SELECT passhash FROM users WHERE id=?`, uid).Scan(&hash); err != nil { http.Error(w, err.Error(), 500); return }
-		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(body.Current)) != nil { http.Error(w, "invalid current password", 400); return }
-		newHash, _ := bcrypt.GenerateFromPassword([]byte(body.New), bcrypt.DefaultCost)
-		if _, err := s.DB.Exec(`UPDATE users SET passhash=? WHERE id=?`, string(newHash), uid); err != nil { http.Error(w, err.Error(), 500); return }
+		if !checkPassword(hash, body.Current) { http.Error(w, "invalid current password", 400); return }
+		newHash, err := hashPassword(body.New)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if _, err := s.DB.Exec(`UPDATE users SET passhash=?, temp_password_expires_at=NULL WHERE id=?`, newHash, uid); err != nil { http.Error(w, err.Error(), 500); return }
+		s.revokeSessions(uid, s.cookieJTI(r), "password_change")
 		s.audit(nil, "change_password", "auth", map[string]any{})
 		writeJSON(w, 200, map[string]any{"ok": true})
 	})
 
-	s.Mux.HandleFunc("/api/auth/refresh", func(w http.ResponseWriter, r *http.Request) {
+	s.Mux.HandleFunc("/api/v1/auth/refresh", func(w http.ResponseWriter, r *http.Request) {
 		ck, err := r.Cookie("bootah_refresh"); if err != nil { http.Error(w, "no refresh", 401); return }
-		t, err := jwt.ParseWithClaims(ck.Value, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) { return []byte(secret), nil }, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
-		if err != nil || !t.Valid { http.Error(w, "invalid refresh", 401); return }
-		claims := t.Claims.(*jwt.RegisteredClaims)
-		id, _ := strconv.ParseInt(claims.Subject, 10, 64)
-		var email, role string
-		if err := s.DB.QueryRow(`SELECT email, role FROM users WHERE id=?`, id).Scan(&email, &role); err != nil { http.Error(w, "user not found", 401); return }
-		acc, ref, _ := s.issueTokens(id, email, role)
-		http.SetCookie(w, &http.Cookie{Name:"bootah_refresh", Value:ref, HttpOnly:true, Secure:false, Path:"/", SameSite:http.SameSiteLaxMode, MaxAge:int(30*24*time.Hour/time.Second)})
+		id, jti, ok := s.refreshJTI(ck.Value)
+		if !ok { http.Error(w, "invalid refresh", 401); return }
+		var email, role, source, dn string
+		if err := s.DB.QueryRow(`SELECT email, role, source, COALESCE(directory_dn,'') FROM users WHERE id=?`, id).Scan(&email, &role, &source, &dn); err != nil { http.Error(w, "user not found", 401); return }
+		if source == "ldap" && ldapConfigured() {
+			// the directory decides on every refresh (see ldap.go)
+			lrole, err := s.ldapRecheck(dn)
+			if errors.Is(err, errLDAPInvalid) {
+				s.revokeSessions(id, "", "directory")
+				http.Error(w, "directory account is no longer valid", 401); return
+			}
+			if err != nil { log.Printf("ldap refresh %s: %v", email, err); http.Error(w, "directory unavailable", 503); return }
+			if err := s.syncLDAPRole(id, lrole); err != nil { http.Error(w, err.Error(), 500); return }
+			role = lrole
+		}
+		if role == rolePending { http.Error(w, errAccountPending.Error(), 403); return }
+		if s.mfaRequired(role) && !s.mfaEnabled(id) { http.Error(w, "two-factor authentication is required for your role; log in again to set it up", 401); return }
+		acc, ref, live, err := s.rotateSession(id, jti, email, role)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if !live { http.Error(w, "session ended", 401); return }
+		s.setRefreshCookie(w, r, ref)
 		writeJSON(w, 200, map[string]any{"token": acc})
 	})
 
-	s.Mux.HandleFunc("/api/auth/logout", func(w http.ResponseWriter, r *http.Request) {
+	// Token lifetimes and validation leeway, plus server time so clients can
+	// detect their own clock skew
+	s.Mux.HandleFunc("/api/v1/auth/policy", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		writeJSON(w, 200, map[string]any{"access_ttl_seconds": int64(jwtAccessTTL() / time.Second), "refresh_ttl_seconds": int64(jwtRefreshTTL() / time.Second),
+			"leeway_seconds": int64(jwtLeeway() / time.Second), "issuer": jwtIssuer(), "audience": jwtAudience(), "server_time": time.Now().UTC().Format(time.RFC3339)})
+	})
+
+	s.Mux.HandleFunc("/api/v1/auth/logout", func(w http.ResponseWriter, r *http.Request) {
+		if jti := s.cookieJTI(r); jti != "" {
+			_, _ = s.DB.Exec(`UPDATE sessions SET revoked_at=?, revoked_reason='logout' WHERE jti=? AND revoked_at IS NULL`, time.Now().UTC().Format(time.RFC3339), jti)
+		}
 		http.SetCookie(w, &http.Cookie{Name:"bootah_refresh", Value:"", MaxAge:0, Path:"/"})
 		writeJSON(w, 200, map[string]any{"ok": true})
 	})
 
-	s.Mux.HandleFunc("/api/auth/me", func(w http.ResponseWriter, r *http.Request) {
+	s.Mux.HandleFunc("/api/v1/auth/me", func(w http.ResponseWriter, r *http.Request) {
 		_, claims, err := s.verifyAuth(r)
 		if err != nil { http.Error(w, "unauthorized", 401); return }
 		writeJSON(w, 200, claims)
@@ -488,7 +911,7 @@ func (s *Server) authRoutes() {
 }
 
 func (s *Server) adminUserRoutes() {
-	s.Mux.HandleFunc("/api/admin/users", func(w http.ResponseWriter, r *http.Request) {
+	s.Mux.HandleFunc("/api/v1/admin/users", func(w http.ResponseWriter, r *http.Request) {
 		if !s.requireRole(w, r, "admin") { return }
 		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
 		rows, err := s.DB.Query(`SELECT id, email, role, created_at FROM users ORDER BY id ASC`)
@@ -503,92 +926,107 @@ func (s *Server) adminUserRoutes() {
 		writeJSON(w, 200, out)
 	})
 
-	s.Mux.HandleFunc("/api/admin/users/role", func(w http.ResponseWriter, r *http.Request) {
+	s.Mux.HandleFunc("/api/v1/admin/users/role", func(w http.ResponseWriter, r *http.Request) {
 		if !s.requireRole(w, r, "admin") { return }
 		if r.Method != http.MethodPut { http.Error(w, "method not allowed", 405); return }
 		var body struct{ ID int64 `json:"id"`; Role string `json:"role"` }
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil { http.Error(w, err.Error(), 400); return }
+		if !decodeJSON(w, r, &body) { return }
 		role := strings.ToLower(strings.TrimSpace(body.Role))
-		if role != "admin" && role != "operator" && role != "viewer" {
-			http.Error(w, "invalid role", 400); return
-		}
+		var v validator
+		if !s.roleExists(role) { v.add("role", "unknown role %q", role) }
+		if body.ID <= 0 { v.add("id", "is required") }
+		if sites, err := s.userSites(body.ID); err == nil && role == "admin" && len(sites) > 0 { v.add("role", "admins are global; clear the user's sites first") }
+		if err := v.err(); err != nil { badRequest(w, err); return }
+		var cur string
+		if err := s.DB.QueryRow(`SELECT role FROM users WHERE id=?`, body.ID).Scan(&cur); err != nil { http.NotFound(w, r); return }
+		if !s.requireGrant(w, r, cur, role) { return }
 		if _, err := s.DB.Exec(`UPDATE users SET role=? WHERE id=?`, role, body.ID); err != nil { http.Error(w, err.Error(), 500); return }
+		s.revokeSessions(body.ID, "", "role_change")
 		s.audit(nil, "role_update", "user", map[string]any{"id": body.ID, "role": role})
 		writeJSON(w, 200, map[string]any{"ok": true})
 	})
 
-	s.Mux.HandleFunc("/api/admin/users/delete", func(w http.ResponseWriter, r *http.Request) {
+	s.Mux.HandleFunc("/api/v1/admin/users/delete", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		s.handleDeleteUser(w, r)
+	})
+
+	s.Mux.HandleFunc("/api/v1/admin/users/owned", func(w http.ResponseWriter, r *http.Request) {
 		if !s.requireRole(w, r, "admin") { return }
-		if r.Method != http.MethodDelete { http.Error(w, "method not allowed", 405); return }
-		var body struct{ ID int64 `json:"id"` }
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil { http.Error(w, err.Error(), 400); return }
-		if _, err := s.DB.Exec(`DELETE FROM users WHERE id=?`, body.ID); err != nil { http.Error(w, err.Error(), 500); return }
-		writeJSON(w, 200, map[string]any{"deleted": body.ID})
+		s.handleUserOwnership(w, r)
 	})
 
-	s.Mux.HandleFunc("/api/admin/users/reset_password", func(w http.ResponseWriter, r *http.Request) {
+	s.Mux.HandleFunc("/api/v1/admin/users/reset_password", func(w http.ResponseWriter, r *http.Request) {
 		if !s.requireRole(w, r, "admin") { return }
 		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
-		var body struct{ ID int64 `json:"id"` }
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil { http.Error(w, err.Error(), 400); return }
+		var body struct {
+			ID       int64  `json:"id"`
+			Delivery string `json:"delivery"` // response (default) | email
+		}
+		if !decodeJSON(w, r, &body) { return }
+		if body.Delivery == "" { body.Delivery = "response" }
+		var v validator
+		v.oneOf("delivery", body.Delivery, "response", "email")
+		if err := v.err(); err != nil { badRequest(w, err); return }
+		if body.Delivery == "email" && !mailConfigured() { http.Error(w, "email delivery is not configured", 409); return }
+		var email string
+		if err := s.DB.QueryRow(`SELECT email FROM users WHERE id=?`, body.ID).Scan(&email); err != nil { http.NotFound(w, r); return }
 		temp := genTempPassword()
-		hash, _ := bcrypt.GenerateFromPassword([]byte(temp), bcrypt.DefaultCost)
-		if _, err := s.DB.Exec(`UPDATE users SET passhash=? WHERE id=?`, string(hash), body.ID); err != nil { http.Error(w, err.Error(), 500); return }
-		s.audit(nil, "reset_password", "user", map[string]any{"id": body.ID})
-		writeJSON(w, 200, map[string]any{"temporaryPassword": temp})
+		hash, err := hashPassword(temp)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		expires := time.Now().UTC().Add(tempPasswordTTL()).Format(time.RFC3339)
+		if body.Delivery == "email" {
+			msg := fmt.Sprintf("An administrator reset your Bootah password.\n\nTemporary password: %s\n\nIt expires at %s. Log in and change it before then.\n", temp, expires)
+			if err := sendMail(email, "Your temporary Bootah password", msg); err != nil { http.Error(w, "email delivery: "+err.Error(), 502); return }
+		}
+		if _, err := s.DB.Exec(`UPDATE users SET passhash=?, temp_password_expires_at=? WHERE id=?`, hash, expires, body.ID); err != nil { http.Error(w, err.Error(), 500); return }
+		s.revokeSessions(body.ID, "", "password_reset")
+		s.audit(s.actorID(r), "reset_password", "user", map[string]any{"id": body.ID, "delivery": body.Delivery, "expires_at": expires})
+		if body.Delivery == "email" { writeJSON(w, 200, map[string]any{"delivered": "email", "expiresAt": expires}); return }
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, 200, map[string]any{"temporaryPassword": temp, "expiresAt": expires})
 	})
 }
 
 // ---- OIDC ----
 func (s *Server) oidcStart(w http.ResponseWriter, r *http.Request) {
 	if !s.OIDCEnabled { http.Error(w, "oidc disabled", 400); return }
-	state := genID()
-	url := s.OAuth2Conf.AuthCodeURL(state)
-	writeJSON(w, 200, map[string]string{"redirect": url, "state": state})
+	st := oidcLoginState{State: randToken(16), Nonce: randToken(16), Verifier: oauth2.GenerateVerifier(),
+		ReturnTo: oidcReturnTarget(r.URL.Query().Get("return_to")), Exp: time.Now().Add(10 * time.Minute).Unix()}
+	if err := s.setOIDCState(w, r, st); err != nil { http.Error(w, err.Error(), 500); return }
+	url := s.OAuth2Conf.AuthCodeURL(st.State, oidc.Nonce(st.Nonce), oauth2.S256ChallengeOption(st.Verifier))
+	if r.URL.Query().Get("redirect") == "1" { http.Redirect(w, r, url, http.StatusFound); return }
+	writeJSON(w, 200, map[string]string{"redirect": url, "state": st.State})
 }
 
 func (s *Server) oidcCallback(w http.ResponseWriter, r *http.Request) {
 	if !s.OIDCEnabled { http.Error(w, "oidc disabled", 400); return }
 	ctx := r.Context()
+	st, err := s.takeOIDCState(w, r)
+	if err != nil { http.Error(w, err.Error(), 400); return }
+	if e := r.URL.Query().Get("error"); e != "" { http.Error(w, "provider: "+e+" "+r.URL.Query().Get("error_description"), 400); return }
 	code := r.URL.Query().Get("code")
 	if code == "" { http.Error(w, "missing code", 400); return }
-	oauth2Token, err := s.OAuth2Conf.Exchange(ctx, code)
+	oauth2Token, err := s.OAuth2Conf.Exchange(ctx, code, oauth2.VerifierOption(st.Verifier))
 	if err != nil { http.Error(w, "exchange: "+err.Error(), 400); return }
 	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
 	if !ok { http.Error(w, "missing id_token", 400); return }
 	idToken, err := s.OIDCVerifier.Verify(ctx, rawIDToken)
 	if err != nil { http.Error(w, "verify: "+err.Error(), 400); return }
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(st.Nonce)) != 1 { http.Error(w, "nonce mismatch", 400); return }
 	var claims struct{ Email string `json:"email"` }
 	if err := idToken.Claims(&claims); err != nil { http.Error(w, "claims: "+err.Error(), 400); return }
 	if strings.TrimSpace(claims.Email) == "" { http.Error(w, "no email", 400); return }
-	var id int64
-	err = s.DB.QueryRow(`SELECT id FROM users WHERE email=?`, claims.Email).Scan(&id)
-	if errors.Is(err, sql.ErrNoRows) {
-		var cnt int
-		_ = s.DB.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&cnt)
-		role := "operator"
-		if cnt == 0 { role = "admin" }
-		_, err = s.DB.Exec(`INSERT INTO users (email, passhash, role, created_at) VALUES (?,?,?,?)`,
-			claims.Email, "", role, time.Now().Format(time.RFC3339))
-		if err != nil { http.Error(w, "create: "+err.Error(), 500); return }
-		_ = s.DB.QueryRow(`SELECT id FROM users WHERE email=?`, claims.Email).Scan(&id)
-	} else if err != nil {
-		http.Error(w, err.Error(), 500); return
-	}
-	role := "viewer"
-	_ = s.DB.QueryRow(`SELECT role FROM users WHERE id=?`, id).Scan(&role)
-	access, refresh, _ := s.issueTokens(id, claims.Email, role)
-	http.SetCookie(w, &http.Cookie{Name:"bootah_refresh", Value:refresh, HttpOnly:true, Secure:false, Path:"/", SameSite:http.SameSiteLaxMode, MaxAge:int(30*24*time.Hour/time.Second)})
-	html := fmt.Sprintf(`<!doctype html><meta charset="utf-8"><script>
-localStorage.setItem('bootah_token', %q);
-fetch('/api/auth/me',{headers:{Authorization:'Bearer '+%q}}).then(r=>r.json()).then(me=>{
-  localStorage.setItem('bootah_role', me.role||'');
-  window.location.href='/';
-});
-</script>`, access, access)
-	w.Header().Set("Content-Type", "text/html")
-	w.WriteHeader(200)
-	_, _ = w.Write([]byte(html))
+	id, role, err := s.provisionOIDCUser(claims.Email)
+	if errors.Is(err, errAccountPending) { http.Error(w, "your account is awaiting administrator approval", 403); return }
+	if errors.Is(err, errNoAccount) { http.Error(w, err.Error(), 403); return }
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	_, refresh, err := s.startSession(r, id, claims.Email, role, "oidc")
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	s.setRefreshCookie(w, r, refresh)
+	s.audit(&id, "login", "auth", map[string]any{"email": claims.Email, "method": "oidc"})
+	// The UI trades the refresh cookie for an access token via /api/v1/auth/refresh.
+	http.Redirect(w, r, st.ReturnTo, http.StatusFound)
 }
 
 // ---- DB & helpers ----
@@ -599,10 +1037,11 @@ func initDB(db *sql.DB) error {
 		type TEXT NOT NULL,
 		size_mb INTEGER NOT NULL,
 		updated TEXT NOT NULL,
-		file TEXT NOT NULL
+		file TEXT NOT NULL,
+		sha256 TEXT
 	);`
-	_, err := db.Exec(ddl)
-	return err
+	if _, err := db.Exec(ddl); err != nil { return err }
+	return nil
 }
 
 func getenv(k, def string) string { if v := strings.TrimSpace(os.Getenv(k)); v != "" { return v }; return def }
@@ -612,9 +1051,43 @@ func detectType(filename string) string {
 	switch ext { case ".wim": return "wim"; case ".ffu": return "ffu"; case ".iso": return "iso"; default: return strings.TrimPrefix(ext, ".") }
 }
 func genID() string { return fmt.Sprintf("%d%04d", time.Now().Unix(), rand.Intn(10000)) }
-func genTempPassword() string {
-	const letters = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789!@$%"
-	b := make([]byte, 12); for i := range b { b[i] = letters[rand.Intn(len(letters))] }; return string(b)
+
+// Tokens name this install as issuer and carry distinct audiences for access
+// and refresh use, so tokens minted elsewhere with the same secret, or a
+// refresh token presented as a bearer token, are rejected. Both default to
+// the install's name (BOOTAH_PUBLIC_URL, or its generated instance ID when
+// that is unset), never to a value another install shares;
+// BOOTAH_JWT_ISSUER and BOOTAH_JWT_AUDIENCE override them.
+func jwtIssuer() string { return getenv("BOOTAH_JWT_ISSUER", instanceName()) }
+func jwtAudience() string { return getenv("BOOTAH_JWT_AUDIENCE", instanceName()+"/api") }
+
+// instanceName identifies the install: its public URL, or urn:bootah: and
+// its instance ID.
+func instanceName() string {
+	if u := getenv("BOOTAH_PUBLIC_URL", ""); u != "" { return strings.TrimRight(u, "/") }
+	return "urn:bootah:" + instanceID
+}
+func jwtRefreshAudience() string { return jwtAudience() + "/refresh" }
+
+// Token lifetimes (BOOTAH_JWT_ACCESS_TTL, default 15m; BOOTAH_JWT_REFRESH_TTL,
+// default 720h) and the clock skew tolerated when validating exp/iat/nbf
+// (BOOTAH_JWT_LEEWAY, default 30s, at most 5m). Invalid values fall back to
+// the defaults. Clients can read them from /api/v1/auth/policy.
+func envDuration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(getenv(key, ""))
+	if err != nil || d <= 0 { return def }
+	return d
+}
+func jwtAccessTTL() time.Duration { return envDuration("BOOTAH_JWT_ACCESS_TTL", 15*time.Minute) }
+func jwtRefreshTTL() time.Duration {
+	if d := envDuration("BOOTAH_JWT_REFRESH_TTL", 30*24*time.Hour); d >= jwtAccessTTL() { return d }
+	return jwtAccessTTL()
+}
+func jwtLeeway() time.Duration {
+	d, err := time.ParseDuration(getenv("BOOTAH_JWT_LEEWAY", "30s"))
+	if err != nil || d < 0 { return 30 * time.Second }
+	if d > 5*time.Minute { return 5 * time.Minute }
+	return d
 }
 
 // verifyAuth using JWT lib
@@ -622,22 +1095,27 @@ type jwtClaims struct {
 	Sub   int64  `json:"sub"`
 	Email string `json:"email"`
 	Role  string `json:"role"`
+	Impersonator int64 `json:"imp,omitempty"` // admin acting as this user
 	jwt.RegisteredClaims
 }
-func (s *Server) issueTokens(id int64, email, role string) (string, string, error) {
+func (s *Server) issueTokens(id int64, email, role, jti string) (string, string, error) {
 	now := time.Now()
 	acc := jwt.NewWithClaims(jwt.SigningMethodHS256, jwtClaims{
 		Sub: id, Email: email, Role: role,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(now.Add(15 * time.Minute)),
+			Issuer:    jwtIssuer(),
+			Audience:  jwt.ClaimStrings{jwtAudience()},
+			ExpiresAt: jwt.NewNumericDate(now.Add(jwtAccessTTL())),
 			IssuedAt:  jwt.NewNumericDate(now),
 		},
 	})
 	ref := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer:    jwtIssuer(),
+		Audience:  jwt.ClaimStrings{jwtRefreshAudience()},
 		Subject:   fmt.Sprint(id),
-		ExpiresAt: jwt.NewNumericDate(now.Add(30 * 24 * time.Hour)),
+		ExpiresAt: jwt.NewNumericDate(now.Add(jwtRefreshTTL())),
 		IssuedAt:  jwt.NewNumericDate(now),
-		ID:        genID(),
+		ID:        jti,
 	})
 	accStr, err := acc.SignedString([]byte(s.JWTSecret))
 	if err != nil { return "", "", err }
@@ -648,7 +1126,7 @@ func (s *Server) issueTokens(id int64, email, role string) (string, string, erro
 func (s *Server) parseAccess(token string) (*jwtClaims, error) {
 	t, err := jwt.ParseWithClaims(token, &jwtClaims{}, func(t *jwt.Token) (interface{}, error) {
 		return []byte(s.JWTSecret), nil
-	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(jwtIssuer()), jwt.WithAudience(jwtAudience()), jwt.WithLeeway(jwtLeeway()))
 	if err != nil { return nil, err }
 	if claims, ok := t.Claims.(*jwtClaims); ok && t.Valid { return claims, nil }
 	return nil, fmt.Errorf("invalid token")
@@ -657,15 +1135,28 @@ func (s *Server) verifyAuth(r *http.Request) (string, map[string]any, error) {
 	ah := r.Header.Get("Authorization")
 	if !strings.HasPrefix(ah, "Bearer ") { return "", nil, fmt.Errorf("no bearer") }
 	tok := strings.TrimPrefix(ah, "Bearer ")
+	if strings.HasPrefix(tok, apiKeyPrefix) {
+		m, err := s.verifyAPIKey(r, tok)
+		return tok, m, err
+	}
 	claims, err := s.parseAccess(tok)
 	if err != nil { return "", nil, err }
 	m := map[string]any{"sub": claims.Sub, "email": claims.Email, "role": claims.Role}
+	if claims.Impersonator != 0 { m["impersonator"] = claims.Impersonator }
 	return tok, m, nil
 }
+// actorID returns the authenticated user's id for audit entries, or nil.
+func (s *Server) actorID(r *http.Request) *int64 {
+	_, claims, err := s.verifyAuth(r)
+	if err != nil { return nil }
+	id, ok := claims["sub"].(int64)
+	if !ok { return nil }
+	return &id
+}
 
 // simple logging/cors
 func loggingMiddleware(next http.Handler) http.Handler { return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { start := time.Now(); next.ServeHTTP(w, r); log.Printf("%s %s %s", r.Method, r.URL.Path, time.Since(start)) }) }
-func corsMiddleware(next http.Handler) http.Handler { return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Header().Set("Access-Control-Allow-Origin", "*"); w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS"); w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization"); if r.Method == http.MethodOptions { w.WriteHeader(http.StatusNoContent); return }; next.ServeHTTP(w, r) }) }
+func corsMiddleware(next http.Handler) http.Handler { return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Header().Set("Access-Control-Allow-Origin", "*"); w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS"); w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-ID"); w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, X-Total-Count, Deprecation, Sunset, Link"); if r.Method == http.MethodOptions { w.WriteHeader(http.StatusNoContent); return }; next.ServeHTTP(w, r) }) }
 func writeJSON(w http.ResponseWriter, status int, v any) { w.Header().Set("Content-Type", "application/json"); w.WriteHeader(status); json.NewEncoder(w).Encode(v) }
 
 // ---- Audit Log ----
@@ -685,47 +1176,68 @@ func (s *Server) audit(actorID *int64, action, resource string, meta map[string]
 	js, _ := json.Marshal(meta)
 	var aid any = nil
 	if actorID != nil { aid = *actorID }
-	_, _ = s.DB.Exec(`INSERT INTO audit (ts, actor_id, action, resource, meta) VALUES (?,?,?,?,?)`,
-		time.Now().Format(time.RFC3339), aid, action, resource, string(js))
+	typ, ver := auditSchema(action, resource, js)
+	_, _ = s.DB.Exec(`INSERT INTO audit (ts, actor_id, action, resource, meta, event_type, schema_version) VALUES (?,?,?,?,?,?,?)`,
+		time.Now().Format(time.RFC3339), aid, action, resource, string(js), typ, ver)
 }
 func (s *Server) adminAuditRoutes() {
-	s.Mux.HandleFunc("/api/admin/audit", func(w http.ResponseWriter, r *http.Request) {
+	s.Mux.HandleFunc("/api/v1/admin/audit", func(w http.ResponseWriter, r *http.Request) {
 		if !s.requireRole(w, r, "admin") { return }
-		rows, err := s.DB.Query(`SELECT id, ts, actor_id, action, resource, meta FROM audit ORDER BY id DESC LIMIT 500`)
+		// ?type=resource.action filters; "data" is meta decoded, typed per
+		// /api/v1/admin/audit/types when schema_version > 0
+		out, err := s.auditEntries(r.URL.Query().Get("type"), "", "", 500)
 		if err != nil { http.Error(w, err.Error(), 500); return }
-		defer rows.Close()
-		var out []map[string]any
-		for rows.Next() {
-			var id int64; var ts, action, resource, meta string; var actor any
-			if err := rows.Scan(&id, &ts, &actor, &action, &resource, &meta); err != nil { http.Error(w, err.Error(), 500); return }
-			out = append(out, map[string]any{"id": id, "ts": ts, "actor_id": actor, "action": action, "resource": resource, "meta": meta})
-		}
 		writeJSON(w, 200, out)
 	})
 }
 
+// auditEntries returns the newest audit entries, optionally of one type and
+// within [from, to] (RFC 3339 timestamps).
+func (s *Server) auditEntries(typ, from, to string, limit int) ([]map[string]any, error) {
+	q, args := `SELECT id, ts, actor_id, COALESCE(actor_label,''), action, resource, meta, COALESCE(event_type, resource||'.'||action), schema_version FROM audit WHERE 1=1`, []any{}
+	if typ != "" { q += ` AND COALESCE(event_type, resource||'.'||action)=?`; args = append(args, typ) }
+	if from != "" { q += ` AND ts>=?`; args = append(args, from) }
+	if to != "" { q += ` AND ts<=?`; args = append(args, to) }
+	rows, err := s.DB.Query(q+` ORDER BY id DESC LIMIT ?`, append(args, limit)...)
+	if err != nil { return nil, err }
+	return scanAuditEntries(rows)
+}
+
+func scanAuditEntries(rows *sql.Rows) ([]map[string]any, error) {
+	defer rows.Close()
+	var out []map[string]any
+	for rows.Next() {
+		var id int64; var ts, label, action, resource, meta, typ string; var ver int; var actor any
+		if err := rows.Scan(&id, &ts, &actor, &label, &action, &resource, &meta, &typ, &ver); err != nil { return nil, err }
+		var data any
+		_ = json.Unmarshal([]byte(meta), &data)
+		e := map[string]any{"id": id, "ts": ts, "actor_id": actor, "action": action, "resource": resource, "meta": meta, "type": typ, "schema_version": ver, "data": data}
+		if label != "" { e["actor"] = label }
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
 // ---- Storage health ----
 func (s *Server) adminStorageRoutes() {
-	s.Mux.HandleFunc("/api/admin/storage/health", func(w http.ResponseWriter, r *http.Request) {
+	s.Mux.HandleFunc("/api/v1/admin/storage/health", func(w http.ResponseWriter, r *http.Request) {
 		if !s.requireRole(w, r, "admin") { return }
 		mode := getenv("BOOTAH_STORAGE", "local")
 		resp := map[string]any{"mode": mode}
-		switch mode {
-		case "s3":
+		if mode == "s3" {
 			resp["bucket"] = getenv("BOOTAH_S3_BUCKET", "")
 			resp["region"] = getenv("BOOTAH_S3_REGION", "")
-			if s3, ok := s.Store.(*S3Storage); ok {
-				_, err := s3.Presign(r.Context(), "healthcheck.txt", 1*time.Second)
-				if err != nil { resp["ok"] = false; resp["error"] = err.Error() } else { resp["ok"] = true }
-			}
-		default:
-			resp["ok"] = true
 		}
+		// live write/read/delete probe, recorded like the periodic ones
+		p := s.checkStorageHealth(r.Context())
+		resp["ok"], resp["probe"] = p.OK, p
+		if p.Error != "" { resp["error"] = p.Error }
+		if win, err := s.storageWindowFor(nodeID); err == nil { resp["window"] = win }
 		writeJSON(w, 200, resp)
 	})
 }
 
-// ---- WinPE Builder (stub) ----
+// ---- WinPE Builder ----
 func initJobs(db *sql.DB) error {
 	ddl := `CREATE TABLE IF NOT EXISTS jobs (
 		id TEXT PRIMARY KEY,
@@ -738,28 +1250,29 @@ func initJobs(db *sql.DB) error {
 	return err
 }
 func (s *Server) winpeRoutes() {
-	s.Mux.HandleFunc("/api/admin/winpe/jobs", func(w http.ResponseWriter, r *http.Request) {
+	s.Mux.HandleFunc("/api/v1/admin/winpe/jobs", func(w http.ResponseWriter, r *http.Request) {
 		if !s.requireRole(w, r, "admin") { return }
 		switch r.Method {
 		case http.MethodGet:
-			rows, err := s.DB.Query(`SELECT id, kind, status, created_at, result FROM jobs ORDER BY created_at DESC LIMIT 100`)
+			out, err := s.listJobs("", "")
 			if err != nil { http.Error(w, err.Error(), 500); return }
-			defer rows.Close()
-			var out []map[string]any
-			for rows.Next() {
-				var id, kind, status, created, result string
-				if err := rows.Scan(&id, &kind, &status, &created, &result); err != nil { http.Error(w, err.Error(), 500); return }
-				out = append(out, map[string]any{"id": id, "kind": kind, "status": status, "created_at": created, "result": result})
-			}
 			writeJSON(w, 200, out)
 		case http.MethodPost:
-			id := "job-" + genID()
-			now := time.Now().Format(time.RFC3339)
-			result := "/assets/winpe/boot.wim"
-			_, err := s.DB.Exec(`INSERT INTO jobs (id, kind, status, created_at, result) VALUES (?,?,?,?,?)`, id, "winpe-build", "completed", now, result)
+			// {"arch": "amd64", "locale": "", "keyboard": "", "base": "", "driver_packs": [], "image_id": "", "files": {}};
+			// outputs are published as boot assets under the prefix ("winpe") when the build succeeds
+			var j winpeBuildJob
+			if err := json.NewDecoder(r.Body).Decode(&j); err != nil && err != io.EOF { http.Error(w, err.Error(), 400); return }
+			if err := j.normalize(); err != nil { http.Error(w, err.Error(), 400); return }
+			if err := winpeConfigured(&j); err != nil { http.Error(w, err.Error(), 400); return }
+			for _, id := range j.DriverPacks {
+				var n int
+				_ = s.DB.QueryRow(`SELECT COUNT(*) FROM driver_packs WHERE id=?`, id).Scan(&n)
+				if n == 0 { http.Error(w, "unknown driver pack "+id, 400); return }
+			}
+			id, err := s.enqueueJob("winpe-build", j)
 			if err != nil { http.Error(w, err.Error(), 500); return }
-			s.audit(nil, "winpe_build", "job", map[string]any{"job": id})
-			writeJSON(w, 201, map[string]any{"id": id, "status": "completed", "result": result})
+			s.audit(s.actorID(r), "winpe_build", "job", map[string]any{"job": id, "prefix": j.Prefix, "arch": j.Arch, "driver_packs": j.DriverPacks, "image_id": j.ImageID})
+			writeJSON(w, 202, map[string]any{"id": id, "status": "queued"})
 		default:
 			http.Error(w, "method not allowed", 405)
 		}
@@ -788,31 +1301,33 @@ func initDrivers(db *sql.DB) error {
 }
 func (s *Server) driverRoutes() {
 	// CRUD driver packs (admin)
-	s.Mux.HandleFunc("/api/admin/driver_packs", func(w http.ResponseWriter, r *http.Request) {
+	s.Mux.HandleFunc("/api/v1/admin/driver_packs", func(w http.ResponseWriter, r *http.Request) {
 		if !s.requireRole(w, r, "admin") { return }
 		switch r.Method {
 		case http.MethodGet:
-			rows, err := s.DB.Query(`SELECT id, vendor, model, version, url, checksum, notes FROM driver_packs ORDER BY vendor, model`)
+			rows, err := s.DB.Query(`SELECT id, vendor, model, version, url, checksum, notes, COALESCE(overlay,''), COALESCE(overlay_asset,'') FROM driver_packs ORDER BY vendor, model`)
 			if err != nil { http.Error(w, err.Error(), 500); return }
 			defer rows.Close()
 			var out []map[string]any
 			for rows.Next() {
-				var id, vendor, model, version, url, checksum, notes string
-				if err := rows.Scan(&id, &vendor, &model, &version, &url, &checksum, &notes); err != nil { http.Error(w, err.Error(), 500); return }
-				out = append(out, map[string]any{"id": id, "vendor": vendor, "model": model, "version": version, "url": url, "checksum": checksum, "notes": notes})
+				var id, vendor, model, version, url, checksum, notes, overlay, built string
+				if err := rows.Scan(&id, &vendor, &model, &version, &url, &checksum, &notes, &overlay, &built); err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, map[string]any{"id": id, "vendor": vendor, "model": model, "version": version, "url": url, "checksum": checksum, "notes": notes, "overlay": overlay, "overlay_asset": built})
 			}
 			writeJSON(w, 200, out)
 		case http.MethodPost:
-			var body map[string]any
-			if err := json.NewDecoder(r.Body).Decode(&body); err != nil { http.Error(w, err.Error(), 400); return }
+			var body driverPackBody
+			if !decodeJSON(w, r, &body) { return }
 			id := "drv-" + genID()
-			_, err := s.DB.Exec(`INSERT INTO driver_packs (id, vendor, model, version, url, checksum, notes) VALUES (?,?,?,?,?,?,?)`,
-				id, body["vendor"], body["model"], body["version"], body["url"], body["checksum"], body["notes"])
+			overlay, err := overlayPrefixValid(body.Overlay)
+			if err != nil { badRequest(w, validationError{{Field: "overlay", Message: err.Error()}}); return }
+			_, err = s.DB.Exec(`INSERT INTO driver_packs (id, vendor, model, version, url, checksum, notes, overlay) VALUES (?,?,?,?,?,?,?,NULLIF(?,''))`,
+				id, body.Vendor, body.Model, body.Version, body.URL, strings.ToLower(body.Checksum), body.Notes, overlay)
 			if err != nil { http.Error(w, err.Error(), 500); return }
 			writeJSON(w, 201, map[string]any{"id": id})
 		case http.MethodDelete:
 			var body struct{ ID string `json:"id"` }
-			if err := json.NewDecoder(r.Body).Decode(&body); err != nil { http.Error(w, err.Error(), 400); return }
+			if !decodeJSON(w, r, &body) { return }
 			if _, err := s.DB.Exec(`DELETE FROM driver_packs WHERE id=?`, body.ID); err != nil { http.Error(w, err.Error(), 500); return }
 			writeJSON(w, 200, map[string]any{"deleted": body.ID})
 		default:
@@ -821,7 +1336,7 @@ func (s *Server) driverRoutes() {
 	})
 
 	// Attach/detach to images (admin)
-	s.Mux.HandleFunc("/api/admin/images/packs", func(w http.ResponseWriter, r *http.Request) {
+	s.Mux.HandleFunc("/api/v1/admin/images/packs", func(w http.ResponseWriter, r *http.Request) {
 		if !s.requireRole(w, r, "admin") { return }
 		switch r.Method {
 		case http.MethodGet:
@@ -838,12 +1353,12 @@ func (s *Server) driverRoutes() {
 			writeJSON(w, 200, out)
 		case http.MethodPost:
 			var body struct{ ImageID, PackID string }
-			if err := json.NewDecoder(r.Body).Decode(&body); err != nil { http.Error(w, err.Error(), 400); return }
+			if !decodeJSON(w, r, &body) { return }
 			if _, err := s.DB.Exec(`INSERT OR IGNORE INTO image_driver_packs (image_id, pack_id) VALUES (?,?)`, body.ImageID, body.PackID); err != nil { http.Error(w, err.Error(), 500); return }
 			writeJSON(w, 201, map[string]any{"ok": true})
 		case http.MethodDelete:
 			var body struct{ ImageID, PackID string }
-			if err := json.NewDecoder(r.Body).Decode(&body); err != nil { http.Error(w, err.Error(), 400); return }
+			if !decodeJSON(w, r, &body) { return }
 			if _, err := s.DB.Exec(`DELETE FROM image_driver_packs WHERE image_id=? AND pack_id=?`, body.ImageID, body.PackID); err != nil { http.Error(w, err.Error(), 500); return }
 			writeJSON(w, 200, map[string]any{"ok": true})
 		default:
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ---- Maintenance runs and dry runs ----
+// Destructive admin endpoints take ?dry_run=1: they validate the request and
+// return exactly what would be deleted, rolled back or rewritten, in the same
+// shape as a real run and with "dry_run": true, without changing anything.
+// That covers bulk machine deletion (DELETE /api/v1/machines {macs}), user
+// deletion, schema migrations (POST /api/v1/admin/db/migrations) and the two
+// cleanups the leader otherwise runs on its own schedule, which admins can
+// run now:
+//
+//	POST /api/v1/admin/maintenance/gc         boot asset versions past their
+//	                                          grace period, forgotten upload
+//	                                          sessions
+//	POST /api/v1/admin/maintenance/retention  image download history past
+//	                                          retention or anonymization age
+//
+// Real runs are audited; dry runs are not.
+func isDryRun(r *http.Request) bool {
+	v := strings.ToLower(r.URL.Query().Get("dry_run"))
+	return v == "1" || v == "true"
+}
+
+func (s *Server) maintenanceRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/maintenance/gc", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		dry := isDryRun(r)
+		versions, err := s.prunableAssetVersions()
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if !dry { versions = s.pruneAssetVersions() }
+		var bytes int64
+		for _, v := range versions { bytes += v.Size }
+		var sessions int64
+		if err := s.DB.QueryRow(`SELECT COUNT(*) FROM upload_sessions WHERE `+forgettableUploadSessions, uploadSessionForgetBefore()).Scan(&sessions); err != nil { http.Error(w, err.Error(), 500); return }
+		if !dry && sessions > 0 {
+			res, err := s.DB.Exec(`DELETE FROM upload_sessions WHERE `+forgettableUploadSessions, uploadSessionForgetBefore())
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			sessions, _ = res.RowsAffected()
+		}
+		if versions == nil { versions = []assetVersionRef{} }
+		if !dry { s.audit(s.actorID(r), "gc", "maintenance", map[string]any{"boot_asset_versions": len(versions), "bytes": bytes, "upload_sessions": sessions}) }
+		writeJSON(w, 200, map[string]any{"dry_run": dry, "boot_asset_versions": versions, "bytes": bytes, "upload_sessions": sessions})
+	})
+
+	s.Mux.HandleFunc("/api/v1/admin/maintenance/retention", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		dry := isDryRun(r)
+		downloads, err := s.applyDownloadRetention(downloadPrivacyConfig(), dry)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if !dry { s.audit(s.actorID(r), "retention", "maintenance", map[string]any{"deleted": downloads["delete"], "anonymized": downloads["anonymize"]}) }
+		writeJSON(w, 200, map[string]any{"dry_run": dry, "image_downloads": downloads})
+	})
+}
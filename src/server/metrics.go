@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---- Deployment metrics & SLO reporting ----
+// /metrics exposes Prometheus text format computed from the deployments table
+// on each scrape; /api/v1/admin/reports/deployments summarises durations against
+// an SLO target. Set BOOTAH_METRICS_TOKEN to require a bearer token on /metrics.
+var durationBuckets = []float64{600, 1200, 1800, 2700, 3600, 5400, 7200}
+
+type finishedDeployment struct {
+	Status   string
+	Cause    string
+	Finished time.Time
+	Duration time.Duration
+}
+
+// finishedDeployments returns deployments finished since t.
+func (s *Server) finishedDeployments(since time.Time) ([]finishedDeployment, error) {
+	rows, err := s.DB.Query(`SELECT status, COALESCE(error,''), COALESCE(started_at, created_at), finished_at FROM deployments
+		WHERE finished_at IS NOT NULL AND finished_at >= ?`, since.Format(time.RFC3339))
+	if err != nil { return nil, err }
+	defer rows.Close()
+	var out []finishedDeployment
+	for rows.Next() {
+		var status, cause, started, finished string
+		if err := rows.Scan(&status, &cause, &started, &finished); err != nil { return nil, err }
+		st, err1 := time.Parse(time.RFC3339, started)
+		fin, err2 := time.Parse(time.RFC3339, finished)
+		if err1 != nil || err2 != nil { continue }
+		out = append(out, finishedDeployment{Status: status, Cause: failureCause(cause), Finished: fin, Duration: fin.Sub(st)})
+	}
+	return out, rows.Err()
+}
+
+// failureCause reduces a free-text error to a low-cardinality label.
+func failureCause(msg string) string {
+	msg = strings.TrimSpace(msg)
+	if msg == "" { return "unknown" }
+	if i := strings.IndexAny(msg, ":\n"); i > 0 { msg = msg[:i] }
+	if len(msg) > 40 { msg = msg[:40] }
+	return strings.ToLower(msg)
+}
+
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 { return 0 }
+	i := int(p * float64(len(sorted)-1))
+	return sorted[i]
+}
+
+func (s *Server) metricsRoutes() {
+	s.Mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if tok := getenv("BOOTAH_METRICS_TOKEN", ""); tok != "" && r.Header.Get("Authorization") != "Bearer "+tok {
+			http.Error(w, "unauthorized", 401); return
+		}
+		var b strings.Builder
+		b.WriteString("# HELP bootah_deployments Deployments by current status.\n# TYPE bootah_deployments gauge\n")
+		rows, err := s.DB.Query(`SELECT status, COUNT(*) FROM deployments GROUP BY status ORDER BY status`)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		for rows.Next() {
+			var status string; var n int
+			if err := rows.Scan(&status, &n); err != nil { rows.Close(); http.Error(w, err.Error(), 500); return }
+			fmt.Fprintf(&b, "bootah_deployments{status=%q} %d\n", status, n)
+		}
+		rows.Close()
+
+		done, err := s.finishedDeployments(time.Time{})
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		counts := make([]int, len(durationBuckets))
+		var sum float64; var n int
+		causes := map[string]int{}
+		for _, d := range done {
+			if d.Status == "failed" { causes[d.Cause]++; continue }
+			secs := d.Duration.Seconds()
+			sum += secs; n++
+			for i, le := range durationBuckets {
+				if secs <= le { counts[i]++ }
+			}
+		}
+		b.WriteString("# HELP bootah_deployment_duration_seconds Duration of succeeded deployments.\n# TYPE bootah_deployment_duration_seconds histogram\n")
+		for i, le := range durationBuckets {
+			fmt.Fprintf(&b, "bootah_deployment_duration_seconds_bucket{le=\"%g\"} %d\n", le, counts[i])
+		}
+		fmt.Fprintf(&b, "bootah_deployment_duration_seconds_bucket{le=\"+Inf\"} %d\nbootah_deployment_duration_seconds_sum %g\nbootah_deployment_duration_seconds_count %d\n", n, sum, n)
+		b.WriteString("# HELP bootah_deployment_failures_total Failed deployments by cause.\n# TYPE bootah_deployment_failures_total counter\n")
+		keys := make([]string, 0, len(causes))
+		for k := range causes { keys = append(keys, k) }
+		sort.Strings(keys)
+		for _, k := range keys { fmt.Fprintf(&b, "bootah_deployment_failures_total{cause=%q} %d\n", k, causes[k]) }
+		b.WriteString("# HELP bootah_disk_free_bytes Free space on volumes this node writes to.\n# TYPE bootah_disk_free_bytes gauge\n")
+		vols := s.diskVolumes()
+		for _, v := range vols {
+			if v.Error == "" { fmt.Fprintf(&b, "bootah_disk_free_bytes{volume=%q} %d\n", v.Name, v.FreeBytes) }
+		}
+		b.WriteString("# HELP bootah_disk_total_bytes Size of volumes this node writes to.\n# TYPE bootah_disk_total_bytes gauge\n")
+		for _, v := range vols {
+			if v.Error == "" { fmt.Fprintf(&b, "bootah_disk_total_bytes{volume=%q} %d\n", v.Name, v.TotalBytes) }
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte(b.String()))
+	})
+
+	// SLO report: ?days=30&slo_minutes=45
+	s.Mux.HandleFunc("/api/v1/admin/reports/deployments", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		days, _ := strconv.Atoi(r.URL.Query().Get("days"))
+		if days <= 0 { days = 30 }
+		slo, _ := strconv.Atoi(r.URL.Query().Get("slo_minutes"))
+		if slo <= 0 { slo, _ = strconv.Atoi(getenv("BOOTAH_DEPLOY_SLO_MINUTES", "45")) }
+		resp, err := s.deploymentSLOReport(days, slo)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		writeJSON(w, 200, resp)
+	})
+}
+
+// deploymentSLOReport summarizes deployments finished in the last days against
+// an SLO of slo minutes.
+func (s *Server) deploymentSLOReport(days, slo int) (map[string]any, error) {
+	done, err := s.finishedDeployments(time.Now().AddDate(0, 0, -days))
+	if err != nil { return nil, err }
+	var mins []float64
+	perDay := map[string]int{}
+	causes := map[string]int{}
+	failed, within := 0, 0
+	for _, d := range done {
+		perDay[d.Finished.Format("2006-01-02")]++
+		if d.Status == "failed" { failed++; causes[d.Cause]++; continue }
+		m := d.Duration.Minutes()
+		mins = append(mins, m)
+		if m <= float64(slo) { within++ }
+	}
+	sort.Float64s(mins)
+	var throughput []map[string]any
+	for day, c := range perDay { throughput = append(throughput, map[string]any{"date": day, "count": c}) }
+	sort.Slice(throughput, func(i, j int) bool { return throughput[i]["date"].(string) < throughput[j]["date"].(string) })
+	var causeList []map[string]any
+	for c, n := range causes { causeList = append(causeList, map[string]any{"cause": c, "count": n}) }
+	sort.Slice(causeList, func(i, j int) bool { return causeList[i]["count"].(int) > causeList[j]["count"].(int) })
+	resp := map[string]any{"days": days, "slo_minutes": slo, "total": len(done), "succeeded": len(mins), "failed": failed,
+		"p50_minutes": percentile(mins, 0.5), "p90_minutes": percentile(mins, 0.9), "p95_minutes": percentile(mins, 0.95),
+		"throughput": throughput, "failure_causes": causeList}
+	if len(done) > 0 { resp["success_rate"] = float64(len(mins)) / float64(len(done)) }
+	if len(mins) > 0 { resp["within_slo_rate"] = float64(within) / float64(len(mins)) }
+	return resp, nil
+}
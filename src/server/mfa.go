@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ---- Two-factor authentication (TOTP) ----
+// Local accounts can add a time-based one-time password (RFC 6238: SHA-1,
+// 6 digits, 30 s) as a second factor. POST /api/v1/auth/mfa/setup returns a
+// new secret and its otpauth:// URL for an authenticator app; POST
+// /api/v1/auth/mfa/verify {"code"} confirms it and turns MFA on. From then on
+// /api/v1/auth/login needs {"code"} next to the password and answers 401 with
+// "mfa_required": true without it. A code is accepted one step either side of
+// the server's clock, and only once; five wrong codes in a row lock the
+// second factor for five minutes. Secrets are sealed like every other
+// stored secret. GET /api/v1/auth/mfa shows the caller's state and POST
+// /api/v1/auth/mfa/disable {"code"} turns it off.
+//
+// Admins require MFA for roles with PUT /api/v1/admin/mfa/policy {"roles"}.
+// A user of such a role without MFA gets 403 with "mfa_setup_required" and a
+// short-lived mfa_token at login instead of a session; setup and verify
+// accept it as the bearer token, and verify then starts the session. Their
+// refresh tokens stop working until they enroll, and they cannot disable MFA.
+// POST /api/v1/admin/users/reset_mfa {"id"} removes a user's MFA (lost
+// device). Single sign-on logins leave the second factor to the identity
+// provider. BOOTAH_MFA_ISSUER (default Bootah) names the account in the app.
+const (
+	totpPeriod      = 30
+	totpDigits      = 6
+	mfaMaxFailures  = 5
+	mfaLockDuration = 5 * time.Minute
+)
+
+var errMFALocked = errors.New("too many wrong codes; try again in a few minutes")
+
+func initMFA(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS user_mfa (
+		user_id INTEGER PRIMARY KEY,
+		secret TEXT NOT NULL,
+		enabled_at TEXT,
+		last_step INTEGER NOT NULL DEFAULT 0,
+		failures INTEGER NOT NULL DEFAULT 0,
+		locked_until TEXT,
+		created_at TEXT NOT NULL
+	)`); err != nil {
+		return err
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS mfa_policy (
+		role TEXT PRIMARY KEY,
+		updated_by INTEGER,
+		updated_at TEXT NOT NULL
+	)`)
+	return err
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	_, _ = crand.Read(b)
+	return totpEncoding.EncodeToString(b)
+}
+
+// totpCode is the HOTP value (RFC 4226) of key for a time step.
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// totpMatch returns the step code is valid for at now, allowing one step of
+// clock drift either way and refusing steps at or before lastStep.
+func totpMatch(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if err != nil || len(code) != totpDigits { return 0, false }
+	cur := now.Unix() / totpPeriod
+	for _, step := range []int64{cur - 1, cur, cur + 1} {
+		if step > lastStep && hmac.Equal([]byte(totpCode(key, step)), []byte(code)) { return step, true }
+	}
+	return 0, false
+}
+
+func totpURL(email, secret string) string {
+	issuer := getenv("BOOTAH_MFA_ISSUER", "Bootah")
+	q := url.Values{"secret": {secret}, "issuer": {issuer}, "algorithm": {"SHA1"}, "digits": {fmt.Sprint(totpDigits)}, "period": {fmt.Sprint(totpPeriod)}}
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+email) + "?" + q.Encode()
+}
+
+func (s *Server) mfaEnabled(uid int64) bool {
+	var n int
+	_ = s.DB.QueryRow(`SELECT COUNT(*) FROM user_mfa WHERE user_id=? AND enabled_at IS NOT NULL`, uid).Scan(&n)
+	return n > 0
+}
+
+func (s *Server) mfaRequired(role string) bool {
+	var n int
+	_ = s.DB.QueryRow(`SELECT COUNT(*) FROM mfa_policy WHERE role=?`, role).Scan(&n)
+	return n > 0
+}
+
+// checkMFACode verifies a code against the user's secret (pending or
+// enabled) and records its step so it can't be replayed. It returns
+// errMFALocked while too many wrong codes lock the user out.
+func (s *Server) checkMFACode(uid int64, code string) (bool, error) {
+	var sealed, locked string
+	var last int64
+	err := s.DB.QueryRow(`SELECT secret, last_step, COALESCE(locked_until,'') FROM user_mfa WHERE user_id=?`, uid).Scan(&sealed, &last, &locked)
+	if errors.Is(err, sql.ErrNoRows) { return false, nil }
+	if err != nil { return false, err }
+	now := time.Now().UTC()
+	if locked > now.Format(time.RFC3339) { return false, errMFALocked }
+	if locked != "" {
+		// the lockout has passed: the next failures count from zero again
+		if _, err := s.DB.Exec(`UPDATE user_mfa SET failures=0, locked_until=NULL WHERE user_id=? AND locked_until=?`, uid, locked); err != nil { return false, err }
+	}
+	secret, err := s.unseal(sealed)
+	if err != nil { return false, err }
+	step, ok := totpMatch(secret, code, now, last)
+	if !ok {
+		_, err := s.DB.Exec(`UPDATE user_mfa SET failures=failures+1, locked_until=CASE WHEN failures+1>=? THEN ? ELSE locked_until END WHERE user_id=?`,
+			mfaMaxFailures, now.Add(mfaLockDuration).Format(time.RFC3339), uid)
+		return false, err
+	}
+	res, err := s.DB.Exec(`UPDATE user_mfa SET last_step=?, failures=0, locked_until=NULL WHERE user_id=? AND last_step<?`, step, uid, step)
+	if err != nil { return false, err }
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// loginMFA applies the second factor to a login whose first factor (password
+// or ldap) passed. It returns the session method, or false after answering the
+// request itself.
+func (s *Server) loginMFA(w http.ResponseWriter, id int64, email, role, factor, code string) (string, bool) {
+	if !s.mfaEnabled(id) {
+		if !s.mfaRequired(role) { return factor, true }
+		tok, err := s.issueMFAToken(id, email, role)
+		if err != nil { http.Error(w, err.Error(), 500); return "", false }
+		writeJSON(w, 403, map[string]any{"error": "two-factor authentication is required for your role; set it up to continue", "mfa_setup_required": true, "mfa_token": tok})
+		return "", false
+	}
+	if strings.TrimSpace(code) == "" { writeJSON(w, 401, map[string]any{"error": "mfa code required", "mfa_required": true}); return "", false }
+	ok, err := s.checkMFACode(id, code)
+	if errors.Is(err, errMFALocked) { http.Error(w, err.Error(), http.StatusTooManyRequests); return "", false }
+	if err != nil { http.Error(w, err.Error(), 500); return "", false }
+	if !ok {
+		s.audit(&id, "mfa_failed", "auth", map[string]any{"email": email})
+		writeJSON(w, 401, map[string]any{"error": "invalid mfa code", "mfa_required": true})
+		return "", false
+	}
+	return factor + "+totp", true
+}
+
+func mfaAudience() string { return jwtAudience() + "/mfa" }
+
+// issueMFAToken lets a user whose role requires MFA enroll before they get a
+// session.
+func (s *Server) issueMFAToken(id int64, email, role string) (string, error) {
+	now := time.Now()
+	t := jwt.NewWithClaims(jwt.SigningMethodHS256, jwtClaims{Sub: id, Email: email, Role: role, RegisteredClaims: jwt.RegisteredClaims{
+		Issuer: jwtIssuer(), Audience: jwt.ClaimStrings{mfaAudience()}, ExpiresAt: jwt.NewNumericDate(now.Add(10 * time.Minute)), IssuedAt: jwt.NewNumericDate(now)}})
+	return t.SignedString([]byte(s.JWTSecret))
+}
+
+// mfaCaller identifies the user managing their own MFA: a person's access
+// token (not an API key or an impersonation), or an mfa_token from login.
+func (s *Server) mfaCaller(r *http.Request) (*jwtClaims, bool, error) {
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || strings.HasPrefix(tok, apiKeyPrefix) { return nil, false, errors.New("unauthorized") }
+	if c, err := s.parseAccess(tok); err == nil {
+		if c.Impersonator != 0 { return nil, false, errors.New("not available while impersonating") }
+		return c, false, nil
+	}
+	t, err := jwt.ParseWithClaims(tok, &jwtClaims{}, func(t *jwt.Token) (interface{}, error) { return []byte(s.JWTSecret), nil },
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(jwtIssuer()), jwt.WithAudience(mfaAudience()), jwt.WithLeeway(jwtLeeway()))
+	if err != nil || !t.Valid { return nil, false, errors.New("unauthorized") }
+	return t.Claims.(*jwtClaims), true, nil
+}
+
+func (s *Server) mfaRoutes() {
+	s.Mux.HandleFunc("/api/v1/auth/mfa", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		c, _, err := s.mfaCaller(r)
+		if err != nil { http.Error(w, err.Error(), 401); return }
+		writeJSON(w, 200, map[string]any{"enabled": s.mfaEnabled(c.Sub), "required": s.mfaRequired(c.Role)})
+	})
+
+	s.Mux.HandleFunc("/api/v1/auth/mfa/setup", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		c, _, err := s.mfaCaller(r)
+		if err != nil { http.Error(w, err.Error(), 401); return }
+		if s.mfaEnabled(c.Sub) { http.Error(w, "two-factor authentication is already enabled", 409); return }
+		secret := newTOTPSecret()
+		sealed, err := s.seal(secret)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		// a repeated setup replaces the secret that was never verified
+		_, err = s.DB.Exec(`INSERT INTO user_mfa (user_id, secret, created_at) VALUES (?,?,?)
+			ON CONFLICT(user_id) DO UPDATE SET secret=excluded.secret, last_step=0, created_at=excluded.created_at`, c.Sub, sealed, time.Now().UTC().Format(time.RFC3339))
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, 200, map[string]any{"secret": secret, "otpauth_url": totpURL(c.Email, secret)})
+	})
+
+	s.Mux.HandleFunc("/api/v1/auth/mfa/verify", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		c, enrolling, err := s.mfaCaller(r)
+		if err != nil { http.Error(w, err.Error(), 401); return }
+		var body struct{ Code string `json:"code"` }
+		if !decodeJSON(w, r, &body) { return }
+		ok, err := s.checkMFACode(c.Sub, body.Code)
+		if errors.Is(err, errMFALocked) { http.Error(w, err.Error(), http.StatusTooManyRequests); return }
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if !ok { http.Error(w, "invalid code; run setup first if you have not", 400); return }
+		if !s.mfaEnabled(c.Sub) {
+			if _, err := s.DB.Exec(`UPDATE user_mfa SET enabled_at=? WHERE user_id=?`, time.Now().UTC().Format(time.RFC3339), c.Sub); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(&c.Sub, "mfa_enable", "auth", map[string]any{"email": c.Email})
+		}
+		if !enrolling { writeJSON(w, 200, map[string]any{"ok": true}); return }
+		var role string
+		if err := s.DB.QueryRow(`SELECT role FROM users WHERE id=?`, c.Sub).Scan(&role); err != nil { http.Error(w, "user not found", 401); return }
+		access, refresh, err := s.startSession(r, c.Sub, c.Email, role, "password+totp")
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		s.setRefreshCookie(w, r, refresh)
+		s.audit(&c.Sub, "login", "auth", map[string]any{"email": c.Email})
+		writeJSON(w, 200, map[string]any{"ok": true, "token": access})
+	})
+
+	s.Mux.HandleFunc("/api/v1/auth/mfa/disable", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		c, enrolling, err := s.mfaCaller(r)
+		if err != nil || enrolling { http.Error(w, "unauthorized", 401); return }
+		var body struct{ Code string `json:"code"` }
+		if !decodeJSON(w, r, &body) { return }
+		if s.mfaRequired(c.Role) { http.Error(w, "two-factor authentication is required for your role", 409); return }
+		if !s.mfaEnabled(c.Sub) { http.Error(w, "two-factor authentication is not enabled", 409); return }
+		ok, err := s.checkMFACode(c.Sub, body.Code)
+		if errors.Is(err, errMFALocked) { http.Error(w, err.Error(), http.StatusTooManyRequests); return }
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if !ok { http.Error(w, "invalid code", 400); return }
+		if _, err := s.DB.Exec(`DELETE FROM user_mfa WHERE user_id=?`, c.Sub); err != nil { http.Error(w, err.Error(), 500); return }
+		s.audit(&c.Sub, "mfa_disable", "auth", map[string]any{"email": c.Email})
+		writeJSON(w, 200, map[string]any{"ok": true})
+	})
+
+	s.Mux.HandleFunc("/api/v1/admin/mfa/policy", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var body struct{ Roles []string `json:"roles"` }
+			if !decodeJSON(w, r, &body) { return }
+			var v validator
+			for _, role := range body.Roles {
+				if !s.roleExists(role) { v.add("roles", "unknown role %q", role) }
+			}
+			if err := v.err(); err != nil { badRequest(w, err); return }
+			tx, err := s.DB.Begin()
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer tx.Rollback()
+			if _, err := tx.Exec(`DELETE FROM mfa_policy`); err != nil { http.Error(w, err.Error(), 500); return }
+			var by int64
+			if id := s.actorID(r); id != nil { by = *id }
+			for _, role := range body.Roles {
+				if _, err := tx.Exec(`INSERT INTO mfa_policy (role, updated_by, updated_at) VALUES (?,NULLIF(?,0),?) ON CONFLICT(role) DO NOTHING`, role, by, time.Now().UTC().Format(time.RFC3339)); err != nil { http.Error(w, err.Error(), 500); return }
+			}
+			if err := tx.Commit(); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "mfa_policy", "auth", map[string]any{"roles": body.Roles})
+		default:
+			http.Error(w, "method not allowed", 405); return
+		}
+		roles := []string{}
+		rows, err := s.DB.Query(`SELECT role FROM mfa_policy ORDER BY role`)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		defer rows.Close()
+		for rows.Next() {
+			var role string
+			if err := rows.Scan(&role); err != nil { http.Error(w, err.Error(), 500); return }
+			roles = append(roles, role)
+		}
+		// users of a required role who have not enrolled yet
+		pending := []map[string]any{}
+		prows, err := s.DB.Query(`SELECT u.id, u.email, u.role FROM users u JOIN mfa_policy p ON p.role=u.role
+			WHERE u.passhash<>'' AND NOT EXISTS (SELECT 1 FROM user_mfa m WHERE m.user_id=u.id AND m.enabled_at IS NOT NULL) ORDER BY u.id`)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		defer prows.Close()
+		for prows.Next() {
+			var id int64
+			var email, role string
+			if err := prows.Scan(&id, &email, &role); err != nil { http.Error(w, err.Error(), 500); return }
+			pending = append(pending, map[string]any{"id": id, "email": email, "role": role})
+		}
+		writeJSON(w, 200, map[string]any{"roles": roles, "not_enrolled": pending})
+	})
+
+	s.Mux.HandleFunc("/api/v1/admin/users/reset_mfa", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		var body struct{ ID int64 `json:"id"` }
+		if !decodeJSON(w, r, &body) { return }
+		res, err := s.DB.Exec(`DELETE FROM user_mfa WHERE user_id=?`, body.ID)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if n, _ := res.RowsAffected(); n == 0 { http.Error(w, "user has no two-factor authentication", 404); return }
+		s.revokeSessions(body.ID, "", "mfa_reset")
+		s.audit(s.actorID(r), "reset_mfa", "user", map[string]any{"id": body.ID})
+		writeJSON(w, 200, map[string]any{"ok": true})
+	})
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---- Schema migrations ----
+// The init functions create each feature's tables; every change to a table
+// after that is a numbered migration in migrations/NNNN_name.sql, embedded in
+// the binary. A file has a "-- +migrate up" section and a "-- +migrate down"
+// section of ;-terminated statements in the store's SQLite dialect (they are
+// rewritten for PostgreSQL like every other query). On startup the pending
+// migrations are applied in order, each in its own transaction together with
+// its row in schema_migrations (version, name, applied_at); a failure stops
+// the server instead of leaving a column silently missing. ADD COLUMN of a
+// column that already exists and DROP COLUMN of one that does not are
+// skipped, so databases from before migrations adopt them as they are. A
+// down section undoes only what its up adds: a column that is also in the
+// table's CREATE TABLE is added for older databases only, and stays.
+//
+// BOOTAH_DB_MIGRATE_TO=N migrates to version N instead of the latest: below
+// the applied version the down sections are run newest first, after which the
+// server refuses to start, as it needs the latest schema; start the release
+// that matches version N. Replicas never migrate (their database is
+// read-only); they log when the primary has not applied this build's
+// migrations yet. GET /api/v1/admin/db/migrations (admin) lists every
+// migration with its applied_at, and the applied and latest versions; POST
+// applies pending ones (see handleMigrate).
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+var (
+	migrationFileRe = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.sql$`)
+	migrateColumnRe = regexp.MustCompile(`(?i)^ALTER\s+TABLE\s+(\w+)\s+(ADD|DROP)\s+COLUMN\s+(\w+)`)
+)
+
+// loadMigrations parses the embedded migrations, ordered by version.
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil { return nil, err }
+	var out []migration
+	seen := map[int]string{}
+	for _, e := range entries {
+		m := migrationFileRe.FindStringSubmatch(e.Name())
+		if m == nil { return nil, fmt.Errorf("migration %s: name must be NNNN_name.sql", e.Name()) }
+		v, _ := strconv.Atoi(m[1])
+		if v <= 0 { return nil, fmt.Errorf("migration %s: version must be positive", e.Name()) }
+		if other, ok := seen[v]; ok { return nil, fmt.Errorf("migrations %s and %s share version %d", other, e.Name(), v) }
+		seen[v] = e.Name()
+		data, err := migrationFiles.ReadFile("migrations/" + e.Name())
+		if err != nil { return nil, err }
+		mg := migration{Version: v, Name: m[2]}
+		var section *[]string
+		var stmt strings.Builder
+		for _, line := range strings.Split(string(data), "\n") {
+			t := strings.TrimSpace(line)
+			switch {
+			case t == "-- +migrate up":
+				section = &mg.Up
+				continue
+			case t == "-- +migrate down":
+				section = &mg.Down
+				continue
+			case t == "" || strings.HasPrefix(t, "--"):
+				continue
+			case section == nil:
+				return nil, fmt.Errorf("migration %s: statement before -- +migrate up", e.Name())
+			}
+			stmt.WriteString(line + "\n")
+			if strings.HasSuffix(t, ";") {
+				*section = append(*section, strings.TrimSuffix(strings.TrimSpace(stmt.String()), ";"))
+				stmt.Reset()
+			}
+		}
+		if strings.TrimSpace(stmt.String()) != "" { return nil, fmt.Errorf("migration %s: last statement has no ;", e.Name()) }
+		if len(mg.Up) == 0 { return nil, fmt.Errorf("migration %s: empty up section", e.Name()) }
+		out = append(out, mg)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// columnExists reports whether table has column, for skipping ADD and DROP
+// COLUMN statements that were already (un)applied by hand or by an older
+// release.
+func columnExists(tx *sql.Tx, table, column string) (bool, error) {
+	q := `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?`
+	if dbDriver == "postgres" {
+		q = `SELECT COUNT(*) FROM information_schema.columns WHERE table_schema=current_schema() AND table_name=? AND column_name=?`
+	}
+	var n int
+	err := tx.QueryRow(q, strings.ToLower(table), strings.ToLower(column)).Scan(&n)
+	return n > 0, err
+}
+
+// runMigration applies one direction of m and records it.
+func runMigration(db *sql.DB, m migration, up bool) error {
+	tx, err := db.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+	stmts := m.Down
+	if up { stmts = m.Up }
+	for i, q := range stmts {
+		if c := migrateColumnRe.FindStringSubmatch(q); c != nil {
+			exists, err := columnExists(tx, c[1], c[3])
+			if err != nil { return err }
+			if exists == strings.EqualFold(c[2], "add") { continue }
+		}
+		if _, err := tx.Exec(q); err != nil { return fmt.Errorf("statement %d: %w", i+1, err) }
+	}
+	if up {
+		_, err = tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?,?,?)`, m.Version, m.Name, time.Now().UTC().Format(time.RFC3339))
+	} else {
+		_, err = tx.Exec(`DELETE FROM schema_migrations WHERE version=?`, m.Version)
+	}
+	if err != nil { return err }
+	return tx.Commit()
+}
+
+func appliedMigrations(db *sql.DB) (map[int]string, error) {
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := map[int]string{}
+	for rows.Next() {
+		var v int
+		var at string
+		if err := rows.Scan(&v, &at); err != nil { return nil, err }
+		out[v] = at
+	}
+	return out, rows.Err()
+}
+
+// migrationPlan returns the migrations that reaching target applies, in
+// order, and the ones it rolls back, newest first.
+func migrationPlan(migrations []migration, applied map[int]string, target int) (up, down []migration) {
+	for _, m := range migrations {
+		if m.Version <= target && applied[m.Version] == "" { up = append(up, m) }
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		if m := migrations[i]; m.Version > target && applied[m.Version] != "" { down = append(down, m) }
+	}
+	return up, down
+}
+
+// previewMigration lists the statements one direction of m would run and
+// whether each would be skipped, without changing anything.
+func previewMigration(db *sql.DB, m migration, up bool) (map[string]any, error) {
+	tx, err := db.Begin()
+	if err != nil { return nil, err }
+	defer tx.Rollback()
+	stmts := m.Down
+	if up { stmts = m.Up }
+	out := []map[string]any{}
+	for _, q := range stmts {
+		e := map[string]any{"sql": q}
+		if c := migrateColumnRe.FindStringSubmatch(q); c != nil {
+			exists, err := columnExists(tx, c[1], c[3])
+			if err != nil { return nil, err }
+			if exists == strings.EqualFold(c[2], "add") { e["skipped"] = true }
+		}
+		out = append(out, e)
+	}
+	return map[string]any{"version": m.Version, "name": m.Name, "statements": out}, nil
+}
+
+// migrateDB brings the schema to BOOTAH_DB_MIGRATE_TO, by default the
+// latest embedded migration. It runs after the init functions.
+func migrateDB(db *sql.DB) error {
+	migrations, err := loadMigrations()
+	if err != nil { return err }
+	latest := 0
+	if len(migrations) > 0 { latest = migrations[len(migrations)-1].Version }
+	if replicaMode() {
+		applied, err := appliedMigrations(db)
+		if err != nil { log.Printf("schema migrations: %v", err); return nil }
+		for _, m := range migrations {
+			if applied[m.Version] == "" { log.Printf("schema migrations: migration %04d %s is not applied on the primary yet", m.Version, m.Name) }
+		}
+		return nil
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	)`); err != nil {
+		return err
+	}
+	target := latest
+	if v := getenv("BOOTAH_DB_MIGRATE_TO", ""); v != "" {
+		if target, err = strconv.Atoi(v); err != nil || target < 0 { return fmt.Errorf("BOOTAH_DB_MIGRATE_TO must be a migration version, not %q", v) }
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil { return err }
+	up, down := migrationPlan(migrations, applied, target)
+	for _, m := range up {
+		if err := runMigration(db, m, true); err != nil {
+			// another instance sharing the database may have applied it first
+			if again, _ := appliedMigrations(db); again[m.Version] != "" { continue }
+			return fmt.Errorf("migration %04d %s: %w", m.Version, m.Name, err)
+		}
+		log.Printf("schema migrations: applied %04d %s", m.Version, m.Name)
+	}
+	if target >= latest { return nil }
+	for _, m := range down {
+		if err := runMigration(db, m, false); err != nil { return fmt.Errorf("rolling back migration %04d %s: %w", m.Version, m.Name, err) }
+		log.Printf("schema migrations: rolled back %04d %s", m.Version, m.Name)
+	}
+	return fmt.Errorf("schema is at migration %d (BOOTAH_DB_MIGRATE_TO); this build needs %d, start the release that matches it", target, latest)
+}
+
+func (s *Server) migrationRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/db/migrations", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodGet && r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		migrations, err := loadMigrations()
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		applied, err := appliedMigrations(s.DB)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if r.Method == http.MethodPost { s.handleMigrate(w, r, migrations, applied); return }
+		out := []map[string]any{}
+		current, latest, pending := 0, 0, 0
+		for _, m := range migrations {
+			e := map[string]any{"version": m.Version, "name": m.Name, "applied": false}
+			if at := applied[m.Version]; at != "" {
+				e["applied"], e["applied_at"], current = true, at, m.Version
+			} else {
+				pending++
+			}
+			latest = m.Version
+			out = append(out, e)
+		}
+		writeJSON(w, 200, map[string]any{"driver": dbDriver, "current": current, "latest": latest, "pending": pending, "migrations": out})
+	})
+}
+
+// handleMigrate serves POST /api/v1/admin/db/migrations {"to": N}, by default
+// the latest version. It applies pending migrations (a promoted replica's
+// database, say); rolling back needs a restart with BOOTAH_DB_MIGRATE_TO, as
+// the running build needs the latest schema. ?dry_run=1 returns the
+// statements either would run, and which would be skipped, without running
+// them.
+func (s *Server) handleMigrate(w http.ResponseWriter, r *http.Request, migrations []migration, applied map[int]string) {
+	var body struct {
+		To *int `json:"to"`
+	}
+	if r.ContentLength != 0 && !decodeJSON(w, r, &body) { return }
+	target := 0
+	if len(migrations) > 0 { target = migrations[len(migrations)-1].Version }
+	if body.To != nil {
+		if *body.To < 0 { http.Error(w, "to must be a migration version", 400); return }
+		target = *body.To
+	}
+	up, down := migrationPlan(migrations, applied, target)
+	if isDryRun(r) {
+		apply, rollBack := []map[string]any{}, []map[string]any{}
+		for _, m := range up {
+			p, err := previewMigration(s.DB, m, true)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			apply = append(apply, p)
+		}
+		for _, m := range down {
+			p, err := previewMigration(s.DB, m, false)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			rollBack = append(rollBack, p)
+		}
+		writeJSON(w, 200, map[string]any{"dry_run": true, "to": target, "apply": apply, "roll_back": rollBack})
+		return
+	}
+	if replicaMode() { http.Error(w, "replicas never migrate; migrate the primary", 409); return }
+	if len(down) > 0 { http.Error(w, "rolling back needs a restart with BOOTAH_DB_MIGRATE_TO="+strconv.Itoa(target), 409); return }
+	done := []int{}
+	for _, m := range up {
+		if err := runMigration(s.DB, m, true); err != nil {
+			http.Error(w, fmt.Sprintf("migration %04d %s: %v", m.Version, m.Name, err), 500); return
+		}
+		done = append(done, m.Version)
+	}
+	if len(done) > 0 { s.audit(s.actorID(r), "migrate", "db", map[string]any{"to": target, "applied": done}) }
+	writeJSON(w, 200, map[string]any{"dry_run": false, "to": target, "applied": done})
+}
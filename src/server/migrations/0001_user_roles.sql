@@ -0,0 +1,6 @@
+-- +migrate up
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'viewer';
+
+-- +migrate down
+-- role is part of the users table; the up only adds it to databases created
+-- before it was, so there is nothing to undo
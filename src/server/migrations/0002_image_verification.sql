@@ -0,0 +1,8 @@
+-- +migrate up
+ALTER TABLE images ADD COLUMN sha256 TEXT;
+ALTER TABLE images ADD COLUMN verified_at TEXT;
+ALTER TABLE images ADD COLUMN verify_status TEXT;
+
+-- +migrate down
+ALTER TABLE images DROP COLUMN verify_status;
+ALTER TABLE images DROP COLUMN verified_at;
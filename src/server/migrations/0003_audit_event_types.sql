@@ -0,0 +1,7 @@
+-- +migrate up
+ALTER TABLE audit ADD COLUMN event_type TEXT;
+ALTER TABLE audit ADD COLUMN schema_version INTEGER NOT NULL DEFAULT 0;
+
+-- +migrate down
+ALTER TABLE audit DROP COLUMN schema_version;
+ALTER TABLE audit DROP COLUMN event_type;
@@ -0,0 +1,16 @@
+-- +migrate up
+ALTER TABLE jobs ADD COLUMN progress INTEGER;
+ALTER TABLE jobs ADD COLUMN progress_msg TEXT;
+ALTER TABLE jobs ADD COLUMN run_after INTEGER;
+ALTER TABLE jobs ADD COLUMN cancel_requested INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE jobs ADD COLUMN updated_at TEXT;
+ALTER TABLE jobs ADD COLUMN finished_at TEXT;
+UPDATE jobs SET status='succeeded' WHERE status='completed';
+
+-- +migrate down
+ALTER TABLE jobs DROP COLUMN finished_at;
+ALTER TABLE jobs DROP COLUMN updated_at;
+ALTER TABLE jobs DROP COLUMN cancel_requested;
+ALTER TABLE jobs DROP COLUMN run_after;
+ALTER TABLE jobs DROP COLUMN progress_msg;
+ALTER TABLE jobs DROP COLUMN progress;
@@ -0,0 +1,9 @@
+-- +migrate up
+ALTER TABLE deployments ADD COLUMN task_sequence_id TEXT;
+ALTER TABLE deployments ADD COLUMN error TEXT;
+ALTER TABLE deployments ADD COLUMN started_at TEXT;
+ALTER TABLE deployments ADD COLUMN finished_at TEXT;
+
+-- +migrate down
+-- these are part of the deployments table; the up only adds them to
+-- databases created before they were, so there is nothing to undo
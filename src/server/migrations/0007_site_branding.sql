@@ -0,0 +1,5 @@
+-- +migrate up
+ALTER TABLE sites ADD COLUMN branding TEXT;
+
+-- +migrate down
+ALTER TABLE sites DROP COLUMN branding;
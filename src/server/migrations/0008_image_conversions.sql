@@ -0,0 +1,5 @@
+-- +migrate up
+ALTER TABLE images ADD COLUMN derived_from TEXT;
+
+-- +migrate down
+ALTER TABLE images DROP COLUMN derived_from;
@@ -0,0 +1,7 @@
+-- +migrate up
+ALTER TABLE images ADD COLUMN owner_id INTEGER;
+ALTER TABLE audit ADD COLUMN actor_label TEXT;
+
+-- +migrate down
+ALTER TABLE audit DROP COLUMN actor_label;
+ALTER TABLE images DROP COLUMN owner_id;
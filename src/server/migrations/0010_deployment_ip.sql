@@ -0,0 +1,5 @@
+-- +migrate up
+ALTER TABLE deployments ADD COLUMN ip TEXT;
+
+-- +migrate down
+ALTER TABLE deployments DROP COLUMN ip;
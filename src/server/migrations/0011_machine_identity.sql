@@ -0,0 +1,17 @@
+-- +migrate up
+ALTER TABLE machines ADD COLUMN uuid TEXT;
+ALTER TABLE machines ADD COLUMN serial TEXT;
+ALTER TABLE machines ADD COLUMN hostname TEXT;
+ALTER TABLE machines ADD COLUMN model TEXT;
+ALTER TABLE machines ADD COLUMN boot_profile TEXT;
+CREATE INDEX IF NOT EXISTS machines_uuid ON machines (uuid);
+CREATE INDEX IF NOT EXISTS machines_serial ON machines (serial);
+
+-- +migrate down
+DROP INDEX IF EXISTS machines_serial;
+DROP INDEX IF EXISTS machines_uuid;
+ALTER TABLE machines DROP COLUMN boot_profile;
+ALTER TABLE machines DROP COLUMN model;
+ALTER TABLE machines DROP COLUMN hostname;
+ALTER TABLE machines DROP COLUMN serial;
+ALTER TABLE machines DROP COLUMN uuid;
@@ -0,0 +1,21 @@
+-- +migrate up
+ALTER TABLE boot_assets ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE boot_assets ADD COLUMN kind TEXT;
+ALTER TABLE boot_assets ADD COLUMN arch TEXT;
+ALTER TABLE boot_assets ADD COLUMN kernel_version TEXT;
+ALTER TABLE boot_assets ADD COLUMN distro TEXT;
+ALTER TABLE boot_asset_versions ADD COLUMN kind TEXT;
+ALTER TABLE boot_asset_versions ADD COLUMN arch TEXT;
+ALTER TABLE boot_asset_versions ADD COLUMN kernel_version TEXT;
+ALTER TABLE boot_asset_versions ADD COLUMN distro TEXT;
+
+-- +migrate down
+ALTER TABLE boot_asset_versions DROP COLUMN distro;
+ALTER TABLE boot_asset_versions DROP COLUMN kernel_version;
+ALTER TABLE boot_asset_versions DROP COLUMN arch;
+ALTER TABLE boot_asset_versions DROP COLUMN kind;
+ALTER TABLE boot_assets DROP COLUMN distro;
+ALTER TABLE boot_assets DROP COLUMN kernel_version;
+ALTER TABLE boot_assets DROP COLUMN arch;
+ALTER TABLE boot_assets DROP COLUMN kind;
+ALTER TABLE boot_assets DROP COLUMN version;
@@ -0,0 +1,7 @@
+-- +migrate up
+ALTER TABLE machines ADD COLUMN enroll_secret_hash TEXT;
+ALTER TABLE machines ADD COLUMN enroll_secret_set_at TEXT;
+
+-- +migrate down
+ALTER TABLE machines DROP COLUMN enroll_secret_set_at;
+ALTER TABLE machines DROP COLUMN enroll_secret_hash;
@@ -0,0 +1,5 @@
+-- +migrate up
+ALTER TABLE machine_groups ADD COLUMN require_attestation INTEGER NOT NULL DEFAULT 0;
+
+-- +migrate down
+ALTER TABLE machine_groups DROP COLUMN require_attestation;
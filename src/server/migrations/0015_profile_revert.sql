@@ -0,0 +1,7 @@
+-- +migrate up
+ALTER TABLE machines ADD COLUMN boot_profile_once INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE machines ADD COLUMN revert_at TEXT;
+
+-- +migrate down
+ALTER TABLE machines DROP COLUMN revert_at;
+ALTER TABLE machines DROP COLUMN boot_profile_once;
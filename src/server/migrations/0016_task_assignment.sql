@@ -0,0 +1,11 @@
+-- +migrate up
+ALTER TABLE machines ADD COLUMN task_sequence_id TEXT;
+ALTER TABLE machines ADD COLUMN task_assigned_at TEXT;
+ALTER TABLE machine_groups ADD COLUMN task_sequence_id TEXT;
+ALTER TABLE machine_groups ADD COLUMN task_assigned_at TEXT;
+
+-- +migrate down
+ALTER TABLE machine_groups DROP COLUMN task_assigned_at;
+ALTER TABLE machine_groups DROP COLUMN task_sequence_id;
+ALTER TABLE machines DROP COLUMN task_assigned_at;
+ALTER TABLE machines DROP COLUMN task_sequence_id;
@@ -0,0 +1,7 @@
+-- +migrate up
+ALTER TABLE task_runs ADD COLUMN checkin_at TEXT;
+ALTER TABLE task_runs ADD COLUMN agent_version TEXT;
+
+-- +migrate down
+ALTER TABLE task_runs DROP COLUMN agent_version;
+ALTER TABLE task_runs DROP COLUMN checkin_at;
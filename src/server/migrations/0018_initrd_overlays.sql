@@ -0,0 +1,13 @@
+-- +migrate up
+ALTER TABLE driver_packs ADD COLUMN overlay TEXT;
+ALTER TABLE driver_packs ADD COLUMN overlay_include TEXT;
+ALTER TABLE driver_packs ADD COLUMN overlay_asset TEXT;
+ALTER TABLE driver_packs ADD COLUMN overlay_built_at TEXT;
+ALTER TABLE driver_packs ADD COLUMN overlay_sig TEXT;
+
+-- +migrate down
+ALTER TABLE driver_packs DROP COLUMN overlay_sig;
+ALTER TABLE driver_packs DROP COLUMN overlay_built_at;
+ALTER TABLE driver_packs DROP COLUMN overlay_asset;
+ALTER TABLE driver_packs DROP COLUMN overlay_include;
+ALTER TABLE driver_packs DROP COLUMN overlay;
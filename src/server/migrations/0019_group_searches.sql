@@ -0,0 +1,5 @@
+-- +migrate up
+ALTER TABLE machine_groups ADD COLUMN search_id TEXT;
+
+-- +migrate down
+ALTER TABLE machine_groups DROP COLUMN search_id;
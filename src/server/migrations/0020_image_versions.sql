@@ -0,0 +1,9 @@
+-- +migrate up
+ALTER TABLE images ADD COLUMN version INTEGER;
+-- images from before versioning become version 1 of themselves
+INSERT INTO image_versions (image_id, version, file, type, size_mb, sha256, created)
+	SELECT id, 1, file, type, size_mb, sha256, updated FROM images WHERE version IS NULL AND id NOT IN (SELECT image_id FROM image_versions);
+UPDATE images SET version=1 WHERE version IS NULL;
+
+-- +migrate down
+ALTER TABLE images DROP COLUMN version;
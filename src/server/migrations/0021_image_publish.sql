@@ -0,0 +1,9 @@
+-- +migrate up
+ALTER TABLE image_versions ADD COLUMN status TEXT NOT NULL DEFAULT 'published';
+ALTER TABLE image_versions ADD COLUMN published_at TEXT;
+ALTER TABLE image_versions ADD COLUMN published_by TEXT;
+
+-- +migrate down
+ALTER TABLE image_versions DROP COLUMN published_by;
+ALTER TABLE image_versions DROP COLUMN published_at;
+ALTER TABLE image_versions DROP COLUMN status;
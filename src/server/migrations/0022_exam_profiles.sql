@@ -0,0 +1,11 @@
+-- +migrate up
+ALTER TABLE boot_profiles ADD COLUMN kind TEXT NOT NULL DEFAULT 'template';
+ALTER TABLE boot_profiles ADD COLUMN image_id TEXT;
+ALTER TABLE boot_profiles ADD COLUMN image_version INTEGER;
+ALTER TABLE boot_profiles ADD COLUMN image_sha256 TEXT;
+
+-- +migrate down
+ALTER TABLE boot_profiles DROP COLUMN image_sha256;
+ALTER TABLE boot_profiles DROP COLUMN image_version;
+ALTER TABLE boot_profiles DROP COLUMN image_id;
+ALTER TABLE boot_profiles DROP COLUMN kind;
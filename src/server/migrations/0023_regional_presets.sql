@@ -0,0 +1,7 @@
+-- +migrate up
+ALTER TABLE sites ADD COLUMN regional_preset_id TEXT;
+ALTER TABLE machine_groups ADD COLUMN regional_preset_id TEXT;
+
+-- +migrate down
+ALTER TABLE machine_groups DROP COLUMN regional_preset_id;
+ALTER TABLE sites DROP COLUMN regional_preset_id;
@@ -0,0 +1,5 @@
+-- +migrate up
+ALTER TABLE users ADD COLUMN temp_password_expires_at TEXT;
+
+-- +migrate down
+ALTER TABLE users DROP COLUMN temp_password_expires_at;
@@ -0,0 +1,5 @@
+-- +migrate up
+ALTER TABLE image_downloads ADD COLUMN anonymized_at TEXT;
+
+-- +migrate down
+ALTER TABLE image_downloads DROP COLUMN anonymized_at;
@@ -0,0 +1,5 @@
+-- +migrate up
+ALTER TABLE deployments ADD COLUMN token_issued_at TEXT;
+
+-- +migrate down
+ALTER TABLE deployments DROP COLUMN token_issued_at;
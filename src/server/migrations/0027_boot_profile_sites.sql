@@ -0,0 +1,5 @@
+-- +migrate up
+ALTER TABLE boot_profiles ADD COLUMN site_id TEXT;
+
+-- +migrate down
+ALTER TABLE boot_profiles DROP COLUMN site_id;
@@ -0,0 +1,10 @@
+-- +migrate up
+ALTER TABLE users ADD COLUMN source TEXT NOT NULL DEFAULT 'local';
+ALTER TABLE users ADD COLUMN directory_dn TEXT;
+-- accounts provisioned at a directory login before the column existed
+UPDATE users SET source='ldap' WHERE passhash='' AND id IN
+	(SELECT actor_id FROM audit WHERE resource='user' AND action='provision' AND meta LIKE '%"source":"ldap"%');
+
+-- +migrate down
+ALTER TABLE users DROP COLUMN directory_dn;
+ALTER TABLE users DROP COLUMN source;
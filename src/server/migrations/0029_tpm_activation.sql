@@ -0,0 +1,11 @@
+-- +migrate up
+ALTER TABLE tpm_keys ADD COLUMN ak_name TEXT;
+ALTER TABLE tpm_keys ADD COLUMN ak_activated_at TEXT;
+ALTER TABLE tpm_keys ADD COLUMN activation_hash TEXT;
+ALTER TABLE tpm_keys ADD COLUMN activation_expires TEXT;
+
+-- +migrate down
+ALTER TABLE tpm_keys DROP COLUMN activation_expires;
+ALTER TABLE tpm_keys DROP COLUMN activation_hash;
+ALTER TABLE tpm_keys DROP COLUMN ak_activated_at;
+ALTER TABLE tpm_keys DROP COLUMN ak_name;
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// ---- Notifications ----
+// notify records an operator-facing event and, when BOOTAH_NOTIFY_WEBHOOK is
+// set, posts it there as JSON. Delivery is best effort and never blocks the
+// caller.
+func initNotifications(db *sql.DB) error {
+	ddl := `CREATE TABLE IF NOT EXISTS notifications (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ts TEXT NOT NULL,
+		level TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		message TEXT NOT NULL,
+		meta TEXT,
+		acked INTEGER NOT NULL DEFAULT 0
+	);`
+	_, err := db.Exec(ddl)
+	return err
+}
+
+func (s *Server) notify(level, kind, message string, meta map[string]any) {
+	js, _ := json.Marshal(meta)
+	now := time.Now().Format(time.RFC3339)
+	_, _ = s.DB.Exec(`INSERT INTO notifications (ts, level, kind, message, meta) VALUES (?,?,?,?,?)`, now, level, kind, message, string(js))
+	hook := getenv("BOOTAH_NOTIFY_WEBHOOK", "")
+	if hook == "" { return }
+	payload, _ := json.Marshal(map[string]any{"ts": now, "level": level, "kind": kind, "message": message, "meta": meta})
+	go func() {
+		resp, err := (&http.Client{Timeout: 10 * time.Second}).Post(hook, "application/json", bytes.NewReader(payload))
+		if err != nil { log.Printf("notify webhook: %v", err); return }
+		resp.Body.Close()
+	}()
+}
+
+func (s *Server) notificationRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/notifications", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		switch r.Method {
+		case http.MethodGet:
+			q := `SELECT id, ts, level, kind, message, COALESCE(meta,''), acked FROM notifications`
+			if r.URL.Query().Get("all") != "1" { q += ` WHERE acked=0` }
+			rows, err := s.DB.Query(q + ` ORDER BY id DESC LIMIT 500`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			var out []map[string]any
+			for rows.Next() {
+				var id int64; var ts, level, kind, message, meta string; var acked bool
+				if err := rows.Scan(&id, &ts, &level, &kind, &message, &meta, &acked); err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, map[string]any{"id": id, "ts": ts, "level": level, "kind": kind, "message": message, "meta": meta, "acked": acked})
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPost:
+			// acknowledge
+			var body struct{ ID int64 `json:"id"` }
+			if !decodeJSON(w, r, &body) { return }
+			if _, err := s.DB.Exec(`UPDATE notifications SET acked=1 WHERE id=?`, body.ID); err != nil { http.Error(w, err.Error(), 500); return }
+			writeJSON(w, 200, map[string]any{"ok": true})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+}
+
+// mailConfigured reports whether email delivery is set up: BOOTAH_SMTP_ADDR
+// (host:port) and BOOTAH_SMTP_FROM, with BOOTAH_SMTP_USER and
+// BOOTAH_SMTP_PASSWORD when the relay wants authentication. STARTTLS is used
+// whenever the relay offers it; credentials are only sent over TLS or to
+// localhost.
+func mailConfigured() bool { return getenv("BOOTAH_SMTP_ADDR", "") != "" && getenv("BOOTAH_SMTP_FROM", "") != "" }
+
+// sendMail delivers a plain-text message to one recipient.
+func sendMail(to, subject, body string) error {
+	if !mailConfigured() { return errors.New("email delivery is not configured (BOOTAH_SMTP_ADDR, BOOTAH_SMTP_FROM)") }
+	if strings.ContainsAny(to+subject, "\r\n") { return errors.New("invalid mail header") }
+	addr, from := getenv("BOOTAH_SMTP_ADDR", ""), getenv("BOOTAH_SMTP_FROM", "")
+	var auth smtp.Auth
+	if user := getenv("BOOTAH_SMTP_USER", ""); user != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		auth = smtp.PlainAuth("", user, getenv("BOOTAH_SMTP_PASSWORD", ""), host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		from, to, subject, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(body, "\n", "\r\n"))
+	return smtp.SendMail(addr, auth, from, []string{to}, []byte(msg))
+}
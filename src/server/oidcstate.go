@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ---- OIDC login state ----
+// oidcStart seals state, nonce, PKCE verifier and the post-login target into
+// a short-lived HttpOnly cookie; oidcCallback requires the returned state to
+// match it, the ID token nonce to match, and redeems the code with the
+// verifier. Post-login targets are relative paths or URLs whose origin is in
+// BOOTAH_OIDC_REDIRECT_ALLOWLIST; the default is BOOTAH_OIDC_POST_LOGIN_URL.
+const oidcStateCookie = "bootah_oidc"
+
+type oidcLoginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	ReturnTo string `json:"return_to"`
+	Exp      int64  `json:"exp"`
+}
+
+// oidcReturnTarget validates a requested post-login target, falling back to
+// the configured default.
+func oidcReturnTarget(requested string) string {
+	def := getenv("BOOTAH_OIDC_POST_LOGIN_URL", "/")
+	if requested == "" { return def }
+	if strings.HasPrefix(requested, "/") && !strings.HasPrefix(requested, "//") && !strings.Contains(requested, "\\") { return requested }
+	u, err := url.Parse(requested)
+	if err != nil || u.Host == "" { return def }
+	for _, origin := range splitList(getenv("BOOTAH_OIDC_REDIRECT_ALLOWLIST", "")) {
+		if strings.EqualFold(strings.TrimRight(origin, "/"), u.Scheme+"://"+u.Host) { return requested }
+	}
+	return def
+}
+
+func secureRequest(r *http.Request) bool {
+	return r.TLS != nil || strings.HasPrefix(getenv("BOOTAH_PUBLIC_URL", ""), "https://")
+}
+
+func (s *Server) setOIDCState(w http.ResponseWriter, r *http.Request, st oidcLoginState) error {
+	js, _ := json.Marshal(st)
+	sealed, err := s.seal(string(js))
+	if err != nil { return err }
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: sealed, Path: "/api/", HttpOnly: true, Secure: secureRequest(r),
+		SameSite: http.SameSiteLaxMode, MaxAge: int((10 * time.Minute).Seconds())})
+	return nil
+}
+
+// takeOIDCState reads and clears the login state, checking it against the
+// state parameter returned by the provider.
+func (s *Server) takeOIDCState(w http.ResponseWriter, r *http.Request) (*oidcLoginState, error) {
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/api/", MaxAge: -1})
+	ck, err := r.Cookie(oidcStateCookie)
+	if err != nil { return nil, errors.New("login session missing or expired") }
+	plain, err := s.unseal(ck.Value)
+	if err != nil { return nil, errors.New("invalid login session") }
+	var st oidcLoginState
+	if err := json.Unmarshal([]byte(plain), &st); err != nil { return nil, err }
+	if time.Now().Unix() > st.Exp { return nil, errors.New("login session expired") }
+	got := r.URL.Query().Get("state")
+	if got == "" || subtle.ConstantTimeCompare([]byte(got), []byte(st.State)) != 1 { return nil, errors.New("state mismatch") }
+	return &st, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ---- Resource ownership & user deletion ----
+// ownedResources lists every table column that references a user as owner;
+// a feature adding one registers it here.
+// Deleting a user who still owns rows requires reassign_to; the rows move to
+// that account in the same transaction. The user's API keys are revoked
+// rather than moved, since a key acts with its issuer's authority. Audit
+// entries keep a tombstone label instead of a dangling actor id.
+var ownedResources = []struct{ Name, Table, Column string }{
+	{"images", "images", "owner_id"},
+	{"deployments", "deployments", "created_by"},
+	{"deploy_links", "deploy_links", "created_by"},
+	{"report_links", "report_links", "created_by"},
+	{"wake_schedules", "wake_schedules", "created_by"},
+	{"availability_windows", "availability_windows", "created_by"},
+	{"rollouts", "rollouts", "created_by"},
+	{"image_builds", "image_builds", "created_by"},
+	{"upload_sessions", "upload_sessions", "created_by"},
+}
+
+// ownedBy counts the resources each owner column attributes to user id.
+func (s *Server) ownedBy(id int64) (map[string]int, int, error) {
+	out := map[string]int{}
+	total := 0
+	for _, o := range ownedResources {
+		var n int
+		if err := s.DB.QueryRow(`SELECT COUNT(*) FROM `+o.Table+` WHERE `+o.Column+`=?`, id).Scan(&n); err != nil { return nil, 0, err }
+		if n > 0 { out[o.Name] = n; total += n }
+	}
+	return out, total, nil
+}
+
+// deleteUser removes a user, moving owned resources to reassignTo (0 = none)
+// revoking their API keys and tombstoning their audit entries. It returns
+// how many audit entries, sessions and API keys it touched; with dryRun it
+// rolls everything back.
+func (s *Server) deleteUser(id, reassignTo int64, dryRun bool) (map[string]int64, error) {
+	var email, role string
+	if err := s.DB.QueryRow(`SELECT email, role FROM users WHERE id=?`, id).Scan(&email, &role); err != nil { return nil, err }
+	if role == "admin" {
+		var admins int
+		_ = s.DB.QueryRow(`SELECT COUNT(*) FROM users WHERE role='admin'`).Scan(&admins)
+		if admins <= 1 { return nil, errors.New("cannot delete the last admin") }
+	}
+	tx, err := s.DB.Begin()
+	if err != nil { return nil, err }
+	defer tx.Rollback()
+	for _, o := range ownedResources {
+		var to any
+		if reassignTo != 0 { to = reassignTo }
+		if _, err := tx.Exec(`UPDATE `+o.Table+` SET `+o.Column+`=? WHERE `+o.Column+`=?`, to, id); err != nil { return nil, err }
+	}
+	affected := map[string]int64{}
+	label := fmt.Sprintf("deleted-user:%d (%s)", id, email)
+	for _, st := range []struct{ name, q string; args []any }{
+		{"audit_entries", `UPDATE audit SET actor_label=?, actor_id=NULL WHERE actor_id=?`, []any{label, id}},
+		{"sessions", `DELETE FROM sessions WHERE user_id=?`, []any{id}},
+		{"api_keys", `UPDATE api_keys SET revoked_at=? WHERE created_by=? AND revoked_at IS NULL`, []any{time.Now().UTC().Format(time.RFC3339), id}},
+		{"", `DELETE FROM user_mfa WHERE user_id=?`, []any{id}},
+		{"", `DELETE FROM user_sites WHERE user_id=?`, []any{id}},
+		{"", `DELETE FROM users WHERE id=?`, []any{id}},
+	} {
+		res, err := tx.Exec(st.q, st.args...)
+		if err != nil { return nil, err }
+		if st.name != "" { affected[st.name], _ = res.RowsAffected() }
+	}
+	if dryRun { return affected, nil }
+	return affected, tx.Commit()
+}
+
+// handleDeleteUser serves /api/v1/admin/users/delete {"id": 3, "reassign_to": 1}.
+// Without reassign_to, a user who owns resources is refused with 409 and the
+// counts; "reassign_to": 0 with "orphan": true leaves them ownerless.
+// ?dry_run=1 runs the deletion and rolls it back.
+func (s *Server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete { http.Error(w, "method not allowed", 405); return }
+	var body struct {
+		ID         int64 `json:"id"`
+		ReassignTo int64 `json:"reassign_to"`
+		Orphan     bool  `json:"orphan"`
+	}
+	if !decodeJSON(w, r, &body) { return }
+	if actor := s.actorID(r); actor != nil && *actor == body.ID { http.Error(w, "cannot delete your own account", 400); return }
+	owned, total, err := s.ownedBy(body.ID)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	if total > 0 && body.ReassignTo == 0 && !body.Orphan {
+		writeJSON(w, 409, map[string]any{"error": "user owns resources; pass reassign_to (or orphan)", "owned": owned}); return
+	}
+	if body.ReassignTo != 0 {
+		var n int
+		_ = s.DB.QueryRow(`SELECT COUNT(*) FROM users WHERE id=? AND role<>?`, body.ReassignTo, rolePending).Scan(&n)
+		if n == 0 || body.ReassignTo == body.ID { http.Error(w, "invalid reassign_to user", 400); return }
+	}
+	dry := isDryRun(r)
+	affected, err := s.deleteUser(body.ID, body.ReassignTo, dry)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+		http.Error(w, err.Error(), 400); return
+	}
+	if !dry { s.audit(s.actorID(r), "delete", "user", map[string]any{"id": body.ID, "reassign_to": body.ReassignTo, "owned": owned}) }
+	writeJSON(w, 200, map[string]any{"dry_run": dry, "deleted": body.ID, "reassigned": owned, "audit_entries": affected["audit_entries"], "sessions": affected["sessions"], "api_keys_revoked": affected["api_keys"]})
+}
+
+// handleUserOwnership reports what a user owns before deletion (?id=).
+func (s *Server) handleUserOwnership(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil { http.Error(w, "id required", 400); return }
+	owned, total, err := s.ownedBy(id)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	writeJSON(w, 200, map[string]any{"id": id, "owned": owned, "total": total})
+}
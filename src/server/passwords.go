@@ -0,0 +1,186 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ---- Password hashing ----
+// BOOTAH_PASSWORD_HASH picks the scheme new password hashes use: bcrypt
+// (default) with BOOTAH_BCRYPT_COST (default 10), or argon2id with
+// BOOTAH_ARGON2_MEMORY (KiB, default 65536), BOOTAH_ARGON2_TIME (default 3)
+// and BOOTAH_ARGON2_THREADS (default 2), stored in the PHC string format.
+// Hashes of either scheme keep verifying after a change; a hash that does not
+// match the current scheme and parameters is replaced on the account's next
+// successful login, when the plain password is at hand. GET
+// /api/v1/admin/password_hashes (admin) reports the accounts still on other
+// parameters; accounts that never log in again can be moved with a password
+// reset. Accounts without a password (single sign-on only) are left out.
+type argon2Params struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+func passwordScheme() string {
+	if strings.EqualFold(getenv("BOOTAH_PASSWORD_HASH", "bcrypt"), "argon2id") { return "argon2id" }
+	return "bcrypt"
+}
+
+func bcryptCost() int {
+	n, err := strconv.Atoi(getenv("BOOTAH_BCRYPT_COST", ""))
+	if err != nil || n < bcrypt.MinCost || n > bcrypt.MaxCost { return bcrypt.DefaultCost }
+	return n
+}
+
+func argon2Config() argon2Params {
+	num := func(key string, def, max uint64) uint64 {
+		n, err := strconv.ParseUint(getenv(key, ""), 10, 32)
+		if err != nil || n == 0 || n > max { return def }
+		return n
+	}
+	return argon2Params{Memory: uint32(num("BOOTAH_ARGON2_MEMORY", 64*1024, 4<<20)), Time: uint32(num("BOOTAH_ARGON2_TIME", 3, 100)),
+		Threads: uint8(num("BOOTAH_ARGON2_THREADS", 2, 255))}
+}
+
+// hashPassword hashes a new password with the configured scheme.
+func hashPassword(pw string) (string, error) {
+	if passwordScheme() == "argon2id" {
+		p := argon2Config()
+		salt := make([]byte, 16)
+		if _, err := crand.Read(salt); err != nil { return "", err }
+		key := argon2.IDKey([]byte(pw), salt, p.Time, p.Memory, p.Threads, 32)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(pw), bcryptCost())
+	return string(h), err
+}
+
+// parseArgon2Hash splits a PHC argon2id string into its parameters, salt and key.
+func parseArgon2Hash(hash string) (argon2Params, []byte, []byte, bool) {
+	var p argon2Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != fmt.Sprintf("v=%d", argon2.Version) { return p, nil, nil, false }
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil { return p, nil, nil, false }
+	salt, err1 := base64.RawStdEncoding.DecodeString(parts[4])
+	key, err2 := base64.RawStdEncoding.DecodeString(parts[5])
+	if err1 != nil || err2 != nil || len(key) == 0 { return p, nil, nil, false }
+	return p, salt, key, true
+}
+
+// checkPassword reports whether pw matches a bcrypt or argon2id hash.
+func checkPassword(hash, pw string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		p, salt, key, ok := parseArgon2Hash(hash)
+		if !ok { return false }
+		return subtle.ConstantTimeCompare(argon2.IDKey([]byte(pw), salt, p.Time, p.Memory, p.Threads, uint32(len(key))), key) == 1
+	}
+	return hash != "" && bcrypt.CompareHashAndPassword([]byte(hash), []byte(pw)) == nil
+}
+
+// dummyPasswordHash stands in for the hash of an account that doesn't exist
+// or has no local password, so refusing one costs the same as a wrong
+// password and response times don't reveal which emails are registered.
+var dummyPasswordHash = sync.OnceValue(func() string { h, _ := hashPassword(randToken(24)); return h })
+
+// passwordHashParams describes a hash's scheme and parameters.
+func passwordHashParams(hash string) string {
+	if p, _, _, ok := parseArgon2Hash(hash); ok { return fmt.Sprintf("argon2id m=%d,t=%d,p=%d", p.Memory, p.Time, p.Threads) }
+	if cost, err := bcrypt.Cost([]byte(hash)); err == nil { return fmt.Sprintf("bcrypt cost %d", cost) }
+	return "unknown"
+}
+
+// currentHashParams describes what hashPassword produces now.
+func currentHashParams() string {
+	if passwordScheme() == "argon2id" {
+		p := argon2Config()
+		return fmt.Sprintf("argon2id m=%d,t=%d,p=%d", p.Memory, p.Time, p.Threads)
+	}
+	return fmt.Sprintf("bcrypt cost %d", bcryptCost())
+}
+
+// passwordNeedsRehash reports whether a hash is not on the configured scheme
+// and parameters.
+func passwordNeedsRehash(hash string) bool { return passwordHashParams(hash) != currentHashParams() }
+
+// upgradePasswordHash re-hashes a just-verified password when its stored hash
+// is on other parameters. Failures only delay the upgrade to the next login.
+func (s *Server) upgradePasswordHash(id int64, oldHash, pw string) {
+	if !passwordNeedsRehash(oldHash) { return }
+	h, err := hashPassword(pw)
+	if err != nil { return }
+	res, err := s.DB.Exec(`UPDATE users SET passhash=? WHERE id=? AND passhash=?`, h, id, oldHash)
+	if err != nil { return }
+	if n, _ := res.RowsAffected(); n > 0 {
+		s.audit(&id, "rehash_password", "user", map[string]any{"id": id, "from": passwordHashParams(oldHash), "to": passwordHashParams(h)})
+	}
+}
+
+func (s *Server) passwordRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/password_hashes", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		rows, err := s.DB.Query(`SELECT id, email, passhash FROM users WHERE passhash<>'' ORDER BY id`)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		defer rows.Close()
+		current := currentHashParams()
+		total, counts, outdated := 0, map[string]int{}, []map[string]any{}
+		for rows.Next() {
+			var id int64
+			var email, hash string
+			if err := rows.Scan(&id, &email, &hash); err != nil { http.Error(w, err.Error(), 500); return }
+			params := passwordHashParams(hash)
+			total++
+			counts[params]++
+			if params != current { outdated = append(outdated, map[string]any{"id": id, "email": email, "params": params}) }
+		}
+		writeJSON(w, 200, map[string]any{"current": current, "total": total, "by_params": counts, "outdated": outdated})
+	})
+}
+
+// ---- Temporary passwords ----
+// An admin password reset sets a random temporary password drawn with
+// crypto/rand: BOOTAH_TEMP_PASSWORD_LENGTH characters (default 16, 12 to 72)
+// from BOOTAH_TEMP_PASSWORD_CHARSET (default letters, digits and a few
+// symbols, without look-alikes; at least 20 distinct characters). It stops
+// working after BOOTAH_TEMP_PASSWORD_TTL (default 24h) unless the user has
+// replaced it by then. With {"delivery": "email"} it is mailed to the user
+// (see sendMail) instead of being returned in the response.
+const defaultTempCharset = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789!@$%"
+
+func tempPasswordCharset() string {
+	cs := getenv("BOOTAH_TEMP_PASSWORD_CHARSET", "")
+	seen := map[rune]bool{}
+	for _, c := range cs {
+		if c > 0x7e || c < 0x21 { return defaultTempCharset }
+		seen[c] = true
+	}
+	if len(seen) < 20 { return defaultTempCharset }
+	return cs
+}
+
+func genTempPassword() string {
+	n, err := strconv.Atoi(getenv("BOOTAH_TEMP_PASSWORD_LENGTH", ""))
+	if err != nil || n < 12 || n > 72 { n = 16 }
+	cs := tempPasswordCharset()
+	b := make([]byte, n)
+	for i := range b {
+		j, _ := crand.Int(crand.Reader, big.NewInt(int64(len(cs))))
+		b[i] = cs[j.Int64()]
+	}
+	return string(b)
+}
+
+func tempPasswordTTL() time.Duration { return envDuration("BOOTAH_TEMP_PASSWORD_TTL", 24*time.Hour) }
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ---- Roles and permissions ----
+// Routes check permissions, not a role ranking. A route still names the
+// built-in role it is meant for (requireRole(w, r, "operator")); that level
+// and the route's area (see permissionAreas) give the permission it needs:
+// <area>:write for operator routes and <area>:manage for admin routes, e.g.
+// images:write, drivers:manage, users:manage. Waking and powering machines
+// needs machines:power. Read-only routes only need a login. A role is a set of
+// permissions: admin holds all of them and can't be changed, operator holds
+// every :write permission plus machines:power and viewer none, until an admin
+// changes them or adds roles of their own with /api/v1/admin/roles (for
+// example an operator without drivers:write). API keys keep acting within
+// their scopes as before. Editing roles and impersonating need the admin role
+// itself, and users can only be given roles whose permissions the granting
+// user holds.
+var permissionAreas = []struct {
+	Prefix string
+	Area   string
+}{
+	{"/api/v1/admin/users", "users"}, {"/api/v1/admin/sessions", "users"}, {"/api/v1/admin/impersonate", "users"},
+	{"/api/v1/admin/api_keys", "users"}, {"/api/v1/admin/mfa", "users"}, {"/api/v1/admin/password_hashes", "users"},
+	{"/api/v1/admin/roles", "users"},
+	{"/api/v1/admin/driver_packs", "drivers"},
+	{"/api/v1/images", "images"}, {"/api/v1/admin/images", "images"}, {"/api/v1/image_tags", "images"}, {"/api/v1/uploads", "images"},
+	{"/api/v1/builds", "images"}, {"/api/v1/admin/image_downloads", "images"}, {"/api/v1/admin/winpe", "images"},
+	{"/api/v1/admin/updates", "images"},
+	{"/api/v1/machines", "machines"}, {"/api/v1/machine_tags", "machines"}, {"/api/v1/admin/machines", "machines"},
+	{"/api/v1/admin/groups", "machines"}, {"/api/v1/admin/inventory", "machines"}, {"/api/v1/admin/saved_searches", "machines"},
+	{"/api/v1/admin/cmdb", "machines"}, {"/api/v1/ansible", "machines"}, {"/api/v1/exam_boots", "machines"},
+	{"/api/v1/wake_schedules", "power"},
+	{"/api/v1/admin/deployments", "deployments"}, {"/api/v1/deployments", "deployments"}, {"/api/v1/admin/task_sequences", "deployments"},
+	{"/api/v1/admin/task_runs", "deployments"}, {"/api/v1/admin/rollouts", "deployments"}, {"/api/v1/admin/wipes", "deployments"},
+	{"/api/v1/admin/deploy_links", "deployments"}, {"/api/v1/admin/reports/deployments", "deployments"}, {"/api/v1/admin/software", "deployments"},
+	{"/api/v1/admin/software_sets", "deployments"},
+	{"/api/v1/admin/awx", "deployments"}, {"/api/v1/admin/availability_windows", "deployments"},
+	{"/api/v1/admin/templates", "templates"}, {"/api/v1/admin/template_secrets", "templates"}, {"/api/v1/admin/regional_presets", "templates"},
+	{"/api/v1/admin/boot", "boot"}, {"/api/v1/admin/boot-assets", "boot"}, {"/api/v1/admin/boot-pairs", "boot"},
+	{"/api/v1/admin/boot_policies", "boot"}, {"/api/v1/boot_profiles", "boot"}, {"/api/v1/admin/kernel_args", "boot"},
+	{"/api/v1/admin/dhcp", "boot"}, {"/api/v1/admin/relays", "boot"}, {"/api/v1/admin/sites", "boot"},
+	{"/api/v1/admin/audit", "audit"},
+}
+
+var permissionAreaDesc = map[string]string{
+	"users":       "users, sessions, API keys, roles and MFA",
+	"drivers":     "driver packs",
+	"images":      "images, uploads, builds and updates",
+	"machines":    "machines, groups, inventory and tags",
+	"deployments": "deployments, task sequences, rollouts and wipes",
+	"templates":   "answer-file templates, template secrets and regional presets",
+	"boot":        "boot assets, policies, kernel arguments, sites, relays and DHCP",
+	"audit":       "the audit log",
+	"system":      "everything else (storage, jobs, plugins, cluster, notifications)",
+}
+
+// permissionCatalog lists every permission with a description.
+func permissionCatalog() map[string]string {
+	out := map[string]string{"machines:power": "Wake and power on machines, run wake schedules"}
+	for area, desc := range permissionAreaDesc {
+		out[area+":write"] = "Change " + desc + " (operator level)"
+		out[area+":manage"] = "Administer " + desc + " (admin level)"
+	}
+	return out
+}
+
+// routePermission is the permission a route for role level needs.
+func routePermission(path, level string) string {
+	area, best := "system", 0
+	for _, a := range permissionAreas {
+		if (path == a.Prefix || strings.HasPrefix(path, a.Prefix+"/")) && len(a.Prefix) > best {
+			area, best = a.Area, len(a.Prefix)
+		}
+	}
+	if area == "power" || area == "machines" && strings.HasSuffix(strings.TrimSuffix(path, "/"), "/wake") { return "machines:power" }
+	if level == "admin" { return area + ":manage" }
+	return area + ":write"
+}
+
+var roleNameRe = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,31}$`)
+
+func initRoles(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS roles (
+		name TEXT PRIMARY KEY,
+		description TEXT,
+		builtin INTEGER NOT NULL DEFAULT 0,
+		updated_at TEXT NOT NULL
+	)`); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS role_permissions (
+		role TEXT NOT NULL,
+		permission TEXT NOT NULL,
+		PRIMARY KEY (role, permission)
+	)`); err != nil {
+		return err
+	}
+	// built-in roles are seeded once with the reach they had before
+	// permissions; later edits are kept
+	now := time.Now().UTC().Format(time.RFC3339)
+	defaults := map[string][]string{"admin": nil, "operator": {"machines:power"}, "viewer": nil}
+	for p := range permissionCatalog() {
+		if strings.HasSuffix(p, ":write") { defaults["operator"] = append(defaults["operator"], p) }
+	}
+	descs := map[string]string{"admin": "Everything", "operator": "Day-to-day imaging work", "viewer": "Read-only access"}
+	for role, perms := range defaults {
+		res, err := db.Exec(`INSERT INTO roles (name, description, builtin, updated_at) VALUES (?,?,1,?) ON CONFLICT(name) DO NOTHING`, role, descs[role], now)
+		if err != nil { return err }
+		if n, _ := res.RowsAffected(); n == 0 { continue }
+		for _, p := range perms {
+			if _, err := db.Exec(`INSERT INTO role_permissions (role, permission) VALUES (?,?)`, role, p); err != nil { return err }
+		}
+	}
+	return nil
+}
+
+type Role struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Builtin     bool     `json:"builtin"`
+	Permissions []string `json:"permissions"`
+	Users       int      `json:"users"`
+	UpdatedAt   string   `json:"updated_at"`
+}
+
+func (ro *Role) validateFields(v *validator) {
+	if v.required("name", ro.Name) && !roleNameRe.MatchString(ro.Name) { v.add("name", "lowercase letters, digits, _ and - (2 to 32, starting with a letter)") }
+	if ro.Name == rolePending { v.add("name", "is reserved") }
+	v.maxLen("description", ro.Description, 256)
+	catalog := permissionCatalog()
+	for _, p := range ro.Permissions {
+		if _, ok := catalog[p]; !ok { v.add("permissions", fmt.Sprintf("unknown permission %q", p)) }
+	}
+}
+
+// roleExists reports whether users can be given role.
+func (s *Server) roleExists(role string) bool {
+	var n int
+	_ = s.DB.QueryRow(`SELECT COUNT(*) FROM roles WHERE name=?`, role).Scan(&n)
+	return n > 0
+}
+
+func (s *Server) roleAllows(role, perm string) bool {
+	if role == "admin" { return true }
+	var n int
+	_ = s.DB.QueryRow(`SELECT COUNT(*) FROM role_permissions WHERE role=? AND permission=?`, role, perm).Scan(&n)
+	return n > 0
+}
+
+// requireRole authorizes a request for a route meant for level (operator or
+// admin) by the permission routePermission derives from it.
+func (s *Server) requireRole(w http.ResponseWriter, r *http.Request, level string) bool {
+	_, claims, err := s.verifyAuth(r)
+	if err != nil { http.Error(w, "unauthorized", 401); return false }
+	if perm := routePermission(r.URL.Path, level); !s.claimsAllow(claims, r.URL.Path, level) {
+		http.Error(w, "forbidden: needs permission "+perm, 403)
+		return false
+	}
+	if scope := s.claimsSites(claims); scope != nil { return s.checkSiteScope(w, r, scope) }
+	return true
+}
+
+// requireAdmin is requireRole for the routes that hand out access themselves,
+// impersonation and role editing: they need the admin role, not just
+// users:manage, which a custom role could otherwise use to raise itself.
+func (s *Server) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !s.requireRole(w, r, "admin") { return false }
+	_, claims, _ := s.verifyAuth(r)
+	if role, _ := claims["role"].(string); role != "admin" { http.Error(w, "forbidden: needs the admin role", 403); return false }
+	return true
+}
+
+// claimsCanGrant reports whether verified claims may give a user role: only
+// admins grant admin, and no one grants a permission they don't hold.
+func (s *Server) claimsCanGrant(claims map[string]any, role string) bool {
+	mine, _ := claims["role"].(string)
+	if mine == "admin" { return true }
+	if role == "admin" { return false }
+	rows, err := s.DB.Query(`SELECT permission FROM role_permissions WHERE role=?`, role)
+	if err != nil { return false }
+	var perms []string
+	for rows.Next() {
+		var p string
+		if rows.Scan(&p) == nil { perms = append(perms, p) }
+	}
+	rows.Close()
+	for _, p := range perms {
+		if !s.roleAllows(mine, p) { return false }
+	}
+	return true
+}
+
+// requireGrant writes 403 unless the caller may move a user from role from
+// to role to.
+func (s *Server) requireGrant(w http.ResponseWriter, r *http.Request, from, to string) bool {
+	_, claims, err := s.verifyAuth(r)
+	if err != nil { http.Error(w, "unauthorized", 401); return false }
+	if (from != "" && from != rolePending && !s.claimsCanGrant(claims, from)) || !s.claimsCanGrant(claims, to) {
+		http.Error(w, "forbidden: the role holds permissions you don't", 403)
+		return false
+	}
+	return true
+}
+
+// claimsAllow reports whether verified claims may use the route at path meant
+// for level.
+func (s *Server) claimsAllow(claims map[string]any, path, level string) bool {
+	role, _ := claims["role"].(string)
+	if _, ok := claims["api_key"]; ok {
+		// scopes already limited the key to its routes
+		return roleRanks[role] >= roleRanks[level]
+	}
+	return s.roleAllows(role, routePermission(path, level))
+}
+
+func (s *Server) loadRoles(name string) ([]*Role, error) {
+	q, args := `SELECT name, COALESCE(description,''), builtin, updated_at, (SELECT COUNT(*) FROM users u WHERE u.role=roles.name) FROM roles`, []any{}
+	if name != "" { q, args = q+` WHERE name=?`, append(args, name) }
+	rows, err := s.DB.Query(q+` ORDER BY builtin DESC, name`, args...)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := []*Role{}
+	byName := map[string]*Role{}
+	for rows.Next() {
+		ro := &Role{Permissions: []string{}}
+		if err := rows.Scan(&ro.Name, &ro.Description, &ro.Builtin, &ro.UpdatedAt, &ro.Users); err != nil { return nil, err }
+		out = append(out, ro)
+		byName[ro.Name] = ro
+	}
+	if err := rows.Err(); err != nil { return nil, err }
+	prows, err := s.DB.Query(`SELECT role, permission FROM role_permissions ORDER BY permission`)
+	if err != nil { return nil, err }
+	defer prows.Close()
+	for prows.Next() {
+		var role, perm string
+		if err := prows.Scan(&role, &perm); err != nil { return nil, err }
+		if ro := byName[role]; ro != nil { ro.Permissions = append(ro.Permissions, perm) }
+	}
+	if ro := byName["admin"]; ro != nil {
+		ro.Permissions = ro.Permissions[:0]
+		for p := range permissionCatalog() { ro.Permissions = append(ro.Permissions, p) }
+		sort.Strings(ro.Permissions)
+	}
+	return out, prows.Err()
+}
+
+// saveRolePermissions replaces role's permissions.
+func (s *Server) saveRolePermissions(tx *sql.Tx, role string, perms []string) error {
+	if _, err := tx.Exec(`DELETE FROM role_permissions WHERE role=?`, role); err != nil { return err }
+	seen := map[string]bool{}
+	for _, p := range perms {
+		if seen[p] { continue }
+		seen[p] = true
+		if _, err := tx.Exec(`INSERT INTO role_permissions (role, permission) VALUES (?,?)`, role, p); err != nil { return err }
+	}
+	return nil
+}
+
+func (s *Server) roleRoutes() {
+	// GET lists roles with their permissions and the permission catalog;
+	// POST {name, description?, permissions} adds a role
+	s.Mux.HandleFunc("/api/v1/admin/roles", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireAdmin(w, r) { return }
+		switch r.Method {
+		case http.MethodGet:
+			roles, err := s.loadRoles("")
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			writeJSON(w, 200, map[string]any{"roles": roles, "permissions": permissionCatalog()})
+		case http.MethodPost:
+			var ro Role
+			if !decodeJSON(w, r, &ro) { return }
+			if s.roleExists(ro.Name) { http.Error(w, "role exists", 409); return }
+			tx, err := s.DB.Begin()
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer tx.Rollback()
+			if _, err := tx.Exec(`INSERT INTO roles (name, description, updated_at) VALUES (?,NULLIF(?,''),?)`, ro.Name, ro.Description, time.Now().UTC().Format(time.RFC3339)); err != nil { http.Error(w, err.Error(), 500); return }
+			if err := s.saveRolePermissions(tx, ro.Name, ro.Permissions); err != nil { http.Error(w, err.Error(), 500); return }
+			if err := tx.Commit(); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "create", "role", map[string]any{"name": ro.Name, "permissions": ro.Permissions})
+			roles, err := s.loadRoles(ro.Name)
+			if err != nil || len(roles) == 0 { http.Error(w, "role vanished", 500); return }
+			writeJSON(w, 201, roles[0])
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// PUT {description?, permissions} replaces a role's permissions; DELETE
+	// removes a role no user holds. admin and the built-in roles can't be
+	// deleted, and admin can't be changed.
+	s.Mux.HandleFunc("/api/v1/admin/roles/", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireAdmin(w, r) { return }
+		name := strings.TrimPrefix(r.URL.Path, "/api/v1/admin/roles/")
+		roles, err := s.loadRoles(name)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if len(roles) == 0 { http.NotFound(w, r); return }
+		cur := roles[0]
+		switch r.Method {
+		case http.MethodPut:
+			if name == "admin" { http.Error(w, "the admin role always holds every permission", 409); return }
+			ro := Role{Name: name}
+			if !decodeJSON(w, r, &ro) { return }
+			tx, err := s.DB.Begin()
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer tx.Rollback()
+			if _, err := tx.Exec(`UPDATE roles SET description=NULLIF(?,''), updated_at=? WHERE name=?`, ro.Description, time.Now().UTC().Format(time.RFC3339), name); err != nil { http.Error(w, err.Error(), 500); return }
+			if err := s.saveRolePermissions(tx, name, ro.Permissions); err != nil { http.Error(w, err.Error(), 500); return }
+			if err := tx.Commit(); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "update", "role", map[string]any{"name": name, "permissions": ro.Permissions})
+			roles, err = s.loadRoles(name)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			writeJSON(w, 200, roles[0])
+		case http.MethodDelete:
+			if cur.Builtin { http.Error(w, "built-in roles can't be deleted", 409); return }
+			if cur.Users > 0 { http.Error(w, fmt.Sprintf("role is held by %d users", cur.Users), 409); return }
+			tx, err := s.DB.Begin()
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer tx.Rollback()
+			for _, q := range []string{`DELETE FROM role_permissions WHERE role=?`, `DELETE FROM mfa_policy WHERE role=?`, `DELETE FROM roles WHERE name=?`} {
+				if _, err := tx.Exec(q, name); err != nil { http.Error(w, err.Error(), 500); return }
+			}
+			if err := tx.Commit(); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "delete", "role", map[string]any{"name": name})
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ---- Deployment plans ----
+// planDeployment resolves everything a deployment would use - machine,
+// groups, image version, driver packs, task sequence and the rendered answer
+// file and scripts - without creating anything, so a rollout can be reviewed
+// first. Errors are what createDeployment or the agent would trip over;
+// warnings are worth a second look (destructive steps, superseded images).
+// Generated secrets are shown as placeholders.
+type planRequest struct {
+	MAC        string `json:"mac"`
+	Hostname   string `json:"hostname"`
+	ImageID    string `json:"image_id"`
+	TemplateID string `json:"template_id"`
+	SequenceID string `json:"task_sequence_id"`
+}
+
+type deploymentPlan struct {
+	MAC      string           `json:"mac"`
+	Machine  map[string]any   `json:"machine"`
+	Groups   []string         `json:"groups"`
+	Image    map[string]any   `json:"image,omitempty"`
+	Drivers  []map[string]any `json:"drivers"`
+	Sequence *TaskSequence    `json:"task_sequence,omitempty"`
+	Regional *RegionalPreset  `json:"regional_preset,omitempty"`
+	Steps    []map[string]any `json:"steps"`
+	Files    []map[string]any `json:"files"`
+	Errors   []string         `json:"errors"`
+	Warnings []string         `json:"warnings"`
+	OK       bool             `json:"ok"`
+}
+
+func (s *Server) planDeployment(req planRequest) (*deploymentPlan, error) {
+	p := &deploymentPlan{MAC: normalizeMAC(req.MAC), Machine: map[string]any{}, Groups: []string{}, Drivers: []map[string]any{},
+		Steps: []map[string]any{}, Files: []map[string]any{}, Errors: []string{}, Warnings: []string{}}
+	errorf := func(format string, a ...any) { p.Errors = append(p.Errors, fmt.Sprintf(format, a...)) }
+	warnf := func(format string, a ...any) { p.Warnings = append(p.Warnings, fmt.Sprintf(format, a...)) }
+
+	// machine and groups
+	var vendor, model, serial, asset, collected *string
+	err := s.DB.QueryRow(`SELECT vendor, model, serial, asset_tag, collected_at FROM inventory WHERE mac=? ORDER BY id DESC LIMIT 1`, p.MAC).
+		Scan(&vendor, &model, &serial, &asset, &collected)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		warnf("machine %s has no inventory; driver packs and model groups cannot be resolved", p.MAC)
+	case err != nil:
+		return nil, err
+	default:
+		p.Machine = map[string]any{"vendor": strOrEmpty(vendor), "model": strOrEmpty(model), "serial": strOrEmpty(serial),
+			"asset_tag": strOrEmpty(asset), "inventoried_at": strOrEmpty(collected)}
+		packs, err := s.driverPacksForModel(strOrEmpty(vendor), strOrEmpty(model))
+		if err != nil { return nil, err }
+		if packs != nil { p.Drivers = packs }
+	}
+	names, err := s.machineGroupNames()
+	if err != nil { return nil, err }
+	ids, err := s.groupsForMachine(p.MAC)
+	if err != nil { return nil, err }
+	for _, id := range ids { p.Groups = append(p.Groups, names[id]) }
+	if fields, err := s.machineFields(p.MAC); err == nil && len(fields) > 0 { p.Machine["fields"] = fields }
+	var active string
+	if s.DB.QueryRow(`SELECT id FROM deployments WHERE mac=? AND status IN ('pending','running','validating') LIMIT 1`, p.MAC).Scan(&active) == nil {
+		warnf("machine already has active deployment %s", active)
+	}
+
+	// image version
+	if req.ImageID == "" {
+		warnf("no image selected")
+	} else {
+		var name, typ, updated, sum string
+		var size int64
+		var version int
+		err := s.DB.QueryRow(`SELECT name, type, size_mb, updated, COALESCE(sha256,''), COALESCE(version,1) FROM images WHERE id=?`, req.ImageID).Scan(&name, &typ, &size, &updated, &sum, &version)
+		if errors.Is(err, sql.ErrNoRows) {
+			errorf("unknown image %s", req.ImageID)
+		} else if err != nil {
+			return nil, err
+		} else {
+			p.Image = map[string]any{"id": req.ImageID, "name": name, "type": typ, "size_mb": size, "updated": updated, "sha256": sum, "version": version}
+			if err := s.imageBootable(req.ImageID); err != nil { errorf("%v", err) }
+			if ok, err := s.imageAvailable(req.ImageID, time.Now()); err == nil && !ok { warnf("image %s is outside its availability windows; the machine will not be offered deployment until one opens", req.ImageID) }
+			if log, err := s.imageChangelog(req.ImageID); err == nil && len(log) > 0 { p.Image["changelog"] = log[0] }
+			var newer string
+			if s.DB.QueryRow(`SELECT image_id FROM image_changelog WHERE previous_id=? ORDER BY created DESC LIMIT 1`, req.ImageID).Scan(&newer) == nil {
+				warnf("image %s has been superseded by %s", req.ImageID, newer)
+			}
+		}
+	}
+
+	// task sequence, step by step
+	if req.SequenceID != "" {
+		seq, err := s.taskSequence(req.SequenceID)
+		if errors.Is(err, sql.ErrNoRows) {
+			errorf("unknown task sequence %s", req.SequenceID)
+		} else if err != nil {
+			return nil, err
+		} else {
+			p.Sequence = seq
+			if err := validateSteps(seq.Steps); err != nil { errorf("task sequence: %v", err) }
+			for _, st := range seq.Steps {
+				step := map[string]any{"name": st.Name, "type": st.Type, "params": st.Params}
+				switch st.Type {
+				case "wipe":
+					warnf("step %q wipes the disk (%s)", st.Name, st.Params["method"])
+				case "inject_drivers":
+					if len(p.Drivers) == 0 { warnf("step %q injects drivers but no driver pack matches this model", st.Name) }
+				case "install_update":
+					b, err := s.resolveUpdateBundle(st.Params["bundle"], st.Params["product"])
+					if err != nil { errorf("step %q: update bundle %s not found", st.Name, st.Params["bundle"]) } else { step["bundle"] = b }
+				case "install_software":
+					name, pkgs, err := s.softwareSet(st.Params["set"])
+					if err != nil {
+						errorf("step %q: software set %s not found", st.Name, st.Params["set"])
+					} else {
+						step["software_set"] = map[string]any{"id": st.Params["set"], "name": name, "packages": pkgs}
+						p.Files = append(p.Files, map[string]any{"name": "install-" + st.Params["set"] + ".ps1", "step": st.Name,
+							"content": renderInstallScript(st.Params["set"], "<deployment-id>", p.MAC, pkgs)})
+					}
+				}
+				p.Steps = append(p.Steps, step)
+			}
+		}
+	}
+
+	// answer file
+	var kind, body string
+	err = s.DB.QueryRow(`SELECT kind, body FROM templates WHERE id=?`, req.TemplateID).Scan(&kind, &body)
+	if errors.Is(err, sql.ErrNoRows) {
+		errorf("unknown template %q", req.TemplateID)
+	} else if err != nil {
+		return nil, err
+	} else {
+		for _, i := range lintErrors(lintTemplate(kind, body)) { errorf("template line %d: %s", i.Line, i.Message) }
+		placeholders := map[string]string{secretAdminPassword: "<generated>", secretAgentToken: "<generated>"}
+		if p.Regional, err = s.regionalPresetFor(p.MAC); err != nil { return nil, err }
+		out, err := renderTemplate(kind, body, answerFileVars("<deployment-id>", p.MAC, strings.TrimSpace(req.Hostname), placeholders, p.Regional),
+			s.secretResolver("<deployment-id>", p.MAC, req.TemplateID, false))
+		if err != nil {
+			errorf("render answer file: %v", err)
+		} else {
+			name := "autounattend.xml"
+			if kind == "cloud-init" { name = "user-data" }
+			p.Files = append([]map[string]any{{"name": name, "kind": kind, "template_id": req.TemplateID, "content": out}}, p.Files...)
+		}
+	}
+	p.OK = len(p.Errors) == 0
+	return p, nil
+}
+
+func (s *Server) planRoutes() {
+	// POST the body /api/v1/admin/deployments would take; nothing is created
+	s.Mux.HandleFunc("/api/v1/deployments/plan", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		var req planRequest
+		if !decodeJSON(w, r, &req) { return }
+		if normalizeMAC(req.MAC) == "" { http.Error(w, "mac required", 400); return }
+		p, err := s.planDeployment(req)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		writeJSON(w, 200, p)
+	})
+}
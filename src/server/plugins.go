@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---- Event plugins ----
+// Core handlers call s.emit for lifecycle events (image.published,
+// deployment.finished, machine.enrolled, ...). Events are delivered in order
+// by one dispatcher to every plugin subscribed to them; a slow or failing
+// plugin is logged and never blocks the handler that emitted the event.
+// Plugins are either compiled in (registerPlugin from an init func) or
+// configured with BOOTAH_PLUGINS="name=https://host/hook,name2=exec:/path/cmd":
+// HTTP plugins receive the event as a signed POST
+// (BOOTAH_PLUGIN_<NAME>_SECRET), exec plugins get it as JSON on stdin.
+// BOOTAH_PLUGIN_<NAME>_EVENTS limits a plugin to matching kinds ("image.*").
+type Event struct {
+	ID   string         `json:"id"`
+	Kind string         `json:"kind"`
+	Time string         `json:"time"`
+	Node string         `json:"node"`
+	Data map[string]any `json:"data"`
+}
+
+type Plugin interface {
+	Name() string
+	Handle(ctx context.Context, s *Server, ev Event) error
+}
+
+type pluginEntry struct {
+	Plugin
+	events []string // kind patterns, empty = all
+
+	mu        sync.Mutex
+	delivered int64
+	failed    int64
+	lastError string
+	lastAt    string
+}
+
+func (p *pluginEntry) wants(kind string) bool {
+	if len(p.events) == 0 { return true }
+	for _, pat := range p.events {
+		if ok, _ := path.Match(strings.ReplaceAll(pat, ".", "/"), strings.ReplaceAll(kind, ".", "/")); ok { return true }
+	}
+	return false
+}
+
+var (
+	compiledPlugins []Plugin
+	plugins         []*pluginEntry
+	pluginEvents    = make(chan Event, 1024)
+)
+
+// registerPlugin adds a compiled-in plugin; call it from an init func.
+func registerPlugin(p Plugin) { compiledPlugins = append(compiledPlugins, p) }
+
+func pluginTimeout() time.Duration {
+	d, err := time.ParseDuration(getenv("BOOTAH_PLUGIN_TIMEOUT", "15s"))
+	if err != nil || d <= 0 { return 15 * time.Second }
+	return d
+}
+
+func pluginEnv(name, suffix string) string {
+	return getenv("BOOTAH_PLUGIN_"+strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))+"_"+suffix, "")
+}
+
+type httpPlugin struct{ name, url, secret string }
+
+func (p httpPlugin) Name() string { return p.name }
+
+func (p httpPlugin) Handle(ctx context.Context, s *Server, ev Event) error {
+	js, _ := json.Marshal(ev)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(js))
+	if err != nil { return err }
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Bootah-Event", ev.Kind)
+	if p.secret != "" {
+		m := hmac.New(sha256.New, []byte(p.secret))
+		m.Write(js)
+		req.Header.Set("X-Bootah-Signature", "sha256="+hex.EncodeToString(m.Sum(nil)))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil { return err }
+	resp.Body.Close()
+	if resp.StatusCode >= 300 { return fmt.Errorf("%s returned %s", p.url, resp.Status) }
+	return nil
+}
+
+type execPlugin struct {
+	name string
+	argv []string
+}
+
+func (p execPlugin) Name() string { return p.name }
+
+func (p execPlugin) Handle(ctx context.Context, s *Server, ev Event) error {
+	js, _ := json.Marshal(ev)
+	cmd := exec.CommandContext(ctx, p.argv[0], p.argv[1:]...)
+	cmd.Stdin = bytes.NewReader(js)
+	cmd.Env = append(cmd.Environ(), "BOOTAH_EVENT="+ev.Kind)
+	out, err := cmd.CombinedOutput()
+	if err != nil { return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out))) }
+	return nil
+}
+
+// loadPlugins builds the active plugin list from the compiled-in registry and
+// BOOTAH_PLUGINS.
+func loadPlugins() error {
+	plugins = nil
+	seen := map[string]bool{}
+	add := func(p Plugin) error {
+		if seen[p.Name()] { return fmt.Errorf("plugin %q defined twice", p.Name()) }
+		seen[p.Name()] = true
+		plugins = append(plugins, &pluginEntry{Plugin: p, events: splitList(pluginEnv(p.Name(), "EVENTS"))})
+		return nil
+	}
+	for _, p := range compiledPlugins {
+		if err := add(p); err != nil { return err }
+	}
+	for _, spec := range splitList(getenv("BOOTAH_PLUGINS", "")) {
+		name, target, ok := strings.Cut(spec, "=")
+		name, target = strings.TrimSpace(name), strings.TrimSpace(target)
+		if !ok || name == "" || target == "" { return fmt.Errorf("BOOTAH_PLUGINS: want name=target, got %q", spec) }
+		var p Plugin
+		if cmd, isExec := strings.CutPrefix(target, "exec:"); isExec {
+			argv := strings.Fields(cmd)
+			if len(argv) == 0 { return fmt.Errorf("plugin %q: empty command", name) }
+			p = execPlugin{name: name, argv: argv}
+		} else if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+			p = httpPlugin{name: name, url: target, secret: pluginEnv(name, "SECRET")}
+		} else {
+			return fmt.Errorf("plugin %q: target must be a URL or exec:<command>", name)
+		}
+		if err := add(p); err != nil { return err }
+	}
+	return nil
+}
+
+// emit queues a lifecycle event for plugins. It never blocks; when the queue
+// is full the event is dropped and logged.
+func (s *Server) emit(kind string, data map[string]any) {
+	if len(plugins) == 0 { return }
+	ev := Event{ID: "evt-" + genID(), Kind: kind, Time: time.Now().UTC().Format(time.RFC3339), Node: nodeID, Data: data}
+	select {
+	case pluginEvents <- ev:
+	default:
+		log.Printf("plugins: queue full, dropping %s event %s", kind, ev.ID)
+	}
+}
+
+func (s *Server) deliverEvent(ctx context.Context, p *pluginEntry, ev Event) {
+	ctx, cancel := context.WithTimeout(ctx, pluginTimeout())
+	defer cancel()
+	err := p.Handle(ctx, s, ev)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastAt = time.Now().UTC().Format(time.RFC3339)
+	if err != nil {
+		p.failed++
+		p.lastError = err.Error()
+		log.Printf("plugin %s: %s event %s: %v", p.Name(), ev.Kind, ev.ID, err)
+		return
+	}
+	p.delivered++
+	p.lastError = ""
+}
+
+// startPlugins runs the dispatcher until ctx is cancelled.
+func (s *Server) startPlugins(ctx context.Context) {
+	if len(plugins) == 0 { return }
+	names := make([]string, len(plugins))
+	for i, p := range plugins { names[i] = p.Name() }
+	log.Printf("plugins: %s", strings.Join(names, ", "))
+	go func() {
+		for {
+			select {
+			case ev := <-pluginEvents:
+				for _, p := range plugins {
+					if p.wants(ev.Kind) { s.deliverEvent(context.Background(), p, ev) }
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (s *Server) pluginRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/plugins", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		out := []map[string]any{}
+		for _, p := range plugins {
+			p.mu.Lock()
+			kind := "compiled"
+			switch p.Plugin.(type) {
+			case httpPlugin:
+				kind = "http"
+			case execPlugin:
+				kind = "exec"
+			}
+			out = append(out, map[string]any{"name": p.Name(), "type": kind, "events": p.events, "delivered": p.delivered,
+				"failed": p.failed, "last_error": p.lastError, "last_delivery": p.lastAt})
+			p.mu.Unlock()
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i]["name"].(string) < out[j]["name"].(string) })
+		writeJSON(w, 200, map[string]any{"plugins": out, "queued": len(pluginEvents)})
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// ---- Post-deployment profile reversion ----
+// A machine that PXE-boots first would redeploy on every boot if its boot
+// profile kept pointing at the deploy entry. When a deployment succeeds the
+// machine's boot profile is switched to BOOTAH_REVERT_PROFILE (default
+// "local", a profile id or entry name) after BOOTAH_REVERT_DELAY (default 0,
+// immediately). BOOTAH_REVERT_AFTER_DEPLOY picks which machines revert:
+// "once" (default) only those whose profile was assigned with
+// boot_profile_once, "always" every machine, "off" none. Reverting clears the
+// one-time flag. Assigning a profile by hand cancels a pending reversion. A
+// machine reverted to the local or next entry boots on directly, without
+// the menu.
+func revertMode() string {
+	switch m := getenv("BOOTAH_REVERT_AFTER_DEPLOY", "once"); m {
+	case "always", "off":
+		return m
+	}
+	return "once"
+}
+
+// scheduleProfileRevert queues the reversion for a machine whose deployment
+// just succeeded.
+func (s *Server) scheduleProfileRevert(mac string) {
+	mode := revertMode()
+	if mode == "off" { return }
+	at := time.Now().UTC().Add(envDuration("BOOTAH_REVERT_DELAY", 0))
+	q := `UPDATE machines SET revert_at=? WHERE mac=? AND COALESCE(boot_profile,'') <> ?`
+	if mode == "once" { q += ` AND boot_profile_once=1` }
+	if _, err := s.DB.Exec(q, at.Format(time.RFC3339), mac, getenv("BOOTAH_REVERT_PROFILE", "local")); err != nil {
+		log.Printf("schedule profile revert %s: %v", mac, err); return
+	}
+	if !at.After(time.Now()) { s.revertDueProfiles() }
+}
+
+// revertDueProfiles applies every reversion that has come due.
+func (s *Server) revertDueProfiles() {
+	target := getenv("BOOTAH_REVERT_PROFILE", "local")
+	if !s.bootProfileExists(target) { log.Printf("profile revert: BOOTAH_REVERT_PROFILE %q is neither a profile nor an entry", target); return }
+	rows, err := s.DB.Query(`SELECT mac, COALESCE(boot_profile,'') FROM machines WHERE revert_at IS NOT NULL AND revert_at <= ?`, time.Now().UTC().Format(time.RFC3339))
+	if err != nil { log.Printf("profile revert: %v", err); return }
+	type due struct{ mac, from string }
+	var list []due
+	for rows.Next() {
+		var d due
+		if rows.Scan(&d.mac, &d.from) == nil { list = append(list, d) }
+	}
+	rows.Close()
+	for _, d := range list {
+		res, err := s.DB.Exec(`UPDATE machines SET boot_profile=?, boot_profile_once=0, revert_at=NULL WHERE mac=? AND revert_at IS NOT NULL`, target, d.mac)
+		if err != nil { log.Printf("profile revert %s: %v", d.mac, err); continue }
+		if n, _ := res.RowsAffected(); n == 0 { continue }
+		s.audit(nil, "revert_profile", "machine", map[string]any{"mac": d.mac, "from": d.from, "to": target})
+		s.emit("machine.profile_reverted", map[string]any{"mac": d.mac, "from": d.from, "to": target})
+	}
+}
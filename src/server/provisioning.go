@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ---- SSO user provisioning ----
+// New OIDC users are created just-in-time with BOOTAH_OIDC_DEFAULT_ROLE
+// (viewer, operator, admin, or "pending" to hold them for approval); with
+// BOOTAH_OIDC_JIT=false only users that already exist may sign in. Pending
+// accounts cannot obtain tokens until an admin approves them.
+const rolePending = "pending"
+
+var (
+	errAccountPending = errors.New("account pending approval")
+	errNoAccount      = errors.New("no Bootah account for this user and JIT provisioning is disabled")
+)
+
+func oidcDefaultRole() string {
+	switch r := strings.ToLower(getenv("BOOTAH_OIDC_DEFAULT_ROLE", "operator")); r {
+	case "viewer", "operator", "admin", rolePending:
+		return r
+	}
+	return rolePending
+}
+
+// provisionOIDCUser returns the user for an SSO email, creating it when JIT
+// provisioning allows. The very first user always becomes admin.
+func (s *Server) provisionOIDCUser(email string) (int64, string, error) {
+	var id int64
+	var role string
+	err := s.DB.QueryRow(`SELECT id, role FROM users WHERE email=?`, email).Scan(&id, &role)
+	if err == nil {
+		if role == rolePending { return id, role, errAccountPending }
+		return id, role, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) { return 0, "", err }
+	var cnt int
+	_ = s.DB.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&cnt)
+	role = oidcDefaultRole()
+	if cnt == 0 {
+		role = "admin"
+	} else if getenv("BOOTAH_OIDC_JIT", "true") != "true" {
+		return 0, "", errNoAccount
+	}
+	// RETURNING rather than LastInsertId, which PostgreSQL drivers lack
+	err = s.DB.QueryRow(`INSERT INTO users (email, passhash, role, created_at) VALUES (?,?,?,?) RETURNING id`, email, "", role, time.Now().Format(time.RFC3339)).Scan(&id)
+	if err != nil { return 0, "", err }
+	s.audit(&id, "provision", "user", map[string]any{"email": email, "role": role, "source": "oidc"})
+	if role == rolePending {
+		s.notify("warning", "user_pending", "New SSO account "+email+" is waiting for approval", map[string]any{"user_id": id, "email": email})
+		return id, role, errAccountPending
+	}
+	s.notify("info", "user_created", "New SSO account "+email+" created with role "+role, map[string]any{"user_id": id, "email": email, "role": role})
+	return id, role, nil
+}
+
+func (s *Server) provisioningRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/users/pending", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		rows, err := s.DB.Query(`SELECT id, email, created_at FROM users WHERE role=? ORDER BY created_at`, rolePending)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		defer rows.Close()
+		out := []map[string]any{}
+		for rows.Next() {
+			var id int64
+			var email, created string
+			if err := rows.Scan(&id, &email, &created); err != nil { http.Error(w, err.Error(), 500); return }
+			out = append(out, map[string]any{"id": id, "email": email, "created_at": created})
+		}
+		writeJSON(w, 200, out)
+	})
+
+	// {"id": 12, "role": "operator"} approves; {"id": 12, "reject": true} deletes
+	s.Mux.HandleFunc("/api/v1/admin/users/approve", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		var body struct {
+			ID     int64  `json:"id"`
+			Role   string `json:"role"`
+			Reject bool   `json:"reject"`
+		}
+		if !decodeJSON(w, r, &body) { return }
+		var email string
+		if err := s.DB.QueryRow(`SELECT email FROM users WHERE id=? AND role=?`, body.ID, rolePending).Scan(&email); err != nil {
+			if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+			http.Error(w, err.Error(), 500); return
+		}
+		if body.Reject {
+			if _, err := s.DB.Exec(`DELETE FROM users WHERE id=?`, body.ID); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "reject", "user", map[string]any{"id": body.ID, "email": email})
+			writeJSON(w, 200, map[string]any{"rejected": body.ID})
+			return
+		}
+		if body.Role == "" { body.Role = "viewer" }
+		var v validator
+		if !s.roleExists(body.Role) { v.add("role", "unknown role %q", body.Role) }
+		if err := v.err(); err != nil { badRequest(w, err); return }
+		if !s.requireGrant(w, r, "", body.Role) { return }
+		if _, err := s.DB.Exec(`UPDATE users SET role=? WHERE id=?`, body.Role, body.ID); err != nil { http.Error(w, err.Error(), 500); return }
+		s.audit(s.actorID(r), "approve", "user", map[string]any{"id": body.ID, "email": email, "role": body.Role})
+		writeJSON(w, 200, map[string]any{"id": body.ID, "role": body.Role})
+	})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ---- Regional presets ----
+// A regional preset holds the locale, time zone and keyboard settings of a
+// region once, for every answer-file template to use instead of repeating
+// the same blocks: {{.Locale}} (de-DE), {{.LinuxLocale}} (de_DE.UTF-8),
+// {{.Timezone}} (IANA, Europe/Berlin), {{.WindowsTimezone}} (W. Europe
+// Standard Time), {{.InputLocale}} (0407:00000407), {{.KeyboardLayout}} (de)
+// and {{.KeyboardVariant}} (nodeadkeys). A preset is assigned to machine
+// groups and sites with PUT /api/v1/admin/regional_presets/assign; a
+// deployment uses the preset of the machine's first group that has one, else
+// that of the site its last boot came from, else BOOTAH_REGIONAL_PRESET (an
+// id or name). Without a preset the variables render empty.
+type RegionalPreset struct {
+	ID              string `json:"id"`
+	Name            string `json:"name"`
+	Locale          string `json:"locale"`
+	Timezone        string `json:"timezone"`
+	WindowsTimezone string `json:"windows_timezone,omitempty"`
+	InputLocale     string `json:"input_locale,omitempty"`
+	KeyboardLayout  string `json:"keyboard_layout,omitempty"`
+	KeyboardVariant string `json:"keyboard_variant,omitempty"`
+	Notes           string `json:"notes,omitempty"`
+	Updated         string `json:"updated"`
+}
+
+var (
+	keyboardLayoutRe  = regexp.MustCompile(`^[a-z]{2,8}$`)
+	keyboardVariantRe = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+)
+
+func initRegionalPresets(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS regional_presets (
+		id TEXT PRIMARY KEY,
+		name TEXT UNIQUE NOT NULL,
+		locale TEXT NOT NULL,
+		timezone TEXT NOT NULL,
+		windows_timezone TEXT,
+		input_locale TEXT,
+		keyboard_layout TEXT,
+		keyboard_variant TEXT,
+		notes TEXT,
+		updated TEXT NOT NULL
+	)`)
+	return err
+}
+
+func (p *RegionalPreset) validateFields(v *validator) {
+	v.required("name", p.Name)
+	if v.required("locale", p.Locale) && (!winpeLocaleRe.MatchString(p.Locale) || !strings.Contains(p.Locale, "-")) {
+		v.add("locale", "must be a language tag with a region such as de-DE")
+	}
+	if v.required("timezone", p.Timezone) {
+		if _, err := time.LoadLocation(p.Timezone); err != nil { v.add("timezone", "unknown time zone") }
+	}
+	if len(p.WindowsTimezone) > 64 || !printableLine(p.WindowsTimezone) { v.add("windows_timezone", "must be a single line of at most 64 characters") }
+	if p.InputLocale != "" && !winpeKeyboardRe.MatchString(p.InputLocale) { v.add("input_locale", "must look like 0407:00000407") }
+	if p.KeyboardLayout != "" && !keyboardLayoutRe.MatchString(p.KeyboardLayout) { v.add("keyboard_layout", "must be an XKB layout such as de") }
+	if p.KeyboardVariant != "" && !keyboardVariantRe.MatchString(p.KeyboardVariant) { v.add("keyboard_variant", "must be an XKB variant such as nodeadkeys") }
+}
+
+// linuxLocale turns a language tag into a glibc locale: de-DE -> de_DE.UTF-8.
+func linuxLocale(tag string) string {
+	if tag == "" { return "" }
+	parts := strings.Split(tag, "-")
+	out := strings.ToLower(parts[0])
+	if len(parts) > 1 { out += "_" + strings.ToUpper(parts[len(parts)-1]) }
+	return out + ".UTF-8"
+}
+
+// addTemplateVars adds the preset's answer-file variables to vars; a nil
+// preset sets them empty.
+func (p *RegionalPreset) addTemplateVars(vars map[string]string) {
+	if p == nil { p = &RegionalPreset{} }
+	vars["Locale"], vars["LinuxLocale"], vars["Timezone"], vars["WindowsTimezone"] = p.Locale, linuxLocale(p.Locale), p.Timezone, p.WindowsTimezone
+	vars["InputLocale"], vars["KeyboardLayout"], vars["KeyboardVariant"] = p.InputLocale, p.KeyboardLayout, p.KeyboardVariant
+}
+
+const regionalPresetColumns = `id, name, locale, timezone, COALESCE(windows_timezone,''), COALESCE(input_locale,''), COALESCE(keyboard_layout,''), COALESCE(keyboard_variant,''), COALESCE(notes,''), updated FROM regional_presets`
+
+func scanRegionalPreset(row interface{ Scan(...any) error }) (*RegionalPreset, error) {
+	var p RegionalPreset
+	if err := row.Scan(&p.ID, &p.Name, &p.Locale, &p.Timezone, &p.WindowsTimezone, &p.InputLocale, &p.KeyboardLayout, &p.KeyboardVariant, &p.Notes, &p.Updated); err != nil { return nil, err }
+	return &p, nil
+}
+
+// regionalPresetFor resolves the preset for mac, or nil when none applies.
+func (s *Server) regionalPresetFor(mac string) (*RegionalPreset, error) {
+	var id string
+	ids, err := s.groupsForMachine(mac)
+	if err != nil { return nil, err }
+	for _, g := range ids {
+		if s.DB.QueryRow(`SELECT COALESCE(regional_preset_id,'') FROM machine_groups WHERE id=?`, g).Scan(&id) == nil && id != "" { break }
+	}
+	if id == "" {
+		var ip string
+		_ = s.DB.QueryRow(`SELECT COALESCE(last_boot_ip,'') FROM machines WHERE mac=?`, mac).Scan(&ip)
+		site, err := s.siteForIP(net.ParseIP(ip))
+		if err != nil { return nil, err }
+		if site != nil { _ = s.DB.QueryRow(`SELECT COALESCE(regional_preset_id,'') FROM sites WHERE id=?`, site.ID).Scan(&id) }
+	}
+	if id == "" { id = getenv("BOOTAH_REGIONAL_PRESET", "") }
+	if id == "" { return nil, nil }
+	p, err := scanRegionalPreset(s.DB.QueryRow(`SELECT `+regionalPresetColumns+` WHERE id=? OR name=?`, id, id))
+	if errors.Is(err, sql.ErrNoRows) { return nil, nil }
+	return p, err
+}
+
+func (s *Server) regionalPresetRoutes() {
+	// GET lists presets; POST {name, locale, timezone, windows_timezone?,
+	// input_locale?, keyboard_layout?, keyboard_variant?, notes?} creates one
+	s.Mux.HandleFunc("/api/v1/admin/regional_presets", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := s.DB.Query(`SELECT ` + regionalPresetColumns + ` ORDER BY name`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			out := []*RegionalPreset{}
+			for rows.Next() {
+				p, err := scanRegionalPreset(rows)
+				if err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, p)
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPost:
+			var p RegionalPreset
+			if !decodeJSON(w, r, &p) { return }
+			p.ID, p.Updated = "rp-"+genID(), time.Now().UTC().Format(time.RFC3339)
+			_, err := s.DB.Exec(`INSERT INTO regional_presets (id, name, locale, timezone, windows_timezone, input_locale, keyboard_layout, keyboard_variant, notes, updated)
+				VALUES (?,?,?,?,NULLIF(?,''),NULLIF(?,''),NULLIF(?,''),NULLIF(?,''),NULLIF(?,''),?)`,
+				p.ID, p.Name, p.Locale, p.Timezone, p.WindowsTimezone, p.InputLocale, p.KeyboardLayout, p.KeyboardVariant, p.Notes, p.Updated)
+			if err != nil { http.Error(w, err.Error(), 409); return }
+			s.audit(s.actorID(r), "create", "regional_preset", map[string]any{"id": p.ID, "name": p.Name})
+			writeJSON(w, 201, p)
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// Assign a preset to a site or group: {"regional_preset_id": "", "site_id"|"group_id": ""};
+	// an empty regional_preset_id clears the assignment
+	s.Mux.HandleFunc("/api/v1/admin/regional_presets/assign", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+			out := []map[string]any{}
+			rows, err := s.DB.Query(`SELECT 'site', id, name, regional_preset_id FROM sites WHERE COALESCE(regional_preset_id,'')<>''
+				UNION ALL SELECT 'group', id, name, regional_preset_id FROM machine_groups WHERE COALESCE(regional_preset_id,'')<>''`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			for rows.Next() {
+				var scope, target, name, preset string
+				if err := rows.Scan(&scope, &target, &name, &preset); err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, map[string]any{"scope": scope, "target": target, "name": name, "regional_preset_id": preset})
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPut:
+			var body struct {
+				PresetID string `json:"regional_preset_id"`
+				SiteID   string `json:"site_id"`
+				GroupID  string `json:"group_id"`
+			}
+			if !decodeJSON(w, r, &body) { return }
+			if (body.SiteID == "") == (body.GroupID == "") { http.Error(w, "give exactly one of site_id or group_id", 400); return }
+			if body.PresetID != "" {
+				var n int
+				_ = s.DB.QueryRow(`SELECT COUNT(*) FROM regional_presets WHERE id=?`, body.PresetID).Scan(&n)
+				if n == 0 { http.Error(w, "unknown regional preset", 400); return }
+			}
+			var res sql.Result
+			var err error
+			if body.SiteID != "" {
+				res, err = s.DB.Exec(`UPDATE sites SET regional_preset_id=NULLIF(?,'') WHERE id=?`, body.PresetID, body.SiteID)
+			} else {
+				res, err = s.DB.Exec(`UPDATE machine_groups SET regional_preset_id=NULLIF(?,'') WHERE id=?`, body.PresetID, body.GroupID)
+			}
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			if n, _ := res.RowsAffected(); n == 0 { http.NotFound(w, r); return }
+			s.audit(s.actorID(r), "assign", "regional_preset", map[string]any{"id": body.PresetID, "site_id": body.SiteID, "group_id": body.GroupID})
+			writeJSON(w, 200, map[string]any{"regional_preset_id": body.PresetID, "site_id": body.SiteID, "group_id": body.GroupID})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// /api/v1/admin/regional_presets/{id}: GET, PUT (replace), DELETE (refused
+	// while assigned)
+	s.Mux.HandleFunc("/api/v1/admin/regional_presets/", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		id := strings.TrimPrefix(r.URL.Path, "/api/v1/admin/regional_presets/")
+		p, err := scanRegionalPreset(s.DB.QueryRow(`SELECT `+regionalPresetColumns+` WHERE id=?`, id))
+		if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, 200, p)
+		case http.MethodPut:
+			var body RegionalPreset
+			if !decodeJSON(w, r, &body) { return }
+			body.ID, body.Updated = p.ID, time.Now().UTC().Format(time.RFC3339)
+			_, err := s.DB.Exec(`UPDATE regional_presets SET name=?, locale=?, timezone=?, windows_timezone=NULLIF(?,''), input_locale=NULLIF(?,''),
+				keyboard_layout=NULLIF(?,''), keyboard_variant=NULLIF(?,''), notes=NULLIF(?,''), updated=? WHERE id=?`,
+				body.Name, body.Locale, body.Timezone, body.WindowsTimezone, body.InputLocale, body.KeyboardLayout, body.KeyboardVariant, body.Notes, body.Updated, p.ID)
+			if err != nil { http.Error(w, err.Error(), 409); return }
+			s.audit(s.actorID(r), "update", "regional_preset", map[string]any{"id": p.ID, "name": body.Name})
+			writeJSON(w, 200, body)
+		case http.MethodDelete:
+			var n int
+			_ = s.DB.QueryRow(`SELECT (SELECT COUNT(*) FROM sites WHERE regional_preset_id=?) + (SELECT COUNT(*) FROM machine_groups WHERE regional_preset_id=?)`, p.ID, p.ID).Scan(&n)
+			if n > 0 { http.Error(w, "regional preset is assigned to sites or groups", 409); return }
+			if _, err := s.DB.Exec(`DELETE FROM regional_presets WHERE id=?`, p.ID); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "delete", "regional_preset", map[string]any{"id": p.ID, "name": p.Name})
+			writeJSON(w, 200, map[string]any{"deleted": p.ID})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ---- Edge relays ----
+// A relay (cmd/relay) sits on a remote subnet, caches boot assets and TFTP
+// files, serves them locally and proxies boot-script and agent requests back
+// here. An admin creates the relay and hands its one-time registration token
+// to the relay, which exchanges it for a long-lived key (stored hashed) and
+// then heartbeats with cache statistics. The relay's own cache fills, marked
+// X-Bootah-Relay-Sync, need no download token; before serving a cached asset
+// to a client it asks /api/v1/relay/authorize whether that client's token
+// would pass here.
+const relayOfflineAfter = 3 * time.Minute
+
+func initRelays(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS relays (
+		id TEXT PRIMARY KEY,
+		name TEXT UNIQUE NOT NULL,
+		site_id TEXT,
+		registration_hash TEXT,
+		key_hash TEXT UNIQUE,
+		version TEXT,
+		addr TEXT,
+		stats TEXT,
+		last_seen TEXT,
+		created_at TEXT NOT NULL
+	)`)
+	return err
+}
+
+// requireRelay authenticates a relay by its X-Bootah-Relay-Key header.
+func (s *Server) requireRelay(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id, ok := s.relayForKey(r.Header.Get("X-Bootah-Relay-Key"))
+	if !ok { http.Error(w, "invalid relay key", 401) }
+	return id, ok
+}
+
+// relaySync reports whether r is a relay filling its cache rather than a
+// client request it forwards, whose sync header the relay strips.
+func (s *Server) relaySync(r *http.Request) bool {
+	if r.Header.Get("X-Bootah-Relay-Sync") == "" { return false }
+	_, ok := s.relayForKey(r.Header.Get("X-Bootah-Relay-Key"))
+	return ok
+}
+
+func (s *Server) relayForKey(key string) (string, bool) {
+	if key == "" { return "", false }
+	var id string
+	if err := s.DB.QueryRow(`SELECT id FROM relays WHERE key_hash=?`, hashToken(key)).Scan(&id); err != nil { return "", false }
+	return id, true
+}
+
+// relayForwarding lets relays pass the original client address: requests
+// carrying a valid relay key have RemoteAddr replaced by X-Forwarded-For, so
+// site selection and IP-bound download tokens see the real client.
+func (s *Server) relayForwarding(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := r.Header.Get("X-Bootah-Relay-Key"); key != "" {
+			if _, ok := s.relayForKey(key); ok {
+				if ip := net.ParseIP(strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-For"), ",")[0])); ip != nil {
+					r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type relayFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// relayManifest lists everything a relay should cache: the /assets tree
+// (managed boot assets, under the versioned paths menus link, win over web
+// root files) and the TFTP boot files.
+func (s *Server) relayManifest() (map[string][]relayFile, error) {
+	out := map[string][]relayFile{"assets": {}, "tftp": {}}
+	walk := func(root, prefix, section string) error {
+		return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+			if err != nil { if os.IsNotExist(err) { return nil }; return err }
+			if fi.IsDir() || strings.HasSuffix(p, ".sha256") { return nil }
+			rel, _ := filepath.Rel(root, p)
+			sum, err := assetChecksum(p)
+			if err != nil { return err }
+			out[section] = append(out[section], relayFile{Path: path.Join(prefix, filepath.ToSlash(rel)), Size: fi.Size(), SHA256: sum})
+			return nil
+		})
+	}
+	if err := walk(filepath.Join(s.WebRoot, "assets"), "/assets", "assets"); err != nil { return nil, err }
+	managed, err := s.listBootAssets("")
+	if err != nil { return nil, err }
+	seen := map[string]int{}
+	for i, f := range out["assets"] { seen[f.Path] = i }
+	for _, a := range managed {
+		f := relayFile{Path: a.VersionURL, Size: a.Size, SHA256: a.SHA256}
+		if i, ok := seen[a.URL]; ok { out["assets"][i] = f } else { out["assets"] = append(out["assets"], f) }
+	}
+	if err := walk(getenv("BOOTAH_TFTP_ROOT", "./tftp"), "", "tftp"); err != nil { return nil, err }
+	return out, nil
+}
+
+func (s *Server) relayRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/relays", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := s.DB.Query(`SELECT id, name, COALESCE(site_id,''), COALESCE(version,''), COALESCE(addr,''), COALESCE(stats,''), COALESCE(last_seen,''), key_hash IS NOT NULL, created_at FROM relays ORDER BY name`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			out := []map[string]any{}
+			for rows.Next() {
+				var id, name, site, version, addr, stats, seen, created string
+				var registered bool
+				if err := rows.Scan(&id, &name, &site, &version, &addr, &stats, &seen, &registered, &created); err != nil { http.Error(w, err.Error(), 500); return }
+				status := "pending"
+				if registered {
+					status = "offline"
+					if t, err := time.Parse(time.RFC3339, seen); err == nil && time.Since(t) < relayOfflineAfter { status = "online" }
+				}
+				m := map[string]any{"id": id, "name": name, "site_id": site, "version": version, "addr": addr, "last_seen": seen, "status": status, "created_at": created}
+				if stats != "" { m["stats"] = json.RawMessage(stats) }
+				out = append(out, m)
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPost:
+			var body struct {
+				Name   string `json:"name"`
+				SiteID string `json:"site_id"`
+			}
+			if !decodeJSON(w, r, &body) { return }
+			if strings.TrimSpace(body.Name) == "" { http.Error(w, "name required", 400); return }
+			id, token := "relay-"+genID(), randToken(24)
+			_, err := s.DB.Exec(`INSERT INTO relays (id, name, site_id, registration_hash, created_at) VALUES (?,?,?,?,?)`,
+				id, strings.TrimSpace(body.Name), body.SiteID, hashToken(token), time.Now().UTC().Format(time.RFC3339))
+			if err != nil { http.Error(w, err.Error(), 400); return }
+			s.audit(s.actorID(r), "create", "relay", map[string]any{"id": id, "name": body.Name})
+			writeJSON(w, 201, map[string]any{"id": id, "registration_token": token})
+		case http.MethodDelete:
+			id := r.URL.Query().Get("id")
+			res, err := s.DB.Exec(`DELETE FROM relays WHERE id=?`, id)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			if n, _ := res.RowsAffected(); n == 0 { http.NotFound(w, r); return }
+			s.audit(s.actorID(r), "delete", "relay", map[string]any{"id": id})
+			writeJSON(w, 200, map[string]any{"deleted": id})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// Relay: exchange the registration token for a relay key
+	s.Mux.HandleFunc("/api/v1/relay/register", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		var body struct {
+			Token   string `json:"token"`
+			Version string `json:"version"`
+		}
+		if !decodeJSON(w, r, &body) { return }
+		var id string
+		if err := s.DB.QueryRow(`SELECT id FROM relays WHERE registration_hash=?`, hashToken(body.Token)).Scan(&id); err != nil || body.Token == "" {
+			http.Error(w, "invalid registration token", 401); return
+		}
+		key := randToken(32)
+		_, err := s.DB.Exec(`UPDATE relays SET key_hash=?, registration_hash=NULL, version=?, addr=?, last_seen=? WHERE id=?`,
+			hashToken(key), body.Version, clientIP(r).String(), time.Now().UTC().Format(time.RFC3339), id)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		s.audit(nil, "register", "relay", map[string]any{"id": id, "addr": clientIP(r).String()})
+		writeJSON(w, 200, map[string]any{"id": id, "key": key})
+	})
+
+	s.Mux.HandleFunc("/api/v1/relay/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		id, ok := s.requireRelay(w, r)
+		if !ok { return }
+		var body struct {
+			Version string          `json:"version"`
+			Stats   json.RawMessage `json:"stats"`
+		}
+		if !decodeJSON(w, r, &body) { return }
+		_, err := s.DB.Exec(`UPDATE relays SET version=?, addr=?, stats=?, last_seen=? WHERE id=?`,
+			body.Version, clientIP(r).String(), string(body.Stats), time.Now().UTC().Format(time.RFC3339), id)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		writeJSON(w, 200, map[string]any{"ok": true})
+	})
+
+	s.Mux.HandleFunc("/api/v1/relay/manifest", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		if _, ok := s.requireRelay(w, r); !ok { return }
+		m, err := s.relayManifest()
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		writeJSON(w, 200, m)
+	})
+
+	// Relay: 204 when the client in X-Forwarded-For may download the cached
+	// ?path= with ?dt=, by the same check this server makes for /assets
+	s.Mux.HandleFunc("/api/v1/relay/authorize", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		if _, ok := s.requireRelay(w, r); !ok { return }
+		p := path.Clean("/" + r.URL.Query().Get("path"))
+		if !strings.HasPrefix(p, "/assets/") { http.Error(w, "path must be under /assets/", 400); return }
+		req := r.Clone(r.Context())
+		req.Header.Del("X-Bootah-Relay-Sync")
+		req.URL.Path = p
+		q := url.Values{}
+		if dt := r.URL.Query().Get("dt"); dt != "" { q.Set("dt", dt) }
+		req.URL.RawQuery = q.Encode()
+		if !s.checkDownloadToken(w, req) { return }
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// TFTP boot files are not under the web root, so relays fetch them here
+	s.Mux.HandleFunc("/api/v1/relay/tftp/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		if _, ok := s.requireRelay(w, r); !ok { return }
+		rel := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/api/v1/relay/tftp/"))
+		longTransfer(w)
+		http.ServeFile(w, r, filepath.Join(getenv("BOOTAH_TFTP_ROOT", "./tftp"), filepath.FromSlash(rel)))
+	})
+}
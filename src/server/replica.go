@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---- Read-only replica mode ----
+// BOOTAH_MODE=replica runs an instance that only serves boot and download
+// traffic: the database is opened read-only (it is expected to be a replica
+// of the primary's, at the same schema version), the management API is not
+// reachable and nothing is written. With BOOTAH_REPLICA_CACHE_DIR set, blobs
+// from remote storage are fetched once and served from the local cache.
+func replicaMode() bool { return strings.ToLower(getenv("BOOTAH_MODE", "")) == "replica" }
+
+var errReadOnly = errors.New("read-only replica")
+
+// replicaPaths are the GET/HEAD routes a replica answers.
+var replicaPaths = []string{"/ipxe/", "/assets/", "/api/health", "/api/v1/health", "/api/v1/catalog/", "/metrics"}
+
+func replicaAllowed(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead { return false }
+	p := r.URL.Path
+	for _, prefix := range replicaPaths {
+		if strings.HasPrefix(p, prefix) { return true }
+	}
+	if p == "/api/v1/images" { return true }
+	if rest, ok := strings.CutPrefix(p, "/api/v1/images/"); ok {
+		parts := strings.Split(rest, "/")
+		return len(parts) == 2 && (parts[1] == "download" || parts[1] == "checksum")
+	}
+	return false
+}
+
+func replicaMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !replicaAllowed(r) { http.Error(w, "not available on a read-only replica", http.StatusForbidden); return }
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CachingStorage is a read-only Storage that serves objects from a local
+// cache directory, filling it from the underlying store on first access.
+type CachingStorage struct {
+	Inner Storage
+	Dir   string
+
+	mu       sync.Mutex
+	fetching map[string]*sync.Mutex
+}
+
+func (c *CachingStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error { return errReadOnly }
+func (c *CachingStorage) Delete(ctx context.Context, key string) error                      { return errReadOnly }
+func (c *CachingStorage) Presign(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return c.Inner.Presign(ctx, key, expiry)
+}
+
+func (c *CachingStorage) path(key string) string { return filepath.Join(c.Dir, filepath.FromSlash(filepath.Clean("/"+key))) }
+
+// LocalPath returns the cached copy of key, fetching it first if needed.
+func (c *CachingStorage) LocalPath(key string) (string, bool) {
+	if p, ok := c.Inner.LocalPath(key); ok { return p, true }
+	p := c.path(key)
+	if _, err := os.Stat(p); err == nil { return p, true }
+	c.mu.Lock()
+	if c.fetching == nil { c.fetching = map[string]*sync.Mutex{} }
+	l, ok := c.fetching[key]
+	if !ok { l = &sync.Mutex{}; c.fetching[key] = l }
+	c.mu.Unlock()
+	l.Lock()
+	defer l.Unlock()
+	if _, err := os.Stat(p); err == nil { return p, true }
+	if err := c.fetch(key, p); err != nil { log.Printf("replica cache %s: %v", key, err); return "", false }
+	return p, true
+}
+
+func (c *CachingStorage) fetch(key, p string) error {
+	rc, err := c.Inner.Open(context.Background(), key)
+	if err != nil { return err }
+	defer rc.Close()
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil { return err }
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".fetch-*")
+	if err != nil { return err }
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, rc); err != nil { tmp.Close(); return err }
+	if err := tmp.Close(); err != nil { return err }
+	return os.Rename(tmp.Name(), p)
+}
+
+func (c *CachingStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	if p, ok := c.LocalPath(key); ok { return os.Open(p) }
+	return c.Inner.Open(ctx, key)
+}
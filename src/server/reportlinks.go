@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---- Report share links ----
+// Expiring read-only links that let an auditor without a Bootah account see
+// one report: an audit log extract (kind "audit": audit_type?, from?, to?; to
+// defaults to the moment the link is created, so later events are never
+// exposed), one deployment with its checks, task runs and audit trail (kind
+// "deployment": deployment_id), or the deployment SLO report (kind
+// "deployments": days?, slo_minutes?). Creating, listing and revoking a link
+// needs the same access as the report itself (/api/v1/admin/report_links).
+// Links last ttl (default 72h, at most BOOTAH_REPORT_LINK_MAX_TTL, default
+// 720h) and max_views views when set. Only the token hash is stored; every
+// view, and every refused use of a known token, is audited with the
+// client's IP. Guests read the report at GET /api/v1/shared/{token}.
+type reportLinkParams struct {
+	AuditType    string `json:"audit_type,omitempty"`
+	From         string `json:"from,omitempty"`
+	To           string `json:"to,omitempty"`
+	DeploymentID string `json:"deployment_id,omitempty"`
+	Days         int    `json:"days,omitempty"`
+	SLOMinutes   int    `json:"slo_minutes,omitempty"`
+}
+
+// reportLinkKinds names, per kind, the route whose access sharing it needs.
+var reportLinkKinds = map[string]struct{ Path, Level string }{
+	"audit":       {"/api/v1/admin/audit", "admin"},
+	"deployment":  {"/api/v1/admin/deployments", "operator"},
+	"deployments": {"/api/v1/admin/reports/deployments", "operator"},
+}
+
+func initReportLinks(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS report_links (
+		id TEXT PRIMARY KEY,
+		token_hash TEXT UNIQUE NOT NULL,
+		kind TEXT NOT NULL,
+		params TEXT NOT NULL,
+		note TEXT,
+		max_views INTEGER NOT NULL DEFAULT 0,
+		views INTEGER NOT NULL DEFAULT 0,
+		last_viewed_at TEXT,
+		expires_at TEXT NOT NULL,
+		revoked INTEGER NOT NULL DEFAULT 0,
+		created_by INTEGER,
+		created_at TEXT NOT NULL
+	)`)
+	return err
+}
+
+type reportLink struct {
+	ID        string
+	Kind      string
+	Params    reportLinkParams
+	Note      string
+	MaxViews  int
+	Views     int
+	ExpiresAt time.Time
+	Revoked   bool
+	CreatedAt string
+}
+
+func (s *Server) reportLinkByToken(token string) (*reportLink, error) {
+	var l reportLink
+	var params, exp string
+	var revoked int
+	err := s.DB.QueryRow(`SELECT id, kind, params, COALESCE(note,''), max_views, views, expires_at, revoked, created_at FROM report_links WHERE token_hash=?`, hashToken(token)).
+		Scan(&l.ID, &l.Kind, &params, &l.Note, &l.MaxViews, &l.Views, &exp, &revoked, &l.CreatedAt)
+	if err != nil { return nil, err }
+	_ = json.Unmarshal([]byte(params), &l.Params)
+	l.ExpiresAt, _ = time.Parse(time.RFC3339, exp)
+	l.Revoked = revoked == 1
+	return &l, nil
+}
+
+// normalizeTime turns an RFC 3339 timestamp or a date into the local RFC 3339
+// form audit timestamps are stored in.
+func normalizeTime(v string, endOfDay bool) (string, bool) {
+	if v == "" { return "", true }
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		if t, err = time.ParseInLocation("2006-01-02", v, time.Local); err != nil { return "", false }
+		if endOfDay { t = t.Add(24*time.Hour - time.Second) }
+	}
+	return t.Local().Format(time.RFC3339), true
+}
+
+// renderReport builds the report a link shares.
+func (s *Server) renderReport(kind string, p reportLinkParams) (any, error) {
+	switch kind {
+	case "audit":
+		out, err := s.auditEntries(p.AuditType, p.From, p.To, 5000)
+		if out == nil { out = []map[string]any{} }
+		return map[string]any{"audit_type": p.AuditType, "from": p.From, "to": p.To, "entries": out}, err
+	case "deployment":
+		return s.deploymentReport(p.DeploymentID)
+	default:
+		return s.deploymentSLOReport(p.Days, p.SLOMinutes)
+	}
+}
+
+// deploymentReport is one deployment without its credentials, with its
+// validation checks, task runs and audit trail.
+func (s *Server) deploymentReport(id string) (map[string]any, error) {
+	var mac, hostname, image, tpl, seq, status, cause, started, finished, created string
+	err := s.DB.QueryRow(`SELECT mac, COALESCE(hostname,''), COALESCE(image_id,''), COALESCE(template_id,''), COALESCE(task_sequence_id,''), status, COALESCE(error,''), COALESCE(started_at,''), COALESCE(finished_at,''), created_at FROM deployments WHERE id=?`, id).
+		Scan(&mac, &hostname, &image, &tpl, &seq, &status, &cause, &started, &finished, &created)
+	if err != nil { return nil, err }
+	out := map[string]any{"id": id, "mac": mac, "hostname": hostname, "image_id": image, "template_id": tpl, "task_sequence_id": seq,
+		"status": status, "error": cause, "started_at": started, "finished_at": finished, "created_at": created}
+	checks := []map[string]any{}
+	rows, err := s.DB.Query(`SELECT name, passed, COALESCE(detail,''), reported_at FROM deployment_checks WHERE deployment_id=? ORDER BY name`, id)
+	if err != nil { return nil, err }
+	for rows.Next() {
+		var name, detail, at string
+		var passed int
+		if err := rows.Scan(&name, &passed, &detail, &at); err != nil { rows.Close(); return nil, err }
+		checks = append(checks, map[string]any{"name": name, "passed": passed == 1, "detail": detail, "reported_at": at})
+	}
+	rows.Close()
+	runs := []map[string]any{}
+	rows, err = s.DB.Query(`SELECT id, sequence_id, step, status, COALESCE(error,''), started_at, updated_at FROM task_runs WHERE deployment_id=? ORDER BY started_at`, id)
+	if err != nil { return nil, err }
+	for rows.Next() {
+		var rid, sid, st, e, at, up string
+		var step int
+		if err := rows.Scan(&rid, &sid, &step, &st, &e, &at, &up); err != nil { rows.Close(); return nil, err }
+		runs = append(runs, map[string]any{"id": rid, "sequence_id": sid, "step": step, "status": st, "error": e, "started_at": at, "updated_at": up})
+	}
+	rows.Close()
+	trail := []map[string]any{}
+	rows, err = s.DB.Query(`SELECT ts, action, resource, COALESCE(event_type, resource||'.'||action), meta FROM audit WHERE meta LIKE ? ORDER BY id`, `%"`+id+`"%`)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	for rows.Next() {
+		var ts, action, resource, typ, meta string
+		if err := rows.Scan(&ts, &action, &resource, &typ, &meta); err != nil { return nil, err }
+		var data any
+		_ = json.Unmarshal([]byte(meta), &data)
+		trail = append(trail, map[string]any{"ts": ts, "type": typ, "data": data})
+	}
+	out["checks"], out["task_runs"], out["audit"] = checks, runs, trail
+	return out, rows.Err()
+}
+
+func (s *Server) reportLinkRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/report_links", func(w http.ResponseWriter, r *http.Request) {
+		_, claims, err := s.verifyAuth(r)
+		if err != nil { http.Error(w, "unauthorized", 401); return }
+		// reports span sites
+		if s.claimsSites(claims) != nil { http.Error(w, "forbidden: site admins can't share reports", 403); return }
+		mayShare := func(kind string) bool {
+			k, ok := reportLinkKinds[kind]
+			return ok && s.claimsAllow(claims, k.Path, k.Level)
+		}
+		switch r.Method {
+		case http.MethodGet:
+			// links of the kinds the caller may share
+			rows, err := s.DB.Query(`SELECT id, kind, params, COALESCE(note,''), max_views, views, COALESCE(last_viewed_at,''), expires_at, revoked, COALESCE(created_by,0), created_at FROM report_links ORDER BY created_at DESC LIMIT 200`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			out := []map[string]any{}
+			for rows.Next() {
+				var id, kind, params, note, viewed, exp, created string
+				var maxViews, views, revoked int
+				var by int64
+				if err := rows.Scan(&id, &kind, &params, &note, &maxViews, &views, &viewed, &exp, &revoked, &by, &created); err != nil { http.Error(w, err.Error(), 500); return }
+				if !mayShare(kind) { continue }
+				out = append(out, map[string]any{"id": id, "kind": kind, "params": json.RawMessage(params), "note": note, "max_views": maxViews, "views": views,
+					"last_viewed_at": viewed, "expires_at": exp, "revoked": revoked == 1, "created_by": by, "created_at": created})
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPost:
+			var body struct {
+				reportLinkParams
+				Kind     string `json:"kind"`
+				Note     string `json:"note"`
+				TTL      string `json:"ttl"`
+				MaxViews int    `json:"max_views"`
+			}
+			if !decodeJSON(w, r, &body) { return }
+			if _, ok := reportLinkKinds[body.Kind]; !ok { http.Error(w, "kind must be audit, deployment or deployments", 400); return }
+			if !mayShare(body.Kind) { http.Error(w, "forbidden: you can't read this report", 403); return }
+			p, now := body.reportLinkParams, time.Now()
+			switch body.Kind {
+			case "audit":
+				var ok1, ok2 bool
+				p.From, ok1 = normalizeTime(p.From, false)
+				p.To, ok2 = normalizeTime(p.To, true)
+				if !ok1 || !ok2 { http.Error(w, "from and to must be RFC 3339 timestamps or dates", 400); return }
+				if p.To == "" || p.To > now.Format(time.RFC3339) { p.To = now.Format(time.RFC3339) }
+				p = reportLinkParams{AuditType: p.AuditType, From: p.From, To: p.To}
+			case "deployment":
+				var n int
+				_ = s.DB.QueryRow(`SELECT COUNT(*) FROM deployments WHERE id=?`, p.DeploymentID).Scan(&n)
+				if n == 0 { http.Error(w, "unknown deployment", 400); return }
+				p = reportLinkParams{DeploymentID: p.DeploymentID}
+			case "deployments":
+				if p.Days <= 0 { p.Days = 30 }
+				if p.SLOMinutes <= 0 { p.SLOMinutes, _ = strconv.Atoi(getenv("BOOTAH_DEPLOY_SLO_MINUTES", "45")) }
+				p = reportLinkParams{Days: p.Days, SLOMinutes: p.SLOMinutes}
+			}
+			if body.TTL == "" { body.TTL = "72h" }
+			ttl, err := time.ParseDuration(body.TTL)
+			max := envDuration("BOOTAH_REPORT_LINK_MAX_TTL", 720*time.Hour)
+			if err != nil || ttl <= 0 || ttl > max { http.Error(w, "ttl must be a duration up to "+max.String(), 400); return }
+			if body.MaxViews < 0 { http.Error(w, "max_views must not be negative", 400); return }
+			actor := s.actorID(r)
+			var createdBy any
+			if actor != nil { createdBy = *actor }
+			id, token := "rl-"+genID(), randToken(24)
+			exp := now.Add(ttl).UTC().Format(time.RFC3339)
+			params, _ := json.Marshal(p)
+			_, err = s.DB.Exec(`INSERT INTO report_links (id, token_hash, kind, params, note, max_views, expires_at, created_by, created_at) VALUES (?,?,?,?,?,?,?,?,?)`,
+				id, hashToken(token), body.Kind, string(params), body.Note, body.MaxViews, exp, createdBy, now.UTC().Format(time.RFC3339))
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(actor, "create", "report_link", map[string]any{"id": id, "kind": body.Kind, "params": p, "expires_at": exp, "max_views": body.MaxViews})
+			writeJSON(w, 201, map[string]any{"id": id, "token": token, "url": catalogBaseURL(r) + "/api/v1/shared/" + token, "params": p, "expires_at": exp})
+		case http.MethodDelete:
+			id := r.URL.Query().Get("id")
+			var kind string
+			if err := s.DB.QueryRow(`SELECT kind FROM report_links WHERE id=?`, id).Scan(&kind); err != nil { http.NotFound(w, r); return }
+			if !mayShare(kind) { http.Error(w, "forbidden", 403); return }
+			if _, err := s.DB.Exec(`UPDATE report_links SET revoked=1 WHERE id=?`, id); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "revoke", "report_link", map[string]any{"id": id})
+			writeJSON(w, 200, map[string]any{"revoked": id})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// Guest side: no account, the token is the credential
+	s.Mux.HandleFunc("/api/v1/shared/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		w.Header().Set("X-Robots-Tag", "noindex")
+		l, err := s.reportLinkByToken(strings.TrimPrefix(r.URL.Path, "/api/v1/shared/"))
+		if err != nil { http.Error(w, "link invalid or expired", 403); return }
+		ip := ""
+		if c := clientIP(r); c != nil { ip = c.String() }
+		deny := func(reason string) {
+			s.audit(nil, "view_denied", "report_link", map[string]any{"id": l.ID, "reason": reason, "ip": ip})
+			http.Error(w, "link invalid or expired", 403)
+		}
+		if l.Revoked { deny("revoked"); return }
+		if time.Now().After(l.ExpiresAt) { deny("expired"); return }
+		res, err := s.DB.Exec(`UPDATE report_links SET views=views+1, last_viewed_at=? WHERE id=? AND (max_views=0 OR views<max_views)`, time.Now().UTC().Format(time.RFC3339), l.ID)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if n, _ := res.RowsAffected(); n == 0 { deny("max_views"); return }
+		report, err := s.renderReport(l.Kind, l.Params)
+		if err == sql.ErrNoRows { http.NotFound(w, r); return }
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		s.audit(nil, "view", "report_link", map[string]any{"id": l.ID, "kind": l.Kind, "ip": ip})
+		writeJSON(w, 200, map[string]any{"kind": l.Kind, "note": l.Note, "shared_at": l.CreatedAt, "expires_at": l.ExpiresAt.Format(time.RFC3339),
+			"generated_at": time.Now().UTC().Format(time.RFC3339), "report": report})
+	})
+}
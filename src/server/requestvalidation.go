@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+// ---- Request validation ----
+// decodeJSON reads every JSON request body. Malformed JSON, an empty body and
+// values of the wrong type are answered with 400 validation_failed and the
+// offending fields, e.g.
+// {"error": {"code": "validation_failed", "fields": [{"field": "role", "message": "..."}]}}.
+// Bodies whose type has a validateFields method are checked with it before
+// the handler sees them; handlers with anonymous bodies build a validator
+// themselves and answer with badRequest.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type validationError []fieldError
+
+func (e validationError) Error() string {
+	parts := make([]string, len(e))
+	for i, f := range e {
+		parts[i] = f.Message
+		if f.Field != "" { parts[i] = f.Field + ": " + f.Message }
+	}
+	return strings.Join(parts, "; ")
+}
+
+// fieldValidator is implemented by request bodies that check themselves.
+type fieldValidator interface{ validateFields(v *validator) }
+
+type validator struct{ errs validationError }
+
+func (v *validator) add(field, format string, args ...any) {
+	v.errs = append(v.errs, fieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) err() error {
+	if len(v.errs) == 0 { return nil }
+	return v.errs
+}
+
+func (v *validator) required(field, val string) bool {
+	if strings.TrimSpace(val) == "" { v.add(field, "is required"); return false }
+	return true
+}
+
+func (v *validator) maxLen(field, val string, n int) {
+	if len(val) > n { v.add(field, "must be at most %d characters", n) }
+}
+
+func (v *validator) oneOf(field, val string, allowed ...string) {
+	for _, a := range allowed {
+		if val == a { return }
+	}
+	v.add(field, "must be one of %s", strings.Join(allowed, ", "))
+}
+
+func (v *validator) email(field, val string) {
+	if !v.required(field, val) { return }
+	if a, err := mail.ParseAddress(val); err != nil || a.Address != val { v.add(field, "must be a plain email address") }
+}
+
+// password checks a new password: bcrypt ignores anything past 72 bytes.
+func (v *validator) password(field, val string) {
+	if !v.required(field, val) { return }
+	if len(val) < 8 { v.add(field, "must be at least 8 characters") }
+	if len(val) > 72 { v.add(field, "must be at most 72 bytes") }
+}
+
+// url checks an optional absolute http(s) URL.
+func (v *validator) url(field, val string) {
+	if val == "" { return }
+	u, err := url.Parse(val)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" { v.add(field, "must be an absolute http or https URL") }
+}
+
+// sha256 checks an optional hex SHA-256 digest.
+func (v *validator) sha256(field, val string) {
+	if val == "" { return }
+	if b, err := hex.DecodeString(val); err != nil || len(b) != 32 { v.add(field, "must be a SHA-256 digest in hex (64 characters)") }
+}
+
+// badRequest answers 400, with field details for a validationError.
+func badRequest(w http.ResponseWriter, err error) {
+	var ve validationError
+	if !errors.As(err, &ve) { http.Error(w, err.Error(), http.StatusBadRequest); return }
+	writeJSON(w, http.StatusBadRequest, map[string]any{"error": apiError{Code: "validation_failed", Message: "the request is invalid: " + ve.Error(),
+		Fields: ve, RequestID: w.Header().Get("X-Request-ID")}})
+}
+
+// decodeJSON decodes the body into dst and validates it, answering 400 on
+// failure; it reports whether the handler should go on.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst any) bool {
+	err := json.NewDecoder(r.Body).Decode(dst)
+	var syn *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+	case errors.Is(err, io.EOF):
+		badRequest(w, validationError{{Message: "request body is empty"}}); return false
+	case errors.As(err, &syn):
+		badRequest(w, validationError{{Message: fmt.Sprintf("malformed JSON at offset %d", syn.Offset)}}); return false
+	case errors.As(err, &typ):
+		badRequest(w, validationError{{Field: typ.Field, Message: "must be " + jsonKind(typ.Type)}}); return false
+	default:
+		badRequest(w, validationError{{Message: "malformed JSON: " + err.Error()}}); return false
+	}
+	if fv, ok := dst.(fieldValidator); ok {
+		var v validator
+		fv.validateFields(&v)
+		if err := v.err(); err != nil { badRequest(w, err); return false }
+	}
+	return true
+}
+
+func jsonKind(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer { t = t.Elem() }
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	}
+	return "a " + t.String()
+}
+
+// driverPackBody is the POST body of /api/v1/admin/driver_packs.
+type driverPackBody struct {
+	Vendor   string `json:"vendor"`
+	Model    string `json:"model"`
+	Version  string `json:"version"`
+	URL      string `json:"url"`
+	Checksum string `json:"checksum"`
+	Notes    string `json:"notes"`
+	Overlay  string `json:"overlay"`
+}
+
+func (b *driverPackBody) validateFields(v *validator) {
+	v.required("vendor", b.Vendor)
+	v.required("model", b.Model)
+	v.required("version", b.Version)
+	v.maxLen("notes", b.Notes, 4096)
+	if v.required("url", b.URL) { v.url("url", b.URL) }
+	v.sha256("checksum", b.Checksum)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ---- Rollouts (wave-based mass deployment) ----
+// A rollout deploys one image/template/sequence to many machines in waves of
+// at most `concurrency` machines. The leader advances rollouts every
+// rolloutTick: a wave starts only when the previous one has settled, its
+// health check passed (failure rate, optional health_url returning 2xx) and
+// wave_delay has elapsed. Machines are woken with a magic packet when their
+// deployment is created (see wol.go). A rollout pauses itself when a wave's failure rate
+// exceeds max_failure_rate; resume continues with the next wave.
+const rolloutTick = 15 * time.Second
+
+type Rollout struct {
+	ID             string  `json:"id"`
+	Name           string  `json:"name"`
+	Status         string  `json:"status"` // running|paused|completed|cancelled
+	Reason         string  `json:"reason,omitempty"`
+	ImageID        string  `json:"image_id"`
+	TemplateID     string  `json:"template_id"`
+	SequenceID     string  `json:"task_sequence_id"`
+	Concurrency    int     `json:"concurrency"`
+	WaveDelay      int     `json:"wave_delay_seconds"`
+	WaveTimeout    int     `json:"wave_timeout_minutes"`
+	MaxFailureRate float64 `json:"max_failure_rate"`
+	HealthURL      string  `json:"health_url,omitempty"`
+	CurrentWave    int     `json:"current_wave"`
+	WaveStarted    string  `json:"wave_started_at,omitempty"`
+	CreatedAt      string  `json:"created_at"`
+}
+
+func initRollouts(db *sql.DB) error {
+	ddl1 := `CREATE TABLE IF NOT EXISTS rollouts (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		status TEXT NOT NULL,
+		reason TEXT,
+		image_id TEXT,
+		template_id TEXT NOT NULL,
+		task_sequence_id TEXT,
+		concurrency INTEGER NOT NULL,
+		wave_delay INTEGER NOT NULL DEFAULT 0,
+		wave_timeout INTEGER NOT NULL DEFAULT 120,
+		max_failure_rate REAL NOT NULL DEFAULT 0.1,
+		health_url TEXT,
+		current_wave INTEGER NOT NULL DEFAULT -1,
+		wave_started_at TEXT,
+		wave_settled_at TEXT,
+		resumed_wave INTEGER NOT NULL DEFAULT -1,
+		created_by INTEGER,
+		created_at TEXT NOT NULL
+	);`
+	ddl2 := `CREATE TABLE IF NOT EXISTS rollout_targets (
+		rollout_id TEXT NOT NULL,
+		mac TEXT NOT NULL,
+		hostname TEXT,
+		wave INTEGER NOT NULL,
+		deployment_id TEXT,
+		status TEXT NOT NULL,
+		PRIMARY KEY (rollout_id, mac)
+	);`
+	for _, ddl := range []string{ddl1, ddl2} {
+		if _, err := db.Exec(ddl); err != nil { return err }
+	}
+	return nil
+}
+
+const rolloutColumns = `id, name, status, COALESCE(reason,''), COALESCE(image_id,''), template_id, COALESCE(task_sequence_id,''), concurrency,
+	wave_delay, wave_timeout, max_failure_rate, COALESCE(health_url,''), current_wave, COALESCE(wave_started_at,''), created_at`
+
+func scanRollout(row interface{ Scan(...any) error }) (*Rollout, error) {
+	var ro Rollout
+	err := row.Scan(&ro.ID, &ro.Name, &ro.Status, &ro.Reason, &ro.ImageID, &ro.TemplateID, &ro.SequenceID, &ro.Concurrency,
+		&ro.WaveDelay, &ro.WaveTimeout, &ro.MaxFailureRate, &ro.HealthURL, &ro.CurrentWave, &ro.WaveStarted, &ro.CreatedAt)
+	return &ro, err
+}
+
+// rolloutCounts tallies target statuses, overall and for one wave.
+func (s *Server) rolloutCounts(id string, wave int) (all, cur map[string]int, err error) {
+	rows, err := s.DB.Query(`SELECT wave, status, COUNT(*) FROM rollout_targets WHERE rollout_id=? GROUP BY wave, status`, id)
+	if err != nil { return nil, nil, err }
+	defer rows.Close()
+	all, cur = map[string]int{}, map[string]int{}
+	for rows.Next() {
+		var w, n int
+		var st string
+		if err := rows.Scan(&w, &st, &n); err != nil { return nil, nil, err }
+		all[st] += n
+		if w == wave { cur[st] += n }
+	}
+	return all, cur, rows.Err()
+}
+
+func (s *Server) pauseRollout(ro *Rollout, reason string) {
+	_, _ = s.DB.Exec(`UPDATE rollouts SET status='paused', reason=? WHERE id=? AND status='running'`, reason, ro.ID)
+	s.notify("warning", "rollout_paused", "Rollout "+ro.Name+" paused: "+reason, map[string]any{"rollout_id": ro.ID, "wave": ro.CurrentWave})
+}
+
+// syncRolloutTargets copies deployment outcomes onto the current wave and
+// fails targets that overran the wave timeout.
+func (s *Server) syncRolloutTargets(ro *Rollout) error {
+	_, err := s.DB.Exec(`UPDATE rollout_targets SET status=(SELECT d.status FROM deployments d WHERE d.id=rollout_targets.deployment_id)
+		WHERE rollout_id=? AND status='deploying' AND (SELECT d.status FROM deployments d WHERE d.id=rollout_targets.deployment_id) IN ('succeeded','failed')`, ro.ID)
+	if err != nil { return err }
+	if started, err := time.Parse(time.RFC3339, ro.WaveStarted); err == nil && time.Since(started) > time.Duration(ro.WaveTimeout)*time.Minute {
+		rows, err := s.DB.Query(`SELECT deployment_id FROM rollout_targets WHERE rollout_id=? AND wave=? AND status='deploying'`, ro.ID, ro.CurrentWave)
+		if err != nil { return err }
+		var stuck []string
+		for rows.Next() {
+			var dep string
+			if rows.Scan(&dep) == nil { stuck = append(stuck, dep) }
+		}
+		rows.Close()
+		for _, dep := range stuck {
+			_ = s.setDeploymentStatus(dep, "failed", fmt.Sprintf("rollout wave timeout (%d min)", ro.WaveTimeout))
+			_, _ = s.DB.Exec(`UPDATE rollout_targets SET status='failed' WHERE rollout_id=? AND deployment_id=?`, ro.ID, dep)
+		}
+	}
+	return nil
+}
+
+// rolloutHealthy runs the inter-wave health check.
+func rolloutHealthy(ctx context.Context, ro *Rollout) error {
+	if ro.HealthURL == "" { return nil }
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ro.HealthURL, nil)
+	if err != nil { return err }
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil { return fmt.Errorf("health check: %v", err) }
+	resp.Body.Close()
+	if resp.StatusCode >= 300 { return fmt.Errorf("health check returned %s", resp.Status) }
+	return nil
+}
+
+// startWave creates and wakes the deployments of the next wave.
+func (s *Server) startWave(ro *Rollout, wave int) error {
+	rows, err := s.DB.Query(`SELECT mac, COALESCE(hostname,'') FROM rollout_targets WHERE rollout_id=? AND wave=? AND status='queued'`, ro.ID, wave)
+	if err != nil { return err }
+	type target struct{ mac, hostname string }
+	var targets []target
+	for rows.Next() {
+		var t target
+		if err := rows.Scan(&t.mac, &t.hostname); err != nil { rows.Close(); return err }
+		targets = append(targets, t)
+	}
+	rows.Close()
+	now := time.Now().UTC().Format(time.RFC3339)
+	if _, err := s.DB.Exec(`UPDATE rollouts SET current_wave=?, wave_started_at=?, wave_settled_at=NULL WHERE id=?`, wave, now, ro.ID); err != nil { return err }
+	for _, t := range targets {
+		dep, err := s.createDeployment(t.mac, t.hostname, ro.ImageID, ro.TemplateID, ro.SequenceID, nil)
+		if err != nil {
+			_, _ = s.DB.Exec(`UPDATE rollout_targets SET status='failed' WHERE rollout_id=? AND mac=?`, ro.ID, t.mac)
+			log.Printf("rollout %s: deployment for %s: %v", ro.ID, t.mac, err)
+			continue
+		}
+		_, _ = s.DB.Exec(`UPDATE rollout_targets SET status='deploying', deployment_id=? WHERE rollout_id=? AND mac=?`, dep, ro.ID, t.mac)
+		if _, err := s.wakeMachine(t.mac, wakeOptions{}); err != nil { log.Printf("rollout %s: wake %s: %v", ro.ID, t.mac, err) }
+	}
+	s.audit(nil, "start_wave", "rollout", map[string]any{"id": ro.ID, "wave": wave, "machines": len(targets)})
+	return nil
+}
+
+// advanceRollout moves one running rollout forward by at most one wave.
+func (s *Server) advanceRollout(ctx context.Context, ro *Rollout) error {
+	if err := s.syncRolloutTargets(ro); err != nil { return err }
+	all, cur, err := s.rolloutCounts(ro.ID, ro.CurrentWave)
+	if err != nil { return err }
+	if cur["deploying"] > 0 { return nil }
+	// an operator resuming after a pause accepts the current wave's failures
+	var resumed int
+	_ = s.DB.QueryRow(`SELECT resumed_wave FROM rollouts WHERE id=?`, ro.ID).Scan(&resumed)
+	finished := cur["succeeded"] + cur["failed"]
+	if resumed != ro.CurrentWave && finished > 0 && float64(cur["failed"])/float64(finished) > ro.MaxFailureRate {
+		s.pauseRollout(ro, fmt.Sprintf("wave %d failure rate %d/%d exceeds %.0f%%", ro.CurrentWave, cur["failed"], finished, ro.MaxFailureRate*100))
+		return nil
+	}
+	if all["queued"] == 0 {
+		_, err := s.DB.Exec(`UPDATE rollouts SET status='completed', reason=? WHERE id=?`, fmt.Sprintf("%d succeeded, %d failed", all["succeeded"], all["failed"]), ro.ID)
+		s.notify("info", "rollout_completed", "Rollout "+ro.Name+" completed", map[string]any{"rollout_id": ro.ID, "succeeded": all["succeeded"], "failed": all["failed"]})
+		return err
+	}
+	if ro.CurrentWave >= 0 {
+		var settled sql.NullString
+		_ = s.DB.QueryRow(`SELECT wave_settled_at FROM rollouts WHERE id=?`, ro.ID).Scan(&settled)
+		if !settled.Valid {
+			_, _ = s.DB.Exec(`UPDATE rollouts SET wave_settled_at=? WHERE id=?`, time.Now().UTC().Format(time.RFC3339), ro.ID)
+			if ro.WaveDelay > 0 { return nil }
+		} else if t, err := time.Parse(time.RFC3339, settled.String); err == nil && time.Since(t) < time.Duration(ro.WaveDelay)*time.Second {
+			return nil
+		}
+		if err := rolloutHealthy(ctx, ro); err != nil { s.pauseRollout(ro, err.Error()); return nil }
+	}
+	var next int
+	if err := s.DB.QueryRow(`SELECT MIN(wave) FROM rollout_targets WHERE rollout_id=? AND status='queued'`, ro.ID).Scan(&next); err != nil { return err }
+	return s.startWave(ro, next)
+}
+
+func (s *Server) advanceRollouts() {
+	rows, err := s.DB.Query(`SELECT ` + rolloutColumns + ` FROM rollouts WHERE status='running'`)
+	if err != nil { log.Printf("rollouts: %v", err); return }
+	var running []*Rollout
+	for rows.Next() {
+		ro, err := scanRollout(rows)
+		if err != nil { log.Printf("rollouts: %v", err); continue }
+		running = append(running, ro)
+	}
+	rows.Close()
+	for _, ro := range running {
+		if err := s.advanceRollout(context.Background(), ro); err != nil { log.Printf("rollout %s: %v", ro.ID, err) }
+	}
+}
+
+// rolloutMachines resolves the target list: explicit MACs, or every
+// member of a machine group.
+func (s *Server) rolloutMachines(macs []string, groupID string) ([]string, error) {
+	if groupID == "" {
+		out := []string{}
+		seen := map[string]bool{}
+		for _, m := range macs {
+			m = normalizeMAC(m)
+			if _, err := net.ParseMAC(m); err != nil { return nil, fmt.Errorf("invalid mac %q", m) }
+			if !seen[m] { seen[m] = true; out = append(out, m) }
+		}
+		return out, nil
+	}
+	out, err := s.groupMembers(groupID)
+	if errors.Is(err, sql.ErrNoRows) { return nil, fmt.Errorf("unknown group %s", groupID) }
+	return out, err
+}
+
+func (s *Server) startRollouts(ctx context.Context) {
+	go s.runAsLeader(ctx, "rollouts", rolloutTick, s.advanceRollouts)
+}
+
+func (s *Server) rolloutRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/rollouts", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := s.DB.Query(`SELECT ` + rolloutColumns + ` FROM rollouts ORDER BY created_at DESC LIMIT 100`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			var list []*Rollout
+			for rows.Next() {
+				ro, err := scanRollout(rows)
+				if err != nil { rows.Close(); http.Error(w, err.Error(), 500); return }
+				list = append(list, ro)
+			}
+			rows.Close()
+			out := []map[string]any{}
+			for _, ro := range list {
+				all, _, _ := s.rolloutCounts(ro.ID, ro.CurrentWave)
+				out = append(out, map[string]any{"rollout": ro, "targets": all})
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPost:
+			var body struct {
+				Name           string            `json:"name"`
+				MACs           []string          `json:"macs"`
+				GroupID        string            `json:"group_id"`
+				Hostnames      map[string]string `json:"hostnames"` // mac -> hostname
+				ImageID        string            `json:"image_id"`
+				TemplateID     string            `json:"template_id"`
+				SequenceID     string            `json:"task_sequence_id"`
+				Concurrency    int               `json:"concurrency"`
+				WaveDelay      int               `json:"wave_delay_seconds"`
+				WaveTimeout    int               `json:"wave_timeout_minutes"`
+				MaxFailureRate *float64          `json:"max_failure_rate"`
+				HealthURL      string            `json:"health_url"`
+			}
+			if !decodeJSON(w, r, &body) { return }
+			var v validator
+			v.required("name", body.Name)
+			v.url("health_url", body.HealthURL)
+			if err := v.err(); err != nil { badRequest(w, err); return }
+			var n int
+			_ = s.DB.QueryRow(`SELECT COUNT(*) FROM templates WHERE id=?`, body.TemplateID).Scan(&n)
+			if n == 0 { http.Error(w, "unknown template", 400); return }
+			if body.SequenceID != "" {
+				if _, err := s.taskSequence(body.SequenceID); err != nil { http.Error(w, "unknown task sequence", 400); return }
+			}
+			if body.ImageID != "" {
+				if err := s.imageBootable(body.ImageID); err != nil { http.Error(w, err.Error(), 409); return }
+			}
+			if body.Concurrency <= 0 { body.Concurrency = 10 }
+			if body.WaveTimeout <= 0 { body.WaveTimeout = 120 }
+			rate := 0.1
+			if body.MaxFailureRate != nil { rate = *body.MaxFailureRate }
+			if rate < 0 || rate > 1 { http.Error(w, "max_failure_rate must be between 0 and 1", 400); return }
+			macs, err := s.rolloutMachines(body.MACs, body.GroupID)
+			if err != nil { http.Error(w, err.Error(), 400); return }
+			if len(macs) == 0 { http.Error(w, "no machines to deploy", 400); return }
+			hostnames := map[string]string{}
+			for m, h := range body.Hostnames { hostnames[normalizeMAC(m)] = strings.TrimSpace(h) }
+			id := "ro-" + genID()
+			tx, err := s.DB.Begin()
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer tx.Rollback()
+			_, err = tx.Exec(`INSERT INTO rollouts (id, name, status, image_id, template_id, task_sequence_id, concurrency, wave_delay, wave_timeout, max_failure_rate, health_url, created_by, created_at)
+				VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)`, id, body.Name, "running", body.ImageID, body.TemplateID, body.SequenceID, body.Concurrency,
+				body.WaveDelay, body.WaveTimeout, rate, body.HealthURL, s.actorID(r), time.Now().UTC().Format(time.RFC3339))
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			for i, mac := range macs {
+				if _, err := tx.Exec(`INSERT INTO rollout_targets (rollout_id, mac, hostname, wave, status) VALUES (?,?,?,?,?)`, id, mac, hostnames[mac], i/body.Concurrency, "queued"); err != nil {
+					http.Error(w, err.Error(), 500); return
+				}
+			}
+			if err := tx.Commit(); err != nil { http.Error(w, err.Error(), 500); return }
+			waves := (len(macs) + body.Concurrency - 1) / body.Concurrency
+			s.audit(s.actorID(r), "create", "rollout", map[string]any{"id": id, "name": body.Name, "machines": len(macs), "waves": waves})
+			writeJSON(w, 201, map[string]any{"id": id, "machines": len(macs), "waves": waves, "status": "running"})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// /api/v1/admin/rollouts/{id} (GET with targets) and /{id}/pause|resume|cancel
+	s.Mux.HandleFunc("/api/v1/admin/rollouts/", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/admin/rollouts/"), "/"), "/")
+		ro, err := scanRollout(s.DB.QueryRow(`SELECT `+rolloutColumns+` FROM rollouts WHERE id=?`, parts[0]))
+		if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if len(parts) == 1 {
+			if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+			rows, err := s.DB.Query(`SELECT mac, COALESCE(hostname,''), wave, COALESCE(deployment_id,''), status FROM rollout_targets WHERE rollout_id=? ORDER BY wave, mac`, ro.ID)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			targets := []map[string]any{}
+			for rows.Next() {
+				var mac, hostname, dep, status string
+				var wave int
+				if err := rows.Scan(&mac, &hostname, &wave, &dep, &status); err != nil { http.Error(w, err.Error(), 500); return }
+				targets = append(targets, map[string]any{"mac": mac, "hostname": hostname, "wave": wave, "deployment_id": dep, "status": status})
+			}
+			writeJSON(w, 200, map[string]any{"rollout": ro, "targets": targets})
+			return
+		}
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		var res sql.Result
+		switch parts[1] {
+		case "pause":
+			res, err = s.DB.Exec(`UPDATE rollouts SET status='paused', reason='paused by operator' WHERE id=? AND status='running'`, ro.ID)
+		case "resume":
+			res, err = s.DB.Exec(`UPDATE rollouts SET status='running', reason=NULL, resumed_wave=current_wave WHERE id=? AND status='paused'`, ro.ID)
+		case "cancel":
+			res, err = s.DB.Exec(`UPDATE rollouts SET status='cancelled', reason='cancelled by operator' WHERE id=? AND status IN ('running','paused')`, ro.ID)
+			if err == nil { _, err = s.DB.Exec(`UPDATE rollout_targets SET status='skipped' WHERE rollout_id=? AND status='queued'`, ro.ID) }
+		default:
+			http.NotFound(w, r); return
+		}
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if n, _ := res.RowsAffected(); n == 0 { http.Error(w, "rollout is "+ro.Status, 409); return }
+		s.audit(s.actorID(r), parts[1], "rollout", map[string]any{"id": ro.ID})
+		writeJSON(w, 200, map[string]any{"id": ro.ID, "action": parts[1]})
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ---- SBOM generation ----
+// Linux images are unpacked and scanned with an SBOM tool (syft by default,
+// BOOTAH_SBOM_TOOL overrides); the document is stored as an "sbom" attachment
+// named sbom.<format>.json.
+var sbomFormats = map[string]string{"spdx": "spdx-json", "cyclonedx": "cyclonedx-json"}
+
+// sbomExtract maps image types to the command that unpacks them into {work}.
+var sbomExtract = map[string][]string{
+	"squashfs": {"unsquashfs", "-f", "-d", "{work}", "{src}"},
+	"iso":      {"xorriso", "-osirrox", "on", "-indev", "{src}", "-extract", "/", "{work}"},
+	"tar":      {"tar", "-xf", "{src}", "-C", "{work}"},
+	"gz":       {"tar", "-xzf", "{src}", "-C", "{work}"},
+}
+
+func (s *Server) generateSBOM(ctx context.Context, imageID, format string) (*Attachment, error) {
+	var typ, key string
+	if err := s.DB.QueryRow(`SELECT type, file FROM images WHERE id=?`, imageID).Scan(&typ, &key); err != nil { return nil, err }
+	extract, ok := sbomExtract[typ]
+	if !ok { return nil, fmt.Errorf("SBOM generation not supported for %s images", typ) }
+	work, err := os.MkdirTemp("", "bootah-sbom-")
+	if err != nil { return nil, err }
+	defer os.RemoveAll(work)
+	src, err := s.stageObject(ctx, key, work)
+	if err != nil { return nil, err }
+	tree := filepath.Join(work, "tree")
+	if err := os.Mkdir(tree, 0o755); err != nil { return nil, err }
+	repl := strings.NewReplacer("{src}", src, "{work}", tree)
+	args := make([]string, len(extract))
+	for i, a := range extract { args[i] = repl.Replace(a) }
+	if out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, getenv("BOOTAH_SBOM_TOOL", "syft"), "dir:"+tree, "-o", sbomFormats[format], "-q")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil { return nil, fmt.Errorf("sbom: %v: %s", err, strings.TrimSpace(stderr.String())) }
+	return s.addAttachment(ctx, imageID, "sbom."+format+".json", "sbom", "application/json", &stdout)
+}
+
+type sbomJob struct {
+	ImageID string `json:"image_id"`
+	Format  string `json:"format"`
+}
+
+func init() {
+	registerJobHandler("sbom", func(s *Server, ctx context.Context, payload json.RawMessage) (string, error) {
+		var j sbomJob
+		if err := json.Unmarshal(payload, &j); err != nil { return "", err }
+		a, err := s.generateSBOM(ctx, j.ImageID, j.Format)
+		if err != nil { return "", err }
+		return "attachment:" + a.ID, nil
+	})
+}
+
+// handleImageSBOM starts generation (POST, admin) or returns the latest SBOM
+// in the requested format (GET, ?format=spdx|cyclonedx).
+func (s *Server) handleImageSBOM(w http.ResponseWriter, r *http.Request, imageID string) {
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" { format = "spdx" }
+	if _, ok := sbomFormats[format]; !ok { http.Error(w, "format must be spdx or cyclonedx", 400); return }
+	switch r.Method {
+	case http.MethodGet:
+		list, err := s.listAttachments(imageID, "sbom")
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		for _, a := range list {
+			if a.Name == "sbom."+format+".json" { s.serveAttachment(w, r, a); return }
+		}
+		http.NotFound(w, r)
+	case http.MethodPost:
+		if !s.requireRole(w, r, "admin") { return }
+		var typ string
+		if err := s.DB.QueryRow(`SELECT type FROM images WHERE id=?`, imageID).Scan(&typ); err != nil {
+			if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+			http.Error(w, err.Error(), 500); return
+		}
+		if _, ok := sbomExtract[typ]; !ok { http.Error(w, "SBOM generation not supported for "+typ+" images", 400); return }
+		jobID, err := s.enqueueJob("sbom", sbomJob{ImageID: imageID, Format: format})
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		s.audit(s.actorID(r), "sbom_start", "image", map[string]any{"id": imageID, "format": format, "job": jobID})
+		writeJSON(w, 202, map[string]any{"job": jobID, "status": "queued"})
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ---- Sessions ----
+// Every login starts a session, stored server-side under the JTI of its
+// refresh token. /api/v1/auth/refresh only accepts a refresh token whose
+// session is still live, and rotates it: the new token gets a new JTI and the
+// old one stops working. Logging out ends the session; changing one's
+// password ends the user's other sessions; an admin password reset, a role
+// change or deleting the user ends all of them. Access tokens already issued
+// stay valid until they expire (BOOTAH_JWT_ACCESS_TTL). Refresh tokens from
+// before sessions existed are refused, so users log in once more after the
+// upgrade. GET /api/v1/admin/sessions (?user_id=, ?all=true to include ended
+// ones) lists sessions; DELETE /api/v1/admin/sessions/{id} ends one and
+// DELETE /api/v1/admin/sessions?user_id= all of a user's.
+func initSessions(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		jti TEXT UNIQUE NOT NULL,
+		user_id INTEGER NOT NULL,
+		method TEXT NOT NULL,
+		ip TEXT,
+		user_agent TEXT,
+		created_at TEXT NOT NULL,
+		last_used_at TEXT NOT NULL,
+		expires_at TEXT NOT NULL,
+		revoked_at TEXT,
+		revoked_reason TEXT
+	)`)
+	if err != nil { return err }
+	_, _ = db.Exec(`CREATE INDEX IF NOT EXISTS sessions_user ON sessions (user_id)`)
+	return nil
+}
+
+type Session struct {
+	ID            string `json:"id"`
+	UserID        int64  `json:"user_id"`
+	Email         string `json:"email"`
+	Method        string `json:"method"`
+	IP            string `json:"ip,omitempty"`
+	UserAgent     string `json:"user_agent,omitempty"`
+	CreatedAt     string `json:"created_at"`
+	LastUsedAt    string `json:"last_used_at"`
+	ExpiresAt     string `json:"expires_at"`
+	RevokedAt     string `json:"revoked_at,omitempty"`
+	RevokedReason string `json:"revoked_reason,omitempty"`
+}
+
+func (s *Server) setRefreshCookie(w http.ResponseWriter, r *http.Request, refresh string) {
+	http.SetCookie(w, &http.Cookie{Name: "bootah_refresh", Value: refresh, HttpOnly: true, Secure: secureRequest(r), Path: "/", SameSite: http.SameSiteLaxMode, MaxAge: int(jwtRefreshTTL() / time.Second)})
+}
+
+// startSession records a new session for a login and returns its tokens.
+func (s *Server) startSession(r *http.Request, id int64, email, role, method string) (string, string, error) {
+	jti := randToken(16)
+	access, refresh, err := s.issueTokens(id, email, role, jti)
+	if err != nil { return "", "", err }
+	now := time.Now().UTC()
+	var ip string
+	if c := clientIP(r); c != nil { ip = c.String() }
+	ua := r.UserAgent()
+	if len(ua) > 256 { ua = ua[:256] }
+	_, err = s.DB.Exec(`INSERT INTO sessions (id, jti, user_id, method, ip, user_agent, created_at, last_used_at, expires_at) VALUES (?,?,?,?,NULLIF(?,''),NULLIF(?,''),?,?,?)`,
+		"sess-"+genID(), jti, id, method, ip, ua, now.Format(time.RFC3339), now.Format(time.RFC3339), now.Add(jwtRefreshTTL()).Format(time.RFC3339))
+	if err != nil { return "", "", err }
+	_, _ = s.DB.Exec(`DELETE FROM sessions WHERE expires_at<?`, now.Add(-7*24*time.Hour).Format(time.RFC3339))
+	return access, refresh, nil
+}
+
+// refreshJTI validates a refresh token and returns its user id and JTI.
+func (s *Server) refreshJTI(tok string) (int64, string, bool) {
+	t, err := jwt.ParseWithClaims(tok, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) { return []byte(s.JWTSecret), nil },
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(jwtIssuer()), jwt.WithAudience(jwtRefreshAudience()), jwt.WithLeeway(jwtLeeway()))
+	if err != nil || !t.Valid { return 0, "", false }
+	claims := t.Claims.(*jwt.RegisteredClaims)
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || claims.ID == "" { return 0, "", false }
+	return id, claims.ID, true
+}
+
+// rotateSession moves the live session of jti to a new refresh token.
+func (s *Server) rotateSession(id int64, jti, email, role string) (string, string, bool, error) {
+	next := randToken(16)
+	access, refresh, err := s.issueTokens(id, email, role, next)
+	if err != nil { return "", "", false, err }
+	now := time.Now().UTC()
+	res, err := s.DB.Exec(`UPDATE sessions SET jti=?, last_used_at=?, expires_at=? WHERE jti=? AND user_id=? AND revoked_at IS NULL AND expires_at>?`,
+		next, now.Format(time.RFC3339), now.Add(jwtRefreshTTL()).Format(time.RFC3339), jti, id, now.Format(time.RFC3339))
+	if err != nil { return "", "", false, err }
+	if n, _ := res.RowsAffected(); n == 0 { return "", "", false, nil }
+	return access, refresh, true, nil
+}
+
+// revokeSessions ends the user's live sessions, except the one holding keepJTI.
+func (s *Server) revokeSessions(userID int64, keepJTI, reason string) int64 {
+	res, err := s.DB.Exec(`UPDATE sessions SET revoked_at=?, revoked_reason=? WHERE user_id=? AND jti<>? AND revoked_at IS NULL`,
+		time.Now().UTC().Format(time.RFC3339), reason, userID, keepJTI)
+	if err != nil { return 0 }
+	n, _ := res.RowsAffected()
+	return n
+}
+
+// cookieJTI returns the JTI of the request's refresh cookie, or "".
+func (s *Server) cookieJTI(r *http.Request) string {
+	ck, err := r.Cookie("bootah_refresh")
+	if err != nil { return "" }
+	_, jti, _ := s.refreshJTI(ck.Value)
+	return jti
+}
+
+func (s *Server) sessionRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		q := r.URL.Query()
+		var uid int64
+		if v := q.Get("user_id"); v != "" {
+			var err error
+			if uid, err = strconv.ParseInt(v, 10, 64); err != nil { http.Error(w, "invalid user_id", 400); return }
+		}
+		switch r.Method {
+		case http.MethodGet:
+			where, args := ` WHERE 1=1`, []any{}
+			if uid != 0 { where, args = where+` AND s.user_id=?`, append(args, uid) }
+			if q.Get("all") != "true" { where, args = where+` AND s.revoked_at IS NULL AND s.expires_at>?`, append(args, time.Now().UTC().Format(time.RFC3339)) }
+			rows, err := s.DB.Query(`SELECT s.id, s.user_id, COALESCE(u.email,''), s.method, COALESCE(s.ip,''), COALESCE(s.user_agent,''), s.created_at, s.last_used_at, s.expires_at,
+				COALESCE(s.revoked_at,''), COALESCE(s.revoked_reason,'') FROM sessions s LEFT JOIN users u ON u.id=s.user_id`+where+` ORDER BY s.last_used_at DESC LIMIT 500`, args...)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			out := []Session{}
+			for rows.Next() {
+				var x Session
+				if err := rows.Scan(&x.ID, &x.UserID, &x.Email, &x.Method, &x.IP, &x.UserAgent, &x.CreatedAt, &x.LastUsedAt, &x.ExpiresAt, &x.RevokedAt, &x.RevokedReason); err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, x)
+			}
+			writeJSON(w, 200, out)
+		case http.MethodDelete:
+			if uid == 0 { http.Error(w, "user_id required", 400); return }
+			n := s.revokeSessions(uid, "", "admin")
+			s.audit(s.actorID(r), "revoke", "session", map[string]any{"user_id": uid, "count": n})
+			writeJSON(w, 200, map[string]any{"user_id": uid, "revoked": n})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	s.Mux.HandleFunc("/api/v1/admin/sessions/", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodDelete { http.Error(w, "method not allowed", 405); return }
+		id := strings.TrimPrefix(r.URL.Path, "/api/v1/admin/sessions/")
+		var uid int64
+		if err := s.DB.QueryRow(`SELECT user_id FROM sessions WHERE id=?`, id).Scan(&uid); err != nil { http.NotFound(w, r); return }
+		res, err := s.DB.Exec(`UPDATE sessions SET revoked_at=?, revoked_reason='admin' WHERE id=? AND revoked_at IS NULL`, time.Now().UTC().Format(time.RFC3339), id)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if n, _ := res.RowsAffected(); n == 0 { http.Error(w, "session already ended", 409); return }
+		s.audit(s.actorID(r), "revoke", "session", map[string]any{"id": id, "user_id": uid, "count": 1})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ---- PXE boot simulation ----
+// /api/v1/admin/boot/simulate walks the request sequence of a PXE client: the
+// DHCP answer it would get, the iPXE script fetch and a HEAD of every asset
+// the script references. Requests to this server are served in-process so the
+// simulation sees exactly what a client at that address would; mirror and CDN
+// URLs are probed over the network. With ?strict=1 any problem yields 422,
+// which makes the endpoint usable as a CI gate.
+type simStep struct {
+	Name     string   `json:"name"`
+	OK       bool     `json:"ok"`
+	Detail   string   `json:"detail,omitempty"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+func (st *simStep) fail(format string, a ...any) {
+	st.OK = false
+	st.Problems = append(st.Problems, fmt.Sprintf(format, a...))
+}
+
+func pxeBootFile(arch string) string {
+	if arch == "efi" { return getenv("BOOTAH_PXE_EFI_FILE", "ipxe.efi") }
+	return getenv("BOOTAH_PXE_BIOS_FILE", "undionly.kpxe")
+}
+
+// simulateBoot runs the sequence for a client at ip. nextServer is the host
+// substituted for ${next-server} in the script.
+func (s *Server) simulateBoot(ctx context.Context, ip net.IP, mac, arch, nextServer string) []simStep {
+	var steps []simStep
+
+	dhcp := simStep{Name: "dhcp", OK: true}
+	file := pxeBootFile(arch)
+	dhcp.Detail = fmt.Sprintf("next-server %s, filename %s, iPXE chain http://%s/ipxe/boot.ipxe", nextServer, file, nextServer)
+	if _, err := os.Stat(filepath.Join(getenv("BOOTAH_TFTP_ROOT", "./tftp"), file)); err != nil { dhcp.fail("boot file %s not found in TFTP root: %v", file, err) }
+	if site, err := s.siteForIP(ip); err != nil {
+		dhcp.fail("site lookup: %v", err)
+	} else if site != nil {
+		dhcp.Detail += ", site " + site.Name
+	}
+	steps = append(steps, dhcp)
+
+	script := simStep{Name: "ipxe_script", OK: true}
+	req := httptest.NewRequest(http.MethodGet, "/ipxe/boot.ipxe?mac="+url.QueryEscape(mac), nil).WithContext(ctx)
+	req.RemoteAddr = net.JoinHostPort(ip.String(), "68")
+	rec := httptest.NewRecorder()
+	s.Mux.ServeHTTP(rec, req)
+	body := rec.Body.String()
+	var assets []string
+	if rec.Code != 200 {
+		script.fail("GET /ipxe/boot.ipxe returned %d", rec.Code)
+	} else {
+		if !strings.HasPrefix(body, "#!ipxe") { script.fail("script does not start with #!ipxe") }
+		labels := map[string]bool{}
+		var def string
+		for _, line := range strings.Split(body, "\n") {
+			f := strings.Fields(line)
+			switch {
+			case len(f) == 0:
+			case strings.HasPrefix(f[0], ":"):
+				labels[f[0][1:]] = true
+			case f[0] == "set" && len(f) == 3 && f[1] == "menu-default":
+				def = f[2]
+			case (f[0] == "kernel" || f[0] == "initrd" || f[0] == "chain") && len(f) > 1:
+				assets = append(assets, f[1])
+			}
+		}
+		if def != "" && !labels[def] { script.fail("default entry %q has no label in the menu", def) }
+		script.Detail = fmt.Sprintf("%d bytes, %d entries, default %s", len(body), len(labels), def)
+	}
+	steps = append(steps, script)
+
+	head := simStep{Name: "assets", OK: true}
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, a := range assets {
+		a = strings.ReplaceAll(a, "${next-server}", nextServer)
+		u, err := url.Parse(a)
+		if err != nil { head.fail("%s: %v", a, err); continue }
+		var code int
+		if u.Host == nextServer || strings.HasPrefix(u.Host, nextServer+":") {
+			req := httptest.NewRequest(http.MethodHead, u.RequestURI(), nil).WithContext(ctx)
+			req.RemoteAddr = net.JoinHostPort(ip.String(), "68")
+			rec := httptest.NewRecorder()
+			s.Mux.ServeHTTP(rec, req)
+			code = rec.Code
+		} else {
+			req, _ := http.NewRequestWithContext(ctx, http.MethodHead, a, nil)
+			resp, err := client.Do(req)
+			if err != nil { head.fail("HEAD %s: %v", a, err); continue }
+			resp.Body.Close()
+			code = resp.StatusCode
+		}
+		if code >= 400 { head.fail("HEAD %s returned %d", a, code) }
+	}
+	head.Detail = fmt.Sprintf("%d asset(s) checked", len(assets))
+	return append(steps, head)
+}
+
+func (s *Server) simulateRoutes() {
+	// {"ip": "10.0.0.5", "mac": "...", "arch": "bios|efi", "next_server": "host"}
+	s.Mux.HandleFunc("/api/v1/admin/boot/simulate", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		var body struct {
+			IP         string `json:"ip"`
+			MAC        string `json:"mac"`
+			Arch       string `json:"arch"`
+			NextServer string `json:"next_server"`
+		}
+		if !decodeJSON(w, r, &body) { return }
+		ip := net.ParseIP(body.IP)
+		if ip == nil { http.Error(w, "valid ip required", 400); return }
+		if body.Arch == "" { body.Arch = "bios" }
+		if body.Arch != "bios" && body.Arch != "efi" { http.Error(w, "arch must be bios or efi", 400); return }
+		if body.NextServer == "" { body.NextServer = r.Host }
+		steps := s.simulateBoot(r.Context(), ip, normalizeMAC(body.MAC), body.Arch, body.NextServer)
+		ok := true
+		var problems []string
+		for _, st := range steps {
+			ok = ok && st.OK
+			for _, p := range st.Problems { problems = append(problems, st.Name+": "+p) }
+		}
+		status := 200
+		if !ok && r.URL.Query().Get("strict") == "1" { status = 422 }
+		writeJSON(w, status, map[string]any{"ok": ok, "steps": steps, "problems": problems})
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ---- Sites & subnets ----
+// A site owns one or more client subnets. The boot script is rendered for the
+// site whose subnet most specifically contains the client address, so one
+// /ipxe/boot.ipxe URL serves each region its own menu and nearest mirror.
+type Site struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	Subnets      []string `json:"subnets"`
+	MirrorURL    string   `json:"mirror_url"`    // base URL for /assets, empty = boot server
+	DefaultEntry string   `json:"default_entry"` // overrides BOOTAH_IPXE_DEFAULT
+	MenuItems    []string `json:"menu_items"`    // entries to show, empty = all
+	Branding     *MenuBranding `json:"branding,omitempty"`
+}
+
+func initSites(db *sql.DB) error {
+	ddl := `CREATE TABLE IF NOT EXISTS sites (
+		id TEXT PRIMARY KEY,
+		name TEXT UNIQUE NOT NULL,
+		subnets TEXT NOT NULL,
+		mirror_url TEXT,
+		default_entry TEXT,
+		menu_items TEXT
+	);`
+	_, err := db.Exec(ddl)
+	return err
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" { out = append(out, p) }
+	}
+	return out
+}
+
+func (s *Server) listSites() ([]Site, error) {
+	rows, err := s.DB.Query(`SELECT id, name, subnets, COALESCE(mirror_url,''), COALESCE(default_entry,''), COALESCE(menu_items,''), COALESCE(branding,'') FROM sites ORDER BY name`)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	var out []Site
+	for rows.Next() {
+		var st Site; var subnets, items, branding string
+		if err := rows.Scan(&st.ID, &st.Name, &subnets, &st.MirrorURL, &st.DefaultEntry, &items, &branding); err != nil { return nil, err }
+		st.Subnets, st.MenuItems = splitList(subnets), splitList(items)
+		if branding != "" { _ = json.Unmarshal([]byte(branding), &st.Branding) }
+		out = append(out, st)
+	}
+	return out, rows.Err()
+}
+
+// siteForIP returns the site with the longest-prefix subnet containing ip, or
+// nil when no site matches.
+func (s *Server) siteForIP(ip net.IP) (*Site, error) {
+	if ip == nil { return nil, nil }
+	sites, err := s.listSites()
+	if err != nil { return nil, err }
+	return matchSite(sites, ip), nil
+}
+
+// matchSite picks the site for ip from an already loaded list.
+func matchSite(sites []Site, ip net.IP) *Site {
+	if ip == nil { return nil }
+	var best *Site
+	bestLen := -1
+	for i := range sites {
+		for _, cidr := range sites[i].Subnets {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil || !n.Contains(ip) { continue }
+			if ones, _ := n.Mask.Size(); ones > bestLen { best, bestLen = &sites[i], ones }
+		}
+	}
+	return best
+}
+
+// clientIP returns the request's client address, honouring X-Forwarded-For
+// only when BOOTAH_TRUST_PROXY=true.
+func clientIP(r *http.Request) net.IP {
+	if getenv("BOOTAH_TRUST_PROXY", "false") == "true" {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			return net.ParseIP(strings.TrimSpace(strings.Split(xff, ",")[0]))
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil { host = r.RemoteAddr }
+	return net.ParseIP(host)
+}
+
+func validateSite(st Site) error {
+	if strings.TrimSpace(st.Name) == "" { return fmt.Errorf("name required") }
+	if len(st.Subnets) == 0 { return fmt.Errorf("at least one subnet required") }
+	for _, c := range st.Subnets {
+		if _, _, err := net.ParseCIDR(c); err != nil { return fmt.Errorf("invalid subnet %q", c) }
+	}
+	var v validator
+	v.url("mirror_url", st.MirrorURL)
+	if err := v.err(); err != nil { return err }
+	return validateBranding(st.Branding)
+}
+
+func (s *Server) siteRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/sites", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+			out, err := s.listSites()
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			writeJSON(w, 200, out)
+		case http.MethodPost, http.MethodPut:
+			var body Site
+			if !decodeJSON(w, r, &body) { return }
+			if err := validateSite(body); err != nil { badRequest(w, err); return }
+			subnets, items := strings.Join(body.Subnets, ","), strings.Join(body.MenuItems, ",")
+			var branding any
+			if body.Branding != nil { js, _ := json.Marshal(body.Branding); branding = string(js) }
+			if r.Method == http.MethodPut {
+				res, err := s.DB.Exec(`UPDATE sites SET name=?, subnets=?, mirror_url=?, default_entry=?, menu_items=?, branding=? WHERE id=?`,
+					body.Name, subnets, body.MirrorURL, body.DefaultEntry, items, branding, body.ID)
+				if err != nil { http.Error(w, err.Error(), 500); return }
+				if n, _ := res.RowsAffected(); n == 0 { http.NotFound(w, r); return }
+				s.audit(s.actorID(r), "update", "site", map[string]any{"id": body.ID, "name": body.Name})
+				writeJSON(w, 200, map[string]any{"id": body.ID})
+				return
+			}
+			id := "site-" + genID()
+			_, err := s.DB.Exec(`INSERT INTO sites (id, name, subnets, mirror_url, default_entry, menu_items, branding) VALUES (?,?,?,?,?,?,?)`,
+				id, body.Name, subnets, body.MirrorURL, body.DefaultEntry, items, branding)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "create", "site", map[string]any{"id": id, "name": body.Name})
+			writeJSON(w, 201, map[string]any{"id": id})
+		case http.MethodDelete:
+			var body struct{ ID string `json:"id"` }
+			if !decodeJSON(w, r, &body) { return }
+			if _, err := s.DB.Exec(`DELETE FROM sites WHERE id=?`, body.ID); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "delete", "site", map[string]any{"id": body.ID})
+			writeJSON(w, 200, map[string]any{"deleted": body.ID})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// Which site (and therefore menu/mirror) a client address resolves to
+	s.Mux.HandleFunc("/api/v1/admin/sites/resolve", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		ip := net.ParseIP(r.URL.Query().Get("ip"))
+		if ip == nil { http.Error(w, "invalid ip", 400); return }
+		site, err := s.siteForIP(ip)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		writeJSON(w, 200, map[string]any{"ip": ip.String(), "site": site})
+	})
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ---- Site-scoped administration ----
+// A user assigned to one or more sites (PUT /api/v1/admin/users/sites) is a
+// site admin: whatever their role grants, they can only manage machines,
+// their tags, boot profiles and task sequence assignments, and deployments,
+// and only for machines whose last boot came from one of their sites.
+// They may register new MACs, which join a site on their first boot. Boot
+// profiles they create belong to one of their sites (site_id) and only those
+// can they change; global profiles stay readable and assignable. Images,
+// image tags and builds stay readable for picking what to deploy; storage,
+// users, settings and everything else are left to global admins. Machine and
+// deployment lists only show their sites and report links can't be shared.
+// Users with the admin role are always global, and API keys are never
+// site-scoped.
+var siteScopedRoutes = []string{
+	"/api/v1/machines", "/api/v1/machine_tags", "/api/v1/admin/deployments",
+	"/api/v1/deployments/plan", "/api/v1/admin/task_sequences/assign", "/api/v1/boot_profiles",
+}
+
+// siteReadableRoutes are the other routes site admins may GET.
+var siteReadableRoutes = []string{"/api/v1/images", "/api/v1/image_tags", "/api/v1/builds"}
+
+func initSiteScopes(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS user_sites (
+		user_id INTEGER NOT NULL,
+		site_id TEXT NOT NULL,
+		PRIMARY KEY (user_id, site_id)
+	)`)
+	return err
+}
+
+// userSites returns the sites a user is limited to; none means global.
+func (s *Server) userSites(id int64) ([]string, error) {
+	rows, err := s.DB.Query(`SELECT site_id FROM user_sites WHERE user_id=? ORDER BY site_id`, id)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := []string{}
+	for rows.Next() {
+		var site string
+		if err := rows.Scan(&site); err != nil { return nil, err }
+		out = append(out, site)
+	}
+	return out, rows.Err()
+}
+
+// claimsSites returns the sites verified claims are limited to, nil for
+// global users and API keys.
+func (s *Server) claimsSites(claims map[string]any) []string {
+	if _, ok := claims["api_key"]; ok { return nil }
+	uid, ok := claims["sub"].(int64)
+	if !ok { return nil }
+	sites, err := s.userSites(uid)
+	if err != nil || len(sites) == 0 { return nil }
+	return sites
+}
+
+// siteFilter returns a check of last boot IPs against the caller's sites, or
+// nil when the caller isn't site-scoped.
+func (s *Server) siteFilter(r *http.Request) (func(ip string) bool, error) {
+	_, claims, err := s.verifyAuth(r)
+	if err != nil { return nil, nil }
+	scope := s.claimsSites(claims)
+	if scope == nil { return nil, nil }
+	sites, err := s.listSites()
+	if err != nil { return nil, err }
+	return func(ip string) bool {
+		st := matchSite(sites, net.ParseIP(ip))
+		return st != nil && containsString(scope, st.ID)
+	}, nil
+}
+
+// siteMACs returns the machines in the caller's sites for filtering lists in
+// SQL, or nil when the caller isn't site-scoped.
+func (s *Server) siteMACs(r *http.Request) ([]string, error) {
+	inScope, err := s.siteFilter(r)
+	if inScope == nil || err != nil { return nil, err }
+	rows, err := s.DB.Query(`SELECT mac, COALESCE(last_boot_ip,'') FROM machines`)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := []string{}
+	for rows.Next() {
+		var mac, ip string
+		if err := rows.Scan(&mac, &ip); err != nil { return nil, err }
+		if inScope(ip) { out = append(out, mac) }
+	}
+	return out, rows.Err()
+}
+
+func routeIn(path string, routes []string) bool {
+	for _, p := range routes {
+		if path == p || strings.HasPrefix(path, p+"/") { return true }
+	}
+	return false
+}
+
+// checkSiteScope is requireRole's check for site-scoped callers: the route
+// must be one they may use and every machine the request names must be in
+// their sites.
+func (s *Server) checkSiteScope(w http.ResponseWriter, r *http.Request, scope []string) bool {
+	path := r.URL.Path
+	if !routeIn(path, siteScopedRoutes) || path == "/api/v1/machines/import" {
+		if r.Method == http.MethodGet && routeIn(path, siteReadableRoutes) { return true }
+		http.Error(w, "forbidden: site admins can only manage machines, boot profiles and deployments", 403)
+		return false
+	}
+	if path == "/api/v1/boot_profiles" { return s.checkSiteProfile(w, r, scope) }
+	refs, deps := siteScopeTargets(r)
+	if _, ok := jsonField(r, "group_id"); ok {
+		http.Error(w, "forbidden: machine groups span sites; assign machines instead", 403)
+		return false
+	}
+	if v, ok := jsonField(r, "boot_profile"); ok {
+		var ref string
+		if json.Unmarshal(v, &ref) == nil && !s.profileInScope(ref, scope, true) {
+			http.Error(w, "forbidden: boot profile "+ref+" belongs to another site", 403)
+			return false
+		}
+	}
+	for _, id := range deps {
+		var mac string
+		if err := s.DB.QueryRow(`SELECT mac FROM deployments WHERE id=?`, id).Scan(&mac); err == nil { refs = append(refs, mac) }
+	}
+	if len(refs) == 0 { return true }
+	sites, err := s.listSites()
+	if err != nil { http.Error(w, err.Error(), 500); return false }
+	for _, ref := range refs {
+		var ip string
+		err := s.DB.QueryRow(`SELECT COALESCE(last_boot_ip,'') FROM machines WHERE mac=? OR uuid=NULLIF(?,'') OR serial=NULLIF(?,'') LIMIT 1`, normalizeMAC(ref), normalizeUUID(ref), normalizeSerial(ref)).Scan(&ip)
+		if errors.Is(err, sql.ErrNoRows) { continue }
+		if err != nil { http.Error(w, err.Error(), 500); return false }
+		if st := matchSite(sites, net.ParseIP(ip)); st == nil || !containsString(scope, st.ID) {
+			http.Error(w, "forbidden: machine "+ref+" is outside your sites", 403)
+			return false
+		}
+	}
+	return true
+}
+
+// profileInScope reports whether a boot profile (or boot entry) belongs to
+// one of scope's sites, or is global and global is acceptable.
+func (s *Server) profileInScope(ref string, scope []string, global bool) bool {
+	var site string
+	if err := s.DB.QueryRow(`SELECT COALESCE(site_id,'') FROM boot_profiles WHERE id=?`, ref).Scan(&site); err != nil { return global }
+	if site == "" { return global }
+	return containsString(scope, site)
+}
+
+// checkSiteProfile lets site admins create, change and delete only the boot
+// profiles of their own sites, never the default.
+func (s *Server) checkSiteProfile(w http.ResponseWriter, r *http.Request, scope []string) bool {
+	if r.Method == http.MethodGet { return true }
+	var id, site string
+	var isDefault bool
+	if v, ok := jsonField(r, "id"); ok { _ = json.Unmarshal(v, &id) }
+	if v, ok := jsonField(r, "site_id"); ok { _ = json.Unmarshal(v, &site) }
+	if v, ok := jsonField(r, "is_default"); ok { _ = json.Unmarshal(v, &isDefault) }
+	if r.Method != http.MethodPost && !s.profileInScope(id, scope, false) {
+		http.Error(w, "forbidden: boot profile belongs to another site or to all", 403)
+		return false
+	}
+	if r.Method != http.MethodDelete && !containsString(scope, site) {
+		http.Error(w, "forbidden: site_id must be one of your sites", 403)
+		return false
+	}
+	if isDefault { http.Error(w, "forbidden: only global admins set the default profile", 403); return false }
+	return true
+}
+
+// siteScopeTargets collects the machines (mac, uuid or serial) and
+// deployments a request names in its path, query and JSON body. The body is
+// put back for the handler.
+func siteScopeTargets(r *http.Request) (refs, deps []string) {
+	if ref, ok := strings.CutPrefix(r.URL.Path, "/api/v1/machines/"); ok {
+		ref, _ = strings.CutSuffix(strings.Trim(ref, "/"), "/wake")
+		if ref != "" { refs = append(refs, ref) }
+	}
+	q := r.URL.Query()
+	refs = append(refs, q["mac"]...)
+	deps = append(deps, q["deployment_id"]...)
+	for _, id := range q["id"] {
+		if strings.HasPrefix(id, "dep-") { deps = append(deps, id) }
+	}
+	if v, ok := jsonField(r, "mac"); ok {
+		var mac string
+		if json.Unmarshal(v, &mac) == nil && mac != "" { refs = append(refs, mac) }
+	}
+	if v, ok := jsonField(r, "macs"); ok {
+		var macs []string
+		if json.Unmarshal(v, &macs) == nil { refs = append(refs, macs...) }
+	}
+	for _, k := range []string{"deployment_id", "id"} {
+		if v, ok := jsonField(r, k); ok {
+			var id string
+			if json.Unmarshal(v, &id) == nil && (k == "deployment_id" || strings.HasPrefix(id, "dep-")) { deps = append(deps, id) }
+		}
+	}
+	return refs, deps
+}
+
+// jsonField reads one top-level field of a JSON request body, leaving the
+// body readable.
+func jsonField(r *http.Request, key string) (json.RawMessage, bool) {
+	if r.Body == nil || r.Method == http.MethodGet { return nil, false }
+	raw, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(raw), r.Body))
+	if err != nil { return nil, false }
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(raw, &fields) != nil { return nil, false }
+	v, ok := fields[key]
+	return v, ok && string(v) != "null"
+}
+
+func containsString(list []string, v string) bool {
+	for _, x := range list {
+		if x == v { return true }
+	}
+	return false
+}
+
+func (s *Server) siteScopeRoutes() {
+	// GET ?id= a user's sites; PUT {"id": 3, "site_ids": ["campus-a"]} sets
+	// them, an empty list making the user global again
+	s.Mux.HandleFunc("/api/v1/admin/users/sites", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+			var id int64
+			if err := s.DB.QueryRow(`SELECT id FROM users WHERE id=?`, r.URL.Query().Get("id")).Scan(&id); err != nil { http.NotFound(w, r); return }
+			sites, err := s.userSites(id)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			writeJSON(w, 200, map[string]any{"id": id, "site_ids": sites})
+		case http.MethodPut:
+			var body struct {
+				ID      int64    `json:"id"`
+				SiteIDs []string `json:"site_ids"`
+			}
+			if !decodeJSON(w, r, &body) { return }
+			var role string
+			if err := s.DB.QueryRow(`SELECT role FROM users WHERE id=?`, body.ID).Scan(&role); err != nil { http.NotFound(w, r); return }
+			var v validator
+			if role == "admin" && len(body.SiteIDs) > 0 { v.add("id", "admins are global; give the user another role first") }
+			sites := []string{}
+			for _, id := range body.SiteIDs {
+				id = strings.TrimSpace(id)
+				if id == "" || containsString(sites, id) { continue }
+				var n int
+				_ = s.DB.QueryRow(`SELECT COUNT(*) FROM sites WHERE id=?`, id).Scan(&n)
+				if n == 0 { v.add("site_ids", "unknown site %q", id) }
+				sites = append(sites, id)
+			}
+			if err := v.err(); err != nil { badRequest(w, err); return }
+			tx, err := s.DB.Begin()
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer tx.Rollback()
+			if _, err := tx.Exec(`DELETE FROM user_sites WHERE user_id=?`, body.ID); err != nil { http.Error(w, err.Error(), 500); return }
+			for _, id := range sites {
+				if _, err := tx.Exec(`INSERT INTO user_sites (user_id, site_id) VALUES (?,?)`, body.ID, id); err != nil { http.Error(w, err.Error(), 500); return }
+			}
+			if err := tx.Commit(); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "site_scope", "user", map[string]any{"id": body.ID, "site_ids": sites})
+			writeJSON(w, 200, map[string]any{"id": body.ID, "site_ids": sites})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+}
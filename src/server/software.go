@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ---- Software sets (winget / Chocolatey) ----
+// A software set lists package ids for winget or choco. Task sequences attach
+// one with an "install_software" step; the agent fetches the rendered
+// PowerShell script, runs it, and the script posts per-package results back.
+type SoftwarePackage struct {
+	Manager string `json:"manager"` // winget|choco
+	ID      string `json:"id"`
+	Version string `json:"version,omitempty"`
+}
+
+func initSoftware(db *sql.DB) error {
+	ddl1 := `CREATE TABLE IF NOT EXISTS software_sets (
+		id TEXT PRIMARY KEY,
+		name TEXT UNIQUE NOT NULL,
+		packages TEXT NOT NULL,
+		updated TEXT NOT NULL
+	);`
+	ddl2 := `CREATE TABLE IF NOT EXISTS software_installs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		mac TEXT NOT NULL,
+		deployment_id TEXT,
+		set_id TEXT NOT NULL,
+		manager TEXT NOT NULL,
+		package TEXT NOT NULL,
+		version TEXT,
+		exit_code INTEGER NOT NULL,
+		ok INTEGER NOT NULL,
+		reported_at TEXT NOT NULL
+	);`
+	ddl3 := `CREATE INDEX IF NOT EXISTS software_installs_mac ON software_installs (mac, reported_at);`
+	for _, ddl := range []string{ddl1, ddl2, ddl3} {
+		if _, err := db.Exec(ddl); err != nil { return err }
+	}
+	return nil
+}
+
+// packageIDPattern keeps package ids and versions safe to splice into the
+// rendered PowerShell without quoting games.
+var packageIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`)
+
+func validatePackages(pkgs []SoftwarePackage) error {
+	if len(pkgs) == 0 { return fmt.Errorf("at least one package required") }
+	for i, p := range pkgs {
+		if p.Manager != "winget" && p.Manager != "choco" { return fmt.Errorf("package %d: manager must be winget or choco", i+1) }
+		if !packageIDPattern.MatchString(p.ID) { return fmt.Errorf("package %d: invalid id %q", i+1, p.ID) }
+		if p.Version != "" && !packageIDPattern.MatchString(p.Version) { return fmt.Errorf("package %d: invalid version %q", i+1, p.Version) }
+	}
+	return nil
+}
+
+func (s *Server) softwareSet(id string) (string, []SoftwarePackage, error) {
+	var name, js string
+	if err := s.DB.QueryRow(`SELECT name, packages FROM software_sets WHERE id=?`, id).Scan(&name, &js); err != nil { return "", nil, err }
+	var pkgs []SoftwarePackage
+	err := json.Unmarshal([]byte(js), &pkgs)
+	return name, pkgs, err
+}
+
+// renderInstallScript produces a PowerShell script that installs every package
+// and reports the exit codes to /api/v1/agent/software/results.
+func renderInstallScript(setID, deploymentID, mac string, pkgs []SoftwarePackage) string {
+	var b strings.Builder
+	b.WriteString("$ErrorActionPreference = 'Continue'\n$results = @()\n")
+	for _, p := range pkgs {
+		cmd := "winget install --id " + p.ID + " -e --silent --accept-package-agreements --accept-source-agreements"
+		if p.Manager == "choco" { cmd = "choco install " + p.ID + " -y --no-progress" }
+		if p.Version != "" { cmd += " --version " + p.Version }
+		fmt.Fprintf(&b, "& %s\n$results += @{ manager = '%s'; id = '%s'; version = '%s'; exit_code = $LASTEXITCODE }\n", cmd, p.Manager, p.ID, p.Version)
+	}
+	fmt.Fprintf(&b, "$body = @{ mac = '%s'; deployment_id = '%s'; set_id = '%s'; results = $results } | ConvertTo-Json -Depth 4\n", mac, deploymentID, setID)
+	fmt.Fprintf(&b, "Invoke-RestMethod -Method Post -Uri \"%s/api/v1/agent/software/results\" -ContentType 'application/json' -Headers @{ 'X-Bootah-Agent-Token' = $env:BOOTAH_AGENT_TOKEN } -Body $body\n",
+		getenv("BOOTAH_PUBLIC_URL", ""))
+	return b.String()
+}
+
+func (s *Server) softwareRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/software_sets", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := s.DB.Query(`SELECT id, name, packages, updated FROM software_sets ORDER BY name`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			var out []map[string]any
+			for rows.Next() {
+				var id, name, pkgs, updated string
+				if err := rows.Scan(&id, &name, &pkgs, &updated); err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, map[string]any{"id": id, "name": name, "packages": json.RawMessage(pkgs), "updated": updated})
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPost, http.MethodPut:
+			var body struct {
+				ID       string            `json:"id"`
+				Name     string            `json:"name"`
+				Packages []SoftwarePackage `json:"packages"`
+			}
+			if !decodeJSON(w, r, &body) { return }
+			if strings.TrimSpace(body.Name) == "" { http.Error(w, "name required", 400); return }
+			if err := validatePackages(body.Packages); err != nil { badRequest(w, err); return }
+			js, _ := json.Marshal(body.Packages)
+			now := time.Now().Format(time.RFC3339)
+			if r.Method == http.MethodPut {
+				res, err := s.DB.Exec(`UPDATE software_sets SET name=?, packages=?, updated=? WHERE id=?`, body.Name, string(js), now, body.ID)
+				if err != nil { http.Error(w, err.Error(), 500); return }
+				if n, _ := res.RowsAffected(); n == 0 { http.NotFound(w, r); return }
+				s.audit(s.actorID(r), "update", "software_set", map[string]any{"id": body.ID, "name": body.Name})
+				writeJSON(w, 200, map[string]any{"id": body.ID})
+				return
+			}
+			id := "sw-" + genID()
+			if _, err := s.DB.Exec(`INSERT INTO software_sets (id, name, packages, updated) VALUES (?,?,?,?)`, id, body.Name, string(js), now); err != nil {
+				http.Error(w, err.Error(), 500); return
+			}
+			s.audit(s.actorID(r), "create", "software_set", map[string]any{"id": id, "name": body.Name})
+			writeJSON(w, 201, map[string]any{"id": id})
+		case http.MethodDelete:
+			var body struct{ ID string `json:"id"` }
+			if !decodeJSON(w, r, &body) { return }
+			if _, err := s.DB.Exec(`DELETE FROM software_sets WHERE id=?`, body.ID); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "delete", "software_set", map[string]any{"id": body.ID})
+			writeJSON(w, 200, map[string]any{"deleted": body.ID})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// Agent: rendered install script for an install_software step (?set=&mac=&deployment=)
+	s.Mux.HandleFunc("/api/v1/agent/software/script", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireAgent(w, r) { return }
+		q := r.URL.Query()
+		_, pkgs, err := s.softwareSet(q.Get("set"))
+		if err != nil {
+			if err == sql.ErrNoRows { http.NotFound(w, r); return }
+			http.Error(w, err.Error(), 500); return
+		}
+		mac := normalizeMAC(q.Get("mac"))
+		if !packageIDPattern.MatchString(strings.ReplaceAll(mac, ":", "")) { http.Error(w, "mac required", 400); return }
+		dep := q.Get("deployment")
+		if dep != "" && !packageIDPattern.MatchString(dep) { http.Error(w, "invalid deployment", 400); return }
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(renderInstallScript(q.Get("set"), dep, mac, pkgs)))
+	})
+
+	// Agent: per-package installation results
+	s.Mux.HandleFunc("/api/v1/agent/software/results", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		if !s.requireAgent(w, r) { return }
+		var body struct {
+			MAC          string `json:"mac"`
+			DeploymentID string `json:"deployment_id"`
+			SetID        string `json:"set_id"`
+			Results      []struct {
+				Manager  string `json:"manager"`
+				ID       string `json:"id"`
+				Version  string `json:"version"`
+				ExitCode int    `json:"exit_code"`
+			} `json:"results"`
+		}
+		if !decodeJSON(w, r, &body) { return }
+		mac := normalizeMAC(body.MAC)
+		if mac == "" || body.SetID == "" { http.Error(w, "mac and set_id required", 400); return }
+		if !s.requireAgentFor(w, r, mac) { return }
+		now := time.Now().Format(time.RFC3339)
+		var failed []string
+		for _, res := range body.Results {
+			// winget reports "already installed" as a non-zero code; choco uses 3010 for reboot required.
+			ok := res.ExitCode == 0 || res.ExitCode == 3010 || (res.Manager == "winget" && res.ExitCode == -1978335189)
+			if !ok { failed = append(failed, res.ID) }
+			_, err := s.DB.Exec(`INSERT INTO software_installs (mac, deployment_id, set_id, manager, package, version, exit_code, ok, reported_at) VALUES (?,?,?,?,?,?,?,?,?)`,
+				mac, body.DeploymentID, body.SetID, res.Manager, res.ID, res.Version, res.ExitCode, ok, now)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+		}
+		if len(failed) > 0 {
+			s.notify("warning", "software_install_failed", fmt.Sprintf("%d package(s) failed to install on %s", len(failed), mac), map[string]any{"mac": mac, "set_id": body.SetID, "packages": failed})
+		}
+		writeJSON(w, 201, map[string]any{"ok": true, "failed": failed})
+	})
+
+	// Installation results per machine (?mac=)
+	s.Mux.HandleFunc("/api/v1/admin/software/installs", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		rows, err := s.DB.Query(`SELECT mac, COALESCE(deployment_id,''), set_id, manager, package, COALESCE(version,''), exit_code, ok, reported_at FROM software_installs WHERE mac=? ORDER BY id DESC LIMIT 500`,
+			normalizeMAC(r.URL.Query().Get("mac")))
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		defer rows.Close()
+		var out []map[string]any
+		for rows.Next() {
+			var mac, dep, set, manager, pkg, version, at string; var code int; var ok bool
+			if err := rows.Scan(&mac, &dep, &set, &manager, &pkg, &version, &code, &ok, &at); err != nil { http.Error(w, err.Error(), 500); return }
+			out = append(out, map[string]any{"mac": mac, "deployment_id": dep, "set_id": set, "manager": manager, "package": pkg, "version": version, "exit_code": code, "ok": ok, "reported_at": at})
+		}
+		writeJSON(w, 200, out)
+	})
+}
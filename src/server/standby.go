@@ -0,0 +1,617 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ---- Warm standby ----
+// A second instance started with BOOTAH_MODE=standby takes no part in boot
+// or management traffic (its health checks answer 503 so load balancers skip
+// it) and waits to be promoted. Both sides share BOOTAH_STANDBY_TOKEN.
+//
+// With SQLite the primary switches the database to WAL mode and its leader
+// ships each BOOTAH_STANDBY_URLS entry the log frames committed since the
+// last round, every BOOTAH_STANDBY_INTERVAL (default 10s, which bounds how
+// much a failover can lose). The standby journals each batch, writes its
+// pages into the database at BOOTAH_DB_PATH and records its position in
+// standby.position. A standby without a position, one that fell behind
+// across a log restart, and every standby once each
+// BOOTAH_STANDBY_FULL_INTERVAL (default 1h) gets a full snapshot instead: a
+// copy of the database file with the log laid over it, gzipped and SHA-256
+// checked, which the standby verifies and swaps in. With PostgreSQL nothing
+// is shipped: run the standby against a streaming replica and let
+// BOOTAH_STANDBY_PROMOTE_CMD promote it (pg_ctl promote, or psql -c 'SELECT
+// pg_promote()'; the command runs under sh -c, so shell quoting applies).
+// Image blobs are not replicated either; use S3 storage or sync
+// BOOTAH_IMAGES_DIR separately.
+//
+//	GET  /api/v1/standby/status    the latest snapshot and WAL position
+//	                               (standby token)
+//	POST /api/v1/standby/promote   run BOOTAH_STANDBY_PROMOTE_CMD if set
+//	                               (e.g. to move a floating IP), then start
+//	                               as the primary
+//
+// A promoted standby leaves a standby.promoted file next to the database and
+// stays primary across restarts until it is removed. It answers snapshots
+// and log batches with 409, which the old primary raises as an error notification: stop
+// the old primary before promoting, and make it the new standby afterwards.
+// GET /api/v1/admin/standby shows shipping status on the primary.
+func standbyMode() bool {
+	if strings.ToLower(getenv("BOOTAH_MODE", "")) != "standby" { return false }
+	_, err := os.Stat(standbyMarker())
+	return errors.Is(err, os.ErrNotExist)
+}
+
+func standbyMarker() string { return standbyFile("standby.promoted") }
+
+// standbyFile is the path of a standby bookkeeping file next to the database.
+func standbyFile(name string) string {
+	return filepath.Join(filepath.Dir(getenv("BOOTAH_DB_PATH", "./data/bootah.db")), name)
+}
+
+func standbyAuthorized(r *http.Request) bool {
+	token := getenv("BOOTAH_STANDBY_TOKEN", "")
+	return token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+// promotion describes how this process became the primary, audited once the
+// server is up; nil when it started as one.
+var promotion map[string]any
+
+type standbyState struct {
+	mu         sync.Mutex
+	snapshotAt string
+	sha        string
+	bytes      int64
+	from       string
+	pos        string // WAL position of the database; "" until a snapshot sets one
+	appliedAt  string
+	promoted   chan struct{}
+}
+
+// waitAsStandby serves the standby endpoints on port until the instance is
+// promoted, then returns so startup continues as a primary. It exits on
+// SIGTERM.
+func waitAsStandby(port string) error {
+	if getenv("BOOTAH_STANDBY_TOKEN", "") == "" { return errors.New("BOOTAH_MODE=standby needs BOOTAH_STANDBY_TOKEN") }
+	sb := &standbyState{promoted: make(chan struct{})}
+	if st, err := os.Stat(getenv("BOOTAH_DB_PATH", "./data/bootah.db")); err == nil && dbDriverName() == "sqlite" {
+		sb.snapshotAt, sb.bytes = st.ModTime().UTC().Format(time.RFC3339), st.Size()
+		pos, err := replayStandbyWAL()
+		if err != nil { return fmt.Errorf("standby: replaying WAL batch: %w", err) }
+		if pos == "" {
+			if b, err := os.ReadFile(standbyFile("standby.position")); err == nil { pos = strings.TrimSpace(string(b)) }
+		}
+		sb.pos = pos
+	}
+	mux := http.NewServeMux()
+	health := func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"ok": false, "standby": true, "ts": time.Now()})
+	}
+	mux.HandleFunc("/api/health", health)
+	mux.HandleFunc("/api/v1/health", health)
+	mux.HandleFunc("/api/v1/standby/snapshot", sb.handleSnapshot)
+	mux.HandleFunc("/api/v1/standby/status", func(w http.ResponseWriter, r *http.Request) {
+		if !standbyAuthorized(r) { http.Error(w, "unauthorized", 401); return }
+		sb.mu.Lock()
+		defer sb.mu.Unlock()
+		writeJSON(w, 200, map[string]any{"role": "standby", "driver": dbDriverName(), "snapshot_at": sb.snapshotAt, "sha256": sb.sha, "bytes": sb.bytes, "from": sb.from,
+			"wal_position": sb.pos, "wal_applied_at": sb.appliedAt})
+	})
+	mux.HandleFunc("/api/v1/standby/wal", sb.handleWAL)
+	mux.HandleFunc("/api/v1/standby/promote", sb.handlePromote)
+	servers, err := serveHTTP(loggingMiddleware(mux), port)
+	if err != nil { return err }
+	log.Printf("warm standby: waiting for promotion (POST /api/v1/standby/promote)")
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	select {
+	case <-stop:
+		log.Println("Bootah standby stopped")
+		os.Exit(0)
+	case <-sb.promoted:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, srv := range servers { _ = srv.Shutdown(ctx) }
+	log.Printf("warm standby: promoted, starting as primary")
+	return nil
+}
+
+// dbDriverName is BOOTAH_DB_DRIVER before openStore has set dbDriver.
+func dbDriverName() string { return strings.ToLower(getenv("BOOTAH_DB_DRIVER", "sqlite")) }
+
+// handleSnapshot receives a gzipped SQLite snapshot, checks its hash and
+// integrity, and swaps it in for the database file.
+func (sb *standbyState) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !standbyAuthorized(r) { http.Error(w, "unauthorized", 401); return }
+	if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+	if dbDriverName() != "sqlite" { http.Error(w, "PostgreSQL standbys replicate through PostgreSQL", 409); return }
+	want := strings.ToLower(r.Header.Get("X-Bootah-Snapshot-SHA256"))
+	if want == "" { http.Error(w, "X-Bootah-Snapshot-SHA256 required", 400); return }
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	select {
+	case <-sb.promoted:
+		http.Error(w, "promoted: this instance is a primary", 409)
+		return
+	default:
+	}
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil { http.Error(w, "snapshot must be gzipped: "+err.Error(), 400); return }
+	dbPath := getenv("BOOTAH_DB_PATH", "./data/bootah.db")
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0o755); err != nil { http.Error(w, err.Error(), 500); return }
+	f, err := os.CreateTemp(filepath.Dir(dbPath), ".standby-*.db")
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), gz)
+	if cerr := f.Close(); err == nil { err = cerr }
+	if err != nil { http.Error(w, "reading snapshot: "+err.Error(), 400); return }
+	sum := hex.EncodeToString(h.Sum(nil))
+	if sum != want { http.Error(w, "snapshot checksum mismatch", 400); return }
+	if err := checkSnapshot(tmp); err != nil { http.Error(w, "snapshot failed integrity check: "+err.Error(), 400); return }
+	// the old position and any unapplied batch belong to the database being
+	// replaced
+	sb.pos = ""
+	for _, name := range []string{"standby.position", "standby.wal"} {
+		if err := os.Remove(standbyFile(name)); err != nil && !errors.Is(err, os.ErrNotExist) { http.Error(w, err.Error(), 500); return }
+	}
+	if err := os.Rename(tmp, dbPath); err != nil { http.Error(w, err.Error(), 500); return }
+	_ = os.Remove(dbPath + "-wal")
+	_ = os.Remove(dbPath + "-shm")
+	sb.snapshotAt, sb.sha, sb.bytes, sb.from = time.Now().UTC().Format(time.RFC3339), sum, n, r.Header.Get("X-Bootah-Node")
+	if pos := r.Header.Get("X-Bootah-WAL-Position"); pos != "" {
+		if err := os.WriteFile(standbyFile("standby.position"), []byte(pos+"\n"), 0o644); err != nil { http.Error(w, err.Error(), 500); return }
+		sb.pos = pos
+	}
+	writeJSON(w, 200, map[string]any{"sha256": sum, "bytes": n, "wal_position": sb.pos})
+}
+
+// handleWAL applies a batch of log frames on top of the database. The batch
+// names the position it follows; a standby anywhere else answers 409 and the
+// primary sends a full snapshot instead.
+func (sb *standbyState) handleWAL(w http.ResponseWriter, r *http.Request) {
+	if !standbyAuthorized(r) { http.Error(w, "unauthorized", 401); return }
+	if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+	if dbDriverName() != "sqlite" { http.Error(w, "PostgreSQL standbys replicate through PostgreSQL", 409); return }
+	want, base, pos := strings.ToLower(r.Header.Get("X-Bootah-Snapshot-SHA256")), r.Header.Get("X-Bootah-WAL-Base"), r.Header.Get("X-Bootah-WAL-Position")
+	pageSize, err := strconv.Atoi(r.Header.Get("X-Bootah-WAL-Page-Size"))
+	if want == "" || base == "" || pos == "" || err != nil || pageSize < 512 {
+		http.Error(w, "X-Bootah-Snapshot-SHA256, X-Bootah-WAL-Base, X-Bootah-WAL-Position and X-Bootah-WAL-Page-Size required", 400)
+		return
+	}
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	select {
+	case <-sb.promoted:
+		http.Error(w, "promoted: this instance is a primary", 409)
+		return
+	default:
+	}
+	if sb.pos != base { http.Error(w, fmt.Sprintf("out of sync: at %q, batch follows %q", sb.pos, base), 409); return }
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil { http.Error(w, "batch must be gzipped: "+err.Error(), 400); return }
+	frames, err := io.ReadAll(gz)
+	if err != nil { http.Error(w, "reading batch: "+err.Error(), 400); return }
+	if sum := sha256.Sum256(frames); hex.EncodeToString(sum[:]) != want { http.Error(w, "batch checksum mismatch", 400); return }
+	if len(frames)%(walFrameHeaderSize+pageSize) != 0 { http.Error(w, "batch is not whole frames", 400); return }
+	if err := journalStandbyWAL(pos, pageSize, frames); err != nil { http.Error(w, err.Error(), 500); return }
+	if _, err := replayStandbyWAL(); err != nil {
+		// the journal stays for the next start; until then take snapshots only
+		sb.pos = ""
+		http.Error(w, "applying batch: "+err.Error(), 500)
+		return
+	}
+	sb.pos, sb.appliedAt, sb.from = pos, time.Now().UTC().Format(time.RFC3339), r.Header.Get("X-Bootah-Node")
+	writeJSON(w, 200, map[string]any{"wal_position": pos, "bytes": len(frames)})
+}
+
+// journalStandbyWAL saves a batch next to the database before it is applied,
+// so a standby that stops part way through finishes it on the next start.
+func journalStandbyWAL(pos string, pageSize int, frames []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(standbyFile("standby.wal")), ".standby-wal-*")
+	if err != nil { return err }
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	_, err = fmt.Fprintf(f, "%s %d\n", pos, pageSize)
+	if err == nil { _, err = f.Write(frames) }
+	if err == nil { err = f.Sync() }
+	if cerr := f.Close(); err == nil { err = cerr }
+	if err != nil { return err }
+	return os.Rename(tmp, standbyFile("standby.wal"))
+}
+
+// replayStandbyWAL applies the journaled batch, if any, records its position
+// and returns it.
+func replayStandbyWAL() (string, error) {
+	b, err := os.ReadFile(standbyFile("standby.wal"))
+	if errors.Is(err, os.ErrNotExist) { return "", nil }
+	if err != nil { return "", err }
+	line, frames, _ := bytes.Cut(b, []byte("\n"))
+	var pos string
+	var pageSize int
+	if _, err := fmt.Sscanf(string(line), "%s %d", &pos, &pageSize); err != nil { return "", fmt.Errorf("standby.wal: %w", err) }
+	f, err := os.OpenFile(getenv("BOOTAH_DB_PATH", "./data/bootah.db"), os.O_RDWR, 0)
+	if err != nil { return "", err }
+	err = applyWAL(f, frames, pageSize)
+	if err == nil { err = f.Sync() }
+	if cerr := f.Close(); err == nil { err = cerr }
+	if err != nil { return "", err }
+	if err := os.WriteFile(standbyFile("standby.position"), []byte(pos+"\n"), 0o644); err != nil { return "", err }
+	return pos, os.Remove(standbyFile("standby.wal"))
+}
+
+func checkSnapshot(path string) error {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil { return err }
+	defer db.Close()
+	var res string
+	if err := db.QueryRow(`PRAGMA quick_check`).Scan(&res); err != nil { return err }
+	if res != "ok" { return errors.New(res) }
+	return nil
+}
+
+func (sb *standbyState) handlePromote(w http.ResponseWriter, r *http.Request) {
+	if !standbyAuthorized(r) { http.Error(w, "unauthorized", 401); return }
+	if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	select {
+	case <-sb.promoted:
+		http.Error(w, "already promoted", 409)
+		return
+	default:
+	}
+	if dbDriverName() == "sqlite" {
+		if sb.snapshotAt == "" { http.Error(w, "no snapshot received yet", 409); return }
+		// a database built from log batches is checked once, here
+		if err := checkSnapshot(getenv("BOOTAH_DB_PATH", "./data/bootah.db")); err != nil { http.Error(w, "database failed integrity check: "+err.Error(), 500); return }
+	}
+	if cmd := strings.TrimSpace(getenv("BOOTAH_STANDBY_PROMOTE_CMD", "")); cmd != "" {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+		defer cancel()
+		if out, err := exec.CommandContext(ctx, "sh", "-c", cmd).CombinedOutput(); err != nil {
+			http.Error(w, fmt.Sprintf("promote command: %v: %s", err, strings.TrimSpace(string(out))), 500)
+			return
+		}
+	}
+	// the old primary's leases would otherwise hold the schedulers until
+	// they expire
+	db, err := openStore()
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	_, err = db.Exec(`DELETE FROM cluster_leases`)
+	db.Close()
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	if err := os.WriteFile(standbyMarker(), []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0o644); err != nil { http.Error(w, err.Error(), 500); return }
+	promotion = map[string]any{"snapshot_at": sb.snapshotAt, "sha256": sb.sha, "from": sb.from, "wal_position": sb.pos, "wal_applied_at": sb.appliedAt}
+	close(sb.promoted)
+	writeJSON(w, 200, map[string]any{"promoted": true, "snapshot_at": sb.snapshotAt})
+}
+
+// ---- Shipping (primary) ----
+
+type standbyTarget struct {
+	url string
+
+	mu        sync.Mutex
+	shipped   int64
+	failed    int64
+	bytes     int64
+	lastError string
+	lastAt    string
+	shippedAt string
+	fenced    bool
+	pos       string    // WAL position the standby holds; "" to send a full snapshot
+	fullAt    time.Time // last full snapshot
+}
+
+var standbyTargets []*standbyTarget
+
+// loadStandbyTargets reads BOOTAH_STANDBY_URLS.
+func loadStandbyTargets() error {
+	standbyTargets = nil
+	for _, u := range splitList(getenv("BOOTAH_STANDBY_URLS", "")) {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") { return fmt.Errorf("BOOTAH_STANDBY_URLS: %q is not an http(s) URL", u) }
+		standbyTargets = append(standbyTargets, &standbyTarget{url: strings.TrimSuffix(u, "/")})
+	}
+	if len(standbyTargets) > 0 && getenv("BOOTAH_STANDBY_TOKEN", "") == "" { return errors.New("BOOTAH_STANDBY_URLS needs BOOTAH_STANDBY_TOKEN") }
+	return nil
+}
+
+// walShipper is the leader's view of the database's write-ahead log between
+// shipping rounds.
+type walShipper struct {
+	enabled bool
+	reader  *sql.Tx // pins the log at the last round's snapshot
+	gen     string  // generation and committed frames read last round
+	frames  int
+	prev    string // position the previous generation ended at
+}
+
+var standbyWAL walShipper
+
+func (s *Server) startStandbyShipping(ctx context.Context) {
+	if len(standbyTargets) == 0 { return }
+	if dbDriver != "sqlite" { log.Printf("standby: BOOTAH_STANDBY_URLS ignored with %s; replicate the database instead", dbDriver); return }
+	var mode string
+	if err := s.DB.QueryRowContext(ctx, `PRAGMA journal_mode=WAL`).Scan(&mode); err != nil || mode != "wal" {
+		log.Printf("standby: database not in WAL mode (%s, %v); shipping full snapshots", mode, err)
+	} else if n := s.DB.Stats().MaxOpenConnections; n > 0 && n < 3 {
+		log.Printf("standby: BOOTAH_DB_MAX_OPEN_CONNS=%d leaves no connection to pin the WAL; shipping full snapshots", n)
+	} else {
+		standbyWAL.enabled = true
+	}
+	go s.runAsLeader(ctx, "standby-ship", envDuration("BOOTAH_STANDBY_INTERVAL", 10*time.Second), func() { s.shipStandbys(ctx) })
+}
+
+func walPos(gen string, frames int) string { return gen + ":" + strconv.Itoa(frames) }
+
+// shipStandbys sends every standby the WAL frames committed since its
+// position, or a full snapshot when it has none, is in another generation
+// or is due one.
+//
+// Each round opens a read transaction before reading the log and keeps it
+// until the next round has read the log in turn. SQLite neither checkpoints
+// frames past a reader's snapshot nor restarts the log under it, so a
+// generation can only end with frames this round has already read, and the
+// next generation starts from exactly the database those frames produce.
+func (s *Server) shipStandbys(ctx context.Context) {
+	ws := &standbyWAL
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil { log.Printf("standby: %v", err); return }
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master`).Scan(new(int)); err != nil { tx.Rollback(); log.Printf("standby: %v", err); return }
+	dbPath := getenv("BOOTAH_DB_PATH", "./data/bootah.db")
+	wal, err := os.ReadFile(dbPath + "-wal")
+	if errors.Is(err, os.ErrNotExist) { err = nil }
+	var gen string
+	var pageSize, n int
+	if err == nil { gen, pageSize, n, err = parseWAL(wal) }
+	if err != nil { tx.Rollback(); log.Printf("standby: reading WAL: %v", err); return }
+	if !ws.enabled {
+		// without a pinned log every round is a full snapshot, and in
+		// rollback-journal mode the reader holds off writers while it's taken
+		defer tx.Rollback()
+	} else {
+		if ws.reader != nil {
+			ws.reader.Rollback()
+			if gen != ws.gen { ws.prev = walPos(ws.gen, ws.frames) }
+		} else {
+			ws.prev = ""
+		}
+		ws.reader, ws.gen, ws.frames = tx, gen, n
+	}
+	var frames []byte
+	if n > 0 { frames = wal[walHeaderSize : walHeaderSize+n*(walFrameHeaderSize+pageSize)] }
+	pos := walPos(gen, n)
+
+	snapshot, sum := "", ""
+	var size int64
+	defer func() { if snapshot != "" { os.Remove(snapshot) } }()
+	full := func(t *standbyTarget) (int64, error) {
+		if snapshot == "" {
+			var err error
+			if snapshot, sum, size, err = buildSnapshot(dbPath, frames, pageSize); err != nil { snapshot = ""; return 0, err }
+		}
+		f, err := os.Open(snapshot)
+		if err != nil { return 0, err }
+		defer f.Close()
+		return size, t.post(ctx, "snapshot", f, map[string]string{"Content-Type": "application/vnd.sqlite3", "X-Bootah-Snapshot-SHA256": sum, "X-Bootah-WAL-Position": pos})
+	}
+	fullEvery := envDuration("BOOTAH_STANDBY_FULL_INTERVAL", time.Hour)
+	for _, t := range standbyTargets {
+		t.mu.Lock()
+		at, fullAt := t.pos, t.fullAt
+		t.mu.Unlock()
+		var sent int64
+		var err error
+		isFull := true
+		if from, ok := ws.deltaFrom(at); ok && time.Since(fullAt) < fullEvery {
+			if from == n && strings.HasPrefix(at, gen+":") { continue } // nothing new
+			isFull = false
+			batch := frames[from*(walFrameHeaderSize+pageSize):]
+			h := sha256.Sum256(batch)
+			sent = int64(len(batch))
+			err = t.post(ctx, "wal", bytes.NewReader(batch), map[string]string{"Content-Type": "application/octet-stream", "X-Bootah-Snapshot-SHA256": hex.EncodeToString(h[:]),
+				"X-Bootah-WAL-Base": at, "X-Bootah-WAL-Position": pos, "X-Bootah-WAL-Page-Size": strconv.Itoa(pageSize)})
+			if errors.Is(err, errStandbyOutOfSync) { isFull = true; sent, err = full(t) }
+		} else {
+			sent, err = full(t)
+		}
+		t.mu.Lock()
+		t.lastAt = time.Now().UTC().Format(time.RFC3339)
+		var fenced bool
+		if err != nil {
+			t.failed++
+			t.lastError = err.Error()
+			fenced = errors.Is(err, errStandbyPromoted) && !t.fenced
+			t.fenced = errors.Is(err, errStandbyPromoted)
+			if isFull { t.pos = "" }
+		} else {
+			t.shipped++
+			t.bytes, t.shippedAt, t.lastError, t.fenced, t.pos = sent, t.lastAt, "", false, pos
+			if isFull { t.fullAt = time.Now() }
+		}
+		t.mu.Unlock()
+		if err != nil { log.Printf("standby %s: %v", t.url, err) }
+		if fenced {
+			s.notify("error", "standby_promoted", "Standby "+t.url+" has been promoted while this instance is still running as primary",
+				map[string]any{"url": t.url})
+		}
+	}
+}
+
+// deltaFrom returns the frame a delta to a standby at pos starts from, or
+// false when only a full snapshot will bring it up to date.
+func (ws *walShipper) deltaFrom(pos string) (int, bool) {
+	if !ws.enabled || pos == "" { return 0, false }
+	if pos == ws.prev && ws.prev != walPos(ws.gen, ws.frames) { return 0, true }
+	gen, frames, ok := strings.Cut(pos, ":")
+	n, err := strconv.Atoi(frames)
+	if !ok || err != nil || gen != ws.gen || n < 0 || n > ws.frames { return 0, false }
+	return n, true
+}
+
+// buildSnapshot copies the database file and lays the log's committed frames
+// over it. Pages a concurrent checkpoint copies into the file come from those
+// same frames, so the result is the database as of the last one.
+func buildSnapshot(dbPath string, frames []byte, pageSize int) (path, sum string, size int64, err error) {
+	src, err := os.Open(dbPath)
+	if err != nil { return "", "", 0, err }
+	defer src.Close()
+	f, err := os.CreateTemp(filepath.Dir(dbPath), ".standby-snapshot-*.db")
+	if err != nil { return "", "", 0, err }
+	path = f.Name()
+	defer func() { if err != nil { os.Remove(path) } }()
+	defer f.Close()
+	if _, err = io.Copy(f, src); err != nil { return }
+	if err = applyWAL(f, frames, pageSize); err != nil { return }
+	if _, err = f.Seek(0, io.SeekStart); err != nil { return }
+	h := sha256.New()
+	if size, err = io.Copy(h, f); err != nil { return }
+	return path, hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+var (
+	errStandbyPromoted  = errors.New("standby has been promoted")
+	errStandbyOutOfSync = errors.New("standby is out of sync")
+)
+
+// post sends body gzipped to the standby's endpoint under /api/v1/standby.
+func (t *standbyTarget) post(ctx context.Context, endpoint string, body io.Reader, header map[string]string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, body)
+		if err == nil { err = gz.Close() }
+		pw.CloseWithError(err)
+	}()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url+"/api/v1/standby/"+endpoint, pr)
+	if err != nil { pr.Close(); return err }
+	req.Header.Set("Authorization", "Bearer "+getenv("BOOTAH_STANDBY_TOKEN", ""))
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("X-Bootah-Node", nodeID)
+	for k, v := range header { req.Header.Set(k, v) }
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	switch {
+	case resp.StatusCode == http.StatusConflict && strings.Contains(string(msg), "promoted"):
+		return errStandbyPromoted
+	case resp.StatusCode == http.StatusConflict && strings.Contains(string(msg), "out of sync"):
+		return errStandbyOutOfSync
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// ---- WAL format ----
+
+const walHeaderSize, walFrameHeaderSize = 32, 24
+
+// parseWAL checks a SQLite WAL file's header and frame checksums and returns
+// its generation (the header salts, which change whenever SQLite restarts
+// the log), page size and the number of frames up to the last commit. A
+// missing or empty log is generation "".
+func parseWAL(b []byte) (gen string, pageSize, frames int, err error) {
+	if len(b) < walHeaderSize { return "", 0, 0, nil }
+	magic := binary.BigEndian.Uint32(b)
+	if magic&^1 != 0x377f0682 { return "", 0, 0, errors.New("not a WAL file") }
+	var order binary.ByteOrder = binary.LittleEndian
+	if magic&1 == 1 { order = binary.BigEndian }
+	if pageSize = int(binary.BigEndian.Uint32(b[8:])); pageSize == 1 { pageSize = 65536 }
+	if pageSize < 512 || pageSize > 65536 || pageSize&(pageSize-1) != 0 { return "", 0, 0, fmt.Errorf("bad page size %d", pageSize) }
+	s0, s1 := walChecksum(order, 0, 0, b[:24])
+	if s0 != binary.BigEndian.Uint32(b[24:]) || s1 != binary.BigEndian.Uint32(b[28:]) { return "", 0, 0, errors.New("header checksum mismatch") }
+	salt := b[16:24]
+	for i, off := 0, walHeaderSize; off+walFrameHeaderSize+pageSize <= len(b); i, off = i+1, off+walFrameHeaderSize+pageSize {
+		fh := b[off : off+walFrameHeaderSize]
+		if !bytes.Equal(fh[8:16], salt) { break }
+		s0, s1 = walChecksum(order, s0, s1, fh[:8])
+		s0, s1 = walChecksum(order, s0, s1, b[off+walFrameHeaderSize:off+walFrameHeaderSize+pageSize])
+		if s0 != binary.BigEndian.Uint32(fh[16:]) || s1 != binary.BigEndian.Uint32(fh[20:]) { break }
+		if binary.BigEndian.Uint32(fh[4:]) != 0 { frames = i + 1 }
+	}
+	return hex.EncodeToString(salt), pageSize, frames, nil
+}
+
+func walChecksum(order binary.ByteOrder, s0, s1 uint32, b []byte) (uint32, uint32) {
+	for i := 0; i+8 <= len(b); i += 8 {
+		s0 += order.Uint32(b[i:]) + s1
+		s1 += order.Uint32(b[i+4:]) + s0
+	}
+	return s0, s1
+}
+
+// applyWAL writes each frame's page into f and truncates f to the database
+// size recorded in each commit frame. Frames are whole pages, so applying a
+// batch again, or over a copy that already has some of it, is harmless.
+func applyWAL(f *os.File, frames []byte, pageSize int) error {
+	size := walFrameHeaderSize + pageSize
+	if len(frames)%size != 0 { return errors.New("truncated WAL frame") }
+	for off := 0; off < len(frames); off += size {
+		pgno, commit := binary.BigEndian.Uint32(frames[off:]), binary.BigEndian.Uint32(frames[off+4:])
+		if pgno == 0 { return errors.New("bad WAL frame") }
+		if _, err := f.WriteAt(frames[off+walFrameHeaderSize:off+size], int64(pgno-1)*int64(pageSize)); err != nil { return err }
+		if commit != 0 {
+			if err := f.Truncate(int64(commit) * int64(pageSize)); err != nil { return err }
+		}
+	}
+	return nil
+}
+
+func (s *Server) standbyRoutes() {
+	// a promoted standby refuses snapshots and log batches from the primary
+	// it replaced
+	refuse := func(w http.ResponseWriter, r *http.Request) {
+		if !standbyAuthorized(r) { http.Error(w, "unauthorized", 401); return }
+		http.Error(w, "promoted: this instance is a primary", 409)
+	}
+	s.Mux.HandleFunc("/api/v1/standby/snapshot", refuse)
+	s.Mux.HandleFunc("/api/v1/standby/wal", refuse)
+
+	s.Mux.HandleFunc("/api/v1/admin/standby", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		out := []map[string]any{}
+		for _, t := range standbyTargets {
+			t.mu.Lock()
+			full := ""
+			if !t.fullAt.IsZero() { full = t.fullAt.UTC().Format(time.RFC3339) }
+			out = append(out, map[string]any{"url": t.url, "shipped": t.shipped, "failed": t.failed, "bytes": t.bytes, "last_shipped": t.shippedAt,
+				"last_attempt": t.lastAt, "last_error": t.lastError, "promoted": t.fenced, "wal_position": t.pos, "last_full": full})
+			t.mu.Unlock()
+		}
+		resp := map[string]any{"role": "primary", "driver": dbDriver, "interval": envDuration("BOOTAH_STANDBY_INTERVAL", 10*time.Second).String(),
+			"full_interval": envDuration("BOOTAH_STANDBY_FULL_INTERVAL", time.Hour).String(), "wal": standbyWAL.enabled, "standbys": out}
+		if promotion != nil { resp["promoted_from"] = promotion }
+		writeJSON(w, 200, resp)
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ---- Web UI file server ----
+// The web root is served with security headers: Content-Security-Policy
+// (BOOTAH_CSP, default allows this origin plus the CDNs index.html loads
+// from), X-Frame-Options (BOOTAH_FRAME_OPTIONS, default DENY),
+// Referrer-Policy (BOOTAH_REFERRER_POLICY, default same-origin) and
+// X-Content-Type-Options: nosniff. Setting a header's variable to "off"
+// leaves it out. Browser navigations to paths that are not files (no
+// extension, outside /api/) get index.html so the UI can route on the
+// client; BOOTAH_SPA_FALLBACK=false turns that off.
+const defaultCSP = "default-src 'self'; script-src 'self' 'unsafe-inline' https://cdn.tailwindcss.com https://unpkg.com; " +
+	"style-src 'self' 'unsafe-inline'; img-src 'self' data: https:; connect-src 'self'; font-src 'self' data:; " +
+	"object-src 'none'; base-uri 'self'; frame-ancestors 'none'; form-action 'self'"
+
+// staticHeaders returns the configured security headers.
+func staticHeaders() map[string]string {
+	out := map[string]string{"X-Content-Type-Options": "nosniff"}
+	for h, v := range map[string]string{
+		"Content-Security-Policy": getenv("BOOTAH_CSP", defaultCSP),
+		"X-Frame-Options":         strings.ToUpper(getenv("BOOTAH_FRAME_OPTIONS", "DENY")),
+		"Referrer-Policy":         getenv("BOOTAH_REFERRER_POLICY", "same-origin"),
+	} {
+		if !strings.EqualFold(v, "off") { out[h] = v }
+	}
+	return out
+}
+
+// staticHandler serves root with security headers and the SPA fallback.
+func staticHandler(root string) http.Handler {
+	files := http.FileServer(http.Dir(root))
+	headers := staticHeaders()
+	fallback := getenv("BOOTAH_SPA_FALLBACK", "true") != "false"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for h, v := range headers { w.Header().Set(h, v) }
+		if fallback && spaRoute(r) {
+			if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(path.Clean("/"+r.URL.Path)))); os.IsNotExist(err) {
+				w.Header().Set("Cache-Control", "no-cache")
+				http.ServeFile(w, r, filepath.Join(root, "index.html"))
+				return
+			}
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// spaRoute reports a browser navigation to a client-side route.
+func spaRoute(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead { return false }
+	p := r.URL.Path
+	if strings.HasPrefix(p, "/api/") || path.Ext(p) != "" { return false }
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
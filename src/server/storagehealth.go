@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ---- Storage health ----
+// A probe writes, reads back and deletes a small object under "healthcheck/"
+// and times each step. Every node probes its own view of Storage every
+// BOOTAH_STORAGE_PROBE_INTERVAL (default 5m) and records the result. Over the
+// last BOOTAH_STORAGE_ALERT_WINDOW probes (default 12) the node raises one
+// notification when the failure rate reaches BOOTAH_STORAGE_ALERT_ERROR_RATE
+// (default 0.25) or the mean latency reaches BOOTAH_STORAGE_ALERT_LATENCY_MS
+// (default 2000), and another when it recovers. History is kept 30 days.
+func initStorageHealth(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS storage_probes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		node TEXT NOT NULL,
+		ok INTEGER NOT NULL,
+		write_ms INTEGER NOT NULL,
+		read_ms INTEGER NOT NULL,
+		delete_ms INTEGER NOT NULL,
+		total_ms INTEGER NOT NULL,
+		error TEXT,
+		created TEXT NOT NULL
+	)`)
+	return err
+}
+
+type storageProbe struct {
+	OK       bool   `json:"ok"`
+	WriteMS  int64  `json:"write_ms"`
+	ReadMS   int64  `json:"read_ms"`
+	DeleteMS int64  `json:"delete_ms"`
+	TotalMS  int64  `json:"total_ms"`
+	Error    string `json:"error,omitempty"`
+	Node     string `json:"node"`
+	Created  string `json:"created"`
+}
+
+func (s *Server) probeStorage(ctx context.Context) storageProbe {
+	p := storageProbe{Node: nodeID, Created: time.Now().UTC().Format(time.RFC3339)}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	payload := make([]byte, 4096)
+	_, _ = crand.Read(payload)
+	key := "healthcheck/" + nodeID + "-" + genID()
+	step := func(ms *int64, fn func() error) error {
+		t := time.Now()
+		err := fn()
+		*ms = time.Since(t).Milliseconds()
+		return err
+	}
+	err := step(&p.WriteMS, func() error { return s.Store.Put(ctx, key, bytes.NewReader(payload), int64(len(payload))) })
+	if err == nil {
+		err = step(&p.ReadMS, func() error {
+			rc, err := s.Store.Open(ctx, key)
+			if err != nil { return err }
+			defer rc.Close()
+			got, err := io.ReadAll(rc)
+			if err != nil { return err }
+			if !bytes.Equal(got, payload) { return errors.New("read back different content") }
+			return nil
+		})
+		if derr := step(&p.DeleteMS, func() error { return s.Store.Delete(ctx, key) }); err == nil { err = derr }
+	}
+	p.TotalMS = p.WriteMS + p.ReadMS + p.DeleteMS
+	p.OK = err == nil
+	if err != nil { p.Error = err.Error() }
+	return p
+}
+
+func (s *Server) recordStorageProbe(p storageProbe) {
+	_, err := s.DB.Exec(`INSERT INTO storage_probes (node, ok, write_ms, read_ms, delete_ms, total_ms, error, created) VALUES (?,?,?,?,?,?,?,?)`,
+		p.Node, p.OK, p.WriteMS, p.ReadMS, p.DeleteMS, p.TotalMS, p.Error, p.Created)
+	if err != nil { log.Printf("record storage probe: %v", err) }
+	_, _ = s.DB.Exec(`DELETE FROM storage_probes WHERE created < ?`, time.Now().UTC().AddDate(0, 0, -30).Format(time.RFC3339))
+}
+
+type storageWindow struct {
+	Probes    int      `json:"probes"`
+	Failures  int      `json:"failures"`
+	ErrorRate float64  `json:"error_rate"`
+	MeanMS    int64    `json:"mean_ms"`
+	Alerting  bool     `json:"alerting"`
+	Reasons   []string `json:"reasons,omitempty"`
+}
+
+func storageThresholds() (window int, rate float64, latency int64) {
+	window, err := strconv.Atoi(getenv("BOOTAH_STORAGE_ALERT_WINDOW", "12"))
+	if err != nil || window <= 0 { window = 12 }
+	rate, err = strconv.ParseFloat(getenv("BOOTAH_STORAGE_ALERT_ERROR_RATE", "0.25"), 64)
+	if err != nil || rate <= 0 { rate = 0.25 }
+	latency, err = strconv.ParseInt(getenv("BOOTAH_STORAGE_ALERT_LATENCY_MS", "2000"), 10, 64)
+	if err != nil || latency <= 0 { latency = 2000 }
+	return
+}
+
+// storageWindowFor summarizes node's most recent probes against the thresholds.
+func (s *Server) storageWindowFor(node string) (storageWindow, error) {
+	n, rate, latency := storageThresholds()
+	var w storageWindow
+	rows, err := s.DB.Query(`SELECT ok, total_ms FROM storage_probes WHERE node=? ORDER BY id DESC LIMIT ?`, node, n)
+	if err != nil { return w, err }
+	defer rows.Close()
+	var sum int64
+	for rows.Next() {
+		var ok bool
+		var ms int64
+		if err := rows.Scan(&ok, &ms); err != nil { return w, err }
+		w.Probes++
+		if !ok { w.Failures++ } else { sum += ms }
+	}
+	if w.Probes == 0 { return w, rows.Err() }
+	w.ErrorRate = float64(w.Failures) / float64(w.Probes)
+	if ok := w.Probes - w.Failures; ok > 0 { w.MeanMS = sum / int64(ok) }
+	if w.ErrorRate >= rate { w.Reasons = append(w.Reasons, fmt.Sprintf("error rate %.0f%% over %d probes", w.ErrorRate*100, w.Probes)) }
+	if w.MeanMS >= latency { w.Reasons = append(w.Reasons, fmt.Sprintf("mean latency %dms", w.MeanMS)) }
+	w.Alerting = len(w.Reasons) > 0
+	return w, rows.Err()
+}
+
+var storageAlert = struct {
+	sync.Mutex
+	active bool
+}{}
+
+// checkStorageHealth probes, records and notifies on alert transitions.
+func (s *Server) checkStorageHealth(ctx context.Context) storageProbe {
+	p := s.probeStorage(ctx)
+	s.recordStorageProbe(p)
+	w, err := s.storageWindowFor(nodeID)
+	if err != nil { log.Printf("storage health: %v", err); return p }
+	storageAlert.Lock()
+	was := storageAlert.active
+	storageAlert.active = w.Alerting
+	storageAlert.Unlock()
+	meta := map[string]any{"node": nodeID, "mode": getenv("BOOTAH_STORAGE", "local"), "error_rate": w.ErrorRate, "mean_ms": w.MeanMS, "last_error": p.Error}
+	switch {
+	case w.Alerting && !was:
+		s.notify("error", "storage_unhealthy", fmt.Sprintf("Storage on node %s is unhealthy: %v", nodeID, w.Reasons), meta)
+	case !w.Alerting && was:
+		s.notify("info", "storage_recovered", "Storage on node "+nodeID+" has recovered", meta)
+	}
+	return p
+}
+
+func (s *Server) startStorageHealth(ctx context.Context) {
+	interval, err := time.ParseDuration(getenv("BOOTAH_STORAGE_PROBE_INTERVAL", "5m"))
+	if err != nil || interval <= 0 { interval = 5 * time.Minute }
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			s.checkStorageHealth(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+func (s *Server) storageHealthRoutes() {
+	// Recorded probes, newest first (?node=&limit=)
+	s.Mux.HandleFunc("/api/v1/admin/storage/health/history", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 || limit > 1000 { limit = 100 }
+		q := `SELECT node, ok, write_ms, read_ms, delete_ms, total_ms, COALESCE(error,''), created FROM storage_probes`
+		var args []any
+		if node := r.URL.Query().Get("node"); node != "" { q += ` WHERE node=?`; args = append(args, node) }
+		rows, err := s.DB.Query(q+` ORDER BY id DESC LIMIT ?`, append(args, limit)...)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		defer rows.Close()
+		out := []storageProbe{}
+		for rows.Next() {
+			var p storageProbe
+			if err := rows.Scan(&p.Node, &p.OK, &p.WriteMS, &p.ReadMS, &p.DeleteMS, &p.TotalMS, &p.Error, &p.Created); err != nil { http.Error(w, err.Error(), 500); return }
+			out = append(out, p)
+		}
+		writeJSON(w, 200, out)
+	})
+}
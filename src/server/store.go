@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ---- Database store ----
+// BOOTAH_DB_DRIVER selects the database: sqlite (default, file at
+// BOOTAH_DB_PATH, opened read-only on replicas) or postgres (BOOTAH_DB_DSN, a
+// postgres:// URL or key=value string; point replicas at a read replica).
+// PostgreSQL lets several instances share one database (see clustering);
+// its driver is compiled in with -tags postgres.
+//
+// The schema and queries are written once, in SQLite syntax with ?
+// placeholders. For PostgreSQL the store translates each statement before
+// it reaches the driver, working on tokens so string literals, quoted
+// identifiers and comments pass through unchanged: $n placeholders,
+// BIGSERIAL for AUTOINCREMENT keys, BIGINT for INTEGER columns, INSERT OR
+// IGNORE as ON CONFLICT DO NOTHING, LIMIT ALL for LIMIT -1, string_agg for
+// group_concat, and boolean arguments as 0/1 to match the INTEGER flag
+// columns. The few queries that differ beyond that branch on dbDriver where
+// they are issued.
+//
+// Pool settings apply to both drivers: BOOTAH_DB_MAX_OPEN_CONNS (default
+// unlimited; 1 serialises SQLite writers), BOOTAH_DB_MAX_IDLE_CONNS (default
+// 2), BOOTAH_DB_CONN_MAX_LIFETIME and BOOTAH_DB_CONN_MAX_IDLE_TIME (durations,
+// default unlimited). With PostgreSQL keep MAX_OPEN_CONNS times the number of
+// instances below the server's max_connections, and set a lifetime shorter
+// than any idle timeout of a pooler (PgBouncer) in between.
+
+// postgresDriver is the database/sql driver name registered by the postgres
+// build (db_postgres.go); empty when it is not compiled in.
+var postgresDriver string
+
+// openStore opens the configured database and applies the pool settings.
+func openStore() (*sql.DB, error) {
+	var db *sql.DB
+	var err error
+	switch dbDriver = strings.ToLower(getenv("BOOTAH_DB_DRIVER", "sqlite")); dbDriver {
+	case "sqlite":
+		dbPath := getenv("BOOTAH_DB_PATH", "./data/bootah.db")
+		dsn := dbPath
+		if replicaMode() { dsn = "file:" + dbPath + "?mode=ro" }
+		if err := os.MkdirAll(filepath.Dir(dbPath), 0o755); err != nil { return nil, err }
+		db, err = sql.Open("sqlite", dsn)
+	case "postgres":
+		dsn := getenv("BOOTAH_DB_DSN", "")
+		if dsn == "" { return nil, errors.New("BOOTAH_DB_DSN is required for BOOTAH_DB_DRIVER=postgres") }
+		if postgresDriver == "" { return nil, errors.New("this build has no PostgreSQL driver; rebuild with -tags postgres") }
+		db, err = sql.Open("bootah-postgres", dsn)
+	default:
+		return nil, fmt.Errorf("BOOTAH_DB_DRIVER must be sqlite or postgres, not %q", dbDriver)
+	}
+	if err != nil { return nil, err }
+	if n, err := strconv.Atoi(getenv("BOOTAH_DB_MAX_OPEN_CONNS", "")); err == nil && n > 0 { db.SetMaxOpenConns(n) }
+	if n, err := strconv.Atoi(getenv("BOOTAH_DB_MAX_IDLE_CONNS", "")); err == nil && n >= 0 { db.SetMaxIdleConns(n) }
+	db.SetConnMaxLifetime(envDuration("BOOTAH_DB_CONN_MAX_LIFETIME", 0))
+	db.SetConnMaxIdleTime(envDuration("BOOTAH_DB_CONN_MAX_IDLE_TIME", 0))
+	if err := db.Ping(); err != nil { db.Close(); return nil, fmt.Errorf("%s: %w", dbDriver, err) }
+	return db, nil
+}
+
+// dbOnDisk reports the directory of a SQLite database, for disk checks.
+func dbOnDisk() (string, bool) {
+	if dbDriver != "sqlite" { return "", false }
+	return filepath.Dir(getenv("BOOTAH_DB_PATH", "./data/bootah.db")), true
+}
+
+var pgRewritten sync.Map // query -> rewritten query
+
+// sqlToken is one lexical token of a statement: kind is 'w' for a word
+// (keyword or bare identifier), 's' a string literal, 'q' a quoted
+// identifier, 'c' a comment, ' ' whitespace, '?' a placeholder and 'p'
+// anything else (a number or one punctuation character).
+type sqlToken struct {
+	kind byte
+	text string
+}
+
+func sqlWordByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+// sqlTokens splits q into tokens; joining their texts gives q back.
+func sqlTokens(q string) []sqlToken {
+	var out []sqlToken
+	for i := 0; i < len(q); {
+		c, j, kind := q[i], i+1, byte('p')
+		switch {
+		case c == '\'' || c == '"':
+			kind = 's'
+			if c == '"' { kind = 'q' }
+			for j < len(q) {
+				if q[j] != c { j++; continue }
+				if j+1 < len(q) && q[j+1] == c { j += 2; continue } // doubled quote
+				j++
+				break
+			}
+		case strings.HasPrefix(q[i:], "--"):
+			kind, j = 'c', len(q)
+			if k := strings.IndexByte(q[i:], '\n'); k >= 0 { j = i + k }
+		case strings.HasPrefix(q[i:], "/*"):
+			kind, j = 'c', len(q)
+			if k := strings.Index(q[i+2:], "*/"); k >= 0 { j = i + 2 + k + 2 }
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			kind = ' '
+			for j < len(q) && strings.IndexByte(" \t\n\r", q[j]) >= 0 { j++ }
+		case c == '?':
+			kind = '?'
+		case c >= '0' && c <= '9':
+			for j < len(q) && (q[j] >= '0' && q[j] <= '9' || q[j] == '.') { j++ }
+		case sqlWordByte(c):
+			kind = 'w'
+			for j < len(q) && sqlWordByte(q[j]) { j++ }
+		}
+		out = append(out, sqlToken{kind, q[i:j]})
+		i = j
+	}
+	return out
+}
+
+// pgRewrite translates a statement in the store's SQLite dialect into
+// PostgreSQL token by token, so literals, quoted identifiers and comments
+// are never touched.
+func pgRewrite(q string) string {
+	if v, ok := pgRewritten.Load(q); ok { return v.(string) }
+	toks := sqlTokens(q)
+	// next returns the index of the first token at or after i that isn't
+	// whitespace or a comment
+	next := func(i int) int {
+		for i < len(toks) && (toks[i].kind == ' ' || toks[i].kind == 'c') { i++ }
+		return i
+	}
+	is := func(i int, word string) bool { return i < len(toks) && toks[i].kind == 'w' && strings.EqualFold(toks[i].text, word) }
+	punct := func(i int, p string) bool { return i < len(toks) && toks[i].kind == 'p' && toks[i].text == p }
+	first := next(0)
+	ddl := (is(first, "CREATE") || is(first, "ALTER")) && is(next(first+1), "TABLE")
+	// INSERT OR IGNORE INTO: drop OR IGNORE, add ON CONFLICT DO NOTHING below
+	ignore := false
+	if or := next(first + 1); is(first, "INSERT") && is(or, "OR") && is(next(or+1), "IGNORE") {
+		toks = append(toks[:first+1], toks[next(or+1)+1:]...)
+		ignore = true
+	}
+	// group_concat(x) becomes string_agg(x, ','), group_concat(x, sep)
+	// string_agg(x, sep)
+	for i := range toks {
+		if !is(i, "group_concat") || !punct(next(i+1), "(") { continue }
+		toks[i].text = "string_agg"
+		depth, commas := 0, 0
+		for k := next(i + 1); k < len(toks); k++ {
+			switch {
+			case punct(k, "("):
+				depth++
+			case punct(k, ","):
+				if depth == 1 { commas++ }
+			case punct(k, ")"):
+				if depth--; depth == 0 {
+					if commas == 0 { toks = append(toks[:k], append([]sqlToken{{'p', ","}, {' ', " "}, {'s', "','"}}, toks[k:]...)...) }
+					k = len(toks)
+				}
+			}
+		}
+	}
+	var b strings.Builder
+	n, depth := 0, 0
+	for i := 0; i < len(toks); i++ {
+		t := toks[i]
+		switch {
+		case t.kind == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		case punct(i, "("):
+			depth++
+		case punct(i, ")"):
+			depth--
+		case ddl && is(i, "INTEGER"):
+			if k := next(i + 1); is(k, "PRIMARY") && is(next(k+1), "KEY") && is(next(next(k+1)+1), "AUTOINCREMENT") {
+				b.WriteString("BIGSERIAL PRIMARY KEY")
+				i = next(next(k+1) + 1)
+				continue
+			}
+			b.WriteString("BIGINT")
+			continue
+		case is(i, "LIMIT"):
+			if k := next(i + 1); punct(k, "-") && punct(k+1, "1") {
+				b.WriteString("LIMIT ALL")
+				i = k + 1
+				continue
+			}
+		case ignore && depth == 0 && is(i, "RETURNING"):
+			b.WriteString("ON CONFLICT DO NOTHING ")
+			ignore = false
+		}
+		b.WriteString(t.text)
+	}
+	out := b.String()
+	if ignore {
+		body := strings.TrimRight(out, " \t\r\n;")
+		out = body + " ON CONFLICT DO NOTHING" + out[len(body):]
+	}
+	pgRewritten.Store(q, out)
+	return out
+}
+
+// pgArgs stores booleans as the 0/1 the INTEGER flag columns hold.
+func pgArgs(args []driver.NamedValue) []driver.NamedValue {
+	for i, a := range args {
+		if v, ok := a.Value.(bool); ok {
+			args[i].Value = int64(0)
+			if v { args[i].Value = int64(1) }
+		}
+	}
+	return args
+}
+
+// rewriteDriver wraps the PostgreSQL driver with pgRewrite.
+type rewriteDriver struct{ inner driver.Driver }
+
+func (d rewriteDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.inner.Open(name)
+	if err != nil { return nil, err }
+	return &rewriteConn{c}, nil
+}
+
+type rewriteConn struct{ driver.Conn }
+
+func (c *rewriteConn) Prepare(q string) (driver.Stmt, error) { return c.Conn.Prepare(pgRewrite(q)) }
+
+func (c *rewriteConn) PrepareContext(ctx context.Context, q string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok { return p.PrepareContext(ctx, pgRewrite(q)) }
+	return c.Prepare(q)
+}
+
+func (c *rewriteConn) QueryContext(ctx context.Context, q string, args []driver.NamedValue) (driver.Rows, error) {
+	if qc, ok := c.Conn.(driver.QueryerContext); ok { return qc.QueryContext(ctx, pgRewrite(q), pgArgs(args)) }
+	return nil, driver.ErrSkip
+}
+
+func (c *rewriteConn) ExecContext(ctx context.Context, q string, args []driver.NamedValue) (driver.Result, error) {
+	if ec, ok := c.Conn.(driver.ExecerContext); ok { return ec.ExecContext(ctx, pgRewrite(q), pgArgs(args)) }
+	return nil, driver.ErrSkip
+}
+
+func (c *rewriteConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if bc, ok := c.Conn.(driver.ConnBeginTx); ok { return bc.BeginTx(ctx, opts) }
+	return c.Conn.Begin()
+}
+
+func (c *rewriteConn) CheckNamedValue(v *driver.NamedValue) error {
+	if nc, ok := c.Conn.(driver.NamedValueChecker); ok { return nc.CheckNamedValue(v) }
+	return driver.ErrSkip
+}
+
+func (c *rewriteConn) ResetSession(ctx context.Context) error {
+	if rs, ok := c.Conn.(driver.SessionResetter); ok { return rs.ResetSession(ctx) }
+	return nil
+}
+
+func (c *rewriteConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok { return v.IsValid() }
+	return true
+}
+
+// registerPostgres is called by the postgres build with the name of the
+// driver it imports.
+func registerPostgres(name string) {
+	db, err := sql.Open(name, "")
+	if err != nil { panic(err) }
+	sql.Register("bootah-postgres", rewriteDriver{db.Driver()})
+	_ = db.Close()
+	postgresDriver = name
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestPgRewrite(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{`SELECT * FROM machines WHERE mac=? AND hostname=?`, `SELECT * FROM machines WHERE mac=$1 AND hostname=$2`},
+		{`SELECT '?', "a?b", x FROM t WHERE y=? -- why?
+AND z=? /* or? */`, `SELECT '?', "a?b", x FROM t WHERE y=$1 -- why?
+AND z=$2 /* or? */`},
+		{`SELECT 'it''s ?' WHERE a=?`, `SELECT 'it''s ?' WHERE a=$1`},
+		{`INSERT OR IGNORE INTO machine_tags(mac, tag) VALUES(?, ?)`, `INSERT INTO machine_tags(mac, tag) VALUES($1, $2) ON CONFLICT DO NOTHING`},
+		{`insert or ignore into t(a) values(?);`, `insert into t(a) values($1) ON CONFLICT DO NOTHING;`},
+		{`INSERT OR IGNORE INTO t(a) VALUES(?) RETURNING id`, `INSERT INTO t(a) VALUES($1) ON CONFLICT DO NOTHING RETURNING id`},
+		{`INSERT INTO t(a) SELECT 'OR IGNORE'`, `INSERT INTO t(a) SELECT 'OR IGNORE'`},
+		{`CREATE TABLE IF NOT EXISTS t (id INTEGER PRIMARY KEY AUTOINCREMENT, n INTEGER NOT NULL, integer_count INTEGER)`,
+			`CREATE TABLE IF NOT EXISTS t (id BIGSERIAL PRIMARY KEY, n BIGINT NOT NULL, integer_count BIGINT)`},
+		{`ALTER TABLE t ADD COLUMN n integer DEFAULT 0`, `ALTER TABLE t ADD COLUMN n BIGINT DEFAULT 0`},
+		{`SELECT CAST(x AS INTEGER) FROM t`, `SELECT CAST(x AS INTEGER) FROM t`},
+		{`SELECT id FROM images LIMIT -1 OFFSET 20`, `SELECT id FROM images LIMIT ALL OFFSET 20`},
+		{`SELECT a-1 FROM t LIMIT 10`, `SELECT a-1 FROM t LIMIT 10`},
+		{`SELECT group_concat(tag) FROM t`, `SELECT string_agg(tag, ',') FROM t`},
+		{`SELECT group_concat(tag, ';') FROM t`, `SELECT string_agg(tag, ';') FROM t`},
+		{`SELECT group_concat(DISTINCT lower(tag)) FROM t`, `SELECT string_agg(DISTINCT lower(tag), ',') FROM t`},
+		{`SELECT 'group_concat(x)'`, `SELECT 'group_concat(x)'`},
+		{machineImportSnapshot, `SELECT COALESCE(uuid,'')||'|'||COALESCE(serial,'')||'|'||COALESCE(hostname,'')||'|'||COALESCE(model,'')||'|'||COALESCE(boot_profile,'')||'|'||
+	COALESCE((SELECT value FROM machine_fields f WHERE f.mac=machines.mac AND f.name='ip_address'),'')||'|'||
+	COALESCE((SELECT string_agg(tag, ',') FROM (SELECT tag FROM machine_tags t WHERE t.mac=machines.mac ORDER BY tag) o),'') FROM machines WHERE mac=$1`},
+	} {
+		if got := pgRewrite(c.in); got != c.want { t.Errorf("pgRewrite(%q)\n got %q\nwant %q", c.in, got, c.want) }
+	}
+}
+
+func TestSQLTokensRoundTrip(t *testing.T) {
+	for _, q := range []string{`SELECT 'unterminated`, `SELECT "a""b" /* open`, "x -- tail", `a=?;`, "é ß"} {
+		got := ""
+		for _, tok := range sqlTokens(q) { got += tok.text }
+		if got != q { t.Errorf("sqlTokens(%q) joins to %q", q, got) }
+	}
+}
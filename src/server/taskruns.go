@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ---- Task sequence runs ----
+// A task sequence reaches a machine through its active deployment, else
+// through an assignment to the machine, else through the first of its groups
+// (by name) that has one. The WinPE/Linux agent polls
+// /api/v1/tasks/next?mac= for the step to run and reports each outcome to
+// /api/v1/tasks/report; a run walks the steps in order, a failed step fails
+// the run and its deployment. "validate" steps are skipped here: they run in
+// the installed OS and report through /api/v1/agent/validation. A finished or
+// failed run is not repeated until the sequence or the assignment changes or
+// an admin deletes the run.
+type TaskRun struct {
+	ID           string `json:"id"`
+	MAC          string `json:"mac"`
+	SequenceID   string `json:"task_sequence_id"`
+	DeploymentID string `json:"deployment_id,omitempty"`
+	Step         int    `json:"step"` // index of the next step
+	Status       string `json:"status"`
+	Error        string `json:"error,omitempty"`
+	StartedAt    string `json:"started_at"`
+	UpdatedAt    string `json:"updated_at"`
+}
+
+func initTaskRuns(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS task_runs (
+		id TEXT PRIMARY KEY,
+		mac TEXT NOT NULL,
+		sequence_id TEXT NOT NULL,
+		deployment_id TEXT,
+		step INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL,
+		error TEXT,
+		started_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL
+	)`)
+	if err != nil { return err }
+	_, _ = db.Exec(`CREATE INDEX IF NOT EXISTS task_runs_mac ON task_runs (mac, started_at)`)
+	return nil
+}
+
+const taskRunColumns = `id, mac, sequence_id, COALESCE(deployment_id,''), step, status, COALESCE(error,''), started_at, updated_at FROM task_runs`
+
+func scanTaskRun(row interface{ Scan(...any) error }) (*TaskRun, error) {
+	var t TaskRun
+	if err := row.Scan(&t.ID, &t.MAC, &t.SequenceID, &t.DeploymentID, &t.Step, &t.Status, &t.Error, &t.StartedAt, &t.UpdatedAt); err != nil { return nil, err }
+	return &t, nil
+}
+
+// taskSequenceFor resolves the sequence mac should run, with the active
+// deployment (if any) and the time the assignment was made. An empty id
+// means there is nothing to run.
+func (s *Server) taskSequenceFor(mac string) (seqID, deploymentID, assigned string, err error) {
+	err = s.DB.QueryRow(`SELECT id, COALESCE(task_sequence_id,''), created_at FROM deployments WHERE mac=? AND status IN ('pending','running','validating') ORDER BY created_at DESC LIMIT 1`, mac).
+		Scan(&deploymentID, &seqID, &assigned)
+	if err == nil { return seqID, deploymentID, assigned, nil }
+	if !errors.Is(err, sql.ErrNoRows) { return "", "", "", err }
+	err = s.DB.QueryRow(`SELECT COALESCE(task_sequence_id,''), COALESCE(task_assigned_at,'') FROM machines WHERE mac=?`, mac).Scan(&seqID, &assigned)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) { return "", "", "", err }
+	if seqID != "" { return seqID, "", assigned, nil }
+	ids, err := s.groupsForMachine(mac)
+	if err != nil { return "", "", "", err }
+	for _, id := range ids {
+		if s.DB.QueryRow(`SELECT COALESCE(task_sequence_id,''), COALESCE(task_assigned_at,'') FROM machine_groups WHERE id=?`, id).Scan(&seqID, &assigned) == nil && seqID != "" {
+			return seqID, "", assigned, nil
+		}
+	}
+	return "", "", "", nil
+}
+
+// currentTaskRun returns the run mac should be working on, starting one when
+// its sequence has not been run since it was assigned or last edited. nil
+// means nothing to do.
+func (s *Server) currentTaskRun(mac string) (*TaskRun, *TaskSequence, error) {
+	seqID, depID, assigned, err := s.taskSequenceFor(mac)
+	if err != nil || seqID == "" { return nil, nil, err }
+	seq, err := s.taskSequence(seqID)
+	if errors.Is(err, sql.ErrNoRows) { return nil, nil, nil }
+	if err != nil { return nil, nil, err }
+	run, err := scanTaskRun(s.DB.QueryRow(`SELECT `+taskRunColumns+` WHERE mac=? AND sequence_id=? AND COALESCE(deployment_id,'')=? ORDER BY started_at DESC LIMIT 1`, mac, seqID, depID))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) { return nil, nil, err }
+	if run != nil && (run.Status == "running" || (!rfc3339After(seq.Updated, run.StartedAt) && !rfc3339After(assigned, run.StartedAt))) {
+		if run.Status != "running" { return nil, nil, nil }
+		return run, seq, nil
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	run = &TaskRun{ID: "run-" + genID(), MAC: mac, SequenceID: seqID, DeploymentID: depID, Status: "running", StartedAt: now, UpdatedAt: now}
+	_, err = s.DB.Exec(`INSERT INTO task_runs (id, mac, sequence_id, deployment_id, step, status, started_at, updated_at) VALUES (?,?,?,NULLIF(?,''),0,?,?,?)`,
+		run.ID, mac, seqID, depID, run.Status, now, now)
+	if err != nil { return nil, nil, err }
+	if depID != "" {
+		var status string
+		if s.DB.QueryRow(`SELECT status FROM deployments WHERE id=?`, depID).Scan(&status) == nil && status == "pending" { _ = s.setDeploymentStatus(depID, "running", "") }
+	}
+	s.emit("task_run.started", map[string]any{"run_id": run.ID, "mac": mac, "task_sequence_id": seqID, "deployment_id": depID})
+	return run, seq, nil
+}
+
+// rfc3339After reports whether a is later than b; timestamps here are
+// written in both local time and UTC, so compare them parsed.
+func rfc3339After(a, b string) bool {
+	ta, err1 := time.Parse(time.RFC3339, a)
+	tb, err2 := time.Parse(time.RFC3339, b)
+	return err1 == nil && err2 == nil && ta.After(tb)
+}
+
+// nextTaskStep skips validate steps from i, returning len(steps) when done.
+func nextTaskStep(steps []TaskStep, i int) int {
+	for i < len(steps) && steps[i].Type == "validate" { i++ }
+	return i
+}
+
+// finishTaskRun closes a run; a failure also fails its deployment.
+func (s *Server) finishTaskRun(run *TaskRun, step int, status, cause string) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	if _, err := s.DB.Exec(`UPDATE task_runs SET step=?, status=?, error=NULLIF(?,''), updated_at=? WHERE id=?`, step, status, cause, now, run.ID); err != nil { return err }
+	if status == "failed" && run.DeploymentID != "" {
+		if err := s.setDeploymentStatus(run.DeploymentID, "failed", cause); err != nil { return err }
+		s.notify("error", "deployment_failed", "Deployment "+run.DeploymentID+" failed", map[string]any{"deployment_id": run.DeploymentID, "error": cause})
+	}
+	s.emit("task_run.finished", map[string]any{"run_id": run.ID, "mac": run.MAC, "task_sequence_id": run.SequenceID, "deployment_id": run.DeploymentID, "status": status, "error": cause})
+	return nil
+}
+
+// pendingTaskStep is the run mac is working on and the index of its next
+// step; a run with only validate steps left is closed here. A nil run means
+// nothing to do.
+func (s *Server) pendingTaskStep(mac string) (*TaskRun, *TaskSequence, int, error) {
+	run, seq, err := s.currentTaskRun(mac)
+	if err != nil || run == nil { return nil, nil, 0, err }
+	i := nextTaskStep(seq.Steps, run.Step)
+	if i >= len(seq.Steps) {
+		return nil, nil, 0, s.finishTaskRun(run, i, "succeeded", "")
+	}
+	return run, seq, i, nil
+}
+
+// advanceTaskRun records the outcome of step i, the current step of run, and
+// moves the run on. It returns the run's new status.
+func (s *Server) advanceTaskRun(run *TaskRun, seq *TaskSequence, i int, ok bool, exitCode *int, detail, output string) (string, error) {
+	if err := s.recordTaskStep(run.ID, i, seq.Steps[i].Name, ok, exitCode, detail, output); err != nil { return "", err }
+	switch {
+	case !ok:
+		return "failed", s.finishTaskRun(run, i, "failed", "task step "+seq.Steps[i].Name+": "+detail)
+	case nextTaskStep(seq.Steps, i+1) >= len(seq.Steps):
+		return "succeeded", s.finishTaskRun(run, len(seq.Steps), "succeeded", "")
+	}
+	_, err := s.DB.Exec(`UPDATE task_runs SET step=?, updated_at=? WHERE id=?`, i+1, time.Now().UTC().Format(time.RFC3339), run.ID)
+	return "running", err
+}
+
+// agentRunStep loads a running run for an agent report about step, which
+// must be the run's current step, writing the error response otherwise.
+func (s *Server) agentRunStep(w http.ResponseWriter, r *http.Request, runID, step string) (*TaskRun, *TaskSequence, int, bool) {
+	run, err := scanTaskRun(s.DB.QueryRow(`SELECT `+taskRunColumns+` WHERE id=?`, runID))
+	if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return nil, nil, 0, false }
+	if err != nil { http.Error(w, err.Error(), 500); return nil, nil, 0, false }
+	if !s.agentTaskMAC(w, r, run.MAC) { return nil, nil, 0, false }
+	if run.Status != "running" { http.Error(w, "run is "+run.Status, 409); return nil, nil, 0, false }
+	seq, err := s.taskSequence(run.SequenceID)
+	if errors.Is(err, sql.ErrNoRows) { http.Error(w, "task sequence was deleted", 409); return nil, nil, 0, false }
+	if err != nil { http.Error(w, err.Error(), 500); return nil, nil, 0, false }
+	i := nextTaskStep(seq.Steps, run.Step)
+	if i >= len(seq.Steps) || seq.Steps[i].Name != step { http.Error(w, "step is not the current step of this run", 409); return nil, nil, 0, false }
+	return run, seq, i, true
+}
+
+// agentTaskMAC rejects per-deployment agent tokens presented for another machine.
+func (s *Server) agentTaskMAC(w http.ResponseWriter, r *http.Request, mac string) bool {
+	if dep, ok := s.deploymentForAgentToken(r.Header.Get("X-Bootah-Agent-Token")); ok {
+		var depMAC string
+		if s.DB.QueryRow(`SELECT mac FROM deployments WHERE id=?`, dep).Scan(&depMAC) != nil || depMAC != mac {
+			http.Error(w, "token not valid for this machine", 403); return false
+		}
+	}
+	return true
+}
+
+func (s *Server) taskRunRoutes() {
+	// Agent: the next step for ?mac=, 204 when there is nothing to run
+	s.Mux.HandleFunc("/api/v1/tasks/next", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		if !s.requireAgent(w, r) { return }
+		mac := normalizeMAC(r.URL.Query().Get("mac"))
+		if mac == "" { http.Error(w, "mac required", 400); return }
+		if !s.agentTaskMAC(w, r, mac) || !s.requireEnrollment(w, r, mac) || !s.requireAttestation(w, r, mac) { return }
+		run, seq, i, err := s.pendingTaskStep(mac)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if run == nil { w.WriteHeader(http.StatusNoContent); return }
+		var image string
+		if run.DeploymentID != "" { _ = s.DB.QueryRow(`SELECT COALESCE(image_id,'') FROM deployments WHERE id=?`, run.DeploymentID).Scan(&image) }
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, 200, map[string]any{"run_id": run.ID, "deployment_id": run.DeploymentID, "task_sequence_id": seq.ID, "task_sequence": seq.Name,
+			"image_id": image, "index": i, "total": len(seq.Steps), "step": seq.Steps[i]})
+	})
+
+	// Agent: {"run_id": "...", "step": "name", "ok": true, "detail": ""}
+	s.Mux.HandleFunc("/api/v1/tasks/report", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		if !s.requireAgent(w, r) { return }
+		var body struct {
+			RunID  string `json:"run_id"`
+			Step   string `json:"step"`
+			OK     bool   `json:"ok"`
+			Detail string `json:"detail"`
+		}
+		if !decodeJSON(w, r, &body) { return }
+		run, seq, i, ok := s.agentRunStep(w, r, body.RunID, body.Step)
+		if !ok { return }
+		status, err := s.advanceTaskRun(run, seq, i, body.OK, nil, body.Detail, "")
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		writeJSON(w, 200, map[string]any{"run_id": run.ID, "status": status})
+	})
+
+	// Assign a sequence to a machine or group: {"task_sequence_id": "", "mac"|"group_id": ""};
+	// an empty task_sequence_id clears the assignment
+	s.Mux.HandleFunc("/api/v1/admin/task_sequences/assign", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+			out := []map[string]any{}
+			rows, err := s.DB.Query(`SELECT 'machine', mac, task_sequence_id, COALESCE(task_assigned_at,'') FROM machines WHERE COALESCE(task_sequence_id,'')<>''
+				UNION ALL SELECT 'group', id, task_sequence_id, COALESCE(task_assigned_at,'') FROM machine_groups WHERE COALESCE(task_sequence_id,'')<>''`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			for rows.Next() {
+				var kind, target, seq, at string
+				if err := rows.Scan(&kind, &target, &seq, &at); err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, map[string]any{"scope": kind, "target": target, "task_sequence_id": seq, "assigned_at": at})
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPut:
+			var body struct {
+				SequenceID string `json:"task_sequence_id"`
+				MAC        string `json:"mac"`
+				GroupID    string `json:"group_id"`
+			}
+			if !decodeJSON(w, r, &body) { return }
+			mac := normalizeMAC(body.MAC)
+			if (mac == "") == (body.GroupID == "") { http.Error(w, "give exactly one of mac or group_id", 400); return }
+			if body.SequenceID != "" {
+				if _, err := s.taskSequence(body.SequenceID); err != nil { http.Error(w, "unknown task sequence", 400); return }
+			}
+			now := time.Now().UTC().Format(time.RFC3339)
+			var res sql.Result
+			var err error
+			if mac != "" {
+				res, err = s.DB.Exec(`UPDATE machines SET task_sequence_id=NULLIF(?,''), task_assigned_at=? WHERE mac=?`, body.SequenceID, now, mac)
+			} else {
+				res, err = s.DB.Exec(`UPDATE machine_groups SET task_sequence_id=NULLIF(?,''), task_assigned_at=? WHERE id=?`, body.SequenceID, now, body.GroupID)
+			}
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			if n, _ := res.RowsAffected(); n == 0 { http.NotFound(w, r); return }
+			s.audit(s.actorID(r), "assign", "task_sequence", map[string]any{"id": body.SequenceID, "mac": mac, "group_id": body.GroupID})
+			writeJSON(w, 200, map[string]any{"task_sequence_id": body.SequenceID, "mac": mac, "group_id": body.GroupID, "assigned_at": now})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// Runs, newest first (?mac=); DELETE {"id"} lets a finished or failed run be repeated
+	s.Mux.HandleFunc("/api/v1/admin/task_runs", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		switch r.Method {
+		case http.MethodGet:
+			q, args := `SELECT `+taskRunColumns, []any{}
+			if mac := normalizeMAC(r.URL.Query().Get("mac")); mac != "" { q += ` WHERE mac=?`; args = append(args, mac) }
+			rows, err := s.DB.Query(q+` ORDER BY started_at DESC LIMIT 200`, args...)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			out := []TaskRun{}
+			for rows.Next() {
+				t, err := scanTaskRun(rows)
+				if err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, *t)
+			}
+			writeJSON(w, 200, out)
+		case http.MethodDelete:
+			if !s.requireRole(w, r, "admin") { return }
+			var body struct{ ID string `json:"id"` }
+			if !decodeJSON(w, r, &body) { return }
+			res, err := s.DB.Exec(`DELETE FROM task_runs WHERE id=?`, body.ID)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			if n, _ := res.RowsAffected(); n == 0 { http.NotFound(w, r); return }
+			_, _ = s.DB.Exec(`DELETE FROM task_steps WHERE run_id=?`, body.ID)
+			s.audit(s.actorID(r), "delete", "task_run", map[string]any{"id": body.ID})
+			writeJSON(w, 200, map[string]any{"deleted": body.ID})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ---- Task sequences ----
+type TaskStep struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type"`
+	Params map[string]string `json:"params,omitempty"`
+}
+
+type TaskSequence struct {
+	ID      string     `json:"id"`
+	Name    string     `json:"name"`
+	Steps   []TaskStep `json:"steps"`
+	Updated string     `json:"updated"`
+}
+
+func initTasks(db *sql.DB) error {
+	ddl := `CREATE TABLE IF NOT EXISTS task_sequences (
+		id TEXT PRIMARY KEY,
+		name TEXT UNIQUE NOT NULL,
+		steps TEXT NOT NULL,
+		updated TEXT NOT NULL
+	);`
+	_, err := db.Exec(ddl)
+	return err
+}
+
+var stepTypes = map[string]bool{
+	"partition": true, "apply_image": true, "inject_drivers": true, "run_script": true,
+	"join_domain": true, "enroll_cert": true, "validate": true, "wipe": true,
+	"install_update": true, "install_software": true,
+}
+
+// validationChecks are the post-deployment checks an agent knows how to run.
+var validationChecks = map[string]bool{"service_running": true, "domain_joined": true, "disk_encrypted": true}
+
+// validateSteps checks step types and names; step names key agent reports so
+// they must be unique within a sequence.
+func validateSteps(steps []TaskStep) error {
+	seen := map[string]bool{}
+	for i, st := range steps {
+		if strings.TrimSpace(st.Name) == "" { return fmt.Errorf("step %d: name required", i+1) }
+		if seen[st.Name] { return fmt.Errorf("step %d: duplicate name %q", i+1, st.Name) }
+		seen[st.Name] = true
+		if !stepTypes[st.Type] { return fmt.Errorf("step %d: unknown type %q", i+1, st.Type) }
+		if st.Type == "wipe" && !wipeMethods[st.Params["method"]] { return fmt.Errorf("step %d: unknown wipe method %q", i+1, st.Params["method"]) }
+		if st.Type == "install_update" {
+			if st.Params["bundle"] == "" { return fmt.Errorf("step %d: install_update needs a bundle id or \"latest\"", i+1) }
+			if st.Params["bundle"] == "latest" && st.Params["product"] == "" { return fmt.Errorf("step %d: latest update needs a product", i+1) }
+		}
+		if st.Type == "install_software" && st.Params["set"] == "" { return fmt.Errorf("step %d: install_software needs a set", i+1) }
+		if st.Type == "validate" {
+			if !validationChecks[st.Params["check"]] { return fmt.Errorf("step %d: unknown check %q", i+1, st.Params["check"]) }
+			if st.Params["check"] == "service_running" && st.Params["target"] == "" { return fmt.Errorf("step %d: service_running needs a target", i+1) }
+		}
+	}
+	return nil
+}
+
+func (s *Server) taskSequence(id string) (*TaskSequence, error) {
+	var ts TaskSequence
+	var steps string
+	if err := s.DB.QueryRow(`SELECT id, name, steps, updated FROM task_sequences WHERE id=?`, id).Scan(&ts.ID, &ts.Name, &steps, &ts.Updated); err != nil { return nil, err }
+	if err := json.Unmarshal([]byte(steps), &ts.Steps); err != nil { return nil, err }
+	return &ts, nil
+}
+
+func (s *Server) taskRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/task_sequences", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := s.DB.Query(`SELECT id, name, steps, updated FROM task_sequences ORDER BY name`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			var out []TaskSequence
+			for rows.Next() {
+				var ts TaskSequence; var steps string
+				if err := rows.Scan(&ts.ID, &ts.Name, &steps, &ts.Updated); err != nil { http.Error(w, err.Error(), 500); return }
+				_ = json.Unmarshal([]byte(steps), &ts.Steps)
+				out = append(out, ts)
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPost, http.MethodPut:
+			var body TaskSequence
+			if !decodeJSON(w, r, &body) { return }
+			if strings.TrimSpace(body.Name) == "" { http.Error(w, "name required", 400); return }
+			if err := validateSteps(body.Steps); err != nil { badRequest(w, err); return }
+			js, _ := json.Marshal(body.Steps)
+			now := time.Now().Format(time.RFC3339)
+			if r.Method == http.MethodPut {
+				res, err := s.DB.Exec(`UPDATE task_sequences SET name=?, steps=?, updated=? WHERE id=?`, body.Name, string(js), now, body.ID)
+				if err != nil { http.Error(w, err.Error(), 500); return }
+				if n, _ := res.RowsAffected(); n == 0 { http.NotFound(w, r); return }
+				s.audit(s.actorID(r), "update", "task_sequence", map[string]any{"id": body.ID, "name": body.Name})
+				writeJSON(w, 200, map[string]any{"id": body.ID})
+				return
+			}
+			id := "ts-" + genID()
+			if _, err := s.DB.Exec(`INSERT INTO task_sequences (id, name, steps, updated) VALUES (?,?,?,?)`, id, body.Name, string(js), now); err != nil {
+				http.Error(w, err.Error(), 500); return
+			}
+			s.audit(s.actorID(r), "create", "task_sequence", map[string]any{"id": id, "name": body.Name})
+			writeJSON(w, 201, map[string]any{"id": id})
+		case http.MethodDelete:
+			var body struct{ ID string `json:"id"` }
+			if !decodeJSON(w, r, &body) { return }
+			if _, err := s.DB.Exec(`DELETE FROM task_sequences WHERE id=?`, body.ID); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "delete", "task_sequence", map[string]any{"id": body.ID})
+			writeJSON(w, 200, map[string]any{"deleted": body.ID})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+}
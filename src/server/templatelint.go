@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template/parse"
+)
+
+// ---- Template linting ----
+// lintTemplate checks a template before it is saved: it must parse, may only
+// reference variables renderAnswerFile provides and template secrets by
+// quoted name, and must render to a plausible document for its kind. Unattend output is checked against the
+// structure Windows Setup requires (root element and namespace, settings
+// passes, component attributes); full XSD validation needs the Windows ADK
+// schema, which we do not ship. Problems carry a line number where known.
+type lintIssue struct {
+	Line     int    `json:"line,omitempty"`
+	Severity string `json:"severity"` // error|warning
+	Message  string `json:"message"`
+}
+
+// templateVars is the data every answer-file template is rendered with; keep
+// in sync with answerFileVars.
+var templateVars = []string{"DeploymentID", "MAC", "Hostname", "ServerURL", "AdminPassword", "AgentToken",
+	"Locale", "LinuxLocale", "Timezone", "WindowsTimezone", "InputLocale", "KeyboardLayout", "KeyboardVariant"}
+
+// lintKinds are the kinds the linter understands; ipxe covers custom boot
+// scripts, which are linted but not stored as answer-file templates.
+var lintKinds = map[string]bool{"unattend": true, "cloud-init": true, "ipxe": true}
+
+const unattendNS = "urn:schemas-microsoft-com:unattend"
+
+var unattendPasses = map[string]bool{"windowsPE": true, "offlineServicing": true, "generalize": true, "specialize": true,
+	"auditSystem": true, "auditUser": true, "oobeSystem": true}
+
+var unattendArchs = map[string]bool{"x86": true, "amd64": true, "arm64": true, "wow64": true, "ia64": true}
+
+var templateErrLine = regexp.MustCompile(`^template: [^:]*:(\d+)(?::\d+)?: (.*)$`)
+
+// walkTemplate calls fn for every node of a parse tree.
+func walkTemplate(n parse.Node, fn func(parse.Node)) {
+	if n == nil { return }
+	walk := func(c parse.Node) { walkTemplate(c, fn) }
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil { return }
+		for _, c := range n.Nodes { walk(c) }
+	case *parse.ActionNode:
+		walk(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil { return }
+		for _, c := range n.Cmds { walk(c) }
+	case *parse.CommandNode:
+		for _, a := range n.Args { walk(a) }
+	case *parse.ChainNode:
+		walk(n.Node)
+	case *parse.IfNode:
+		walk(n.Pipe); walk(n.List); walk(n.ElseList)
+	case *parse.RangeNode:
+		walk(n.Pipe); walk(n.List); walk(n.ElseList)
+	case *parse.WithNode:
+		walk(n.Pipe); walk(n.List); walk(n.ElseList)
+	case *parse.TemplateNode:
+		walk(n.Pipe)
+	}
+	fn(n)
+}
+
+// templateFields collects the top-level .Field references in a parse tree
+// with the line each first appears on.
+func templateFields(tree *parse.Tree) map[string]int {
+	out := map[string]int{}
+	walkTemplate(tree.Root, func(n parse.Node) {
+		f, ok := n.(*parse.FieldNode)
+		if !ok { return }
+		if _, ok := out[f.Ident[0]]; !ok { loc, _ := tree.ErrorContext(f); out[f.Ident[0]] = locationLine(loc) }
+	})
+	return out
+}
+
+// templateSecretRefs collects the names passed to secret, as an argument or
+// piped in, with the line each first appears on. Calls whose argument is not
+// a single quoted name are returned under "" (the first one's line), as they
+// can't be checked or authorized ahead of rendering.
+func templateSecretRefs(tree *parse.Tree) map[string]int {
+	out := map[string]int{}
+	walkTemplate(tree.Root, func(n parse.Node) {
+		p, ok := n.(*parse.PipeNode)
+		if !ok { return }
+		for i, c := range p.Cmds {
+			if id, ok := c.Args[0].(*parse.IdentifierNode); !ok || id.Ident != "secret" { continue }
+			var name string
+			switch {
+			case len(c.Args) == 2:
+				if s, ok := c.Args[1].(*parse.StringNode); ok { name = s.Text }
+			case len(c.Args) == 1 && i > 0 && len(p.Cmds[i-1].Args) == 1:
+				if s, ok := p.Cmds[i-1].Args[0].(*parse.StringNode); ok { name = s.Text }
+			}
+			if _, ok := out[name]; !ok { loc, _ := tree.ErrorContext(c); out[name] = locationLine(loc) }
+		}
+	})
+	return out
+}
+
+// locationLine turns parse.Tree.ErrorContext's "name:line:col" into a line.
+func locationLine(loc string) int {
+	parts := strings.Split(loc, ":")
+	if len(parts) < 2 { return 0 }
+	n, _ := strconv.Atoi(parts[1])
+	return n
+}
+
+func lintTemplate(kind, body string) []lintIssue {
+	issues := []lintIssue{}
+	errorf := func(line int, format string, a ...any) {
+		issues = append(issues, lintIssue{Line: line, Severity: "error", Message: fmt.Sprintf(format, a...)})
+	}
+	warnf := func(line int, format string, a ...any) {
+		issues = append(issues, lintIssue{Line: line, Severity: "warning", Message: fmt.Sprintf(format, a...)})
+	}
+	if strings.TrimSpace(body) == "" { errorf(0, "template is empty"); return issues }
+	t, err := newAnswerTemplate(kind, body, nil).Parse(body)
+	if err != nil {
+		if m := templateErrLine.FindStringSubmatch(err.Error()); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			errorf(line, "%s", m[2])
+		} else {
+			errorf(0, "%s", err.Error())
+		}
+		return issues
+	}
+	known := map[string]bool{}
+	for _, v := range templateVars { known[v] = true }
+	fields := templateFields(t.Tree)
+	names := make([]string, 0, len(fields))
+	for name := range fields { names = append(names, name) }
+	sort.Slice(names, func(i, j int) bool { return fields[names[i]] < fields[names[j]] })
+	for _, name := range names {
+		if known[name] { continue }
+		hint := ""
+		for _, v := range templateVars {
+			if strings.EqualFold(v, name) { hint = fmt.Sprintf(" (did you mean .%s?)", v) }
+		}
+		if hint == "" { hint = " (available: ." + strings.Join(templateVars, ", .") + ")" }
+		errorf(fields[name], "unknown variable .%s%s", name, hint)
+	}
+	refs := templateSecretRefs(t.Tree)
+	names = names[:0]
+	for name := range refs { names = append(names, name) }
+	sort.Slice(names, func(i, j int) bool { return refs[names[i]] < refs[names[j]] })
+	for _, name := range names {
+		if name == "" {
+			errorf(refs[name], `secret takes one quoted name, e.g. {{secret "domain_join_password"}}`)
+		} else if !templateSecretName.MatchString(name) {
+			errorf(refs[name], "invalid secret name %q", name)
+		}
+	}
+	if len(issues) > 0 { return issues }
+
+	sample := map[string]string{}
+	for _, v := range templateVars { sample[v] = "sample-" + strings.ToLower(v) }
+	sample["MAC"] = "00:11:22:33:44:55"
+	sample["ServerURL"] = "https://bootah.example"
+	sample["AdminPassword"] = "p&ss<w>rd"
+	(&RegionalPreset{Locale: "de-DE", Timezone: "Europe/Berlin", WindowsTimezone: "W. Europe Standard Time", InputLocale: "0407:00000407",
+		KeyboardLayout: "de", KeyboardVariant: "nodeadkeys"}).addTemplateVars(sample)
+	out, err := renderTemplate(kind, body, sample, nil)
+	if err != nil {
+		line := 0
+		if m := templateErrLine.FindStringSubmatch(err.Error()); m != nil { line, _ = strconv.Atoi(m[1]) }
+		errorf(line, "render: %v", err)
+		return issues
+	}
+	switch kind {
+	case "unattend":
+		lintUnattend(out, errorf, warnf)
+	case "cloud-init":
+		lintCloudInit(out, errorf, warnf)
+	case "ipxe":
+		if !strings.HasPrefix(out, "#!ipxe") { errorf(1, "iPXE scripts must start with #!ipxe") }
+	}
+	if kind == "cloud-init" {
+		for n, line := range strings.Split(body, "\n") {
+			if strings.Contains(line, `"{{`) || strings.Contains(line, `'{{`) { warnf(n+1, "values are rendered quoted; drop the quotes around the action") }
+		}
+	}
+	return issues
+}
+
+type lintFunc func(line int, format string, a ...any)
+
+// lintUnattend checks well-formedness and the unattend structure. Line numbers
+// refer to the rendered output, which matches the template unless an action
+// expands to several lines.
+func lintUnattend(doc string, errorf, warnf lintFunc) {
+	dec := xml.NewDecoder(strings.NewReader(doc))
+	depth, root := 0, false
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) { break }
+		if err != nil {
+			var se *xml.SyntaxError
+			if errors.As(err, &se) { errorf(se.Line, "XML: %s", se.Msg) } else { errorf(0, "XML: %v", err) }
+			return
+		}
+		line, _ := dec.InputPos()
+		switch el := tok.(type) {
+		case xml.StartElement:
+			depth++
+			attr := func(name string) string {
+				for _, a := range el.Attr { if a.Name.Local == name { return a.Value } }
+				return ""
+			}
+			switch {
+			case depth == 1:
+				root = true
+				if el.Name.Local != "unattend" { errorf(line, "root element must be <unattend>, got <%s>", el.Name.Local) }
+				if el.Name.Space != unattendNS { errorf(line, "root element must declare xmlns=%q", unattendNS) }
+			case el.Name.Local == "settings":
+				if p := attr("pass"); !unattendPasses[p] { errorf(line, "<settings> has invalid pass %q", p) }
+			case el.Name.Local == "component":
+				if attr("name") == "" { errorf(line, "<component> is missing the name attribute") }
+				if a := attr("processorArchitecture"); !unattendArchs[a] { errorf(line, "<component> has invalid processorArchitecture %q", a) }
+				for _, req := range []string{"publicKeyToken", "language", "versionScope"} {
+					if attr(req) == "" { warnf(line, "<component name=%q> is missing %s", attr("name"), req) }
+				}
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+	if !root { errorf(0, "document has no root element") }
+}
+
+// lintCloudInit checks the header and the YAML mistakes that most often
+// break cloud-init: tab indentation and a missing #cloud-config marker.
+func lintCloudInit(doc string, errorf, warnf lintFunc) {
+	first := strings.SplitN(doc, "\n", 2)[0]
+	switch {
+	case strings.HasPrefix(first, "#cloud-config"), strings.HasPrefix(first, "#!"), strings.HasPrefix(first, "#include"),
+		strings.HasPrefix(first, "## template:"), strings.HasPrefix(first, "Content-Type: multipart/"):
+	default:
+		errorf(1, "cloud-init user data must start with #cloud-config (or #! for a script)")
+		return
+	}
+	if !strings.HasPrefix(first, "#cloud-config") { return }
+	sc := bufio.NewScanner(strings.NewReader(doc))
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if strings.Contains(indent, "\t") { errorf(n, "YAML does not allow tabs for indentation") }
+		if strings.HasSuffix(line, " ") && strings.TrimSpace(line) != "" { warnf(n, "trailing whitespace") }
+	}
+}
+
+// lintErrors reduces issues to the blocking ones.
+func lintErrors(issues []lintIssue) []lintIssue {
+	var out []lintIssue
+	for _, i := range issues { if i.Severity == "error" { out = append(out, i) } }
+	return out
+}
+
+func (s *Server) templateLintRoutes() {
+	// POST {"kind":"unattend","body":"..."} -> {"ok":bool,"issues":[...]}
+	s.Mux.HandleFunc("/api/v1/admin/templates/lint", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		var body struct{ Kind, Body string }
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<20)).Decode(&body); err != nil { http.Error(w, err.Error(), 400); return }
+		body.Kind = strings.ToLower(strings.TrimSpace(body.Kind))
+		if !lintKinds[body.Kind] { http.Error(w, "invalid kind", 400); return }
+		issues := lintTemplate(body.Kind, body.Body)
+		writeJSON(w, 200, map[string]any{"ok": len(lintErrors(issues)) == 0, "issues": issues, "variables": templateVars})
+	})
+}
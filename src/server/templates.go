@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// ---- Answer-file templates (unattend.xml / cloud-init) ----
+func initTemplates(db *sql.DB) error {
+	ddl := `CREATE TABLE IF NOT EXISTS templates (
+		id TEXT PRIMARY KEY,
+		name TEXT UNIQUE NOT NULL,
+		kind TEXT NOT NULL,
+		body TEXT NOT NULL,
+		updated TEXT NOT NULL
+	);`
+	_, err := db.Exec(ddl)
+	return err
+}
+
+var templateKinds = map[string]bool{"unattend": true, "cloud-init": true}
+
+// xmlEscape is applied to every value rendered into an unattend template so
+// generated passwords containing &, < or > don't corrupt the XML.
+func xmlEscape(v string) string {
+	var b bytes.Buffer
+	_ = xml.EscapeText(&b, []byte(v))
+	return b.String()
+}
+
+// yamlQuote renders v as a double-quoted YAML scalar, so passwords and
+// hostnames can't end the value early or start a new key.
+func yamlQuote(v string) string { return strconv.Quote(v) }
+
+// shellQuote renders v as one single-quoted shell word.
+func shellQuote(v string) string { return "'" + strings.ReplaceAll(v, "'", `'\''`) + "'" }
+
+// templateEscaper returns how values are escaped for a template: XML text for
+// unattend, a quoted YAML scalar for cloud-config and a quoted shell word for
+// #! user-data scripts. Quoted values carry their own quotes.
+func templateEscaper(kind, body string) func(string) string {
+	switch {
+	case kind == "unattend":
+		return xmlEscape
+	case kind == "cloud-init" && strings.HasPrefix(body, "#!"):
+		return shellQuote
+	case kind == "cloud-init":
+		return yamlQuote
+	}
+	return func(v string) string { return v }
+}
+
+// secretPlaceholder is what {{secret "name"}} renders to wherever the value
+// must not appear (lint samples, deployment plans).
+func secretPlaceholder(name string) (string, error) { return "<secret:" + name + ">", nil }
+
+// newAnswerTemplate is the template an answer file body is parsed as; secret
+// resolves {{secret "name"}} and {{"name" | secret}}, escaped like every other
+// value.
+func newAnswerTemplate(kind, body string, secret func(name string) (string, error)) *template.Template {
+	if secret == nil { secret = secretPlaceholder }
+	escape := templateEscaper(kind, body)
+	return template.New(kind).Option("missingkey=error").Funcs(template.FuncMap{"secret": func(name string) (string, error) {
+		v, err := secret(name)
+		if err != nil { return "", err }
+		return escape(v), nil
+	}})
+}
+
+// renderTemplate executes a stored template against vars. Values are escaped
+// for the template kind before rendering. secret resolves named template
+// secrets; nil renders placeholders instead.
+func renderTemplate(kind, body string, vars map[string]string, secret func(name string) (string, error)) (string, error) {
+	escape := templateEscaper(kind, body)
+	data := map[string]string{}
+	for k, v := range vars { data[k] = escape(v) }
+	t, err := newAnswerTemplate(kind, body, secret).Parse(body)
+	if err != nil { return "", err }
+	var out bytes.Buffer
+	if err := t.Execute(&out, data); err != nil { return "", err }
+	return out.String(), nil
+}
+
+func (s *Server) templateRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/templates", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := s.DB.Query(`SELECT id, name, kind, body, updated FROM templates ORDER BY name`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			var out []map[string]any
+			for rows.Next() {
+				var id, name, kind, body, updated string
+				if err := rows.Scan(&id, &name, &kind, &body, &updated); err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, map[string]any{"id": id, "name": name, "kind": kind, "body": body, "updated": updated})
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPost, http.MethodPut:
+			var body struct{ ID, Name, Kind, Body string }
+			if !decodeJSON(w, r, &body) { return }
+			body.Kind = strings.ToLower(strings.TrimSpace(body.Kind))
+			if !templateKinds[body.Kind] { http.Error(w, "invalid kind", 400); return }
+			if strings.TrimSpace(body.Name) == "" { http.Error(w, "name required", 400); return }
+			if errs := lintErrors(lintTemplate(body.Kind, body.Body)); len(errs) > 0 {
+				writeJSON(w, 400, map[string]any{"error": "template has errors", "issues": errs}); return
+			}
+			now := time.Now().Format(time.RFC3339)
+			if r.Method == http.MethodPut {
+				res, err := s.DB.Exec(`UPDATE templates SET name=?, kind=?, body=?, updated=? WHERE id=?`, body.Name, body.Kind, body.Body, now, body.ID)
+				if err != nil { http.Error(w, err.Error(), 500); return }
+				if n, _ := res.RowsAffected(); n == 0 { http.NotFound(w, r); return }
+				s.audit(s.actorID(r), "update", "template", map[string]any{"id": body.ID, "name": body.Name})
+				writeJSON(w, 200, map[string]any{"id": body.ID})
+				return
+			}
+			id := "tpl-" + genID()
+			if _, err := s.DB.Exec(`INSERT INTO templates (id, name, kind, body, updated) VALUES (?,?,?,?,?)`, id, body.Name, body.Kind, body.Body, now); err != nil {
+				http.Error(w, err.Error(), 500); return
+			}
+			s.audit(s.actorID(r), "create", "template", map[string]any{"id": id, "name": body.Name})
+			writeJSON(w, 201, map[string]any{"id": id})
+		case http.MethodDelete:
+			var body struct{ ID string `json:"id"` }
+			if !decodeJSON(w, r, &body) { return }
+			if _, err := s.DB.Exec(`DELETE FROM templates WHERE id=?`, body.ID); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "delete", "template", map[string]any{"id": body.ID})
+			writeJSON(w, 200, map[string]any{"deleted": body.ID})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+}
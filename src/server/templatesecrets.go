@@ -0,0 +1,229 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ---- Template secrets ----
+// Answer-file templates reference named secrets (domain join passwords,
+// Wi-Fi keys, license keys) with {{secret "name"}} or {{"name" | secret}}
+// instead of carrying them, and render escaped for the answer file's format
+// like any variable. Values are stored sealed and bound late: only the answer file an agent
+// fetches for an active deployment (/api/v1/agent/answer) resolves them, and
+// the rendered document is served with no-store and never kept. A secret may
+// be limited to machine groups and sites (group_ids, site_ids; a machine
+// qualifies through either); a deployment to any other machine fails to
+// render. Every resolution is audited (template_secret.resolve) with the
+// deployment and machine. Lint and plans render <secret:name> and plans check
+// that each referenced secret exists and is available to the machine.
+// Admins manage secrets with /api/v1/admin/template_secrets[/{name}]; values
+// are write-only and never returned.
+type TemplateSecret struct {
+	Name           string   `json:"name"`
+	Value          string   `json:"value,omitempty"`
+	Description    string   `json:"description,omitempty"`
+	GroupIDs       []string `json:"group_ids"`
+	SiteIDs        []string `json:"site_ids"`
+	UpdatedBy      int64    `json:"updated_by,omitempty"`
+	UpdatedAt      string   `json:"updated_at"`
+	LastResolvedAt string   `json:"last_resolved_at,omitempty"`
+}
+
+var templateSecretName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+func initTemplateSecrets(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS template_secrets (
+		name TEXT PRIMARY KEY,
+		value TEXT NOT NULL,
+		description TEXT,
+		group_ids TEXT,
+		site_ids TEXT,
+		updated_by INTEGER,
+		updated_at TEXT NOT NULL,
+		last_resolved_at TEXT
+	)`)
+	return err
+}
+
+func (t *TemplateSecret) validateFields(v *validator) {
+	if v.required("name", t.Name) && !templateSecretName.MatchString(t.Name) { v.add("name", "letters, digits, _ . - only (at most 64)") }
+	v.maxLen("description", t.Description, 256)
+	v.maxLen("value", t.Value, 64<<10)
+}
+
+const templateSecretColumns = `name, value, COALESCE(description,''), COALESCE(group_ids,''), COALESCE(site_ids,''), COALESCE(updated_by,0), updated_at, COALESCE(last_resolved_at,'') FROM template_secrets`
+
+// scanTemplateSecret returns the secret with its value still sealed.
+func scanTemplateSecret(row interface{ Scan(...any) error }) (*TemplateSecret, error) {
+	var t TemplateSecret
+	var groups, sites string
+	if err := row.Scan(&t.Name, &t.Value, &t.Description, &groups, &sites, &t.UpdatedBy, &t.UpdatedAt, &t.LastResolvedAt); err != nil { return nil, err }
+	t.GroupIDs, t.SiteIDs = splitList(groups), splitList(sites)
+	return &t, nil
+}
+
+// availableTo reports whether a machine in groups, booting from site, may use
+// the secret.
+func (t *TemplateSecret) availableTo(groups []string, site string) bool {
+	if len(t.GroupIDs) == 0 && len(t.SiteIDs) == 0 { return true }
+	for _, g := range groups {
+		for _, id := range t.GroupIDs {
+			if g == id { return true }
+		}
+	}
+	for _, id := range t.SiteIDs {
+		if site != "" && site == id { return true }
+	}
+	return false
+}
+
+// secretResolver returns the secret function a deployment's answer file is
+// rendered with. With reveal it unseals values and audits each resolution;
+// without (plans) it only checks the secret is available and renders the
+// placeholder.
+func (s *Server) secretResolver(deploymentID, mac, templateID string, reveal bool) func(name string) (string, error) {
+	var groups []string
+	var site string
+	scoped := false
+	resolved := map[string]string{}
+	return func(name string) (string, error) {
+		if v, ok := resolved[name]; ok { return v, nil }
+		t, err := scanTemplateSecret(s.DB.QueryRow(`SELECT `+templateSecretColumns+` WHERE name=?`, name))
+		if errors.Is(err, sql.ErrNoRows) { return "", fmt.Errorf("unknown secret %q", name) }
+		if err != nil { return "", err }
+		if !scoped {
+			if groups, err = s.groupsForMachine(mac); err != nil { return "", err }
+			var ip string
+			_ = s.DB.QueryRow(`SELECT COALESCE(last_boot_ip,'') FROM machines WHERE mac=?`, mac).Scan(&ip)
+			st, err := s.siteForIP(net.ParseIP(ip))
+			if err != nil { return "", err }
+			if st != nil { site = st.ID }
+			scoped = true
+		}
+		if !t.availableTo(groups, site) { return "", fmt.Errorf("secret %q is not available to %s", name, mac) }
+		v, _ := secretPlaceholder(name)
+		if reveal {
+			if v, err = s.unseal(t.Value); err != nil { return "", fmt.Errorf("secret %q: %w", name, err) }
+			_, _ = s.DB.Exec(`UPDATE template_secrets SET last_resolved_at=? WHERE name=?`, time.Now().UTC().Format(time.RFC3339), name)
+			s.audit(nil, "resolve", "template_secret", map[string]any{"name": name, "deployment_id": deploymentID, "mac": mac, "template_id": templateID})
+		}
+		resolved[name] = v
+		return v, nil
+	}
+}
+
+// checkSecretScope verifies group and site ids exist.
+func (s *Server) checkSecretScope(t *TemplateSecret) error {
+	for _, id := range t.GroupIDs {
+		var n int
+		_ = s.DB.QueryRow(`SELECT COUNT(*) FROM machine_groups WHERE id=?`, id).Scan(&n)
+		if n == 0 { return fmt.Errorf("unknown group %q", id) }
+	}
+	for _, id := range t.SiteIDs {
+		var n int
+		_ = s.DB.QueryRow(`SELECT COUNT(*) FROM sites WHERE id=?`, id).Scan(&n)
+		if n == 0 { return fmt.Errorf("unknown site %q", id) }
+	}
+	return nil
+}
+
+// templatesUsingSecret names the stored templates that reference a secret.
+func (s *Server) templatesUsingSecret(name string) ([]string, error) {
+	rows, err := s.DB.Query(`SELECT name, kind, body FROM templates ORDER BY name`)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	out := []string{}
+	for rows.Next() {
+		var tname, kind, body string
+		if err := rows.Scan(&tname, &kind, &body); err != nil { return nil, err }
+		t, err := newAnswerTemplate(kind, body, nil).Parse(body)
+		if err != nil { continue }
+		if _, ok := templateSecretRefs(t.Tree)[name]; ok { out = append(out, tname) }
+	}
+	return out, rows.Err()
+}
+
+func (s *Server) templateSecretRoutes() {
+	// GET lists secrets without values; POST {name, value, description?,
+	// group_ids?, site_ids?} adds one
+	s.Mux.HandleFunc("/api/v1/admin/template_secrets", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := s.DB.Query(`SELECT ` + templateSecretColumns + ` ORDER BY name`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			out := []*TemplateSecret{}
+			for rows.Next() {
+				t, err := scanTemplateSecret(rows)
+				if err != nil { http.Error(w, err.Error(), 500); return }
+				t.Value = ""
+				out = append(out, t)
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPost:
+			var t TemplateSecret
+			if !decodeJSON(w, r, &t) { return }
+			if t.Value == "" { http.Error(w, "value required", 400); return }
+			if err := s.checkSecretScope(&t); err != nil { http.Error(w, err.Error(), 400); return }
+			var n int
+			if err := s.DB.QueryRow(`SELECT COUNT(*) FROM template_secrets WHERE name=?`, t.Name).Scan(&n); err != nil { http.Error(w, err.Error(), 500); return }
+			if n > 0 { http.Error(w, "secret exists", 409); return }
+			sealed, err := s.seal(t.Value)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			if _, c, err := s.verifyAuth(r); err == nil { t.UpdatedBy, _ = c["sub"].(int64) }
+			t.Value, t.UpdatedAt = "", time.Now().UTC().Format(time.RFC3339)
+			_, err = s.DB.Exec(`INSERT INTO template_secrets (name, value, description, group_ids, site_ids, updated_by, updated_at) VALUES (?,?,NULLIF(?,''),?,?,NULLIF(?,0),?)`,
+				t.Name, sealed, t.Description, strings.Join(t.GroupIDs, ","), strings.Join(t.SiteIDs, ","), t.UpdatedBy, t.UpdatedAt)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "create", "template_secret", map[string]any{"name": t.Name, "group_ids": t.GroupIDs, "site_ids": t.SiteIDs})
+			writeJSON(w, 201, t)
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// PUT replaces description and scope, and the value when one is given;
+	// DELETE refuses while a template references the secret
+	s.Mux.HandleFunc("/api/v1/admin/template_secrets/", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		name := strings.TrimPrefix(r.URL.Path, "/api/v1/admin/template_secrets/")
+		cur, err := scanTemplateSecret(s.DB.QueryRow(`SELECT `+templateSecretColumns+` WHERE name=?`, name))
+		if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		switch r.Method {
+		case http.MethodPut:
+			t := TemplateSecret{Name: name}
+			if !decodeJSON(w, r, &t) { return }
+			t.Name = name
+			if err := s.checkSecretScope(&t); err != nil { http.Error(w, err.Error(), 400); return }
+			sealed := cur.Value
+			if t.Value != "" {
+				if sealed, err = s.seal(t.Value); err != nil { http.Error(w, err.Error(), 500); return }
+			}
+			if _, c, err := s.verifyAuth(r); err == nil { t.UpdatedBy, _ = c["sub"].(int64) }
+			t.Value, t.UpdatedAt, t.LastResolvedAt = "", time.Now().UTC().Format(time.RFC3339), cur.LastResolvedAt
+			_, err = s.DB.Exec(`UPDATE template_secrets SET value=?, description=NULLIF(?,''), group_ids=?, site_ids=?, updated_by=NULLIF(?,0), updated_at=? WHERE name=?`,
+				sealed, t.Description, strings.Join(t.GroupIDs, ","), strings.Join(t.SiteIDs, ","), t.UpdatedBy, t.UpdatedAt, name)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "update", "template_secret", map[string]any{"name": name, "value_changed": sealed != cur.Value, "group_ids": t.GroupIDs, "site_ids": t.SiteIDs})
+			writeJSON(w, 200, t)
+		case http.MethodDelete:
+			used, err := s.templatesUsingSecret(name)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			if len(used) > 0 { http.Error(w, "secret is used by templates: "+strings.Join(used, ", "), 409); return }
+			if _, err := s.DB.Exec(`DELETE FROM template_secrets WHERE name=?`, name); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "delete", "template_secret", map[string]any{"name": name})
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ---- HTTPS ----
+// BOOTAH_TLS_MODE picks how the API and UI are served:
+//
+//	off         plain HTTP on BOOTAH_HTTP_PORT (default)
+//	manual      BOOTAH_TLS_CERT and BOOTAH_TLS_KEY (PEM files, re-read when
+//	            they change, so renewals need no restart)
+//	selfsigned  a certificate generated on first start for BOOTAH_TLS_HOSTS
+//	            (default: the BOOTAH_PUBLIC_URL host, the machine's hostname,
+//	            localhost) and kept in BOOTAH_TLS_DIR (default tls/ next to
+//	            the database); it is regenerated when it nears expiry or the
+//	            hosts change, and its SHA-256 fingerprint is logged for pinning
+//	acme        Let's Encrypt (or BOOTAH_ACME_DIRECTORY) through autocert for
+//	            BOOTAH_ACME_DOMAINS, with BOOTAH_ACME_EMAIL as contact and
+//	            the account and certificates cached in BOOTAH_TLS_DIR/acme;
+//	            the HTTP-01 challenge is answered on BOOTAH_HTTP_PORT, which
+//	            must be reachable as port 80
+//
+// With TLS on, HTTPS listens on BOOTAH_HTTPS_PORT (default 8443) and the HTTP
+// port redirects to it, except for BOOTAH_TLS_PLAIN_PATHS (default /ipxe/,
+// /assets/ and /api/health): firmware and iPXE builds without the
+// certificate's CA fetch boot scripts and assets there. BOOTAH_TLS_REDIRECT=
+// false serves everything on both ports instead.
+func tlsMode() string { return strings.ToLower(getenv("BOOTAH_TLS_MODE", "off")) }
+
+func tlsDir() string {
+	return getenv("BOOTAH_TLS_DIR", filepath.Join(filepath.Dir(getenv("BOOTAH_DB_PATH", "./data/bootah.db")), "tls"))
+}
+
+// serveHTTP starts the listeners for h and returns them for shutdown.
+func serveHTTP(h http.Handler, port string) ([]*http.Server, error) {
+	mode := tlsMode()
+	if mode == "off" {
+		srv := newHTTPServer(":"+port, h)
+		go listen(srv, "http", srv.ListenAndServe)
+		return []*http.Server{srv}, nil
+	}
+	httpsPort := getenv("BOOTAH_HTTPS_PORT", "8443")
+	plain := plainHandler(h, httpsPort)
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch mode {
+	case "manual":
+		c := &fileCert{cert: getenv("BOOTAH_TLS_CERT", ""), key: getenv("BOOTAH_TLS_KEY", "")}
+		if c.cert == "" || c.key == "" { return nil, fmt.Errorf("BOOTAH_TLS_MODE=manual needs BOOTAH_TLS_CERT and BOOTAH_TLS_KEY") }
+		if _, err := c.get(nil); err != nil { return nil, err }
+		cfg.GetCertificate = c.get
+	case "selfsigned":
+		cert, err := selfSignedCert(tlsDir(), tlsHosts())
+		if err != nil { return nil, fmt.Errorf("self-signed certificate: %w", err) }
+		cfg.Certificates = []tls.Certificate{cert}
+	case "acme":
+		domains := splitList(getenv("BOOTAH_ACME_DOMAINS", ""))
+		if len(domains) == 0 { return nil, fmt.Errorf("BOOTAH_TLS_MODE=acme needs BOOTAH_ACME_DOMAINS") }
+		m := &autocert.Manager{Prompt: autocert.AcceptTOS, HostPolicy: autocert.HostWhitelist(domains...), Cache: autocert.DirCache(filepath.Join(tlsDir(), "acme")),
+			Email: getenv("BOOTAH_ACME_EMAIL", "")}
+		if dir := getenv("BOOTAH_ACME_DIRECTORY", ""); dir != "" { m.Client = &acme.Client{DirectoryURL: dir} }
+		cfg.GetCertificate = m.GetCertificate
+		cfg.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+		plain = m.HTTPHandler(plain)
+	default:
+		return nil, fmt.Errorf("BOOTAH_TLS_MODE must be off, selfsigned, acme or manual, not %q", mode)
+	}
+	secure := newHTTPServer(":"+httpsPort, h)
+	secure.TLSConfig = cfg
+	insecure := newHTTPServer(":"+port, plain)
+	go listen(secure, "https", func() error { return secure.ListenAndServeTLS("", "") })
+	go listen(insecure, "http", insecure.ListenAndServe)
+	return []*http.Server{secure, insecure}, nil
+}
+
+func listen(srv *http.Server, scheme string, serve func() error) {
+	log.Printf("listening on %s://localhost%s", scheme, srv.Addr)
+	if err := serve(); err != nil && err != http.ErrServerClosed { log.Fatalf("server error: %v", err) }
+}
+
+// plainHandler is what the HTTP port serves while TLS is on: the plain paths,
+// and a redirect to HTTPS for everything else.
+func plainHandler(h http.Handler, httpsPort string) http.Handler {
+	if getenv("BOOTAH_TLS_REDIRECT", "true") != "true" { return h }
+	paths := splitList(getenv("BOOTAH_TLS_PLAIN_PATHS", "/ipxe/,/assets/,/api/health"))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, p := range paths {
+			if r.URL.Path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(r.URL.Path, p) { h.ServeHTTP(w, r); return }
+		}
+		host := r.Host
+		if hh, _, err := net.SplitHostPort(host); err == nil { host = hh }
+		if strings.Contains(host, ":") { host = "[" + host + "]" }
+		if httpsPort != "443" { host += ":" + httpsPort }
+		u := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		code := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead { code = http.StatusPermanentRedirect }
+		http.Redirect(w, r, u.String(), code)
+	})
+}
+
+// fileCert serves a certificate from PEM files, reloading them when either
+// changes.
+type fileCert struct {
+	cert, key string
+	mu        sync.Mutex
+	loaded    *tls.Certificate
+	mtime     time.Time
+}
+
+func (c *fileCert) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var mtime time.Time
+	for _, f := range []string{c.cert, c.key} {
+		st, err := os.Stat(f)
+		if err != nil { if c.loaded != nil { return c.loaded, nil }; return nil, err }
+		if st.ModTime().After(mtime) { mtime = st.ModTime() }
+	}
+	if c.loaded != nil && !mtime.After(c.mtime) { return c.loaded, nil }
+	cert, err := tls.LoadX509KeyPair(c.cert, c.key)
+	if err != nil {
+		// a renewal caught half-written keeps the previous pair
+		if c.loaded != nil { log.Printf("tls: reloading %s: %v", c.cert, err); return c.loaded, nil }
+		return nil, err
+	}
+	c.loaded, c.mtime = &cert, mtime
+	return c.loaded, nil
+}
+
+// tlsHosts are the names and addresses a self-signed certificate covers.
+func tlsHosts() []string {
+	if hosts := splitList(getenv("BOOTAH_TLS_HOSTS", "")); len(hosts) > 0 { return hosts }
+	var hosts []string
+	if u, err := url.Parse(getenv("BOOTAH_PUBLIC_URL", "")); err == nil && u.Hostname() != "" { hosts = append(hosts, u.Hostname()) }
+	if h, err := os.Hostname(); err == nil && h != "" { hosts = append(hosts, h) }
+	return append(hosts, "localhost", "127.0.0.1", "::1")
+}
+
+// selfSignedCert loads the certificate kept in dir, or generates a new one
+// when there is none, it expires within 30 days or it doesn't cover hosts.
+func selfSignedCert(dir string, hosts []string) (tls.Certificate, error) {
+	certFile, keyFile := filepath.Join(dir, "selfsigned.crt"), filepath.Join(dir, "selfsigned.key")
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil && time.Until(leaf.NotAfter) > 30*24*time.Hour && certCovers(leaf, hosts) {
+			logFingerprint(leaf.Raw, false)
+			return cert, nil
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil { return tls.Certificate{}, err }
+	serial, err := crand.Int(crand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil { return tls.Certificate{}, err }
+	now := time.Now()
+	tpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0], Organization: []string{"Bootah"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil { tpl.IPAddresses = append(tpl.IPAddresses, ip) } else { tpl.DNSNames = append(tpl.DNSNames, h) }
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil { return tls.Certificate{}, err }
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil { return tls.Certificate{}, err }
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.MkdirAll(dir, 0o700); err != nil { return tls.Certificate{}, err }
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil { return tls.Certificate{}, err }
+	if err := os.WriteFile(certFile, certPEM, 0o644); err != nil { return tls.Certificate{}, err }
+	logFingerprint(der, true)
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func certCovers(leaf *x509.Certificate, hosts []string) bool {
+	for _, h := range hosts {
+		if leaf.VerifyHostname(h) != nil { return false }
+	}
+	return true
+}
+
+func logFingerprint(der []byte, generated bool) {
+	sum := sha256.Sum256(der)
+	verb := "using"
+	if generated { verb = "generated" }
+	log.Printf("tls: %s self-signed certificate, SHA-256 fingerprint %s", verb, strings.ToUpper(hex.EncodeToString(sum[:])))
+}
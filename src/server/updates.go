@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ---- Offline update bundles (WSUS / Windows Update catalog) ----
+// A catalog-sync job reads a JSON feed of cumulative updates
+// (BOOTAH_UPDATE_CATALOG_URL) and mirrors new packages into Storage. Task
+// sequences reference them with an "install_update" step, either by bundle id
+// or "latest" for a product, and the agent installs them right after imaging.
+type UpdateCatalogEntry struct {
+	Product  string `json:"product"` // e.g. "windows11-23h2-x64"
+	KB       string `json:"kb"`
+	Title    string `json:"title"`
+	URL      string `json:"url"`
+	Released string `json:"released"`
+}
+
+func initUpdates(db *sql.DB) error {
+	ddl := `CREATE TABLE IF NOT EXISTS update_bundles (
+		id TEXT PRIMARY KEY,
+		product TEXT NOT NULL,
+		kb TEXT NOT NULL,
+		title TEXT,
+		source_url TEXT NOT NULL,
+		file TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		released TEXT,
+		synced_at TEXT NOT NULL,
+		UNIQUE (product, kb)
+	);`
+	_, err := db.Exec(ddl)
+	return err
+}
+
+// syncUpdateCatalog downloads catalog entries not yet mirrored.
+func (s *Server) syncUpdateCatalog(ctx context.Context, catalogURL string) (string, error) {
+	client := &http.Client{Timeout: 6 * time.Hour}
+	resp, err := client.Get(catalogURL)
+	if err != nil { return "", err }
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 { return "", fmt.Errorf("catalog: %s", resp.Status) }
+	var entries []UpdateCatalogEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil { return "", fmt.Errorf("catalog: %w", err) }
+	added := 0
+	for _, e := range entries {
+		if e.Product == "" || e.KB == "" || e.URL == "" { continue }
+		var n int
+		_ = s.DB.QueryRow(`SELECT COUNT(*) FROM update_bundles WHERE product=? AND kb=?`, e.Product, e.KB).Scan(&n)
+		if n > 0 { continue }
+		pkg, err := client.Get(e.URL)
+		if err != nil { return "", fmt.Errorf("%s: %w", e.KB, err) }
+		if pkg.StatusCode != 200 { pkg.Body.Close(); return "", fmt.Errorf("%s: %s", e.KB, pkg.Status) }
+		id := "upd-" + genID()
+		ext := ".msu"
+		if strings.HasSuffix(strings.ToLower(e.URL), ".cab") { ext = ".cab" }
+		key := "updates/" + id + ext
+		size, sum, err := s.StorePut(ctx, key, pkg.Body)
+		pkg.Body.Close()
+		if err != nil { return "", fmt.Errorf("%s: %w", e.KB, err) }
+		_, err = s.DB.Exec(`INSERT INTO update_bundles (id, product, kb, title, source_url, file, size, sha256, released, synced_at) VALUES (?,?,?,?,?,?,?,?,?,?)`,
+			id, e.Product, e.KB, e.Title, e.URL, key, size, sum, e.Released, time.Now().Format(time.RFC3339))
+		if err != nil { return "", err }
+		added++
+	}
+	return fmt.Sprintf("%d new bundles", added), nil
+}
+
+// resolveUpdateBundle finds a bundle by id, or the newest for a product when
+// ref is "latest".
+func (s *Server) resolveUpdateBundle(ref, product string) (map[string]any, error) {
+	q := `SELECT id, product, kb, COALESCE(title,''), size, sha256, COALESCE(released,'') FROM update_bundles WHERE id=?`
+	args := []any{ref}
+	if ref == "latest" {
+		q = `SELECT id, product, kb, COALESCE(title,''), size, sha256, COALESCE(released,'') FROM update_bundles WHERE product=? ORDER BY released DESC, synced_at DESC LIMIT 1`
+		args = []any{product}
+	}
+	var id, prod, kb, title, sum, released string; var size int64
+	if err := s.DB.QueryRow(q, args...).Scan(&id, &prod, &kb, &title, &size, &sum, &released); err != nil { return nil, err }
+	return map[string]any{"id": id, "product": prod, "kb": kb, "title": title, "size": size, "sha256": sum, "released": released,
+		"url": "/api/v1/agent/update/download?id=" + id}, nil
+}
+
+func (s *Server) updateRoutes() {
+	s.Mux.HandleFunc("/api/v1/admin/updates", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := s.DB.Query(`SELECT id, product, kb, COALESCE(title,''), size, sha256, COALESCE(released,''), synced_at FROM update_bundles ORDER BY product, released DESC`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			var out []map[string]any
+			for rows.Next() {
+				var id, product, kb, title, sum, released, synced string; var size int64
+				if err := rows.Scan(&id, &product, &kb, &title, &size, &sum, &released, &synced); err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, map[string]any{"id": id, "product": product, "kb": kb, "title": title, "size": size, "sha256": sum, "released": released, "synced_at": synced})
+			}
+			writeJSON(w, 200, out)
+		case http.MethodDelete:
+			if !s.requireRole(w, r, "admin") { return }
+			var body struct{ ID string `json:"id"` }
+			if !decodeJSON(w, r, &body) { return }
+			var key string
+			if err := s.DB.QueryRow(`SELECT file FROM update_bundles WHERE id=?`, body.ID).Scan(&key); err != nil {
+				if err == sql.ErrNoRows { http.NotFound(w, r); return }
+				http.Error(w, err.Error(), 500); return
+			}
+			_ = s.Store.Delete(r.Context(), key)
+			if _, err := s.DB.Exec(`DELETE FROM update_bundles WHERE id=?`, body.ID); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "delete", "update_bundle", map[string]any{"id": body.ID})
+			writeJSON(w, 200, map[string]any{"deleted": body.ID})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// Start a catalog-sync job: {"catalog_url": "..."} (defaults to BOOTAH_UPDATE_CATALOG_URL)
+	s.Mux.HandleFunc("/api/v1/admin/updates/sync", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		var body struct{ CatalogURL string `json:"catalog_url"` }
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		catalog := body.CatalogURL
+		if catalog == "" { catalog = getenv("BOOTAH_UPDATE_CATALOG_URL", "") }
+		var v validator
+		if v.required("catalog_url", catalog) { v.url("catalog_url", catalog) }
+		if err := v.err(); err != nil { badRequest(w, err); return }
+		id, err := s.runJob("update-sync", func(ctx context.Context) (string, error) { return s.syncUpdateCatalog(ctx, catalog) })
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		s.audit(s.actorID(r), "update_sync", "job", map[string]any{"job": id, "catalog": catalog})
+		writeJSON(w, 202, map[string]any{"id": id, "status": "running"})
+	})
+
+	// Agent: resolve an install_update step (?bundle=<id>|latest&product=...)
+	s.Mux.HandleFunc("/api/v1/agent/update", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireAgent(w, r) { return }
+		q := r.URL.Query()
+		b, err := s.resolveUpdateBundle(q.Get("bundle"), q.Get("product"))
+		if err != nil {
+			if err == sql.ErrNoRows { http.NotFound(w, r); return }
+			http.Error(w, err.Error(), 500); return
+		}
+		writeJSON(w, 200, b)
+	})
+
+	s.Mux.HandleFunc("/api/v1/agent/update/download", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireAgent(w, r) { return }
+		var key, kb string
+		if err := s.DB.QueryRow(`SELECT file, kb FROM update_bundles WHERE id=?`, r.URL.Query().Get("id")).Scan(&key, &kb); err != nil {
+			if err == sql.ErrNoRows { http.NotFound(w, r); return }
+			http.Error(w, err.Error(), 500); return
+		}
+		s.serveObject(w, r, key, kb+filepath.Ext(key), objectMeta{})
+	})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ---- Upload progress ----
+// Clients tag an upload with an X-Upload-ID header (or ?upload_id=) and can
+// poll /api/v1/uploads/{id}/progress or stream /api/v1/uploads/{id}/events
+// while the body is still arriving; resumable upload sessions report there
+// too. Progress lives in memory only and is
+// dropped an hour after the upload ends.
+type uploadProgress struct {
+	ID       string
+	Total    int64
+	received atomic.Int64
+	lastRead atomic.Int64 // unix nanos
+	Started  time.Time
+	session  bool // resumable session; idles between chunks
+
+	mu      sync.Mutex
+	status  string // receiving|storing|done|failed
+	imageID string
+	err     string
+	ended   time.Time
+}
+
+var uploadIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{8,64}$`)
+
+var uploadsMu sync.Mutex
+var uploadsInFlight = map[string]*uploadProgress{}
+
+func uploadStallAfter() time.Duration {
+	d, err := time.ParseDuration(getenv("BOOTAH_UPLOAD_STALL_AFTER", "60s"))
+	if err != nil { d = time.Minute }
+	return d
+}
+
+// trackUpload registers progress for r (if tagged) and wraps its body so reads
+// are counted. The returned tracker is nil for untagged uploads.
+func trackUpload(r *http.Request) (*uploadProgress, error) {
+	id := r.Header.Get("X-Upload-ID")
+	if id == "" { id = r.URL.Query().Get("upload_id") }
+	if id == "" { return nil, nil }
+	if !uploadIDPattern.MatchString(id) { return nil, fmt.Errorf("invalid upload id") }
+	p := &uploadProgress{ID: id, Total: r.ContentLength, Started: time.Now(), status: "receiving"}
+	p.lastRead.Store(time.Now().UnixNano())
+	uploadsMu.Lock()
+	defer uploadsMu.Unlock()
+	if old, ok := uploadsInFlight[id]; ok && old.ended.IsZero() { return nil, fmt.Errorf("upload %s already in progress", id) }
+	for k, old := range uploadsInFlight {
+		if !old.ended.IsZero() && time.Since(old.ended) > time.Hour { delete(uploadsInFlight, k) }
+	}
+	uploadsInFlight[id] = p
+	r.Body = &countingBody{ReadCloser: r.Body, p: p}
+	return p, nil
+}
+
+type countingBody struct {
+	io.ReadCloser
+	p *uploadProgress
+}
+
+func (c *countingBody) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	if n > 0 {
+		c.p.received.Add(int64(n))
+		c.p.lastRead.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (p *uploadProgress) setStatus(status string) {
+	if p == nil { return }
+	p.mu.Lock(); p.status = status; p.mu.Unlock()
+}
+
+func (p *uploadProgress) finish(imageID string, err error) {
+	if p == nil { return }
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ended = time.Now()
+	if err != nil { p.status, p.err = "failed", err.Error(); return }
+	p.status, p.imageID = "done", imageID
+}
+
+func (p *uploadProgress) lastActivity() time.Time { return time.Unix(0, p.lastRead.Load()) }
+
+// stalled reports a transfer still receiving that has seen no data for d.
+func (p *uploadProgress) stalled(d time.Duration) bool {
+	p.mu.Lock()
+	receiving := p.status == "receiving"
+	p.mu.Unlock()
+	return receiving && time.Since(p.lastActivity()) > d
+}
+
+func (p *uploadProgress) snapshot() map[string]any {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	recv := p.received.Load()
+	last := p.lastActivity()
+	out := map[string]any{"id": p.ID, "status": p.status, "received": recv, "total": p.Total, "session": p.session,
+		"started": p.Started.Format(time.RFC3339), "last_activity": last.Format(time.RFC3339)}
+	if p.Total > 0 { out["percent"] = float64(recv) * 100 / float64(p.Total) }
+	if secs := time.Since(p.Started).Seconds(); secs > 0 { out["bytes_per_sec"] = int64(float64(recv) / secs) }
+	out["stalled"] = p.status == "receiving" && time.Since(last) > uploadStallAfter()
+	if p.imageID != "" { out["image_id"] = p.imageID }
+	if p.err != "" { out["error"] = p.err }
+	return out
+}
+
+func lookupUpload(id string) (*uploadProgress, bool) {
+	uploadsMu.Lock()
+	defer uploadsMu.Unlock()
+	p, ok := uploadsInFlight[id]
+	return p, ok
+}
+
+func (s *Server) uploadRoutes() {
+	// All tracked uploads, newest first (?stalled=true: only stalled ones);
+	// POST opens a resumable upload session
+	s.Mux.HandleFunc("/api/v1/uploads", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method == http.MethodPost { s.createUploadSession(w, r); return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		uploadsMu.Lock()
+		list := make([]*uploadProgress, 0, len(uploadsInFlight))
+		for _, p := range uploadsInFlight { list = append(list, p) }
+		uploadsMu.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].Started.After(list[j].Started) })
+		onlyStalled := r.URL.Query().Get("stalled") == "true"
+		out := make([]map[string]any, 0, len(list))
+		for _, p := range list {
+			snap := p.snapshot()
+			if onlyStalled && snap["stalled"] != true { continue }
+			out = append(out, snap)
+		}
+		writeJSON(w, 200, out)
+	})
+
+	s.Mux.HandleFunc("/api/v1/uploads/", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/uploads/"), "/")
+		if len(parts) == 1 || (len(parts) == 2 && parts[1] == "complete") {
+			s.handleUploadSession(w, r, parts[0], len(parts) == 2)
+			return
+		}
+		if len(parts) != 2 || r.Method != http.MethodGet { http.NotFound(w, r); return }
+		p, ok := lookupUpload(parts[0])
+		if !ok { http.NotFound(w, r); return }
+		switch parts[1] {
+		case "progress":
+			writeJSON(w, 200, p.snapshot())
+		case "events":
+			fl, ok := w.(http.Flusher)
+			if !ok { http.Error(w, "streaming unsupported", 500); return }
+			w.Header().Set("Content-Type", "text/event-stream")
+			streamResponse(w)
+			w.Header().Set("Cache-Control", "no-cache")
+			t := time.NewTicker(time.Second)
+			defer t.Stop()
+			for {
+				snap := p.snapshot()
+				js, _ := json.Marshal(snap)
+				fmt.Fprintf(w, "event: progress\ndata: %s\n\n", js)
+				fl.Flush()
+				if snap["status"] == "done" || snap["status"] == "failed" { return }
+				select {
+				case <-r.Context().Done():
+					return
+				case <-t.C:
+				}
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---- Resumable uploads ----
+// Large images can be sent in chunks: POST /api/v1/uploads {name, filename,
+// size, sha256?, replaces?, changelog?, ticket?} opens a session, PATCH
+// /api/v1/uploads/{id} appends the request body at the Upload-Offset header
+// (or ?offset=), HEAD or GET tells where to resume, and POST
+// /api/v1/uploads/{id}/complete stores the assembled file in the storage
+// backend and publishes it like a single-request upload (202; poll the
+// session or its progress). A chunk arriving at the wrong offset gets 409
+// with the offset the server has. Chunks are staged on the node that opened
+// the session, under BOOTAH_UPLOAD_STAGING_DIR (default "uploads" next to the
+// database). Sessions idle for BOOTAH_UPLOAD_SESSION_TTL (default 24h) expire
+// and their staged data is removed; finished sessions are forgotten after a
+// week. DELETE /api/v1/uploads/{id} abandons a session.
+type uploadSession struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Filename  string `json:"filename"`
+	Size      int64  `json:"size"`
+	Received  int64  `json:"received"`
+	Sha256    string `json:"sha256,omitempty"`
+	Replaces  string `json:"replaces,omitempty"`
+	Changelog string `json:"changelog,omitempty"`
+	Ticket    string `json:"ticket,omitempty"`
+	Node      string `json:"node"`
+	Status    string `json:"status"` // open|storing|done|failed|cancelled|expired
+	ImageID   string `json:"image_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+	ExpiresAt string `json:"expires_at"`
+	Stalled   bool   `json:"stalled"` // open and no data for BOOTAH_UPLOAD_STALL_AFTER
+}
+
+func initUploadSessions(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS upload_sessions (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		received INTEGER NOT NULL DEFAULT 0,
+		sha256 TEXT,
+		replaces TEXT,
+		changelog TEXT,
+		ticket TEXT,
+		node TEXT NOT NULL,
+		status TEXT NOT NULL,
+		image_id TEXT,
+		error TEXT,
+		created_by INTEGER,
+		created_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL,
+		expires_at TEXT NOT NULL
+	)`)
+	return err
+}
+
+func uploadStagingDir() string {
+	return getenv("BOOTAH_UPLOAD_STAGING_DIR", filepath.Join(filepath.Dir(getenv("BOOTAH_DB_PATH", "./data/bootah.db")), "uploads"))
+}
+
+func uploadSessionTTL() time.Duration { return envDuration("BOOTAH_UPLOAD_SESSION_TTL", 24*time.Hour) }
+
+func (u *uploadSession) stagingPath() string { return filepath.Join(uploadStagingDir(), u.ID+".part") }
+
+// uploadSessionLocks serializes chunk writes and completion per session.
+// A session's entry is dropped, with the lock held, once it is finished; a
+// request still holding the old mutex finds it no longer open.
+var uploadSessionLocks sync.Map
+
+func lockUploadSession(id string) (func(), bool) {
+	v, _ := uploadSessionLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	if !mu.TryLock() { return nil, false }
+	return mu.Unlock, true
+}
+
+const uploadSessionColumns = `id, name, filename, size, received, COALESCE(sha256,''), COALESCE(replaces,''), COALESCE(changelog,''), COALESCE(ticket,''),
+	node, status, COALESCE(image_id,''), COALESCE(error,''), created_at, updated_at, expires_at`
+
+func scanUploadSession(row interface{ Scan(...any) error }) (*uploadSession, error) {
+	var u uploadSession
+	err := row.Scan(&u.ID, &u.Name, &u.Filename, &u.Size, &u.Received, &u.Sha256, &u.Replaces, &u.Changelog, &u.Ticket,
+		&u.Node, &u.Status, &u.ImageID, &u.Error, &u.CreatedAt, &u.UpdatedAt, &u.ExpiresAt)
+	return &u, err
+}
+
+func (s *Server) uploadSession(id string) (*uploadSession, error) {
+	u, err := scanUploadSession(s.DB.QueryRow(`SELECT `+uploadSessionColumns+` FROM upload_sessions WHERE id=?`, id))
+	if err == nil && u.Status == "open" && u.Received < u.Size { u.Stalled = time.Since(u.lastActivity()) > uploadStallAfter() }
+	return u, err
+}
+
+// lastActivity is when the session last received data: the live tracker if a
+// chunk is arriving on this node, else its last recorded update.
+func (u *uploadSession) lastActivity() time.Time {
+	t, _ := time.Parse(time.RFC3339, u.UpdatedAt)
+	if p, ok := lookupUpload(u.ID); ok && p.lastActivity().After(t) { t = p.lastActivity() }
+	return t
+}
+
+// setUploadSession updates a session's progress and status and pushes the
+// expiry out by one TTL.
+func (s *Server) setUploadSession(u *uploadSession) error {
+	now := time.Now().UTC()
+	u.UpdatedAt, u.ExpiresAt = now.Format(time.RFC3339), now.Add(uploadSessionTTL()).Format(time.RFC3339)
+	_, err := s.DB.Exec(`UPDATE upload_sessions SET received=?, status=?, image_id=NULLIF(?,''), error=NULLIF(?,''), updated_at=?, expires_at=? WHERE id=?`,
+		u.Received, u.Status, u.ImageID, u.Error, u.UpdatedAt, u.ExpiresAt, u.ID)
+	return err
+}
+
+// sessionProgress returns the in-memory progress tracker for a session,
+// registering one (e.g. after a restart) when missing.
+func sessionProgress(u *uploadSession) *uploadProgress {
+	uploadsMu.Lock()
+	defer uploadsMu.Unlock()
+	if p, ok := uploadsInFlight[u.ID]; ok { return p }
+	p := &uploadProgress{ID: u.ID, Total: u.Size, Started: time.Now(), status: "receiving", session: true}
+	p.received.Store(u.Received)
+	last, err := time.Parse(time.RFC3339, u.UpdatedAt)
+	if err != nil { last = time.Now() }
+	p.lastRead.Store(last.UnixNano())
+	uploadsInFlight[u.ID] = p
+	return p
+}
+
+// writeUploadChunk appends r's body to the staging file at u.Received.
+func (s *Server) writeUploadChunk(u *uploadSession, r *http.Request) (int64, error) {
+	if err := os.MkdirAll(uploadStagingDir(), 0o755); err != nil { return 0, err }
+	f, err := os.OpenFile(u.stagingPath(), os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil { return 0, err }
+	defer f.Close()
+	// drop anything past the recorded offset left by an interrupted chunk
+	if err := f.Truncate(u.Received); err != nil { return 0, err }
+	if _, err := f.Seek(u.Received, io.SeekStart); err != nil { return 0, err }
+	p := sessionProgress(u)
+	n, err := io.Copy(f, &countingBody{ReadCloser: io.NopCloser(io.LimitReader(r.Body, u.Size-u.Received)), p: p})
+	if err == nil && n == u.Size-u.Received {
+		if extra, _ := r.Body.Read(make([]byte, 1)); extra > 0 { err = errUploadTooLarge }
+	}
+	if serr := f.Sync(); err == nil { err = serr }
+	return n, err
+}
+
+var errUploadTooLarge = errors.New("chunk runs past the declared upload size")
+
+// completeUpload stores the staged file and publishes the image.
+func (s *Server) completeUpload(r *http.Request, u *uploadSession) {
+	p := sessionProgress(u)
+	fail := func(err error, final bool) {
+		u.Error, u.Status = err.Error(), "open"
+		if final {
+			u.Status = "failed"
+			_ = os.Remove(u.stagingPath())
+			p.finish("", err)
+		} else {
+			p.setStatus("receiving")
+		}
+		if err := s.setUploadSession(u); err != nil { log.Printf("upload %s: %v", u.ID, err) }
+	}
+	prevID, err := s.previousImageVersion(u.Name, u.Replaces)
+	if err == nil { err = checkChangelog(prevID, u.Changelog, u.Ticket) }
+	if err != nil { fail(err, true); return }
+	f, err := os.Open(u.stagingPath())
+	if err != nil { fail(err, false); return }
+	defer f.Close()
+	id := genID()
+	key := id + strings.ToLower(filepath.Ext(u.Filename))
+	size, sum, err := s.StorePut(r.Context(), key, f)
+	if err == nil && size != u.Size { err = fmt.Errorf("stored %d of %d bytes", size, u.Size) }
+	if err != nil { _ = s.Store.Delete(context.Background(), key); fail(fmt.Errorf("store put: %w", err), false); return }
+	if u.Sha256 != "" && !strings.EqualFold(u.Sha256, sum) {
+		_ = s.Store.Delete(context.Background(), key)
+		fail(fmt.Errorf("sha256 mismatch: got %s", sum), true)
+		return
+	}
+	if id, _, err = s.addUploadedImage(r, id, key, u.Name, detectType(u.Filename), size, sum, prevID, u.Changelog, u.Ticket); err != nil {
+		_ = s.Store.Delete(context.Background(), key)
+		fail(err, false)
+		return
+	}
+	_ = os.Remove(u.stagingPath())
+	u.Status, u.ImageID, u.Error = "done", id, ""
+	if err := s.setUploadSession(u); err != nil { log.Printf("upload %s: %v", u.ID, err) }
+	p.finish(id, nil)
+}
+
+// sweepUploadSessions expires idle sessions staged on this node, removes
+// staging files no open session owns and forgets old finished sessions.
+func (s *Server) sweepUploadSessions() {
+	now := time.Now().UTC()
+	rows, err := s.DB.Query(`SELECT `+uploadSessionColumns+` FROM upload_sessions WHERE node=? AND status='open' AND expires_at < ?`, nodeID, now.Format(time.RFC3339))
+	if err != nil { log.Printf("upload sessions: %v", err); return }
+	var expired []*uploadSession
+	for rows.Next() {
+		if u, err := scanUploadSession(rows); err == nil { expired = append(expired, u) }
+	}
+	rows.Close()
+	for _, u := range expired {
+		unlock, ok := lockUploadSession(u.ID)
+		if !ok { continue }
+		_ = os.Remove(u.stagingPath())
+		_, _ = s.DB.Exec(`UPDATE upload_sessions SET status='expired', updated_at=? WHERE id=? AND status='open'`, now.Format(time.RFC3339), u.ID)
+		if p, ok := lookupUpload(u.ID); ok { p.finish("", fmt.Errorf("upload session expired with %d of %d bytes received", u.Received, u.Size)) }
+		uploadSessionLocks.Delete(u.ID)
+		unlock()
+	}
+	entries, _ := os.ReadDir(uploadStagingDir())
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".part")
+		if !ok { continue }
+		var n int
+		_ = s.DB.QueryRow(`SELECT COUNT(*) FROM upload_sessions WHERE id=? AND status IN ('open','storing')`, id).Scan(&n)
+		if n == 0 { _ = os.Remove(filepath.Join(uploadStagingDir(), e.Name())) }
+	}
+	_, _ = s.DB.Exec(`DELETE FROM upload_sessions WHERE `+forgettableUploadSessions, uploadSessionForgetBefore())
+}
+
+// forgettableUploadSessions selects finished sessions older than
+// uploadSessionForgetBefore, which the sweep deletes.
+const forgettableUploadSessions = `status NOT IN ('open','storing') AND updated_at < ?`
+
+func uploadSessionForgetBefore() string { return time.Now().UTC().AddDate(0, 0, -7).Format(time.RFC3339) }
+
+// startUploadSessions reopens sessions this node was storing when it stopped
+// (complete can be retried), tracks its open sessions so stalled ones show in
+// the uploads list, and sweeps every minute (sessions every ten).
+func (s *Server) startUploadSessions(ctx context.Context) {
+	if err := os.MkdirAll(uploadStagingDir(), 0o755); err != nil { log.Printf("upload staging: %v", err) }
+	_, _ = s.DB.Exec(`UPDATE upload_sessions SET status='open', error='interrupted while storing' WHERE node=? AND status='storing'`, nodeID)
+	if rows, err := s.DB.Query(`SELECT `+uploadSessionColumns+` FROM upload_sessions WHERE node=? AND status='open'`, nodeID); err == nil {
+		for rows.Next() {
+			if u, err := scanUploadSession(rows); err == nil { sessionProgress(u) }
+		}
+		rows.Close()
+	}
+	go func() {
+		t := time.NewTicker(time.Minute)
+		defer t.Stop()
+		for n := 0; ; n++ {
+			sweepUploads()
+			if n%10 == 0 { s.sweepUploadSessions() }
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// createUploadSession handles POST /api/v1/uploads.
+func (s *Server) createUploadSession(w http.ResponseWriter, r *http.Request) {
+	var body uploadSession
+	if !decodeJSON(w, r, &body) { return }
+	if body.Filename = filepath.Base(strings.TrimSpace(body.Filename)); body.Filename == "." || body.Filename == "/" { http.Error(w, "filename required", 400); return }
+	if body.Name = strings.TrimSpace(body.Name); body.Name == "" { body.Name = body.Filename }
+	if body.Size <= 0 { http.Error(w, "size required", 400); return }
+	if body.Sha256 != "" {
+		if b, err := hex.DecodeString(body.Sha256); err != nil || len(b) != sha256.Size { http.Error(w, "invalid sha256", 400); return }
+	}
+	prevID, err := s.previousImageVersion(body.Name, body.Replaces)
+	if err == nil { err = checkChangelog(prevID, body.Changelog, body.Ticket) }
+	if err != nil { http.Error(w, err.Error(), 400); return }
+	if err := s.diskSpaceFor(uint64(body.Size)); err != nil { http.Error(w, err.Error(), http.StatusInsufficientStorage); return }
+	now := time.Now().UTC()
+	u := &uploadSession{ID: "up-" + genID(), Name: body.Name, Filename: body.Filename, Size: body.Size, Sha256: strings.ToLower(body.Sha256),
+		Replaces: body.Replaces, Changelog: body.Changelog, Ticket: body.Ticket, Node: nodeID, Status: "open",
+		CreatedAt: now.Format(time.RFC3339), UpdatedAt: now.Format(time.RFC3339), ExpiresAt: now.Add(uploadSessionTTL()).Format(time.RFC3339)}
+	_, err = s.DB.Exec(`INSERT INTO upload_sessions (id, name, filename, size, sha256, replaces, changelog, ticket, node, status, created_by, created_at, updated_at, expires_at)
+		VALUES (?,?,?,?,NULLIF(?,''),NULLIF(?,''),NULLIF(?,''),NULLIF(?,''),?,?,?,?,?,?)`,
+		u.ID, u.Name, u.Filename, u.Size, u.Sha256, u.Replaces, u.Changelog, u.Ticket, u.Node, u.Status, s.actorID(r), u.CreatedAt, u.UpdatedAt, u.ExpiresAt)
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	sessionProgress(u)
+	w.Header().Set("Location", "/api/v1/uploads/"+u.ID)
+	w.Header().Set("Upload-Offset", "0")
+	writeJSON(w, 201, u)
+}
+
+// handleUploadSession serves /api/v1/uploads/{id} and .../complete.
+func (s *Server) handleUploadSession(w http.ResponseWriter, r *http.Request, id string, complete bool) {
+	u, err := s.uploadSession(id)
+	if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+	if err != nil { http.Error(w, err.Error(), 500); return }
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Received, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Size, 10))
+	if complete && r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		writeJSON(w, 200, u)
+		return
+	case http.MethodPatch, http.MethodPost, http.MethodDelete:
+	default:
+		http.Error(w, "method not allowed", 405); return
+	}
+	if r.Method == http.MethodPost && !complete { http.Error(w, "method not allowed", 405); return }
+	if u.Node != nodeID { http.Error(w, "upload is staged on node "+u.Node, http.StatusMisdirectedRequest); return }
+	unlock, ok := lockUploadSession(id)
+	if !ok { http.Error(w, "another request is writing to this upload", 409); return }
+	held := true
+	defer func() { if held { unlock() } }()
+	if u, err = s.uploadSession(id); err != nil { http.Error(w, err.Error(), 500); return }
+	if u.Status != "open" { uploadSessionLocks.Delete(id); http.Error(w, "upload is "+u.Status, 409); return }
+	switch {
+	case r.Method == http.MethodDelete:
+		_ = os.Remove(u.stagingPath())
+		u.Status = "cancelled"
+		if err := s.setUploadSession(u); err != nil { http.Error(w, err.Error(), 500); return }
+		sessionProgress(u).finish("", errors.New("upload cancelled"))
+		uploadSessionLocks.Delete(id)
+		writeJSON(w, 200, map[string]any{"deleted": id})
+	case complete:
+		if u.Received != u.Size { http.Error(w, fmt.Sprintf("upload incomplete: %d of %d bytes received", u.Received, u.Size), 409); return }
+		u.Status, u.Error = "storing", ""
+		if err := s.setUploadSession(u); err != nil { http.Error(w, err.Error(), 500); return }
+		sessionProgress(u).setStatus("storing")
+		// the session stays locked while storing; the request only lends its
+		// credentials to the audit trail
+		bg := r.Clone(context.Background())
+		held = false
+		go func() {
+			defer unlock()
+			s.completeUpload(bg, u)
+			// a failure that can be retried leaves the session open
+			if u.Status != "open" { uploadSessionLocks.Delete(u.ID) }
+		}()
+		writeJSON(w, 202, u)
+	default:
+		off := r.Header.Get("Upload-Offset")
+		if off == "" { off = r.URL.Query().Get("offset") }
+		offset, err := strconv.ParseInt(off, 10, 64)
+		if err != nil { http.Error(w, "Upload-Offset required", 400); return }
+		if offset != u.Received { writeJSON(w, 409, map[string]any{"error": "offset mismatch", "offset": u.Received}); return }
+		if r.ContentLength > 0 {
+			if err := s.diskSpaceFor(uint64(r.ContentLength)); err != nil { http.Error(w, err.Error(), http.StatusInsufficientStorage); return }
+		}
+		limitUploadBody(w, r)
+		n, werr := s.writeUploadChunk(u, r)
+		u.Received += n
+		if err := s.setUploadSession(u); err != nil { http.Error(w, err.Error(), 500); return }
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.Received, 10))
+		if errors.Is(werr, errUploadTooLarge) { http.Error(w, werr.Error(), 413); return }
+		if werr != nil { uploadFailed(w, werr, 400, "chunk interrupted: "); return }
+		writeJSON(w, 200, map[string]any{"id": u.ID, "offset": u.Received, "size": u.Size})
+	}
+}
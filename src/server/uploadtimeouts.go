@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ---- Upload deadlines ----
+// Upload bodies (image uploads, resumable session chunks, attachments, boot
+// assets and build artifacts) are read under deadlines on the connection itself: when no byte arrives for
+// BOOTAH_UPLOAD_IDLE_TIMEOUT (default 2m), or one request takes longer than
+// BOOTAH_UPLOAD_MAX_DURATION (default 12h), the read fails, the request ends
+// with 408 and its goroutine and multipart temp files are released. A session
+// chunk cut short keeps the bytes that were written; the client resumes at
+// Upload-Offset. These replace the server read and write timeouts
+// (httpserver.go) for the request.
+//
+// Uploads and open sessions that received nothing for
+// BOOTAH_UPLOAD_STALL_AFTER are reported with "stalled": true
+// (GET /api/v1/uploads?stalled=true lists only those). The sweeper fails
+// single-request uploads stuck past the idle timeout and expires stalled
+// sessions with the session TTL.
+var errUploadStalled = errors.New("upload stalled")
+
+func uploadIdleTimeout() time.Duration { return envDuration("BOOTAH_UPLOAD_IDLE_TIMEOUT", 2*time.Minute) }
+
+func uploadMaxDuration() time.Duration { return envDuration("BOOTAH_UPLOAD_MAX_DURATION", 12*time.Hour) }
+
+// deadlineBody pushes the connection read deadline out before every read, so
+// it only fires on an idle or overlong transfer.
+type deadlineBody struct {
+	body io.ReadCloser
+	rc   *http.ResponseController
+	idle time.Duration
+	end  time.Time
+	set  time.Time // when the deadline was last moved
+}
+
+func (d *deadlineBody) Read(b []byte) (int, error) {
+	if now := time.Now(); now.Sub(d.set) > d.idle/8 {
+		deadline := now.Add(d.idle)
+		if d.end.Before(deadline) { deadline = d.end }
+		_ = d.rc.SetReadDeadline(deadline)
+		d.set = now
+	}
+	n, err := d.body.Read(b)
+	var ne net.Error
+	if err != nil && errors.As(err, &ne) && ne.Timeout() {
+		if !time.Now().Before(d.end) { return n, fmt.Errorf("%w: exceeded %s", errUploadStalled, uploadMaxDuration()) }
+		return n, fmt.Errorf("%w: no data received for %s", errUploadStalled, d.idle)
+	}
+	return n, err
+}
+
+func (d *deadlineBody) Close() error { return d.body.Close() }
+
+// limitUploadBody puts r's body under the upload deadlines. Writers that
+// cannot set deadlines (no underlying connection) are left alone.
+func limitUploadBody(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	idle := uploadIdleTimeout()
+	now := time.Now()
+	if err := rc.SetReadDeadline(now.Add(idle)); err != nil { return }
+	// the response follows the whole body, so the server write timeout
+	// (counted from the request headers) cannot apply
+	_ = rc.SetWriteDeadline(time.Time{})
+	r.Body = &deadlineBody{body: r.Body, rc: rc, idle: idle, end: now.Add(uploadMaxDuration()), set: now}
+}
+
+// uploadFailed answers a failed upload read: 408 for a stalled transfer,
+// otherwise status with prefix.
+func uploadFailed(w http.ResponseWriter, err error, status int, prefix string) {
+	if errors.Is(err, errUploadStalled) { http.Error(w, err.Error(), http.StatusRequestTimeout); return }
+	http.Error(w, prefix+err.Error(), status)
+}
+
+// sweepUploads fails single-request uploads whose body has not moved past
+// the idle timeout (their request should have ended already) and forgets
+// progress an hour after an upload ends.
+func sweepUploads() {
+	uploadsMu.Lock()
+	list := make([]*uploadProgress, 0, len(uploadsInFlight))
+	for k, p := range uploadsInFlight {
+		p.mu.Lock()
+		ended := p.ended
+		p.mu.Unlock()
+		if !ended.IsZero() && time.Since(ended) > time.Hour { delete(uploadsInFlight, k); continue }
+		list = append(list, p)
+	}
+	uploadsMu.Unlock()
+	idle := uploadIdleTimeout()
+	for _, p := range list {
+		if p.session || !p.stalled(idle) { continue }
+		p.finish("", fmt.Errorf("%w: no data received for %s", errUploadStalled, time.Since(p.lastActivity()).Round(time.Second)))
+	}
+}
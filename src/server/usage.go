@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---- API usage accounting ----
+// Authenticated requests are counted per principal ("user:<id>", or
+// "key:<id>" for an API key, apart from its creator's own use) and day,
+// with request and response bytes. Counters accumulate in memory and are
+// flushed to api_usage periodically. BOOTAH_USAGE_DAILY_LIMIT, when set, caps
+// the daily request count per principal (admins exempt) with 429.
+type usageCounter struct {
+	Requests, BytesIn, BytesOut int64
+}
+
+type usageKey struct{ principal, day string }
+
+var usage = struct {
+	sync.Mutex
+	pending map[usageKey]*usageCounter
+	today   map[string]int64 // principal -> requests today incl. flushed, for quota checks
+	day     string
+}{pending: map[usageKey]*usageCounter{}, today: map[string]int64{}}
+
+func initUsage(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS api_usage (
+		principal TEXT NOT NULL,
+		day TEXT NOT NULL,
+		requests INTEGER NOT NULL DEFAULT 0,
+		bytes_in INTEGER NOT NULL DEFAULT 0,
+		bytes_out INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (principal, day)
+	)`)
+	return err
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingWriter) Unwrap() http.ResponseWriter { return c.ResponseWriter }
+
+func (c *countingWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok { f.Flush() }
+}
+
+// requestPrincipal identifies the caller for accounting, "" if anonymous.
+func (s *Server) requestPrincipal(r *http.Request) (string, string) {
+	_, claims, err := s.verifyAuth(r)
+	if err != nil { return "", "" }
+	role, _ := claims["role"].(string)
+	if key, ok := claims["api_key"].(string); ok { return "key:" + key, role }
+	return "user:" + strconv.FormatInt(claims["sub"].(int64), 10), role
+}
+
+// dailyUsage returns today's request count for principal, loading the
+// persisted count on first use each day.
+func (s *Server) dailyUsage(principal, day string) int64 {
+	usage.Lock()
+	defer usage.Unlock()
+	if usage.day != day { usage.day, usage.today = day, map[string]int64{} }
+	n, ok := usage.today[principal]
+	if !ok {
+		_ = s.DB.QueryRow(`SELECT COALESCE(SUM(requests),0) FROM api_usage WHERE principal=? AND day=?`, principal, day).Scan(&n)
+		for k, c := range usage.pending {
+			if k.principal == principal && k.day == day { n += c.Requests }
+		}
+		usage.today[principal] = n
+	}
+	return n
+}
+
+func (s *Server) usageAccounting(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, role := s.requestPrincipal(r)
+		if principal == "" { next.ServeHTTP(w, r); return }
+		day := time.Now().UTC().Format("2006-01-02")
+		if limit, _ := strconv.ParseInt(getenv("BOOTAH_USAGE_DAILY_LIMIT", "0"), 10, 64); limit > 0 && role != "admin" {
+			if s.dailyUsage(principal, day) >= limit {
+				w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(time.Now().UTC().Truncate(24*time.Hour).Add(24*time.Hour)).Seconds())))
+				http.Error(w, "daily API quota exceeded", http.StatusTooManyRequests)
+				return
+			}
+		}
+		cw := &countingWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+		in := r.ContentLength
+		if in < 0 { in = 0 }
+		usage.Lock()
+		k := usageKey{principal, day}
+		c := usage.pending[k]
+		if c == nil { c = &usageCounter{}; usage.pending[k] = c }
+		c.Requests++
+		c.BytesIn += in
+		c.BytesOut += cw.n
+		if usage.day == day { if _, ok := usage.today[principal]; ok { usage.today[principal]++ } }
+		usage.Unlock()
+	})
+}
+
+func (s *Server) flushUsage() {
+	usage.Lock()
+	pending := usage.pending
+	usage.pending = map[usageKey]*usageCounter{}
+	usage.Unlock()
+	for k, c := range pending {
+		_, err := s.DB.Exec(`INSERT INTO api_usage (principal, day, requests, bytes_in, bytes_out) VALUES (?,?,?,?,?)
+			ON CONFLICT(principal, day) DO UPDATE SET requests=requests+excluded.requests, bytes_in=bytes_in+excluded.bytes_in, bytes_out=bytes_out+excluded.bytes_out`,
+			k.principal, k.day, c.Requests, c.BytesIn, c.BytesOut)
+		if err != nil { log.Printf("usage flush: %v", err) }
+	}
+}
+
+func (s *Server) startUsageFlusher(ctx context.Context) {
+	go func() {
+		t := time.NewTicker(30 * time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				s.flushUsage()
+				return
+			case <-t.C:
+				s.flushUsage()
+			}
+		}
+	}()
+}
+
+func (s *Server) usageRoutes() {
+	// ?days=7 (default) aggregated per principal, heaviest first
+	s.Mux.HandleFunc("/api/v1/admin/usage", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "admin") { return }
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		days, _ := strconv.Atoi(r.URL.Query().Get("days"))
+		if days <= 0 || days > 366 { days = 7 }
+		s.flushUsage()
+		since := time.Now().UTC().AddDate(0, 0, -days+1).Format("2006-01-02")
+		rows, err := s.DB.Query(`SELECT principal, SUM(requests), SUM(bytes_in), SUM(bytes_out) FROM api_usage WHERE day >= ? GROUP BY principal ORDER BY SUM(requests) DESC`, since)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		defer rows.Close()
+		out := []map[string]any{}
+		for rows.Next() {
+			var principal string
+			var reqs, in, outb int64
+			if err := rows.Scan(&principal, &reqs, &in, &outb); err != nil { http.Error(w, err.Error(), 500); return }
+			m := map[string]any{"principal": principal, "requests": reqs, "bytes_in": in, "bytes_out": outb}
+			if id, ok := strings.CutPrefix(principal, "user:"); ok {
+				var email string
+				if s.DB.QueryRow(`SELECT email FROM users WHERE id=?`, id).Scan(&email) == nil { m["email"] = email }
+			} else if id, ok := strings.CutPrefix(principal, "key:"); ok {
+				var name string
+				if s.DB.QueryRow(`SELECT name FROM api_keys WHERE id=?`, id).Scan(&name) == nil { m["api_key_name"] = name }
+			}
+			out = append(out, m)
+		}
+		writeJSON(w, 200, map[string]any{"since": since, "usage": out})
+	})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ---- Post-deployment validation ----
+// A deployment whose task sequence contains "validate" steps moves to
+// "validating" when imaging finishes and only becomes "succeeded" once the
+// agent has reported every check as passed. Any failed check fails it.
+func initValidation(db *sql.DB) error {
+	ddl := `CREATE TABLE IF NOT EXISTS deployment_checks (
+		deployment_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		passed INTEGER NOT NULL,
+		detail TEXT,
+		reported_at TEXT NOT NULL,
+		PRIMARY KEY (deployment_id, name)
+	);`
+	_, err := db.Exec(ddl)
+	return err
+}
+
+// requiredChecks returns the validate steps of a deployment's task sequence.
+func (s *Server) requiredChecks(deploymentID string) ([]TaskStep, error) {
+	var seqID string
+	if err := s.DB.QueryRow(`SELECT COALESCE(task_sequence_id,'') FROM deployments WHERE id=?`, deploymentID).Scan(&seqID); err != nil { return nil, err }
+	if seqID == "" { return nil, nil }
+	ts, err := s.taskSequence(seqID)
+	if err != nil { return nil, err }
+	var out []TaskStep
+	for _, st := range ts.Steps {
+		if st.Type == "validate" { out = append(out, st) }
+	}
+	return out, nil
+}
+
+// evaluateChecks settles a validating deployment from the reported results.
+func (s *Server) evaluateChecks(id string) (string, error) {
+	checks, err := s.requiredChecks(id)
+	if err != nil { return "", err }
+	rows, err := s.DB.Query(`SELECT name, passed, COALESCE(detail,'') FROM deployment_checks WHERE deployment_id=?`, id)
+	if err != nil { return "", err }
+	defer rows.Close()
+	passed := map[string]bool{}
+	var failed []map[string]any
+	for rows.Next() {
+		var name, detail string; var ok bool
+		if err := rows.Scan(&name, &ok, &detail); err != nil { return "", err }
+		passed[name] = ok
+		if !ok { failed = append(failed, map[string]any{"name": name, "detail": detail}) }
+	}
+	if err := rows.Err(); err != nil { return "", err }
+	if len(failed) > 0 {
+		var names []string
+		for _, f := range failed { names = append(names, f["name"].(string)) }
+		if err := s.setDeploymentStatus(id, "failed", "validation: "+strings.Join(names, ", ")); err != nil { return "", err }
+		s.notify("error", "deployment_validation_failed", "Deployment "+id+" failed post-deployment validation", map[string]any{"deployment_id": id, "failed": failed})
+		return "failed", nil
+	}
+	for _, c := range checks {
+		if !passed[c.Name] { return "validating", nil }
+	}
+	return "succeeded", s.setDeploymentStatus(id, "succeeded", "")
+}
+
+// agentDeployment loads an active deployment's status, rejecting per-deployment
+// tokens that belong to a different deployment.
+func (s *Server) agentDeployment(w http.ResponseWriter, r *http.Request, id string) (string, bool) {
+	if tokDep, ok := s.deploymentForAgentToken(r.Header.Get("X-Bootah-Agent-Token")); ok && tokDep != id {
+		http.Error(w, "token not valid for this deployment", 403); return "", false
+	}
+	var status string
+	if err := s.DB.QueryRow(`SELECT status FROM deployments WHERE id=?`, id).Scan(&status); err != nil {
+		if err == sql.ErrNoRows { http.NotFound(w, r); return "", false }
+		http.Error(w, err.Error(), 500); return "", false
+	}
+	if !deploymentActive(status) { http.Error(w, "deployment not active", 409); return "", false }
+	return status, true
+}
+
+func (s *Server) validationRoutes() {
+	// Imaging finished: {"deployment_id": "...", "ok": true, "error": ""}
+	s.Mux.HandleFunc("/api/v1/agent/deployment/finish", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		if !s.requireAgent(w, r) { return }
+		var body struct {
+			DeploymentID string `json:"deployment_id"`
+			OK           bool   `json:"ok"`
+			Error        string `json:"error"`
+			IP           string `json:"ip"` // address of the installed OS, if known
+		}
+		if !decodeJSON(w, r, &body) { return }
+		if _, ok := s.agentDeployment(w, r, body.DeploymentID); !ok { return }
+		ip := body.IP
+		if net.ParseIP(ip) == nil {
+			ip = ""
+			if c := clientIP(r); c != nil { ip = c.String() }
+		}
+		_, _ = s.DB.Exec(`UPDATE deployments SET ip=? WHERE id=?`, ip, body.DeploymentID)
+		status := "failed"
+		if body.OK {
+			checks, err := s.requiredChecks(body.DeploymentID)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			status = "succeeded"
+			if len(checks) > 0 { status = "validating" }
+		}
+		if err := s.setDeploymentStatus(body.DeploymentID, status, body.Error); err != nil { http.Error(w, err.Error(), 500); return }
+		if status == "failed" {
+			s.notify("error", "deployment_failed", "Deployment "+body.DeploymentID+" failed", map[string]any{"deployment_id": body.DeploymentID, "error": body.Error})
+		}
+		s.audit(nil, "finish", "deployment", map[string]any{"id": body.DeploymentID, "status": status})
+		writeJSON(w, 200, map[string]any{"status": status})
+	})
+
+	// Validation results: {"deployment_id": "...", "results": [{"name": "...", "passed": true, "detail": ""}]}
+	s.Mux.HandleFunc("/api/v1/agent/validation", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		if !s.requireAgent(w, r) { return }
+		var body struct {
+			DeploymentID string `json:"deployment_id"`
+			Results      []struct {
+				Name   string `json:"name"`
+				Passed bool   `json:"passed"`
+				Detail string `json:"detail"`
+			} `json:"results"`
+		}
+		if !decodeJSON(w, r, &body) { return }
+		status, ok := s.agentDeployment(w, r, body.DeploymentID)
+		if !ok { return }
+		if status != "validating" { http.Error(w, "deployment is not awaiting validation", 409); return }
+		now := time.Now().Format(time.RFC3339)
+		for _, res := range body.Results {
+			_, err := s.DB.Exec(`INSERT INTO deployment_checks (deployment_id, name, passed, detail, reported_at) VALUES (?,?,?,?,?)
+				ON CONFLICT(deployment_id, name) DO UPDATE SET passed=excluded.passed, detail=excluded.detail, reported_at=excluded.reported_at`,
+				body.DeploymentID, res.Name, res.Passed, res.Detail, now)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+		}
+		status, err := s.evaluateChecks(body.DeploymentID)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		writeJSON(w, 200, map[string]any{"status": status})
+	})
+
+	// Required checks and reported results for one deployment
+	s.Mux.HandleFunc("/api/v1/admin/deployments/checks", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		id := r.URL.Query().Get("id")
+		checks, err := s.requiredChecks(id)
+		if err != nil {
+			if err == sql.ErrNoRows { http.NotFound(w, r); return }
+			http.Error(w, err.Error(), 500); return
+		}
+		rows, err := s.DB.Query(`SELECT name, passed, COALESCE(detail,''), reported_at FROM deployment_checks WHERE deployment_id=?`, id)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		defer rows.Close()
+		reported := map[string]map[string]any{}
+		for rows.Next() {
+			var name, detail, at string; var passed bool
+			if err := rows.Scan(&name, &passed, &detail, &at); err != nil { http.Error(w, err.Error(), 500); return }
+			reported[name] = map[string]any{"passed": passed, "detail": detail, "reported_at": at}
+		}
+		var out []map[string]any
+		for _, c := range checks {
+			out = append(out, map[string]any{"name": c.Name, "check": c.Params["check"], "target": c.Params["target"], "result": reported[c.Name]})
+		}
+		writeJSON(w, 200, out)
+	})
+}
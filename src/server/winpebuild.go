@@ -0,0 +1,323 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ---- WinPE build pipeline ----
+// A build takes a base WinPE image, adds the Bootah agent, the boot-critical
+// drivers of the chosen driver packs, a generated startnet.cmd and any extra
+// files, and publishes the result as <prefix>/boot.wim (prefix "winpe" for
+// amd64, "winpe/arm64" for arm64). The base is a boot asset (e.g. an uploaded
+// winpe/base/boot.wim) or winpe.wim from the ADK mirror at
+// BOOTAH_WINPE_ADK_MIRROR, laid out like the ADK's "Windows Preinstallation
+// Environment" folder (<arch>/en-us/winpe.wim, <arch>/Media/...). The image
+// is edited in place with wimlib-imagex (BOOTAH_WIMLIB), so no Windows host is
+// needed; drivers are copied to X:\bootah\drivers and loaded with drvload
+// before the network comes up. The agent is every boot asset under
+// BOOTAH_WINPE_AGENT_PREFIX (default "agent/winpe"), copied to X:\bootah and
+// started with BOOTAH_WINPE_AGENT_CMD (default bootah-agent.exe).
+//
+// Sites with their own tooling (DISM, ADK copype) set BOOTAH_WINPE_BUILD_CMD
+// instead: ";"-separated commands run after the inputs are staged, with
+// {base} (the base wim), {overlay} (the tree to add to it), {drivers},
+// {arch}, {locale}, {work} and {out}; whatever they leave in {out} is
+// published.
+type winpeBuildJob struct {
+	Prefix      string            `json:"prefix"`
+	Arch        string            `json:"arch"`         // amd64 (default) or arm64
+	Locale      string            `json:"locale"`       // user and input locale, e.g. "de-DE"
+	Keyboard    string            `json:"keyboard"`     // keyboard layout for wpeutil, e.g. "0407:00000407"
+	Base        string            `json:"base"`         // boot asset of the base wim; empty uses the ADK mirror
+	DriverPacks []string          `json:"driver_packs"` // driver pack ids
+	ImageID     string            `json:"image_id"`     // also the packs attached to this image
+	Files       map[string]string `json:"files"`        // path in the image -> boot asset path
+}
+
+var (
+	winpeLocaleRe   = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+	winpeKeyboardRe = regexp.MustCompile(`^[0-9A-Fa-f]{4}:[0-9A-Fa-f]{8}$`)
+)
+
+// normalize fills in defaults and validates a build request.
+func (j *winpeBuildJob) normalize() error {
+	switch j.Arch = strings.ToLower(j.Arch); j.Arch {
+	case "", "amd64", "x64", "x86_64":
+		j.Arch = "amd64"
+	case "arm64", "aarch64":
+		j.Arch = "arm64"
+	default:
+		return fmt.Errorf("unsupported arch %q", j.Arch)
+	}
+	if j.Prefix == "" {
+		j.Prefix = "winpe"
+		if j.Arch != "amd64" { j.Prefix = "winpe/" + j.Arch }
+	}
+	if _, err := cleanAssetPath(j.Prefix); err != nil { return err }
+	if j.Locale != "" && !winpeLocaleRe.MatchString(j.Locale) { return fmt.Errorf("invalid locale %q", j.Locale) }
+	if j.Keyboard != "" && !winpeKeyboardRe.MatchString(j.Keyboard) { return fmt.Errorf("invalid keyboard layout %q", j.Keyboard) }
+	if j.Base != "" {
+		p, err := cleanAssetPath(j.Base)
+		if err != nil { return err }
+		j.Base = p
+	}
+	for dst, src := range j.Files {
+		if _, err := winpeFilePath(dst); err != nil { return err }
+		if _, err := cleanAssetPath(src); err != nil { return err }
+	}
+	return nil
+}
+
+// winpeFilePath turns a path inside the image ("Windows\System32\x.cmd",
+// "X:/tools/y.exe") into a clean relative slash path.
+func winpeFilePath(p string) (string, error) {
+	rel := strings.ReplaceAll(p, `\`, "/")
+	if len(rel) >= 2 && rel[1] == ':' { rel = rel[2:] }
+	rel = strings.TrimPrefix(rel, "/")
+	if rel == "" || path.Clean(rel) != rel || rel == ".." || strings.HasPrefix(rel, "../") { return "", fmt.Errorf("invalid file path %q", p) }
+	return rel, nil
+}
+
+// winpeConfigured reports why a build cannot run on this node, if it cannot.
+func winpeConfigured(j *winpeBuildJob) error {
+	if len(toolCommands(getenv("BOOTAH_WINPE_BUILD_CMD", ""))) == 0 {
+		if _, err := exec.LookPath(getenv("BOOTAH_WIMLIB", "wimlib-imagex")); err != nil {
+			return errors.New("winpe build needs wimlib-imagex (BOOTAH_WIMLIB) or BOOTAH_WINPE_BUILD_CMD")
+		}
+	}
+	if j.Base == "" && getenv("BOOTAH_WINPE_ADK_MIRROR", "") == "" {
+		return errors.New("no base image: give base or set BOOTAH_WINPE_ADK_MIRROR")
+	}
+	return nil
+}
+
+// winpeDriverPacks resolves the packs a build injects, in id order.
+func (s *Server) winpeDriverPacks(j *winpeBuildJob) ([]string, error) {
+	set := map[string]bool{}
+	for _, id := range j.DriverPacks { set[id] = true }
+	if j.ImageID != "" {
+		rows, err := s.DB.Query(`SELECT pack_id FROM image_driver_packs WHERE image_id=?`, j.ImageID)
+		if err != nil { return nil, err }
+		defer rows.Close()
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil { return nil, err }
+			set[id] = true
+		}
+		if err := rows.Err(); err != nil { return nil, err }
+	}
+	ids := make([]string, 0, len(set))
+	for id := range set { ids = append(ids, id) }
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// fetchURL downloads u to dst, checking its sha256 when want is set.
+func fetchURL(ctx context.Context, u, dst, want string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil { return err }
+	resp, err := (&http.Client{Timeout: 2 * time.Hour}).Do(req)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 { return fmt.Errorf("%s: %s", u, resp.Status) }
+	f, err := os.Create(dst)
+	if err != nil { return err }
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if cerr := f.Close(); err == nil { err = cerr }
+	if err != nil { return err }
+	want = strings.ToLower(strings.TrimPrefix(want, "sha256:"))
+	if want != "" && hex.EncodeToString(h.Sum(nil)) != want { return fmt.Errorf("%s: checksum mismatch", u) }
+	return nil
+}
+
+// unpackDriverPack extracts a downloaded pack into dir: zip archives
+// natively, cabinets with BOOTAH_CABEXTRACT_CMD; anything else is copied.
+func unpackDriverPack(ctx context.Context, src, name, dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil { return err }
+	switch strings.ToLower(path.Ext(name)) {
+	case ".zip":
+		zr, err := zip.OpenReader(src)
+		if err != nil { return err }
+		defer zr.Close()
+		for _, f := range zr.File {
+			rel := path.Clean(strings.ReplaceAll(f.Name, `\`, "/"))
+			if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") || path.IsAbs(rel) { return fmt.Errorf("%s: bad entry %q", name, f.Name) }
+			dst := filepath.Join(dir, filepath.FromSlash(rel))
+			if f.FileInfo().IsDir() { if err := os.MkdirAll(dst, 0o755); err != nil { return err }; continue }
+			if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil { return err }
+			rc, err := f.Open()
+			if err != nil { return err }
+			out, err := os.Create(dst)
+			if err != nil { rc.Close(); return err }
+			_, err = io.Copy(out, rc)
+			rc.Close()
+			if cerr := out.Close(); err == nil { err = cerr }
+			if err != nil { return err }
+		}
+		return nil
+	case ".cab":
+		cmds := toolCommands(getenv("BOOTAH_CABEXTRACT_CMD", "cabextract -q -d {dst} {src}"))
+		return runTools(ctx, cmds, strings.NewReplacer("{src}", src, "{dst}", dir))
+	}
+	in, err := os.Open(src)
+	if err != nil { return err }
+	defer in.Close()
+	out, err := os.Create(filepath.Join(dir, path.Base(name)))
+	if err != nil { return err }
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil { err = cerr }
+	return err
+}
+
+// copyBootAsset writes the current version of a boot asset to dst.
+func (s *Server) copyBootAsset(ctx context.Context, p, dst string) error {
+	a, err := s.bootAsset(p)
+	if errors.Is(err, sql.ErrNoRows) { return fmt.Errorf("boot asset %s not found", p) }
+	if err != nil { return err }
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil { return err }
+	rc, err := s.Store.Open(ctx, a.file)
+	if err != nil { return err }
+	defer rc.Close()
+	f, err := os.Create(dst)
+	if err != nil { return err }
+	_, err = io.Copy(f, rc)
+	if cerr := f.Close(); err == nil { err = cerr }
+	return err
+}
+
+// winpeStartnet is the startnet.cmd of a build: load the injected drivers,
+// bring up the network and start the agent.
+func winpeStartnet(j *winpeBuildJob, infs []string) string {
+	var b strings.Builder
+	b.WriteString("@echo off\r\n")
+	for _, inf := range infs { fmt.Fprintf(&b, "drvload \"X:\\bootah\\drivers\\%s\"\r\n", strings.ReplaceAll(inf, "/", `\`)) }
+	b.WriteString("wpeinit\r\n")
+	if j.Locale != "" { fmt.Fprintf(&b, "wpeutil SetUserLocale %s\r\n", j.Locale) }
+	if j.Keyboard != "" { fmt.Fprintf(&b, "wpeutil SetKeyboardLayout %s\r\n", j.Keyboard) }
+	b.WriteString("wpeutil WaitForNetwork\r\n")
+	fmt.Fprintf(&b, "set BOOTAH_SERVER=%s\r\n", getenv("BOOTAH_PUBLIC_URL", ""))
+	cmd := getenv("BOOTAH_WINPE_AGENT_CMD", "bootah-agent.exe")
+	fmt.Fprintf(&b, "if exist \"X:\\bootah\\%s\" \"X:\\bootah\\%s\"\r\n", cmd, cmd)
+	return b.String()
+}
+
+// stageWinPE prepares the build inputs under work: the base wim and the
+// overlay tree. It returns the base path, the overlay directory and the
+// number of drivers staged.
+func (s *Server) stageWinPE(ctx context.Context, j *winpeBuildJob, work string) (base, overlay string, drivers int, err error) {
+	base = filepath.Join(work, "base.wim")
+	jobProgress(ctx, 5, "fetching base image")
+	if j.Base != "" {
+		err = s.copyBootAsset(ctx, j.Base, base)
+	} else {
+		err = fetchURL(ctx, strings.TrimRight(getenv("BOOTAH_WINPE_ADK_MIRROR", ""), "/")+"/"+j.Arch+"/en-us/winpe.wim", base, "")
+	}
+	if err != nil { return "", "", 0, fmt.Errorf("base image: %w", err) }
+
+	overlay = filepath.Join(work, "overlay")
+	bootah := filepath.Join(overlay, "bootah")
+	jobProgress(ctx, 20, "staging agent")
+	agent := strings.Trim(getenv("BOOTAH_WINPE_AGENT_PREFIX", "agent/winpe"), "/")
+	files, err := s.listBootAssets(agent + "/")
+	if err != nil { return "", "", 0, err }
+	for _, f := range files {
+		if err := s.copyBootAsset(ctx, f.Path, filepath.Join(bootah, filepath.FromSlash(strings.TrimPrefix(f.Path, agent+"/")))); err != nil { return "", "", 0, err }
+	}
+
+	packs, err := s.winpeDriverPacks(j)
+	if err != nil { return "", "", 0, err }
+	dl := filepath.Join(work, "downloads")
+	if err := os.MkdirAll(dl, 0o755); err != nil { return "", "", 0, err }
+	for n, id := range packs {
+		jobProgress(ctx, 30+30*n/len(packs), "driver pack "+id)
+		var url, checksum string
+		if err := s.DB.QueryRow(`SELECT url, COALESCE(checksum,'') FROM driver_packs WHERE id=?`, id).Scan(&url, &checksum); err != nil {
+			if errors.Is(err, sql.ErrNoRows) { return "", "", 0, permanent(fmt.Errorf("driver pack %s not found", id)) }
+			return "", "", 0, err
+		}
+		name := path.Base(strings.SplitN(url, "?", 2)[0])
+		src := filepath.Join(dl, id+"-"+name)
+		if err := fetchURL(ctx, url, src, checksum); err != nil { return "", "", 0, fmt.Errorf("driver pack %s: %w", id, err) }
+		if err := unpackDriverPack(ctx, src, name, filepath.Join(bootah, "drivers", id)); err != nil { return "", "", 0, fmt.Errorf("driver pack %s: %w", id, err) }
+	}
+	var infs []string
+	_ = filepath.Walk(filepath.Join(bootah, "drivers"), func(p string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() && strings.EqualFold(filepath.Ext(p), ".inf") {
+			rel, _ := filepath.Rel(filepath.Join(bootah, "drivers"), p)
+			infs = append(infs, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(infs)
+
+	jobProgress(ctx, 60, "staging files")
+	for dst, src := range j.Files {
+		rel, _ := winpeFilePath(dst)
+		if err := s.copyBootAsset(ctx, src, filepath.Join(overlay, filepath.FromSlash(rel))); err != nil { return "", "", 0, err }
+	}
+	custom := false
+	for dst := range j.Files {
+		if rel, _ := winpeFilePath(dst); strings.EqualFold(rel, "Windows/System32/startnet.cmd") { custom = true }
+	}
+	if startnet := filepath.Join(overlay, "Windows", "System32", "startnet.cmd"); !custom {
+		if err := os.MkdirAll(filepath.Dir(startnet), 0o755); err != nil { return "", "", 0, err }
+		if err := os.WriteFile(startnet, []byte(winpeStartnet(j, infs)), 0o644); err != nil { return "", "", 0, err }
+	}
+	return base, overlay, len(infs), nil
+}
+
+// buildWinPE runs a build and publishes its output.
+func (s *Server) buildWinPE(ctx context.Context, j *winpeBuildJob) ([]string, error) {
+	if err := j.normalize(); err != nil { return nil, permanent(err) }
+	if err := winpeConfigured(j); err != nil { return nil, permanent(err) }
+	work, err := os.MkdirTemp("", "bootah-winpe-")
+	if err != nil { return nil, err }
+	defer os.RemoveAll(work)
+	out := filepath.Join(work, "out")
+	if err := os.Mkdir(out, 0o755); err != nil { return nil, err }
+	base, overlay, drivers, err := s.stageWinPE(ctx, j, work)
+	if err != nil { return nil, err }
+	jobProgress(ctx, 70, "building image")
+	if cmds := toolCommands(getenv("BOOTAH_WINPE_BUILD_CMD", "")); len(cmds) > 0 {
+		repl := strings.NewReplacer("{base}", base, "{overlay}", overlay, "{drivers}", filepath.Join(overlay, "bootah", "drivers"),
+			"{arch}", j.Arch, "{locale}", j.Locale, "{work}", work, "{out}", out)
+		if err := runTools(ctx, cmds, repl); err != nil { return nil, err }
+	} else {
+		wim := getenv("BOOTAH_WIMLIB", "wimlib-imagex")
+		if o, err := exec.CommandContext(ctx, wim, "update", base, "1", "--command=add "+overlay+" /").CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("%s update: %v: %s", wim, err, strings.TrimSpace(string(o)))
+		}
+		if o, err := exec.CommandContext(ctx, wim, "optimize", base).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("%s optimize: %v: %s", wim, err, strings.TrimSpace(string(o)))
+		}
+		if err := os.Rename(base, filepath.Join(out, "boot.wim")); err != nil { return nil, err }
+		// the EFI loader the boot menu needs, when the mirror has it and it is not published yet
+		efi := "bootx64.efi"
+		if j.Arch == "arm64" { efi = "bootaa64.efi" }
+		if mirror := getenv("BOOTAH_WINPE_ADK_MIRROR", ""); mirror != "" && !s.assetAvailable(j.Prefix+"/"+efi) {
+			if err := fetchURL(ctx, strings.TrimRight(mirror, "/")+"/"+j.Arch+"/Media/EFI/Boot/"+efi, filepath.Join(out, efi), ""); err != nil { return nil, err }
+		}
+	}
+	jobProgress(ctx, 95, "publishing")
+	paths, err := s.publishBootAssets(ctx, "winpe-build", j.Prefix, out)
+	if err != nil { return nil, err }
+	s.emit("winpe.built", map[string]any{"prefix": j.Prefix, "arch": j.Arch, "locale": j.Locale, "driver_packs": j.DriverPacks, "image_id": j.ImageID, "drivers": drivers, "paths": paths})
+	return paths, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// ---- Secure wipe ----
+// The agent runs "wipe" steps and reports each erased disk. The server issues
+// a signed wipe certificate per disk for asset-disposal records: signed with
+// the local CA key when one is configured, otherwise HMAC'd with the server
+// encryption key. Reports must come from an agent credential valid for the
+// machine and pass its enrollment secret check.
+var wipeMethods = map[string]bool{"quick": true, "zero_fill": true, "nvme_secure_erase": true}
+
+type WipeReport struct {
+	MAC          string        `json:"mac"`
+	DeploymentID string        `json:"deployment_id"`
+	Method       string        `json:"method"`
+	Disk         InventoryDisk `json:"disk"`
+	StartedAt    string        `json:"started_at"`
+	FinishedAt   string        `json:"finished_at"`
+	Passes       int           `json:"passes"`
+	Result       string        `json:"result"` // success|failed
+	Detail       string        `json:"detail,omitempty"`
+}
+
+func initWipe(db *sql.DB) error {
+	ddl1 := `CREATE TABLE IF NOT EXISTS wipe_certs (
+		id TEXT PRIMARY KEY,
+		mac TEXT NOT NULL,
+		deployment_id TEXT,
+		disk_serial TEXT,
+		method TEXT NOT NULL,
+		result TEXT NOT NULL,
+		document TEXT NOT NULL,
+		sig_alg TEXT NOT NULL,
+		signature TEXT NOT NULL,
+		issued_at TEXT NOT NULL
+	);`
+	ddl2 := `CREATE INDEX IF NOT EXISTS wipe_certs_mac ON wipe_certs (mac, issued_at);`
+	for _, ddl := range []string{ddl1, ddl2} {
+		if _, err := db.Exec(ddl); err != nil { return err }
+	}
+	return nil
+}
+
+// signWipeDocument signs doc, returning the algorithm name and signature.
+// Ed25519 keys sign the document itself; RSA and ECDSA keys its SHA-256.
+func (s *Server) signWipeDocument(doc []byte) (string, string, error) {
+	if ca, key, err := loadCA(); err == nil {
+		var sig []byte
+		if _, ok := key.Public().(ed25519.PublicKey); ok {
+			sig, err = key.Sign(crand.Reader, doc, crypto.Hash(0))
+		} else {
+			digest := sha256.Sum256(doc)
+			sig, err = key.Sign(crand.Reader, digest[:], crypto.SHA256)
+		}
+		if err != nil { return "", "", err }
+		return "x509:" + ca.SignatureAlgorithm.String(), base64.StdEncoding.EncodeToString(sig), nil
+	}
+	mac := hmac.New(sha256.New, s.encryptionKey())
+	mac.Write(doc)
+	return "hmac-sha256", hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyWipeDocument checks a stored signature against the current key.
+func (s *Server) verifyWipeDocument(doc []byte, alg, sig string) bool {
+	if alg == "hmac-sha256" {
+		mac := hmac.New(sha256.New, s.encryptionKey())
+		mac.Write(doc)
+		want, err := hex.DecodeString(sig)
+		return err == nil && hmac.Equal(mac.Sum(nil), want)
+	}
+	ca, _, err := loadCA()
+	if err != nil { return false }
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil { return false }
+	digest := sha256.Sum256(doc)
+	switch pub := ca.PublicKey.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, doc, raw)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], raw) == nil
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(pub, digest[:], raw)
+	}
+	return false
+}
+
+func (s *Server) wipeRoutes() {
+	s.Mux.HandleFunc("/api/v1/agent/wipe", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+		if !s.requireAgent(w, r) { return }
+		var rep WipeReport
+		if !decodeJSON(w, r, &rep) { return }
+		rep.MAC = normalizeMAC(rep.MAC)
+		if rep.MAC == "" { http.Error(w, "mac required", 400); return }
+		if !wipeMethods[rep.Method] { http.Error(w, "invalid method", 400); return }
+		if rep.Result != "success" && rep.Result != "failed" { http.Error(w, "result must be success or failed", 400); return }
+		if !s.requireAgentFor(w, r, rep.MAC) { return }
+		// only a deployment's own token can tie the certificate to it
+		rep.DeploymentID, _ = s.deploymentForAgentToken(r.Header.Get("X-Bootah-Agent-Token"))
+		id := "wipe-" + genID()
+		now := time.Now().UTC().Format(time.RFC3339)
+		doc, _ := json.Marshal(map[string]any{"certificate_id": id, "issued_at": now, "issuer": getenv("BOOTAH_PUBLIC_URL", "bootah"), "report": rep})
+		alg, sig, err := s.signWipeDocument(doc)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		_, err = s.DB.Exec(`INSERT INTO wipe_certs (id, mac, deployment_id, disk_serial, method, result, document, sig_alg, signature, issued_at) VALUES (?,?,?,?,?,?,?,?,?,?)`,
+			id, rep.MAC, rep.DeploymentID, rep.Disk.Serial, rep.Method, rep.Result, string(doc), alg, sig, now)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		s.audit(nil, "wipe", "machine", map[string]any{"mac": rep.MAC, "certificate_id": id, "method": rep.Method, "disk_serial": rep.Disk.Serial, "result": rep.Result})
+		if rep.Result != "success" {
+			s.notify("error", "wipe_failed", "Secure wipe failed on "+rep.MAC, map[string]any{"mac": rep.MAC, "certificate_id": id, "detail": rep.Detail})
+		}
+		writeJSON(w, 201, map[string]any{"certificate_id": id})
+	})
+
+	// Wipe certificates, newest first (?mac= to filter)
+	s.Mux.HandleFunc("/api/v1/admin/wipes", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		q := `SELECT id, mac, COALESCE(deployment_id,''), COALESCE(disk_serial,''), method, result, issued_at FROM wipe_certs`
+		var args []any
+		if mac := normalizeMAC(r.URL.Query().Get("mac")); mac != "" { q += ` WHERE mac=?`; args = append(args, mac) }
+		rows, err := s.DB.Query(q+` ORDER BY issued_at DESC LIMIT 500`, args...)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		defer rows.Close()
+		var out []map[string]any
+		for rows.Next() {
+			var id, mac, dep, serial, method, result, issued string
+			if err := rows.Scan(&id, &mac, &dep, &serial, &method, &result, &issued); err != nil { http.Error(w, err.Error(), 500); return }
+			out = append(out, map[string]any{"id": id, "mac": mac, "deployment_id": dep, "disk_serial": serial, "method": method, "result": result, "issued_at": issued})
+		}
+		writeJSON(w, 200, out)
+	})
+
+	// Full signed certificate with a verification result
+	s.Mux.HandleFunc("/api/v1/admin/wipes/certificate", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		var doc, alg, sig string
+		err := s.DB.QueryRow(`SELECT document, sig_alg, signature FROM wipe_certs WHERE id=?`, r.URL.Query().Get("id")).Scan(&doc, &alg, &sig)
+		if err != nil {
+			if err == sql.ErrNoRows { http.NotFound(w, r); return }
+			http.Error(w, err.Error(), 500); return
+		}
+		writeJSON(w, 200, map[string]any{"document": json.RawMessage(doc), "sig_alg": alg, "signature": sig, "valid": s.verifyWipeDocument([]byte(doc), alg, sig)})
+	})
+}
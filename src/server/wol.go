@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ---- Wake-on-LAN ----
+// POST /api/v1/machines/{id}/wake sends a magic packet for one machine, and
+// rollouts wake each machine of a wave the same way. The packet goes to
+// the body's "broadcast" address (host[:port], e.g. a routed subnet's
+// directed broadcast) or out of relay "relay". Without either, it goes
+// through the online relay of the site holding the machine's last boot
+// address, or else to BOOTAH_WOL_BROADCAST (default 255.255.255.255:9).
+// Relays poll GET /api/v1/relay/wake for the packets queued for them.
+//
+// Wake schedules wake every member of a machine group at run_at, once or
+// repeating daily, on weekdays or weekly, pacing packets stagger_ms apart so
+// a lab does not power on at once. POST /api/v1/wake_schedules/{id}/run
+// starts one immediately.
+type wakeOptions struct {
+	Broadcast string `json:"broadcast"`
+	Relay     string `json:"relay"`
+}
+
+func (o *wakeOptions) validateFields(v *validator) {
+	if o.Broadcast != "" {
+		if _, err := wakeAddr(o.Broadcast); err != nil { v.add("broadcast", "must be an IP address with an optional port") }
+	}
+	if o.Broadcast != "" && o.Relay != "" { v.add("relay", "cannot be combined with broadcast") }
+}
+
+type WakeSchedule struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	GroupID    string `json:"group_id"`
+	RunAt      string `json:"run_at"`           // next run, RFC 3339
+	Repeat     string `json:"repeat,omitempty"` // ""|daily|weekdays|weekly
+	StaggerMS  int    `json:"stagger_ms"`
+	Broadcast  string `json:"broadcast,omitempty"`
+	Relay      string `json:"relay,omitempty"`
+	Enabled    bool   `json:"enabled"`
+	LastRunAt  string `json:"last_run_at,omitempty"`
+	LastResult string `json:"last_result,omitempty"`
+	CreatedAt  string `json:"created_at"`
+}
+
+func (ws *WakeSchedule) validateFields(v *validator) {
+	v.required("name", ws.Name)
+	v.required("group_id", ws.GroupID)
+	if v.required("run_at", ws.RunAt) {
+		if _, err := time.Parse(time.RFC3339, ws.RunAt); err != nil { v.add("run_at", "must be an RFC 3339 time") }
+	}
+	if ws.Repeat != "" { v.oneOf("repeat", ws.Repeat, "daily", "weekdays", "weekly") }
+	if ws.StaggerMS < 0 || ws.StaggerMS > 60000 { v.add("stagger_ms", "must be 0-60000") }
+	o := wakeOptions{Broadcast: ws.Broadcast, Relay: ws.Relay}
+	o.validateFields(v)
+}
+
+func initWake(db *sql.DB) error {
+	ddl1 := `CREATE TABLE IF NOT EXISTS wol_requests (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		relay_id TEXT NOT NULL,
+		mac TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		sent_at TEXT
+	);`
+	ddl2 := `CREATE TABLE IF NOT EXISTS wake_schedules (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		group_id TEXT NOT NULL,
+		run_at TEXT NOT NULL,
+		recurrence TEXT,
+		stagger_ms INTEGER NOT NULL DEFAULT 100,
+		broadcast TEXT,
+		relay_id TEXT,
+		enabled INTEGER NOT NULL DEFAULT 1,
+		last_run_at TEXT,
+		last_result TEXT,
+		created_by INTEGER,
+		created_at TEXT NOT NULL
+	);`
+	for _, ddl := range []string{ddl1, ddl2} {
+		if _, err := db.Exec(ddl); err != nil { return err }
+	}
+	return nil
+}
+
+// wakeAddr resolves a broadcast address, defaulting the port to 9 (discard).
+func wakeAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil { host, port = addr, "9" }
+	if net.ParseIP(host) == nil { return "", fmt.Errorf("invalid broadcast address %q", addr) }
+	return net.JoinHostPort(host, port), nil
+}
+
+// sendWake broadcasts a Wake-on-LAN magic packet for mac to addr.
+func sendWake(mac, addr string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil { return err }
+	pkt := make([]byte, 0, 102)
+	pkt = append(pkt, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	for i := 0; i < 16; i++ { pkt = append(pkt, hw...) }
+	conn, err := net.Dial("udp", addr)
+	if err != nil { return err }
+	defer conn.Close()
+	_, err = conn.Write(pkt)
+	return err
+}
+
+// siteRelay returns the online relay of the site containing the machine's
+// last boot address, or "".
+func (s *Server) siteRelay(mac string) string {
+	var ip string
+	if s.DB.QueryRow(`SELECT COALESCE(last_boot_ip,'') FROM machines WHERE mac=?`, mac).Scan(&ip) != nil || ip == "" { return "" }
+	site, err := s.siteForIP(net.ParseIP(ip))
+	if err != nil || site == nil { return "" }
+	var id string
+	err = s.DB.QueryRow(`SELECT id FROM relays WHERE site_id=? AND key_hash IS NOT NULL AND last_seen > ? ORDER BY last_seen DESC LIMIT 1`,
+		site.ID, time.Now().UTC().Add(-relayOfflineAfter).Format(time.RFC3339)).Scan(&id)
+	if err != nil { return "" }
+	return id
+}
+
+// wakeMachine sends or queues the magic packet for mac and describes the
+// route it took.
+func (s *Server) wakeMachine(mac string, o wakeOptions) (string, error) {
+	relay := o.Relay
+	if o.Broadcast == "" && relay == "" { relay = s.siteRelay(mac) }
+	if relay != "" {
+		var n int
+		_ = s.DB.QueryRow(`SELECT COUNT(*) FROM relays WHERE id=?`, relay).Scan(&n)
+		if n == 0 { return "", fmt.Errorf("unknown relay %s", relay) }
+		_, err := s.DB.Exec(`INSERT INTO wol_requests (relay_id, mac, created_at) VALUES (?,?,?)`, relay, mac, time.Now().UTC().Format(time.RFC3339))
+		return "relay " + relay, err
+	}
+	addr := o.Broadcast
+	if addr == "" { addr = getenv("BOOTAH_WOL_BROADCAST", "255.255.255.255:9") }
+	addr, err := wakeAddr(addr)
+	if err != nil { return "", err }
+	return "broadcast " + addr, sendWake(mac, addr)
+}
+
+const wakeScheduleColumns = `id, name, group_id, run_at, COALESCE(recurrence,''), stagger_ms, COALESCE(broadcast,''), COALESCE(relay_id,''), enabled,
+	COALESCE(last_run_at,''), COALESCE(last_result,''), created_at`
+
+func scanWakeSchedule(row interface{ Scan(...any) error }) (*WakeSchedule, error) {
+	var ws WakeSchedule
+	err := row.Scan(&ws.ID, &ws.Name, &ws.GroupID, &ws.RunAt, &ws.Repeat, &ws.StaggerMS, &ws.Broadcast, &ws.Relay, &ws.Enabled,
+		&ws.LastRunAt, &ws.LastResult, &ws.CreatedAt)
+	return &ws, err
+}
+
+// nextWakeRun advances a repeating schedule past now; "" ends a one-off.
+func nextWakeRun(runAt time.Time, repeat string, now time.Time) string {
+	if repeat == "" { return "" }
+	t := runAt.Local()
+	for !t.After(now) || (repeat == "weekdays" && (t.Weekday() == time.Saturday || t.Weekday() == time.Sunday)) {
+		if repeat == "weekly" { t = t.AddDate(0, 0, 7) } else { t = t.AddDate(0, 0, 1) }
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// runWakeSchedule wakes every member of the schedule's group, pacing the
+// packets, and records the outcome.
+func (s *Server) runWakeSchedule(ctx context.Context, ws *WakeSchedule) {
+	macs, err := s.groupMembers(ws.GroupID)
+	if errors.Is(err, sql.ErrNoRows) { err = fmt.Errorf("machine group %s no longer exists", ws.GroupID) }
+	sent, failed := 0, 0
+	if err == nil {
+		for i, mac := range macs {
+			if i > 0 && ws.StaggerMS > 0 {
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Duration(ws.StaggerMS) * time.Millisecond):
+				}
+			}
+			if ctx.Err() != nil { break }
+			if _, err := s.wakeMachine(mac, wakeOptions{Broadcast: ws.Broadcast, Relay: ws.Relay}); err != nil {
+				failed++
+				log.Printf("wake schedule %s: %s: %v", ws.ID, mac, err)
+				continue
+			}
+			sent++
+		}
+	}
+	result := fmt.Sprintf("woke %d of %d machines", sent, len(macs))
+	if failed > 0 { result += fmt.Sprintf(", %d failed", failed) }
+	if err != nil { result = "failed: " + err.Error() }
+	_, _ = s.DB.Exec(`UPDATE wake_schedules SET last_result=? WHERE id=?`, result, ws.ID)
+	s.audit(nil, "run", "wake_schedule", map[string]any{"id": ws.ID, "group_id": ws.GroupID, "machines": len(macs), "sent": sent, "failed": failed})
+	level := "info"
+	if err != nil || failed > 0 { level = "warning" }
+	s.notify(level, "wake_schedule", "Wake schedule "+ws.Name+": "+result, map[string]any{"schedule_id": ws.ID, "group_id": ws.GroupID})
+}
+
+// startWakeRun claims a schedule run (so only one node fires it), moves a
+// repeating schedule to its next time and wakes the group in the background.
+func (s *Server) startWakeRun(ctx context.Context, ws *WakeSchedule, due bool) bool {
+	now := time.Now().UTC()
+	runAt, _ := time.Parse(time.RFC3339, ws.RunAt)
+	next, enabled := ws.RunAt, ws.Enabled
+	if due {
+		if next = nextWakeRun(runAt, ws.Repeat, now); next == "" { next, enabled = ws.RunAt, false }
+	}
+	res, err := s.DB.Exec(`UPDATE wake_schedules SET run_at=?, enabled=?, last_run_at=?, last_result='running' WHERE id=? AND run_at=?`,
+		next, enabled, now.Format(time.RFC3339), ws.ID, ws.RunAt)
+	if err != nil { log.Printf("wake schedule %s: %v", ws.ID, err); return false }
+	if n, _ := res.RowsAffected(); n == 0 { return false }
+	ws.RunAt, ws.Enabled, ws.LastRunAt, ws.LastResult = next, enabled, now.Format(time.RFC3339), "running"
+	go s.runWakeSchedule(ctx, ws)
+	return true
+}
+
+func (s *Server) startWakeSchedules(ctx context.Context) {
+	go s.runAsLeader(ctx, "wake_schedules", 30*time.Second, func() {
+		rows, err := s.DB.Query(`SELECT `+wakeScheduleColumns+` FROM wake_schedules WHERE enabled=1 AND run_at <= ?`, time.Now().UTC().Format(time.RFC3339))
+		if err != nil { log.Printf("wake schedules: %v", err); return }
+		var due []*WakeSchedule
+		for rows.Next() {
+			if ws, err := scanWakeSchedule(rows); err == nil { due = append(due, ws) }
+		}
+		rows.Close()
+		for _, ws := range due { s.startWakeRun(ctx, ws, true) }
+	})
+}
+
+// handleMachineWake serves POST /api/v1/machines/{id}/wake.
+func (s *Server) handleMachineWake(w http.ResponseWriter, r *http.Request, mac string) {
+	if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+	var body wakeOptions
+	if r.ContentLength != 0 && !decodeJSON(w, r, &body) { return }
+	via, err := s.wakeMachine(mac, body)
+	if err != nil { http.Error(w, "wake: "+err.Error(), 502); return }
+	s.audit(s.actorID(r), "wake", "machine", map[string]any{"mac": mac, "via": via})
+	writeJSON(w, 202, map[string]any{"mac": mac, "via": via})
+}
+
+func (s *Server) wakeRoutes() {
+	// GET lists schedules; POST {name, group_id, run_at, repeat?, stagger_ms?,
+	// broadcast?, relay?} creates one
+	s.Mux.HandleFunc("/api/v1/wake_schedules", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := s.DB.Query(`SELECT ` + wakeScheduleColumns + ` FROM wake_schedules ORDER BY run_at`)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			defer rows.Close()
+			out := []*WakeSchedule{}
+			for rows.Next() {
+				ws, err := scanWakeSchedule(rows)
+				if err != nil { http.Error(w, err.Error(), 500); return }
+				out = append(out, ws)
+			}
+			writeJSON(w, 200, out)
+		case http.MethodPost:
+			ws := WakeSchedule{StaggerMS: 100}
+			if !decodeJSON(w, r, &ws) { return }
+			if err := s.checkWakeSchedule(&ws); err != nil { badRequest(w, err); return }
+			ws.ID, ws.Enabled, ws.CreatedAt = "wake-"+genID(), true, time.Now().UTC().Format(time.RFC3339)
+			_, err := s.DB.Exec(`INSERT INTO wake_schedules (id, name, group_id, run_at, recurrence, stagger_ms, broadcast, relay_id, enabled, created_by, created_at)
+				VALUES (?,?,?,?,NULLIF(?,''),?,NULLIF(?,''),NULLIF(?,''),1,?,?)`,
+				ws.ID, ws.Name, ws.GroupID, ws.RunAt, ws.Repeat, ws.StaggerMS, ws.Broadcast, ws.Relay, s.actorID(r), ws.CreatedAt)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "create", "wake_schedule", map[string]any{"id": ws.ID, "name": ws.Name, "group_id": ws.GroupID, "run_at": ws.RunAt, "repeat": ws.Repeat})
+			writeJSON(w, 201, ws)
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// /api/v1/wake_schedules/{id}: GET, PUT (replace; "enabled" pauses it),
+	// DELETE; POST .../run wakes the group now
+	s.Mux.HandleFunc("/api/v1/wake_schedules/", func(w http.ResponseWriter, r *http.Request) {
+		if !s.requireRole(w, r, "operator") { return }
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/wake_schedules/"), "/")
+		if len(parts) > 2 || (len(parts) == 2 && parts[1] != "run") { http.NotFound(w, r); return }
+		ws, err := scanWakeSchedule(s.DB.QueryRow(`SELECT `+wakeScheduleColumns+` FROM wake_schedules WHERE id=?`, parts[0]))
+		if errors.Is(err, sql.ErrNoRows) { http.NotFound(w, r); return }
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		if len(parts) == 2 {
+			if r.Method != http.MethodPost { http.Error(w, "method not allowed", 405); return }
+			if !s.startWakeRun(context.Background(), ws, false) { http.Error(w, "schedule changed, try again", 409); return }
+			s.audit(s.actorID(r), "run_now", "wake_schedule", map[string]any{"id": ws.ID})
+			writeJSON(w, 202, ws)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, 200, ws)
+		case http.MethodPut:
+			body := WakeSchedule{StaggerMS: 100, Enabled: true}
+			if !decodeJSON(w, r, &body) { return }
+			if err := s.checkWakeSchedule(&body); err != nil { badRequest(w, err); return }
+			_, err := s.DB.Exec(`UPDATE wake_schedules SET name=?, group_id=?, run_at=?, recurrence=NULLIF(?,''), stagger_ms=?, broadcast=NULLIF(?,''), relay_id=NULLIF(?,''), enabled=? WHERE id=?`,
+				body.Name, body.GroupID, body.RunAt, body.Repeat, body.StaggerMS, body.Broadcast, body.Relay, body.Enabled, ws.ID)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+			body.ID, body.LastRunAt, body.LastResult, body.CreatedAt = ws.ID, ws.LastRunAt, ws.LastResult, ws.CreatedAt
+			s.audit(s.actorID(r), "update", "wake_schedule", map[string]any{"id": ws.ID, "name": body.Name, "group_id": body.GroupID, "run_at": body.RunAt, "repeat": body.Repeat, "enabled": body.Enabled})
+			writeJSON(w, 200, body)
+		case http.MethodDelete:
+			if _, err := s.DB.Exec(`DELETE FROM wake_schedules WHERE id=?`, ws.ID); err != nil { http.Error(w, err.Error(), 500); return }
+			s.audit(s.actorID(r), "delete", "wake_schedule", map[string]any{"id": ws.ID})
+			writeJSON(w, 200, map[string]any{"deleted": ws.ID})
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	})
+
+	// relays collect the packets queued for their segment
+	s.Mux.HandleFunc("/api/v1/relay/wake", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet { http.Error(w, "method not allowed", 405); return }
+		id, ok := s.requireRelay(w, r)
+		if !ok { return }
+		now := time.Now().UTC()
+		_, _ = s.DB.Exec(`UPDATE relays SET last_seen=? WHERE id=?`, now.Format(time.RFC3339), id)
+		// packets older than ten minutes would wake machines nobody expects
+		_, _ = s.DB.Exec(`DELETE FROM wol_requests WHERE relay_id=? AND sent_at IS NULL AND created_at < ?`, id, now.Add(-10*time.Minute).Format(time.RFC3339))
+		_, _ = s.DB.Exec(`DELETE FROM wol_requests WHERE sent_at < ?`, now.AddDate(0, 0, -1).Format(time.RFC3339))
+		rows, err := s.DB.Query(`SELECT id, mac FROM wol_requests WHERE relay_id=? AND sent_at IS NULL ORDER BY id`, id)
+		if err != nil { http.Error(w, err.Error(), 500); return }
+		var ids []any
+		macs := []string{}
+		for rows.Next() {
+			var rid int64
+			var mac string
+			if rows.Scan(&rid, &mac) == nil { ids, macs = append(ids, rid), append(macs, mac) }
+		}
+		rows.Close()
+		if len(ids) > 0 {
+			_, err := s.DB.Exec(`UPDATE wol_requests SET sent_at=? WHERE id IN (`+strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")+`)`, append([]any{now.Format(time.RFC3339)}, ids...)...)
+			if err != nil { http.Error(w, err.Error(), 500); return }
+		}
+		writeJSON(w, 200, map[string]any{"wake": macs})
+	})
+}
+
+// checkWakeSchedule validates the parts of a schedule that need the database.
+func (s *Server) checkWakeSchedule(ws *WakeSchedule) error {
+	var v validator
+	var n int
+	_ = s.DB.QueryRow(`SELECT COUNT(*) FROM machine_groups WHERE id=?`, ws.GroupID).Scan(&n)
+	if n == 0 { v.add("group_id", "unknown machine group") }
+	if ws.Relay != "" {
+		_ = s.DB.QueryRow(`SELECT COUNT(*) FROM relays WHERE id=?`, ws.Relay).Scan(&n)
+		if n == 0 { v.add("relay", "unknown relay") }
+	}
+	if t, err := time.Parse(time.RFC3339, ws.RunAt); err == nil { ws.RunAt = t.UTC().Format(time.RFC3339) }
+	return v.err()
+}